@@ -0,0 +1,152 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	DriftDetectionConfigKind = "DriftDetectionConfig"
+
+	// DriftDetectionConfigName is the name of the only DriftDetectionConfig
+	// instance considered by drift-detection-manager
+	DriftDetectionConfigName = "default"
+
+	// PermissionsGrantedCondition reports whether drift-detection-manager can get, list and
+	// watch all tracked GVKs. Without those permissions, drift of resources cannot be detected.
+	PermissionsGrantedCondition = "PermissionsGranted"
+
+	// DeniedKindsCondition reports whether any ResourceSummary lists resources whose kind is
+	// denied (see --denied-kinds). Those resources are never tracked.
+	DeniedKindsCondition = "DeniedKinds"
+)
+
+// DriftDetectionConfigSpec defines the runtime tuning of drift-detection-manager.
+// Any field not set falls back to the value passed via command line flags.
+type DriftDetectionConfigSpec struct {
+	// EvaluationInterval is the interval at which queued resources are evaluated
+	// for configuration drift.
+	// +optional
+	EvaluationInterval *metav1.Duration `json:"evaluationInterval,omitempty"`
+
+	// DriftConfirmations is the number of consecutive evaluations which must find
+	// a resource drifted before drift is reported.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	DriftConfirmations *int32 `json:"driftConfirmations,omitempty"`
+
+	// MaxPollingInterval, when greater than polling interval, is the maximum interval at
+	// which resources evaluated by polling, and not changing, are evaluated.
+	// Only applies in polling mode, to resources of GVKs whose watcher was stopped because
+	// memory budget was exceeded: watched resources are evaluated as they change.
+	// +optional
+	MaxPollingInterval *metav1.Duration `json:"maxPollingInterval,omitempty"`
+
+	// DiscoveryCacheTTL is how long discovery results are cached.
+	// +optional
+	DiscoveryCacheTTL *metav1.Duration `json:"discoveryCacheTTL,omitempty"`
+
+	// KindEvaluationIntervals overrides, per kind, the interval at which resources
+	// are evaluated. When set, it replaces the list passed via command line flags.
+	// +optional
+	KindEvaluationIntervals []KindEvaluationInterval `json:"kindEvaluationIntervals,omitempty"`
+
+	// ExcludedNamespaces lists namespaces whose resources are never watched nor evaluated.
+	// When set, it replaces the list passed via command line flags.
+	// +optional
+	ExcludedNamespaces []string `json:"excludedNamespaces,omitempty"`
+}
+
+// KindEvaluationInterval is the interval at which resources of a given kind are evaluated
+type KindEvaluationInterval struct {
+	// Group of the resources. Empty for the core group.
+	// +optional
+	Group string `json:"group"`
+
+	// Kind of the resources
+	Kind string `json:"kind"`
+
+	// Interval at which resources of this kind are evaluated
+	Interval metav1.Duration `json:"interval"`
+}
+
+// DriftDetectionConfigStatus defines the observed state of DriftDetectionConfig
+type DriftDetectionConfigStatus struct {
+	// ObservedGeneration is the generation last applied by drift-detection-manager
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions contains the outcome of drift-detection-manager self-tests
+	// (see PermissionsGrantedCondition)
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// FIPSMode is set when drift-detection-manager runs in FIPS mode: all cryptography goes
+	// through a FIPS validated module
+	// +optional
+	FIPSMode bool `json:"fipsMode,omitempty"`
+
+	// LastOfflineWindow is the most recent period during which drift-detection-manager could not
+	// reach the API server. Drifts detected meanwhile were buffered and flushed afterwards.
+	// +optional
+	LastOfflineWindow *OfflineWindow `json:"lastOfflineWindow,omitempty"`
+}
+
+// OfflineWindow is a period during which drift-detection-manager could not reach the API server
+type OfflineWindow struct {
+	// Start is when API server was first found unreachable
+	Start metav1.Time `json:"start"`
+
+	// End is when API server was reachable again
+	// +optional
+	End *metav1.Time `json:"end,omitempty"`
+
+	// BufferedDrifts is the highest number of drifted resources whose ResourceSummaries
+	// could not be updated during the window
+	// +optional
+	BufferedDrifts int32 `json:"bufferedDrifts,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:path=driftdetectionconfigs,scope=Cluster
+//+kubebuilder:subresource:status
+
+// DriftDetectionConfig is the Schema for the driftdetectionconfigs API.
+// Only the instance named default is considered. Changes are applied without restart.
+type DriftDetectionConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DriftDetectionConfigSpec   `json:"spec,omitempty"`
+	Status DriftDetectionConfigStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// DriftDetectionConfigList contains a list of DriftDetectionConfig
+type DriftDetectionConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DriftDetectionConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DriftDetectionConfig{}, &DriftDetectionConfigList{})
+}
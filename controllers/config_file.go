@@ -0,0 +1,140 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+
+	driftdetectionv1alpha1 "github.com/projectsveltos/drift-detection-manager/api/v1alpha1"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// configFileCheckInterval is the interval at which config file is checked for changes.
+	// A mounted ConfigMap is updated by kubelet, so changes are detected without any signal.
+	configFileCheckInterval = 30 * time.Second
+)
+
+// configFile is the content of the file passed via --config-file
+type configFile struct {
+	// LogLevel sets log severity. Same values as DebuggingConfiguration (LogLevelInfo,
+	// LogLevelDebug, LogLevelVerbose). Whichever of the two changes last wins.
+	// +optional
+	LogLevel libsveltosv1alpha1.LogLevel `json:"logLevel,omitempty"`
+
+	driftdetectionv1alpha1.DriftDetectionConfigSpec `json:",inline"`
+}
+
+// WatchConfigFile loads settings from path and reloads them, without restart, on SIGHUP and
+// anytime file content changes (for instance when file is a mounted ConfigMap which is updated).
+// Settings in config file override the ones passed via command line flags. DriftDetectionConfig,
+// if present, overrides both. Blocks till ctx is cancelled.
+func WatchConfigFile(ctx context.Context, path string, logger logr.Logger) {
+	logger = logger.WithValues("configFile", path)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configFileCheckInterval)
+	defer ticker.Stop()
+
+	var loaded []byte
+	reload := func(force bool) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to read config file: %v", err))
+			return
+		}
+		if !force && loaded != nil && bytes.Equal(content, loaded) {
+			return
+		}
+		if err := applyConfigFile(content, logger); err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to apply config file: %v", err))
+			return
+		}
+		loaded = content
+	}
+
+	reload(true)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.V(logs.LogInfo).Info("SIGHUP received. Reloading config file.")
+			reload(true)
+		case <-ticker.C:
+			reload(false)
+		}
+	}
+}
+
+// applyConfigFile parses content and applies the settings it contains
+func applyConfigFile(content []byte, logger logr.Logger) error {
+	config := &configFile{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return errors.Wrap(err, "failed to parse config file")
+	}
+
+	if config.DriftConfirmations != nil && *config.DriftConfirmations < 1 {
+		return fmt.Errorf("driftConfirmations must be at least 1")
+	}
+
+	if config.LogLevel != "" {
+		if err := setLogLevel(config.LogLevel); err != nil {
+			return err
+		}
+	}
+
+	settings := settingsSources.setConfigFile(&config.DriftDetectionConfigSpec)
+	logger.V(logs.LogInfo).Info(fmt.Sprintf("applied settings %+v", settings))
+	return nil
+}
+
+func setLogLevel(logLevel libsveltosv1alpha1.LogLevel) error {
+	var severity int
+	switch logLevel {
+	case libsveltosv1alpha1.LogLevelNotSet, libsveltosv1alpha1.LogLevelInfo:
+		severity = logs.LogInfo
+	case libsveltosv1alpha1.LogLevelDebug:
+		severity = logs.LogDebug
+	case libsveltosv1alpha1.LogLevelVerbose:
+		severity = logs.LogVerbose
+	default:
+		return fmt.Errorf("unsupported logLevel %q", logLevel)
+	}
+
+	v := flag.Lookup("v")
+	if v == nil {
+		return fmt.Errorf("log verbosity flag not registered")
+	}
+	return v.Value.Set(strconv.Itoa(severity))
+}
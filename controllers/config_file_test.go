@@ -0,0 +1,72 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/klog/v2/textlogger"
+
+	driftdetectionv1alpha1 "github.com/projectsveltos/drift-detection-manager/api/v1alpha1"
+	"github.com/projectsveltos/drift-detection-manager/controllers"
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+var _ = Describe("Config file", func() {
+	var flagSettings driftdetection.RuntimeSettings
+
+	BeforeEach(func() {
+		flagSettings = driftdetection.RuntimeSettings{
+			EvaluationInterval: time.Minute,
+			DriftConfirmations: 1,
+			DiscoveryCacheTTL:  10 * time.Minute,
+		}
+		controllers.SetFlagRuntimeSettings(flagSettings)
+	})
+
+	AfterEach(func() {
+		controllers.SetFlagRuntimeSettings(driftdetection.RuntimeSettings{})
+		controllers.ResetRuntimeSettingsSources()
+	})
+
+	It("applyConfigFile overrides flags and is overridden by DriftDetectionConfig", func() {
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		Expect(controllers.ApplyConfigFile([]byte("evaluationInterval: 10s\ndriftConfirmations: 3\n"),
+			logger)).To(Succeed())
+		settings := driftdetection.GetRuntimeSettings()
+		Expect(settings.EvaluationInterval).To(Equal(10 * time.Second))
+		Expect(settings.DriftConfirmations).To(Equal(uint(3)))
+		Expect(settings.DiscoveryCacheTTL).To(Equal(flagSettings.DiscoveryCacheTTL))
+
+		confirmations := int32(5)
+		controllers.SetDriftDetectionConfigSettings(&driftdetectionv1alpha1.DriftDetectionConfigSpec{
+			DriftConfirmations: &confirmations,
+		})
+		settings = driftdetection.GetRuntimeSettings()
+		Expect(settings.EvaluationInterval).To(Equal(10 * time.Second))
+		Expect(settings.DriftConfirmations).To(Equal(uint(5)))
+
+		// Invalid content is rejected and current settings are kept
+		Expect(controllers.ApplyConfigFile([]byte("unknownField: true\n"), logger)).ToNot(Succeed())
+		Expect(controllers.ApplyConfigFile([]byte("logLevel: LogLevelUnknown\n"), logger)).ToNot(Succeed())
+		Expect(driftdetection.GetRuntimeSettings().DriftConfirmations).To(Equal(uint(5)))
+	})
+})
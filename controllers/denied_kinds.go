@@ -0,0 +1,114 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// deniedKindsByResourceSummary contains, per ResourceSummary, the denied kinds (see
+// driftdetection.SetDeniedKinds) it lists. It is reported in DriftDetectionConfig status.
+var deniedKindsByResourceSummary = &deniedKindsTracker{
+	kinds: make(map[types.NamespacedName][]string),
+}
+
+type deniedKindsTracker struct {
+	mu    sync.Mutex
+	kinds map[types.NamespacedName][]string
+}
+
+// set records the denied kinds resourceSummary lists. Empty kinds forgets resourceSummary.
+func (t *deniedKindsTracker) set(resourceSummary types.NamespacedName, kinds []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(kinds) == 0 {
+		delete(t.kinds, resourceSummary)
+		return
+	}
+	t.kinds[resourceSummary] = kinds
+}
+
+// describe returns, sorted, the ResourceSummaries listing denied kinds along with those kinds
+func (t *deniedKindsTracker) describe() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]string, 0, len(t.kinds))
+	for resourceSummary, kinds := range t.kinds {
+		result = append(result, fmt.Sprintf("%s (%s)", resourceSummary, strings.Join(kinds, ", ")))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// skipDeniedKinds returns the resources whose kind is not denied (see driftdetection.SetDeniedKinds)
+// and the denied kinds found
+func skipDeniedKinds(resources []libsveltosv1alpha1.Resource) (allowed []libsveltosv1alpha1.Resource, denied []string) {
+	allowed = make([]libsveltosv1alpha1.Resource, 0, len(resources))
+	denied = make([]string, 0)
+	for i := range resources {
+		gk := schema.GroupKind{Group: resources[i].Group, Kind: resources[i].Kind}
+		if driftdetection.IsKindDenied(gk) {
+			denied = append(denied, gk.String())
+			continue
+		}
+		allowed = append(allowed, resources[i])
+	}
+	return allowed, denied
+}
+
+// reportDeniedKinds records the denied kinds resourceSummary lists, so that they are surfaced in
+// DriftDetectionConfig status, and reports them via a warning event on resourceSummary
+func (r *ResourceSummaryReconciler) reportDeniedKinds(resourceSummary *libsveltosv1alpha1.ResourceSummary,
+	logger logr.Logger, denied ...string) {
+
+	kinds := make([]string, 0, len(denied))
+	seen := make(map[string]bool, len(denied))
+	for i := range denied {
+		if !seen[denied[i]] {
+			seen[denied[i]] = true
+			kinds = append(kinds, denied[i])
+		}
+	}
+	sort.Strings(kinds)
+
+	deniedKindsByResourceSummary.set(types.NamespacedName{Namespace: resourceSummary.Namespace,
+		Name: resourceSummary.Name}, kinds)
+
+	if len(kinds) == 0 {
+		return
+	}
+
+	msg := fmt.Sprintf("resources of denied kinds are not tracked: %s", strings.Join(kinds, ", "))
+	logger.V(logs.LogInfo).Info(msg)
+	if r.Recorder != nil {
+		r.Recorder.Event(resourceSummary, corev1.EventTypeWarning, "DeniedKind", msg)
+	}
+}
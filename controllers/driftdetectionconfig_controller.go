@@ -0,0 +1,191 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	driftdetectionv1alpha1 "github.com/projectsveltos/drift-detection-manager/api/v1alpha1"
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/features"
+	"github.com/projectsveltos/drift-detection-manager/pkg/fips"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// permissionsConditionRefresh is how often PermissionsGrantedCondition is refreshed
+	permissionsConditionRefresh = 5 * time.Minute
+)
+
+// DriftDetectionConfigReconciler reconciles the DriftDetectionConfig instance named default.
+// Settings in its Spec are applied to drift detection without restart. Any setting not
+// in Spec (or all, when instance does not exist) falls back to the value passed via config
+// file or flags (see SetFlagRuntimeSettings).
+// Its Status reports whether drift-detection-manager lacks permissions on tracked resources.
+type DriftDetectionConfigReconciler struct {
+	client.Client
+}
+
+//+kubebuilder:rbac:groups=driftdetection.projectsveltos.io,resources=driftdetectionconfigs,verbs=get;list;watch
+//+kubebuilder:rbac:groups=driftdetection.projectsveltos.io,resources=driftdetectionconfigs/status,verbs=get;update;patch
+
+func (r *DriftDetectionConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := ctrl.LoggerFrom(ctx)
+	logger.V(logs.LogInfo).Info("Reconciling")
+
+	config := &driftdetectionv1alpha1.DriftDetectionConfig{}
+	err := r.Get(ctx, req.NamespacedName, config)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			logger.V(logs.LogInfo).Info("DriftDetectionConfig not found. Using default settings.")
+			settingsSources.setDriftDetectionConfig(nil)
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, errors.Wrapf(err, "Failed to fetch DriftDetectionConfig %s", req.NamespacedName)
+	}
+
+	settings := settingsSources.setDriftDetectionConfig(&config.Spec)
+	logger.V(logs.LogInfo).Info(fmt.Sprintf("applied settings %+v", settings))
+
+	statusChanged := setPermissionsCondition(config)
+	statusChanged = setDeniedKindsCondition(config) || statusChanged
+	if config.Status.ObservedGeneration != config.Generation {
+		config.Status.ObservedGeneration = config.Generation
+		statusChanged = true
+	}
+	if config.Status.FIPSMode != fips.Enabled() {
+		config.Status.FIPSMode = fips.Enabled()
+		statusChanged = true
+	}
+	statusChanged = setLastOfflineWindow(config) || statusChanged
+
+	if statusChanged {
+		if err := r.Status().Update(ctx, config); err != nil {
+			return reconcile.Result{}, errors.Wrap(err, "failed to update DriftDetectionConfig status")
+		}
+	}
+
+	// Permissions are verified periodically. Refresh condition accordingly.
+	return reconcile.Result{RequeueAfter: permissionsConditionRefresh}, nil
+}
+
+// setPermissionsCondition sets PermissionsGrantedCondition from the outcome of last permission
+// checks (see driftdetection.GetMissingRules). Returns true if condition changed.
+func setPermissionsCondition(config *driftdetectionv1alpha1.DriftDetectionConfig) bool {
+	condition := metav1.Condition{
+		Type:               driftdetectionv1alpha1.PermissionsGrantedCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Granted",
+		Message:            "get, list and watch are allowed on all tracked resources",
+		ObservedGeneration: config.Generation,
+	}
+	if !features.Enabled(features.PermissionSelfTest) {
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "NotVerified"
+		condition.Message = fmt.Sprintf("%s feature gate is disabled", features.PermissionSelfTest)
+	} else if rules := driftdetection.GetMissingRules(); len(rules) != 0 {
+		missing := make([]string, len(rules))
+		for i := range rules {
+			missing[i] = rules[i].String()
+		}
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "MissingPermissions"
+		condition.Message = fmt.Sprintf("drift cannot be detected for all tracked resources. Missing RBAC rules: %s",
+			strings.Join(missing, "; "))
+	}
+
+	return meta.SetStatusCondition(&config.Status.Conditions, condition)
+}
+
+// setDeniedKindsCondition sets DeniedKindsCondition from the ResourceSummaries listing resources
+// of denied kinds. Returns true if condition changed.
+func setDeniedKindsCondition(config *driftdetectionv1alpha1.DriftDetectionConfig) bool {
+	condition := metav1.Condition{
+		Type:               driftdetectionv1alpha1.DeniedKindsCondition,
+		Status:             metav1.ConditionFalse,
+		Reason:             "NoneDenied",
+		Message:            "no ResourceSummary lists resources of denied kinds",
+		ObservedGeneration: config.Generation,
+	}
+	if denied := deniedKindsByResourceSummary.describe(); len(denied) != 0 {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "ResourcesDenied"
+		condition.Message = fmt.Sprintf("resources of denied kinds are not tracked. ResourceSummaries: %s",
+			strings.Join(denied, "; "))
+	}
+
+	return meta.SetStatusCondition(&config.Status.Conditions, condition)
+}
+
+// setLastOfflineWindow sets LastOfflineWindow from the most recent period during which API
+// server was unreachable (see driftdetection.GetLastOfflineWindow). Returns true if it changed.
+func setLastOfflineWindow(config *driftdetectionv1alpha1.DriftDetectionConfig) bool {
+	window := driftdetection.GetLastOfflineWindow()
+	if window == nil {
+		return false
+	}
+
+	// Times are serialized with second precision
+	lastOfflineWindow := &driftdetectionv1alpha1.OfflineWindow{
+		Start:          metav1.NewTime(window.Start).Rfc3339Copy(),
+		BufferedDrifts: int32(window.BufferedDrifts),
+	}
+	if !window.End.IsZero() {
+		end := metav1.NewTime(window.End).Rfc3339Copy()
+		lastOfflineWindow.End = &end
+	}
+
+	current := config.Status.LastOfflineWindow
+	if current != nil && current.Start.Equal(&lastOfflineWindow.Start) &&
+		current.End.Equal(lastOfflineWindow.End) && current.BufferedDrifts == lastOfflineWindow.BufferedDrifts {
+
+		return false
+	}
+	config.Status.LastOfflineWindow = lastOfflineWindow
+	return true
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// Only the DriftDetectionConfig instance named default is considered.
+func (r *DriftDetectionConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	isDefault := predicate.NewPredicateFuncs(func(o client.Object) bool {
+		return o.GetName() == driftdetectionv1alpha1.DriftDetectionConfigName
+	})
+
+	_, err := ctrl.NewControllerManagedBy(mgr).
+		For(&driftdetectionv1alpha1.DriftDetectionConfig{},
+			builder.WithPredicates(isDefault, predicate.GenerationChangedPredicate{})).
+		Build(r)
+	if err != nil {
+		return errors.Wrap(err, "error creating controller")
+	}
+
+	return nil
+}
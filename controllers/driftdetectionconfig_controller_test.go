@@ -0,0 +1,127 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	driftdetectionv1alpha1 "github.com/projectsveltos/drift-detection-manager/api/v1alpha1"
+	"github.com/projectsveltos/drift-detection-manager/controllers"
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/fips"
+)
+
+var _ = Describe("DriftDetectionConfig controller", func() {
+	var flagSettings driftdetection.RuntimeSettings
+
+	BeforeEach(func() {
+		flagSettings = driftdetection.RuntimeSettings{
+			EvaluationInterval: time.Minute,
+			DriftConfirmations: 1,
+			DiscoveryCacheTTL:  10 * time.Minute,
+		}
+		controllers.SetFlagRuntimeSettings(flagSettings)
+		controllers.ResetRuntimeSettingsSources()
+	})
+
+	AfterEach(func() {
+		controllers.SetFlagRuntimeSettings(driftdetection.RuntimeSettings{})
+		controllers.ResetRuntimeSettingsSources()
+	})
+
+	It("applies changes to DriftDetectionConfig without restart and rejects invalid ones", func() {
+		reconciler := &controllers.DriftDetectionConfigReconciler{Client: testEnv.Client}
+		Expect(reconciler.SetupWithManager(testEnv.Manager)).To(Succeed())
+
+		interval := metav1.Duration{Duration: 10 * time.Second}
+		confirmations := int32(3)
+		config := &driftdetectionv1alpha1.DriftDetectionConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: driftdetectionv1alpha1.DriftDetectionConfigName},
+			Spec: driftdetectionv1alpha1.DriftDetectionConfigSpec{
+				EvaluationInterval: &interval,
+				DriftConfirmations: &confirmations,
+			},
+		}
+		Expect(testEnv.Create(ctx, config)).To(Succeed())
+		Expect(waitForObject(ctx, testEnv.Client, config)).To(Succeed())
+
+		Eventually(func() bool {
+			settings := driftdetection.GetRuntimeSettings()
+			return settings.EvaluationInterval == interval.Duration && settings.DriftConfirmations == uint(3)
+		}, timeout, pollingInterval).Should(BeTrue())
+		// Settings not in DriftDetectionConfig fall back to flags
+		Expect(driftdetection.GetRuntimeSettings().DiscoveryCacheTTL).To(Equal(flagSettings.DiscoveryCacheTTL))
+
+		Eventually(func() bool {
+			current := &driftdetectionv1alpha1.DriftDetectionConfig{}
+			if err := testEnv.Get(ctx, client.ObjectKeyFromObject(config), current); err != nil {
+				return false
+			}
+			return current.Status.ObservedGeneration == current.Generation
+		}, timeout, pollingInterval).Should(BeTrue())
+
+		// Status reports crypto mode
+		current := &driftdetectionv1alpha1.DriftDetectionConfig{}
+		Expect(testEnv.Get(ctx, client.ObjectKeyFromObject(config), current)).To(Succeed())
+		Expect(current.Status.FIPSMode).To(Equal(fips.Enabled()))
+
+		// A change reaches the running manager
+		current.Spec.EvaluationInterval = &metav1.Duration{Duration: 20 * time.Second}
+		Expect(testEnv.Update(ctx, current)).To(Succeed())
+		Eventually(func() time.Duration {
+			return driftdetection.GetRuntimeSettings().EvaluationInterval
+		}, timeout, pollingInterval).Should(Equal(20 * time.Second))
+
+		// An invalid change is rejected and current settings are kept
+		Expect(testEnv.Get(ctx, client.ObjectKeyFromObject(config), current)).To(Succeed())
+		invalid := int32(0)
+		current.Spec.DriftConfirmations = &invalid
+		err := testEnv.Update(ctx, current)
+		Expect(err).ToNot(BeNil())
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Consistently(func() bool {
+			settings := driftdetection.GetRuntimeSettings()
+			return settings.EvaluationInterval == 20*time.Second && settings.DriftConfirmations == uint(3)
+		}, time.Second, 100*time.Millisecond).Should(BeTrue())
+
+		// Instances not named default are ignored
+		other := &driftdetectionv1alpha1.DriftDetectionConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: randomString()},
+			Spec:       driftdetectionv1alpha1.DriftDetectionConfigSpec{EvaluationInterval: &interval},
+		}
+		Expect(testEnv.Create(ctx, other)).To(Succeed())
+		Consistently(func() time.Duration {
+			return driftdetection.GetRuntimeSettings().EvaluationInterval
+		}, time.Second, 100*time.Millisecond).Should(Equal(20 * time.Second))
+		Expect(testEnv.Delete(ctx, other)).To(Succeed())
+
+		// Once DriftDetectionConfig is deleted, flags apply again
+		Expect(testEnv.Delete(ctx, config)).To(Succeed())
+		Eventually(func() bool {
+			settings := driftdetection.GetRuntimeSettings()
+			return settings.EvaluationInterval == flagSettings.EvaluationInterval &&
+				settings.DriftConfirmations == flagSettings.DriftConfirmations
+		}, timeout, pollingInterval).Should(BeTrue())
+	})
+})
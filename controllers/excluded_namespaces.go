@@ -0,0 +1,96 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// excludedByResourceSummary contains, per ResourceSummary, the resources in excluded namespaces
+// last reported (see reportExcludedNamespaces)
+var excludedByResourceSummary = &excludedResourcesTracker{
+	resources: make(map[types.NamespacedName]string),
+}
+
+type excludedResourcesTracker struct {
+	mu        sync.Mutex
+	resources map[types.NamespacedName]string
+}
+
+// set records the resources in excluded namespaces resourceSummary lists. Returns true if those
+// changed since last call. Empty resources forgets resourceSummary.
+func (t *excludedResourcesTracker) set(resourceSummary types.NamespacedName, resources string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previous := t.resources[resourceSummary]
+	if resources == "" {
+		delete(t.resources, resourceSummary)
+	} else {
+		t.resources[resourceSummary] = resources
+	}
+	return previous != resources
+}
+
+// skipExcludedNamespaces returns the resources which are not in an excluded namespace
+// (nor, when included namespaces are set, outside of those) and the skipped ones
+func skipExcludedNamespaces(resources []libsveltosv1alpha1.Resource,
+) (kept []libsveltosv1alpha1.Resource, excluded []string) {
+
+	kept = make([]libsveltosv1alpha1.Resource, 0, len(resources))
+	excluded = make([]string, 0)
+	for i := range resources {
+		if driftdetection.IsNamespaceExcluded(resources[i].Namespace) {
+			excluded = append(excluded, fmt.Sprintf("%s %s/%s", resources[i].Kind,
+				resources[i].Namespace, resources[i].Name))
+			continue
+		}
+		kept = append(kept, resources[i])
+	}
+	return kept, excluded
+}
+
+// reportExcludedNamespaces reports the resources of resourceSummary not tracked because in excluded
+// namespaces via a warning event on resourceSummary. ResourceSummaries are reconciled often: event
+// is only emitted when those resources change.
+func (r *ResourceSummaryReconciler) reportExcludedNamespaces(resourceSummary *libsveltosv1alpha1.ResourceSummary,
+	logger logr.Logger, excluded ...string) {
+
+	sort.Strings(excluded)
+	description := strings.Join(excluded, ", ")
+	if !excludedByResourceSummary.set(types.NamespacedName{Namespace: resourceSummary.Namespace,
+		Name: resourceSummary.Name}, description) || description == "" {
+		return
+	}
+
+	msg := fmt.Sprintf("resources in excluded namespaces are not tracked: %s", description)
+	logger.V(logs.LogInfo).Info(msg)
+	if r.Recorder != nil {
+		r.Recorder.Event(resourceSummary, corev1.EventTypeWarning, "ExcludedNamespace", msg)
+	}
+}
@@ -16,6 +16,10 @@ limitations under the License.
 
 package controllers
 
+import (
+	driftdetectionv1alpha1 "github.com/projectsveltos/drift-detection-manager/api/v1alpha1"
+)
+
 var (
 	UpdateMaps       = (*ResourceSummaryReconciler).updateMaps
 	CleanMaps        = (*ResourceSummaryReconciler).cleanMaps
@@ -23,5 +27,21 @@ var (
 	GetHelmResources = (*ResourceSummaryReconciler).getHelmResources
 	GetChartResource = (*ResourceSummaryReconciler).getChartResource
 
+	SkipExcludedNamespaces   = skipExcludedNamespaces
+	ReportExcludedNamespaces = (*ResourceSummaryReconciler).reportExcludedNamespaces
+	ReportFetchTimeout       = (*ResourceSummaryReconciler).reportFetchTimeout
+	SkipDeniedKinds          = skipDeniedKinds
+
 	GetKeyFromObject = getKeyFromObject
+
+	ApplyConfigFile = applyConfigFile
 )
+
+func SetDriftDetectionConfigSettings(spec *driftdetectionv1alpha1.DriftDetectionConfigSpec) {
+	settingsSources.setDriftDetectionConfig(spec)
+}
+
+func ResetRuntimeSettingsSources() {
+	settingsSources.setConfigFile(nil)
+	settingsSources.setDriftDetectionConfig(nil)
+}
@@ -19,21 +19,28 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/discovery"
 	memory "k8s.io/client-go/discovery/cached"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/cluster-api/util/patch"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -53,6 +60,29 @@ const (
 	DoNotSendUpdates
 )
 
+const (
+	// ClusterNameLabel is set, on ResourceSummaries stored in the management cluster, to the name
+	// of the managed cluster they refer to. ResourceSummaries are in the managed cluster namespace.
+	ClusterNameLabel = "projectsveltos.io/cluster-name"
+
+	// ClusterTypeLabel is set, on ResourceSummaries stored in the management cluster, to the
+	// lowercase type of the managed cluster they refer to
+	ClusterTypeLabel = "projectsveltos.io/cluster-type"
+)
+
+// ManagedClusterResourceSummaries returns the cache settings selecting, among the ResourceSummaries
+// stored in the management cluster, the ones of the managed cluster clusterNamespace/clusterName
+// of type clusterType
+func ManagedClusterResourceSummaries(clusterNamespace, clusterName, clusterType string) cache.ByObject {
+	return cache.ByObject{
+		Namespaces: map[string]cache.Config{clusterNamespace: {}},
+		Label: labels.SelectorFromSet(labels.Set{
+			ClusterNameLabel: clusterName,
+			ClusterTypeLabel: strings.ToLower(clusterType),
+		}),
+	}
+}
+
 // ResourceSummaryReconciler reconciles a ResourceSummary object.
 // The goal of this controller is to make sure none of the resources deployed by Sveltos are
 // locally modified in the cluster. Logic to achieve such goal is following:
@@ -66,6 +96,7 @@ const (
 // is signal for sveltos to redeploy again to make sure there is no configuration drift)
 type ResourceSummaryReconciler struct {
 	client.Client
+	// Config is the rest config tracked resources are read with (see driftdetection.InitializeManager)
 	Config           *rest.Config
 	Scheme           *runtime.Scheme
 	RunMode          Mode
@@ -73,6 +104,10 @@ type ResourceSummaryReconciler struct {
 	ClusterName      string
 	ClusterType      libsveltosv1alpha1.ClusterType
 
+	// Recorder, if set, is used to report resources which are not tracked because
+	// in excluded namespaces
+	Recorder record.EventRecorder
+
 	// Used to update internal maps and sets
 	Mux sync.RWMutex
 
@@ -93,6 +128,7 @@ type ResourceSummaryReconciler struct {
 //+kubebuilder:rbac:groups=lib.projectsveltos.io,resources=resourcesummaries,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=lib.projectsveltos.io,resources=resourcesummaries/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=lib.projectsveltos.io,resources=resourcesummaries/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 func (r *ResourceSummaryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
 	logger := ctrl.LoggerFrom(ctx)
@@ -191,6 +227,8 @@ func (r *ResourceSummaryReconciler) reconcileNormal(ctx context.Context,
 		return err
 	}
 
+	r.observeResourceSummary(ctx, resourceSummary)
+
 	logger.V(logs.LogInfo).Info("reconciliation succeeded")
 	return nil
 }
@@ -280,11 +318,15 @@ func (r *ResourceSummaryReconciler) getChartResource(ctx context.Context,
 	return resources, nil
 }
 
-// getHelmResources gets all resources considering all the Helm charts in a ResourceSummary
+// getHelmResources gets all resources considering all the Helm charts in a ResourceSummary.
+// Returns no resource if helm section is disabled.
 func (r *ResourceSummaryReconciler) getHelmResources(ctx context.Context,
 	resourceSummary *libsveltosv1alpha1.ResourceSummary) ([]libsveltosv1alpha1.Resource, error) {
 
 	resources := make([]libsveltosv1alpha1.Resource, 0)
+	if driftdetection.IsSectionDisabled(driftdetection.HelmSection) {
+		return resources, nil
+	}
 
 	for i := range resourceSummary.Spec.ChartResources {
 		chartResources, err := r.getChartResource(ctx, &resourceSummary.Spec.ChartResources[i])
@@ -297,16 +339,75 @@ func (r *ResourceSummaryReconciler) getHelmResources(ctx context.Context,
 	return resources, nil
 }
 
-// getResources gets all resources in a ResourceSummary
+// getResources gets all resources in a ResourceSummary.
+// Returns no resource if resources section is disabled.
 func (r *ResourceSummaryReconciler) getResources(resourceSummary *libsveltosv1alpha1.ResourceSummary,
 ) []libsveltosv1alpha1.Resource {
 
+	if driftdetection.IsSectionDisabled(driftdetection.ResourcesSection) {
+		return make([]libsveltosv1alpha1.Resource, 0)
+	}
+
 	resources := make([]libsveltosv1alpha1.Resource, len(resourceSummary.Spec.Resources))
 	copy(resources, resourceSummary.Spec.Resources)
 
 	return resources
 }
 
+// reportMissingPermissions verifies drift-detection-manager can get, list and watch resources of
+// each GVK referenced by resourceSummary. Missing permissions are reported via a warning event on
+// resourceSummary: drift of those resources cannot be detected.
+func (r *ResourceSummaryReconciler) reportMissingPermissions(ctx context.Context,
+	resourceSummary *libsveltosv1alpha1.ResourceSummary, resources []libsveltosv1alpha1.Resource, logger logr.Logger) {
+
+	manager, err := driftdetection.GetManager()
+	if err != nil {
+		return
+	}
+
+	gvks := make(map[schema.GroupVersionKind]bool)
+	for i := range resources {
+		gvks[schema.GroupVersionKind{Group: resources[i].Group, Version: resources[i].Version,
+			Kind: resources[i].Kind}] = true
+	}
+
+	issues := make([]string, 0)
+	for gvk := range gvks {
+		missing, err := manager.MissingPermissions(ctx, gvk)
+		if err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to verify permissions on %s: %v", gvk, err))
+			continue
+		}
+		if len(missing) != 0 {
+			issues = append(issues, fmt.Sprintf("%s (%s)", gvk.GroupKind().String(), strings.Join(missing, ", ")))
+		}
+	}
+
+	if len(issues) != 0 {
+		sort.Strings(issues)
+		msg := fmt.Sprintf("missing permissions, drift cannot be detected: %s", strings.Join(issues, ", "))
+		logger.V(logs.LogInfo).Info(msg)
+		if r.Recorder != nil {
+			r.Recorder.Event(resourceSummary, corev1.EventTypeWarning, "MissingPermissions", msg)
+		}
+	}
+}
+
+// reportFetchTimeout reports, via an event on resourceSummary, the time each GET of a resource it
+// tracks can take (see driftdetection.FetchTimeoutAnnotation). Zero timeout means none is set.
+func (r *ResourceSummaryReconciler) reportFetchTimeout(resourceSummary *libsveltosv1alpha1.ResourceSummary,
+	timeout time.Duration, logger logr.Logger) {
+
+	msg := "tracked resources are fetched without timeout"
+	if timeout != 0 {
+		msg = fmt.Sprintf("tracked resources are fetched with a %s timeout", timeout)
+	}
+	logger.V(logs.LogInfo).Info(msg)
+	if r.Recorder != nil {
+		r.Recorder.Event(resourceSummary, corev1.EventTypeNormal, "FetchTimeout", msg)
+	}
+}
+
 func (r *ResourceSummaryReconciler) getObjectRef(resource *libsveltosv1alpha1.Resource) *corev1.ObjectReference {
 	gvk := schema.GroupVersionKind{
 		Group:   resource.Group,
@@ -329,6 +430,11 @@ func (r *ResourceSummaryReconciler) getObjectRef(resource *libsveltosv1alpha1.Re
 func (r *ResourceSummaryReconciler) cleanMaps(resourceSummary *libsveltosv1alpha1.ResourceSummary,
 	logger logr.Logger) error {
 
+	deniedKindsByResourceSummary.set(types.NamespacedName{Namespace: resourceSummary.Namespace,
+		Name: resourceSummary.Name}, nil)
+	excludedByResourceSummary.set(types.NamespacedName{Namespace: resourceSummary.Namespace,
+		Name: resourceSummary.Name}, "")
+
 	r.Mux.Lock()
 	defer r.Mux.Unlock()
 
@@ -362,9 +468,31 @@ func (r *ResourceSummaryReconciler) cleanMaps(resourceSummary *libsveltosv1alpha
 		delete(r.HelmResourceSummaryMap, *policyRef)
 	}
 
+	manager.StopTrackingHelmValues(policyRef)
+	manager.ForgetRemediations(policyRef)
+	manager.ClearIgnorePaths(policyRef)
+	manager.ClearDriftExpressions(policyRef)
+	manager.ClearLuaHooks(policyRef)
+	manager.ClearFetchTimeout(policyRef)
+
 	return nil
 }
 
+// observeResourceSummary starts tracking values of the Helm releases listed in ResourceSummary
+// (see SetHelmValuesInterval) and reports drifts Sveltos remediated by reconciling it
+func (r *ResourceSummaryReconciler) observeResourceSummary(ctx context.Context,
+	resourceSummary *libsveltosv1alpha1.ResourceSummary) {
+
+	manager, err := driftdetection.GetManager()
+	if err != nil {
+		return
+	}
+
+	requestor := getKeyFromObject(r.Scheme, resourceSummary)
+	manager.TrackHelmValues(ctx, requestor, resourceSummary)
+	manager.ObserveRemediations(requestor, resourceSummary)
+}
+
 // updateMaps gets all resources referenced in a ResourceSummary.
 // Updates map with all specific resource to watch and starts tracking those
 func (r *ResourceSummaryReconciler) updateMaps(ctx context.Context,
@@ -379,6 +507,38 @@ func (r *ResourceSummaryReconciler) updateMaps(ctx context.Context,
 		return err
 	}
 
+	// Resources in excluded namespaces are never tracked
+	resources, excluded := skipExcludedNamespaces(resources)
+	helmResources, excludedHelm := skipExcludedNamespaces(helmResources)
+	r.reportExcludedNamespaces(resourceSummary, logger, append(excluded, excludedHelm...)...)
+
+	// Resources of denied kinds are never tracked
+	resources, denied := skipDeniedKinds(resources)
+	helmResources, deniedHelm := skipDeniedKinds(helmResources)
+	r.reportDeniedKinds(resourceSummary, logger, append(denied, deniedHelm...)...)
+
+	r.reportMissingPermissions(ctx, resourceSummary, append(resources, helmResources...), logger)
+
+	// Ignore paths are set before registering resources, so that hashes take those into account
+	manager, err := driftdetection.GetManager()
+	if err != nil {
+		return err
+	}
+	if err := manager.SetIgnorePaths(ctx, resourceSummary); err != nil {
+		logger.V(logs.LogInfo).Info(err.Error())
+	}
+	if err := manager.SetDriftExpressions(resourceSummary); err != nil {
+		logger.V(logs.LogInfo).Info(err.Error())
+	}
+	if err := manager.SetLuaHooks(resourceSummary); err != nil {
+		logger.V(logs.LogInfo).Info(err.Error())
+	}
+	if timeout, changed, err := manager.SetFetchTimeout(resourceSummary); err != nil {
+		logger.V(logs.LogInfo).Info(err.Error())
+	} else if changed {
+		r.reportFetchTimeout(resourceSummary, timeout, logger)
+	}
+
 	r.Mux.Lock()
 	defer r.Mux.Unlock()
 
@@ -441,6 +601,15 @@ func (r *ResourceSummaryReconciler) updateMaps(ctx context.Context,
 	resourceSummary.Status.ResourceHashes = resourceHashes
 	resourceSummary.Status.HelmResourceHashes = helmResourceHashes
 
+	// Hashes in status are from now on evaluated with current HashVersion and normalization settings
+	annotations := resourceSummary.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[driftdetection.HashVersionAnnotation] = driftdetection.HashVersion
+	annotations[driftdetection.NormalizationAnnotation] = driftdetection.NormalizationFingerprint()
+	resourceSummary.SetAnnotations(annotations)
+
 	return nil
 }
 
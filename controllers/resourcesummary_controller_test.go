@@ -18,17 +18,22 @@ package controllers_test
 
 import (
 	"context"
+	"strings"
 	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2/textlogger"
 
 	"github.com/projectsveltos/drift-detection-manager/controllers"
@@ -87,6 +92,122 @@ var _ = Describe("ResourceSummary Reconciler", func() {
 		Expect(len(helmResources)).To(Equal(0))
 	})
 
+	It("getResources returns no resource when resources section is disabled", func() {
+		driftdetection.SetDisabledSections([]driftdetection.Section{driftdetection.ResourcesSection})
+		defer driftdetection.SetDisabledSections(nil)
+
+		resourceSummary := getResourceSummary(&resourceRef, nil)
+
+		reconciler := &controllers.ResourceSummaryReconciler{
+			Client:                 testEnv.Client,
+			Scheme:                 scheme,
+			Mux:                    sync.RWMutex{},
+			ResourceSummaryMap:     make(map[corev1.ObjectReference]*libsveltosset.Set),
+			HelmResourceSummaryMap: make(map[corev1.ObjectReference]*libsveltosset.Set),
+		}
+
+		Expect(controllers.GetResources(reconciler, resourceSummary)).To(BeEmpty())
+	})
+
+	It("skipExcludedNamespaces drops and reports resources in excluded namespaces", func() {
+		excludedNamespace := randomString()
+		driftdetection.SetExcludedNamespaces([]string{excludedNamespace})
+		defer driftdetection.SetExcludedNamespaces(nil)
+
+		resourceSummary := getResourceSummary(&resourceRef, nil)
+		resources := []libsveltosv1alpha1.Resource{
+			{Kind: "ConfigMap", Version: "v1", Namespace: excludedNamespace, Name: randomString()},
+			{Kind: "ConfigMap", Version: "v1", Namespace: randomString(), Name: randomString()},
+			{Kind: "Namespace", Version: "v1", Name: excludedNamespace},
+		}
+
+		recorder := record.NewFakeRecorder(3)
+		reconciler := &controllers.ResourceSummaryReconciler{
+			Client:   testEnv.Client,
+			Scheme:   scheme,
+			Recorder: recorder,
+		}
+
+		kept, excluded := controllers.SkipExcludedNamespaces(resources)
+		Expect(kept).To(ConsistOf(resources[1], resources[2]))
+		Expect(excluded).To(HaveLen(1))
+
+		// Excluded resources are reported once, not on every reconciliation
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+		controllers.ReportExcludedNamespaces(reconciler, resourceSummary, logger, excluded...)
+		Expect(recorder.Events).To(HaveLen(1))
+		controllers.ReportExcludedNamespaces(reconciler, resourceSummary, logger, excluded...)
+		Expect(recorder.Events).To(HaveLen(1))
+
+		// and again when they change
+		_, excluded = controllers.SkipExcludedNamespaces(resources[:1])
+		controllers.ReportExcludedNamespaces(reconciler, resourceSummary, logger)
+		Expect(recorder.Events).To(HaveLen(1))
+		controllers.ReportExcludedNamespaces(reconciler, resourceSummary, logger, excluded...)
+		Expect(recorder.Events).To(HaveLen(2))
+	})
+
+	It("skipExcludedNamespaces drops and reports resources not in included namespaces", func() {
+		includedNamespace := randomString()
+		driftdetection.SetIncludedNamespaces([]string{includedNamespace})
+		defer driftdetection.SetIncludedNamespaces(nil)
+
+		resourceSummary := getResourceSummary(&resourceRef, nil)
+		resources := []libsveltosv1alpha1.Resource{
+			{Kind: "ConfigMap", Version: "v1", Namespace: includedNamespace, Name: randomString()},
+			{Kind: "ConfigMap", Version: "v1", Namespace: randomString(), Name: randomString()},
+			{Kind: "Namespace", Version: "v1", Name: includedNamespace},
+		}
+
+		recorder := record.NewFakeRecorder(1)
+		reconciler := &controllers.ResourceSummaryReconciler{
+			Client:   testEnv.Client,
+			Scheme:   scheme,
+			Recorder: recorder,
+		}
+
+		kept, excluded := controllers.SkipExcludedNamespaces(resources)
+		Expect(kept).To(ConsistOf(resources[0]))
+		Expect(excluded).To(HaveLen(2))
+
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+		controllers.ReportExcludedNamespaces(reconciler, resourceSummary, logger, excluded...)
+		Expect(recorder.Events).To(HaveLen(1))
+	})
+
+	It("reportFetchTimeout reports the effective fetch timeout", func() {
+		resourceSummary := getResourceSummary(&resourceRef, nil)
+
+		recorder := record.NewFakeRecorder(2)
+		reconciler := &controllers.ResourceSummaryReconciler{
+			Client:   testEnv.Client,
+			Scheme:   scheme,
+			Recorder: recorder,
+		}
+
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+		controllers.ReportFetchTimeout(reconciler, resourceSummary, 2*time.Minute, logger)
+		Eventually(recorder.Events).Should(Receive(ContainSubstring("2m0s timeout")))
+		controllers.ReportFetchTimeout(reconciler, resourceSummary, 0, logger)
+		Eventually(recorder.Events).Should(Receive(ContainSubstring("without timeout")))
+	})
+
+	It("skipDeniedKinds drops resources of denied kinds", func() {
+		driftdetection.SetDeniedKinds([]schema.GroupKind{{Kind: "Secret"}, {Group: "coordination.k8s.io", Kind: "Lease"}})
+		defer driftdetection.SetDeniedKinds(nil)
+
+		resources := []libsveltosv1alpha1.Resource{
+			{Kind: "Secret", Version: "v1", Namespace: randomString(), Name: randomString()},
+			{Kind: "ConfigMap", Version: "v1", Namespace: randomString(), Name: randomString()},
+			{Kind: "Lease", Group: "coordination.k8s.io", Version: "v1", Namespace: randomString(), Name: randomString()},
+			{Kind: "Lease", Group: "example.com", Version: "v1", Namespace: randomString(), Name: randomString()},
+		}
+
+		allowed, denied := controllers.SkipDeniedKinds(resources)
+		Expect(allowed).To(ConsistOf(resources[1], resources[3]))
+		Expect(denied).To(ConsistOf("Secret", "Lease.coordination.k8s.io"))
+	})
+
 	It("getHelmResources returns resources", func() {
 		resourceSummary := getResourceSummary(nil, &resourceRef)
 
@@ -238,4 +359,54 @@ var _ = Describe("ResourceSummary Reconciler", func() {
 		Expect(resources).To(ContainElement(resource3))
 
 	})
+
+	It("ManagedClusterResourceSummaries only caches ResourceSummaries of the managed cluster", func() {
+		clusterNamespace := randomString()
+		clusterName := randomString()
+		clusterType := string(libsveltosv1alpha1.ClusterTypeCapi)
+
+		otherNamespace := randomString()
+		for _, name := range []string{clusterNamespace, otherNamespace} {
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+			Expect(testEnv.Create(watcherCtx, ns)).To(Succeed())
+			Expect(waitForObject(watcherCtx, testEnv.Client, ns)).To(Succeed())
+		}
+
+		newResourceSummary := func(namespace, name string) *libsveltosv1alpha1.ResourceSummary {
+			rs := getResourceSummary(nil, nil)
+			rs.Namespace = namespace
+			rs.Labels = map[string]string{
+				controllers.ClusterNameLabel: name,
+				controllers.ClusterTypeLabel: strings.ToLower(clusterType),
+			}
+			Expect(testEnv.Create(watcherCtx, rs)).To(Succeed())
+			Expect(waitForObject(watcherCtx, testEnv.Client, rs)).To(Succeed())
+			return rs
+		}
+
+		managed := newResourceSummary(clusterNamespace, clusterName)
+		// Same namespace, different cluster
+		newResourceSummary(clusterNamespace, randomString())
+		// Same cluster name, different namespace
+		newResourceSummary(otherNamespace, clusterName)
+
+		c, err := cache.New(testEnv.Config, cache.Options{
+			Scheme: scheme,
+			ByObject: map[client.Object]cache.ByObject{
+				&libsveltosv1alpha1.ResourceSummary{}: controllers.ManagedClusterResourceSummaries(
+					clusterNamespace, clusterName, clusterType),
+			},
+		})
+		Expect(err).To(BeNil())
+		go func() {
+			_ = c.Start(watcherCtx)
+		}()
+		Expect(c.WaitForCacheSync(watcherCtx)).To(BeTrue())
+
+		resourceSummaries := &libsveltosv1alpha1.ResourceSummaryList{}
+		Expect(c.List(watcherCtx, resourceSummaries)).To(Succeed())
+		Expect(len(resourceSummaries.Items)).To(Equal(1))
+		Expect(resourceSummaries.Items[0].Namespace).To(Equal(managed.Namespace))
+		Expect(resourceSummaries.Items[0].Name).To(Equal(managed.Name))
+	})
 })
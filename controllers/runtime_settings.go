@@ -0,0 +1,122 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	driftdetectionv1alpha1 "github.com/projectsveltos/drift-detection-manager/api/v1alpha1"
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+// runtimeSettingsSources contains all the sources drift detection runtime settings come from.
+// Sources are layered, each one overriding the settings it sets: command line flags first,
+// then config file (see WatchConfigFile), then DriftDetectionConfig.
+type runtimeSettingsSources struct {
+	mu sync.Mutex
+
+	flags                driftdetection.RuntimeSettings
+	configFile           *driftdetectionv1alpha1.DriftDetectionConfigSpec
+	driftDetectionConfig *driftdetectionv1alpha1.DriftDetectionConfigSpec
+}
+
+var settingsSources = &runtimeSettingsSources{}
+
+// SetFlagRuntimeSettings sets the settings passed via command line flags. Those are used
+// for any setting neither config file nor DriftDetectionConfig sets.
+func SetFlagRuntimeSettings(settings driftdetection.RuntimeSettings) {
+	settingsSources.mu.Lock()
+	defer settingsSources.mu.Unlock()
+
+	settingsSources.flags = settings
+}
+
+// setConfigFile sets the settings read from config file, and applies the resulting settings.
+// Nil means no config file.
+func (s *runtimeSettingsSources) setConfigFile(spec *driftdetectionv1alpha1.DriftDetectionConfigSpec,
+) driftdetection.RuntimeSettings {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.configFile = spec
+	return s.apply()
+}
+
+// setDriftDetectionConfig sets the settings in DriftDetectionConfig, and applies the resulting settings.
+// Nil means DriftDetectionConfig does not exist.
+func (s *runtimeSettingsSources) setDriftDetectionConfig(spec *driftdetectionv1alpha1.DriftDetectionConfigSpec,
+) driftdetection.RuntimeSettings {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.driftDetectionConfig = spec
+	return s.apply()
+}
+
+// apply merges all sources and applies the resulting settings. Lock must be held.
+func (s *runtimeSettingsSources) apply() driftdetection.RuntimeSettings {
+	settings := s.flags
+	if s.configFile != nil {
+		settings = getRuntimeSettings(s.configFile, settings)
+	}
+	if s.driftDetectionConfig != nil {
+		settings = getRuntimeSettings(s.driftDetectionConfig, settings)
+	}
+
+	driftdetection.ApplyRuntimeSettings(settings)
+	return settings
+}
+
+// getRuntimeSettings returns defaults overridden by any setting in spec
+func getRuntimeSettings(spec *driftdetectionv1alpha1.DriftDetectionConfigSpec,
+	defaults driftdetection.RuntimeSettings) driftdetection.RuntimeSettings {
+
+	settings := defaults
+	if spec.EvaluationInterval != nil {
+		settings.EvaluationInterval = spec.EvaluationInterval.Duration
+	}
+	if spec.DriftConfirmations != nil && *spec.DriftConfirmations > 0 {
+		settings.DriftConfirmations = uint(*spec.DriftConfirmations)
+	}
+	if spec.MaxPollingInterval != nil {
+		settings.MaxPollingInterval = spec.MaxPollingInterval.Duration
+	}
+	if spec.DiscoveryCacheTTL != nil {
+		settings.DiscoveryCacheTTL = spec.DiscoveryCacheTTL.Duration
+	}
+	if spec.KindEvaluationIntervals != nil {
+		settings.KindEvaluationIntervals = make(map[schema.GroupKind]time.Duration, len(spec.KindEvaluationIntervals))
+		for i := range spec.KindEvaluationIntervals {
+			kindInterval := &spec.KindEvaluationIntervals[i]
+			if kindInterval.Interval.Duration <= 0 {
+				continue
+			}
+			gk := schema.GroupKind{Group: kindInterval.Group, Kind: kindInterval.Kind}
+			settings.KindEvaluationIntervals[gk] = kindInterval.Interval.Duration
+		}
+	}
+	if spec.ExcludedNamespaces != nil {
+		settings.ExcludedNamespaces = make([]string, len(spec.ExcludedNamespaces))
+		copy(settings.ExcludedNamespaces, spec.ExcludedNamespaces)
+	}
+	return settings
+}
@@ -19,6 +19,7 @@ package controllers_test
 import (
 	"context"
 	"fmt"
+	"path"
 	"testing"
 	"time"
 
@@ -38,6 +39,7 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	driftdetectionv1alpha1 "github.com/projectsveltos/drift-detection-manager/api/v1alpha1"
 	"github.com/projectsveltos/drift-detection-manager/internal/test/helpers"
 	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
 	"github.com/projectsveltos/libsveltos/lib/crd"
@@ -60,6 +62,11 @@ var (
 	}
 )
 
+const (
+	timeout         = 1 * time.Minute
+	pollingInterval = 5 * time.Second
+)
+
 func TestControllers(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Classification Suite")
@@ -76,7 +83,7 @@ var _ = BeforeSuite(func() {
 	scheme, err = setupScheme()
 	Expect(err).To(BeNil())
 
-	testEnvConfig := helpers.NewTestEnvironmentConfiguration([]string{}, scheme)
+	testEnvConfig := helpers.NewTestEnvironmentConfiguration([]string{path.Join("config", "crd", "bases")}, scheme)
 	testEnv, err = testEnvConfig.Build(scheme)
 	if err != nil {
 		panic(err)
@@ -128,6 +135,9 @@ func setupScheme() (*runtime.Scheme, error) {
 	if err := apiextensionsv1.AddToScheme(s); err != nil {
 		return nil, err
 	}
+	if err := driftdetectionv1alpha1.AddToScheme(s); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -17,22 +17,32 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	cliflag "k8s.io/component-base/cli/flag"
 	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/textlogger"
@@ -41,12 +51,37 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
-	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	driftdetectionv1alpha1 "github.com/projectsveltos/drift-detection-manager/api/v1alpha1"
 	"github.com/projectsveltos/drift-detection-manager/controllers"
+	"github.com/projectsveltos/drift-detection-manager/pkg/admin"
+	"github.com/projectsveltos/drift-detection-manager/pkg/alerts"
+	"github.com/projectsveltos/drift-detection-manager/pkg/argocd"
+	"github.com/projectsveltos/drift-detection-manager/pkg/bench"
+	"github.com/projectsveltos/drift-detection-manager/pkg/cdevents"
+	"github.com/projectsveltos/drift-detection-manager/pkg/checkpoint"
+	"github.com/projectsveltos/drift-detection-manager/pkg/cloudauth"
 	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/egress"
+	"github.com/projectsveltos/drift-detection-manager/pkg/fanout"
+	"github.com/projectsveltos/drift-detection-manager/pkg/features"
+	"github.com/projectsveltos/drift-detection-manager/pkg/fips"
+	"github.com/projectsveltos/drift-detection-manager/pkg/inspect"
+	"github.com/projectsveltos/drift-detection-manager/pkg/issues"
+	"github.com/projectsveltos/drift-detection-manager/pkg/kms"
+	"github.com/projectsveltos/drift-detection-manager/pkg/kubeconfig"
+	"github.com/projectsveltos/drift-detection-manager/pkg/loadgen"
+	"github.com/projectsveltos/drift-detection-manager/pkg/mtls"
+	"github.com/projectsveltos/drift-detection-manager/pkg/preflight"
+	"github.com/projectsveltos/drift-detection-manager/pkg/siem"
+	"github.com/projectsveltos/drift-detection-manager/pkg/statsd"
+	"github.com/projectsveltos/drift-detection-manager/pkg/tracing"
+	"github.com/projectsveltos/drift-detection-manager/pkg/transport"
+	"github.com/projectsveltos/drift-detection-manager/pkg/validate"
 	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
 	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
 	"github.com/projectsveltos/libsveltos/lib/logsettings"
@@ -57,67 +92,216 @@ import (
 const (
 	noUpdates = "do-not-send-updates"
 
-	managedCluster = "managed-cluster"
+	managedCluster    = "managed-cluster"
+	managementCluster = "management-cluster"
+
+	// envPrefix is the prefix of the environment variables overriding flags (see applyEnvOverrides)
+	envPrefix = "DRIFT_DETECTION_"
+
+	// exitDegradedShutdown is the exit code used when state was lost on termination
+	// (see driftdetection.ShutdownReport). Exit code is 0 on clean shutdown and 1 on failures.
+	exitDegradedShutdown = 2
+
+	// exitPreflightFailed is the exit code used when a preflight check failed (see --preflight)
+	exitPreflightFailed = 3
+
+	// defaultCredentialRefresh is below the lifetime of credentials issued by cloud providers
+	// exec plugins (15 minutes on EKS)
+	defaultCredentialRefresh = 10 * time.Minute
+
+	// clusterPausedCheckInterval is how often the paused state of the managed cluster is checked
+	clusterPausedCheckInterval = 30 * time.Second
+
+	// terminationMessagePath is where Kubernetes reads the termination message of a container from
+	terminationMessagePath = "/dev/termination-log"
 )
 
 var (
-	setupLog            = ctrl.Log.WithName("setup")
-	diagnosticsAddress  string
-	insecureDiagnostics bool
-	runMode             string
-	deployedCluster     string
-	clusterNamespace    string
-	clusterName         string
-	clusterType         string
-	restConfigQPS       float32
-	restConfigBurst     int
-	webhookPort         int
-	syncPeriod          time.Duration
-	healthAddr          string
+	setupLog = ctrl.Log.WithName("setup")
 )
 
+// options are the settings of drift-detection-manager, set via flags (see initFlags) or
+// environment variables (see applyEnvOverrides), grouped by subsystem
+type options struct {
+	runMode         string
+	preflightOnly   bool
+	configFile      string
+	namespaceScoped bool
+
+	cluster      clusterOptions
+	manager      managerOptions
+	diagnostics  diagnosticsOptions
+	integrations integrationOptions
+	detection    detectionOptions
+	reporting    reportingOptions
+	state        stateOptions
+	security     securityOptions
+}
+
+// clusterOptions identify the managed cluster and configure how it is reached
+type clusterOptions struct {
+	deployedCluster         string
+	namespace               string
+	name                    string
+	clusterType             string
+	qps                     float32
+	burst                   int
+	credentialRefresh       time.Duration
+	endpointFailover        bool
+	transportMode           string
+	proxyURL                string
+	proxyTLS                transport.ProxyTLS
+	tokenProvider           string
+	tokenClusterID          string
+	workloadKubeconfig      string
+	workloadContext         string
+	resourceSummaryLocation string
+
+	// transport is how managed cluster is reached when running in the management cluster
+	transport transport.Transport
+
+	// token, when set, authenticates requests to the managed cluster with cloud provider tokens
+	token *cloudauth.Source
+}
+
+// String returns the managed cluster as type:namespace/name
+func (c *clusterOptions) String() string {
+	return fmt.Sprintf("%s:%s/%s", c.clusterType, c.namespace, c.name)
+}
+
+// managerOptions configure the controller-runtime manager
+type managerOptions struct {
+	healthAddr              string
+	webhookPort             int
+	syncPeriod              time.Duration
+	leaderElect             bool
+	leaderElectionNamespace string
+}
+
+// diagnosticsOptions configure the diagnostics endpoint
+type diagnosticsOptions struct {
+	address        string
+	insecure       bool
+	certDir        string
+	clientCAFile   string
+	adminTokenFile string
+	adminAuditFile string
+}
+
+// integrationOptions configure the integrations sending drift data outside of the cluster
+type integrationOptions struct {
+	tracingEndpoint  string
+	tracingInsecure  bool
+	cdeventsEndpoint string
+	syslog           siem.Options
+	statsd           statsd.Options
+	issues           issues.Options
+	egressAllowlist  []string
+}
+
+// detectionOptions configure which resources are tracked and how they are evaluated
+type detectionOptions struct {
+	startupConcurrency   int
+	hashMode             string
+	generationAwareKinds []string
+	kindIntervals        map[string]string
+	disabledSections     []string
+	excludedNamespaces   []string
+	includedNamespaces   []string
+	deniedKinds          []string
+	fieldExclusionsFile  string
+	terraformOwnership   string
+	crossplaneAware      bool
+	sidecarNormalization bool
+	certManagerRotation  bool
+	externalSecretsAware bool
+	memoryBudget         string
+	pollingInterval      time.Duration
+	maxPollingInterval   time.Duration
+	incrementalThreshold string
+	listPageSize         int64
+	discoveryCacheTTL    time.Duration
+	driftConfirmations   uint
+	pausedWatchers       string
+	evaluationQPS        float32
+	evaluationBurst      int
+}
+
+// reportingOptions configure how detected drifts are reported
+type reportingOptions struct {
+	reportOnly           bool
+	driftEventsStdout    bool
+	driftEventsFormat    string
+	helmValuesInterval   time.Duration
+	inventoryCorrelation bool
+	policyReportInterval time.Duration
+	eventSourceName      string
+	eventReportInterval  time.Duration
+	componentLabel       string
+	fluxOwnership        string
+}
+
+// stateOptions configure where state of tracked resources is persisted
+type stateOptions struct {
+	snapshotPath       string
+	snapshotInterval   time.Duration
+	kekFile            string
+	plaintextMigration bool
+	checkpointSecret   string
+}
+
+// securityOptions configure the identity tracked resources are read with, signing of drift
+// events and FIPS mode
+type securityOptions struct {
+	impersonateUser          string
+	impersonateGroups        []string
+	driftEventSigningKeyFile string
+	fips                     bool
+}
+
 // Add RBAC for the authorized diagnostics endpoint.
 // +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
 // +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+// Allow verifying own permissions on tracked resources.
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=selfsubjectaccessreviews,verbs=create
+// Allow the inspect subcommand, run inside the pod, to read state from the diagnostics endpoint.
+// +kubebuilder:rbac:urls=/debug/state,verbs=get
+// Allow reading tracked resources, drift events and drift per component via the versioned API.
+// +kubebuilder:rbac:urls=/api/v1/tracked;/api/v1/events;/api/v1/components,verbs=get
+// Allow forcing the evaluation of a single resource (see kubectl drift evaluate).
+// +kubebuilder:rbac:urls=/evaluate/*,verbs=post
+// Allow leader election and state checkpoints (see --leader-elect and --state-checkpoint-secret).
+// +kubebuilder:rbac:groups=coordination.k8s.io,namespace=projectsveltos,resources=leases,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",namespace=projectsveltos,resources=secrets,verbs=get;create;update;delete
+// Allow writing drift events as PolicyReports (see --policy-report-interval).
+// +kubebuilder:rbac:groups=wgpolicyk8s.io,resources=policyreports;clusterpolicyreports,verbs=get;list;create;patch;delete
+// Allow writing drifted resources as EventReports (see --event-source-name).
+// +kubebuilder:rbac:groups=lib.projectsveltos.io,resources=eventreports,verbs=get;list;watch;create;update
+// +kubebuilder:rbac:groups=lib.projectsveltos.io,resources=eventreports/status,verbs=get;update
 
 func main() {
+	if runSubcommand() {
+		return
+	}
+
 	scheme, err := controllers.InitScheme()
 	if err != nil {
 		os.Exit(1)
 	}
 
-	klog.InitFlags(nil)
-
-	initFlags(pflag.CommandLine)
-	pflag.CommandLine.SetNormalizeFunc(cliflag.WordSepNormalizeFunc)
-	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
-	pflag.Parse()
-
-	ctrl.SetLogger(klog.Background())
+	o := parseFlags()
 
 	ctx := ctrl.SetupSignalHandler()
 
-	ctrlOptions := ctrl.Options{
-		Scheme:                 scheme,
-		Metrics:                getDiagnosticsOptions(),
-		HealthProbeBindAddress: healthAddr,
-		WebhookServer: webhook.NewServer(
-			webhook.Options{
-				Port: webhookPort,
-			}),
-		Cache: cache.Options{
-			SyncPeriod: &syncPeriod,
-		},
-	}
+	shutdownTracing := setupOutboundIntegrations(ctx, o)
+
+	ctrlOptions := getManagerOptions(ctx, scheme, o)
 
 	restConfig := ctrl.GetConfigOrDie()
-	if deployedCluster != managedCluster {
-		// if drift-detection-manager is running in the management cluster, get the kubeconfig
-		// of the managed cluster
-		restConfig = getManagedClusterRestConfig(ctx, restConfig, ctrl.Log.WithName("get-kubeconfig"))
+	if o.preflightOnly {
+		os.Exit(runPreflight(ctx, restConfig, o))
 	}
-	restConfig.QPS = restConfigQPS
-	restConfig.Burst = restConfigBurst
+	restConfig, workloadConfig := getRestConfigs(ctx, restConfig, &o.cluster)
 
 	mgr, err := ctrl.NewManager(restConfig, ctrlOptions)
 	if err != nil {
@@ -125,26 +309,30 @@ func main() {
 		os.Exit(1)
 	}
 
-	logsettings.RegisterForLogSettings(ctx,
-		libsveltosv1alpha1.ComponentDriftDetectionManager, ctrl.Log.WithName("log-setter"),
-		restConfig)
+	if !o.namespaceScoped {
+		// DebuggingConfiguration is cluster wide
+		logsettings.RegisterForLogSettings(ctx,
+			libsveltosv1alpha1.ComponentDriftDetectionManager, ctrl.Log.WithName("log-setter"),
+			restConfig)
+	}
 
 	sendUpdates := controllers.SendUpdates // do not send reports
-	if runMode == noUpdates {
+	if o.runMode == noUpdates {
 		sendUpdates = controllers.DoNotSendUpdates
 	}
 
 	if err = (&controllers.ResourceSummaryReconciler{
 		Client:                 mgr.GetClient(),
-		Config:                 mgr.GetConfig(),
+		Config:                 workloadConfig,
 		Scheme:                 mgr.GetScheme(),
 		RunMode:                sendUpdates,
 		Mux:                    sync.RWMutex{},
 		ResourceSummaryMap:     make(map[corev1.ObjectReference]*libsveltosset.Set),
 		HelmResourceSummaryMap: make(map[corev1.ObjectReference]*libsveltosset.Set),
-		ClusterNamespace:       clusterNamespace,
-		ClusterName:            clusterName,
-		ClusterType:            libsveltosv1alpha1.ClusterType(clusterType),
+		ClusterNamespace:       o.cluster.namespace,
+		ClusterName:            o.cluster.name,
+		ClusterType:            libsveltosv1alpha1.ClusterType(o.cluster.clusterType),
+		Recorder:               mgr.GetEventRecorderFor("drift-detection-manager"),
 		MapperLock:             sync.Mutex{},
 	}).SetupWithManager(ctx, mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ResourceSummary")
@@ -154,34 +342,436 @@ func main() {
 
 	setupChecks(mgr)
 
-	go initializeManager(ctx, mgr, sendUpdates, clusterNamespace, clusterName,
-		libsveltosv1alpha1.ClusterType(clusterType), setupLog)
+	configureDriftDetection(o)
+	setupStateCheckpoints(ctx, mgr, o)
+	setupRuntimeSettings(ctx, mgr, o)
+	shutdown := setupShutdownReport(mgr)
+
+	go initializeManager(ctx, mgr, workloadConfig, sendUpdates, &o.cluster, setupLog)
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+
+	report := shutdown()
+
+	if err := shutdownTracing(context.Background()); err != nil {
+		setupLog.Error(err, "failed to shutdown tracing")
+	}
+
+	if report.Degraded() {
+		os.Exit(exitDegradedShutdown)
+	}
+}
+
+// getRestConfigs returns the rest config ResourceSummaries are read and updated with, which the
+// controller-runtime manager is built on, and the one tracked resources are read with. cfg is
+// the config of the cluster drift-detection-manager is deployed in. Exits on error.
+func getRestConfigs(ctx context.Context, cfg *rest.Config, cluster *clusterOptions,
+) (resourceSummaryConfig, workloadConfig *rest.Config) {
+
+	restConfig := cfg
+	if cluster.deployedCluster != managedCluster {
+		// if drift-detection-manager is running in the management cluster, get the kubeconfig
+		// of the managed cluster
+		restConfig = getManagedClusterRestConfig(ctx, cfg, cluster, ctrl.Log.WithName("get-kubeconfig"))
+	}
+	restConfig.QPS = cluster.qps
+	restConfig.Burst = cluster.burst
+
+	switch cluster.resourceSummaryLocation {
+	case managedCluster:
+		return restConfig, getWorkloadRestConfig(restConfig, cluster)
+	case managementCluster:
+		var err error
+		if cluster.deployedCluster == managedCluster {
+			err = fmt.Errorf("ResourceSummaries in the management cluster require running in the management cluster")
+		} else if cluster.workloadKubeconfig != "" {
+			err = fmt.Errorf("--workload-kubeconfig cannot be used with ResourceSummaries in the management cluster")
+		}
+		if err != nil {
+			setupLog.Error(err, "invalid --resource-summary-location")
+			os.Exit(1)
+		}
+		// Workloads are watched in the managed cluster, while ResourceSummaries of this managed
+		// cluster are read and updated in the management cluster (see getCacheOptions)
+		cfg.QPS = cluster.qps
+		cfg.Burst = cluster.burst
+		return cfg, restConfig
+	default:
+		setupLog.Error(fmt.Errorf("unsupported location %q", cluster.resourceSummaryLocation), "invalid --resource-summary-location")
+		os.Exit(1)
+		return nil, nil
+	}
+}
+
+// getWorkloadRestConfig returns the rest config tracked resources are read with. By default, the
+// cluster ResourceSummaries are stored in (restConfig). With a hosted control plane or a virtual
+// cluster (e.g. vcluster), tracked workloads live behind a different API server: its kubeconfig is
+// passed via --workload-kubeconfig, while ResourceSummaries keep being read and updated via
+// restConfig. Exits on error.
+func getWorkloadRestConfig(restConfig *rest.Config, cluster *clusterOptions) *rest.Config {
+	if cluster.workloadKubeconfig == "" {
+		return restConfig
+	}
+
+	workloadConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: cluster.workloadKubeconfig},
+		&clientcmd.ConfigOverrides{CurrentContext: cluster.workloadContext}).ClientConfig()
+	if err != nil {
+		setupLog.Error(err, "invalid --workload-kubeconfig")
+		os.Exit(1)
+	}
+	workloadConfig.QPS = cluster.qps
+	workloadConfig.Burst = cluster.burst
+	setupLog.V(logsettings.LogInfo).Info(fmt.Sprintf("tracked resources are read from %s", workloadConfig.Host))
+	return workloadConfig
+}
+
+// getManagerOptions returns the options of the controller-runtime manager
+func getManagerOptions(ctx context.Context, scheme *runtime.Scheme, o *options) ctrl.Options {
+	return ctrl.Options{
+		Scheme:                 scheme,
+		Metrics:                getDiagnosticsOptions(ctx, &o.diagnostics),
+		HealthProbeBindAddress: o.manager.healthAddr,
+		WebhookServer: webhook.NewServer(
+			webhook.Options{
+				Port: o.manager.webhookPort,
+			}),
+		Cache: getCacheOptions(o),
+
+		// Only the leader tracks drift. Standby takes over as soon as leader releases leadership.
+		LeaderElection:                o.manager.leaderElect,
+		LeaderElectionID:              "drift-detection-manager-leader",
+		LeaderElectionNamespace:       o.manager.leaderElectionNamespace,
+		LeaderElectionReleaseOnCancel: true,
+	}
+}
+
+// setupStateCheckpoints persists state in Secrets, readable by all replicas, when
+// --state-checkpoint-secret is set. Till this replica is elected, the checkpoints written by the
+// leader are prefetched, so that on failover tracking resumes from leader state.
+func setupStateCheckpoints(ctx context.Context, mgr ctrl.Manager, o *options) {
+	if o.state.checkpointSecret == "" {
+		return
+	}
+
+	// Secrets are read directly: caching them would watch all Secrets
+	store := checkpoint.NewSecretStore(mgr.GetClient(), mgr.GetAPIReader(), o.manager.leaderElectionNamespace,
+		o.state.checkpointSecret)
+	driftdetection.SetSnapshotStore(store, o.state.snapshotInterval)
+
+	prefetchCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		select {
+		case <-mgr.Elected():
+		case <-ctx.Done():
+		}
+	}()
+	go store.Prefetch(prefetchCtx, o.state.snapshotInterval, ctrl.Log.WithName("checkpoint"))
+}
+
+// setupShutdownReport makes reportShutdown run when leader election runnables are stopped, so
+// that last checkpoint is written before leadership is released. Returned function returns the
+// shutdown report once manager has stopped.
+func setupShutdownReport(mgr ctrl.Manager) func() *driftdetection.ShutdownReport {
+	var report *driftdetection.ShutdownReport
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		report = reportShutdown()
+		return nil
+	})); err != nil {
+		setupLog.Error(err, "unable to set up shutdown report")
+		os.Exit(1)
+	}
+
+	return func() *driftdetection.ShutdownReport {
+		if report == nil {
+			// Never elected
+			report = reportShutdown()
+		}
+		return report
+	}
+}
+
+// reportShutdown persists drift detection state one last time and logs a summary of it.
+// Summary is also written, in JSON format, as container termination message so that
+// lossy restarts can be detected from pod status.
+func reportShutdown() *driftdetection.ShutdownReport {
+	report := driftdetection.Shutdown()
+	setupLog.Info("shutdown report",
+		"initialized", report.Initialized,
+		"trackedResources", report.TrackedResources,
+		"pendingEvaluations", report.PendingEvaluations,
+		"unflushedDrifts", report.UnflushedDrifts,
+		"checkpoint", report.Checkpoint,
+		"checkpointError", report.CheckpointError,
+		"degraded", report.Degraded())
+
+	// Termination message file only exists when running in a container
+	if f, err := os.OpenFile(terminationMessagePath, os.O_WRONLY|os.O_TRUNC, 0); err == nil {
+		defer func() { _ = f.Close() }()
+		_ = json.NewEncoder(f).Encode(report)
+	}
+
+	return report
+}
+
+// runPreflight runs preflight checks, prints their report and returns the exit code.
+// Report is also written, in JSON format, as container termination message.
+func runPreflight(ctx context.Context, restConfig *rest.Config, o *options) int {
+	options := &preflight.Options{Namespaces: o.detection.includedNamespaces}
+	if o.cluster.deployedCluster != managedCluster {
+		options.ManagedClusterConfig = func(ctx context.Context) (*rest.Config, error) {
+			return fetchManagedClusterRestConfig(ctx, restConfig, &o.cluster)
+		}
+	}
+
+	report := preflight.Run(ctx, restConfig, options)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSTATUS\tDETAILS")
+	for i := range report.Checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", report.Checks[i].Name, report.Checks[i].Status, report.Checks[i].Message)
+	}
+	_ = w.Flush()
+
+	if f, err := os.OpenFile(terminationMessagePath, os.O_WRONLY|os.O_TRUNC, 0); err == nil {
+		defer func() { _ = f.Close() }()
+		_ = json.NewEncoder(f).Encode(report)
+	}
+
+	if report.Failed() {
+		return exitPreflightFailed
+	}
+	return 0
+}
+
+// parseFlags parses command line flags (overridden by environment variables) and verifies the
+// settings which must be valid before anything else starts. Exits on error.
+func parseFlags() *options {
+	klog.InitFlags(nil)
+
+	o := &options{}
+	initFlags(pflag.CommandLine, o)
+	pflag.CommandLine.SetNormalizeFunc(cliflag.WordSepNormalizeFunc)
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Parse()
+	// Logger is set first, so that invalid settings are logged. Verbosity set by environment
+	// variables still applies, as it is read on each log.
+	ctrl.SetLogger(klog.Background())
+	if err := applyEnvOverrides(pflag.CommandLine); err != nil {
+		setupLog.Error(err, "invalid environment variable")
+		os.Exit(1)
+	}
+	if o.namespaceScoped && len(o.detection.includedNamespaces) == 0 {
+		setupLog.Error(fmt.Errorf("--namespace-scoped requires --included-namespaces"), "invalid --namespace-scoped")
+		os.Exit(1)
+	}
+	if o.state.checkpointSecret != "" && o.state.snapshotPath != "" {
+		setupLog.Error(fmt.Errorf("--state-checkpoint-secret and --state-snapshot-path are mutually exclusive"),
+			"invalid --state-checkpoint-secret")
+		os.Exit(1)
+	}
+	if err := egress.SetAllowlist(o.integrations.egressAllowlist); err != nil {
+		setupLog.Error(err, "invalid --egress-allowlist")
+		os.Exit(1)
+	}
+
+	if o.security.fips {
+		if err := fips.Assert(); err != nil {
+			setupLog.Error(err, "invalid --fips")
+			os.Exit(1)
+		}
+	}
+	setupLog.Info("crypto mode", "fips", fips.Enabled())
+
+	return o
+}
+
+// setupOutboundIntegrations sets up all integrations sending drift data outside of the cluster
+// and returns the function flushing traces on shutdown. Exits on error.
+func setupOutboundIntegrations(ctx context.Context, o *options) func(context.Context) error {
+	shutdownTracing, err := tracing.Setup(ctx, o.integrations.tracingEndpoint, o.integrations.tracingInsecure)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+	if o.cluster.deployedCluster != managedCluster {
+		detectClusterType(ctx, &o.cluster)
+	}
+	setupManagedClusterTransport(&o.cluster)
+	setupManagedClusterToken(&o.cluster)
+	setupCDEvents(ctx, o)
+	setupSIEM(ctx, o)
+	setupStatsD(ctx, o)
+	setupIssues(ctx, o)
+	// All outbound integrations are set up: record, for audit, where drift data is sent
+	setupLog.Info("outbound destinations", "destinations", egress.Destinations())
+
+	return shutdownTracing
+}
+
+// setupCDEvents sends drifts and their remediation as CDEvents to --cdevents-endpoint, if set.
+// Exits on error.
+func setupCDEvents(ctx context.Context, o *options) {
+	if o.integrations.cdeventsEndpoint == "" {
+		return
+	}
+
+	sink, err := cdevents.New(o.integrations.cdeventsEndpoint, o.cluster.String(),
+		ctrl.Log.WithName("cdevents"))
+	if err != nil {
+		setupLog.Error(err, "invalid --cdevents-endpoint")
+		os.Exit(1)
+	}
+	driftdetection.AddDriftEventSink(sink)
+	go sink.Run(ctx)
+}
+
+// setupSIEM sends drifts and their remediation to --syslog-endpoint, if set. Exits on error.
+func setupSIEM(ctx context.Context, o *options) {
+	if o.integrations.syslog.Endpoint == "" {
+		return
+	}
+
+	o.integrations.syslog.Cluster = o.cluster.String()
+	sink, err := siem.New(&o.integrations.syslog, ctrl.Log.WithName("siem"))
+	if err != nil {
+		setupLog.Error(err, "invalid --syslog-endpoint")
+		os.Exit(1)
+	}
+	driftdetection.AddDriftEventSink(sink)
+	go sink.Run(ctx)
+}
+
+// setupStatsD sends metrics to the StatsD agent at --statsd-address, if set. Exits on error.
+func setupStatsD(ctx context.Context, o *options) {
+	if o.integrations.statsd.Address == "" {
+		return
+	}
+
+	emitter, err := statsd.New(&o.integrations.statsd, metrics.Registry, ctrl.Log.WithName("statsd"))
+	if err != nil {
+		setupLog.Error(err, "invalid --statsd-address")
+		os.Exit(1)
+	}
+	go emitter.Run(ctx)
+}
+
+// setupIssues opens issues for drifts persisting beyond --issue-after in --issue-repository, if
+// set. Exits on error.
+func setupIssues(ctx context.Context, o *options) {
+	if o.integrations.issues.Repository == "" {
+		return
+	}
+
+	o.integrations.issues.Cluster = o.cluster.String()
+	sink, err := issues.New(&o.integrations.issues, ctrl.Log.WithName("issues"))
+	if err != nil {
+		setupLog.Error(err, "invalid --issue-repository")
+		os.Exit(1)
+	}
+	driftdetection.AddDriftEventSink(sink)
+	go sink.Run(ctx)
 }
 
-func initFlags(fs *pflag.FlagSet) {
-	fs.StringVar(&diagnosticsAddress, "diagnostics-address", ":8443",
+// detectClusterType sets the cluster type from the cluster object, SveltosCluster or ClusterAPI
+// Cluster, representing the managed cluster in the management cluster. --cluster-type is only
+// needed when this is ambiguous. Exits on error.
+func detectClusterType(ctx context.Context, cluster *clusterOptions) {
+	c, err := getManagementClusterClient(ctrl.GetConfigOrDie())
+	if err == nil {
+		var detected libsveltosv1alpha1.ClusterType
+		detected, err = kubeconfig.DetectClusterType(ctx, c, cluster.namespace, cluster.name,
+			libsveltosv1alpha1.ClusterType(cluster.clusterType))
+		cluster.clusterType = string(detected)
+	}
+	if err != nil {
+		setupLog.Error(err, "unable to detect cluster type")
+		os.Exit(1)
+	}
+	setupLog.V(logsettings.LogInfo).Info(fmt.Sprintf("cluster type %s", cluster.clusterType))
+}
+
+// setupManagedClusterTransport sets how the managed cluster is reached when running in the
+// management cluster. A tunnel endpoint is an outbound destination. Exits on error.
+func setupManagedClusterTransport(cluster *clusterOptions) {
+	var err error
+	cluster.transport, err = transport.New(transport.Mode(cluster.transportMode), cluster.proxyURL, &cluster.proxyTLS,
+		&transport.Cluster{Namespace: cluster.namespace, Name: cluster.name, Type: cluster.clusterType})
+	if err == nil && cluster.deployedCluster == managedCluster && cluster.transport.Endpoint() != "" {
+		err = fmt.Errorf("tunneling requires running in the management cluster")
+	}
+	if err == nil && cluster.transport.Endpoint() != "" {
+		err = egress.Register("managed-cluster-tunnel", cluster.transport.Endpoint())
+	}
+	if err != nil {
+		setupLog.Error(err, "invalid --managed-cluster-transport")
+		os.Exit(1)
+	}
+}
+
+// setupManagedClusterToken sets, when a token provider is configured, the cloud provider tokens
+// requests to the managed cluster are authenticated with. Exits on error.
+func setupManagedClusterToken(cluster *clusterOptions) {
+	if cluster.tokenProvider == "" {
+		return
+	}
+
+	var err error
+	if cluster.deployedCluster == managedCluster {
+		err = fmt.Errorf("token provider requires running in the management cluster")
+	} else {
+		id := cluster.tokenClusterID
+		if id == "" && cloudauth.Provider(cluster.tokenProvider) == cloudauth.EKS {
+			id = cluster.name
+		}
+		cluster.token, err = cloudauth.New(cloudauth.Provider(cluster.tokenProvider), id)
+	}
+	if err != nil {
+		setupLog.Error(err, "invalid --managed-cluster-token-provider")
+		os.Exit(1)
+	}
+}
+
+func initFlags(fs *pflag.FlagSet, o *options) {
+	fs.StringVar(&o.diagnostics.address, "diagnostics-address", ":8443",
 		"The address the diagnostics endpoint binds to. Per default metrics are served via https and with"+
 			"authentication/authorization. To serve via http and without authentication/authorization set --insecure-diagnostics."+
 			"If --insecure-diagnostics is not set the diagnostics endpoint also serves pprof endpoints and an endpoint to change the log level.")
 
-	fs.BoolVar(&insecureDiagnostics, "insecure-diagnostics", false,
+	fs.BoolVar(&o.diagnostics.insecure, "insecure-diagnostics", false,
 		"Enable insecure diagnostics serving. For more details see the description of --diagnostics-address.")
 
+	fs.StringVar(&o.diagnostics.certDir, "diagnostics-cert-dir", "",
+		"Directory containing tls.crt and tls.key (e.g. mounted from a Secret) the diagnostics endpoint is served with. "+
+			"Certificate is reloaded on rotation. When empty or not found, a self-signed certificate is used.")
+
+	fs.StringVar(&o.diagnostics.clientCAFile, "diagnostics-client-ca-file", "",
+		"PEM encoded CA bundle (e.g. mounted from a Secret). When set, diagnostics endpoint clients must present "+
+			"a certificate signed by one of those CAs, in addition to being authenticated. Bundle is reloaded on rotation.")
+
+	fs.StringVar(&o.diagnostics.adminTokenFile, "admin-token-file", "",
+		"File (e.g. mounted from a Secret) containing a bearer token granting access to all secure diagnostics endpoints, "+
+			"as an alternative to TokenReview authentication. File is read again on each request, so token can be rotated.")
+
+	fs.StringVar(&o.diagnostics.adminAuditFile, "admin-audit-file", "",
+		"File each admin request to the diagnostics endpoint (e.g. forced evaluations) is appended to, as a single-line "+
+			"JSON audit record. Audit records are always logged.")
+
 	flag.StringVar(
-		&runMode,
+		&o.runMode,
 		"run-mode",
 		noUpdates,
 		"indicates whether updates will be sent to management cluster or just created locally",
 	)
 
 	flag.StringVar(
-		&deployedCluster,
+		&o.cluster.deployedCluster,
 		"current-cluster",
 		managedCluster,
 		"Indicate whether drift-detection-manager was deployed in the managed or the management cluster. "+
@@ -189,49 +779,462 @@ func initFlags(fs *pflag.FlagSet) {
 	)
 
 	flag.StringVar(
-		&clusterNamespace,
+		&o.cluster.namespace,
 		"cluster-namespace",
 		"",
 		"cluster namespace",
 	)
 
 	flag.StringVar(
-		&clusterName,
+		&o.cluster.name,
 		"cluster-name",
 		"",
 		"cluster name",
 	)
 
 	flag.StringVar(
-		&clusterType,
+		&o.cluster.clusterType,
 		"cluster-type",
 		"",
-		"cluster type",
+		"cluster type (Capi or Sveltos). When running in the management cluster, it is detected from the existing "+
+			"Cluster or SveltosCluster and only needed if both exist",
 	)
 
-	fs.StringVar(&healthAddr, "health-addr", ":9440",
+	fs.DurationVar(&o.cluster.credentialRefresh, "managed-cluster-credential-refresh", defaultCredentialRefresh,
+		"When running in the management cluster with a managed cluster kubeconfig using an exec credential plugin "+
+			"(EKS/GKE/AKS style), how often the plugin is run again to get new credentials. Must be shorter than credentials "+
+			"lifetime, so that they never expire while in use. Zero means only when expired.")
+
+	fs.StringVar(&o.cluster.tokenProvider, "managed-cluster-token-provider", "",
+		fmt.Sprintf("When running in the management cluster, authenticate to the managed cluster with tokens of the cloud "+
+			"identity of this pod, in place of the credentials in the managed cluster kubeconfig. No exec credential plugin "+
+			"is needed. Tokens are refreshed ahead of expiry. Possible options are %s (IRSA, EKS Pod Identity or AWS_* "+
+			"credentials), %s (metadata server, e.g. GKE workload identity) and %s (Azure workload identity or managed identity).",
+			cloudauth.EKS, cloudauth.GKE, cloudauth.AKS))
+
+	fs.StringVar(&o.cluster.tokenClusterID, "managed-cluster-token-cluster-id", "",
+		"With --managed-cluster-token-provider, the EKS cluster name (defaults to --cluster-name) or the application ID of "+
+			"the AKS AAD server (defaults to the one of AKS managed AAD).")
+
+	fs.BoolVar(&o.cluster.endpointFailover, "managed-cluster-endpoint-failover", false,
+		"When running in the management cluster, consider each context of the managed cluster kubeconfig an API server "+
+			"endpoint of the managed cluster, current context being the preferred one. When requests keep failing with "+
+			"connection errors, next endpoint is used. All contexts must point to the same cluster.")
+
+	fs.StringVar(&o.cluster.transportMode, "managed-cluster-transport", string(transport.Direct),
+		fmt.Sprintf("When running in the management cluster, how the managed cluster API server is reached. Possible options "+
+			"are %s (address in managed cluster kubeconfig) and %s (tunneled through --managed-cluster-proxy-url, e.g. a "+
+			"reverse tunnel server agents in air-gapped managed clusters are connected to).", transport.Direct, transport.HTTPConnect))
+
+	fs.StringVar(&o.cluster.proxyURL, "managed-cluster-proxy-url", "",
+		"URL of the HTTP(S) CONNECT proxy (e.g. konnectivity server) used with --managed-cluster-transport=http-connect. "+
+			"It can reference the managed cluster, e.g. http://tunnel.{{.Namespace}}.svc:8090 ({{.Namespace}}, {{.Name}} "+
+			"and {{.Type}} are available).")
+
+	fs.StringVar(&o.cluster.proxyTLS.CAFile, "managed-cluster-proxy-ca-file", "",
+		"PEM file with the CA verifying the https proxy set with --managed-cluster-proxy-url. System roots if not set.")
+
+	fs.StringVar(&o.cluster.proxyTLS.CertFile, "managed-cluster-proxy-cert-file", "",
+		"PEM file with the client certificate presented to the https proxy set with --managed-cluster-proxy-url, "+
+			"e.g. konnectivity server requiring mTLS. Requires --managed-cluster-proxy-key-file.")
+
+	fs.StringVar(&o.cluster.proxyTLS.KeyFile, "managed-cluster-proxy-key-file", "",
+		"PEM file with the key of --managed-cluster-proxy-cert-file.")
+
+	fs.StringVar(&o.cluster.workloadKubeconfig, "workload-kubeconfig", "",
+		"Path to the kubeconfig of the API server tracked resources are read from, when different from the one "+
+			"ResourceSummaries are stored in (e.g. hosted control plane or vcluster). ResourceSummaries keep being read "+
+			"and updated in the cluster drift-detection-manager is configured for. Same cluster when empty.")
+
+	fs.StringVar(&o.cluster.resourceSummaryLocation, "resource-summary-location", managedCluster,
+		"Where ResourceSummaries are stored. Possible options are managed-cluster or management-cluster. With "+
+			"management-cluster (requires --current-cluster=management-cluster), workloads are watched in the managed "+
+			"cluster while its ResourceSummaries (labeled with cluster name and type, in the cluster namespace) are read "+
+			"and updated in the management cluster, so they need not be replicated into every managed cluster.")
+
+	fs.StringVar(&o.cluster.workloadContext, "workload-kubeconfig-context", "",
+		"Context of --workload-kubeconfig to use. Current context when empty.")
+
+	fs.StringVar(&o.manager.healthAddr, "health-addr", ":9440",
 		"The address the health endpoint binds to.")
 
 	const defautlRestConfigQPS = 40
-	fs.Float32Var(&restConfigQPS, "kube-api-qps", defautlRestConfigQPS,
+	fs.Float32Var(&o.cluster.qps, "kube-api-qps", defautlRestConfigQPS,
 		fmt.Sprintf("Maximum queries per second from the controller client to the Kubernetes API server. Defaults to %d",
 			defautlRestConfigQPS))
 
 	const defaultRestConfigBurst = 60
-	fs.IntVar(&restConfigBurst, "kube-api-burst", defaultRestConfigBurst,
+	fs.IntVar(&o.cluster.burst, "kube-api-burst", defaultRestConfigBurst,
 		fmt.Sprintf("Maximum number of queries that should be allowed in one burst from the controller client to the Kubernetes API server. Default %d",
 			defaultRestConfigBurst))
 
 	const defaultWebhookPort = 9443
-	fs.IntVar(&webhookPort, "webhook-port", defaultWebhookPort,
+	fs.IntVar(&o.manager.webhookPort, "webhook-port", defaultWebhookPort,
 		"Webhook Server port")
 
+	fs.StringVar(&o.integrations.cdeventsEndpoint, "cdevents-endpoint", "",
+		"When set, CloudEvents HTTP endpoint drifts (incident.detected) and their remediation by Sveltos "+
+			"(incident.resolved and service.rolledback) are sent to as CDEvents.")
+
+	fs.StringVar(&o.integrations.syslog.Endpoint, "syslog-endpoint", "",
+		"When set, syslog server (tcp://host:port or tls://host:port) drifts and their remediation by Sveltos are "+
+			"sent to as RFC 5424 messages, e.g. to land drift records in a SIEM.")
+
+	fs.StringVar((*string)(&o.integrations.syslog.Format), "syslog-format", string(siem.RFC5424Format),
+		fmt.Sprintf("Format of messages sent to --syslog-endpoint. Possible options are %s (drift details as "+
+			"structured data), %s (ArcSight Common Event Format) and %s (QRadar Log Event Extended Format).",
+			siem.RFC5424Format, siem.CEFFormat, siem.LEEFFormat))
+
+	fs.StringVar(&o.integrations.syslog.CAFile, "syslog-ca-file", "",
+		"PEM file with the CA verifying the tls syslog server set with --syslog-endpoint. System roots if not set.")
+
+	fs.StringVar(&o.integrations.statsd.Address, "statsd-address", "",
+		"When set, StatsD agent (host:port) metrics are sent to over UDP, for environments where workload clusters "+
+			"are not scraped by Prometheus. Metrics are still exposed to Prometheus.")
+
+	fs.StringVar((*string)(&o.integrations.statsd.Flavor), "statsd-flavor", string(statsd.StatsDFlavor),
+		fmt.Sprintf("Protocol used to send metrics to --statsd-address. Possible options are %s (label values are "+
+			"appended to metric names) and %s (labels are sent as tags).", statsd.StatsDFlavor, statsd.DogStatsDFlavor))
+
+	fs.StringVar(&o.integrations.statsd.Prefix, "statsd-prefix", "",
+		"Prefix of the names of metrics sent to --statsd-address.")
+
+	const defaultStatsDInterval = 10 * time.Second
+	fs.DurationVar(&o.integrations.statsd.Interval, "statsd-interval", defaultStatsDInterval,
+		"How often metrics are sent to --statsd-address.")
+
+	fs.StringSliceVar(&o.integrations.statsd.Tags, "statsd-tags", []string{},
+		"Comma separated list of key:value tags added to all metrics sent to --statsd-address. Requires dogstatsd flavor.")
+
+	fs.StringVar(&o.integrations.issues.Repository, "issue-repository", "",
+		"When set, repository (owner/name on GitHub, project ID or path on GitLab) an issue is opened in for each "+
+			"resource whose drift persists beyond --issue-after. Issue is closed once Sveltos remediates the drift.")
+
+	fs.StringVar((*string)(&o.integrations.issues.Provider), "issue-provider", string(issues.GitHubProvider),
+		fmt.Sprintf("Git provider of --issue-repository. Possible options are %s and %s.",
+			issues.GitHubProvider, issues.GitLabProvider))
+
+	fs.StringVar(&o.integrations.issues.URL, "issue-provider-url", "",
+		"API URL of the Git provider of --issue-repository (e.g. for GitHub Enterprise or self-managed GitLab). "+
+			"Public GitHub or GitLab if not set.")
+
+	fs.StringVar(&o.integrations.issues.TokenFile, "issue-token-file", "",
+		"File (e.g. mounted from a Secret) containing the token issues are opened in --issue-repository with.")
+
+	fs.StringVar(&o.integrations.issues.Label, "issue-label", "sveltos-drift",
+		"Label of the issues opened in --issue-repository. Open issues with this label are reused across restarts.")
+
+	const defaultIssueAfter = time.Hour
+	fs.DurationVar(&o.integrations.issues.After, "issue-after", defaultIssueAfter,
+		"How long drift of a resource must persist before an issue is opened in --issue-repository.")
+
+	fs.StringVar(&o.integrations.tracingEndpoint, "tracing-endpoint", "",
+		"OTLP gRPC endpoint (host:port) traces are exported to. When set, exemplars carrying trace IDs "+
+			"are attached to drift and evaluation latency metrics. Tracing is disabled when empty.")
+
+	fs.BoolVar(&o.integrations.tracingInsecure, "tracing-insecure", false,
+		"Disable TLS when exporting traces to --tracing-endpoint.")
+
+	fs.StringSliceVar(&o.integrations.egressAllowlist, "egress-allowlist", []string{},
+		"Comma separated list of destinations (host, host:port, *.domain or *.domain:port) drift data may be sent to "+
+			"by outbound integrations (e.g. --tracing-endpoint). Startup fails if any configured destination is not "+
+			"listed. Any destination is allowed when empty.")
+
+	const defaultStartupConcurrency = 10
+	fs.IntVar(&o.detection.startupConcurrency, "startup-concurrency", defaultStartupConcurrency,
+		fmt.Sprintf("Maximum number of existing ResourceSummaries processed concurrently on startup. Default %d",
+			defaultStartupConcurrency))
+
+	fs.StringVar(&o.detection.hashMode, "hash-mode", string(driftdetection.FullHashMode),
+		"Which part of a resource is considered when detecting configuration drift. Possible options are "+
+			"full (labels, annotations and any content but metadata and status) or "+
+			"spec (any content but metadata and status). With spec, resources are evaluated using the object "+
+			"carried by the watch event without fetching them again.")
+
+	fs.StringSliceVar(&o.detection.generationAwareKinds, "generation-aware-kinds", []string{},
+		"Comma separated list of Kind.group (e.g. Deployment.apps) whose metadata.generation changes on any spec change. "+
+			"With --hash-mode=spec, resources of those kinds are not evaluated when only metadata/status changed.")
+
+	fs.StringToStringVar(&o.detection.kindIntervals, "kind-evaluation-intervals", map[string]string{},
+		"Comma separated list of Kind.group=interval (e.g. Secret=30s,ConfigMap=5m,Deployment.apps=1m) overriding, "+
+			"per kind, the interval at which resources are evaluated for configuration drift.")
+
+	fs.StringSliceVar(&o.detection.disabledSections, "disabled-sections", []string{},
+		fmt.Sprintf("Comma separated list of ResourceSummary sections whose resources are not tracked. Possible options are %s "+
+			"(resources deployed because of referenced ConfigMaps/Secrets) and %s (resources deployed because of helm charts).",
+			driftdetection.ResourcesSection, driftdetection.HelmSection))
+
+	fs.StringSliceVar(&o.detection.excludedNamespaces, "excluded-namespaces", []string{},
+		"Comma separated list of namespaces (e.g. kube-system) whose resources are never watched nor evaluated. "+
+			"ResourceSummaries listing resources in those namespaces get a warning event.")
+
+	fs.StringSliceVar(&o.detection.includedNamespaces, "included-namespaces", []string{},
+		"Comma separated list of namespaces. When set, only resources in those namespaces are watched and evaluated "+
+			"(cluster wide resources are not) and only ResourceSummaries in those namespaces are processed.")
+
+	fs.StringSliceVar(&o.detection.deniedKinds, "denied-kinds", []string{},
+		"Comma separated list of Kind.group (e.g. Secret,Lease.coordination.k8s.io) whose resources are never watched "+
+			"nor evaluated, whatever ResourceSummaries list. ResourceSummaries listing those resources get a warning event.")
+
+	fs.BoolVar(&o.namespaceScoped, "namespace-scoped", false,
+		"When set, drift-detection-manager never lists nor watches cluster wide resources, so it can run with namespaced "+
+			"RBAC (see config/namespaced): DriftDetectionConfig and log settings are ignored. Requires --included-namespaces.")
+
+	fs.BoolVar(&o.reporting.reportOnly, "report-only", false,
+		"When set, configuration drifts are detected, logged, counted in metrics and recorded as drift events, "+
+			"but ResourceSummaries are never marked for reconciliation. Use it to evaluate drift noise first.")
+
+	fs.StringVar(&o.detection.fieldExclusionsFile, "field-exclusions-file", "",
+		"Path to a YAML list of field exclusions: fields (JSON pointers, or fields owned by given field managers) of "+
+			"matching resources whose changes are not configuration drifts. Each entry has group, kind, namespace, name, "+
+			"jsonPointers and managedFieldsManagers. Argo CD ignoreDifferences can be translated with the import-argocd subcommand.")
+
+	fs.StringVar(&o.reporting.fluxOwnership, "flux-ownership", string(driftdetection.ReportFluxOwned),
+		fmt.Sprintf("How drifts of resources carrying Flux Kustomization or HelmRelease ownership labels are handled, so "+
+			"that clusters mixing Sveltos and Flux do not get duplicate drift signals. Possible options are %s (like any "+
+			"other resource), %s (recorded as report-only drift events, ResourceSummaries are not marked for "+
+			"reconciliation) and %s (ignored, as Flux reverts them).",
+			driftdetection.ReportFluxOwned, driftdetection.DownrankFluxOwned, driftdetection.SkipFluxOwned))
+
+	fs.StringVar(&o.detection.terraformOwnership, "terraform-ownership", string(driftdetection.ReportTerraformOwned),
+		fmt.Sprintf("How drifts of resources managed by Terraform (labeled app.kubernetes.io/managed-by=terraform, or with "+
+			"fields owned by Terraform field managers) are handled, so that clusters mixing Sveltos and Terraform do not "+
+			"get drift reports each tool reverting the other's changes. Possible options are %s (like any other resource), "+
+			"%s (changes to fields owned by Terraform are ignored) and %s (drifts of whole resources are ignored).",
+			driftdetection.ReportTerraformOwned, driftdetection.ExcludeTerraformFields, driftdetection.SkipTerraformOwned))
+
+	fs.BoolVar(&o.detection.crossplaneAware, "crossplane-aware", true,
+		"When set, fields Crossplane populates in claims and composite resources, and bookkeeping annotations of "+
+			"managed resources, are not considered. Drift is evaluated at claim level: drifts of composite resources "+
+			"bound to a claim and of composed resources are ignored, as Crossplane reconciles them.")
+
+	fs.BoolVar(&o.detection.sidecarNormalization, "normalize-sidecars", true,
+		"When set, containers, init containers, volumes, labels and annotations injected by Istio and Linkerd are "+
+			"removed from pod templates before hashing, so that sidecar injection is not reported as drift.")
+
+	fs.BoolVar(&o.detection.certManagerRotation, "cert-manager-rotation", true,
+		"When set, data keys cert-manager rotates on renewal (tls.crt, tls.key, ca.crt and keystores) are ignored in "+
+			"Secrets owned by a cert-manager Certificate. Drift is only reported if owning Certificate or other keys change.")
+
+	fs.BoolVar(&o.detection.externalSecretsAware, "external-secrets-aware", false,
+		"When set, in Secrets managed by an External Secrets Operator ExternalSecret, data fields written by ESO (per "+
+			"managedFields) are ignored, so periodic refreshes are not reported as drift. Manual edits and changes of "+
+			"the managing ExternalSecret are still reported.")
+
+	fs.DurationVar(&o.reporting.helmValuesInterval, "helm-values-interval", 0,
+		"When set, interval at which values of the deployed revision of each Helm release listed in ResourceSummaries "+
+			"are compared against the values Sveltos deployed it with. Differences (e.g. a manual helm upgrade --set) are "+
+			"reported as values drifts. Requires list permission on Secrets. Zero disables it.")
+
+	fs.DurationVar(&o.reporting.policyReportInterval, "policy-report-interval", 0,
+		"When set, interval at which drift events are written as PolicyReports and a ClusterPolicyReport "+
+			"(wgpolicyk8s.io/v1alpha2) in the managed cluster, so that tools like Policy Reporter show drifts. "+
+			"PolicyReport CRDs must be installed. Zero disables it.")
+
+	fs.StringVar(&o.reporting.eventSourceName, "event-source-name", "",
+		"When set, resources which drifted are written as the EventReport of the EventSource with this name, "+
+			"where ResourceSummaries are stored, so that Sveltos EventTriggers referencing it react to drifts "+
+			"(notifications, automation). Disabled when empty.")
+
+	const defaultEventReportInterval = 1
+	fs.DurationVar(&o.reporting.eventReportInterval, "event-report-interval", defaultEventReportInterval*time.Minute,
+		fmt.Sprintf("Interval at which the EventReport of --event-source-name is written. It lists resources which "+
+			"drifted during last interval. Default: %d minute", defaultEventReportInterval))
+
+	fs.StringVar(&o.reporting.componentLabel, "component-label", "app.kubernetes.io/part-of",
+		fmt.Sprintf("Label tracked resources are grouped by when serving drift per component at %s on the "+
+			"diagnostics endpoint (e.g. for a developer portal). Can be overridden by the label query parameter.",
+			driftdetection.ComponentsPath))
+
+	fs.BoolVar(&o.reporting.inventoryCorrelation, "inventory-correlation", false,
+		"When set, tracked resources listed by an inventory (Flux Kustomization or cli-utils inventory ConfigMap) and "+
+			"deleted after being removed from it are recorded as intentionally pruned, rather than reported as drifts.")
+
+	fs.BoolVar(&o.reporting.driftEventsStdout, "drift-events-stdout", false,
+		"When set, each drift event is also written to stdout as a single-line JSON record. Logs go to stderr, "+
+			"so log collectors can ingest structured drift data from stdout.")
+
+	fs.StringVar(&o.reporting.driftEventsFormat, "drift-events-format", string(driftdetection.NativeDriftEventFormat),
+		fmt.Sprintf("Format of drift events written to stdout. Possible options are %s and %s (like violations "+
+			"logged by OPA Gatekeeper audit, so that drifts show up next to policy violations).",
+			driftdetection.NativeDriftEventFormat, driftdetection.GatekeeperDriftEventFormat))
+
+	fs.BoolVar(&o.security.fips, "fips", false,
+		"When set, drift-detection-manager refuses to start unless built in FIPS mode (see make build-fips), "+
+			"so that all cryptography goes through a FIPS validated module. Mode is reported in DriftDetectionConfig status.")
+
+	fs.StringVar(&o.security.driftEventSigningKeyFile, "drift-event-signing-key-file", "",
+		"File (e.g. mounted from a Secret) containing the key drift events are signed with (HMAC-SHA256), so that "+
+			"consumers can verify drift events were neither forged nor altered. Key is read at startup.")
+
+	fs.StringVar(&o.security.impersonateUser, "as", "",
+		"Username to impersonate when reading (watching, listing and fetching) tracked resources, so that drift "+
+			"detection runs with reduced privileges. ResourceSummaries are still managed with own identity, which "+
+			"must be granted the impersonate verb on this user (and on --as-group groups).")
+
+	fs.StringSliceVar(&o.security.impersonateGroups, "as-group", []string{},
+		"Groups to impersonate when reading tracked resources. Only used when --as is set.")
+
+	fs.BoolVar(&o.preflightOnly, "preflight", false,
+		"When set, only verify API server connectivity, required CRDs, RBAC and (when running in the management "+
+			"cluster) managed cluster reachability, print a report and exit. Exit code is non zero if any check failed. "+
+			"Meant for init containers and install verification.")
+
+	features.MutableFeatureGate.AddFlag(fs)
+
+	fs.StringVar(&o.configFile, "config-file", "",
+		"YAML file (e.g. a mounted ConfigMap) with settings to change without restart: logLevel and any field of "+
+			"DriftDetectionConfig spec. Reloaded on SIGHUP and whenever its content changes. Settings in the default "+
+			"DriftDetectionConfig, if any, take precedence.")
+
+	fs.StringVar(&o.detection.memoryBudget, "memory-budget", "",
+		"Maximum heap drift-detection-manager should use (e.g. 400Mi). When exceeded, watchers caching most objects "+
+			"are stopped and corresponding resources are evaluated every --polling-interval instead. Disabled when empty.")
+
+	const defaultPollingInterval = 1
+	fs.DurationVar(&o.detection.pollingInterval, "polling-interval", defaultPollingInterval*time.Minute,
+		fmt.Sprintf("Interval at which resources whose watcher was stopped because of --memory-budget are evaluated. Default: %d minute",
+			defaultPollingInterval))
+
+	fs.DurationVar(&o.detection.maxPollingInterval, "max-polling-interval", 0,
+		"When greater than --polling-interval, resources evaluated by polling which have not changed in a long time are "+
+			"evaluated less frequently, up to this interval, while recently changed ones keep being evaluated every --polling-interval. "+
+			"Only applies in polling mode, to resources of GVKs whose watcher was stopped because of --memory-budget: "+
+			"watched resources are evaluated as they change.")
+
+	fs.StringVar(&o.detection.incrementalThreshold, "incremental-hash-threshold", "1Mi",
+		"Data size above which the per-key digests of ConfigMaps and Secrets are kept, so that keys changed by a "+
+			"drift are reported. Hashes do not depend on it. Set to 0 to disable.")
+
+	const defaultListPageSize = 500
+	fs.Int64Var(&o.detection.listPageSize, "list-page-size", defaultListPageSize,
+		fmt.Sprintf("Maximum number of objects returned by each LIST request issued when baselining tracked "+
+			"resources on startup and when scanning GVKs in polling mode. Default: %d", defaultListPageSize))
+
+	const defaultDiscoveryCacheTTL = 10
+	fs.DurationVar(&o.detection.discoveryCacheTTL, "discovery-cache-ttl", defaultDiscoveryCacheTTL*time.Minute,
+		fmt.Sprintf("How long discovery results are cached. Cached results are also dropped when a resource mapping "+
+			"cannot be found. Default: %d minutes", defaultDiscoveryCacheTTL))
+
+	const defaultDriftConfirmations = 1
+	fs.UintVar(&o.detection.driftConfirmations, "drift-confirmations", defaultDriftConfirmations,
+		"Number of consecutive evaluations which must find a resource drifted before drift is reported. "+
+			"Higher values avoid reconciliations caused by controllers rapidly reverting changes, at the cost of detection latency.")
+
+	fs.StringVar(&o.detection.pausedWatchers, "paused-cluster-watchers", string(driftdetection.KeepPausedWatchers),
+		fmt.Sprintf("When running in the management cluster, drift detection is suspended while the managed cluster is "+
+			"paused. This defines what happens to watchers meanwhile. Possible options are %s (changes keep being queued) "+
+			"and %s (watchers are stopped, releasing their caches, and started again on unpause).",
+			driftdetection.KeepPausedWatchers, driftdetection.StopPausedWatchers))
+
+	fs.Float32Var(&o.detection.evaluationQPS, "evaluation-qps", 0,
+		"Maximum number of resources evaluated per second, so that a drift storm cannot use more than its share of CPU "+
+			"and API server requests. In fanout mode, this is the budget of each managed cluster. No limit when 0.")
+
+	const defaultEvaluationBurst = 10
+	fs.IntVar(&o.detection.evaluationBurst, "evaluation-burst", defaultEvaluationBurst,
+		fmt.Sprintf("Maximum number of resources evaluated in one burst. Only used when --evaluation-qps is set. Default: %d",
+			defaultEvaluationBurst))
+
+	fs.StringVar(&o.state.snapshotPath, "state-snapshot-path", "",
+		"File where state of tracked resources is persisted (e.g. on an emptyDir volume). On restart, resources whose "+
+			"state was persisted are neither fetched nor hashed again. Disabled when empty.")
+
+	fs.StringVar(&o.state.kekFile, "state-snapshot-kek-file", "",
+		"File (e.g. mounted from a Secret managed by an external secret store) containing a base64 encoded 32 bytes key. "+
+			"When set, persisted state is envelope encrypted: each snapshot with a new data key, wrapped with this key.")
+
+	fs.BoolVar(&o.state.plaintextMigration, "state-snapshot-plaintext-migration", false,
+		"With --state-snapshot-kek-file, load once persisted state found in plaintext (written before encryption was "+
+			"enabled). Otherwise state in plaintext is rejected. Only set it for the first restart after enabling encryption.")
+
+	fs.BoolVar(&o.manager.leaderElect, "leader-elect", false,
+		"Enable leader election, so that two replicas can run active-passive: only the leader tracks drift. "+
+			"Use with --state-checkpoint-secret so that on failover tracking resumes from leader state.")
+
+	fs.StringVar(&o.manager.leaderElectionNamespace, "leader-election-namespace", "projectsveltos",
+		"Namespace of the leader election Lease and of the state checkpoint Secrets.")
+
+	fs.StringVar(&o.state.checkpointSecret, "state-checkpoint-secret", "",
+		"Name of the Secrets where state of tracked resources is persisted, instead of --state-snapshot-path. Unlike a "+
+			"local file, state is available to a standby replica (see --leader-elect), which prefetches it, so on failover "+
+			"tracked resources are neither fetched nor hashed again. Disabled when empty.")
+
+	const defaultSnapshotInterval = 5
+	fs.DurationVar(&o.state.snapshotInterval, "state-snapshot-interval", defaultSnapshotInterval*time.Minute,
+		fmt.Sprintf("Interval at which state of tracked resources is persisted. Default: %d minutes", defaultSnapshotInterval))
+
 	const defaultSyncPeriod = 10
-	fs.DurationVar(&syncPeriod, "sync-period", defaultSyncPeriod*time.Minute,
+	fs.DurationVar(&o.manager.syncPeriod, "sync-period", defaultSyncPeriod*time.Minute,
 		fmt.Sprintf("The minimum interval at which watched resources are reconciled (e.g. 15m). Default: %d minutes",
 			defaultSyncPeriod))
 }
 
+// applyEnvOverrides sets every flag not passed on the command line from the environment variable
+// named envPrefix followed by the flag name in upper case, with dashes replaced by underscores
+// (e.g. DRIFT_DETECTION_POLLING_INTERVAL for --polling-interval, DRIFT_DETECTION_V for --v).
+// This allows configuring drift-detection-manager via a ConfigMap and envFrom.
+//
+// Precedence, from highest to lowest, is:
+//  1. DriftDetectionConfig named default (only settings it exposes);
+//  2. --config-file (only settings DriftDetectionConfig exposes, plus log level);
+//  3. command line flags;
+//  4. environment variables;
+//  5. flag defaults.
+func applyEnvOverrides(fs *pflag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", name, setErr)
+		}
+	})
+	return err
+}
+
+// runSubcommand runs the subcommand passed as first argument, if any.
+// Returns false if no subcommand was requested.
+func runSubcommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+
+	var run func(ctx context.Context, args []string, out io.Writer) error
+	switch os.Args[1] {
+	case bench.Name:
+		run = bench.Run
+	case loadgen.Name:
+		run = loadgen.Run
+	case inspect.Name:
+		run = inspect.Run
+	case validate.Name:
+		run = validate.Run
+	case fanout.Name:
+		run = fanout.Run
+	case fanout.CompareName:
+		run = fanout.RunCompare
+	case argocd.Name:
+		run = argocd.Run
+	case alerts.Name:
+		run = alerts.Run
+	default:
+		return false
+	}
+
+	if err := run(ctrl.SetupSignalHandler(), os.Args[2:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+	return true
+}
+
 func setupChecks(mgr ctrl.Manager) {
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
@@ -243,20 +1246,244 @@ func setupChecks(mgr ctrl.Manager) {
 	}
 }
 
-func initializeManager(ctx context.Context, mgr ctrl.Manager, sendUpdates controllers.Mode,
-	clusterNamespace, clusterName string, clusterType libsveltosv1alpha1.ClusterType,
-	logger logr.Logger) {
+// configureDriftDetection passes drift detection settings to the driftdetection package.
+// Must be called before the drift detection manager is initialized.
+func configureDriftDetection(o *options) {
+	driftdetection.SetReadResourceSummariesConcurrency(o.detection.startupConcurrency)
+
+	switch driftdetection.HashMode(o.detection.hashMode) {
+	case driftdetection.FullHashMode, driftdetection.SpecHashMode:
+		driftdetection.SetHashMode(driftdetection.HashMode(o.detection.hashMode))
+	default:
+		setupLog.Error(fmt.Errorf("unsupported hash mode %q", o.detection.hashMode), "invalid --hash-mode")
+		os.Exit(1)
+	}
+
+	driftdetection.SetGenerationAwareGroupKinds(parseGroupKinds(o.detection.generationAwareKinds))
+	configureFieldExclusions(&o.detection)
+	driftdetection.SetCrossplaneAware(o.detection.crossplaneAware)
+	driftdetection.SetSidecarNormalization(o.detection.sidecarNormalization)
+	driftdetection.SetCertManagerRotation(o.detection.certManagerRotation)
+	driftdetection.SetExternalSecretsAware(o.detection.externalSecretsAware)
+	driftdetection.SetDeniedKinds(parseGroupKinds(o.detection.deniedKinds))
+
+	sections := make([]driftdetection.Section, len(o.detection.disabledSections))
+	for i := range o.detection.disabledSections {
+		sections[i] = driftdetection.Section(o.detection.disabledSections[i])
+		if sections[i] != driftdetection.ResourcesSection && sections[i] != driftdetection.HelmSection {
+			setupLog.Error(fmt.Errorf("unsupported section %q", o.detection.disabledSections[i]), "invalid --disabled-sections")
+			os.Exit(1)
+		}
+	}
+	driftdetection.SetDisabledSections(sections)
+
+	driftdetection.SetExcludedNamespaces(o.detection.excludedNamespaces)
+	driftdetection.SetIncludedNamespaces(o.detection.includedNamespaces)
+	intervals := make(map[schema.GroupKind]time.Duration, len(o.detection.kindIntervals))
+	for kind, value := range o.detection.kindIntervals {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			setupLog.Error(err, "invalid --kind-evaluation-intervals", "kind", kind)
+			os.Exit(1)
+		}
+		intervals[schema.ParseGroupKind(kind)] = interval
+	}
+	driftdetection.SetKindEvaluationIntervals(intervals)
+
+	if o.detection.memoryBudget != "" {
+		budget, err := resource.ParseQuantity(o.detection.memoryBudget)
+		if err != nil {
+			setupLog.Error(err, "invalid --memory-budget")
+			os.Exit(1)
+		}
+		driftdetection.SetMemoryBudget(uint64(budget.Value()), o.detection.pollingInterval)
+	}
+	driftdetection.SetMaxPollingInterval(o.detection.maxPollingInterval)
+
+	threshold, err := resource.ParseQuantity(o.detection.incrementalThreshold)
+	if err != nil {
+		setupLog.Error(err, "invalid --incremental-hash-threshold")
+		os.Exit(1)
+	}
+	driftdetection.SetIncrementalHashThreshold(uint64(threshold.Value()))
+
+	driftdetection.SetListPageSize(o.detection.listPageSize)
+
+	driftdetection.SetEvaluationBudget(o.detection.evaluationQPS, o.detection.evaluationBurst)
+
+	switch driftdetection.PausedWatchers(o.detection.pausedWatchers) {
+	case driftdetection.KeepPausedWatchers, driftdetection.StopPausedWatchers:
+		driftdetection.SetPausedWatchers(driftdetection.PausedWatchers(o.detection.pausedWatchers))
+	default:
+		setupLog.Error(fmt.Errorf("unsupported mode %q", o.detection.pausedWatchers), "invalid --paused-cluster-watchers")
+		os.Exit(1)
+	}
+
+	driftdetection.SetDiscoveryCacheTTL(o.detection.discoveryCacheTTL)
+
+	driftdetection.SetDriftConfirmations(o.detection.driftConfirmations)
+
+	driftdetection.SetSnapshot(o.state.snapshotPath, o.state.snapshotInterval)
+
+	configureDriftReporting(o)
+	configureDriftDetectionSecurity(o)
+}
+
+// configureFieldExclusions sets the fields excluded from drift detection: the ones listed in
+// --field-exclusions-file and, depending on --terraform-ownership, the ones owned by Terraform.
+// Exits on error.
+func configureFieldExclusions(detection *detectionOptions) {
+	var exclusions []driftdetection.FieldExclusion
+	if detection.fieldExclusionsFile != "" {
+		data, err := os.ReadFile(detection.fieldExclusionsFile)
+		if err == nil {
+			exclusions, err = driftdetection.ReadFieldExclusions(data)
+		}
+		if err != nil {
+			setupLog.Error(err, "invalid --field-exclusions-file")
+			os.Exit(1)
+		}
+	}
+
+	switch driftdetection.TerraformOwnership(detection.terraformOwnership) {
+	case driftdetection.ExcludeTerraformFields:
+		exclusions = append(exclusions, driftdetection.TerraformFieldExclusion())
+	case driftdetection.ReportTerraformOwned, driftdetection.SkipTerraformOwned:
+	default:
+		setupLog.Error(fmt.Errorf("unsupported mode %q", detection.terraformOwnership), "invalid --terraform-ownership")
+		os.Exit(1)
+	}
+	driftdetection.SetTerraformOwnership(driftdetection.TerraformOwnership(detection.terraformOwnership))
+
+	if err := driftdetection.SetFieldExclusions(exclusions); err != nil {
+		setupLog.Error(err, "invalid --field-exclusions-file")
+		os.Exit(1)
+	}
+}
+
+// configureDriftReporting sets how detected drifts are reported. Exits on error.
+func configureDriftReporting(o *options) {
+	driftdetection.SetReportOnly(o.reporting.reportOnly)
+	if o.reporting.driftEventsStdout {
+		driftdetection.SetDriftEventOutput(os.Stdout)
+	}
+	switch driftdetection.DriftEventFormat(o.reporting.driftEventsFormat) {
+	case driftdetection.NativeDriftEventFormat, driftdetection.GatekeeperDriftEventFormat:
+		driftdetection.SetDriftEventFormat(driftdetection.DriftEventFormat(o.reporting.driftEventsFormat))
+	default:
+		setupLog.Error(fmt.Errorf("unsupported format %q", o.reporting.driftEventsFormat), "invalid --drift-events-format")
+		os.Exit(1)
+	}
+	driftdetection.SetHelmValuesInterval(o.reporting.helmValuesInterval)
+	driftdetection.SetInventoryCorrelation(o.reporting.inventoryCorrelation)
+	driftdetection.SetPolicyReportInterval(o.reporting.policyReportInterval)
+	driftdetection.SetEventReports(o.reporting.eventSourceName, o.reporting.eventReportInterval,
+		o.cluster.resourceSummaryLocation == managementCluster)
+	driftdetection.SetComponentLabel(o.reporting.componentLabel)
+
+	switch driftdetection.FluxOwnership(o.reporting.fluxOwnership) {
+	case driftdetection.ReportFluxOwned, driftdetection.DownrankFluxOwned, driftdetection.SkipFluxOwned:
+		driftdetection.SetFluxOwnership(driftdetection.FluxOwnership(o.reporting.fluxOwnership))
+	default:
+		setupLog.Error(fmt.Errorf("unsupported mode %q", o.reporting.fluxOwnership), "invalid --flux-ownership")
+		os.Exit(1)
+	}
+}
+
+// parseGroupKinds parses kinds in the Kind.group format (e.g. Deployment.apps)
+func parseGroupKinds(kinds []string) []schema.GroupKind {
+	groupKinds := make([]schema.GroupKind, len(kinds))
+	for i := range kinds {
+		groupKinds[i] = schema.ParseGroupKind(kinds[i])
+	}
+	return groupKinds
+}
+
+// configureDriftDetectionSecurity configures the identity tracked resources are read with,
+// signing of drift events and encryption of persisted state
+func configureDriftDetectionSecurity(o *options) {
+	if o.security.impersonateUser == "" && len(o.security.impersonateGroups) != 0 {
+		setupLog.Error(fmt.Errorf("--as-group requires --as"), "invalid --as-group")
+		os.Exit(1)
+	}
+	driftdetection.SetImpersonation(o.security.impersonateUser, o.security.impersonateGroups)
+	if o.security.driftEventSigningKeyFile != "" {
+		key, err := os.ReadFile(o.security.driftEventSigningKeyFile)
+		if err == nil && len(bytes.TrimSpace(key)) == 0 {
+			err = fmt.Errorf("%s is empty", o.security.driftEventSigningKeyFile)
+		}
+		if err != nil {
+			setupLog.Error(err, "invalid --drift-event-signing-key-file")
+			os.Exit(1)
+		}
+		driftdetection.SetDriftEventSigningKey(bytes.TrimSpace(key))
+	}
+	if o.state.kekFile != "" {
+		kek, err := kms.NewLocal(o.state.kekFile)
+		if err != nil {
+			setupLog.Error(err, "invalid --state-snapshot-kek-file")
+			os.Exit(1)
+		}
+		driftdetection.SetSnapshotEncryption(kek)
+		driftdetection.SetPlaintextSnapshotMigration(o.state.plaintextMigration)
+	}
+}
+
+// setupRuntimeSettings starts watching config file, if any, and DriftDetectionConfig, so drift detection
+// settings can be changed without restart. DriftDetectionConfig is skipped if its CRD is not installed.
+// Must be called after configureDriftDetection: settings passed via flags are used as defaults.
+func setupRuntimeSettings(ctx context.Context, mgr ctrl.Manager, o *options) {
+	controllers.SetFlagRuntimeSettings(driftdetection.GetRuntimeSettings())
+
+	if o.configFile != "" {
+		go controllers.WatchConfigFile(ctx, o.configFile, ctrl.Log.WithName("config-file"))
+	}
+
+	if o.namespaceScoped {
+		// DriftDetectionConfig is cluster wide
+		setupLog.V(logsettings.LogInfo).Info("namespace scoped: DriftDetectionConfig is ignored")
+		return
+	}
+
+	_, err := mgr.GetRESTMapper().RESTMapping(schema.GroupKind{
+		Group: driftdetectionv1alpha1.GroupVersion.Group,
+		Kind:  driftdetectionv1alpha1.DriftDetectionConfigKind,
+	}, driftdetectionv1alpha1.GroupVersion.Version)
+	if err != nil {
+		setupLog.V(logsettings.LogInfo).Info(fmt.Sprintf("DriftDetectionConfig not available: %v", err))
+		return
+	}
+
+	if err := (&controllers.DriftDetectionConfigReconciler{
+		Client: mgr.GetClient(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DriftDetectionConfig")
+		os.Exit(1)
+	}
+}
+
+func initializeManager(ctx context.Context, mgr ctrl.Manager, workloadConfig *rest.Config, sendUpdates controllers.Mode,
+	cluster *clusterOptions, logger logr.Logger) {
 
 	const intervalInSecond = 5
 
+	driftdetection.SetEventRecorder(mgr.GetEventRecorderFor("drift-detection-manager"))
+
+	// With --leader-elect, only the leader tracks drift
+	select {
+	case <-mgr.Elected():
+	case <-ctx.Done():
+		return
+	}
+
 	for {
 		var err error
 		if sendUpdates == controllers.SendUpdates {
-			err = driftdetection.InitializeManager(ctx, mgr.GetLogger(), mgr.GetConfig(), mgr.GetClient(), mgr.GetScheme(),
-				clusterNamespace, clusterName, clusterType, intervalInSecond, true)
+			err = driftdetection.InitializeManager(ctx, mgr.GetLogger(), workloadConfig, mgr.GetClient(), mgr.GetScheme(),
+				cluster.namespace, cluster.name, libsveltosv1alpha1.ClusterType(cluster.clusterType), intervalInSecond, true)
 		} else {
-			err = driftdetection.InitializeManager(ctx, mgr.GetLogger(), mgr.GetConfig(), mgr.GetClient(), mgr.GetScheme(),
-				clusterNamespace, clusterName, clusterType, intervalInSecond, false)
+			err = driftdetection.InitializeManager(ctx, mgr.GetLogger(), workloadConfig, mgr.GetClient(), mgr.GetScheme(),
+				cluster.namespace, cluster.name, libsveltosv1alpha1.ClusterType(cluster.clusterType), intervalInSecond, false)
 		}
 
 		if err != nil {
@@ -268,61 +1495,259 @@ func initializeManager(ctx context.Context, mgr ctrl.Manager, sendUpdates contro
 		logger.V(logsettings.LogInfo).Info("manager initialized")
 		break
 	}
+
+	if cluster.deployedCluster != managedCluster {
+		// Paused state is only visible from the management cluster
+		go followClusterPaused(ctx, cluster, logger)
+	}
+}
+
+// followClusterPaused suspends drift detection while the managed cluster (SveltosCluster or
+// ClusterAPI Cluster) is paused, checking it every clusterPausedCheckInterval till ctx is canceled
+func followClusterPaused(ctx context.Context, cluster *clusterOptions, logger logr.Logger) {
+	c, err := getManagementClusterClient(ctrl.GetConfigOrDie())
+	if err != nil {
+		logger.V(logsettings.LogInfo).Info(fmt.Sprintf("cannot follow cluster paused state: %v", err))
+		return
+	}
+
+	ticker := time.NewTicker(clusterPausedCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		paused, err := clusterproxy.IsClusterPaused(ctx, c, cluster.namespace, cluster.name,
+			libsveltosv1alpha1.ClusterType(cluster.clusterType))
+		if err != nil {
+			logger.V(logsettings.LogInfo).Info(fmt.Sprintf("failed to get cluster paused state: %v", err))
+		} else if err := driftdetection.SetPaused(ctx, paused); err != nil {
+			logger.V(logsettings.LogInfo).Info(fmt.Sprintf("failed to set paused state: %v", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
-func getManagedClusterRestConfig(ctx context.Context, cfg *rest.Config, logger logr.Logger) *rest.Config {
-	logger = logger.WithValues("cluster", fmt.Sprintf("%s:%s/%s", clusterType, clusterNamespace, clusterName))
+// getManagedClusterRestConfig returns the rest config of the managed cluster. Kubeconfig is
+// periodically fetched again and, on rotation, new credentials are transparently used, so
+// that no restart (which would drop all tracking state) is needed.
+func getManagedClusterRestConfig(ctx context.Context, cfg *rest.Config, cluster *clusterOptions,
+	logger logr.Logger) *rest.Config {
+	logger = logger.WithValues("cluster", cluster.String())
 	logger.V(logsettings.LogInfo).Info("get secret with kubeconfig")
 
+	rotator, err := kubeconfig.NewRotator(ctx, func(ctx context.Context) ([]*rest.Config, error) {
+		return fetchManagedClusterEndpoints(ctx, cfg, cluster)
+	}, logger)
+	if err != nil {
+		logger.V(logsettings.LogInfo).Info(err.Error())
+		panic(1)
+	}
+	rotator.SetCredentialRefresh(cluster.credentialRefresh)
+	go rotator.Start(ctx)
+
+	return rotator.Config()
+}
+
+// fetchManagedClusterEndpoints returns the rest configs of the API server endpoints of the
+// managed cluster, read from the management cluster cfg points to. With endpoint failover,
+// there is one per kubeconfig context, otherwise only the one of current context.
+func fetchManagedClusterEndpoints(ctx context.Context, cfg *rest.Config, cluster *clusterOptions) ([]*rest.Config, error) {
+	if !cluster.endpointFailover {
+		currentCfg, err := fetchManagedClusterRestConfig(ctx, cfg, cluster)
+		if err != nil {
+			return nil, err
+		}
+		return []*rest.Config{currentCfg}, nil
+	}
+
+	c, err := getManagementClusterClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := clusterproxy.GetSecretData(ctx, c, cluster.namespace, cluster.name, "", "",
+		libsveltosv1alpha1.ClusterType(cluster.clusterType), textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+	configs, err := kubeconfig.ContextConfigs(data)
+	if err != nil {
+		return nil, err
+	}
+	for i := range configs {
+		if cluster.transport != nil {
+			cluster.transport.Configure(configs[i])
+		}
+		if cluster.token != nil {
+			cluster.token.Configure(configs[i])
+		}
+	}
+
+	return configs, nil
+}
+
+// fetchManagedClusterRestConfig returns the rest config of the managed cluster, read from the
+// management cluster cfg points to
+func fetchManagedClusterRestConfig(ctx context.Context, cfg *rest.Config, cluster *clusterOptions) (*rest.Config, error) {
+	c, err := getManagementClusterClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// In this mode, drift-detection-manager is running in the management cluster.
+	// It access the managed cluster from here.
+	currentCfg, err := clusterproxy.GetKubernetesRestConfig(ctx, c, cluster.namespace, cluster.name, "", "",
+		libsveltosv1alpha1.ClusterType(cluster.clusterType), textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+	if cluster.transport != nil {
+		cluster.transport.Configure(currentCfg)
+	}
+	if cluster.token != nil {
+		cluster.token.Configure(currentCfg)
+	}
+
+	return currentCfg, nil
+}
+
+// getManagementClusterClient returns a client of the management cluster cfg points to
+func getManagementClusterClient(cfg *rest.Config) (client.Client, error) {
 	// When running in the management cluster, drift-detection-manager will need
 	// to access Secret and Cluster/SveltosCluster (to verify existence)
 	s := runtime.NewScheme()
 	if err := clientgoscheme.AddToScheme(s); err != nil {
-		panic(1)
+		return nil, err
 	}
 	if err := clusterv1.AddToScheme(s); err != nil {
-		panic(1)
+		return nil, err
 	}
 	if err := libsveltosv1alpha1.AddToScheme(s); err != nil {
-		panic(1)
+		return nil, err
 	}
 
 	c, err := client.New(cfg, client.Options{Scheme: s})
 	if err != nil {
-		logger.V(logsettings.LogInfo).Info(fmt.Sprintf("failed to get management cluster client: %v", err))
-		panic(1)
+		return nil, fmt.Errorf("failed to get management cluster client: %w", err)
 	}
+	return c, nil
+}
 
-	// In this mode, drift-detection-manager is running in the management cluster.
-	// It access the managed cluster from here.
-	var currentCfg *rest.Config
-	currentCfg, err = clusterproxy.GetKubernetesRestConfig(ctx, c, clusterNamespace, clusterName, "", "",
-		libsveltosv1alpha1.ClusterType(clusterType), textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))
-	if err != nil {
-		logger.V(logsettings.LogInfo).Info(fmt.Sprintf("failed to get secret: %v", err))
-		panic(1)
+// getCacheOptions returns the options for the controller-runtime cache. When included namespaces
+// are set, namespaced objects (ResourceSummaries) are only cached in those namespaces.
+func getCacheOptions(o *options) cache.Options {
+	options := cache.Options{
+		SyncPeriod: &o.manager.syncPeriod,
+	}
+
+	if o.cluster.resourceSummaryLocation == managementCluster {
+		// ResourceSummaries of all managed clusters are stored in the management cluster. Only those
+		// of this managed cluster are cached. Included namespaces refer to the managed cluster.
+		options.ByObject = map[client.Object]cache.ByObject{
+			&libsveltosv1alpha1.ResourceSummary{}: controllers.ManagedClusterResourceSummaries(o.cluster.namespace,
+				o.cluster.name, o.cluster.clusterType),
+		}
+		return options
+	}
+
+	if len(o.detection.includedNamespaces) > 0 {
+		options.DefaultNamespaces = make(map[string]cache.Config, len(o.detection.includedNamespaces))
+		for i := range o.detection.includedNamespaces {
+			options.DefaultNamespaces[o.detection.includedNamespaces[i]] = cache.Config{}
+		}
 	}
 
-	return currentCfg
+	return options
 }
 
 // getDiagnosticsOptions returns metrics options which can be used to configure a Manager.
-func getDiagnosticsOptions() metricsserver.Options {
+func getDiagnosticsOptions(ctx context.Context, diagnostics *diagnosticsOptions) metricsserver.Options {
 	// If "--insecure-diagnostics" is set, serve metrics via http
 	// and without authentication/authorization.
-	if insecureDiagnostics {
+	if diagnostics.insecure {
+		if diagnostics.certDir != "" || diagnostics.clientCAFile != "" {
+			setupLog.Error(fmt.Errorf("TLS options require secure diagnostics"),
+				"--diagnostics-cert-dir and --diagnostics-client-ca-file cannot be used with --insecure-diagnostics")
+			os.Exit(1)
+		}
+		if diagnostics.adminTokenFile != "" || diagnostics.adminAuditFile != "" {
+			setupLog.Error(fmt.Errorf("admin options require secure diagnostics"),
+				"--admin-token-file and --admin-audit-file cannot be used with --insecure-diagnostics")
+			os.Exit(1)
+		}
 		return metricsserver.Options{
-			BindAddress:   diagnosticsAddress,
+			BindAddress:   diagnostics.address,
 			SecureServing: false,
+			ExtraHandlers: getOpenMetricsHandlers(),
 		}
 	}
 
 	// If "--insecure-diagnostics" is not set, serve metrics via https
 	// and with authentication/authorization. As the endpoint is protected,
-	// we also serve pprof endpoints and an endpoint to change the log level.
-	return metricsserver.Options{
-		BindAddress:    diagnosticsAddress,
+	// we also serve pprof endpoints, an endpoint to change the log level
+	// an endpoint exposing drift detection state (see inspect subcommand),
+	// an endpoint forcing evaluation of a single resource and the versioned
+	// API listing tracked resources and drift events (see kubectl-drift).
+	handlers := getOpenMetricsHandlers()
+	handlers[driftdetection.StatePath] = driftdetection.StateHandler()
+	handlers[driftdetection.EvaluatePath] = driftdetection.EvaluateHandler()
+	handlers[driftdetection.TrackedPath] = driftdetection.TrackedHandler()
+	handlers[driftdetection.DriftEventsPath] = driftdetection.DriftEventsHandler()
+	handlers[driftdetection.ComponentsPath] = driftdetection.ComponentsHandler()
+	options := metricsserver.Options{
+		BindAddress:    diagnostics.address,
 		SecureServing:  true,
-		FilterProvider: filters.WithAuthenticationAndAuthorization,
+		FilterProvider: admin.FilterProvider(getAdminOptions(diagnostics)),
+		ExtraHandlers:  handlers,
+		// Certificate is reloaded on rotation. When not found, a self-signed one is generated.
+		CertDir: diagnostics.certDir,
+	}
+
+	if diagnostics.clientCAFile != "" {
+		watcher, err := mtls.NewClientCAWatcher(diagnostics.clientCAFile)
+		if err != nil {
+			setupLog.Error(err, "invalid --diagnostics-client-ca-file")
+			os.Exit(1)
+		}
+		go watcher.Start(ctx, ctrl.Log.WithName("diagnostics-client-ca"))
+		options.TLSOpts = append(options.TLSOpts, watcher.TLSOpt())
+	}
+
+	return options
+}
+
+// getAdminOptions returns how secure diagnostics endpoint requests are authenticated and which
+// are audited: all requests changing or exposing drift detection state.
+func getAdminOptions(diagnostics *diagnosticsOptions) *admin.Options {
+	options := &admin.Options{
+		TokenFile:  diagnostics.adminTokenFile,
+		AdminPaths: driftdetection.AdminPaths(),
+	}
+
+	if diagnostics.adminAuditFile != "" {
+		f, err := os.OpenFile(diagnostics.adminAuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			setupLog.Error(err, "invalid --admin-audit-file")
+			os.Exit(1)
+		}
+		options.AuditOutput = f
+	}
+
+	return options
+}
+
+// getOpenMetricsHandlers returns an handler serving metrics in OpenMetrics format.
+// Exemplars (trace IDs attached to drift and evaluation latency metrics) are only
+// exposed in such format.
+func getOpenMetricsHandlers() map[string]http.Handler {
+	return map[string]http.Handler{
+		"/openmetrics": promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{
+			ErrorHandling:     promhttp.HTTPErrorOnError,
+			EnableOpenMetrics: true,
+		}),
 	}
 }
@@ -0,0 +1,107 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/pflag"
+)
+
+var _ = Describe("Environment overrides", func() {
+	newFlagSet := func() *pflag.FlagSet {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		fs.Duration("polling-interval", time.Minute, "")
+		fs.Int("workers", 10, "")
+		fs.StringSlice("included-namespaces", nil, "")
+		fs.StringToString("kind-evaluation-intervals", nil, "")
+		return fs
+	}
+
+	DescribeTable("applyEnvOverrides sets flags not passed on the command line from the environment",
+		func(args []string, env map[string]string, expectedErr string, verify func(fs *pflag.FlagSet)) {
+			for name, value := range env {
+				Expect(os.Setenv(name, value)).To(Succeed())
+				DeferCleanup(os.Unsetenv, name)
+			}
+
+			fs := newFlagSet()
+			Expect(fs.Parse(args)).To(Succeed())
+			err := applyEnvOverrides(fs)
+			if expectedErr != "" {
+				Expect(err).ToNot(BeNil())
+				Expect(err.Error()).To(ContainSubstring(expectedErr))
+				return
+			}
+			Expect(err).To(BeNil())
+			verify(fs)
+		},
+		Entry("flag default when neither flag nor environment variable is set", nil, nil, "",
+			func(fs *pflag.FlagSet) {
+				Expect(fs.GetDuration("polling-interval")).To(Equal(time.Minute))
+				Expect(fs.Lookup("polling-interval").Changed).To(BeFalse())
+			}),
+		Entry("environment variable over flag default", nil,
+			map[string]string{"DRIFT_DETECTION_POLLING_INTERVAL": "2m"}, "",
+			func(fs *pflag.FlagSet) {
+				Expect(fs.GetDuration("polling-interval")).To(Equal(2 * time.Minute))
+			}),
+		Entry("command line over environment variable", []string{"--polling-interval=3m"},
+			map[string]string{"DRIFT_DETECTION_POLLING_INTERVAL": "2m", "DRIFT_DETECTION_WORKERS": "20"}, "",
+			func(fs *pflag.FlagSet) {
+				Expect(fs.GetDuration("polling-interval")).To(Equal(3 * time.Minute))
+				Expect(fs.GetInt("workers")).To(Equal(20))
+			}),
+		Entry("slice flag from environment variable", nil,
+			map[string]string{"DRIFT_DETECTION_INCLUDED_NAMESPACES": "apps,monitoring"}, "",
+			func(fs *pflag.FlagSet) {
+				Expect(fs.GetStringSlice("included-namespaces")).To(Equal([]string{"apps", "monitoring"}))
+			}),
+		Entry("map flag from environment variable", nil,
+			map[string]string{"DRIFT_DETECTION_KIND_EVALUATION_INTERVALS": "Secret=30s,ConfigMap=5m"}, "",
+			func(fs *pflag.FlagSet) {
+				Expect(fs.GetStringToString("kind-evaluation-intervals")).To(Equal(
+					map[string]string{"Secret": "30s", "ConfigMap": "5m"}))
+			}),
+		Entry("invalid environment variable value", nil,
+			map[string]string{"DRIFT_DETECTION_WORKERS": "many"}, "DRIFT_DETECTION_WORKERS", nil),
+		Entry("invalid environment variable value of a flag passed on the command line is ignored",
+			[]string{"--workers=5"}, map[string]string{"DRIFT_DETECTION_WORKERS": "many"}, "",
+			func(fs *pflag.FlagSet) {
+				Expect(fs.GetInt("workers")).To(Equal(5))
+			}),
+	)
+
+	It("every flag is set from its own environment variable", func() {
+		// As parseFlags does, flags registered on the Go flag set are set too
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		initFlags(fs, &options{})
+		fs.AddGoFlagSet(flag.CommandLine)
+
+		names := make(map[string]string)
+		fs.VisitAll(func(f *pflag.Flag) {
+			name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+			Expect(names).ToNot(HaveKey(name), "flags %s and %s share environment variable", f.Name, names[name])
+			names[name] = f.Name
+		})
+	})
+})
@@ -0,0 +1,281 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package admin protects the secure diagnostics endpoint. Requests are authenticated either
+// with a static bearer token (see Options.TokenFile) or via TokenReview, and authorized via
+// SubjectAccessReview. Every request to an admin path (an endpoint changing or exposing the
+// state of drift detection, like forcing an evaluation) is audited: who sent it, what was
+// requested and the outcome, so that admin actions are attributable.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/authenticatorfactory"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/authorization/authorizerfactory"
+	authenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	authorizationv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	"k8s.io/client-go/rest"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+const (
+	// TokenUser is the user requests authenticated with the static bearer token are audited as
+	TokenUser = "drift-detection-manager:admin-token"
+
+	reviewTimeout = 10 * time.Second
+)
+
+// Options configures authentication and auditing of the diagnostics endpoint
+type Options struct {
+	// TokenFile, when set, contains a static bearer token. Requests presenting it are allowed to
+	// access any path, without TokenReview nor SubjectAccessReview. File is read on each request
+	// presenting a token, so token can be rotated (e.g. when mounted from a Secret).
+	TokenFile string
+
+	// AdminPaths are the paths (or path prefixes, when ending with "/") whose requests are audited
+	AdminPaths []string
+
+	// AuditOutput, when set, is where each audit record is written as a single-line JSON record.
+	// Records are always logged.
+	AuditOutput io.Writer
+}
+
+// AuditRecord describes a request to an admin path
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+
+	// User is the authenticated user. Empty if authentication failed.
+	User string `json:"user,omitempty"`
+
+	Groups []string `json:"groups,omitempty"`
+
+	Method string `json:"method"`
+
+	Path string `json:"path"`
+
+	// StatusCode is the HTTP status code of the response
+	StatusCode int `json:"statusCode"`
+
+	// Reason, when set, explains why request was rejected
+	Reason string `json:"reason,omitempty"`
+}
+
+// backoff is the retry backoff of TokenReviews and SubjectAccessReviews (same used by
+// controller-runtime filters.WithAuthenticationAndAuthorization)
+var backoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   1.5,
+	Jitter:   0.2,
+	Steps:    5,
+}
+
+// FilterProvider returns a metricsserver FilterProvider authenticating, authorizing and auditing
+// requests as described by options
+func FilterProvider(options *Options) func(*rest.Config, *http.Client) (metricsserver.Filter, error) {
+	return func(config *rest.Config, httpClient *http.Client) (metricsserver.Filter, error) {
+		authenticationClient, err := authenticationv1.NewForConfigAndClient(config, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		authorizationClient, err := authorizationv1.NewForConfigAndClient(config, httpClient)
+		if err != nil {
+			return nil, err
+		}
+
+		authenticatorConfig := authenticatorfactory.DelegatingAuthenticatorConfig{
+			Anonymous:                false,
+			CacheTTL:                 1 * time.Minute,
+			TokenAccessReviewClient:  authenticationClient,
+			TokenAccessReviewTimeout: reviewTimeout,
+			WebhookRetryBackoff:      &backoff,
+		}
+		delegatingAuthenticator, _, err := authenticatorConfig.New()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create authenticator")
+		}
+
+		authorizerConfig := authorizerfactory.DelegatingAuthorizerConfig{
+			SubjectAccessReviewClient: authorizationClient,
+			AllowCacheTTL:             5 * time.Minute,
+			DenyCacheTTL:              30 * time.Second,
+			WebhookRetryBackoff:       &backoff,
+		}
+		delegatingAuthorizer, err := authorizerConfig.New()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create authorizer")
+		}
+
+		return NewFilter(options, delegatingAuthenticator, delegatingAuthorizer), nil
+	}
+}
+
+// NewFilter returns a metricsserver Filter authenticating requests with the static token (if
+// configured) or authn, authorizing them with authz and auditing those to admin paths
+func NewFilter(options *Options, authn authenticator.Request, authz authorizer.Authorizer) metricsserver.Filter {
+	f := &filter{options: options, authn: authn, authz: authz}
+	return func(log logr.Logger, handler http.Handler) (http.Handler, error) {
+		auditLog := log.WithName("admin-audit")
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !f.isAdminPath(req.URL.Path) {
+				f.serve(log, w, req, handler, nil)
+				return
+			}
+
+			record := &AuditRecord{Time: time.Now(), Method: req.Method, Path: req.URL.Path}
+			recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+			f.serve(log, recorder, req, handler, record)
+			record.StatusCode = recorder.statusCode
+			f.audit(auditLog, record)
+		}), nil
+	}
+}
+
+type filter struct {
+	options *Options
+	authn   authenticator.Request
+	authz   authorizer.Authorizer
+
+	// mu serializes writes to AuditOutput
+	mu sync.Mutex
+}
+
+func (f *filter) isAdminPath(path string) bool {
+	for _, adminPath := range f.options.AdminPaths {
+		if path == adminPath || (strings.HasSuffix(adminPath, "/") && strings.HasPrefix(path, adminPath)) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve authenticates and authorizes req and, if allowed, passes it to handler. When not nil,
+// record is filled with user and rejection reason.
+func (f *filter) serve(log logr.Logger, w http.ResponseWriter, req *http.Request, handler http.Handler,
+	record *AuditRecord) {
+
+	if record == nil {
+		record = &AuditRecord{}
+	}
+
+	if f.hasStaticToken(req) {
+		record.User = TokenUser
+		handler.ServeHTTP(w, req)
+		return
+	}
+
+	res, ok, err := f.authn.AuthenticateRequest(req)
+	if err != nil {
+		log.Error(err, "Authentication failed")
+		record.Reason = "authentication failed"
+		http.Error(w, "Authentication failed", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		record.Reason = "unauthenticated"
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	record.User = res.User.GetName()
+	record.Groups = res.User.GetGroups()
+
+	attributes := authorizer.AttributesRecord{
+		User: res.User,
+		Verb: strings.ToLower(req.Method),
+		Path: req.URL.Path,
+	}
+	authorized, reason, err := f.authz.Authorize(req.Context(), attributes)
+	if err != nil {
+		msg := fmt.Sprintf("Authorization for user %s failed", res.User.GetName())
+		log.Error(err, msg)
+		record.Reason = "authorization failed"
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	if authorized != authorizer.DecisionAllow {
+		record.Reason = "forbidden"
+		if reason != "" {
+			record.Reason += ": " + reason
+		}
+		http.Error(w, fmt.Sprintf("Authorization denied for user %s", res.User.GetName()), http.StatusForbidden)
+		return
+	}
+
+	handler.ServeHTTP(w, req)
+}
+
+// hasStaticToken returns true if the static token is configured and req presents it
+func (f *filter) hasStaticToken(req *http.Request) bool {
+	if f.options.TokenFile == "" {
+		return false
+	}
+
+	const prefix = "bearer "
+	header := req.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return false
+	}
+
+	content, err := os.ReadFile(f.options.TokenFile)
+	if err != nil {
+		return false
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(header[len(prefix):])), []byte(token)) == 1
+}
+
+// audit logs record and, if configured, writes it to AuditOutput
+func (f *filter) audit(log logr.Logger, record *AuditRecord) {
+	log.Info("admin request", "user", record.User, "groups", record.Groups, "method", record.Method,
+		"path", record.Path, "statusCode", record.StatusCode, "reason", record.Reason)
+
+	if f.options.AuditOutput == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := json.NewEncoder(f.options.AuditOutput).Encode(record); err != nil {
+		log.Error(err, "failed to write audit record")
+	}
+}
+
+// statusRecorder records the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/admin"
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+const (
+	validToken = "valid"
+	adminToken = "admin-secret"
+)
+
+// authenticate authenticates requests presenting validToken as user "jane"
+var authenticate = authenticator.RequestFunc(func(req *http.Request) (*authenticator.Response, bool, error) {
+	if req.Header.Get("Authorization") != "Bearer "+validToken {
+		return nil, false, nil
+	}
+	return &authenticator.Response{User: &user.DefaultInfo{Name: "jane", Groups: []string{"ops"}}}, true, nil
+})
+
+// authorize only allows GET requests
+var authorize = authorizer.AuthorizerFunc(func(_ context.Context, a authorizer.Attributes) (authorizer.Decision, string, error) {
+	if a.GetVerb() == "get" {
+		return authorizer.DecisionAllow, "", nil
+	}
+	return authorizer.DecisionDeny, "not allowed", nil
+})
+
+var _ = Describe("Admin", func() {
+	var output *bytes.Buffer
+	var handler http.Handler
+
+	BeforeEach(func() {
+		tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+		Expect(os.WriteFile(tokenFile, []byte(adminToken+"\n"), 0600)).To(Succeed())
+
+		output = &bytes.Buffer{}
+		options := &admin.Options{
+			TokenFile:   tokenFile,
+			AdminPaths:  []string{"/evaluate/", "/debug/state"},
+			AuditOutput: output,
+		}
+
+		var err error
+		handler, err = admin.NewFilter(options, authenticate, authorize)(logr.Discard(),
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusAccepted) }))
+		Expect(err).To(BeNil())
+	})
+
+	send := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, http.NoBody)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	lastRecord := func() *admin.AuditRecord {
+		lines := bytes.Split(bytes.TrimSpace(output.Bytes()), []byte("\n"))
+		record := &admin.AuditRecord{}
+		Expect(json.Unmarshal(lines[len(lines)-1], record)).To(Succeed())
+		return record
+	}
+
+	It("authenticates and authorizes requests", func() {
+		Expect(send(http.MethodGet, "/metrics", "")).To(Equal(http.StatusUnauthorized))
+		Expect(send(http.MethodGet, "/metrics", "invalid")).To(Equal(http.StatusUnauthorized))
+		Expect(send(http.MethodGet, "/metrics", validToken)).To(Equal(http.StatusAccepted))
+		Expect(send(http.MethodPost, "/evaluate/apps/v1/Deployment/default/nginx", validToken)).To(Equal(http.StatusForbidden))
+
+		// Static token is allowed any request
+		Expect(send(http.MethodPost, "/evaluate/apps/v1/Deployment/default/nginx", adminToken)).To(Equal(http.StatusAccepted))
+	})
+
+	It("audits requests to admin paths only", func() {
+		Expect(send(http.MethodGet, "/metrics", validToken)).To(Equal(http.StatusAccepted))
+		Expect(output.Len()).To(BeZero())
+
+		Expect(send(http.MethodPost, "/evaluate/apps/v1/Deployment/default/nginx", validToken)).To(Equal(http.StatusForbidden))
+		record := lastRecord()
+		Expect(record.User).To(Equal("jane"))
+		Expect(record.Groups).To(Equal([]string{"ops"}))
+		Expect(record.Method).To(Equal(http.MethodPost))
+		Expect(record.Path).To(Equal("/evaluate/apps/v1/Deployment/default/nginx"))
+		Expect(record.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(record.Reason).To(ContainSubstring("forbidden"))
+
+		Expect(send(http.MethodPost, "/evaluate/core/v1/ConfigMap/default/cm", adminToken)).To(Equal(http.StatusAccepted))
+		record = lastRecord()
+		Expect(record.User).To(Equal(admin.TokenUser))
+		Expect(record.StatusCode).To(Equal(http.StatusAccepted))
+		Expect(record.Reason).To(BeEmpty())
+
+		Expect(send(http.MethodGet, "/debug/state", "")).To(Equal(http.StatusUnauthorized))
+		record = lastRecord()
+		Expect(record.User).To(BeEmpty())
+		Expect(record.Reason).To(Equal("unauthenticated"))
+	})
+
+	It("audits all requests changing or exposing drift detection state", func() {
+		options := &admin.Options{AdminPaths: driftdetection.AdminPaths(), AuditOutput: output}
+		var err error
+		handler, err = admin.NewFilter(options, authenticate, authorize)(logr.Discard(),
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusAccepted) }))
+		Expect(err).To(BeNil())
+
+		for _, path := range []string{driftdetection.StatePath, driftdetection.TrackedPath,
+			driftdetection.DriftEventsPath, driftdetection.ComponentsPath} {
+
+			Expect(send(http.MethodGet, path, validToken)).To(Equal(http.StatusAccepted))
+			record := lastRecord()
+			Expect(record.Path).To(Equal(path))
+			Expect(record.User).To(Equal("jane"))
+		}
+
+		Expect(send(http.MethodPost, "/evaluate/apps/v1/Deployment/default/nginx", validToken)).To(Equal(http.StatusForbidden))
+		Expect(lastRecord().Path).To(Equal("/evaluate/apps/v1/Deployment/default/nginx"))
+
+		// Metrics scraping is not audited
+		output.Reset()
+		Expect(send(http.MethodGet, "/metrics", validToken)).To(Equal(http.StatusAccepted))
+		Expect(output.Len()).To(BeZero())
+	})
+
+	It("rejects evaluation requests from callers not granted it by RBAC", func() {
+		data, err := os.ReadFile(filepath.Join("..", "..", "config", "rbac", "role.yaml"))
+		Expect(err).To(BeNil())
+		role := &rbacv1.ClusterRole{}
+		Expect(yaml.Unmarshal(data, role)).To(Succeed())
+
+		// jane is bound to the ClusterRole of drift-detection-manager, john is not
+		rbacAuthorize := authorizer.AuthorizerFunc(func(_ context.Context, a authorizer.Attributes,
+		) (authorizer.Decision, string, error) {
+
+			if a.GetUser().GetName() != "jane" {
+				return authorizer.DecisionDeny, "no binding", nil
+			}
+			for i := range role.Rules {
+				if allowsNonResourceURL(&role.Rules[i], a.GetVerb(), a.GetPath()) {
+					return authorizer.DecisionAllow, "", nil
+				}
+			}
+			return authorizer.DecisionDeny, "no rule", nil
+		})
+		authenticateBoth := authenticator.RequestFunc(func(req *http.Request) (*authenticator.Response, bool, error) {
+			name := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+			return &authenticator.Response{User: &user.DefaultInfo{Name: name}}, true, nil
+		})
+
+		handler, err = admin.NewFilter(&admin.Options{AdminPaths: []string{"/evaluate/"}}, authenticateBoth,
+			rbacAuthorize)(logr.Discard(),
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusAccepted) }))
+		Expect(err).To(BeNil())
+
+		Expect(send(http.MethodPost, "/evaluate/apps/v1/Deployment/default/nginx", "jane")).To(Equal(http.StatusAccepted))
+		Expect(send(http.MethodPost, "/evaluate/apps/v1/Deployment/default/nginx", "john")).To(Equal(http.StatusForbidden))
+		// Evaluation is only granted via POST
+		Expect(send(http.MethodGet, "/evaluate/apps/v1/Deployment/default/nginx", "jane")).To(Equal(http.StatusForbidden))
+	})
+})
+
+// allowsNonResourceURL returns true if rule grants verb on path, as RBAC does for non resource URLs
+func allowsNonResourceURL(rule *rbacv1.PolicyRule, verb, path string) bool {
+	verbAllowed := false
+	for _, v := range rule.Verbs {
+		if v == verb || v == rbacv1.VerbAll {
+			verbAllowed = true
+		}
+	}
+	if !verbAllowed {
+		return false
+	}
+	for _, url := range rule.NonResourceURLs {
+		if url == path || (strings.HasSuffix(url, "*") && strings.HasPrefix(path, strings.TrimSuffix(url, "*"))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package alerts implements the generate-alerts subcommand, which writes Prometheus alerting and
+// recording rules, as a PrometheusRule, matching the metrics exposed by drift-detection-manager:
+//
+//	drift-detection-manager generate-alerts --service-monitor | kubectl apply -f -
+//
+// Rules are versioned (see RulesVersion): regenerate them when upgrading drift-detection-manager,
+// as metrics may change across releases. With --service-monitor a ServiceMonitor scraping
+// drift-detection-manager is also generated.
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// Name is the name of the subcommand
+const Name = "generate-alerts"
+
+// RulesVersion is the version of the generated rules. It is increased whenever rules, or the
+// metrics they are based upon, change.
+const RulesVersion = "1"
+
+const (
+	// rulesVersionLabel labels generated resources with RulesVersion
+	rulesVersionLabel = "projectsveltos.io/drift-detection-rules-version"
+
+	componentLabel = "control-plane"
+	component      = "drift-detection-manager"
+
+	metricPrefix = "projectsveltos_drift_detection_"
+)
+
+// Names of the metrics rules are based upon (see pkg/drift-detection/metrics.go)
+const (
+	driftsTotal            = metricPrefix + "drifts_total"
+	watcherErrorsTotal     = metricPrefix + "watcher_errors_total"
+	queueLength            = metricPrefix + "queue_length"
+	queueWaitTimeBucket    = metricPrefix + "queue_wait_time_seconds_bucket"
+	missingPermissions     = metricPrefix + "missing_permissions"
+	throttledRequestsTotal = metricPrefix + "throttled_requests_total"
+)
+
+// Names of the recording rules
+const (
+	driftRate        = "projectsveltos:drift_detection_drifts:rate1h"
+	queueWaitTimeP99 = "projectsveltos:drift_detection_queue_wait_time_seconds:p99"
+)
+
+// Options are the settings of the generated rules
+type Options struct {
+	// Namespace is the namespace of the generated resources
+	Namespace string
+	// DriftsPerHour is the number of drifts per hour, per GVK, above which an alert fires
+	DriftsPerHour float64
+	// QueueLength is the number of resources waiting for evaluation above which an alert fires
+	QueueLength int
+	// QueueWaitTime is the 99th percentile of time, in seconds, resources wait for evaluation
+	// above which an alert fires
+	QueueWaitTime float64
+	// ServiceMonitor, when set, also generates a ServiceMonitor scraping drift-detection-manager
+	ServiceMonitor bool
+}
+
+type metadata struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type rule struct {
+	Record      string            `json:"record,omitempty"`
+	Alert       string            `json:"alert,omitempty"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ruleGroup struct {
+	Name  string `json:"name"`
+	Rules []rule `json:"rules"`
+}
+
+type prometheusRule struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Metadata   metadata `json:"metadata"`
+	Spec       struct {
+		Groups []ruleGroup `json:"groups"`
+	} `json:"spec"`
+}
+
+type endpoint struct {
+	Path            string          `json:"path"`
+	Port            string          `json:"port"`
+	Scheme          string          `json:"scheme"`
+	BearerTokenFile string          `json:"bearerTokenFile"`
+	TLSConfig       map[string]bool `json:"tlsConfig"`
+}
+
+type serviceMonitor struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Metadata   metadata `json:"metadata"`
+	Spec       struct {
+		Endpoints []endpoint `json:"endpoints"`
+		Selector  struct {
+			MatchLabels map[string]string `json:"matchLabels"`
+		} `json:"selector"`
+	} `json:"spec"`
+}
+
+// Run runs the generate-alerts subcommand
+func Run(_ context.Context, args []string, out io.Writer) error {
+	options := &Options{}
+	flags := pflag.NewFlagSet(Name, pflag.ContinueOnError)
+	flags.StringVar(&options.Namespace, "namespace", "projectsveltos",
+		"Namespace of the generated resources")
+	flags.Float64Var(&options.DriftsPerHour, "drifts-per-hour", 10,
+		"Number of configuration drifts per hour, per GVK, above which DriftDetectionHighDriftRate fires")
+	flags.IntVar(&options.QueueLength, "queue-length", 1000,
+		"Number of resources waiting for evaluation above which DriftDetectionQueueSaturated fires")
+	flags.Float64Var(&options.QueueWaitTime, "queue-wait-time", 300,
+		"99th percentile of the time, in seconds, resources wait for evaluation above which DriftDetectionQueueSlow fires")
+	flags.BoolVar(&options.ServiceMonitor, "service-monitor", false,
+		"Also generate a ServiceMonitor scraping drift-detection-manager metrics")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: %s [flags]", Name)
+	}
+
+	return Generate(options, out)
+}
+
+// Generate writes to out the rules, and optionally the ServiceMonitor, configured by options
+func Generate(options *Options, out io.Writer) error {
+	if options.DriftsPerHour <= 0 || options.QueueLength <= 0 || options.QueueWaitTime <= 0 {
+		return fmt.Errorf("thresholds must be positive")
+	}
+
+	fmt.Fprintf(out, "# Generated by %s, rules version %s\n", Name, RulesVersion)
+	data, err := yaml.Marshal(buildPrometheusRule(options))
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(data); err != nil {
+		return err
+	}
+
+	if !options.ServiceMonitor {
+		return nil
+	}
+	data, err = yaml.Marshal(buildServiceMonitor(options))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "---")
+	_, err = out.Write(data)
+	return err
+}
+
+func getLabels() map[string]string {
+	return map[string]string{
+		componentLabel:    component,
+		rulesVersionLabel: RulesVersion,
+	}
+}
+
+func buildPrometheusRule(options *Options) *prometheusRule {
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	pr := &prometheusRule{
+		APIVersion: "monitoring.coreos.com/v1",
+		Kind:       "PrometheusRule",
+		Metadata: metadata{
+			Name:      "drift-detection-manager-rules",
+			Namespace: options.Namespace,
+			Labels:    getLabels(),
+		},
+	}
+
+	recording := ruleGroup{
+		Name: "drift-detection-manager.recording",
+		Rules: []rule{
+			{
+				Record: driftRate,
+				Expr:   fmt.Sprintf("sum by (gvk) (increase(%s[1h]))", driftsTotal),
+			},
+			{
+				Record: queueWaitTimeP99,
+				Expr:   fmt.Sprintf("histogram_quantile(0.99, sum by (le) (rate(%s[5m])))", queueWaitTimeBucket),
+			},
+		},
+	}
+
+	warning := map[string]string{"severity": "warning"}
+	alerting := ruleGroup{
+		Name: "drift-detection-manager.alerts",
+		Rules: []rule{
+			{
+				Alert:  "DriftDetectionHighDriftRate",
+				Expr:   fmt.Sprintf("%s > %s", driftRate, formatFloat(options.DriftsPerHour)),
+				For:    "15m",
+				Labels: warning,
+				Annotations: map[string]string{
+					"summary": "Resources of {{ $labels.gvk }} drift frequently",
+					"description": "{{ $value }} configuration drifts of {{ $labels.gvk }} detected in the last hour. " +
+						"Something is repeatedly changing resources deployed by Sveltos.",
+				},
+			},
+			{
+				Alert:  "DriftDetectionWatcherFailing",
+				Expr:   fmt.Sprintf("sum by (gvk) (increase(%s[10m])) > 0", watcherErrorsTotal),
+				For:    "10m",
+				Labels: warning,
+				Annotations: map[string]string{
+					"summary": "Watcher for {{ $labels.gvk }} keeps failing",
+					"description": "Watcher for {{ $labels.gvk }} failed to list or watch resources. " +
+						"Drifts of such resources might not be detected.",
+				},
+			},
+			{
+				Alert:  "DriftDetectionMissingPermissions",
+				Expr:   fmt.Sprintf("max by (gvk) (%s) > 0", missingPermissions),
+				For:    "15m",
+				Labels: warning,
+				Annotations: map[string]string{
+					"summary": "drift-detection-manager lacks permissions on {{ $labels.gvk }}",
+					"description": "drift-detection-manager lacks {{ $value }} of get, list, watch permissions " +
+						"on {{ $labels.gvk }}. Drifts of such resources are not detected.",
+				},
+			},
+			{
+				Alert:  "DriftDetectionQueueSaturated",
+				Expr:   fmt.Sprintf("max(%s) > %d", queueLength, options.QueueLength),
+				For:    "15m",
+				Labels: warning,
+				Annotations: map[string]string{
+					"summary":     "Evaluation queue is saturated",
+					"description": "{{ $value }} resources are waiting to be evaluated for configuration drift.",
+				},
+			},
+			{
+				Alert:  "DriftDetectionQueueSlow",
+				Expr:   fmt.Sprintf("%s > %s", queueWaitTimeP99, formatFloat(options.QueueWaitTime)),
+				For:    "15m",
+				Labels: warning,
+				Annotations: map[string]string{
+					"summary":     "Resources wait long before being evaluated",
+					"description": "99th percentile of evaluation queue wait time is {{ $value }}s.",
+				},
+			},
+			{
+				Alert:  "DriftDetectionThrottled",
+				Expr:   fmt.Sprintf("sum(rate(%s[5m])) > 0", throttledRequestsTotal),
+				For:    "15m",
+				Labels: map[string]string{"severity": "info"},
+				Annotations: map[string]string{
+					"summary":     "API server is throttling drift-detection-manager",
+					"description": "API server keeps rejecting drift-detection-manager requests with 429.",
+				},
+			},
+		},
+	}
+
+	pr.Spec.Groups = []ruleGroup{recording, alerting}
+	return pr
+}
+
+func buildServiceMonitor(options *Options) *serviceMonitor {
+	sm := &serviceMonitor{
+		APIVersion: "monitoring.coreos.com/v1",
+		Kind:       "ServiceMonitor",
+		Metadata: metadata{
+			Name:      "drift-detection-manager-metrics-monitor",
+			Namespace: options.Namespace,
+			Labels:    getLabels(),
+		},
+	}
+	sm.Spec.Endpoints = []endpoint{
+		{
+			Path:            "/metrics",
+			Port:            "https",
+			Scheme:          "https",
+			BearerTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			TLSConfig:       map[string]bool{"insecureSkipVerify": true},
+		},
+	}
+	sm.Spec.Selector.MatchLabels = map[string]string{componentLabel: component}
+	return sm
+}
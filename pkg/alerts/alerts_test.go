@@ -0,0 +1,115 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerts_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/alerts"
+)
+
+func decode(data []byte) []*unstructured.Unstructured {
+	result := make([]*unstructured.Unstructured, 0)
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for {
+		u := &unstructured.Unstructured{}
+		err := decoder.Decode(&u.Object)
+		if err == io.EOF {
+			return result
+		}
+		Expect(err).To(BeNil())
+		if len(u.Object) != 0 {
+			result = append(result, u)
+		}
+	}
+}
+
+func getRules(u *unstructured.Unstructured) map[string]map[string]interface{} {
+	groups, found, err := unstructured.NestedSlice(u.Object, "spec", "groups")
+	Expect(err).To(BeNil())
+	Expect(found).To(BeTrue())
+
+	rules := make(map[string]map[string]interface{})
+	for i := range groups {
+		groupRules := groups[i].(map[string]interface{})["rules"].([]interface{})
+		for j := range groupRules {
+			r := groupRules[j].(map[string]interface{})
+			name, ok := r["alert"].(string)
+			if !ok {
+				name = r["record"].(string)
+			}
+			rules[name] = r
+		}
+	}
+	return rules
+}
+
+var _ = Describe("Generate alerts", func() {
+	It("generates versioned rules for drift volume, watcher failures and queue saturation", func() {
+		var out bytes.Buffer
+		Expect(alerts.Run(context.TODO(), []string{"--namespace", "monitoring", "--queue-length", "500"},
+			&out)).To(Succeed())
+
+		objects := decode(out.Bytes())
+		Expect(len(objects)).To(Equal(1))
+		Expect(objects[0].GetKind()).To(Equal("PrometheusRule"))
+		Expect(objects[0].GetNamespace()).To(Equal("monitoring"))
+		Expect(objects[0].GetLabels()).To(HaveKeyWithValue("projectsveltos.io/drift-detection-rules-version",
+			alerts.RulesVersion))
+
+		rules := getRules(objects[0])
+		Expect(rules).To(HaveKey("projectsveltos:drift_detection_drifts:rate1h"))
+		Expect(rules["projectsveltos:drift_detection_drifts:rate1h"]["expr"]).To(ContainSubstring(
+			"projectsveltos_drift_detection_drifts_total"))
+		Expect(rules["DriftDetectionHighDriftRate"]["expr"]).To(Equal(
+			"projectsveltos:drift_detection_drifts:rate1h > 10"))
+		Expect(rules["DriftDetectionWatcherFailing"]["expr"]).To(ContainSubstring(
+			"projectsveltos_drift_detection_watcher_errors_total"))
+		Expect(rules["DriftDetectionQueueSaturated"]["expr"]).To(Equal(
+			"max(projectsveltos_drift_detection_queue_length) > 500"))
+		Expect(rules).To(HaveKey("DriftDetectionMissingPermissions"))
+	})
+
+	It("optionally generates a ServiceMonitor", func() {
+		var out bytes.Buffer
+		Expect(alerts.Run(context.TODO(), []string{"--service-monitor"}, &out)).To(Succeed())
+		Expect(strings.HasPrefix(out.String(), "# Generated by generate-alerts")).To(BeTrue())
+
+		objects := decode(out.Bytes())
+		Expect(len(objects)).To(Equal(2))
+		Expect(objects[1].GetKind()).To(Equal("ServiceMonitor"))
+		Expect(objects[1].GetNamespace()).To(Equal("projectsveltos"))
+
+		selector, _, err := unstructured.NestedStringMap(objects[1].Object, "spec", "selector", "matchLabels")
+		Expect(err).To(BeNil())
+		Expect(selector).To(HaveKeyWithValue("control-plane", "drift-detection-manager"))
+	})
+
+	It("rejects non positive thresholds", func() {
+		var out bytes.Buffer
+		Expect(alerts.Run(context.TODO(), []string{"--drifts-per-hour", "0"}, &out)).ToNot(Succeed())
+	})
+})
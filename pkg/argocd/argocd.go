@@ -0,0 +1,301 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package argocd implements the import-argocd subcommand, which translates Argo CD
+// ignoreDifferences configuration into drift-detection-manager field exclusions (see
+// --field-exclusions-file), easing migration from Argo CD based drift workflows:
+//
+//	kubectl get configmap argocd-cm -n argocd -o yaml > argocd-cm.yaml
+//	kubectl get applications -A -o yaml > applications.yaml
+//	drift-detection-manager import-argocd argocd-cm.yaml applications.yaml > field-exclusions.yaml
+//
+// Both ConfigMaps (resource.customizations.ignoreDifferences.<group_kind> keys, and the legacy
+// resource.customizations key) and Applications (spec.ignoreDifferences) are read, from files
+// or, when argument is "-", from stdin. Lists, as returned by kubectl, are expanded.
+// Ignore differences of an Application only apply to its own resources, while field
+// exclusions apply to any matching resource. jqPathExpressions cannot be translated: those are
+// reported as comments in the output.
+package argocd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+// Name is the name of the subcommand
+const Name = "import-argocd"
+
+const (
+	stdin = "-"
+
+	// ignoreDifferencesKeyPrefix prefixes argocd-cm keys containing the ignore differences of a
+	// kind, as <group>_<kind> (just <kind> for the core group), or of all kinds (all)
+	ignoreDifferencesKeyPrefix = "resource.customizations.ignoreDifferences."
+
+	// customizationsKey is the legacy argocd-cm key containing resource customizations, per group/kind
+	customizationsKey = "resource.customizations"
+
+	allKinds = "all"
+)
+
+// ignoreDifferences is an Argo CD ignore differences rule
+type ignoreDifferences struct {
+	Group                 string   `json:"group,omitempty"`
+	Kind                  string   `json:"kind,omitempty"`
+	Name                  string   `json:"name,omitempty"`
+	Namespace             string   `json:"namespace,omitempty"`
+	JSONPointers          []string `json:"jsonPointers,omitempty"`
+	JQPathExpressions     []string `json:"jqPathExpressions,omitempty"`
+	ManagedFieldsManagers []string `json:"managedFieldsManagers,omitempty"`
+}
+
+// object contains the fields of the objects ignore differences are read from
+type object struct {
+	Kind     string            `json:"kind"`
+	Metadata objectMetadata    `json:"metadata"`
+	Data     map[string]string `json:"data,omitempty"`
+	Items    []json.RawMessage `json:"items,omitempty"`
+	Spec     struct {
+		IgnoreDifferences []ignoreDifferences `json:"ignoreDifferences,omitempty"`
+		// Template is the Application template of an ApplicationSet
+		Template struct {
+			Spec struct {
+				IgnoreDifferences []ignoreDifferences `json:"ignoreDifferences,omitempty"`
+			} `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+}
+
+type objectMetadata struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Translation is the outcome of translating Argo CD configuration
+type Translation struct {
+	Exclusions []driftdetection.FieldExclusion
+
+	// Skipped describes the parts of the configuration which could not be translated
+	Skipped []string
+
+	seen map[string]bool
+}
+
+// Run parses args, translates the Argo CD configuration found in the listed files and writes
+// the resulting field exclusions to out
+func Run(_ context.Context, args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet(Name, pflag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: %s FILE|- ...", Name)
+	}
+
+	translation := &Translation{}
+	for _, arg := range flags.Args() {
+		if err := translateFile(arg, translation); err != nil {
+			return err
+		}
+	}
+
+	data, err := yaml.Marshal(translation.Exclusions)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "# Field exclusions translated from Argo CD ignoreDifferences by %s\n", Name)
+	for _, skipped := range translation.Skipped {
+		fmt.Fprintf(out, "# not translated: %s\n", skipped)
+	}
+	if len(translation.Exclusions) == 0 {
+		data = []byte("[]\n")
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+func translateFile(arg string, translation *Translation) error {
+	if arg == stdin {
+		return translation.Read("<stdin>", os.Stdin)
+	}
+
+	f, err := os.Open(arg)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+	return translation.Read(arg, f)
+}
+
+// Read translates the ignore differences of the ConfigMaps, Applications and ApplicationSets in
+// the (possibly multi-document) YAML or JSON stream r. Other objects are ignored.
+func (t *Translation) Read(source string, r io.Reader) error {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", source)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		if err := t.readObject(doc); err != nil {
+			return errors.Wrapf(err, "failed to parse %s", source)
+		}
+	}
+}
+
+func (t *Translation) readObject(doc []byte) error {
+	obj := &object{}
+	if err := yaml.Unmarshal(doc, obj); err != nil {
+		return err
+	}
+
+	source := fmt.Sprintf("%s %s", obj.Kind, obj.Metadata.Name)
+	if obj.Metadata.Namespace != "" {
+		source = fmt.Sprintf("%s %s/%s", obj.Kind, obj.Metadata.Namespace, obj.Metadata.Name)
+	}
+	switch obj.Kind {
+	case "List":
+		for i := range obj.Items {
+			if err := t.readObject(obj.Items[i]); err != nil {
+				return err
+			}
+		}
+	case "ConfigMap":
+		return t.readConfigMap(source, obj.Data)
+	case "Application":
+		for i := range obj.Spec.IgnoreDifferences {
+			t.add(source, &obj.Spec.IgnoreDifferences[i])
+		}
+	case "ApplicationSet":
+		for i := range obj.Spec.Template.Spec.IgnoreDifferences {
+			t.add(source, &obj.Spec.Template.Spec.IgnoreDifferences[i])
+		}
+	}
+	return nil
+}
+
+// readConfigMap translates the ignore differences in data, content of argocd-cm
+func (t *Translation) readConfigMap(source string, data map[string]string) error {
+	// Keys are sorted, so that output is stable
+	for _, key := range sortedKeys(data) {
+		value := data[key]
+		if !strings.HasPrefix(key, ignoreDifferencesKeyPrefix) {
+			continue
+		}
+		rule := &ignoreDifferences{}
+		if err := yaml.Unmarshal([]byte(value), rule); err != nil {
+			return errors.Wrapf(err, "invalid %s", key)
+		}
+		groupKind := strings.TrimPrefix(key, ignoreDifferencesKeyPrefix)
+		if groupKind == allKinds {
+			rule.Group, rule.Kind = "*", "*"
+		} else if i := strings.LastIndex(groupKind, "_"); i >= 0 {
+			rule.Group, rule.Kind = groupKind[:i], groupKind[i+1:]
+		} else {
+			rule.Kind = groupKind
+		}
+		t.add(source, rule)
+	}
+
+	legacy, ok := data[customizationsKey]
+	if !ok {
+		return nil
+	}
+	customizations := map[string]struct {
+		IgnoreDifferences string `json:"ignoreDifferences,omitempty"`
+	}{}
+	if err := yaml.Unmarshal([]byte(legacy), &customizations); err != nil {
+		return errors.Wrapf(err, "invalid %s", customizationsKey)
+	}
+	for _, groupKind := range sortedKeys(customizations) {
+		customization := customizations[groupKind]
+		if customization.IgnoreDifferences == "" {
+			continue
+		}
+		rule := &ignoreDifferences{}
+		if err := yaml.Unmarshal([]byte(customization.IgnoreDifferences), rule); err != nil {
+			return errors.Wrapf(err, "invalid %s for %s", customizationsKey, groupKind)
+		}
+		if i := strings.LastIndex(groupKind, "/"); i >= 0 {
+			rule.Group, rule.Kind = groupKind[:i], groupKind[i+1:]
+		} else {
+			rule.Kind = groupKind
+		}
+		t.add(source, rule)
+	}
+	return nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// add translates rule, read from source, into a field exclusion
+func (t *Translation) add(source string, rule *ignoreDifferences) {
+	description := rule.Kind
+	if rule.Group != "" {
+		description = rule.Kind + "." + rule.Group
+	}
+	if len(rule.JQPathExpressions) != 0 {
+		t.Skipped = append(t.Skipped, fmt.Sprintf("%s: %s: jqPathExpressions %s", source, description,
+			strings.Join(rule.JQPathExpressions, ", ")))
+	}
+	if rule.Kind == "" || (len(rule.JSONPointers) == 0 && len(rule.ManagedFieldsManagers) == 0) {
+		return
+	}
+
+	exclusion := driftdetection.FieldExclusion{
+		Group:                 rule.Group,
+		Kind:                  rule.Kind,
+		Namespace:             rule.Namespace,
+		Name:                  rule.Name,
+		JSONPointers:          rule.JSONPointers,
+		ManagedFieldsManagers: rule.ManagedFieldsManagers,
+	}
+	// Same rule is often repeated across Applications
+	key, _ := json.Marshal(&exclusion)
+	if t.seen == nil {
+		t.seen = make(map[string]bool)
+	}
+	if !t.seen[string(key)] {
+		t.seen[string(key)] = true
+		t.Exclusions = append(t.Exclusions, exclusion)
+	}
+}
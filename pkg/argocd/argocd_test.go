@@ -0,0 +1,112 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package argocd_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/argocd"
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+const argoConfig = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: argocd-cm
+  namespace: argocd
+data:
+  resource.customizations.ignoreDifferences.apps_Deployment: |
+    jsonPointers:
+    - /spec/replicas
+  resource.customizations.ignoreDifferences.all: |
+    managedFieldsManagers:
+    - kube-controller-manager
+  resource.customizations: |
+    admissionregistration.k8s.io/MutatingWebhookConfiguration:
+      ignoreDifferences: |
+        jsonPointers:
+        - /webhooks/0/clientConfig/caBundle
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: argoproj.io/v1alpha1
+  kind: Application
+  metadata:
+    name: guestbook
+    namespace: argocd
+  spec:
+    ignoreDifferences:
+    - group: apps
+      kind: Deployment
+      jsonPointers:
+      - /spec/replicas
+    - kind: ConfigMap
+      name: settings
+      namespace: guestbook
+      jqPathExpressions:
+      - .data.timestamp
+    - kind: Service
+      namespace: guestbook
+      jsonPointers:
+      - /spec/clusterIP
+      jqPathExpressions:
+      - .spec.ports[].nodePort
+`
+
+var _ = Describe("ArgoCD", func() {
+	It("Read translates argocd-cm and Application ignore differences", func() {
+		translation := &argocd.Translation{}
+		Expect(translation.Read("test", strings.NewReader(argoConfig))).To(Succeed())
+
+		Expect(translation.Exclusions).To(Equal([]driftdetection.FieldExclusion{
+			{Group: "*", Kind: "*", ManagedFieldsManagers: []string{"kube-controller-manager"}},
+			{Group: "apps", Kind: "Deployment", JSONPointers: []string{"/spec/replicas"}},
+			{Group: "admissionregistration.k8s.io", Kind: "MutatingWebhookConfiguration",
+				JSONPointers: []string{"/webhooks/0/clientConfig/caBundle"}},
+			{Kind: "Service", Namespace: "guestbook", JSONPointers: []string{"/spec/clusterIP"}},
+		}))
+		Expect(translation.Skipped).To(HaveLen(2))
+		Expect(translation.Skipped[0]).To(ContainSubstring(".data.timestamp"))
+
+		// Translated exclusions are accepted by drift-detection-manager
+		Expect(driftdetection.SetFieldExclusions(translation.Exclusions)).To(Succeed())
+		Expect(driftdetection.SetFieldExclusions(nil)).To(Succeed())
+	})
+
+	It("Run writes field exclusions which can be read back", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "argocd-cm.yaml")
+		Expect(os.WriteFile(path, []byte(argoConfig), 0600)).To(Succeed())
+
+		var out bytes.Buffer
+		Expect(argocd.Run(context.TODO(), []string{path}, &out)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("# not translated: Application argocd/guestbook: ConfigMap: jqPathExpressions"))
+
+		exclusions, err := driftdetection.ReadFieldExclusions(out.Bytes())
+		Expect(err).To(BeNil())
+		Expect(exclusions).To(HaveLen(4))
+
+		Expect(argocd.Run(context.TODO(), nil, &out)).ToNot(Succeed())
+	})
+})
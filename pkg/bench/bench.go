@@ -0,0 +1,84 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bench implements the bench subcommand, which measures the drift evaluation
+// path against synthetic objects so that performance regressions can be measured reproducibly.
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+// Name is the name of the subcommand
+const Name = "bench"
+
+// Run parses args and runs the benchmark, writing the report to out
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	fs := pflag.NewFlagSet(Name, pflag.ContinueOnError)
+
+	options := &driftdetection.BenchmarkOptions{}
+	var shape, hashMode, incrementalThreshold string
+	fs.StringVar(&shape, "shape", string(driftdetection.NestedShape),
+		"Shape of synthetic objects. Possible options are nested (Deployment-like objects with a nested spec) "+
+			"or configmap (ConfigMaps with flat data).")
+	fs.IntVar(&options.Objects, "objects", 1000, "Number of synthetic objects.")
+	fs.IntVar(&options.Iterations, "iterations", 10, "Number of times all objects are evaluated.")
+	fs.IntVar(&options.Fields, "fields", 10, "Number of fields per map (data keys with shape configmap).")
+	fs.IntVar(&options.Depth, "depth", 3, "Nesting depth of spec (shape nested only).")
+	fs.IntVar(&options.ValueSize, "value-size", 64, "Size, in bytes, of each string value.")
+	fs.Float64Var(&options.DriftRatio, "drift-ratio", 0.1, "Fraction of objects modified before each iteration.")
+	fs.StringVar(&hashMode, "hash-mode", string(driftdetection.FullHashMode),
+		"Hash mode used to evaluate objects. Possible options are full or spec.")
+	fs.StringVar(&incrementalThreshold, "incremental-hash-threshold", "1Mi",
+		"Data size above which ConfigMaps are hashed incrementally. Set to 0 to disable.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	options.Shape = driftdetection.BenchmarkShape(shape)
+
+	switch driftdetection.HashMode(hashMode) {
+	case driftdetection.FullHashMode, driftdetection.SpecHashMode:
+		driftdetection.SetHashMode(driftdetection.HashMode(hashMode))
+	default:
+		return fmt.Errorf("unsupported hash mode %q", hashMode)
+	}
+
+	threshold, err := resource.ParseQuantity(incrementalThreshold)
+	if err != nil {
+		return errors.Wrap(err, "invalid incremental-hash-threshold")
+	}
+	driftdetection.SetIncrementalHashThreshold(uint64(threshold.Value()))
+
+	result, err := driftdetection.RunBenchmark(ctx, options)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "shape: %s objects: %d iterations: %d fields: %d depth: %d value-size: %d drift-ratio: %.2f\n%s",
+		options.Shape, options.Objects, options.Iterations, options.Fields, options.Depth, options.ValueSize,
+		options.DriftRatio, result)
+	return err
+}
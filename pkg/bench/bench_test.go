@@ -0,0 +1,71 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bench_test
+
+import (
+	"bytes"
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/bench"
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+var _ = Describe("Bench", func() {
+	It("RunBenchmark evaluates all objects at every iteration", func() {
+		for _, shape := range []driftdetection.BenchmarkShape{driftdetection.NestedShape, driftdetection.ConfigMapShape} {
+			options := &driftdetection.BenchmarkOptions{Shape: shape, Objects: 20, Iterations: 3,
+				Fields: 4, Depth: 2, ValueSize: 16, DriftRatio: 1}
+			result, err := driftdetection.RunBenchmark(context.TODO(), options)
+			Expect(err).To(BeNil())
+			Expect(result.Evaluations).To(Equal(60))
+			// Every object is modified before each iteration
+			Expect(result.Drifts).To(Equal(60))
+			Expect(result.Duration).ToNot(BeZero())
+
+			options.DriftRatio = 0
+			result, err = driftdetection.RunBenchmark(context.TODO(), options)
+			Expect(err).To(BeNil())
+			Expect(result.Evaluations).To(Equal(60))
+			Expect(result.Drifts).To(BeZero())
+		}
+	})
+
+	It("RunBenchmark rejects invalid options", func() {
+		_, err := driftdetection.RunBenchmark(context.TODO(), &driftdetection.BenchmarkOptions{
+			Shape: "unknown", Objects: 1, Iterations: 1, Fields: 1, Depth: 1})
+		Expect(err).ToNot(BeNil())
+
+		_, err = driftdetection.RunBenchmark(context.TODO(), &driftdetection.BenchmarkOptions{
+			Shape: driftdetection.NestedShape, Iterations: 1, Fields: 1, Depth: 1})
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("Run prints the report", func() {
+		out := &bytes.Buffer{}
+		Expect(bench.Run(context.TODO(), []string{"--objects=5", "--iterations=2", "--shape=configmap"},
+			out)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("shape: configmap objects: 5 iterations: 2"))
+		Expect(out.String()).To(ContainSubstring("evaluations: 10"))
+		Expect(out.String()).To(ContainSubstring("allocs/evaluation"))
+
+		Expect(bench.Run(context.TODO(), []string{"--hash-mode=unknown"}, out)).ToNot(Succeed())
+		Expect(bench.Run(context.TODO(), []string{"--incremental-hash-threshold=abc"}, out)).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,241 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cdevents sends drifts, and their remediation by Sveltos, as CDEvents (https://cdevents.dev)
+// so that CI/CD observability platforms consuming CDEvents can correlate drifts with deployments:
+//   - a drift is an incident.detected event, whose subject is the drift;
+//   - once Sveltos remediated it, an incident.resolved event (same subject) and a service.rolledback
+//     event, whose subject is the drifted resource, are sent.
+//
+// Events are sent to a CloudEvents HTTP endpoint, in binary content mode.
+package cdevents
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/egress"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// specVersion is the version of the CDEvents specification events follow
+	specVersion = "0.4.1"
+
+	// IncidentDetected is sent when a drift is detected
+	IncidentDetected = "dev.cdevents.incident.detected.0.2.0"
+
+	// IncidentResolved is sent when Sveltos remediated a drift
+	IncidentResolved = "dev.cdevents.incident.resolved.0.2.0"
+
+	// ServiceRolledBack is sent when Sveltos remediated a drift, by deploying resource again
+	ServiceRolledBack = "dev.cdevents.service.rolledback.0.2.0"
+
+	// queueSize is the number of events waiting to be sent. Events are dropped when queue is full.
+	queueSize = 1000
+
+	// requestTimeout bounds each request to the endpoint
+	requestTimeout = 10 * time.Second
+)
+
+// Event is a CDEvent
+type Event struct {
+	Context Context `json:"context"`
+	Subject Subject `json:"subject"`
+}
+
+// Context is the context of a CDEvent
+type Context struct {
+	Version   string    `json:"version"`
+	ID        string    `json:"id"`
+	Source    string    `json:"source"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Subject is the subject of a CDEvent
+type Subject struct {
+	ID      string                 `json:"id"`
+	Source  string                 `json:"source"`
+	Type    string                 `json:"type"`
+	Content map[string]interface{} `json:"content"`
+}
+
+// Sink sends drift events as CDEvents (see driftdetection.AddDriftEventSink)
+type Sink struct {
+	endpoint string
+	// source identifies drift-detection-manager for the managed cluster
+	source string
+	// environment identifies the managed cluster
+	environment string
+
+	queue  chan *Event
+	client *http.Client
+	log    logr.Logger
+}
+
+// New returns a Sink sending CDEvents to endpoint, a CloudEvents HTTP endpoint. cluster identifies
+// the managed cluster, as type:namespace/name. Fails if endpoint is not allowed (see
+// egress.SetAllowlist). Events are only sent once Run is called.
+func New(endpoint, cluster string, logger logr.Logger) (*Sink, error) {
+	if err := egress.Register("cdevents", endpoint); err != nil {
+		return nil, err
+	}
+
+	return &Sink{
+		endpoint:    endpoint,
+		source:      fmt.Sprintf("/projectsveltos/drift-detection-manager/%s", cluster),
+		environment: cluster,
+		queue:       make(chan *Event, queueSize),
+		client:      &http.Client{Timeout: requestTimeout},
+		log:         logger,
+	}, nil
+}
+
+// Run sends queued events till ctx is canceled
+func (s *Sink) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-s.queue:
+			if err := s.send(ctx, event); err != nil {
+				s.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to send %s CDEvent %s: %v",
+					event.Context.Type, event.Context.ID, err))
+			}
+		}
+	}
+}
+
+// DriftDetected queues an incident.detected event
+func (s *Sink) DriftDetected(event *driftdetection.DriftEvent) {
+	s.enqueue(s.newEvent(IncidentDetected, event.Time, s.getIncident(event)))
+}
+
+// DriftRemediated queues an incident.resolved and a service.rolledback event
+func (s *Sink) DriftRemediated(event *driftdetection.DriftEvent, resourceSummary *corev1.ObjectReference) {
+	now := time.Now()
+	s.enqueue(s.newEvent(IncidentResolved, now, s.getIncident(event)))
+
+	s.enqueue(s.newEvent(ServiceRolledBack, now, Subject{
+		ID:     getResourceID(&event.Resource),
+		Source: s.source,
+		Type:   "service",
+		Content: map[string]interface{}{
+			"environment": map[string]interface{}{"id": s.environment, "source": s.source},
+			"artifactId":  fmt.Sprintf("resourcesummary/%s/%s", resourceSummary.Namespace, resourceSummary.Name),
+		},
+	}))
+}
+
+// getIncident returns the incident subject of event. Subject ID is the same for detection and
+// resolution.
+func (s *Sink) getIncident(event *driftdetection.DriftEvent) Subject {
+	description := "configuration drift"
+	switch {
+	case event.ValuesDrift:
+		description = "Helm release values drift"
+	case event.Deleted:
+		description = "configuration drift: resource deleted"
+	}
+
+	return Subject{
+		ID:     fmt.Sprintf("drift-%d", event.Sequence),
+		Source: s.source,
+		Type:   "incident",
+		Content: map[string]interface{}{
+			"description": description,
+			"environment": map[string]interface{}{"id": s.environment, "source": s.source},
+			"service":     map[string]interface{}{"id": getResourceID(&event.Resource), "source": s.source},
+		},
+	}
+}
+
+func (s *Sink) newEvent(eventType string, timestamp time.Time, subject Subject) *Event {
+	return &Event{
+		Context: Context{
+			Version:   specVersion,
+			ID:        newID(),
+			Source:    s.source,
+			Type:      eventType,
+			Timestamp: timestamp,
+		},
+		Subject: subject,
+	}
+}
+
+// enqueue queues event. Drift detection must never be blocked by the endpoint: event is dropped
+// if queue is full.
+func (s *Sink) enqueue(event *Event) {
+	select {
+	case s.queue <- event:
+	default:
+		s.log.V(logs.LogInfo).Info(fmt.Sprintf("CDEvents queue is full. Dropping %s event", event.Context.Type))
+	}
+}
+
+// send sends event as a CloudEvent in binary content mode
+func (s *Sink) send(ctx context.Context, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Ce-Specversion", "1.0")
+	req.Header.Set("Ce-Id", event.Context.ID)
+	req.Header.Set("Ce-Source", event.Context.Source)
+	req.Header.Set("Ce-Type", event.Context.Type)
+	req.Header.Set("Ce-Time", event.Context.Timestamp.UTC().Format(time.RFC3339Nano))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// getResourceID returns the ID of resource (apiVersion/kind/namespace/name)
+func getResourceID(resource *corev1.ObjectReference) string {
+	return fmt.Sprintf("%s/%s/%s/%s", resource.APIVersion, resource.Kind, resource.Namespace, resource.Name)
+}
+
+// newID returns a random event ID
+func newID() string {
+	id := make([]byte, 16)
+	// crypto/rand never fails on supported platforms
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
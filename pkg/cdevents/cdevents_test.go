@@ -0,0 +1,79 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cdevents_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/cdevents"
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+var _ = Describe("CDEvents", func() {
+	It("sends drift and its remediation as CDEvents", func() {
+		received := make(chan *cdevents.Event, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			data, err := io.ReadAll(r.Body)
+			Expect(err).To(BeNil())
+			event := &cdevents.Event{}
+			Expect(json.Unmarshal(data, event)).To(Succeed())
+			Expect(r.Header.Get("Ce-Type")).To(Equal(event.Context.Type))
+			Expect(r.Header.Get("Ce-Id")).To(Equal(event.Context.ID))
+			received <- event
+		}))
+		defer server.Close()
+
+		sink, err := cdevents.New(server.URL, "sveltos:default/cluster", logr.Discard())
+		Expect(err).To(BeNil())
+
+		ctx, cancel := context.WithCancel(context.TODO())
+		defer cancel()
+		go sink.Run(ctx)
+
+		drift := &driftdetection.DriftEvent{
+			Sequence: 7,
+			Resource: corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm"},
+		}
+		sink.DriftDetected(drift)
+		sink.DriftRemediated(drift, &corev1.ObjectReference{Namespace: "projectsveltos", Name: "summary"})
+
+		var detected, resolved, rolledBack *cdevents.Event
+		Eventually(received).Should(Receive(&detected))
+		Eventually(received).Should(Receive(&resolved))
+		Eventually(received).Should(Receive(&rolledBack))
+
+		Expect(detected.Context.Type).To(Equal(cdevents.IncidentDetected))
+		Expect(resolved.Context.Type).To(Equal(cdevents.IncidentResolved))
+		Expect(rolledBack.Context.Type).To(Equal(cdevents.ServiceRolledBack))
+
+		// Detection and resolution refer to the same incident
+		Expect(resolved.Subject.ID).To(Equal(detected.Subject.ID))
+		Expect(rolledBack.Subject.ID).To(Equal("v1/ConfigMap/default/cm"))
+		Expect(rolledBack.Subject.Content["artifactId"]).To(Equal("resourcesummary/projectsveltos/summary"))
+	})
+})
@@ -0,0 +1,222 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package checkpoint implements a drift detection state store (see
+// driftdetection.SetSnapshotStore) backed by Secrets, so that state checkpoints written by the
+// leader replica are available to a standby replica, which can then take over without fetching
+// and hashing every tracked resource again.
+package checkpoint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// chunkSize keeps each Secret well below the 1MiB limit
+	chunkSize = 512 * 1024
+
+	dataKey = "checkpoint"
+
+	// generationAnnotation is set on each chunk. All chunks of a checkpoint have the same value.
+	generationAnnotation = "projectsveltos.io/checkpoint-generation"
+
+	// chunksAnnotation is set on first chunk with the number of chunks of the checkpoint
+	chunksAnnotation = "projectsveltos.io/checkpoint-chunks"
+)
+
+// SecretStore persists state in Secrets named <name>-0, <name>-1, ... each holding a chunk.
+// First chunk is written last, so a reader finding all chunks with the generation of the first
+// one has a complete checkpoint.
+type SecretStore struct {
+	c         client.Client
+	reader    client.Reader
+	namespace string
+	name      string
+
+	mu sync.Mutex
+	// generation of last checkpoint written
+	generation int64
+	// chunks is the number of chunks of last checkpoint written
+	chunks int
+	// cached is last checkpoint read (see Prefetch)
+	cached []byte
+}
+
+// NewSecretStore returns a SecretStore. Writes go through c, reads through reader, which
+// must not be a cache: Secrets are not meant to be watched.
+func NewSecretStore(c client.Client, reader client.Reader, namespace, name string) *SecretStore {
+	return &SecretStore{c: c, reader: reader, namespace: namespace, name: name}
+}
+
+// Write replaces the checkpoint with data
+func (s *SecretStore) Write(ctx context.Context, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.generation == 0 {
+		// Continue from the generation of the checkpoint written by previous leader, if any
+		if first, err := s.getChunk(ctx, 0); err == nil {
+			s.generation, _ = strconv.ParseInt(first.Annotations[generationAnnotation], 10, 64)
+			s.chunks, _ = strconv.Atoi(first.Annotations[chunksAnnotation])
+		}
+	}
+	generation := s.generation + 1
+
+	chunks := (len(data) + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	for i := chunks - 1; i >= 0; i-- {
+		end := (i + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		annotations := map[string]string{generationAnnotation: strconv.FormatInt(generation, 10)}
+		if i == 0 {
+			annotations[chunksAnnotation] = strconv.Itoa(chunks)
+		}
+		if err := s.writeChunk(ctx, i, data[i*chunkSize:end], annotations); err != nil {
+			return err
+		}
+	}
+
+	// Chunks of a previous, larger, checkpoint are not needed anymore
+	for i := chunks; i < s.chunks; i++ {
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.chunkName(i)}}
+		if err := s.c.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "failed to delete stale checkpoint chunk")
+		}
+	}
+
+	s.generation = generation
+	s.chunks = chunks
+	return nil
+}
+
+// Read returns the checkpoint. If it cannot be read, last checkpoint read by Prefetch, if any,
+// is returned instead.
+func (s *SecretStore) Read(ctx context.Context) ([]byte, error) {
+	data, err := s.read(ctx)
+	if err == nil {
+		return data, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached != nil {
+		return s.cached, nil
+	}
+	return nil, err
+}
+
+// Prefetch reads the checkpoint every interval till ctx is canceled, so that last complete
+// checkpoint is at hand even if reading fails when it is needed. Meant to be run by a standby
+// replica till it is elected.
+func (s *SecretStore) Prefetch(ctx context.Context, interval time.Duration, logger logr.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if data, err := s.read(ctx); err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to read checkpoint: %v", err))
+		} else if data != nil {
+			s.mu.Lock()
+			s.cached = data
+			s.mu.Unlock()
+			logger.V(logs.LogDebug).Info(fmt.Sprintf("read checkpoint of %d bytes", len(data)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// read returns the checkpoint. Nil if none was written yet.
+func (s *SecretStore) read(ctx context.Context) ([]byte, error) {
+	first, err := s.getChunk(ctx, 0)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get checkpoint")
+	}
+
+	generation := first.Annotations[generationAnnotation]
+	chunks, err := strconv.Atoi(first.Annotations[chunksAnnotation])
+	if err != nil || chunks < 1 {
+		return nil, fmt.Errorf("invalid checkpoint: %q annotation is not set", chunksAnnotation)
+	}
+
+	buf := bytes.NewBuffer(first.Data[dataKey])
+	for i := 1; i < chunks; i++ {
+		chunk, err := s.getChunk(ctx, i)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get checkpoint chunk %d", i)
+		}
+		if chunk.Annotations[generationAnnotation] != generation {
+			// Being replaced by a newer checkpoint
+			return nil, fmt.Errorf("checkpoint chunk %d is from a different checkpoint", i)
+		}
+		buf.Write(chunk.Data[dataKey])
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *SecretStore) chunkName(i int) string {
+	return fmt.Sprintf("%s-%d", s.name, i)
+}
+
+func (s *SecretStore) getChunk(ctx context.Context, i int) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	err := s.reader.Get(ctx, client.ObjectKey{Namespace: s.namespace, Name: s.chunkName(i)}, secret)
+	return secret, err
+}
+
+func (s *SecretStore) writeChunk(ctx context.Context, i int, data []byte, annotations map[string]string) error {
+	secret, err := s.getChunk(ctx, i)
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.chunkName(i), Annotations: annotations},
+			Data:       map[string][]byte{dataKey: data},
+		}
+		return errors.Wrap(s.c.Create(ctx, secret), "failed to create checkpoint chunk")
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get checkpoint chunk")
+	}
+
+	secret.Annotations = annotations
+	secret.Data = map[string][]byte{dataKey: data}
+	return errors.Wrap(s.c.Update(ctx, secret), "failed to update checkpoint chunk")
+}
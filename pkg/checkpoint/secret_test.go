@@ -0,0 +1,101 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checkpoint_test
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/checkpoint"
+)
+
+const (
+	namespace = "projectsveltos"
+	name      = "drift-detection-state"
+)
+
+var _ = Describe("SecretStore", func() {
+	var c client.Client
+
+	BeforeEach(func() {
+		s := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		c = fake.NewClientBuilder().WithScheme(s).Build()
+	})
+
+	It("Read returns nil when no checkpoint was written", func() {
+		store := checkpoint.NewSecretStore(c, c, namespace, name)
+		data, err := store.Read(context.TODO())
+		Expect(err).To(BeNil())
+		Expect(data).To(BeNil())
+	})
+
+	It("Write splits checkpoint in chunks, Read reassembles it", func() {
+		data := make([]byte, 1200*1024)
+		_, err := rand.Read(data)
+		Expect(err).To(BeNil())
+
+		leader := checkpoint.NewSecretStore(c, c, namespace, name)
+		Expect(leader.Write(context.TODO(), data)).To(Succeed())
+
+		// Read by another replica
+		standby := checkpoint.NewSecretStore(c, c, namespace, name)
+		Expect(standby.Read(context.TODO())).To(Equal(data))
+
+		// Chunks of a previous, larger, checkpoint are removed
+		Expect(leader.Write(context.TODO(), data[:10])).To(Succeed())
+		Expect(standby.Read(context.TODO())).To(Equal(data[:10]))
+		secret := &corev1.Secret{}
+		err = c.Get(context.TODO(), client.ObjectKey{Namespace: namespace, Name: name + "-1"}, secret)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("Read returns prefetched checkpoint when checkpoint is being replaced", func() {
+		data := make([]byte, 600*1024)
+		_, err := rand.Read(data)
+		Expect(err).To(BeNil())
+
+		leader := checkpoint.NewSecretStore(c, c, namespace, name)
+		Expect(leader.Write(context.TODO(), data)).To(Succeed())
+
+		standby := checkpoint.NewSecretStore(c, c, namespace, name)
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+		// Reads once, then returns as ctx is canceled
+		standby.Prefetch(ctx, time.Minute, textlogger.NewLogger(textlogger.NewConfig()))
+
+		// Second chunk of a newer checkpoint is written, first is not yet
+		secret := &corev1.Secret{}
+		Expect(c.Get(context.TODO(), client.ObjectKey{Namespace: namespace, Name: name + "-1"}, secret)).To(Succeed())
+		secret.Annotations["projectsveltos.io/checkpoint-generation"] = "100"
+		Expect(c.Update(context.TODO(), secret)).To(Succeed())
+
+		Expect(standby.Read(context.TODO())).To(Equal(data))
+	})
+})
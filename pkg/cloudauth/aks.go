@@ -0,0 +1,108 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudauth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// aksServerApplicationID is the application ID of the AAD server of AKS managed AAD clusters
+	aksServerApplicationID = "6dae42f8-4368-4678-94ff-3960e28e3630"
+
+	// Environment variables set by Azure workload identity webhook
+	azureFederatedTokenFileEnv = "AZURE_FEDERATED_TOKEN_FILE"
+	azureClientIDEnv           = "AZURE_CLIENT_ID"
+	azureTenantIDEnv           = "AZURE_TENANT_ID"
+	azureAuthorityHostEnv      = "AZURE_AUTHORITY_HOST"
+
+	defaultAzureAuthorityHost = "https://login.microsoftonline.com/"
+
+	azureIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// aks gets Azure AD tokens for the AKS AAD server application. With Azure workload identity,
+// the federated service account token is exchanged for an Azure AD token. Otherwise the managed
+// identity of the node (AZURE_CLIENT_ID selecting one, if more are assigned) is used via IMDS.
+type aks struct {
+	serverID string
+
+	// imdsEndpoint is the URL of the Azure instance metadata service token endpoint
+	imdsEndpoint string
+	// authorityHost is the Azure AD authority used with workload identity
+	authorityHost string
+}
+
+func newAKS(serverID string) *aks {
+	authorityHost := os.Getenv(azureAuthorityHostEnv)
+	if authorityHost == "" {
+		authorityHost = defaultAzureAuthorityHost
+	}
+	return &aks{serverID: serverID, imdsEndpoint: azureIMDSEndpoint, authorityHost: authorityHost}
+}
+
+func (a *aks) Token(ctx context.Context) (string, time.Time, error) {
+	if tokenFile := os.Getenv(azureFederatedTokenFileEnv); tokenFile != "" {
+		return a.workloadIdentityToken(ctx, tokenFile)
+	}
+
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {a.serverID}}
+	if clientID := os.Getenv(azureClientIDEnv); clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.imdsEndpoint+"?"+query.Encode(), http.NoBody)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+	return getAccessToken(req)
+}
+
+// workloadIdentityToken exchanges the federated token in tokenFile for an Azure AD token
+func (a *aks) workloadIdentityToken(ctx context.Context, tokenFile string) (string, time.Time, error) {
+	assertion, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "failed to read federated token")
+	}
+	tenantID := os.Getenv(azureTenantIDEnv)
+	clientID := os.Getenv(azureClientIDEnv)
+	if tenantID == "" || clientID == "" {
+		return "", time.Time{}, errors.New("workload identity requires " + azureTenantIDEnv + " and " + azureClientIDEnv)
+	}
+
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+		"scope":                 {a.serverID + "/.default"},
+	}
+	endpoint := strings.TrimSuffix(a.authorityHost, "/") + "/" + url.PathEscape(tenantID) + "/oauth2/v2.0/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return getAccessToken(req)
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloudauth lets drift-detection-manager, when running in the management cluster,
+// authenticate to managed clusters hosted by major cloud providers (EKS, GKE, AKS) with the
+// cloud identity of its own pod, with no exec credential plugin installed in the image.
+// Tokens are requested natively (presigned STS request on EKS, metadata server on GKE, Azure AD
+// on AKS) and refreshed ahead of expiry, so that requests, including those re-establishing
+// watches, never carry an expired token.
+// Kubeconfigs using exec credential plugins keep being supported by the kubeconfig package.
+package cloudauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
+)
+
+// Provider is the cloud provider hosting the managed cluster
+type Provider string
+
+const (
+	// EKS gets tokens from a presigned AWS STS GetCallerIdentity request, like aws-iam-authenticator
+	EKS = Provider("eks")
+
+	// GKE gets tokens of the service account of the node (or of the workload identity) from
+	// the GCE metadata server
+	GKE = Provider("gke")
+
+	// AKS gets Azure AD tokens via Azure workload identity or, if not configured, the managed
+	// identity of the node
+	AKS = Provider("aks")
+)
+
+const (
+	// refreshBefore is how long before expiry tokens are refreshed
+	refreshBefore = 5 * time.Minute
+
+	// retryAfter is how long, after a failed refresh, the current token keeps being used
+	// before refreshing again
+	retryAfter = 10 * time.Second
+
+	// requestTimeout bounds each request to cloud provider endpoints
+	requestTimeout = 30 * time.Second
+)
+
+// TokenSource returns bearer tokens accepted by the managed cluster API server
+type TokenSource interface {
+	// Token returns a new token and when it expires
+	Token(ctx context.Context) (string, time.Time, error)
+}
+
+// Source authenticates requests to the managed cluster with tokens of a TokenSource. Tokens
+// are cached and shared by all rest configs Source is applied to.
+type Source struct {
+	source TokenSource
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+	// retryAt, after a failed refresh, is when refresh is attempted again
+	retryAt time.Time
+}
+
+// New returns the Source for provider. clusterID is, on EKS, the cluster name and, on AKS, the
+// application ID of the AKS AAD server (empty for the one AKS managed AAD uses). It is not used
+// on GKE.
+func New(provider Provider, clusterID string) (*Source, error) {
+	switch provider {
+	case EKS:
+		if clusterID == "" {
+			return nil, errors.New("EKS requires the cluster name")
+		}
+		return NewSource(newEKS(clusterID)), nil
+	case GKE:
+		return NewSource(newGKE()), nil
+	case AKS:
+		if clusterID == "" {
+			clusterID = aksServerApplicationID
+		}
+		return NewSource(newAKS(clusterID)), nil
+	default:
+		return nil, fmt.Errorf("unknown token provider %q. Possible options are %s, %s and %s", provider, EKS, GKE, AKS)
+	}
+}
+
+// NewSource returns a Source using tokens of source
+func NewSource(source TokenSource) *Source {
+	return &Source{source: source}
+}
+
+// Configure sets up cfg, the rest config of the managed cluster, so that requests carry tokens of
+// s in place of any credential in the kubeconfig
+func (s *Source) Configure(cfg *rest.Config) {
+	cfg.ExecProvider = nil
+	cfg.AuthProvider = nil
+	cfg.BearerToken = ""
+	cfg.BearerTokenFile = ""
+	cfg.Username = ""
+	cfg.Password = ""
+	cfg.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &roundTripper{source: s, next: rt}
+	})
+}
+
+// Token returns the cached token, refreshed first if expiring within refreshBefore. When
+// refresh fails, the cached token is returned as long as it is still valid.
+func (s *Source) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	valid := s.token != "" && now.Before(s.expiry)
+	if valid && (now.Before(s.expiry.Add(-refreshBefore)) || now.Before(s.retryAt)) {
+		return s.token, nil
+	}
+
+	token, expiry, err := s.source.Token(ctx)
+	if err != nil {
+		if valid {
+			s.retryAt = now.Add(retryAfter)
+			return s.token, nil
+		}
+		return "", errors.Wrap(err, "failed to get managed cluster token")
+	}
+	s.token = token
+	s.expiry = expiry
+	s.retryAt = time.Time{}
+	return token, nil
+}
+
+// invalidate drops token, rejected by the API server, so that next request gets a new one
+func (s *Source) invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == token {
+		s.token = ""
+		s.retryAt = time.Time{}
+	}
+}
+
+// roundTripper sets the bearer token of source on requests
+type roundTripper struct {
+	source *Source
+	next   http.RoundTripper
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := rt.source.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := rt.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		rt.source.invalidate(token)
+	}
+	return resp, err
+}
+
+// WrappedRoundTripper lets client-go unwrap the transport, e.g. to close idle connections
+func (rt *roundTripper) WrappedRoundTripper() http.RoundTripper {
+	return rt.next
+}
+
+// accessToken is the response of OAuth2 token endpoints
+type accessToken struct {
+	AccessToken string  `json:"access_token"`
+	ExpiresIn   seconds `json:"expires_in"`
+}
+
+// seconds is a duration in seconds, either a JSON number or a string (like on Azure IMDS)
+type seconds int64
+
+func (s *seconds) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "invalid expires_in")
+	}
+	*s = seconds(value)
+	return nil
+}
+
+// getAccessToken sends req to an OAuth2 token endpoint and returns the token and its expiry
+func getAccessToken(req *http.Request) (string, time.Time, error) {
+	var token accessToken
+	if err := doJSON(req, &token); err != nil {
+		return "", time.Time{}, err
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("no access token from %s", req.URL.Host)
+	}
+	return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+// doJSON sends req and decodes the JSON response into result
+func doJSON(req *http.Request, result any) error {
+	client := http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(result), "invalid response from %s", req.URL.Host)
+}
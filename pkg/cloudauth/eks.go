@@ -0,0 +1,284 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// eksTokenPrefix prefixes tokens accepted by aws-iam-authenticator
+	eksTokenPrefix = "k8s-aws-v1."
+
+	// eksClusterIDHeader binds the presigned request to the cluster
+	eksClusterIDHeader = "x-k8s-aws-id"
+
+	// eksTokenLifetime is how long EKS accepts a token (15 minutes), minus a safety margin
+	eksTokenLifetime = 14 * time.Minute
+
+	// presignedExpiry is the X-Amz-Expires of the presigned request, ignored by EKS
+	presignedExpiry = "60"
+
+	// awsSessionName is the role session name with IRSA
+	awsSessionName = "drift-detection-manager"
+
+	// Environment variables set by the AWS SDKs conventions, IRSA and EKS Pod Identity
+	awsAccessKeyIDEnv          = "AWS_ACCESS_KEY_ID"
+	awsSecretAccessKeyEnv      = "AWS_SECRET_ACCESS_KEY"
+	awsSessionTokenEnv         = "AWS_SESSION_TOKEN"
+	awsRegionEnv               = "AWS_REGION"
+	awsDefaultRegionEnv        = "AWS_DEFAULT_REGION"
+	awsRoleARNEnv              = "AWS_ROLE_ARN"
+	awsWebIdentityTokenFileEnv = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	awsContainerCredentialsEnv = "AWS_CONTAINER_CREDENTIALS_FULL_URI"
+	awsContainerTokenFileEnv   = "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"
+
+	// awsGlobalRegion is the region of the global STS endpoint
+	awsGlobalRegion = "us-east-1"
+
+	// sha256 of an empty payload
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// awsCredentials are AWS credentials. expiry is zero for long-lived ones.
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	expiry          time.Time
+}
+
+// eks builds tokens the way aws-iam-authenticator does: a GetCallerIdentity STS request,
+// bound to the cluster name and presigned with AWS Signature Version 4. Credentials are, in
+// order, static ones from the environment, IRSA (web identity) and EKS Pod Identity.
+type eks struct {
+	clusterName string
+	region      string
+
+	// stsEndpoint is the URL of the STS endpoint
+	stsEndpoint string
+
+	// credentials are the cached temporary credentials. Source serializes calls to Token.
+	credentials awsCredentials
+}
+
+func newEKS(clusterName string) *eks {
+	region := os.Getenv(awsRegionEnv)
+	if region == "" {
+		region = os.Getenv(awsDefaultRegionEnv)
+	}
+	stsEndpoint := "https://sts.amazonaws.com/"
+	if region != "" {
+		stsEndpoint = fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	} else {
+		region = awsGlobalRegion
+	}
+	return &eks{clusterName: clusterName, region: region, stsEndpoint: stsEndpoint}
+}
+
+func (e *eks) Token(ctx context.Context) (string, time.Time, error) {
+	credentials, err := e.getCredentials(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	presigned, err := e.presign(credentials, time.Now().UTC())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiry := time.Now().Add(eksTokenLifetime)
+	if !credentials.expiry.IsZero() && credentials.expiry.Before(expiry) {
+		expiry = credentials.expiry
+	}
+	return eksTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(presigned)), expiry, nil
+}
+
+// presign returns the URL of the GetCallerIdentity request signed, at now, with credentials
+func (e *eks) presign(credentials *awsCredentials, now time.Time) (string, error) {
+	endpoint, err := url.Parse(e.stsEndpoint)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid STS endpoint")
+	}
+
+	amzDate := now.Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/sts/aws4_request", now.Format("20060102"), e.region)
+	signedHeaders := "host;" + eksClusterIDHeader
+	query := url.Values{
+		"Action":              {"GetCallerIdentity"},
+		"Version":             {"2011-06-15"},
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {credentials.accessKeyID + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {presignedExpiry},
+		"X-Amz-SignedHeaders": {signedHeaders},
+	}
+	if credentials.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+	// Encode sorts by key. SigV4 requires spaces encoded as %20.
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		"/",
+		canonicalQuery,
+		"host:" + endpoint.Host,
+		eksClusterIDHeader + ":" + e.clusterName,
+		"",
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + credentials.secretAccessKey)
+	for _, value := range []string{now.Format("20060102"), e.region, "sts", "aws4_request"} {
+		key = hmacSHA256(key, value)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return fmt.Sprintf("%s://%s/?%s&X-Amz-Signature=%s", endpoint.Scheme, endpoint.Host, canonicalQuery, signature), nil
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(value))
+	return h.Sum(nil)
+}
+
+// getCredentials returns the AWS credentials, refreshing temporary ones ahead of expiry
+func (e *eks) getCredentials(ctx context.Context) (*awsCredentials, error) {
+	if accessKeyID := os.Getenv(awsAccessKeyIDEnv); accessKeyID != "" {
+		return &awsCredentials{
+			accessKeyID:     accessKeyID,
+			secretAccessKey: os.Getenv(awsSecretAccessKeyEnv),
+			sessionToken:    os.Getenv(awsSessionTokenEnv),
+		}, nil
+	}
+
+	if e.credentials.accessKeyID != "" && time.Until(e.credentials.expiry) > eksTokenLifetime {
+		return &e.credentials, nil
+	}
+
+	var credentials *awsCredentials
+	var err error
+	switch {
+	case os.Getenv(awsWebIdentityTokenFileEnv) != "":
+		credentials, err = e.assumeRoleWithWebIdentity(ctx)
+	case os.Getenv(awsContainerCredentialsEnv) != "":
+		credentials, err = getContainerCredentials(ctx)
+	default:
+		err = fmt.Errorf("no AWS credentials: set %s, IRSA or EKS Pod Identity", awsAccessKeyIDEnv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.credentials = *credentials
+	return credentials, nil
+}
+
+// assumeRoleWithWebIdentity exchanges the IRSA service account token for role credentials
+func (e *eks) assumeRoleWithWebIdentity(ctx context.Context) (*awsCredentials, error) {
+	token, err := os.ReadFile(os.Getenv(awsWebIdentityTokenFileEnv))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read web identity token")
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv(awsRoleARNEnv)},
+		"RoleSessionName":  {awsSessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.stsEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AssumeRoleWithWebIdentity returned %s", resp.Status)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "invalid AssumeRoleWithWebIdentity response")
+	}
+	return &awsCredentials{
+		accessKeyID:     result.Credentials.AccessKeyID,
+		secretAccessKey: result.Credentials.SecretAccessKey,
+		sessionToken:    result.Credentials.SessionToken,
+		expiry:          result.Credentials.Expiration,
+	}, nil
+}
+
+// getContainerCredentials gets credentials from the EKS Pod Identity agent
+func getContainerCredentials(ctx context.Context) (*awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, os.Getenv(awsContainerCredentialsEnv), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	if tokenFile := os.Getenv(awsContainerTokenFileEnv); tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read container authorization token")
+		}
+		req.Header.Set("Authorization", strings.TrimSpace(string(token)))
+	}
+
+	var result struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := doJSON(req, &result); err != nil {
+		return nil, err
+	}
+	return &awsCredentials{
+		accessKeyID:     result.AccessKeyID,
+		secretAccessKey: result.SecretAccessKey,
+		sessionToken:    result.Token,
+		expiry:          result.Expiration,
+	}, nil
+}
@@ -0,0 +1,33 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudauth
+
+func NewGKE(endpoint string) TokenSource {
+	return &gke{endpoint: endpoint}
+}
+
+func NewEKS(clusterName, region, stsEndpoint string) TokenSource {
+	return &eks{clusterName: clusterName, region: region, stsEndpoint: stsEndpoint}
+}
+
+func NewAKS(serverID, imdsEndpoint string) TokenSource {
+	return &aks{serverID: serverID, imdsEndpoint: imdsEndpoint}
+}
+
+const (
+	RefreshBefore = refreshBefore
+)
@@ -0,0 +1,56 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudauth
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// gceMetadataHostEnv, when set, overrides the address of the GCE metadata server
+	gceMetadataHostEnv = "GCE_METADATA_HOST"
+
+	defaultGCEMetadataHost = "metadata.google.internal"
+)
+
+// gke gets tokens of the default service account from the GCE metadata server. With GKE
+// workload identity, the metadata server returns tokens of the Google service account the
+// Kubernetes service account is bound to.
+type gke struct {
+	// endpoint is the URL of the metadata server token endpoint
+	endpoint string
+}
+
+func newGKE() *gke {
+	host := os.Getenv(gceMetadataHostEnv)
+	if host == "" {
+		host = defaultGCEMetadataHost
+	}
+	return &gke{endpoint: "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/token"}
+}
+
+func (g *gke) Token(ctx context.Context) (string, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.endpoint, http.NoBody)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return getAccessToken(req)
+}
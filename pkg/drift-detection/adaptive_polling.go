@@ -0,0 +1,97 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// pollSchedule contains when a resource of a GVK in polling mode is next evaluated.
+//
+// With adaptive polling, the interval at which a resource is evaluated doubles every time
+// the resource is found unchanged, up to MaxPollingInterval, and goes back to pollingInterval
+// as soon as the resource changes. So evaluations are spent on resources which actually drift.
+type pollSchedule struct {
+	interval time.Duration
+	due      time.Time
+}
+
+// isAdaptivePollingEnabled returns true if resources in polling mode are evaluated at
+// an interval adapted to how often they change
+func isAdaptivePollingEnabled() bool {
+	return getRuntimeSettings().MaxPollingInterval > pollingInterval
+}
+
+// duePolledResources returns the resources, among tracked ones, due for evaluation.
+// Resources are evaluated on polling ticks, so any resource due before next tick is considered due.
+func (m *manager) duePolledResources(shard *gvkShard, tracked []corev1.ObjectReference,
+	now time.Time) []corev1.ObjectReference {
+
+	if !isAdaptivePollingEnabled() {
+		return tracked
+	}
+
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	due := make([]corev1.ObjectReference, 0, len(tracked))
+	for i := range tracked {
+		schedule, ok := shard.pollSchedules[tracked[i]]
+		if !ok || schedule.due.Before(now.Add(pollingInterval/2)) {
+			due = append(due, tracked[i])
+		}
+	}
+	return due
+}
+
+// reschedulePolledResources schedules next evaluation of the due resources, evaluated at now.
+// Changed resources are evaluated again after pollingInterval. For unchanged ones, interval is
+// doubled (bounded by MaxPollingInterval).
+func (m *manager) reschedulePolledResources(shard *gvkShard, due, changed []corev1.ObjectReference,
+	now time.Time) {
+
+	if !isAdaptivePollingEnabled() {
+		return
+	}
+	maxPollingInterval := getRuntimeSettings().MaxPollingInterval
+
+	isChanged := make(map[corev1.ObjectReference]bool, len(changed))
+	for i := range changed {
+		isChanged[changed[i]] = true
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	for i := range due {
+		if _, ok := shard.resourceHashes[due[i]]; !ok {
+			// not tracked anymore
+			continue
+		}
+
+		interval := pollingInterval
+		if previous, ok := shard.pollSchedules[due[i]]; ok && !isChanged[due[i]] {
+			interval = 2 * previous.interval
+			if interval > maxPollingInterval {
+				interval = maxPollingInterval
+			}
+		}
+		shard.pollSchedules[due[i]] = pollSchedule{interval: interval, due: now.Add(interval)}
+	}
+}
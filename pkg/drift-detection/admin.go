@@ -0,0 +1,141 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// EvaluatePath is the path prefix, on the diagnostics endpoint, used to force evaluation
+	// of a single resource:
+	// POST /evaluate/{group}/{version}/{kind}/{namespace}/{name} for namespaced resources
+	// POST /evaluate/{group}/{version}/{kind}/{name} for cluster wide resources
+	// Use core as group for resources in the core group.
+	EvaluatePath = "/evaluate/"
+
+	coreGroup = "core"
+)
+
+// EvaluationResult is the response to a forced evaluation
+type EvaluationResult struct {
+	Resource corev1.ObjectReference `json:"resource"`
+
+	// Drifted is set if a configuration drift was detected and reported (only detected
+	// in report-only mode)
+	Drifted bool `json:"drifted"`
+}
+
+// EvaluateHandler returns an handler which evaluates right away the resource identified by
+// the request path (see EvaluatePath), instead of waiting for the next evaluation.
+// Must only be served behind authentication/authorization.
+func EvaluateHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		resourceRef, err := parseEvaluatePath(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m, err := GetManager()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		if !m.stillTrackingResource(resourceRef) {
+			http.Error(w, fmt.Sprintf("%s %s/%s is not tracked", resourceRef.Kind, resourceRef.Namespace,
+				resourceRef.Name), http.StatusNotFound)
+			return
+		}
+
+		if m.paused.Load() {
+			http.Error(w, "cluster is paused", http.StatusConflict)
+			return
+		}
+
+		logger := m.log.WithValues("resource", fmt.Sprintf("%s/%s", resourceRef.Namespace, resourceRef.Name))
+		logger = logger.WithValues("gvk", resourceRef.GroupVersionKind())
+		logger.V(logs.LogInfo).Info("evaluation requested via diagnostics endpoint")
+
+		drifted, err := m.evaluateAndReport(r.Context(), resourceRef)
+		if err != nil {
+			logger.V(logs.LogInfo).Error(err, "failed to evaluate resource")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&EvaluationResult{Resource: *resourceRef, Drifted: drifted}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// AdminPaths returns the paths, on the diagnostics endpoint, changing or exposing drift detection
+// state: forced evaluations, state, tracked resources, drift events and drift per component.
+// Requests to those must be audited.
+func AdminPaths() []string {
+	return []string{EvaluatePath, StatePath, TrackedPath, DriftEventsPath, ComponentsPath}
+}
+
+// parseEvaluatePath returns the resource identified by path (see EvaluatePath)
+func parseEvaluatePath(path string) (*corev1.ObjectReference, error) {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(path, EvaluatePath), "/"), "/")
+
+	const clusterWideSegments = 4
+	const namespacedSegments = 5
+
+	var namespace, name string
+	switch len(segments) {
+	case clusterWideSegments:
+		name = segments[3]
+	case namespacedSegments:
+		namespace, name = segments[3], segments[4]
+	default:
+		return nil, fmt.Errorf("expected %s{group}/{version}/{kind}/[{namespace}/]{name}", EvaluatePath)
+	}
+
+	for i := range segments {
+		if segments[i] == "" {
+			return nil, fmt.Errorf("empty segment in path %s", path)
+		}
+	}
+
+	group := segments[0]
+	if group == coreGroup {
+		group = ""
+	}
+
+	gvk := schema.GroupVersionKind{Group: group, Version: segments[1], Kind: segments[2]}
+	apiVersion, kind := gvk.ToAPIVersionAndKind()
+	return &corev1.ObjectReference{APIVersion: apiVersion, Kind: kind, Namespace: namespace, Name: name}, nil
+}
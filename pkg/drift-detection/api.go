@@ -0,0 +1,253 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// TrackedPath is the path, on the diagnostics endpoint, serving the list of tracked
+	// resources (see TrackedResourceList). Supported query parameters are:
+	// - limit, maximum number of resources returned (default 500, at most 5000);
+	// - continue, the continue token returned with previous page.
+	// Differently from StatePath, response format is stable and meant to be consumed by tools.
+	TrackedPath = "/api/v1/tracked"
+
+	// DriftEventsPath is the path, on the diagnostics endpoint, serving the most recent drift
+	// events (see DriftEventList). Supported query parameter is after: only events with a greater
+	// sequence are returned.
+	DriftEventsPath = "/api/v1/events"
+
+	// TrackedAPIVersion is the version of the format served at TrackedPath and DriftEventsPath
+	TrackedAPIVersion = "v1"
+
+	defaultTrackedLimit = 500
+	maxTrackedLimit     = 5000
+)
+
+// TrackedResourceList is a page of tracked resources, sorted by apiVersion, kind, namespace and name
+type TrackedResourceList struct {
+	APIVersion string `json:"apiVersion"`
+
+	Items []TrackedResource `json:"items"`
+
+	// Continue, if set, must be passed as continue query parameter to get next page.
+	// Empty on last page.
+	Continue string `json:"continue,omitempty"`
+}
+
+// TrackedResource is a resource tracked for configuration drift
+type TrackedResource struct {
+	Resource corev1.ObjectReference `json:"resource"`
+
+	// Sections contains the ResourceSummary sections resource is listed in
+	Sections []Section `json:"sections"`
+
+	// Consumers contains the ResourceSummaries tracking resource
+	Consumers []Consumer `json:"consumers"`
+
+	// Hash is the hex encoded hash resource is compared against (a digest of it for Secrets).
+	// Empty if resource does not exist.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Consumer is a ResourceSummary tracking a resource
+type Consumer struct {
+	ResourceSummary corev1.ObjectReference `json:"resourceSummary"`
+
+	// Section is the ResourceSummary section resource is listed in
+	Section Section `json:"section"`
+}
+
+// DriftEventList contains the most recent drift events, oldest first
+type DriftEventList struct {
+	APIVersion string `json:"apiVersion"`
+
+	Items []DriftEvent `json:"items"`
+}
+
+// getTrackedResourceList returns, from state, at most limit tracked resources following the
+// one encoded in continueToken (from the first one if continueToken is empty)
+func getTrackedResourceList(state *State, limit int, continueToken string) (*TrackedResourceList, error) {
+	start := 0
+	if continueToken != "" {
+		last, err := decodeContinueToken(continueToken)
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(state.Resources), func(i int) bool {
+			return lessObjectRef(last, &state.Resources[i].Resource)
+		})
+	}
+
+	list := &TrackedResourceList{APIVersion: TrackedAPIVersion, Items: make([]TrackedResource, 0)}
+	end := start + limit
+	if end >= len(state.Resources) {
+		end = len(state.Resources)
+	} else {
+		list.Continue = encodeContinueToken(&state.Resources[end-1].Resource)
+	}
+
+	for i := start; i < end; i++ {
+		list.Items = append(list.Items, getTrackedResource(&state.Resources[i]))
+	}
+
+	return list, nil
+}
+
+func getTrackedResource(resourceState *ResourceState) TrackedResource {
+	trackedResource := TrackedResource{
+		Resource:  resourceState.Resource,
+		Sections:  make([]Section, 0),
+		Consumers: make([]Consumer, 0),
+		Hash:      resourceState.Hash,
+	}
+
+	sections := []struct {
+		section   Section
+		consumers []corev1.ObjectReference
+	}{
+		{section: ResourcesSection, consumers: resourceState.Consumers},
+		{section: HelmSection, consumers: resourceState.HelmConsumers},
+	}
+	for _, s := range sections {
+		if len(s.consumers) == 0 {
+			continue
+		}
+		trackedResource.Sections = append(trackedResource.Sections, s.section)
+		consumers := make([]corev1.ObjectReference, len(s.consumers))
+		copy(consumers, s.consumers)
+		sort.Slice(consumers, func(i, j int) bool {
+			return lessObjectRef(&consumers[i], &consumers[j])
+		})
+		for i := range consumers {
+			trackedResource.Consumers = append(trackedResource.Consumers,
+				Consumer{ResourceSummary: consumers[i], Section: s.section})
+		}
+	}
+
+	return trackedResource
+}
+
+// encodeContinueToken returns an opaque token identifying the last returned resource
+func encodeContinueToken(last *corev1.ObjectReference) string {
+	data, err := json.Marshal(last)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeContinueToken(token string) (*corev1.ObjectReference, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid continue token")
+	}
+	last := &corev1.ObjectReference{}
+	if err := json.Unmarshal(data, last); err != nil {
+		return nil, fmt.Errorf("invalid continue token")
+	}
+	return last, nil
+}
+
+// TrackedHandler returns an handler serving, in JSON format, pages of tracked resources
+// (see TrackedPath). Must only be served behind authentication/authorization.
+func TrackedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isGet(w, r) {
+			return
+		}
+
+		limit := defaultTrackedLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit <= 0 || limit > maxTrackedLimit {
+				http.Error(w, fmt.Sprintf("limit must be a number between 1 and %d", maxTrackedLimit),
+					http.StatusBadRequest)
+				return
+			}
+		}
+
+		m, err := GetManager()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		list, err := getTrackedResourceList(m.GetState(), limit, r.URL.Query().Get("continue"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// DriftEventsHandler returns an handler serving, in JSON format, the most recent drift events
+// (see DriftEventsPath). Must only be served behind authentication/authorization.
+func DriftEventsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isGet(w, r) {
+			return
+		}
+
+		var after uint64
+		if value := r.URL.Query().Get("after"); value != "" {
+			var err error
+			after, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				http.Error(w, "after must be a sequence number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		m, err := GetManager()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		list := &DriftEventList{APIVersion: TrackedAPIVersion, Items: m.driftEvents.after(after)}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// isGet returns true if r is a GET request. Otherwise it replies with an error.
+func isGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
+)
+
+// BenchmarkShape defines the shape of the synthetic objects used by RunBenchmark
+type BenchmarkShape string
+
+const (
+	// NestedShape generates Deployment-like objects with a nested spec
+	NestedShape = BenchmarkShape("nested")
+
+	// ConfigMapShape generates ConfigMaps with flat data
+	ConfigMapShape = BenchmarkShape("configmap")
+)
+
+// BenchmarkOptions configures RunBenchmark
+type BenchmarkOptions struct {
+	// Shape of the synthetic objects
+	Shape BenchmarkShape
+	// Objects is the number of synthetic objects evaluated per iteration
+	Objects int
+	// Iterations is the number of times all objects are evaluated
+	Iterations int
+	// Fields is the number of fields per map (spec level for NestedShape, data keys for ConfigMapShape)
+	Fields int
+	// Depth is the nesting depth of spec for NestedShape
+	Depth int
+	// ValueSize is the size, in bytes, of each string value
+	ValueSize int
+	// DriftRatio is the fraction of objects modified before each iteration
+	DriftRatio float64
+}
+
+// BenchmarkResult contains the stats collected by RunBenchmark
+type BenchmarkResult struct {
+	// Evaluations is the number of resource evaluations performed
+	Evaluations int
+	// Drifts is the number of configuration drifts detected
+	Drifts int
+	// Duration is the time spent evaluating
+	Duration time.Duration
+	// Allocs is the number of heap allocations performed while evaluating
+	Allocs uint64
+	// AllocBytes is the number of bytes allocated while evaluating
+	AllocBytes uint64
+}
+
+// String returns a human readable report of the benchmark result
+func (r *BenchmarkResult) String() string {
+	if r.Evaluations == 0 {
+		return "no evaluations performed"
+	}
+	evaluations := uint64(r.Evaluations)
+	return fmt.Sprintf("evaluations: %d\ndrifts: %d\nduration: %s\nthroughput: %.0f evaluations/s\n"+
+		"time: %d ns/evaluation\nallocations: %d allocs/evaluation, %d B/evaluation\n",
+		r.Evaluations, r.Drifts, r.Duration, float64(r.Evaluations)/r.Duration.Seconds(),
+		r.Duration.Nanoseconds()/int64(r.Evaluations), r.Allocs/evaluations, r.AllocBytes/evaluations)
+}
+
+// RunBenchmark runs the evaluation path (hashing, canonical encoding and drift evaluation)
+// against synthetic objects and returns throughput and allocation stats.
+// No API server is needed: objects are evaluated the same way objects carried by watch events are.
+func RunBenchmark(ctx context.Context, options *BenchmarkOptions) (*BenchmarkResult, error) {
+	if options.Objects <= 0 || options.Iterations <= 0 || options.Fields <= 0 || options.Depth <= 0 {
+		return nil, fmt.Errorf("objects, iterations, fields and depth must be positive")
+	}
+	if options.Shape != NestedShape && options.Shape != ConfigMapShape {
+		return nil, fmt.Errorf("unsupported shape %q", options.Shape)
+	}
+
+	m := newBenchmarkManager()
+	requestor := &corev1.ObjectReference{Kind: "ResourceSummary", Namespace: "benchmark", Name: "benchmark"}
+	random := rand.New(rand.NewSource(1)) //nolint: gosec // predictable content is fine for a benchmark
+
+	objects := make([]*unstructured.Unstructured, options.Objects)
+	refs := make([]corev1.ObjectReference, options.Objects)
+	for i := range objects {
+		objects[i] = generateBenchmarkObject(options, i, random)
+		refs[i] = corev1.ObjectReference{Kind: objects[i].GetKind(), APIVersion: objects[i].GetAPIVersion(),
+			Namespace: objects[i].GetNamespace(), Name: objects[i].GetName()}
+
+		ref := m.trackResource(&refs[i], false, requestor)
+		shard := m.getResourceShard(ref)
+		shard.resourceHashes[*ref] = newCompactHash(m.unstructuredHash(objects[i]))
+		shard.evaluatedRevisions[*ref] = getRevision(objects[i])
+	}
+
+	result := &BenchmarkResult{}
+	for iteration := 0; iteration < options.Iterations; iteration++ {
+		// Prepare objects as watch events would carry them: every object has a new
+		// resourceVersion, only some are modified
+		for i := range objects {
+			objects[i].SetResourceVersion(strconv.Itoa(iteration + 1))
+			if random.Float64() < options.DriftRatio {
+				mutateBenchmarkObject(options, objects[i], random)
+			}
+			shard := m.getResourceShard(&refs[i])
+			shard.eventObjects[refs[i]] = objects[i]
+		}
+
+		updates := resourceSummaryUpdates{}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		for i := range refs {
+			if err := m.collectDrift(ctx, &refs[i], updates); err != nil {
+				return nil, err
+			}
+		}
+		result.Duration += time.Since(start)
+		runtime.ReadMemStats(&after)
+
+		result.Evaluations += len(refs)
+		result.Allocs += after.Mallocs - before.Mallocs
+		result.AllocBytes += after.TotalAlloc - before.TotalAlloc
+		for _, update := range updates {
+			result.Drifts += len(update.resources)
+		}
+	}
+
+	return result, nil
+}
+
+// newBenchmarkManager returns a manager which can evaluate resources without
+// being connected to any cluster
+func newBenchmarkManager() *manager {
+	interner := newRefInterner()
+	return &manager{
+		log:           logr.Discard(),
+		mu:            &sync.RWMutex{},
+		jobQueue:      &libsveltosset.Set{},
+		queuedAt:      make(map[corev1.ObjectReference]time.Time),
+		resources:     &consumerMap{interner: interner},
+		helmResources: &consumerMap{interner: interner},
+	}
+}
+
+func generateBenchmarkObject(options *BenchmarkOptions, index int, random *rand.Rand) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetNamespace("benchmark")
+	u.SetName(fmt.Sprintf("object-%d", index))
+	u.SetResourceVersion("0")
+	u.SetLabels(map[string]string{"app": "benchmark", "index": strconv.Itoa(index)})
+
+	if options.Shape == ConfigMapShape {
+		u.SetAPIVersion("v1")
+		u.SetKind("ConfigMap")
+		data := make(map[string]interface{}, options.Fields)
+		for i := 0; i < options.Fields; i++ {
+			data[fmt.Sprintf("key-%d", i)] = randomBenchmarkValue(options.ValueSize, random)
+		}
+		u.Object["data"] = data
+		return u
+	}
+
+	u.SetAPIVersion("apps/v1")
+	u.SetKind("Deployment")
+	u.Object["spec"] = generateBenchmarkMap(options, options.Depth, random)
+	return u
+}
+
+func generateBenchmarkMap(options *BenchmarkOptions, depth int, random *rand.Rand) map[string]interface{} {
+	result := make(map[string]interface{}, options.Fields)
+	for i := 0; i < options.Fields; i++ {
+		key := fmt.Sprintf("field-%d", i)
+		switch {
+		case depth > 1 && i == 0:
+			result[key] = generateBenchmarkMap(options, depth-1, random)
+		case i%3 == 1:
+			result[key] = random.Int63()
+		case i%3 == 2:
+			result[key] = []interface{}{randomBenchmarkValue(options.ValueSize, random), random.Int63()%2 == 0}
+		default:
+			result[key] = randomBenchmarkValue(options.ValueSize, random)
+		}
+	}
+	return result
+}
+
+// mutateBenchmarkObject modifies a single string value of u
+func mutateBenchmarkObject(options *BenchmarkOptions, u *unstructured.Unstructured, random *rand.Rand) {
+	if options.Shape == ConfigMapShape {
+		key := fmt.Sprintf("key-%d", random.Intn(options.Fields))
+		u.Object["data"].(map[string]interface{})[key] = randomBenchmarkValue(options.ValueSize, random)
+		return
+	}
+
+	// field-0 is nested when depth > 1, field-0 of deepest level is a string
+	spec := u.Object["spec"].(map[string]interface{})
+	for {
+		nested, ok := spec["field-0"].(map[string]interface{})
+		if !ok {
+			break
+		}
+		spec = nested
+	}
+	spec["field-0"] = randomBenchmarkValue(options.ValueSize, random)
+}
+
+func randomBenchmarkValue(size int, random *rand.Rand) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = letters[random.Intn(len(letters))]
+	}
+	return string(b)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// cert-manager periodically renews certificates, rewriting the data of the Secrets its
+// Certificates are stored in. When cert-manager rotation awareness is enabled (see
+// SetCertManagerRotation), rotating data keys of Secrets owned by a Certificate are not considered
+// when hashing: only changes to the owning Certificate reference (cert-manager annotations) and
+// to other data keys are configuration drifts.
+
+const (
+	// certManagerCertificateAnnotation is set by cert-manager on Secrets, to the owning Certificate
+	certManagerCertificateAnnotation = "cert-manager.io/certificate-name"
+)
+
+// certManagerRotatingKeys contains the Secret data keys cert-manager rewrites on renewal
+var certManagerRotatingKeys = []string{
+	"tls.crt",
+	"tls.key",
+	"ca.crt",
+	"keystore.jks",
+	"truststore.jks",
+	"keystore.p12",
+	"truststore.p12",
+}
+
+// excludeCertManagerRotation returns u without the data keys cert-manager rotates, if u is a
+// Secret owned by a cert-manager Certificate. u is returned unchanged otherwise, a modified copy
+// if any key was removed.
+func excludeCertManagerRotation(u *unstructured.Unstructured) *unstructured.Unstructured {
+	if !certManagerRotation || u.GetKind() != "Secret" || u.GetAPIVersion() != "v1" {
+		return u
+	}
+	metadata, _ := u.Object["metadata"].(map[string]interface{})
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	if _, ok := annotations[certManagerCertificateAnnotation]; !ok {
+		return u
+	}
+
+	var copied *unstructured.Unstructured
+	for _, field := range []string{"data", "stringData"} {
+		data, ok := u.Object[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, key := range certManagerRotatingKeys {
+			if _, ok := data[key]; !ok {
+				continue
+			}
+			if copied == nil {
+				copied = u.DeepCopy()
+			}
+			delete(copied.Object[field].(map[string]interface{}), key)
+		}
+	}
+
+	if copied == nil {
+		return u
+	}
+	return copied
+}
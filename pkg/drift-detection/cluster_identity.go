@@ -0,0 +1,161 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
+)
+
+const (
+	// clusterIdentityInterval is how often cluster is verified not to have been re-provisioned
+	clusterIdentityInterval = time.Minute
+
+	// ClusterRecreatedReason is the reason of the event emitted when cluster is found
+	// re-provisioned (see SetEventRecorder)
+	ClusterRecreatedReason = "ClusterRecreated"
+)
+
+// getClusterUID returns the UID of kube-system namespace, which identifies the cluster: a cluster
+// rebuilt with the same name (and address) has a different one
+func (m *manager) getClusterUID(ctx context.Context) (types.UID, error) {
+	metadata, err := m.getMetadata(ctx, &corev1.ObjectReference{Kind: "Namespace", APIVersion: "v1",
+		Name: metav1.NamespaceSystem})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get cluster identity")
+	}
+	return metadata.UID, nil
+}
+
+// loadClusterUID returns the UID of the cluster last seen. Empty if unknown.
+func (m *manager) loadClusterUID() types.UID {
+	uid, _ := m.clusterUID.Load().(types.UID)
+	return uid
+}
+
+// followClusterIdentity periodically verifies, till ctx is canceled, that cluster was not
+// re-provisioned. When it was, tracked resources are all gone (or recreated) at once: instead
+// of reporting each one as drifted, baselines are reset (see resetBaselines).
+func (m *manager) followClusterIdentity(ctx context.Context) {
+	ticker := time.NewTicker(clusterIdentityInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		uid, err := m.getClusterUID(ctx)
+		if err != nil {
+			m.log.V(logs.LogDebug).Info(err.Error())
+			continue
+		}
+
+		previous := m.loadClusterUID()
+		if previous == "" {
+			m.clusterUID.Store(uid)
+			continue
+		}
+		if uid == previous {
+			continue
+		}
+
+		m.reportClusterRecreated(previous, uid)
+		// State persisted for previous cluster is ignored from now on (see loadSnapshot)
+		m.clusterUID.Store(uid)
+		if err := m.resetBaselines(ctx); err != nil {
+			m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to reset baselines: %v", err))
+			// Retried next time
+			m.clusterUID.Store(previous)
+		}
+	}
+}
+
+// reportClusterRecreated logs, and emits an event, that cluster was found re-provisioned
+func (m *manager) reportClusterRecreated(previous, current types.UID) {
+	msg := fmt.Sprintf("cluster was re-provisioned (kube-system UID changed from %s to %s). "+
+		"Resetting baselines from ResourceSummaries.", previous, current)
+	m.log.V(logs.LogInfo).Info(msg)
+	trackClusterRecreated()
+
+	if eventRecorder != nil {
+		namespace := &corev1.Namespace{
+			TypeMeta:   metav1.TypeMeta{Kind: "Namespace", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: metav1.NamespaceSystem, UID: current},
+		}
+		eventRecorder.Event(namespace, corev1.EventTypeWarning, ClusterRecreatedReason, msg)
+	}
+}
+
+// resetBaselines drops all tracked resources, their hashes and any queued evaluation or buffered
+// update, all relative to the cluster before it was re-provisioned, then registers resources
+// again from existing ResourceSummaries, as on startup. Evaluations are suspended meanwhile.
+func (m *manager) resetBaselines(ctx context.Context) error {
+	m.resetting.Store(true)
+	defer m.resetting.Store(false)
+
+	// Watchers of GVKs registered meanwhile are deferred till state is rebuilt
+	m.initialized.Store(false)
+
+	m.rangeShards(func(gvk schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+
+		m.stopWatcher(gvk, shard)
+		if shard.polled {
+			trackPolledGVKs(int(m.polledGVKCount.Add(-1)))
+		}
+		shard.reset()
+	})
+
+	m.mu.Lock()
+	for _, consumers := range []*consumerMap{m.resources, m.helmResources} {
+		for resourceRef, resourceSummaries := range consumers.snapshot() {
+			items := resourceSummaries.Items()
+			for i := range items {
+				consumers.erase(&resourceRef, &items[i])
+			}
+		}
+	}
+	m.jobQueue = &libsveltosset.Set{}
+	m.queuedAt = make(map[corev1.ObjectReference]time.Time)
+	m.mu.Unlock()
+
+	m.pending.mu.Lock()
+	m.pending.updates = nil
+	m.pending.persisted = 0
+	m.pending.mu.Unlock()
+
+	if err := m.readResourceSummaries(ctx); err != nil {
+		return err
+	}
+
+	m.initialized.Store(true)
+	return m.startDeferredWatchers(ctx)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// compactHash is a resource hash stored inline (no separate allocation).
+// The zero value represents a missing hash (resource was deleted).
+type compactHash [sha256.Size]byte
+
+// newCompactHash converts a hash to its compact form. It accepts:
+// - hashes as returned by unstructuredHash;
+// - hashes as stored in ResourceSummary Status by the ResourceSummary reconciler (hex encoded).
+// Any other value (nil means resource was deleted) cannot match a current hash anyway, so it is
+// converted to a value which is guaranteed to never match one.
+func newCompactHash(h []byte) compactHash {
+	var result compactHash
+	switch {
+	case len(h) == 0:
+		// zero value
+	case len(h) == sha256.Size:
+		copy(result[:], h)
+	case len(h) == hex.EncodedLen(sha256.Size):
+		if _, err := hex.Decode(result[:], h); err != nil {
+			result = sha256.Sum256(h)
+		}
+	default:
+		result = sha256.Sum256(h)
+	}
+	return result
+}
+
+// bytes returns the hash in the form returned by unstructuredHash. Nil for a missing hash.
+func (h compactHash) bytes() []byte {
+	if h == (compactHash{}) {
+		return nil
+	}
+	return h[:]
+}
+
+// internedRef is an ObjectReference shared by all consumer sets referencing it
+type internedRef struct {
+	ref   corev1.ObjectReference
+	count int
+}
+
+// refInterner deduplicates identical ObjectReference values so that all sets, and map keys,
+// containing an ObjectReference share the same strings. When thousands of ResourceSummaries
+// reference overlapping resources, this avoids keeping a copy of the same strings per set.
+// Entries are reference counted and removed when not used anymore.
+// Not safe for concurrent use. A nil refInterner does not intern.
+type refInterner struct {
+	refs map[corev1.ObjectReference]*internedRef
+}
+
+func newRefInterner() *refInterner {
+	return &refInterner{refs: make(map[corev1.ObjectReference]*internedRef)}
+}
+
+// intern returns the shared copy of ref, taking a reference on it
+func (i *refInterner) intern(ref *corev1.ObjectReference) *corev1.ObjectReference {
+	if i == nil {
+		return ref
+	}
+
+	entry, ok := i.refs[*ref]
+	if !ok {
+		entry = &internedRef{ref: *ref}
+		i.refs[*ref] = entry
+	}
+	entry.count++
+	return &entry.ref
+}
+
+// lookup returns the shared copy of ref, if any, without taking a reference on it
+func (i *refInterner) lookup(ref *corev1.ObjectReference) *corev1.ObjectReference {
+	if i == nil {
+		return ref
+	}
+
+	if entry, ok := i.refs[*ref]; ok {
+		return &entry.ref
+	}
+	return ref
+}
+
+// release drops a reference taken by intern
+func (i *refInterner) release(ref *corev1.ObjectReference) {
+	if i == nil {
+		return
+	}
+
+	entry, ok := i.refs[*ref]
+	if !ok {
+		return
+	}
+	entry.count--
+	if entry.count == 0 {
+		delete(i.refs, *ref)
+	}
+}
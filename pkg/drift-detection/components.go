@@ -0,0 +1,178 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// ComponentsPath is the path, on the diagnostics endpoint, serving current drift grouped by
+	// component (see ComponentList), for instance for a developer portal to show drift status per
+	// service. Resources are grouped by the value of the component label (see SetComponentLabel),
+	// which label query parameter overrides.
+	ComponentsPath = "/api/v1/components"
+
+	// ComponentDrifted is the status of a component with at least one drifted resource
+	ComponentDrifted = "Drifted"
+
+	// ComponentInSync is the status of a component with no drifted resource
+	ComponentInSync = "InSync"
+
+	defaultComponentLabel = "app.kubernetes.io/part-of"
+)
+
+// ComponentList contains the drift status of each component, sorted by name
+type ComponentList struct {
+	APIVersion string `json:"apiVersion"`
+
+	// Label is the label resources were grouped by
+	Label string `json:"label"`
+
+	Items []ComponentDrift `json:"items"`
+}
+
+// ComponentDrift is the drift status of the tracked resources with same component label value
+type ComponentDrift struct {
+	// Component is the component label value. Empty for resources with no such label, or whose
+	// labels are not known because their GVK is not watched (e.g. polled, see SetMemoryBudget).
+	Component string `json:"component"`
+
+	// Status is either Drifted or InSync
+	Status string `json:"status"`
+
+	// TrackedResources is the number of tracked resources of the component
+	TrackedResources int `json:"trackedResources"`
+
+	// DriftedResources contains the resources whose most recent drift event is an actual drift
+	// (see DriftEventsPath), sorted
+	DriftedResources []DriftedResource `json:"driftedResources"`
+}
+
+// DriftedResource is a resource which drifted
+type DriftedResource struct {
+	Resource corev1.ObjectReference `json:"resource"`
+
+	// Time is when drift was detected
+	Time time.Time `json:"time"`
+
+	// Deleted is set if resource was deleted, unset if it was modified
+	Deleted bool `json:"deleted"`
+}
+
+// getComponentList returns the drift status of all components, resources being grouped by label
+func (m *manager) getComponentList(label string) *ComponentList {
+	drifted := make(map[corev1.ObjectReference]*DriftEvent)
+	events := m.driftEvents.after(0)
+	for i := range events {
+		if events[i].isDrift() {
+			drifted[events[i].Resource] = &events[i]
+		} else {
+			delete(drifted, events[i].Resource)
+		}
+	}
+
+	components := make(map[string]*ComponentDrift)
+	m.rangeShards(func(_ schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+
+		tracked := shard.resources.Items()
+		for i := range tracked {
+			name := getComponent(shard.informers, &tracked[i], label)
+			component, ok := components[name]
+			if !ok {
+				component = &ComponentDrift{Component: name, Status: ComponentInSync,
+					DriftedResources: make([]DriftedResource, 0)}
+				components[name] = component
+			}
+			component.TrackedResources++
+			if event, ok := drifted[tracked[i]]; ok {
+				component.Status = ComponentDrifted
+				component.DriftedResources = append(component.DriftedResources,
+					DriftedResource{Resource: tracked[i], Time: event.Time, Deleted: event.Deleted})
+			}
+		}
+	})
+
+	list := &ComponentList{APIVersion: TrackedAPIVersion, Label: label,
+		Items: make([]ComponentDrift, 0, len(components))}
+	for _, component := range components {
+		sort.Slice(component.DriftedResources, func(i, j int) bool {
+			return lessObjectRef(&component.DriftedResources[i].Resource, &component.DriftedResources[j].Resource)
+		})
+		list.Items = append(list.Items, *component)
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Component < list.Items[j].Component
+	})
+	return list
+}
+
+// getComponent returns the value of label of resource, as cached by watchers. Empty if resource
+// is not cached. Shard lock must be held.
+func getComponent(watched informerSet, resourceRef *corev1.ObjectReference, label string) string {
+	if watched == nil {
+		return ""
+	}
+	key := resourceRef.Name
+	if resourceRef.Namespace != "" {
+		key = resourceRef.Namespace + "/" + key
+	}
+	obj, exists, err := watched.getByKey(key)
+	if err != nil || !exists {
+		return ""
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return ""
+	}
+	return u.GetLabels()[label]
+}
+
+// ComponentsHandler returns an handler serving, in JSON format, current drift grouped by
+// component (see ComponentsPath). Must only be served behind authentication/authorization.
+func ComponentsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isGet(w, r) {
+			return
+		}
+
+		label := componentLabel
+		if value := r.URL.Query().Get("label"); value != "" {
+			label = value
+		}
+
+		m, err := GetManager()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(m.getComponentList(label)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
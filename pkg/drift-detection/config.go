@@ -0,0 +1,653 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// HashMode defines which part of a resource is considered when evaluating its hash
+type HashMode string
+
+const (
+	// FullHashMode considers labels, annotations and any content but metadata and status
+	FullHashMode = HashMode("full")
+
+	// SpecHashMode considers any content but metadata and status. Labels and annotations are ignored.
+	SpecHashMode = HashMode("spec")
+)
+
+// Section identifies a section of ResourceSummary listing resources to track
+type Section string
+
+const (
+	// ResourcesSection lists resources deployed because of referenced ConfigMaps/Secrets
+	ResourcesSection = Section("resources")
+
+	// HelmSection lists resources deployed because of helm charts
+	HelmSection = Section("helm")
+)
+
+const (
+	defaultReadResourceSummariesConcurrency = 10
+	defaultPollingInterval                  = time.Minute
+	defaultIncrementalHashThreshold         = 1024 * 1024
+	defaultListPageSize                     = 500
+	defaultDiscoveryCacheTTL                = 10 * time.Minute
+	defaultDriftConfirmations               = 1
+	defaultSnapshotInterval                 = 5 * time.Minute
+	defaultEventReportInterval              = time.Minute
+)
+
+var (
+	// readResourceSummariesConcurrency is the maximum number of ResourceSummaries
+	// processed concurrently when rebuilding internal state on startup
+	readResourceSummariesConcurrency = defaultReadResourceSummariesConcurrency
+
+	// hashMode defines which part of a resource is considered when evaluating its hash
+	hashMode = FullHashMode
+
+	// generationAwareGroupKinds contains the GroupKinds whose metadata.generation is bumped
+	// on any change to content considered by SpecHashMode
+	generationAwareGroupKinds = map[schema.GroupKind]bool{}
+
+	// memoryBudget is the maximum heap, in bytes, drift-detection-manager should use.
+	// Zero means no budget.
+	memoryBudget uint64
+
+	// pollingInterval is the interval at which resources of GVKs whose watcher was
+	// stopped, because memory budget was exceeded, are queued for evaluation
+	pollingInterval = defaultPollingInterval
+
+	// incrementalHashThreshold is the data size, in bytes, above which changed keys of
+	// ConfigMaps/Secrets are tracked. Zero disables tracking.
+	incrementalHashThreshold uint64 = defaultIncrementalHashThreshold
+
+	// listPageSize is the maximum number of objects returned by each LIST request
+	listPageSize int64 = defaultListPageSize
+
+	// evaluationBudget, when set, limits the rate at which resources are evaluated
+	evaluationBudget flowcontrol.RateLimiter
+
+	// pausedWatchers defines what happens to watchers while cluster is paused
+	pausedWatchers = KeepPausedWatchers
+
+	// runtimeSettings contains the settings which can be changed while running.
+	// Copy-on-write: always replaced as a whole, never modified.
+	runtimeSettings atomic.Pointer[RuntimeSettings]
+
+	// snapshotStore is where state of tracked resources is persisted for warm restarts.
+	// Nil means state is not persisted.
+	snapshotStore SnapshotStore
+
+	// snapshotInterval is the interval at which state of tracked resources is persisted
+	snapshotInterval = defaultSnapshotInterval
+
+	// disabledSections contains the ResourceSummary sections whose resources are not tracked
+	disabledSections = map[Section]bool{}
+
+	// includedNamespaces, when not empty, contains the only namespaces whose resources are tracked
+	includedNamespaces = map[string]bool{}
+
+	// deniedKinds contains the kinds whose resources are never tracked, whatever ResourceSummaries list
+	deniedKinds = map[schema.GroupKind]bool{}
+
+	// reportOnly, when set, prevents ResourceSummaries from being marked for reconciliation
+	reportOnly bool
+
+	// fluxOwnership defines how drifts of resources managed by Flux are handled
+	fluxOwnership = ReportFluxOwned
+
+	// terraformOwnership defines how drifts of resources managed by Terraform are handled
+	terraformOwnership = ReportTerraformOwned
+
+	// crossplaneAware, when set, makes drift detection aware of how Crossplane reconciles claims,
+	// composite and managed resources
+	crossplaneAware = true
+
+	// sidecarNormalization, when set, removes what service meshes inject from pod templates
+	// before hashing
+	sidecarNormalization = true
+
+	// certManagerRotation, when set, ignores data rotated by cert-manager in Secrets owned by a Certificate
+	certManagerRotation = true
+
+	// externalSecretsAware, when set, ignores data refreshed by External Secrets Operator in the
+	// Secrets it manages
+	externalSecretsAware bool
+
+	// inventoryCorrelation, when set, makes deletions of resources removed from their inventory
+	// intentional prunings rather than configuration drifts
+	inventoryCorrelation bool
+
+	// policyReportInterval is the interval at which drift events are written as PolicyReports.
+	// Zero disables PolicyReports.
+	policyReportInterval time.Duration
+
+	// eventReportSource, when set, is the name of the EventSource drifted resources are written
+	// as the EventReport of. Empty disables EventReports.
+	eventReportSource string
+
+	// eventReportInterval is the interval at which drifted resources are written as EventReport
+	eventReportInterval time.Duration
+
+	// eventReportsInManagementCluster is set when EventReports are written, along with
+	// ResourceSummaries, in the management cluster
+	eventReportsInManagementCluster bool
+
+	// helmValuesInterval is the interval at which values of Helm releases are evaluated for
+	// drift. Zero disables values drift detection.
+	helmValuesInterval time.Duration
+
+	// driftEventOutput, when set, is where each drift event is written as a single-line JSON record
+	driftEventOutput io.Writer
+
+	// driftEventSinks receive drift events and their remediations
+	driftEventSinks []DriftEventSink
+
+	// driftEventFormat is the format drift events are written in to driftEventOutput
+	driftEventFormat = NativeDriftEventFormat
+
+	// driftEventSigningKey, when set, is the key drift events are signed with
+	driftEventSigningKey []byte
+
+	// snapshotEncryption, when set, wraps the keys persisted state is encrypted with
+	snapshotEncryption KeyEncryptionService
+
+	// plaintextSnapshotMigration, when set, allows loading once a snapshot in plaintext while
+	// encryption is enabled (see SetPlaintextSnapshotMigration)
+	plaintextSnapshotMigration atomic.Bool
+
+	// impersonation is the identity tracked resources are read with. Empty means own identity.
+	impersonation rest.ImpersonationConfig
+
+	// componentLabel is the label tracked resources are grouped by at ComponentsPath
+	componentLabel = defaultComponentLabel
+
+	// eventRecorder, when set, is used to emit events about the cluster (e.g. ClusterRecreated)
+	eventRecorder record.EventRecorder
+)
+
+// RuntimeSettings contains the settings which can be changed while running, without restart
+// (for instance via DriftDetectionConfig).
+type RuntimeSettings struct {
+	// EvaluationInterval is the interval at which queued resources are evaluated.
+	// Zero means the interval passed to InitializeManager.
+	EvaluationInterval time.Duration
+
+	// DriftConfirmations is the number of consecutive evaluations which must find a resource
+	// drifted before drift is reported
+	DriftConfirmations uint
+
+	// MaxPollingInterval, when greater than polling interval, enables adaptive polling: resources
+	// found unchanged are evaluated less and less frequently, up to every MaxPollingInterval.
+	// Only resources in polling mode (see SetMemoryBudget) are affected.
+	MaxPollingInterval time.Duration
+
+	// DiscoveryCacheTTL is how long discovery results are cached
+	DiscoveryCacheTTL time.Duration
+
+	// KindEvaluationIntervals overrides, per GroupKind, the interval at which queued resources
+	// are evaluated. Must not be modified once applied.
+	KindEvaluationIntervals map[schema.GroupKind]time.Duration
+
+	// ExcludedNamespaces contains the namespaces whose resources are never tracked nor evaluated.
+	// Must not be modified once applied.
+	ExcludedNamespaces []string
+}
+
+// GetRuntimeSettings returns the settings currently in use
+func GetRuntimeSettings() RuntimeSettings {
+	return *getRuntimeSettings()
+}
+
+// ApplyRuntimeSettings replaces the settings currently in use. Zero values fall back to defaults.
+// Safe to call while manager is running.
+func ApplyRuntimeSettings(settings RuntimeSettings) {
+	if settings.DriftConfirmations == 0 {
+		settings.DriftConfirmations = defaultDriftConfirmations
+	}
+	if settings.DiscoveryCacheTTL <= 0 {
+		settings.DiscoveryCacheTTL = defaultDiscoveryCacheTTL
+	}
+	runtimeSettings.Store(&settings)
+}
+
+func getRuntimeSettings() *RuntimeSettings {
+	if settings := runtimeSettings.Load(); settings != nil {
+		return settings
+	}
+	return &RuntimeSettings{DriftConfirmations: defaultDriftConfirmations, DiscoveryCacheTTL: defaultDiscoveryCacheTTL}
+}
+
+// updateRuntimeSettings changes a copy of the settings currently in use and applies it
+func updateRuntimeSettings(update func(settings *RuntimeSettings)) {
+	settings := GetRuntimeSettings()
+	update(&settings)
+	ApplyRuntimeSettings(settings)
+}
+
+// SetReadResourceSummariesConcurrency sets the maximum number of ResourceSummaries
+// processed concurrently on startup. Must be called before InitializeManager.
+func SetReadResourceSummariesConcurrency(concurrency int) {
+	if concurrency <= 0 {
+		concurrency = defaultReadResourceSummariesConcurrency
+	}
+	readResourceSummariesConcurrency = concurrency
+}
+
+// SetHashMode sets which part of a resource is considered when evaluating its hash.
+// When SpecHashMode is used, resources are evaluated using the object carried by the
+// watch event, without fetching them again. Must be called before InitializeManager.
+func SetHashMode(mode HashMode) {
+	hashMode = mode
+}
+
+// SetGenerationAwareGroupKinds sets the GroupKinds whose metadata.generation is bumped on any change
+// to content considered by SpecHashMode. With SpecHashMode, resources of those kinds are not
+// hashed when their generation did not change. Must be called before InitializeManager.
+func SetGenerationAwareGroupKinds(groupKinds []schema.GroupKind) {
+	generationAwareGroupKinds = make(map[schema.GroupKind]bool, len(groupKinds))
+	for i := range groupKinds {
+		generationAwareGroupKinds[groupKinds[i]] = true
+	}
+}
+
+func isGenerationAware(groupKind schema.GroupKind) bool {
+	return generationAwareGroupKinds[groupKind]
+}
+
+// SetMemoryBudget sets the maximum heap, in bytes, drift-detection-manager should use.
+// When exceeded, watchers (starting from the one caching most objects) are stopped and
+// resources of corresponding GVKs are queued for evaluation every interval instead.
+// A zero budget disables this behavior. Must be called before InitializeManager.
+func SetMemoryBudget(budget uint64, interval time.Duration) {
+	memoryBudget = budget
+	if interval <= 0 {
+		interval = defaultPollingInterval
+	}
+	pollingInterval = interval
+}
+
+// SetIncrementalHashThreshold sets the data size, in bytes, above which the per-key digests of
+// ConfigMaps and Secrets are kept, so that the keys changed by a drift can be reported. Hashes do
+// not depend on it. Zero disables tracking of changed keys.
+// Must be called before InitializeManager.
+func SetIncrementalHashThreshold(threshold uint64) {
+	incrementalHashThreshold = threshold
+}
+
+// SetListPageSize sets the maximum number of objects returned by each LIST request issued
+// when baselining tracked resources on startup and when scanning GVKs in polling mode.
+// Must be called before InitializeManager.
+func SetListPageSize(size int64) {
+	if size <= 0 {
+		size = defaultListPageSize
+	}
+	listPageSize = size
+}
+
+// SetEvaluationBudget limits evaluations to qps per second, with bursts of up to burst
+// evaluations, so that a drift storm cannot use more than its share of CPU and API server
+// requests. No limit if qps is not positive. Must be called before InitializeManager.
+func SetEvaluationBudget(qps float32, burst int) {
+	if qps <= 0 {
+		evaluationBudget = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	evaluationBudget = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+}
+
+// SetPausedWatchers sets whether watchers keep running while cluster is paused (see SetPaused).
+// Must be called before InitializeManager.
+func SetPausedWatchers(mode PausedWatchers) {
+	pausedWatchers = mode
+}
+
+// SetDiscoveryCacheTTL sets how long discovery results (resource mappings) are cached.
+// Cached results are also dropped anytime a mapping cannot be found.
+func SetDiscoveryCacheTTL(ttl time.Duration) {
+	updateRuntimeSettings(func(settings *RuntimeSettings) {
+		settings.DiscoveryCacheTTL = ttl
+	})
+}
+
+// SetDriftConfirmations sets the number of consecutive evaluations which must find a resource
+// drifted before drift is reported. One (default) reports drifts as soon as detected.
+func SetDriftConfirmations(confirmations uint) {
+	updateRuntimeSettings(func(settings *RuntimeSettings) {
+		settings.DriftConfirmations = confirmations
+	})
+}
+
+// SetMaxPollingInterval enables adaptive polling for resources whose watcher was stopped because
+// memory budget was exceeded. Resources which have not changed in a long time are evaluated less
+// frequently, up to every maxInterval, while recently changed ones are evaluated every polling interval.
+// Adaptive polling is disabled if maxInterval is not greater than polling interval.
+// Must be called after SetMemoryBudget.
+func SetMaxPollingInterval(maxInterval time.Duration) {
+	updateRuntimeSettings(func(settings *RuntimeSettings) {
+		settings.MaxPollingInterval = maxInterval
+	})
+}
+
+// SetKindEvaluationIntervals sets, per GroupKind, the interval at which queued resources are evaluated
+// (for instance Secrets every 30s and ConfigMaps every 5m). Resources of any other kind are evaluated
+// at the interval passed to InitializeManager.
+func SetKindEvaluationIntervals(intervals map[schema.GroupKind]time.Duration) {
+	kindIntervals := make(map[schema.GroupKind]time.Duration, len(intervals))
+	for gk, interval := range intervals {
+		if interval > 0 {
+			kindIntervals[gk] = interval
+		}
+	}
+	updateRuntimeSettings(func(settings *RuntimeSettings) {
+		settings.KindEvaluationIntervals = kindIntervals
+	})
+}
+
+// SetDisabledSections sets the ResourceSummary sections whose resources are not tracked
+// (for instance to only detect drifts of helm resources). Must be called before InitializeManager.
+func SetDisabledSections(sections []Section) {
+	disabledSections = make(map[Section]bool, len(sections))
+	for i := range sections {
+		disabledSections[sections[i]] = true
+	}
+}
+
+// IsSectionDisabled returns true if resources in section are not tracked
+func IsSectionDisabled(section Section) bool {
+	return disabledSections[section]
+}
+
+func getSection(isHelmResource bool) Section {
+	if isHelmResource {
+		return HelmSection
+	}
+	return ResourcesSection
+}
+
+// SetExcludedNamespaces sets the namespaces whose resources are never tracked nor evaluated
+// (for instance kube-system on locked-down clusters). Watchers started afterwards do not
+// receive events for resources in those namespaces.
+func SetExcludedNamespaces(namespaces []string) {
+	excluded := make([]string, len(namespaces))
+	copy(excluded, namespaces)
+	updateRuntimeSettings(func(settings *RuntimeSettings) {
+		settings.ExcludedNamespaces = excluded
+	})
+}
+
+// IsNamespaceExcluded returns true if resources in namespace must never be tracked nor evaluated:
+// namespace is either excluded (see SetExcludedNamespaces) or not included (see SetIncludedNamespaces).
+// Cluster wide resources (empty namespace) are only excluded when included namespaces are set.
+func IsNamespaceExcluded(namespace string) bool {
+	if len(includedNamespaces) != 0 && !includedNamespaces[namespace] {
+		return true
+	}
+	if namespace == "" {
+		return false
+	}
+	for _, excluded := range getRuntimeSettings().ExcludedNamespaces {
+		if excluded == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// SetDeniedKinds sets the kinds whose resources are never tracked nor evaluated, even when listed
+// by a ResourceSummary (for instance Secrets in some environments, or Leases which change all the
+// time). It is a guardrail against watching sensitive or high churn kinds. Must be called before
+// InitializeManager.
+func SetDeniedKinds(kinds []schema.GroupKind) {
+	deniedKinds = make(map[schema.GroupKind]bool, len(kinds))
+	for i := range kinds {
+		deniedKinds[kinds[i]] = true
+	}
+}
+
+// IsKindDenied returns true if resources of kind must never be tracked (see SetDeniedKinds)
+func IsKindDenied(kind schema.GroupKind) bool {
+	return deniedKinds[kind]
+}
+
+// SetIncludedNamespaces sets the only namespaces whose resources are tracked. Resources in any other
+// namespace, and cluster wide resources, are never tracked nor evaluated. Resources are then watched
+// and listed per namespace, so drift-detection-manager can run with namespace-limited RBAC.
+// An empty list means all namespaces. Must be called before InitializeManager.
+func SetIncludedNamespaces(namespaces []string) {
+	includedNamespaces = make(map[string]bool, len(namespaces))
+	for i := range namespaces {
+		includedNamespaces[namespaces[i]] = true
+	}
+}
+
+// getWatchedNamespaces returns the namespaces resources are watched and listed in:
+// all namespaces, unless included namespaces are set
+func getWatchedNamespaces() []string {
+	if len(includedNamespaces) == 0 {
+		return []string{corev1.NamespaceAll}
+	}
+	namespaces := make([]string, 0, len(includedNamespaces))
+	for namespace := range includedNamespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// SetReportOnly enables report-only mode: drifts are detected, logged, counted in metrics and
+// recorded as drift events (see DriftEventsPath), but ResourceSummaries are never marked for
+// reconciliation. Must be called before InitializeManager.
+func SetReportOnly(enabled bool) {
+	reportOnly = enabled
+}
+
+// SetFluxOwnership sets how drifts of resources carrying Flux Kustomization or HelmRelease
+// ownership labels are handled. Deletions are always reported: labels of a deleted resource
+// are not known. Must be called before InitializeManager.
+func SetFluxOwnership(mode FluxOwnership) {
+	fluxOwnership = mode
+}
+
+// SetTerraformOwnership sets how drifts of resources managed by Terraform (labeled
+// app.kubernetes.io/managed-by=terraform, or with fields owned by a Terraform field manager) are
+// handled. With ExcludeTerraformFields, TerraformFieldExclusion must also be passed to
+// SetFieldExclusions. Must be called before InitializeManager.
+func SetTerraformOwnership(mode TerraformOwnership) {
+	terraformOwnership = mode
+}
+
+// SetCrossplaneAware sets whether fields Crossplane populates are ignored, and drift is only
+// evaluated at claim (or standalone composite resource) level. Enabled by default.
+// Must be called before InitializeManager.
+func SetCrossplaneAware(enabled bool) {
+	crossplaneAware = enabled
+}
+
+// SetSidecarNormalization sets whether containers, init containers, volumes, labels and
+// annotations injected by Istio and Linkerd are removed from pod templates before hashing.
+// Enabled by default. Must be called before InitializeManager.
+func SetSidecarNormalization(enabled bool) {
+	sidecarNormalization = enabled
+}
+
+// SetCertManagerRotation sets whether data keys cert-manager rotates on renewal (tls.crt, tls.key,
+// ca.crt and keystores) are ignored in Secrets owned by a cert-manager Certificate. Drift is then
+// only reported if owning Certificate reference or other keys change. Enabled by default.
+// Must be called before InitializeManager.
+func SetCertManagerRotation(enabled bool) {
+	certManagerRotation = enabled
+}
+
+// SetExternalSecretsAware sets whether, in Secrets managed by an ExternalSecret, fields written by
+// External Secrets Operator are ignored. Manual edits, and changes of the managing ExternalSecret,
+// are still reported. Must be called before InitializeManager.
+func SetExternalSecretsAware(enabled bool) {
+	externalSecretsAware = enabled
+}
+
+// SetInventoryCorrelation enables correlating tracked resources with the inventory (Flux
+// Kustomization or cli-utils inventory ConfigMap) listing them: resources deleted after being
+// removed from their inventory are recorded as pruned (see DriftEvent.PrunedBy) rather than
+// reported as configuration drifts. Must be called before InitializeManager.
+func SetInventoryCorrelation(enabled bool) {
+	inventoryCorrelation = enabled
+}
+
+// SetPolicyReportInterval enables writing, every interval, drift events as PolicyReports and a
+// ClusterPolicyReport (wgpolicyk8s.io/v1alpha2) in the managed cluster, so that tools like Policy
+// Reporter show drifts. PolicyReport CRDs must be installed. Zero disables it.
+// Must be called before InitializeManager.
+func SetPolicyReportInterval(interval time.Duration) {
+	policyReportInterval = interval
+}
+
+// SetEventReports enables writing, every interval, the resources which drifted meanwhile as the
+// EventReport of EventSource eventSourceName, so that Sveltos EventTriggers referencing it react
+// to drifts. EventReport is written where ResourceSummaries are stored: inManagementCluster must
+// be set when those are in the management cluster. Empty eventSourceName disables it.
+// Must be called before InitializeManager.
+func SetEventReports(eventSourceName string, interval time.Duration, inManagementCluster bool) {
+	if interval <= 0 {
+		interval = defaultEventReportInterval
+	}
+	eventReportSource = eventSourceName
+	eventReportInterval = interval
+	eventReportsInManagementCluster = inManagementCluster
+}
+
+// SetHelmValuesInterval enables values drift detection: every interval, values of the deployed
+// revision of each Helm release listed in ResourceSummaries are compared against the values
+// Sveltos deployed it with, so that manual `helm upgrade --set` are detected even when rendered
+// resources are similar. Requires list permission on Secrets in release namespaces.
+// Zero disables it. Must be called before InitializeManager.
+func SetHelmValuesInterval(interval time.Duration) {
+	helmValuesInterval = interval
+}
+
+// SetImpersonation sets the identity (user and groups) tracked resources are read (watched, listed
+// and fetched) with, so that drift detection runs with reduced privileges. ResourceSummaries are
+// still read and updated with drift-detection-manager own identity, which must be allowed to
+// impersonate userName and groups. Empty userName disables impersonation.
+// Must be called before InitializeManager.
+func SetImpersonation(userName string, groups []string) {
+	impersonation = rest.ImpersonationConfig{UserName: userName}
+	if userName != "" {
+		impersonation.Groups = make([]string, len(groups))
+		copy(impersonation.Groups, groups)
+	}
+}
+
+// SetDriftEventOutput sets where each drift event (see DriftEvent) is written, as a single-line
+// JSON record, so that log collectors can ingest structured drift data. Nil disables it.
+// Must be called before InitializeManager.
+func SetDriftEventOutput(w io.Writer) {
+	driftEventOutput = w
+}
+
+// AddDriftEventSink adds a sink receiving drift events as they are recorded, and their
+// remediations by Sveltos (e.g. to send those as CDEvents or to a SIEM).
+// Must be called before InitializeManager.
+func AddDriftEventSink(sink DriftEventSink) {
+	driftEventSinks = append(driftEventSinks, sink)
+}
+
+// SetDriftEventFormat sets the format drift events are written in (see SetDriftEventOutput).
+// Must be called before InitializeManager.
+func SetDriftEventFormat(format DriftEventFormat) {
+	driftEventFormat = format
+}
+
+// SetDriftEventSigningKey sets the key each drift event is signed with (see DriftEvent.Signature),
+// so that consumers of drift events can verify they were neither forged nor altered (see
+// VerifyDriftEvent). Empty key disables signing.
+// Must be called before InitializeManager.
+func SetDriftEventSigningKey(key []byte) {
+	driftEventSigningKey = nil
+	if len(key) != 0 {
+		driftEventSigningKey = make([]byte, len(key))
+		copy(driftEventSigningKey, key)
+	}
+}
+
+// SetSnapshot enables persisting state of tracked resources to path, every interval.
+// On restart, resources whose state was persisted are neither fetched nor hashed again.
+// Empty path disables it.
+func SetSnapshot(path string, interval time.Duration) {
+	if path == "" {
+		SetSnapshotStore(nil, interval)
+		return
+	}
+	SetSnapshotStore(&fileSnapshotStore{path: path}, interval)
+}
+
+// SetSnapshotStore enables persisting state of tracked resources to store, every interval.
+// Unlike a local file, a store shared by replicas (see checkpoint.SecretStore) lets a standby
+// replica take over without fetching and hashing every tracked resource again. Nil disables it.
+func SetSnapshotStore(store SnapshotStore, interval time.Duration) {
+	snapshotStore = store
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	snapshotInterval = interval
+}
+
+// SetSnapshotEncryption enables envelope encryption of persisted state (see SetSnapshot): each
+// snapshot is encrypted with a new data key, wrapped by service (for instance an external KMS).
+// Nil disables encryption. Must be called before InitializeManager.
+func SetSnapshotEncryption(service KeyEncryptionService) {
+	snapshotEncryption = service
+}
+
+// SetPlaintextSnapshotMigration allows, when snapshot encryption is enabled (see SetSnapshotEncryption),
+// to load persisted state found in plaintext once, so that enabling encryption does not lose it. Meant
+// to be set only for the first restart after enabling encryption: otherwise a snapshot in plaintext
+// is rejected, as it was not written by a manager with encryption enabled.
+// Must be called before InitializeManager.
+func SetPlaintextSnapshotMigration(enabled bool) {
+	plaintextSnapshotMigration.Store(enabled)
+}
+
+// SetEventRecorder sets the recorder used to emit events about the cluster, for instance when it
+// is found re-provisioned (see ClusterRecreatedReason). Nil disables events.
+// Must be called before InitializeManager.
+func SetEventRecorder(recorder record.EventRecorder) {
+	eventRecorder = recorder
+}
+
+// SetComponentLabel sets the label, e.g. app.kubernetes.io/part-of, tracked resources are grouped
+// by at ComponentsPath. Empty means app.kubernetes.io/part-of.
+func SetComponentLabel(label string) {
+	if label == "" {
+		label = defaultComponentLabel
+	}
+	componentLabel = label
+}
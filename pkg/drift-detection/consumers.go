@@ -0,0 +1,108 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+
+	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
+)
+
+// consumerMap maps each tracked resource to the set of ResourceSummaries referencing it.
+// It is read on hot paths (watch notifications and evaluations) and written only on
+// (un)registration, so:
+// - reads are lock free;
+// - a set, once stored, is never modified. Writers store a modified copy instead
+// (copy-on-write), so readers can safely use a set after the lookup.
+// Writers must be serialized by the caller (manager lock).
+// Resources and ResourceSummaries references are interned, so each distinct reference
+// is kept in memory once no matter how many sets contain it.
+type consumerMap struct {
+	m sync.Map
+
+	// interner is shared by all consumerMaps of a manager. Its access is serialized
+	// by the same lock serializing writers.
+	interner *refInterner
+}
+
+// get returns the set of ResourceSummaries referencing resource.
+// Returned set must not be modified.
+func (c *consumerMap) get(resourceRef *corev1.ObjectReference) (*libsveltosset.Set, bool) {
+	v, ok := c.m.Load(*resourceRef)
+	if !ok {
+		return nil, false
+	}
+	return v.(*libsveltosset.Set), true
+}
+
+// has returns true if at least one ResourceSummary references resource
+func (c *consumerMap) has(resourceRef *corev1.ObjectReference) bool {
+	_, ok := c.m.Load(*resourceRef)
+	return ok
+}
+
+// insert adds consumer to the set of ResourceSummaries referencing resource.
+// Returns the interned resource reference.
+func (c *consumerMap) insert(resourceRef, consumer *corev1.ObjectReference) *corev1.ObjectReference {
+	set := &libsveltosset.Set{}
+	current, ok := c.get(resourceRef)
+	if ok {
+		if current.Has(consumer) {
+			return c.interner.lookup(resourceRef)
+		}
+		set.Append(current)
+	} else {
+		resourceRef = c.interner.intern(resourceRef)
+	}
+	set.Insert(c.interner.intern(consumer))
+	c.m.Store(*resourceRef, set)
+	return c.interner.lookup(resourceRef)
+}
+
+// erase removes consumer from the set of ResourceSummaries referencing resource.
+// Resource is removed when no ResourceSummary references it anymore.
+func (c *consumerMap) erase(resourceRef, consumer *corev1.ObjectReference) {
+	current, ok := c.get(resourceRef)
+	if !ok || !current.Has(consumer) {
+		return
+	}
+
+	c.interner.release(consumer)
+
+	if current.Len() == 1 {
+		c.m.Delete(*resourceRef)
+		c.interner.release(resourceRef)
+		return
+	}
+
+	set := &libsveltosset.Set{}
+	set.Append(current)
+	set.Erase(consumer)
+	c.m.Store(*resourceRef, set)
+}
+
+// snapshot returns a copy of the map. Sets in the returned map must not be modified.
+func (c *consumerMap) snapshot() map[corev1.ObjectReference]*libsveltosset.Set {
+	result := make(map[corev1.ObjectReference]*libsveltosset.Set)
+	c.m.Range(func(key, value any) bool {
+		result[key.(corev1.ObjectReference)] = value.(*libsveltosset.Set)
+		return true
+	})
+	return result
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"maps"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Crossplane continuously reconciles the resources it manages, populating fields of claims,
+// composite resources (XRs) and managed resources on its own. When Crossplane awareness is enabled
+// (see SetCrossplaneAware):
+//   - fields Crossplane populates in claims and XRs (references to the bound XR, to composed
+//     resources, to the selected composition) and bookkeeping annotations of managed resources are
+//     not considered when hashing. Provider populated atProvider fields are in status, which is
+//     never considered;
+//   - drift is evaluated at claim (or standalone XR) level: XRs bound to a claim and resources
+//     composed by an XR are reconciled by Crossplane from the claim, so their drifts are ignored.
+
+const (
+	// crossplaneCompositeLabel is set by Crossplane on composed resources, to their XR
+	crossplaneCompositeLabel = "crossplane.io/composite"
+
+	// crossplaneClaimNameLabel is set by Crossplane on XRs bound to a claim, and their composed resources
+	crossplaneClaimNameLabel = "crossplane.io/claim-name"
+)
+
+// crossplaneBookkeepingAnnotations contains the annotations providers set on managed resources
+// while creating the external resource
+var crossplaneBookkeepingAnnotations = []string{
+	"crossplane.io/external-name",
+	"crossplane.io/external-create-pending",
+	"crossplane.io/external-create-succeeded",
+	"crossplane.io/external-create-failed",
+}
+
+// crossplanePopulatedFields contains the spec fields Crossplane populates in claims and XRs
+var crossplanePopulatedFields = []string{
+	// claim: bound XR
+	"resourceRef",
+	// XR: composed resources
+	"resourceRefs",
+	// XR: bound claim
+	"claimRef",
+	// claim and XR: composition revision in use
+	"compositionRevisionRef",
+}
+
+// getCrossplaneBookkeepingAnnotations returns the Crossplane annotations not considered when
+// hashing. None if Crossplane awareness is disabled.
+func getCrossplaneBookkeepingAnnotations() []string {
+	if !crossplaneAware {
+		return nil
+	}
+	return crossplaneBookkeepingAnnotations
+}
+
+// excludeCrossplaneFields returns u without the spec fields Crossplane populates, if u is a claim
+// or an XR. u is returned unchanged if it contains none, a modified copy otherwise.
+func excludeCrossplaneFields(u *unstructured.Unstructured) *unstructured.Unstructured {
+	if !crossplaneAware {
+		return u
+	}
+	spec, ok := u.Object["spec"].(map[string]interface{})
+	if !ok {
+		return u
+	}
+
+	fields := make([]string, 0)
+	for _, field := range crossplanePopulatedFields {
+		if _, ok := spec[field]; ok {
+			fields = append(fields, field)
+		}
+	}
+	// compositionRef is populated by Crossplane when composition is chosen via compositionSelector
+	if _, ok := spec["compositionSelector"]; ok {
+		if _, ok := spec["compositionRef"]; ok {
+			fields = append(fields, "compositionRef")
+		}
+	}
+	if len(fields) == 0 {
+		return u
+	}
+
+	// Only spec is changed: the rest of the content is shared with u, which is never modified
+	copiedSpec := maps.Clone(spec)
+	for _, field := range fields {
+		delete(copiedSpec, field)
+	}
+	copied := maps.Clone(u.Object)
+	copied["spec"] = copiedSpec
+	return &unstructured.Unstructured{Object: copied}
+}
+
+// isCrossplaneComposed returns true if u is reconciled by Crossplane from a claim or an XR: either
+// an XR bound to a claim or a resource composed by an XR
+func isCrossplaneComposed(u *unstructured.Unstructured) bool {
+	labels := u.GetLabels()
+	return labels[crossplaneCompositeLabel] != "" || labels[crossplaneClaimNameLabel] != ""
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	memory "k8s.io/client-go/discovery/cached"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// discoveryCache caches discovery results and the dynamic client, so that registering
+// a resource or starting a watcher does not run discovery against the API server.
+// On clusters with hundreds of CRDs, discovery is expensive.
+// Discovery results are dropped after DiscoveryCacheTTL and on mapping errors (for
+// instance a CRD was installed after discovery last ran).
+type discoveryCache struct {
+	mu             sync.Mutex
+	mapper         *restmapper.DeferredDiscoveryRESTMapper
+	dynamicClient  dynamic.Interface
+	metadataClient metadata.Interface
+	refreshedAt    time.Time
+}
+
+// getDynamicClient returns the dynamic client, creating it first time it is needed
+func (m *manager) getDynamicClient() (dynamic.Interface, error) {
+	m.discovery.mu.Lock()
+	defer m.discovery.mu.Unlock()
+
+	if m.discovery.dynamicClient == nil {
+		d, err := dynamic.NewForConfig(m.getReadConfig())
+		if err != nil {
+			return nil, err
+		}
+		m.discovery.dynamicClient = d
+	}
+
+	return m.discovery.dynamicClient, nil
+}
+
+// getReadConfig returns the rest.Config tracked resources are read with: own config, impersonating
+// the identity set via SetImpersonation, if any
+func (m *manager) getReadConfig() *rest.Config {
+	if impersonation.UserName == "" {
+		return m.config
+	}
+	config := rest.CopyConfig(m.config)
+	config.Impersonate = impersonation
+	return config
+}
+
+// getMetadataClient returns the metadata client, creating it first time it is needed
+func (m *manager) getMetadataClient() (metadata.Interface, error) {
+	m.discovery.mu.Lock()
+	defer m.discovery.mu.Unlock()
+
+	if m.discovery.metadataClient == nil {
+		c, err := metadata.NewForConfig(m.getReadConfig())
+		if err != nil {
+			return nil, err
+		}
+		m.discovery.metadataClient = c
+	}
+
+	return m.discovery.metadataClient, nil
+}
+
+// getRESTMapper returns the RESTMapper. Cached discovery results are dropped once older
+// than DiscoveryCacheTTL.
+func (m *manager) getRESTMapper() (*restmapper.DeferredDiscoveryRESTMapper, error) {
+	m.discovery.mu.Lock()
+	defer m.discovery.mu.Unlock()
+
+	if m.discovery.mapper == nil {
+		dc, err := discovery.NewDiscoveryClientForConfig(m.config)
+		if err != nil {
+			return nil, err
+		}
+		m.discovery.mapper = restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc))
+		m.discovery.refreshedAt = time.Now()
+	} else if time.Since(m.discovery.refreshedAt) > getRuntimeSettings().DiscoveryCacheTTL {
+		m.discovery.mapper.Reset()
+		m.discovery.refreshedAt = time.Now()
+	}
+
+	return m.discovery.mapper, nil
+}
+
+// invalidateDiscovery drops cached discovery results. Next lookup runs discovery again.
+func (m *manager) invalidateDiscovery() {
+	m.discovery.mu.Lock()
+	defer m.discovery.mu.Unlock()
+
+	if m.discovery.mapper != nil {
+		m.discovery.mapper.Reset()
+		m.discovery.refreshedAt = time.Now()
+	}
+}
+
+// getRESTMapping returns the RESTMapping for gvk using cached discovery results.
+// On a mapping error, cached discovery results are invalidated.
+func (m *manager) getRESTMapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapper, err := m.getRESTMapper()
+	if err != nil {
+		return nil, err
+	}
+
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		if meta.IsNoMatchError(err) {
+			m.invalidateDiscovery()
+		}
+		return nil, err
+	}
+
+	return mapping, nil
+}
+
+// getDynamicResourceInterface returns the dynamic ResourceInterface for gvk in namespace.
+// Namespace is ignored for cluster wide resources.
+func (m *manager) getDynamicResourceInterface(gvk schema.GroupVersionKind, namespace string,
+) (dynamic.ResourceInterface, error) {
+
+	if m.config == nil {
+		return nil, fmt.Errorf("rest.Config is nil")
+	}
+
+	mapping, err := m.getRESTMapping(gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := m.getDynamicClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		// namespaced resources should specify the namespace
+		return d.Resource(mapping.Resource).Namespace(namespace), nil
+	}
+	// for cluster-wide resources
+	return d.Resource(mapping.Resource), nil
+}
+
+// getMetadataResourceInterface returns the metadata ResourceInterface for gvk in namespace.
+// Namespace is ignored for cluster wide resources.
+func (m *manager) getMetadataResourceInterface(gvk schema.GroupVersionKind, namespace string,
+) (metadata.ResourceInterface, error) {
+
+	if m.config == nil {
+		return nil, fmt.Errorf("rest.Config is nil")
+	}
+
+	mapping, err := m.getRESTMapping(gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := m.getMetadataClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		return c.Resource(mapping.Resource).Namespace(namespace), nil
+	}
+	return c.Resource(mapping.Resource), nil
+}
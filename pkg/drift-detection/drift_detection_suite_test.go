@@ -26,6 +26,7 @@ import (
 	. "github.com/onsi/gomega"
 
 	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
 	corev1 "k8s.io/api/core/v1"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -37,6 +38,7 @@ import (
 	"sigs.k8s.io/cluster-api/util"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	"github.com/projectsveltos/drift-detection-manager/internal/test/helpers"
 	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
@@ -221,3 +223,25 @@ func getResourceSummary(resource, helmResource *corev1.ObjectReference) *libsvel
 
 	return rs
 }
+
+// getMetric returns the metric named name whose label labelName is labelValue, nil if not found
+func getMetric(name, labelName, labelValue string) *dto.Metric {
+	families, err := metrics.Registry.Gather()
+	Expect(err).To(BeNil())
+	for i := range families {
+		if families[i].GetName() != name {
+			continue
+		}
+		for _, metric := range families[i].GetMetric() {
+			if labelName == "" {
+				return metric
+			}
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == labelName && label.GetValue() == labelValue {
+					return metric
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -19,44 +19,132 @@ package driftdetection
 import (
 	"context"
 	"fmt"
-	"reflect"
 	"time"
 
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 
+	"github.com/projectsveltos/drift-detection-manager/pkg/tracing"
 	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
 	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
 	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
 )
 
+// resourceSummaryUpdate contains all changes to apply to a ResourceSummary Status
+// because of resources which drifted during an evaluation cycle.
+type resourceSummaryUpdate struct {
+	resourcesChanged     bool
+	helmResourcesChanged bool
+
+	// Key: drifted resource, Value: drifted resource current hash
+	hashes map[corev1.ObjectReference][]byte
+
+	// drifted resources causing this update. Those are queued again
+	// for evaluation if updating ResourceSummary fails.
+	resources []corev1.ObjectReference
+}
+
+// merge applies other, more recent, changes on top of u
+func (u *resourceSummaryUpdate) merge(other *resourceSummaryUpdate) {
+	u.resourcesChanged = u.resourcesChanged || other.resourcesChanged
+	u.helmResourcesChanged = u.helmResourcesChanged || other.helmResourcesChanged
+	for ref, hash := range other.hashes {
+		if _, ok := u.hashes[ref]; !ok {
+			u.resources = append(u.resources, ref)
+		}
+		u.hashes[ref] = hash
+	}
+}
+
+// Key: ResourceSummary, Value: changes to apply to ResourceSummary Status
+type resourceSummaryUpdates map[corev1.ObjectReference]*resourceSummaryUpdate
+
+// add records that resourceRef, tracked because of resourceSummaryRef, drifted
+func (u resourceSummaryUpdates) add(resourceSummaryRef, resourceRef *corev1.ObjectReference,
+	currentHash []byte, isHelm bool) {
+
+	update, ok := u[*resourceSummaryRef]
+	if !ok {
+		update = &resourceSummaryUpdate{hashes: make(map[corev1.ObjectReference][]byte)}
+		u[*resourceSummaryRef] = update
+	}
+
+	if isHelm {
+		update.helmResourcesChanged = true
+	} else {
+		update.resourcesChanged = true
+	}
+	update.hashes[*resourceRef] = currentHash
+	update.resources = append(update.resources, *resourceRef)
+}
+
 // evaluateConfigurationDrift evaluates all resources awaiting evaluation for configuration drift
 func (m *manager) evaluateConfigurationDrift(ctx context.Context) {
+	// First evaluation processes all resources queued while rebuilding
+	// internal state on startup
+	initialEvaluation := true
+
+	// lastEvaluated contains, per GroupKind, last time its queued resources were evaluated
+	lastEvaluated := make(map[schema.GroupKind]time.Time)
+
 	for {
+		if m.paused.Load() || m.resetting.Load() {
+			// Resources stay queued till cluster is unpaused or baselines are reset
+			m.log.V(logs.LogDebug).Info("Cluster is paused or re-provisioned. Skipping evaluation.")
+			time.Sleep(m.getEvaluationInterval())
+			continue
+		}
+
 		m.log.V(logs.LogDebug).Info("Evaluating Configuration drift")
+		start := time.Now()
 
-		m.mu.RLock()
-		// Get current queued resources
-		resources := m.jobQueue.Items()
-		// Reset current queue
-		m.jobQueue = &libsveltosset.Set{}
-		m.mu.RUnlock()
+		resources := m.takeDueResources(lastEvaluated, start)
 
 		failedEvaluations := &libsveltosset.Set{}
 
+		// All drifts detected in this cycle are collected here so that a single
+		// status update is sent for each ResourceSummary
+		updates := resourceSummaryUpdates{}
+
 		for i := range resources {
+			if m.resetting.Load() {
+				// Cluster was re-provisioned: resources are queued again once baselines are reset
+				updates = resourceSummaryUpdates{}
+				break
+			}
+			if err := waitForEvaluationBudget(ctx); err != nil {
+				// Shutting down: leave resources not evaluated yet in the queue
+				for j := i; j < len(resources); j++ {
+					failedEvaluations.Insert(&resources[j])
+				}
+				break
+			}
 			logger := m.log.WithValues("resource", fmt.Sprintf("%s/%s", resources[i].Namespace, resources[i].Name))
 			logger = logger.WithValues("gvk", resources[i].GroupVersionKind())
 			logger.V(logs.LogDebug).Info("Evaluating resource for configuration drift")
-			err := m.evaluateResource(ctx, &resources[i])
+			err := m.collectDrift(ctx, &resources[i], updates)
 			if err != nil {
 				logger.V(logs.LogInfo).Error(err, "failed to evaluate resource")
 				failedEvaluations.Insert(&resources[i])
 			}
 		}
 
+		// Changes which could not be applied before (e.g. while API server was unreachable) are
+		// flushed along with new ones. Those which cannot be applied now are buffered again.
+		m.takePendingUpdates(updates)
+		m.updateResourceSummaries(ctx, updates)
+
+		if initialEvaluation {
+			trackStartupPhase(initialEvaluationPhase, time.Since(start))
+			initialEvaluation = false
+		}
+
 		// Re-queue all resources whose evaluation failed
 		resources = failedEvaluations.Items()
 		for i := range failedEvaluations.Items() {
@@ -69,16 +157,146 @@ func (m *manager) evaluateConfigurationDrift(ctx context.Context) {
 		}
 
 		// Sleep before next evaluation
-		time.Sleep(m.interval)
+		time.Sleep(m.getEvaluationInterval())
 	}
 }
 
+// takeDueResources removes from the queue, and returns, all resources whose GroupKind is due for
+// evaluation. A GroupKind is due once its evaluation interval elapsed since lastEvaluated, which is
+// updated. Resources which are not due are left in the queue.
+func (m *manager) takeDueResources(lastEvaluated map[schema.GroupKind]time.Time, now time.Time,
+) []corev1.ObjectReference {
+
+	settings := getRuntimeSettings()
+	defaultInterval := m.getDefaultEvaluationInterval(settings)
+
+	due := make(map[schema.GroupKind]bool)
+	isDue := func(gk schema.GroupKind) bool {
+		if v, ok := due[gk]; ok {
+			return v
+		}
+		interval, ok := settings.KindEvaluationIntervals[gk]
+		if !ok {
+			interval = defaultInterval
+		}
+		due[gk] = now.Sub(lastEvaluated[gk]) >= interval
+		return due[gk]
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Get current queued resources
+	resources := m.jobQueue.Items()
+	queuedAt := m.queuedAt
+	// Reset current queue
+	m.jobQueue = &libsveltosset.Set{}
+	m.queuedAt = make(map[corev1.ObjectReference]time.Time)
+
+	dueResources := make([]corev1.ObjectReference, 0, len(resources))
+	for i := range resources {
+		if !isDue(resources[i].GroupVersionKind().GroupKind()) {
+			// Leave resource in the queue, keeping the time it was originally queued
+			m.jobQueue.Insert(&resources[i])
+			if t, ok := queuedAt[resources[i]]; ok {
+				m.queuedAt[resources[i]] = t
+			}
+			continue
+		}
+		if t, ok := queuedAt[resources[i]]; ok {
+			trackQueueWaitTime(t)
+		}
+		dueResources = append(dueResources, resources[i])
+	}
+
+	for gk := range due {
+		if due[gk] {
+			lastEvaluated[gk] = now
+		}
+	}
+	trackQueueLength(m.jobQueue.Len())
+
+	return dueResources
+}
+
+// getDefaultEvaluationInterval returns the interval at which queued resources, whose GroupKind
+// has no specific interval, are evaluated
+func (m *manager) getDefaultEvaluationInterval(settings *RuntimeSettings) time.Duration {
+	if settings.EvaluationInterval > 0 {
+		return settings.EvaluationInterval
+	}
+	return m.interval
+}
+
+// getEvaluationInterval returns the interval at which the queue is checked for resources
+// due for evaluation: the shortest among default and per GroupKind intervals
+func (m *manager) getEvaluationInterval() time.Duration {
+	settings := getRuntimeSettings()
+	interval := m.getDefaultEvaluationInterval(settings)
+	for _, kindInterval := range settings.KindEvaluationIntervals {
+		if kindInterval < interval {
+			interval = kindInterval
+		}
+	}
+	return interval
+}
+
 // evaluateResource evaluates whether resource has drifted. If configuration drift is detected,
 // request for Sveltos to reconcile is triggered.
 func (m *manager) evaluateResource(ctx context.Context, resourceRef *corev1.ObjectReference) error {
-	m.mu.RLock()
-	hash, ok := m.resourceHashes[*resourceRef]
-	m.mu.RUnlock()
+	_, err := m.evaluateAndReport(ctx, resourceRef)
+	return err
+}
+
+// evaluateAndReport evaluates whether resource has drifted and, if so, requests reconciliation.
+// Returns true if a configuration drift was reported.
+func (m *manager) evaluateAndReport(ctx context.Context, resourceRef *corev1.ObjectReference) (bool, error) {
+	if m.paused.Load() {
+		return false, fmt.Errorf("cluster is paused")
+	}
+
+	updates := resourceSummaryUpdates{}
+	if err := m.collectDrift(ctx, resourceRef, updates); err != nil {
+		return false, err
+	}
+
+	if failed := m.updateResourceSummaries(ctx, updates); len(failed) != 0 {
+		return false, fmt.Errorf("failed to request reconciliation for %s %s/%s: request is buffered",
+			resourceRef.Kind, resourceRef.Namespace, resourceRef.Name)
+	}
+
+	return len(updates) != 0, nil
+}
+
+// collectDrift evaluates whether resource has drifted. If configuration drift is detected,
+// changes to apply to each ResourceSummary tracking the resource are added to updates.
+func (m *manager) collectDrift(ctx context.Context, resourceRef *corev1.ObjectReference,
+	updates resourceSummaryUpdates) error {
+
+	if IsNamespaceExcluded(resourceRef.Namespace) {
+		// namespace was excluded after resource started being tracked
+		return nil
+	}
+
+	gvk := resourceRef.GroupVersionKind().String()
+
+	ctx, span := tracing.Tracer().Start(ctx, "evaluateResource",
+		trace.WithAttributes(
+			attribute.String("gvk", gvk),
+			attribute.String("namespace", resourceRef.Namespace),
+			attribute.String("name", resourceRef.Name),
+		))
+	defer span.End()
+
+	start := time.Now()
+	defer func() {
+		trackEvaluationDuration(ctx, gvk, time.Since(start))
+	}()
+
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.RLock()
+	hash, ok := shard.resourceHashes[*resourceRef]
+	shard.mu.RUnlock()
 
 	logger := m.log.WithValues("resource", fmt.Sprintf("%s/%s", resourceRef.Namespace, resourceRef.Name))
 	logger = logger.WithValues("gvk", resourceRef.GroupVersionKind())
@@ -88,80 +306,347 @@ func (m *manager) evaluateResource(ctx context.Context, resourceRef *corev1.Obje
 		return nil
 	}
 
-	u, err := m.getUnstructured(ctx, resourceRef)
+	u, unchanged, err := m.getObjectForEvaluation(ctx, resourceRef)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
+			if m.isIntentionallyDeleted(ctx, resourceRef, logger) {
+				return nil
+			}
+			if !m.confirmDrift(resourceRef) {
+				logger.V(logs.LogInfo).Info("resource has been deleted. Waiting for deletion to be confirmed.")
+				return nil
+			}
 			logger.V(logs.LogInfo).Info("resource has been deleted. Request reconciliation.")
-			m.updateResourceHash(resourceRef, nil)
-			return m.requestReconciliations(ctx, resourceRef, nil)
+			trackDrift(ctx, gvk)
+			m.recordDriftEvent(resourceRef, true)
+			m.updateResourceHash(resourceRef, nil, revision{})
+			m.requestReconciliations(resourceRef, nil, updates)
+			return nil
 		}
 		return err
 	}
 
-	currentHash := m.unstructuredHash(u)
+	if unchanged || m.isVersionEvaluated(resourceRef, u.GetResourceVersion()) {
+		logger.V(logs.LogDebug).Info("resourceVersion already evaluated. No configuration drift detected.")
+		return nil
+	}
+
+	if m.isGenerationEvaluated(resourceRef, u.GetGeneration()) {
+		logger.V(logs.LogDebug).Info("generation already evaluated. No configuration drift detected.")
+		m.recordEvaluatedRevision(resourceRef, getRevision(u))
+		return nil
+	}
+
+	currentHash, changedKeys := m.unstructuredHashWithChangedKeys(u)
 
-	if !reflect.DeepEqual(hash, currentHash) {
-		logger.V(logs.LogInfo).Info(fmt.Sprintf("resource has been modified. Request reconciliation. Old %x -- Current %x",
-			hash, currentHash))
-		m.updateResourceHash(resourceRef, currentHash)
-		return m.requestReconciliations(ctx, resourceRef, currentHash)
+	if hash != newCompactHash(currentHash) {
+		if len(changedKeys) != 0 {
+			logger = logger.WithValues("changedKeys", changedKeys)
+		}
+		if !m.confirmDrift(resourceRef) {
+			logger.V(logs.LogInfo).Info("resource has been modified. Waiting for drift to be confirmed.")
+			return nil
+		}
+		if m.skipFluxOwnedDrift(resourceRef, u, currentHash, logger) ||
+			m.skipTerraformOwnedDrift(resourceRef, u, currentHash, logger) ||
+			m.skipCrossplaneComposedDrift(resourceRef, u, currentHash, logger) {
+
+			return nil
+		}
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("resource has been modified. Request reconciliation. Old %s -- Current %s",
+			exposedHash(resourceRef, hash.bytes()), exposedHash(resourceRef, currentHash)))
+		trackDrift(ctx, gvk)
+		m.recordDriftEvent(resourceRef, false)
+		m.updateResourceHash(resourceRef, currentHash, getRevision(u))
+		m.requestReconciliations(resourceRef, currentHash, updates)
+		return nil
 	}
 
+	m.recordEvaluatedRevision(resourceRef, getRevision(u))
 	logger.V(logs.LogInfo).Info("no configuration drift detected.")
 	return nil
 }
 
-func (m *manager) updateResourceHash(resourceRef *corev1.ObjectReference, currentHash []byte) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// skipFluxOwnedDrift returns true if u, found drifted, is managed by Flux and its drift must not
+// be reported to Sveltos (see SetFluxOwnership). In that case current hash becomes the reference.
+func (m *manager) skipFluxOwnedDrift(resourceRef *corev1.ObjectReference, u *unstructured.Unstructured,
+	currentHash []byte, logger logr.Logger) bool {
+
+	fluxOwner := getFluxOwner(u)
+	if fluxOwner == "" || fluxOwnership == ReportFluxOwned {
+		return false
+	}
 
-	m.resourceHashes[*resourceRef] = currentHash
+	logger.V(logs.LogInfo).Info(fmt.Sprintf("resource managed by Flux %s has been modified. "+
+		"Not requesting reconciliation.", fluxOwner))
+	trackFluxOwnedDrift(resourceRef.GroupVersionKind().String())
+	if fluxOwnership == DownrankFluxOwned {
+		m.recordFluxOwnedDriftEvent(resourceRef, fluxOwner)
+	}
+	m.updateResourceHash(resourceRef, currentHash, getRevision(u))
+	return true
 }
 
-func (m *manager) requestReconciliations(ctx context.Context, resourceRef *corev1.ObjectReference,
-	currentHash []byte) error {
+// skipTerraformOwnedDrift returns true if u, found drifted, is managed by Terraform and its drift
+// must be ignored (see SetTerraformOwnership). In that case current hash becomes the reference.
+func (m *manager) skipTerraformOwnedDrift(resourceRef *corev1.ObjectReference, u *unstructured.Unstructured,
+	currentHash []byte, logger logr.Logger) bool {
 
-	var resourceSummaries []corev1.ObjectReference
+	if terraformOwnership != SkipTerraformOwned || !isTerraformOwned(u) {
+		return false
+	}
 
-	// Consider resources
-	m.mu.RLock()
-	rsList, ok := m.resources[*resourceRef]
-	if ok {
-		resourceSummaries = rsList.Items()
+	logger.V(logs.LogInfo).Info("resource managed by Terraform has been modified. Not requesting reconciliation.")
+	trackTerraformOwnedDrift(resourceRef.GroupVersionKind().String())
+	m.updateResourceHash(resourceRef, currentHash, getRevision(u))
+	return true
+}
+
+// skipCrossplaneComposedDrift returns true if u, found drifted, is reconciled by Crossplane from a
+// claim or a composite resource (see SetCrossplaneAware). In that case current hash becomes the reference.
+func (m *manager) skipCrossplaneComposedDrift(resourceRef *corev1.ObjectReference, u *unstructured.Unstructured,
+	currentHash []byte, logger logr.Logger) bool {
+
+	if !crossplaneAware || !isCrossplaneComposed(u) {
+		return false
 	}
-	m.mu.RUnlock()
 
-	for i := range resourceSummaries {
-		l := m.log.WithValues("resourceSummary", fmt.Sprintf("%s/%s",
-			resourceSummaries[i].Namespace, resourceSummaries[i].Name))
-		l.V(logs.LogDebug).Info("create reconciliation request")
-		if err := m.requestReconciliationForResourceSummary(ctx, &resourceSummaries[i],
-			resourceRef, currentHash, false); err != nil {
-			return err
+	logger.V(logs.LogInfo).Info("resource composed by Crossplane has been modified. Not requesting reconciliation.")
+	m.updateResourceHash(resourceRef, currentHash, getRevision(u))
+	return true
+}
+
+// isIntentionallyDeleted returns true if resource, not found, was deleted by the tool which deployed
+// it as part of a deploy: either a kapp versioned resource superseded by a newer version, or a
+// resource pruned after being removed from its inventory (see SetInventoryCorrelation).
+func (m *manager) isIntentionallyDeleted(ctx context.Context, resourceRef *corev1.ObjectReference,
+	logger logr.Logger) bool {
+
+	if m.isKappSuperseded(ctx, resourceRef) {
+		logger.V(logs.LogInfo).Info("kapp versioned resource has been superseded by a newer version. " +
+			"No configuration drift detected.")
+		return true
+	}
+
+	if inventory, pruned := m.isPrunedFromInventory(ctx, resourceRef); pruned {
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("resource has been pruned after being removed from %s. "+
+			"No configuration drift detected.", inventory))
+		trackPrunedResource(resourceRef.GroupVersionKind().String())
+		m.recordPrunedEvent(resourceRef, inventory)
+		return true
+	}
+
+	return false
+}
+
+// getObjectForEvaluation returns the object resource must be evaluated from:
+//   - with SpecHashMode, if resource was queued because of an update watch event,
+//     the object carried by the event is used and no additional GET is needed;
+//   - if resource was queued because it was possibly deleted, only its metadata is fetched first.
+//     If resource still exists and its resourceVersion was already evaluated, unchanged is true
+//     and no object is returned;
+//   - otherwise resource is fetched.
+func (m *manager) getObjectForEvaluation(ctx context.Context, resourceRef *corev1.ObjectReference,
+) (u *unstructured.Unstructured, unchanged bool, err error) {
+
+	if eventObject := m.takeEventObject(resourceRef); eventObject != nil {
+		m.recordInventory(resourceRef, eventObject)
+		return eventObject, false, nil
+	}
+
+	if m.takeExistenceCheck(resourceRef) {
+		metadata, err := m.getMetadata(ctx, resourceRef)
+		if err != nil {
+			return nil, false, err
+		}
+		if m.isVersionEvaluated(resourceRef, metadata.ResourceVersion) {
+			return nil, true, nil
 		}
 	}
 
-	resourceSummaries = nil
+	u, err = m.getUnstructured(ctx, resourceRef)
+	if err == nil {
+		m.recordInventory(resourceRef, u)
+	}
+	return u, false, err
+}
+
+// recordExistenceCheck records that resource, if still tracked, is queued because it was possibly deleted
+func (m *manager) recordExistenceCheck(resourceRef *corev1.ObjectReference) {
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, ok := shard.resourceHashes[*resourceRef]; ok {
+		shard.existenceChecks[*resourceRef] = true
+	}
+}
+
+// takeExistenceCheck returns, and clears, whether resource was queued because it was possibly deleted
+func (m *manager) takeExistenceCheck(resourceRef *corev1.ObjectReference) bool {
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	ok := shard.existenceChecks[*resourceRef]
+	delete(shard.existenceChecks, *resourceRef)
+	return ok
+}
+
+func (m *manager) updateResourceHash(resourceRef *corev1.ObjectReference, currentHash []byte,
+	evaluatedRevision revision) {
+
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.resourceHashes[*resourceRef] = newCompactHash(currentHash)
+	shard.evaluatedRevisions[*resourceRef] = evaluatedRevision
+	delete(shard.driftStreaks, *resourceRef)
+}
+
+// confirmDrift records that resource was found drifted. Returns true if resource was found
+// drifted by DriftConfirmations consecutive evaluations, in which case drift must be reported.
+// Otherwise resource is queued to be evaluated again.
+// This avoids reporting drifts (and the resulting reconciliations) caused by controllers which
+// rapidly revert changes. A resource going back to its previous state is a drift as well, so
+// same number of consecutive evaluations is required before that is reported.
+func (m *manager) confirmDrift(resourceRef *corev1.ObjectReference) bool {
+	driftConfirmations := getRuntimeSettings().DriftConfirmations
+	if driftConfirmations <= 1 {
+		return true
+	}
+
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.Lock()
+	if _, ok := shard.resourceHashes[*resourceRef]; !ok {
+		// not tracked anymore
+		shard.mu.Unlock()
+		return false
+	}
+	shard.driftStreaks[*resourceRef]++
+	confirmed := shard.driftStreaks[*resourceRef] >= driftConfirmations
+	if confirmed {
+		delete(shard.driftStreaks, *resourceRef)
+	}
+	shard.mu.Unlock()
+
+	if !confirmed {
+		m.mu.Lock()
+		m.checkForConfigurationDrift(resourceRef)
+		m.mu.Unlock()
+	}
+	return confirmed
+}
+
+// isVersionEvaluated returns true if resource hash was already evaluated from
+// the given resourceVersion
+func (m *manager) isVersionEvaluated(resourceRef *corev1.ObjectReference, resourceVersion string) bool {
+	if resourceVersion == "" {
+		return false
+	}
+
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	v, ok := shard.evaluatedRevisions[*resourceRef]
+	return ok && v.resourceVersion == resourceVersion
+}
+
+// isGenerationEvaluated returns true if resource hash was already evaluated from the given
+// generation. Only used with SpecHashMode and for resources whose GroupKind has been configured
+// as generation aware: for those, when generation does not change only metadata/status have
+// changed which are not considered when evaluating hash.
+func (m *manager) isGenerationEvaluated(resourceRef *corev1.ObjectReference, generation int64) bool {
+	if hashMode != SpecHashMode || generation == 0 {
+		return false
+	}
+
+	if !isGenerationAware(resourceRef.GroupVersionKind().GroupKind()) {
+		return false
+	}
+
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	v, ok := shard.evaluatedRevisions[*resourceRef]
+	return ok && v.generation == generation
+}
+
+// recordEvaluatedRevision records that resource, if still tracked, was evaluated
+// from the given revision
+func (m *manager) recordEvaluatedRevision(resourceRef *corev1.ObjectReference, evaluatedRevision revision) {
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, ok := shard.resourceHashes[*resourceRef]; ok {
+		shard.evaluatedRevisions[*resourceRef] = evaluatedRevision
+		// resource is not drifted (anymore)
+		delete(shard.driftStreaks, *resourceRef)
+	}
+}
+
+// requestReconciliations adds to updates a reconciliation request for each ResourceSummary
+// tracking the drifted resource.
+// Consumer maps are copy-on-write, so no lock is needed.
+func (m *manager) requestReconciliations(resourceRef *corev1.ObjectReference,
+	currentHash []byte, updates resourceSummaryUpdates) {
+
+	// Consider resources
+	if rsList, ok := m.resources.get(resourceRef); ok {
+		resourceSummaries := rsList.Items()
+		for i := range resourceSummaries {
+			updates.add(&resourceSummaries[i], resourceRef, currentHash, false)
+		}
+	}
 
 	// Consider helm resources
-	m.mu.RLock()
-	rsList, ok = m.helmResources[*resourceRef]
-	if ok {
-		resourceSummaries = rsList.Items()
+	if rsList, ok := m.helmResources.get(resourceRef); ok {
+		resourceSummaries := rsList.Items()
+		for i := range resourceSummaries {
+			updates.add(&resourceSummaries[i], resourceRef, currentHash, true)
+		}
 	}
-	m.mu.RUnlock()
+}
+
+// updateResourceSummaries sends, for each ResourceSummary, a single status update
+// containing all the drifts collected. Updates which fail are buffered (see takePendingUpdates),
+// and persisted along with state of tracked resources, so that detected drifts are not lost
+// while API server is unreachable.
+// Returns the drifted resources for which ResourceSummary could not be updated.
+func (m *manager) updateResourceSummaries(ctx context.Context, updates resourceSummaryUpdates,
+) []corev1.ObjectReference {
+
+	var failed []corev1.ObjectReference
+	defer func() {
+		if len(failed) != 0 {
+			m.persistPendingUpdates()
+		}
+	}()
 
-	for i := range resourceSummaries {
+	for resourceSummaryRef, update := range updates {
 		l := m.log.WithValues("resourceSummary", fmt.Sprintf("%s/%s",
-			resourceSummaries[i].Namespace, resourceSummaries[i].Name))
-		l.V(logs.LogDebug).Info("create reconciliation request")
-		if err := m.requestReconciliationForResourceSummary(ctx, &resourceSummaries[i],
-			resourceRef, currentHash, true); err != nil {
-			return err
+			resourceSummaryRef.Namespace, resourceSummaryRef.Name))
+		if reportOnly {
+			l.V(logs.LogInfo).Info(fmt.Sprintf("report-only mode: not requesting reconciliation for %d drifted resources",
+				len(update.resources)))
+			continue
+		}
+		l.V(logs.LogDebug).Info(fmt.Sprintf("create reconciliation request for %d drifted resources",
+			len(update.resources)))
+		err := m.updateResourceSummaryStatus(ctx, &resourceSummaryRef, update)
+		m.observeConnectivity(err)
+		if err != nil {
+			l.V(logs.LogInfo).Error(err, "failed to request reconciliation. Buffering request.")
+			m.bufferUpdate(&resourceSummaryRef, update)
+			failed = append(failed, update.resources...)
 		}
 	}
 
-	return nil
+	return failed
 }
 
 // requestReconciliationForResourceSummary fetches ResourceSummary. If found, it updates
@@ -177,12 +662,26 @@ func (m *manager) requestReconciliationForResourceSummary(ctx context.Context,
 	resourceSummaryRef, resourceRef *corev1.ObjectReference,
 	currentHash []byte, isHelm bool) error {
 
+	updates := resourceSummaryUpdates{}
+	updates.add(resourceSummaryRef, resourceRef, currentHash, isHelm)
+
+	return m.updateResourceSummaryStatus(ctx, resourceSummaryRef, updates[*resourceSummaryRef])
+}
+
+// updateResourceSummaryStatus fetches ResourceSummary. If found, it applies all changes
+// contained in update with a single status update.
+func (m *manager) updateResourceSummaryStatus(ctx context.Context,
+	resourceSummaryRef *corev1.ObjectReference, update *resourceSummaryUpdate) error {
+
 	logger := m.log.WithValues("resourceSummary", fmt.Sprintf("%s/%s",
 		resourceSummaryRef.Namespace, resourceSummaryRef.Name))
 	logger.V(logs.LogDebug).Info("requesting reconciliation")
 
-	// fetch ResourceSummary
-	u, err := m.getUnstructured(ctx, resourceSummaryRef)
+	// fetch ResourceSummary. ResourceSummaries are read with the client they are updated with:
+	// tracked resources might be read from a different API server (e.g. a virtual cluster).
+	var resourceSummary libsveltosv1alpha1.ResourceSummary
+	err := m.Get(ctx, types.NamespacedName{Namespace: resourceSummaryRef.Namespace, Name: resourceSummaryRef.Name},
+		&resourceSummary)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			// If not found, there is nothing to do.
@@ -192,31 +691,20 @@ func (m *manager) requestReconciliationForResourceSummary(ctx context.Context,
 		return err
 	}
 
-	// Convert unstructured to typed ResourceSummary
-	unstructured := u.UnstructuredContent()
-	var resourceSummary libsveltosv1alpha1.ResourceSummary
-	err = runtime.DefaultUnstructuredConverter.
-		FromUnstructured(unstructured, &resourceSummary)
-	if err != nil {
-		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to convert unstructured to ResourceSummary: %v",
-			err))
-		return err
-	}
-
 	// Mark resourceSummary for reconciliation
-	if isHelm {
+	if update.helmResourcesChanged {
 		resourceSummary.Status.HelmResourcesChanged = true
-	} else {
+	}
+	if update.resourcesChanged {
 		resourceSummary.Status.ResourcesChanged = true
 	}
 
-	// Update resource hash in ResourceSummary Status
+	// Update resource hashes in ResourceSummary Status
 	for i := range resourceSummary.Status.ResourceHashes {
 		r := resourceSummary.Status.ResourceHashes[i]
 		objRef := m.getObjectRef(&r.Resource)
-		if reflect.DeepEqual(objRef, resourceRef) {
+		if currentHash, ok := update.hashes[*objRef]; ok {
 			resourceSummary.Status.ResourceHashes[i].Hash = string(currentHash)
-			break
 		}
 	}
 
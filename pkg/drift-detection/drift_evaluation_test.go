@@ -17,19 +17,33 @@ limitations under the License.
 package driftdetection_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
 
+	"github.com/go-logr/logr"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/trace"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2/textlogger"
 
 	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/features"
 	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
 )
 
@@ -245,6 +259,1071 @@ var _ = Describe("Manager: drift evaluation", func() {
 		Expect(currentResourceSummary.Status.ResourceHashes[0].Resource.Group).To(Equal(resource.GroupVersionKind().Group))
 		Expect(currentResourceSummary.Status.ResourceHashes[0].Resource.Version).To(Equal(resource.GroupVersionKind().Version))
 	})
+
+	It("requestReconciliationForResourceSummary reads ResourceSummary with its own client", func() {
+		// Manager has no rest config: reading any tracked resource fails. ResourceSummaries
+		// must be read, and updated, with the client only.
+		manager := driftdetection.NewEvaluationManager()
+		manager.SetClient(testEnv.Client)
+
+		resourceRef := corev1.ObjectReference{
+			Namespace:  resource.Namespace,
+			Name:       resource.Name,
+			Kind:       resource.Kind,
+			APIVersion: resource.APIVersion,
+		}
+		_, err := driftdetection.GetUnstructured(manager, watcherCtx, &resourceRef)
+		Expect(err).ToNot(BeNil())
+
+		resourceSummary = getResourceSummary(&resourceRef, nil)
+		resourceSummaryNs := &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: resourceSummary.Namespace,
+			},
+		}
+		Expect(testEnv.Create(watcherCtx, resourceSummaryNs)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, resourceSummaryNs)).To(Succeed())
+		Expect(testEnv.Create(watcherCtx, resourceSummary)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, resourceSummary)).To(Succeed())
+		resourceSummaryRef := getObjRefFromResourceSummary(resourceSummary)
+
+		currentResourceSummary := &libsveltosv1alpha1.ResourceSummary{}
+		Expect(testEnv.Get(context.TODO(),
+			types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name},
+			currentResourceSummary)).To(Succeed())
+		currentResourceSummary.Status.ResourceHashes = []libsveltosv1alpha1.ResourceHash{
+			{
+				Hash: randomString(),
+				Resource: libsveltosv1alpha1.Resource{
+					Namespace: resource.Namespace,
+					Name:      resource.Name,
+					Group:     resource.GroupVersionKind().Group,
+					Version:   resource.GroupVersionKind().Version,
+					Kind:      resource.GroupVersionKind().Kind,
+				},
+			},
+		}
+		Expect(testEnv.Status().Update(watcherCtx, currentResourceSummary)).To(Succeed())
+		Eventually(func() bool {
+			err := testEnv.Get(context.TODO(),
+				types.NamespacedName{Name: resourceSummary.Name, Namespace: resourceSummary.Namespace},
+				currentResourceSummary)
+			return err == nil && currentResourceSummary.Status.ResourceHashes != nil
+		}, timeout, pollingInterval).Should(BeTrue())
+
+		hash := []byte(randomString())
+		Expect(driftdetection.RequestReconciliationForResourceSummary(manager, watcherCtx, resourceSummaryRef,
+			&resourceRef, hash, false)).To(Succeed())
+
+		verifyResourceSummary(resourceSummary, true, false)
+		Expect(testEnv.Get(context.TODO(),
+			types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name},
+			currentResourceSummary)).To(Succeed())
+		Expect(len(currentResourceSummary.Status.ResourceHashes)).To(Equal(1))
+		Expect(currentResourceSummary.Status.ResourceHashes[0].Hash).To(Equal(string(hash)))
+	})
+
+	It("resourceSummaryUpdates merges all drifts for the same ResourceSummary", func() {
+		resourceSummaryRef := getObjRefFromResourceSummary(getResourceSummary(nil, nil))
+
+		resource1 := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ServiceAccount", APIVersion: "v1"}
+		resource2 := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+
+		hash1 := []byte(randomString())
+		hash2 := []byte(randomString())
+
+		updates := driftdetection.ResourceSummaryUpdates{}
+		updates.Add(resourceSummaryRef, resource1, hash1, false)
+		updates.Add(resourceSummaryRef, resource2, hash2, true)
+
+		// Only one update is expected per ResourceSummary
+		Expect(len(updates)).To(Equal(1))
+
+		resourcesChanged, helmResourcesChanged := updates.IsMarkedForReconciliation(resourceSummaryRef)
+		Expect(resourcesChanged).To(BeTrue())
+		Expect(helmResourcesChanged).To(BeTrue())
+
+		hashes := updates.GetHashes(resourceSummaryRef)
+		Expect(len(hashes)).To(Equal(2))
+		Expect(hashes[*resource1]).To(Equal(hash1))
+		Expect(hashes[*resource2]).To(Equal(hash2))
+	})
+
+	It("confirmDrift requires drift to persist across consecutive evaluations", func() {
+		const confirmations = 3
+		driftdetection.SetDriftConfirmations(confirmations)
+		defer driftdetection.SetDriftConfirmations(1)
+
+		m := driftdetection.NewEvaluationManager()
+		resourceRef := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+
+		// Not tracked resources are never reported
+		Expect(driftdetection.ConfirmDrift(m, resourceRef)).To(BeFalse())
+
+		m.SetResourceHashes(resourceRef, []byte(randomString()))
+		for i := 1; i < confirmations; i++ {
+			Expect(driftdetection.ConfirmDrift(m, resourceRef)).To(BeFalse())
+			// Resource is queued to be evaluated again
+			Expect(m.GetJobQueue().Has(resourceRef)).To(BeTrue())
+		}
+		Expect(driftdetection.ConfirmDrift(m, resourceRef)).To(BeTrue())
+
+		// Streak restarts once drift has been reported
+		Expect(driftdetection.ConfirmDrift(m, resourceRef)).To(BeFalse())
+	})
+
+	It("observeAPIResponse holds requests for the delay suggested by API server", func() {
+		m := driftdetection.NewEvaluationManager()
+
+		// Not throttled: requests go through right away
+		driftdetection.ObserveAPIResponse(m, "get", nil)
+		driftdetection.ObserveAPIResponse(m, "get", apierrors.NewNotFound(corev1.Resource("configmaps"), randomString()))
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+		defer cancel()
+		Expect(driftdetection.WaitForAPIServer(m, ctx)).To(Succeed())
+
+		const retryAfterSeconds = 2
+		driftdetection.ObserveAPIResponse(m, "get", apierrors.NewTooManyRequests(randomString(), retryAfterSeconds))
+
+		// Requests are held for Retry-After
+		Expect(driftdetection.WaitForAPIServer(m, ctx)).ToNot(Succeed())
+	})
+
+	It("takeDueResources honors per kind evaluation intervals", func() {
+		driftdetection.SetKindEvaluationIntervals(map[schema.GroupKind]time.Duration{{Kind: "Secret"}: time.Hour})
+		defer driftdetection.SetKindEvaluationIntervals(nil)
+
+		m := driftdetection.NewEvaluationManager()
+		configMap := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		secret := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "Secret", APIVersion: "v1"}
+
+		lastEvaluated := make(map[schema.GroupKind]time.Time)
+		now := time.Now()
+
+		// First time, all kinds are due
+		m.QueueResource(&configMap)
+		m.QueueResource(&secret)
+		Expect(driftdetection.TakeDueResources(m, lastEvaluated, now)).To(ConsistOf(configMap, secret))
+		Expect(m.GetJobQueue().Len()).To(BeZero())
+
+		// Secrets are not due again till their interval elapses
+		m.QueueResource(&configMap)
+		m.QueueResource(&secret)
+		Expect(driftdetection.TakeDueResources(m, lastEvaluated, now.Add(time.Minute))).To(ConsistOf(configMap))
+		Expect(m.GetJobQueue().Has(&secret)).To(BeTrue())
+		Expect(m.GetQueuedAt()).To(HaveKey(secret))
+
+		Expect(driftdetection.TakeDueResources(m, lastEvaluated, now.Add(time.Hour))).To(ConsistOf(secret))
+		Expect(m.GetJobQueue().Len()).To(BeZero())
+	})
+
+	It("adaptive polling backs off unchanged resources up to MaxPollingInterval", func() {
+		driftdetection.SetMemoryBudget(0, time.Minute)
+		defer driftdetection.SetMemoryBudget(0, 0)
+		driftdetection.SetMaxPollingInterval(5 * time.Minute)
+		defer driftdetection.SetMaxPollingInterval(0)
+
+		m := driftdetection.NewEvaluationManager()
+		configMap := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		notHashed := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		m.SetResourceHashes(&configMap, []byte(randomString()))
+		gvk := configMap.GroupVersionKind()
+		tracked := []corev1.ObjectReference{configMap, notHashed}
+
+		// Never evaluated resources are due
+		now := time.Now()
+		Expect(m.DuePolledResources(gvk, tracked, now)).To(ConsistOf(configMap, notHashed))
+
+		// Unchanged resources are evaluated after 1, 2, 4 and then, at most, 5 minutes.
+		// Resources not hashed are never scheduled.
+		for _, interval := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute} {
+			m.ReschedulePolledResources(gvk, tracked, nil, now)
+			Expect(m.DuePolledResources(gvk, tracked, now.Add(interval-time.Minute))).To(ConsistOf(notHashed))
+			now = now.Add(interval)
+			Expect(m.DuePolledResources(gvk, tracked, now)).To(ConsistOf(configMap, notHashed))
+		}
+		m.ReschedulePolledResources(gvk, tracked, nil, now)
+		Expect(m.DuePolledResources(gvk, tracked, now.Add(4*time.Minute))).To(ConsistOf(notHashed))
+		Expect(m.DuePolledResources(gvk, tracked, now.Add(5*time.Minute))).To(ConsistOf(configMap, notHashed))
+
+		// Once a change is seen, resource is evaluated every polling interval again
+		now = now.Add(5 * time.Minute)
+		m.ReschedulePolledResources(gvk, tracked, []corev1.ObjectReference{configMap}, now)
+		Expect(m.DuePolledResources(gvk, tracked, now.Add(time.Minute))).To(ConsistOf(configMap, notHashed))
+		m.ReschedulePolledResources(gvk, tracked, nil, now.Add(time.Minute))
+		Expect(m.DuePolledResources(gvk, tracked, now.Add(2*time.Minute))).To(ConsistOf(notHashed))
+		Expect(m.DuePolledResources(gvk, tracked, now.Add(3*time.Minute))).To(ConsistOf(configMap, notHashed))
+	})
+
+	It("without adaptive polling, all tracked resources are due on every polling tick", func() {
+		m := driftdetection.NewEvaluationManager()
+		configMap := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		m.SetResourceHashes(&configMap, []byte(randomString()))
+		gvk := configMap.GroupVersionKind()
+
+		now := time.Now()
+		m.ReschedulePolledResources(gvk, []corev1.ObjectReference{configMap}, nil, now)
+		Expect(m.DuePolledResources(gvk, []corev1.ObjectReference{configMap}, now)).To(ConsistOf(configMap))
+	})
+
+	It("updateResourceSummaries does not mark ResourceSummaries for reconciliation in report-only mode", func() {
+		driftdetection.SetReportOnly(true)
+		defer driftdetection.SetReportOnly(false)
+
+		// Manager has no client: any attempt to update a ResourceSummary would fail
+		m := driftdetection.NewTrackingManager()
+
+		resourceSummaryRef := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String()}
+		configMap := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+
+		updates := driftdetection.ResourceSummaryUpdates{}
+		updates.Add(resourceSummaryRef, configMap, []byte(randomString()), false)
+		Expect(driftdetection.UpdateResourceSummaries(m, context.TODO(), updates)).To(BeEmpty())
+	})
+
+	It("buffered ResourceSummary updates are merged and persisted", func() {
+		m := driftdetection.NewEvaluationManager()
+
+		resourceSummaryRef := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String()}
+		configMap := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		secret := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "Secret", APIVersion: "v1"}
+
+		buffered := driftdetection.ResourceSummaryUpdates{}
+		buffered.Add(resourceSummaryRef, configMap, []byte("old"), false)
+		driftdetection.BufferUpdate(m, resourceSummaryRef, buffered.Get(resourceSummaryRef))
+
+		driftdetection.SetSnapshot(filepath.Join(GinkgoT().TempDir(), "state.json"), 0)
+		defer driftdetection.SetSnapshot("", 0)
+		Expect(driftdetection.WriteSnapshot(m)).To(Succeed())
+
+		// Buffered updates survive a restart
+		restarted := driftdetection.NewEvaluationManager()
+		driftdetection.LoadSnapshot(restarted)
+
+		// More recent changes take precedence
+		updates := driftdetection.ResourceSummaryUpdates{}
+		updates.Add(resourceSummaryRef, configMap, []byte("new"), false)
+		updates.Add(resourceSummaryRef, secret, nil, true)
+		driftdetection.TakePendingUpdates(restarted, updates)
+		Expect(updates.GetHashes(resourceSummaryRef)).To(Equal(map[corev1.ObjectReference][]byte{
+			*configMap: []byte("new"),
+			*secret:    nil,
+		}))
+		resourcesChanged, helmResourcesChanged := updates.IsMarkedForReconciliation(resourceSummaryRef)
+		Expect(resourcesChanged).To(BeTrue())
+		Expect(helmResourcesChanged).To(BeTrue())
+
+		// Pending updates are handed over once
+		updates = driftdetection.ResourceSummaryUpdates{}
+		driftdetection.TakePendingUpdates(restarted, updates)
+		Expect(updates).To(BeEmpty())
+	})
+
+	It("observeAPIResponse records offline windows", func() {
+		m := driftdetection.NewEvaluationManager()
+		Expect(driftdetection.GetLastOfflineWindow(m)).To(BeNil())
+
+		// Errors returned by a reachable API server do not open a window
+		driftdetection.ObserveAPIResponse(m, "get", apierrors.NewNotFound(corev1.Resource("configmaps"), randomString()))
+		Expect(driftdetection.GetLastOfflineWindow(m)).To(BeNil())
+
+		driftdetection.ObserveAPIResponse(m, "get", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})
+		window := driftdetection.GetLastOfflineWindow(m)
+		Expect(window).ToNot(BeNil())
+		Expect(window.Start).ToNot(BeZero())
+		Expect(window.End).To(BeZero())
+
+		driftdetection.ObserveAPIResponse(m, "get", nil)
+		window = driftdetection.GetLastOfflineWindow(m)
+		Expect(window).ToNot(BeNil())
+		Expect(window.End).ToNot(BeZero())
+	})
+
+	It("evaluateAndReport does not evaluate resources while cluster is paused", func() {
+		m := driftdetection.NewEvaluationManager()
+		resourceRef := &corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1",
+			Namespace: randomString(), Name: randomString()}
+
+		Expect(driftdetection.SetPaused(m, context.TODO(), true)).To(Succeed())
+		_, err := driftdetection.EvaluateAndReport(m, context.TODO(), resourceRef)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("cluster is paused"))
+	})
+
+	It("unstructuredHash ignores paths set on ResourceSummaries tracking resource", func() {
+		m := driftdetection.NewTrackingManager()
+
+		deployment := &unstructured.Unstructured{}
+		deployment.SetAPIVersion("apps/v1")
+		deployment.SetKind("Deployment")
+		deployment.SetNamespace(randomString())
+		deployment.SetName(randomString())
+		Expect(unstructured.SetNestedField(deployment.Object, int64(1), "spec", "replicas")).To(Succeed())
+		scaled := deployment.DeepCopy()
+		Expect(unstructured.SetNestedField(scaled.Object, int64(3), "spec", "replicas")).To(Succeed())
+
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+				Annotations: map[string]string{
+					driftdetection.IgnorePathsAnnotation: "- group: apps\n  kind: Deployment\n  jsonPointers: [/spec/replicas]",
+				},
+			},
+		}
+		Expect(m.SetIgnorePaths(context.TODO(), resourceSummary)).To(Succeed())
+
+		// Paths only apply to resources tracked because of that ResourceSummary
+		Expect(driftdetection.UnstructuredHash(m, scaled)).ToNot(Equal(driftdetection.UnstructuredHash(m, deployment)))
+
+		consumer := &corev1.ObjectReference{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name,
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String()}
+		m.AddResource(&corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment",
+			Namespace: deployment.GetNamespace(), Name: deployment.GetName()}, consumer)
+		Expect(driftdetection.UnstructuredHash(m, scaled)).To(Equal(driftdetection.UnstructuredHash(m, deployment)))
+
+		// Invalid paths keep previous ones
+		resourceSummary.Annotations[driftdetection.IgnorePathsAnnotation] = "- kind: Deployment\n  jsonPointers: [spec]"
+		Expect(m.SetIgnorePaths(context.TODO(), resourceSummary)).ToNot(Succeed())
+		Expect(driftdetection.UnstructuredHash(m, scaled)).To(Equal(driftdetection.UnstructuredHash(m, deployment)))
+
+		m.ClearIgnorePaths(consumer)
+		Expect(driftdetection.UnstructuredHash(m, scaled)).ToNot(Equal(driftdetection.UnstructuredHash(m, deployment)))
+	})
+
+	It("SetIgnorePaths only parses paths again when annotation changes", func() {
+		m := driftdetection.NewTrackingManager()
+
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+				Annotations: map[string]string{
+					driftdetection.IgnorePathsAnnotation: "- group: apps\n  kind: Deployment\n  jsonPointers: [/spec/replicas]",
+				},
+			},
+		}
+		consumer := &corev1.ObjectReference{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name,
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String()}
+
+		Expect(m.SetIgnorePaths(context.TODO(), resourceSummary)).To(Succeed())
+		paths := m.GetIgnorePaths(consumer)
+		Expect(len(paths)).To(Equal(1))
+
+		// Resource tracked because of resourceSummary is evaluated with parsed paths as they are
+		deployment := &unstructured.Unstructured{}
+		deployment.SetAPIVersion("apps/v1")
+		deployment.SetKind("Deployment")
+		deployment.SetNamespace(randomString())
+		deployment.SetName(randomString())
+		m.AddResource(&corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment",
+			Namespace: deployment.GetNamespace(), Name: deployment.GetName()}, consumer)
+		driftdetection.UnstructuredHash(m, deployment)
+
+		// Same annotation (e.g. ResourceSummary reconciled again): paths are not parsed again
+		Expect(m.SetIgnorePaths(context.TODO(), resourceSummary)).To(Succeed())
+		Expect(&m.GetIgnorePaths(consumer)[0]).To(BeIdenticalTo(&paths[0]))
+
+		// Annotation changed: paths are parsed again
+		resourceSummary.Annotations[driftdetection.IgnorePathsAnnotation] =
+			"- group: apps\n  kind: Deployment\n  jsonPointers: [/spec/paused]"
+		Expect(m.SetIgnorePaths(context.TODO(), resourceSummary)).To(Succeed())
+		current := m.GetIgnorePaths(consumer)
+		Expect(len(current)).To(Equal(1))
+		Expect(&current[0]).ToNot(BeIdenticalTo(&paths[0]))
+		Expect(current[0].GetPointers()).To(Equal([][]string{{"spec", "paused"}}))
+	})
+
+	It("SetIgnorePaths hashes tracked resources again so that annotation change is not a drift", func() {
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, testEnv.Config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		resourceRef := corev1.ObjectReference{
+			Namespace:  resource.Namespace,
+			Name:       resource.Name,
+			Kind:       resource.Kind,
+			APIVersion: resource.APIVersion,
+		}
+
+		By("Prepare test: add labels to resource and start tracking it")
+		currentSA := &corev1.ServiceAccount{}
+		Expect(testEnv.Get(watcherCtx,
+			types.NamespacedName{Namespace: resource.Namespace, Name: resource.Name}, currentSA)).To(Succeed())
+		currentSA.Labels = map[string]string{randomString(): randomString()}
+		Expect(testEnv.Update(watcherCtx, currentSA)).To(Succeed())
+		var u *unstructured.Unstructured
+		Eventually(func() bool {
+			u, err = driftdetection.GetUnstructured(manager, watcherCtx, &resourceRef)
+			return err == nil && u.GetLabels() != nil
+		}, timeout, pollingInterval).Should(BeTrue())
+		hash := driftdetection.UnstructuredHash(manager, u)
+		manager.SetResourceHashes(&resourceRef, hash)
+
+		resourceSummary = getResourceSummary(&resourceRef, nil)
+		resourceSummaryNs := &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: resourceSummary.Namespace,
+			},
+		}
+		Expect(testEnv.Create(watcherCtx, resourceSummaryNs)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, resourceSummaryNs)).To(Succeed())
+		Expect(testEnv.Create(watcherCtx, resourceSummary)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, resourceSummary)).To(Succeed())
+
+		currentResourceSummary := &libsveltosv1alpha1.ResourceSummary{}
+		Expect(testEnv.Get(context.TODO(),
+			types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name},
+			currentResourceSummary)).To(Succeed())
+		currentResourceSummary.Status.ResourceHashes = []libsveltosv1alpha1.ResourceHash{
+			{Hash: string(hash), Resource: resourceSummary.Spec.Resources[0]},
+		}
+		Expect(testEnv.Status().Update(watcherCtx, currentResourceSummary)).To(Succeed())
+		Eventually(func() bool {
+			err := testEnv.Get(context.TODO(),
+				types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name},
+				currentResourceSummary)
+			return err == nil && currentResourceSummary.Status.ResourceHashes != nil
+		}, timeout, pollingInterval).Should(BeTrue())
+
+		manager.AddResource(&resourceRef, getObjRefFromResourceSummary(resourceSummary))
+
+		By("Set annotation ignoring resource labels")
+		resourceSummary.Annotations = map[string]string{
+			driftdetection.IgnorePathsAnnotation: "- kind: ServiceAccount\n  jsonPointers: [/metadata/labels]",
+		}
+		Expect(manager.SetIgnorePaths(watcherCtx, resourceSummary)).To(Succeed())
+
+		// Stored hash and ResourceSummary Status take new exclusions into account
+		currentHash := manager.GetResourceHashes()[resourceRef]
+		Expect(currentHash).ToNot(Equal(hash))
+		Expect(testEnv.Get(context.TODO(),
+			types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name},
+			currentResourceSummary)).To(Succeed())
+		Expect(len(currentResourceSummary.Status.ResourceHashes)).To(Equal(1))
+		Expect(currentResourceSummary.Status.ResourceHashes[0].Hash).To(Equal(string(currentHash)))
+
+		By("Verify no drift is detected, neither because of annotation change nor of ignored labels")
+		Expect(driftdetection.EvaluateResource(manager, watcherCtx, &resourceRef)).To(Succeed())
+		verifyResourceSummary(resourceSummary, false, false)
+
+		Expect(testEnv.Get(watcherCtx,
+			types.NamespacedName{Namespace: resource.Namespace, Name: resource.Name}, currentSA)).To(Succeed())
+		currentSA.Labels = map[string]string{randomString(): randomString()}
+		Expect(testEnv.Update(watcherCtx, currentSA)).To(Succeed())
+		Expect(driftdetection.EvaluateResource(manager, watcherCtx, &resourceRef)).To(Succeed())
+		verifyResourceSummary(resourceSummary, false, false)
+	})
+
+	It("unstructuredHash only ignores paths set on all ResourceSummaries tracking resource", func() {
+		m := driftdetection.NewTrackingManager()
+
+		deployment := &unstructured.Unstructured{}
+		deployment.SetAPIVersion("apps/v1")
+		deployment.SetKind("Deployment")
+		deployment.SetNamespace(randomString())
+		deployment.SetName(randomString())
+		Expect(unstructured.SetNestedField(deployment.Object, int64(1), "spec", "replicas")).To(Succeed())
+		Expect(unstructured.SetNestedField(deployment.Object, false, "spec", "paused")).To(Succeed())
+		scaled := deployment.DeepCopy()
+		Expect(unstructured.SetNestedField(scaled.Object, int64(3), "spec", "replicas")).To(Succeed())
+		paused := deployment.DeepCopy()
+		Expect(unstructured.SetNestedField(paused.Object, true, "spec", "paused")).To(Succeed())
+
+		resourceRef := &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment",
+			Namespace: deployment.GetNamespace(), Name: deployment.GetName()}
+		for _, annotation := range []string{
+			"- group: apps\n  kind: Deployment\n  jsonPointers: [/spec/replicas]\n- group: apps\n  kind: Deployment\n  jsonPointers: [/spec/paused]",
+			"- group: apps\n  kind: Deployment\n  jsonPointers: [/spec/replicas]",
+		} {
+			resourceSummary := &libsveltosv1alpha1.ResourceSummary{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   randomString(),
+					Name:        randomString(),
+					Annotations: map[string]string{driftdetection.IgnorePathsAnnotation: annotation},
+				},
+			}
+			Expect(m.SetIgnorePaths(context.TODO(), resourceSummary)).To(Succeed())
+			m.AddResource(resourceRef, &corev1.ObjectReference{Namespace: resourceSummary.Namespace,
+				Name: resourceSummary.Name, Kind: libsveltosv1alpha1.ResourceSummaryKind,
+				APIVersion: libsveltosv1alpha1.GroupVersion.String()})
+		}
+
+		// Both ResourceSummaries ignore replicas, only one ignores paused
+		Expect(driftdetection.UnstructuredHash(m, scaled)).To(Equal(driftdetection.UnstructuredHash(m, deployment)))
+		Expect(driftdetection.UnstructuredHash(m, paused)).ToNot(Equal(driftdetection.UnstructuredHash(m, deployment)))
+	})
+
+	It("Lua hooks fail, without the process growing, when allocating too much memory", func() {
+		configMap := &unstructured.Unstructured{}
+		configMap.SetAPIVersion("v1")
+		configMap.SetKind("ConfigMap")
+		configMap.SetNamespace(randomString())
+		configMap.SetName(randomString())
+		Expect(unstructured.SetNestedField(configMap.Object, randomString(), "data", "key")).To(Succeed())
+		changed := configMap.DeepCopy()
+		Expect(unstructured.SetNestedField(changed.Object, randomString(), "data", "key")).To(Succeed())
+
+		isDrift, err := driftdetection.EvaluateLuaHook(
+			"function evaluate()\n  return {drift = obj.data.key ~= oldObj.data.key}\nend", configMap, changed)
+		Expect(err).To(BeNil())
+		Expect(isDrift).To(BeTrue())
+
+		for _, body := range []string{
+			`string.rep("x", 1e10)`,
+			`string.format("%999999999s", "x")`,
+			`string.gsub(string.rep("x", 1000), ".", string.rep("%0", 1000))`,
+			`table.concat({string.rep("x", 1000000), string.rep("x", 1000000)})`,
+			`local s = "x" while true do s = s .. s end`,
+			`local t = {} local i = 0 while true do i = i + 1 t[i] = {i} end`,
+		} {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			_, err := driftdetection.EvaluateLuaHook(
+				"function evaluate()\n  "+body+"\n  return {drift = false}\nend", configMap, changed)
+			Expect(err).ToNot(BeNil(), body)
+
+			runtime.ReadMemStats(&after)
+			Expect(after.TotalAlloc-before.TotalAlloc).To(BeNumerically("<", 256<<20), body)
+		}
+	})
+
+	It("evaluateChange returns an error when evaluator panics", func() {
+		configMap := &unstructured.Unstructured{}
+		configMap.SetAPIVersion("v1")
+		configMap.SetKind("ConfigMap")
+
+		isDrift, err := driftdetection.EvaluateChange(func(_, _ *unstructured.Unstructured) (bool, error) {
+			panic("bad hook")
+		}, configMap, configMap)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("bad hook"))
+		Expect(isDrift).To(BeFalse())
+
+		isDrift, err = driftdetection.EvaluateChange(func(_, _ *unstructured.Unstructured) (bool, error) {
+			return true, nil
+		}, configMap, configMap)
+		Expect(err).To(BeNil())
+		Expect(isDrift).To(BeTrue())
+	})
+
+	It("SetFetchTimeout bounds GETs of tracked resources with largest timeout set", func() {
+		m := driftdetection.NewTrackingManager()
+
+		configMap := &corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap",
+			Namespace: randomString(), Name: randomString()}
+		_, ok := m.GetFetchTimeoutDeadline(configMap)
+		Expect(ok).To(BeFalse())
+
+		resourceSummaries := make([]*libsveltosv1alpha1.ResourceSummary, 2)
+		for i, value := range []string{"30s", "2m"} {
+			resourceSummaries[i] = &libsveltosv1alpha1.ResourceSummary{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   randomString(),
+					Name:        randomString(),
+					Annotations: map[string]string{driftdetection.FetchTimeoutAnnotation: value},
+				},
+			}
+			m.AddResource(configMap, &corev1.ObjectReference{Namespace: resourceSummaries[i].Namespace,
+				Name: resourceSummaries[i].Name, Kind: libsveltosv1alpha1.ResourceSummaryKind,
+				APIVersion: libsveltosv1alpha1.GroupVersion.String()})
+		}
+
+		timeout, changed, err := m.SetFetchTimeout(resourceSummaries[0])
+		Expect(err).To(BeNil())
+		Expect(changed).To(BeTrue())
+		Expect(timeout).To(Equal(30 * time.Second))
+		deadline, ok := m.GetFetchTimeoutDeadline(configMap)
+		Expect(ok).To(BeTrue())
+		Expect(time.Until(deadline)).To(BeNumerically("~", 30*time.Second, time.Second))
+
+		// Same annotation: timeout does not change
+		_, changed, err = m.SetFetchTimeout(resourceSummaries[0])
+		Expect(err).To(BeNil())
+		Expect(changed).To(BeFalse())
+
+		// Largest timeout applies
+		_, changed, err = m.SetFetchTimeout(resourceSummaries[1])
+		Expect(err).To(BeNil())
+		Expect(changed).To(BeTrue())
+		deadline, _ = m.GetFetchTimeoutDeadline(configMap)
+		Expect(time.Until(deadline)).To(BeNumerically("~", 2*time.Minute, time.Second))
+
+		// Invalid timeouts keep previous one
+		resourceSummaries[1].Annotations[driftdetection.FetchTimeoutAnnotation] = "soon"
+		_, _, err = m.SetFetchTimeout(resourceSummaries[1])
+		Expect(err).ToNot(BeNil())
+		resourceSummaries[1].Annotations[driftdetection.FetchTimeoutAnnotation] = "-1s"
+		_, _, err = m.SetFetchTimeout(resourceSummaries[1])
+		Expect(err).ToNot(BeNil())
+		deadline, _ = m.GetFetchTimeoutDeadline(configMap)
+		Expect(time.Until(deadline)).To(BeNumerically("~", 2*time.Minute, time.Second))
+
+		// Removing annotation removes timeout
+		delete(resourceSummaries[1].Annotations, driftdetection.FetchTimeoutAnnotation)
+		timeout, changed, err = m.SetFetchTimeout(resourceSummaries[1])
+		Expect(err).To(BeNil())
+		Expect(changed).To(BeTrue())
+		Expect(timeout).To(BeZero())
+		deadline, _ = m.GetFetchTimeoutDeadline(configMap)
+		Expect(time.Until(deadline)).To(BeNumerically("~", 30*time.Second, time.Second))
+
+		m.ClearFetchTimeout(&corev1.ObjectReference{Namespace: resourceSummaries[0].Namespace,
+			Name: resourceSummaries[0].Name})
+		_, ok = m.GetFetchTimeoutDeadline(configMap)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("recordDriftEvent keeps drift events and their consumers", func() {
+		m := driftdetection.NewTrackingManager()
+
+		configMap := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		consumer := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String()}
+		m.AddResource(&configMap, &consumer)
+
+		driftdetection.RecordDriftEvent(m, &configMap, false)
+		driftdetection.RecordDriftEvent(m, &configMap, true)
+
+		events := m.GetDriftEvents(0)
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Resource).To(Equal(configMap))
+		Expect(events[0].Consumers).To(ConsistOf(consumer))
+		Expect(events[0].Deleted).To(BeFalse())
+		Expect(events[1].Deleted).To(BeTrue())
+
+		events = m.GetDriftEvents(events[0].Sequence)
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Deleted).To(BeTrue())
+	})
+
+	It("recordDriftEvent writes drift events as single-line JSON records", func() {
+		var output bytes.Buffer
+		driftdetection.SetDriftEventOutput(&output)
+		defer driftdetection.SetDriftEventOutput(nil)
+
+		m := driftdetection.NewTrackingManager()
+
+		configMap := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		driftdetection.RecordDriftEvent(m, &configMap, false)
+		driftdetection.RecordDriftEvent(m, &configMap, true)
+
+		lines := bytes.Split(bytes.TrimSpace(output.Bytes()), []byte("\n"))
+		Expect(lines).To(HaveLen(2))
+
+		event := driftdetection.DriftEvent{}
+		Expect(json.Unmarshal(lines[1], &event)).To(Succeed())
+		Expect(event.Resource).To(Equal(configMap))
+		Expect(event.Deleted).To(BeTrue())
+	})
+
+	It("recordDriftEvent writes drift events like Gatekeeper audit violations", func() {
+		var output bytes.Buffer
+		driftdetection.SetDriftEventOutput(&output)
+		defer driftdetection.SetDriftEventOutput(nil)
+		driftdetection.SetDriftEventFormat(driftdetection.GatekeeperDriftEventFormat)
+		defer driftdetection.SetDriftEventFormat(driftdetection.NativeDriftEventFormat)
+
+		m := driftdetection.NewTrackingManager()
+
+		deployment := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "Deployment", APIVersion: "apps/v1"}
+		driftdetection.RecordDriftEvent(m, &deployment, true)
+
+		record := map[string]interface{}{}
+		Expect(json.Unmarshal(output.Bytes(), &record)).To(Succeed())
+		Expect(record["process"]).To(Equal("audit"))
+		Expect(record["event_type"]).To(Equal("violation_audited"))
+		Expect(record["constraint_kind"]).To(Equal("SveltosConfigurationDrift"))
+		Expect(record["constraint_action"]).To(Equal("deny"))
+		Expect(record["resource_group"]).To(Equal("apps"))
+		Expect(record["resource_api_version"]).To(Equal("v1"))
+		Expect(record["resource_kind"]).To(Equal("Deployment"))
+		Expect(record["resource_namespace"]).To(Equal(deployment.Namespace))
+		Expect(record["resource_name"]).To(Equal(deployment.Name))
+		Expect(record["msg"]).To(Equal(fmt.Sprintf("configuration drift: Deployment %s/%s was deleted",
+			deployment.Namespace, deployment.Name)))
+
+		details, ok := record["details"].(map[string]interface{})
+		Expect(ok).To(BeTrue())
+		Expect(details["deleted"]).To(BeTrue())
+	})
+
+	It("buildPolicyReports writes the most recent drift of each resource as PolicyReport results", func() {
+		namespace := randomString()
+		deployment := corev1.ObjectReference{Namespace: namespace, Name: randomString(),
+			Kind: "Deployment", APIVersion: "apps/v1"}
+		configMap := corev1.ObjectReference{Namespace: namespace, Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		clusterRole := corev1.ObjectReference{Name: randomString(),
+			Kind: "ClusterRole", APIVersion: "rbac.authorization.k8s.io/v1"}
+
+		reports := driftdetection.BuildPolicyReports([]driftdetection.DriftEvent{
+			{Sequence: 1, Resource: deployment},
+			{Sequence: 2, Resource: configMap, ReportOnly: true},
+			{Sequence: 3, Resource: deployment, Deleted: true},
+			{Sequence: 4, Resource: clusterRole},
+		})
+		Expect(reports).To(HaveLen(2))
+
+		report := reports[namespace]
+		Expect(report.GetKind()).To(Equal("PolicyReport"))
+		Expect(report.GetNamespace()).To(Equal(namespace))
+		results, found, err := unstructured.NestedSlice(report.Object, "results")
+		Expect(err).To(BeNil())
+		Expect(found).To(BeTrue())
+		Expect(results).To(HaveLen(2))
+		summary, _, err := unstructured.NestedMap(report.Object, "summary")
+		Expect(err).To(BeNil())
+		Expect(summary["fail"]).To(Equal(int64(1)))
+		Expect(summary["warn"]).To(Equal(int64(1)))
+
+		var deploymentResult map[string]interface{}
+		for i := range results {
+			result := results[i].(map[string]interface{})
+			resources := result["resources"].([]interface{})
+			if resources[0].(map[string]interface{})["kind"] == "Deployment" {
+				deploymentResult = result
+			}
+		}
+		Expect(deploymentResult).ToNot(BeNil())
+		Expect(deploymentResult["rule"]).To(Equal("deleted"))
+		Expect(deploymentResult["result"]).To(Equal("fail"))
+
+		Expect(reports[""].GetKind()).To(Equal("ClusterPolicyReport"))
+	})
+
+	It("getDriftedResources lists resources whose most recent event is a drift", func() {
+		namespace := randomString()
+		deployment := corev1.ObjectReference{Namespace: namespace, Name: randomString(),
+			Kind: "Deployment", APIVersion: "apps/v1"}
+		configMap := corev1.ObjectReference{Namespace: namespace, Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		secret := corev1.ObjectReference{Namespace: namespace, Name: randomString(),
+			Kind: "Secret", APIVersion: "v1"}
+
+		resources := driftdetection.GetDriftedResources([]driftdetection.DriftEvent{
+			{Sequence: 1, Resource: deployment},
+			{Sequence: 2, Resource: configMap},
+			{Sequence: 3, Resource: configMap, Deleted: true, PrunedBy: "Kustomization flux-system/apps"},
+			{Sequence: 4, Resource: secret, ReportOnly: true, FluxOwner: "Kustomization flux-system/apps"},
+			{Sequence: 5, Resource: deployment, Deleted: true},
+		})
+		Expect(resources).To(ConsistOf(deployment))
+	})
+
+	It("recordDriftEvent signs drift events when a signing key is set", func() {
+		key := []byte(randomString())
+		driftdetection.SetDriftEventSigningKey(key)
+		defer driftdetection.SetDriftEventSigningKey(nil)
+
+		m := driftdetection.NewTrackingManager()
+
+		configMap := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		driftdetection.RecordDriftEvent(m, &configMap, false)
+
+		events := m.GetDriftEvents(0)
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Signature).ToNot(BeEmpty())
+		Expect(driftdetection.VerifyDriftEvent(&events[0], key)).To(BeTrue())
+		Expect(driftdetection.VerifyDriftEvent(&events[0], []byte(randomString()))).To(BeFalse())
+
+		tampered := events[0]
+		tampered.Deleted = true
+		Expect(driftdetection.VerifyDriftEvent(&tampered, key)).To(BeFalse())
+	})
+
+	It("skipFluxOwnedDrift does not report drifts of resources managed by Flux", func() {
+		m := driftdetection.NewTrackingManager()
+
+		configMap := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		consumer := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String()}
+		m.AddResource(&configMap, &consumer)
+
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion(configMap.APIVersion)
+		u.SetKind(configMap.Kind)
+		u.SetNamespace(configMap.Namespace)
+		u.SetName(configMap.Name)
+		hash := driftdetection.UnstructuredHash(m, u)
+
+		// Resources not managed by Flux are always reported
+		driftdetection.SetFluxOwnership(driftdetection.SkipFluxOwned)
+		defer driftdetection.SetFluxOwnership(driftdetection.ReportFluxOwned)
+		Expect(driftdetection.SkipFluxOwnedDrift(m, &configMap, u, hash, logr.Discard())).To(BeFalse())
+
+		u.SetLabels(map[string]string{
+			"kustomize.toolkit.fluxcd.io/name":      "apps",
+			"kustomize.toolkit.fluxcd.io/namespace": "flux-system",
+		})
+		Expect(driftdetection.SkipFluxOwnedDrift(m, &configMap, u, hash, logr.Discard())).To(BeTrue())
+		Expect(m.GetDriftEvents(0)).To(BeEmpty())
+
+		driftdetection.SetFluxOwnership(driftdetection.DownrankFluxOwned)
+		Expect(driftdetection.SkipFluxOwnedDrift(m, &configMap, u, hash, logr.Discard())).To(BeTrue())
+		events := m.GetDriftEvents(0)
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].FluxOwner).To(Equal("Kustomization flux-system/apps"))
+		Expect(events[0].ReportOnly).To(BeTrue())
+		Expect(events[0].Consumers).To(ConsistOf(consumer))
+
+		driftdetection.SetFluxOwnership(driftdetection.ReportFluxOwned)
+		Expect(driftdetection.SkipFluxOwnedDrift(m, &configMap, u, hash, logr.Discard())).To(BeFalse())
+	})
+
+	It("skipTerraformOwnedDrift ignores drifts of resources managed by Terraform", func() {
+		m := driftdetection.NewTrackingManager()
+
+		configMap := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion(configMap.APIVersion)
+		u.SetKind(configMap.Kind)
+		u.SetNamespace(configMap.Namespace)
+		u.SetName(configMap.Name)
+		hash := driftdetection.UnstructuredHash(m, u)
+
+		driftdetection.SetTerraformOwnership(driftdetection.SkipTerraformOwned)
+		defer driftdetection.SetTerraformOwnership(driftdetection.ReportTerraformOwned)
+		Expect(driftdetection.SkipTerraformOwnedDrift(m, &configMap, u, hash, logr.Discard())).To(BeFalse())
+
+		// Either labeled, or with fields owned by a Terraform field manager
+		u.SetLabels(map[string]string{"app.kubernetes.io/managed-by": "Terraform"})
+		Expect(driftdetection.SkipTerraformOwnedDrift(m, &configMap, u, hash, logr.Discard())).To(BeTrue())
+		u.SetLabels(nil)
+		u.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "HashiCorp"}})
+		Expect(driftdetection.SkipTerraformOwnedDrift(m, &configMap, u, hash, logr.Discard())).To(BeTrue())
+		Expect(m.GetDriftEvents(0)).To(BeEmpty())
+
+		driftdetection.SetTerraformOwnership(driftdetection.ReportTerraformOwned)
+		Expect(driftdetection.SkipTerraformOwnedDrift(m, &configMap, u, hash, logr.Discard())).To(BeFalse())
+	})
+
+	It("skipCrossplaneComposedDrift ignores drifts of resources Crossplane reconciles from a claim", func() {
+		m := driftdetection.NewTrackingManager()
+
+		bucket := corev1.ObjectReference{Name: randomString(), Kind: "Bucket", APIVersion: "s3.aws.upbound.io/v1beta1"}
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion(bucket.APIVersion)
+		u.SetKind(bucket.Kind)
+		u.SetName(bucket.Name)
+		hash := driftdetection.UnstructuredHash(m, u)
+
+		// Standalone managed resources are evaluated
+		Expect(driftdetection.SkipCrossplaneComposedDrift(m, &bucket, u, hash, logr.Discard())).To(BeFalse())
+
+		u.SetLabels(map[string]string{"crossplane.io/composite": "storage-x7k2p"})
+		Expect(driftdetection.SkipCrossplaneComposedDrift(m, &bucket, u, hash, logr.Discard())).To(BeTrue())
+		Expect(m.GetDriftEvents(0)).To(BeEmpty())
+
+		driftdetection.SetCrossplaneAware(false)
+		defer driftdetection.SetCrossplaneAware(true)
+		Expect(driftdetection.SkipCrossplaneComposedDrift(m, &bucket, u, hash, logr.Discard())).To(BeFalse())
+	})
+
+	It("getKappNextVersion returns the next version of kapp versioned resources", func() {
+		next, ok := driftdetection.GetKappNextVersion("settings-ver-9")
+		Expect(ok).To(BeTrue())
+		Expect(next).To(Equal("settings-ver-10"))
+
+		for _, name := range []string{"settings", "settings-ver-", "settings-ver-x", "-ver-1"} {
+			_, ok = driftdetection.GetKappNextVersion(name)
+			Expect(ok).To(BeFalse(), name)
+		}
+	})
+
+	It("getInventoryRef returns the inventory listing a resource", func() {
+		u := &unstructured.Unstructured{}
+		u.SetAnnotations(map[string]string{"config.k8s.io/owning-inventory": "app-inventory"})
+
+		Expect(driftdetection.GetInventoryRef(u)).To(BeNil())
+
+		driftdetection.SetInventoryCorrelation(true)
+		defer driftdetection.SetInventoryCorrelation(false)
+		Expect(driftdetection.GetInventoryRef(u).String()).To(Equal("inventory app-inventory"))
+
+		u.SetAnnotations(nil)
+		u.SetLabels(map[string]string{"kustomize.toolkit.fluxcd.io/name": "apps",
+			"kustomize.toolkit.fluxcd.io/namespace": "flux-system"})
+		Expect(driftdetection.GetInventoryRef(u).String()).To(Equal("Kustomization flux-system/apps"))
+
+		u.SetLabels(nil)
+		Expect(driftdetection.GetInventoryRef(u)).To(BeNil())
+	})
+
+	It("getInventoryEntry returns how resources are listed in inventories", func() {
+		Expect(driftdetection.GetInventoryEntry(&corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment",
+			Namespace: "default", Name: "nginx"})).To(Equal("default_nginx_apps_Deployment"))
+		Expect(driftdetection.GetInventoryEntry(&corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap",
+			Namespace: "default", Name: "settings"})).To(Equal("default_settings__ConfigMap"))
+		Expect(driftdetection.GetInventoryEntry(&corev1.ObjectReference{APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind: "ClusterRole", Name: "system:viewer"})).To(Equal("_system__viewer_rbac.authorization.k8s.io_ClusterRole"))
+	})
+
+	It("getHelmValuesDigest considers values of Helm releases only", func() {
+		encode := func(release map[string]interface{}) []byte {
+			data, err := json.Marshal(release)
+			Expect(err).To(BeNil())
+			var b bytes.Buffer
+			w := gzip.NewWriter(&b)
+			_, err = w.Write(data)
+			Expect(err).To(BeNil())
+			Expect(w.Close()).To(Succeed())
+			return []byte(base64.StdEncoding.EncodeToString(b.Bytes()))
+		}
+
+		digest, err := driftdetection.GetHelmValuesDigest(encode(map[string]interface{}{
+			"version": 1, "config": map[string]interface{}{"replicaCount": 1, "image": "nginx"}}))
+		Expect(err).To(BeNil())
+
+		// Other revisions with same values
+		sameValues, err := driftdetection.GetHelmValuesDigest(encode(map[string]interface{}{
+			"version": 2, "manifest": "kind: Deployment", "config": map[string]interface{}{"image": "nginx", "replicaCount": 1}}))
+		Expect(err).To(BeNil())
+		Expect(sameValues).To(Equal(digest))
+
+		// helm upgrade --set replicaCount=3
+		otherValues, err := driftdetection.GetHelmValuesDigest(encode(map[string]interface{}{
+			"version": 3, "config": map[string]interface{}{"replicaCount": 3, "image": "nginx"}}))
+		Expect(err).To(BeNil())
+		Expect(otherValues).ToNot(Equal(digest))
+
+		_, err = driftdetection.GetHelmValuesDigest([]byte("not a release"))
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("values drift is reported once per drifted revision", func() {
+		baseline := driftdetection.NewHelmValuesBaseline([]byte("sveltos"), 1)
+
+		Expect(baseline.Evaluate(1, []byte("sveltos"))).To(BeFalse())
+		// Sveltos upgrade with same values
+		Expect(baseline.Evaluate(2, []byte("sveltos"))).To(BeFalse())
+		// Manual helm upgrade --set
+		Expect(baseline.Evaluate(3, []byte("manual"))).To(BeTrue())
+		Expect(baseline.Evaluate(3, []byte("manual"))).To(BeFalse())
+		// Sveltos reverts values, then a new manual upgrade
+		Expect(baseline.Evaluate(4, []byte("sveltos"))).To(BeFalse())
+		Expect(baseline.Evaluate(5, []byte("manual"))).To(BeTrue())
+	})
+
+	It("getMissingRules merges missing permissions in minimal RBAC rules", func() {
+		m := driftdetection.NewTrackingManager()
+
+		deployments := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+		statefulSets := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}
+		configMaps := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+		m.SetDeniedVerbs(deployments, "deployments", "", "list", "watch")
+		m.SetDeniedVerbs(statefulSets, "statefulsets", "", "list", "watch")
+		m.SetDeniedVerbs(configMaps, "configmaps", "foo", "get")
+
+		rules := driftdetection.GetMissingRules(m)
+		Expect(rules).To(HaveLen(2))
+		Expect(rules[0].Namespace).To(Equal("foo"))
+		Expect(rules[0].Rule.APIGroups).To(Equal([]string{""}))
+		Expect(rules[0].Rule.Resources).To(Equal([]string{"configmaps"}))
+		Expect(rules[0].Rule.Verbs).To(Equal([]string{"get"}))
+		Expect(rules[1].Namespace).To(BeEmpty())
+		Expect(rules[1].Rule.APIGroups).To(Equal([]string{"apps"}))
+		Expect(rules[1].Rule.Resources).To(Equal([]string{"deployments", "statefulsets"}))
+		Expect(rules[1].Rule.Verbs).To(Equal([]string{"list", "watch"}))
+	})
+
+	It("MissingPermissions reports nothing when PermissionSelfTest feature gate is disabled", func() {
+		m := driftdetection.NewTrackingManager()
+
+		deployments := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+		m.SetDeniedVerbs(deployments, "deployments", "", "watch")
+
+		missing, err := m.MissingPermissions(context.TODO(), deployments)
+		Expect(err).To(BeNil())
+		Expect(missing).To(ConsistOf("watch"))
+
+		Expect(features.MutableFeatureGate.Set(string(features.PermissionSelfTest) + "=false")).To(Succeed())
+		defer func() {
+			Expect(features.MutableFeatureGate.Set(string(features.PermissionSelfTest) + "=true")).To(Succeed())
+		}()
+
+		missing, err = m.MissingPermissions(context.TODO(), deployments)
+		Expect(err).To(BeNil())
+		Expect(missing).To(BeEmpty())
+	})
+
+	It("drift and evaluation latency metrics link to sampled traces via exemplars", func() {
+		traceID := trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+		sampled := trace.ContextWithSpanContext(context.TODO(), trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+			TraceFlags: trace.FlagsSampled,
+		}))
+
+		tracedGVK := randomString()
+		driftdetection.TrackDrift(sampled, tracedGVK)
+		driftdetection.TrackEvaluationDuration(sampled, tracedGVK, 300*time.Millisecond)
+
+		drifts := getMetric("projectsveltos_drift_detection_drifts_total", "gvk", tracedGVK)
+		Expect(drifts).ToNot(BeNil())
+		Expect(drifts.GetCounter().GetValue()).To(Equal(float64(1)))
+		Expect(drifts.GetCounter().GetExemplar().GetLabel()).To(HaveLen(1))
+		Expect(drifts.GetCounter().GetExemplar().GetLabel()[0].GetName()).To(Equal("trace_id"))
+		Expect(drifts.GetCounter().GetExemplar().GetLabel()[0].GetValue()).To(Equal(traceID.String()))
+
+		evaluations := getMetric("projectsveltos_drift_detection_evaluation_duration_seconds", "gvk", tracedGVK)
+		Expect(evaluations).ToNot(BeNil())
+		exemplars := 0
+		for _, bucket := range evaluations.GetHistogram().GetBucket() {
+			if bucket.GetExemplar() != nil {
+				exemplars++
+				Expect(bucket.GetExemplar().GetLabel()[0].GetValue()).To(Equal(traceID.String()))
+			}
+		}
+		Expect(exemplars).To(Equal(1))
+
+		// Without a sampled trace, no exemplar is attached
+		untracedGVK := randomString()
+		driftdetection.TrackDrift(context.TODO(), untracedGVK)
+		drifts = getMetric("projectsveltos_drift_detection_drifts_total", "gvk", untracedGVK)
+		Expect(drifts).ToNot(BeNil())
+		Expect(drifts.GetCounter().GetValue()).To(Equal(float64(1)))
+		Expect(drifts.GetCounter().GetExemplar()).To(BeNil())
+	})
+
+	It("parseEvaluatePath returns the resource to evaluate", func() {
+		resourceRef, err := driftdetection.ParseEvaluatePath("/evaluate/apps/v1/Deployment/default/nginx")
+		Expect(err).To(BeNil())
+		Expect(*resourceRef).To(Equal(corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment",
+			Namespace: "default", Name: "nginx"}))
+
+		resourceRef, err = driftdetection.ParseEvaluatePath("/evaluate/core/v1/Namespace/projectsveltos")
+		Expect(err).To(BeNil())
+		Expect(*resourceRef).To(Equal(corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace",
+			Name: "projectsveltos"}))
+
+		_, err = driftdetection.ParseEvaluatePath("/evaluate/core/v1/ConfigMap")
+		Expect(err).ToNot(BeNil())
+	})
 })
 
 func verifyResourceSummary(resourceSummary *libsveltosv1alpha1.ResourceSummary,
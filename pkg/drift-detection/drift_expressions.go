@@ -0,0 +1,304 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/cel-go/cel"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// DriftExpressionsAnnotation, set on a ResourceSummary, lists the CEL expressions deciding whether
+	// changes to the resources it tracks are configuration drifts, as a YAML (or JSON) list of
+	// DriftExpression, e.g.:
+	//
+	//	- group: apps
+	//	  kind: Deployment
+	//	  expression: object.spec.template != oldObject.spec.template
+	//
+	// ResourceSummary spec is defined by libsveltos, hence the annotation.
+	DriftExpressionsAnnotation = "projectsveltos.io/drift-expressions"
+
+	// driftExpressionTimeout is the time a drift expression can take to evaluate
+	driftExpressionTimeout = 100 * time.Millisecond
+
+	// driftExpressionCostLimit bounds the cost of evaluating a drift expression
+	driftExpressionCostLimit = 1000000
+)
+
+// DriftExpression is a CEL expression deciding whether a change to matching resources is a
+// configuration drift. Expression is given the object before the change as oldObject and the
+// object after the change as object, and must return a bool.
+// When it returns false, change is not a drift: resource current state becomes the reference.
+// When it returns true or fails, resource is evaluated as usual, comparing its hash.
+type DriftExpression struct {
+	// Group of matching resources. Empty for the core group, * for any group.
+	Group string `json:"group,omitempty"`
+
+	// Kind of matching resources. * for any kind.
+	Kind string `json:"kind"`
+
+	// Expression is the CEL expression
+	Expression string `json:"expression"`
+}
+
+func (e *DriftExpression) matches(gvk *schema.GroupVersionKind) bool {
+	return (e.Group == anyValue || e.Group == gvk.Group) && (e.Kind == anyValue || e.Kind == gvk.Kind)
+}
+
+// changeEvaluator decides whether a change to a resource is a configuration drift
+type changeEvaluator interface {
+	// isDrift returns whether the change from oldU to newU is a configuration drift
+	isDrift(oldU, newU *unstructured.Unstructured) (bool, error)
+}
+
+// compiledDriftExpression is a DriftExpression along with its compiled program
+type compiledDriftExpression struct {
+	DriftExpression
+	program cel.Program
+}
+
+// driftExpressionTracker contains the drift expressions set on ResourceSummaries (see
+// DriftExpressionsAnnotation)
+type driftExpressionTracker struct {
+	mu sync.RWMutex
+	// Key: ResourceSummary
+	expressions map[types.NamespacedName][]compiledDriftExpression
+	// programs caches compiled expressions, so each is compiled once however many
+	// ResourceSummaries use it. Key: expression
+	programs map[string]cel.Program
+}
+
+// ReadDriftExpressions parses a YAML (or JSON) list of DriftExpression
+func ReadDriftExpressions(data []byte) ([]DriftExpression, error) {
+	var expressions []DriftExpression
+	if err := yaml.UnmarshalStrict(data, &expressions); err != nil {
+		return nil, errors.Wrap(err, "invalid drift expressions")
+	}
+	return expressions, nil
+}
+
+// compileDriftExpression compiles expression, a CEL expression on oldObject and object
+func compileDriftExpression(expression string) (cel.Program, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("oldObject", cel.DynType),
+		cel.Variable("object", cel.DynType),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	return env.Program(ast,
+		cel.CostLimit(driftExpressionCostLimit),
+		cel.InterruptCheckFrequency(100),
+	)
+}
+
+// SetDriftExpressions sets the drift expressions for resources tracked because of resourceSummary,
+// as listed by its DriftExpressionsAnnotation. On error, previous expressions are kept.
+func (m *manager) SetDriftExpressions(resourceSummary *libsveltosv1alpha1.ResourceSummary) error {
+	key := types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name}
+
+	value := resourceSummary.Annotations[DriftExpressionsAnnotation]
+	if value == "" {
+		m.driftExpressions.set(key, nil)
+		return nil
+	}
+
+	expressions, err := ReadDriftExpressions([]byte(value))
+	if err != nil {
+		return errors.Wrapf(err, "invalid %s annotation", DriftExpressionsAnnotation)
+	}
+	return m.driftExpressions.compileAndSet(key, expressions)
+}
+
+// ClearDriftExpressions forgets the drift expressions of resourceSummary (see SetDriftExpressions)
+func (m *manager) ClearDriftExpressions(resourceSummary *corev1.ObjectReference) {
+	m.driftExpressions.set(types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name}, nil)
+}
+
+// compileAndSet compiles expressions, reusing cached programs, and sets them for resourceSummary
+func (t *driftExpressionTracker) compileAndSet(resourceSummary types.NamespacedName,
+	expressions []DriftExpression) error {
+
+	t.mu.RLock()
+	compiled := make([]compiledDriftExpression, len(expressions))
+	for i := range expressions {
+		compiled[i].DriftExpression = expressions[i]
+		compiled[i].program = t.programs[expressions[i].Expression]
+	}
+	t.mu.RUnlock()
+
+	for i := range compiled {
+		if compiled[i].Kind == "" {
+			return fmt.Errorf("drift expression %d: kind is required", i)
+		}
+		if compiled[i].program != nil {
+			continue
+		}
+		program, err := compileDriftExpression(compiled[i].Expression)
+		if err != nil {
+			return errors.Wrapf(err, "drift expression %d", i)
+		}
+		compiled[i].program = program
+	}
+
+	t.set(resourceSummary, compiled)
+	return nil
+}
+
+func (t *driftExpressionTracker) set(resourceSummary types.NamespacedName, expressions []compiledDriftExpression) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(expressions) == 0 {
+		delete(t.expressions, resourceSummary)
+	} else {
+		if t.expressions == nil {
+			t.expressions = make(map[types.NamespacedName][]compiledDriftExpression)
+		}
+		t.expressions[resourceSummary] = expressions
+	}
+
+	// Only expressions in use are cached
+	t.programs = make(map[string]cel.Program)
+	for _, compiled := range t.expressions {
+		for i := range compiled {
+			t.programs[compiled[i].Expression] = compiled[i].program
+		}
+	}
+}
+
+// getDriftExpressions returns the drift expressions, set by ResourceSummaries tracking resourceRef,
+// matching gvk
+func (m *manager) getDriftExpressions(gvk *schema.GroupVersionKind, resourceRef *corev1.ObjectReference,
+) []changeEvaluator {
+
+	m.driftExpressions.mu.RLock()
+	defer m.driftExpressions.mu.RUnlock()
+
+	if len(m.driftExpressions.expressions) == 0 {
+		return nil
+	}
+
+	var result []changeEvaluator
+	for _, consumer := range m.getDriftConsumers(resourceRef) {
+		expressions := m.driftExpressions.expressions[types.NamespacedName{Namespace: consumer.Namespace,
+			Name: consumer.Name}]
+		for i := range expressions {
+			if expressions[i].matches(gvk) {
+				result = append(result, &expressions[i])
+			}
+		}
+	}
+	return result
+}
+
+// isDrift returns the outcome of expression on the change from oldU to newU
+func (e *compiledDriftExpression) isDrift(oldU, newU *unstructured.Unstructured) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), driftExpressionTimeout)
+	defer cancel()
+
+	out, _, err := e.program.ContextEval(ctx, map[string]interface{}{
+		"oldObject": oldU.UnstructuredContent(),
+		"object":    newU.UnstructuredContent(),
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "drift expression %q", e.Expression)
+	}
+	isDrift, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("drift expression %q returned %v, not a bool", e.Expression, out.Value())
+	}
+	return isDrift, nil
+}
+
+// evaluateChange returns the outcome of evaluator on the change from oldU to newU. A panic is
+// returned as an error, so that a failing evaluator never stops the watcher evaluating it.
+func evaluateChange(evaluator changeEvaluator, oldU, newU *unstructured.Unstructured) (isDrift bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			isDrift, err = false, fmt.Errorf("change evaluation panicked: %v", r)
+		}
+	}()
+	return evaluator.isDrift(oldU, newU)
+}
+
+// acceptChange returns true if the change from oldObj to newObj, carried by an update watch event,
+// is ruled out as a configuration drift by all drift expressions (see DriftExpressionsAnnotation)
+// and Lua hooks (see LuaHooksAnnotation) applying to resource. In that case newObj becomes the reference and resource is not evaluated.
+// A change is only accepted if oldObj was the reference, so that a drift not evaluated yet is
+// never hidden by a following change.
+// Drift expressions and Lua hooks are set by whoever can annotate a ResourceSummary and their
+// errors are logged: they are given objects as they can be exposed (see RedactObject).
+func (m *manager) acceptChange(gvk *schema.GroupVersionKind, oldObj, newObj interface{}, logger logr.Logger) bool {
+	oldU, ok := oldObj.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	newU, ok := newObj.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+
+	objRef := getObjectRefFromEvent(gvk, newU)
+	evaluators := append(m.getDriftExpressions(gvk, objRef), m.getLuaHooks(gvk, objRef)...)
+	if len(evaluators) == 0 {
+		return false
+	}
+
+	shard := m.getResourceShard(objRef)
+	shard.mu.RLock()
+	reference, ok := shard.resourceHashes[*objRef]
+	shard.mu.RUnlock()
+	if !ok || reference != newCompactHash(m.unstructuredHash(oldU)) {
+		return false
+	}
+
+	redactedOld, redactedNew := RedactObject(oldU), RedactObject(newU)
+	for i := range evaluators {
+		isDrift, err := evaluateChange(evaluators[i], redactedOld, redactedNew)
+		if err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to evaluate change: %v", err))
+			return false
+		}
+		if isDrift {
+			return false
+		}
+	}
+
+	logger.V(logs.LogInfo).Info("change is not a configuration drift according to drift expressions and Lua hooks")
+	m.updateResourceHash(objRef, m.unstructuredHash(newU), getRevision(newU))
+	return true
+}
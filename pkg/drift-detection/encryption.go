@@ -0,0 +1,158 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// snapshotCipher is the algorithm persisted state is encrypted with
+	snapshotCipher = "aes-256-gcm"
+
+	// dataKeySize is the size, in bytes, of the key persisted state is encrypted with
+	dataKeySize = 32
+
+	// keyServiceTimeout bounds each call to the KeyEncryptionService
+	keyServiceTimeout = 10 * time.Second
+)
+
+// KeyEncryptionService wraps (encrypts) and unwraps the keys persisted state is encrypted with
+// (envelope encryption), for instance via an external KMS. Each snapshot is encrypted with a new
+// data key. Only the wrapped data key is persisted, so persisted state cannot be read without
+// access to the key encryption key, which never leaves the service.
+type KeyEncryptionService interface {
+	// KeyID identifies the key encryption key data keys are currently wrapped with. It is
+	// persisted along with the wrapped data key.
+	KeyID() string
+
+	// Wrap encrypts dataKey with the key encryption key
+	Wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+
+	// Unwrap decrypts a data key wrapped with the key encryption key identified by keyID
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// encryptedSnapshot is the persisted state when encrypted (see SetSnapshotEncryption)
+type encryptedSnapshot struct {
+	// Cipher is the algorithm Ciphertext was encrypted with. Empty for a snapshot in plaintext.
+	Cipher string `json:"cipher"`
+
+	// KeyID identifies the key encryption key WrappedKey was wrapped with
+	KeyID string `json:"keyID"`
+
+	// WrappedKey is the data key Ciphertext was encrypted with, wrapped by the KeyEncryptionService
+	WrappedKey []byte `json:"wrappedKey"`
+
+	Nonce []byte `json:"nonce"`
+
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// sealSnapshot returns data, the persisted state, encrypted with a new data key when a
+// KeyEncryptionService is set. Returns data otherwise.
+func sealSnapshot(data []byte) ([]byte, error) {
+	if snapshotEncryption == nil {
+		return data, nil
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), keyServiceTimeout)
+	defer cancel()
+	keyID := snapshotEncryption.KeyID()
+	wrapped, err := snapshotEncryption.Wrap(ctx, dataKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to wrap data key")
+	}
+
+	aead, err := newSnapshotAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&encryptedSnapshot{
+		Cipher:     snapshotCipher,
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, data, []byte(keyID)),
+	})
+}
+
+// openSnapshot returns the persisted state data contains, decrypting it if encrypted.
+// When a KeyEncryptionService is set, a snapshot in plaintext is rejected, unless migration of
+// a plaintext snapshot is allowed (see SetPlaintextSnapshotMigration): it is then accepted once,
+// next snapshot being encrypted.
+func openSnapshot(data []byte) ([]byte, error) {
+	envelope := &encryptedSnapshot{}
+	if err := json.Unmarshal(data, envelope); err != nil || envelope.Cipher == "" {
+		if snapshotEncryption == nil || plaintextSnapshotMigration.CompareAndSwap(true, false) {
+			return data, nil
+		}
+		return nil, errors.New("snapshot is in plaintext but encryption is enabled")
+	}
+
+	if envelope.Cipher != snapshotCipher {
+		return nil, fmt.Errorf("unsupported snapshot cipher %q", envelope.Cipher)
+	}
+	if snapshotEncryption == nil {
+		return nil, fmt.Errorf("snapshot is encrypted but no key encryption service is configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), keyServiceTimeout)
+	defer cancel()
+	dataKey, err := snapshotEncryption.Unwrap(ctx, envelope.KeyID, envelope.WrappedKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unwrap data key")
+	}
+
+	aead, err := newSnapshotAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid snapshot nonce")
+	}
+	return aead.Open(nil, envelope.Nonce, envelope.Ciphertext, []byte(envelope.KeyID))
+}
+
+func newSnapshotAEAD(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != dataKeySize {
+		return nil, fmt.Errorf("invalid data key size %d", len(dataKey))
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
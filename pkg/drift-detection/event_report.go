@@ -0,0 +1,152 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// Resources which drifted are periodically written as a Sveltos EventReport, as if an EventSource
+// named eventReportSource matched them. EventTriggers referencing such EventSource then react to
+// drifts (notifications, automation) like to any other Sveltos event, with no separate
+// integration. EventReport lists the resources which drifted during last interval: once no
+// resource drifts anymore, the EventReport lists none.
+// EventReport is written where ResourceSummaries are stored: in the managed cluster, where
+// event-manager collects it from, or in the cluster namespace of the management cluster.
+
+const (
+	// eventReportNamespace is the namespace EventReports are written to in the managed cluster
+	eventReportNamespace = "projectsveltos"
+)
+
+// writeEventReports periodically writes drifted resources as an EventReport (see SetEventReports)
+func (m *manager) writeEventReports(ctx context.Context) {
+	if eventReportSource == "" {
+		return
+	}
+
+	ticker := time.NewTicker(eventReportInterval)
+	defer ticker.Stop()
+
+	// written is the sequence of the most recent drift event considered so far
+	written := uint64(0)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			events := m.driftEvents.after(written)
+			if err := m.writeEventReport(ctx, getDriftedResources(events)); err != nil {
+				m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to write event report: %v", err))
+				continue
+			}
+			if len(events) != 0 {
+				written = events[len(events)-1].Sequence
+			}
+		}
+	}
+}
+
+// getDriftedResources returns, sorted, the resources whose most recent event is an actual drift
+func getDriftedResources(events []DriftEvent) []corev1.ObjectReference {
+	latest := make(map[corev1.ObjectReference]*DriftEvent)
+	for i := range events {
+		latest[events[i].Resource] = &events[i]
+	}
+
+	resources := make([]corev1.ObjectReference, 0, len(latest))
+	for resource, event := range latest {
+		if event.isDrift() {
+			resources = append(resources, resource)
+		}
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return getInventoryEntry(&resources[i]) < getInventoryEntry(&resources[j])
+	})
+	return resources
+}
+
+// writeEventReport writes the EventReport listing resources. EventReport is only updated, and
+// marked for delivery, when resources changed.
+func (m *manager) writeEventReport(ctx context.Context, resources []corev1.ObjectReference) error {
+	eventReport := m.buildEventReport(resources)
+
+	current := &libsveltosv1alpha1.EventReport{}
+	err := m.Get(ctx, types.NamespacedName{Namespace: eventReport.Namespace, Name: eventReport.Name}, current)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		if len(resources) == 0 {
+			return nil
+		}
+		if err := m.Create(ctx, eventReport); err != nil {
+			return err
+		}
+		current = eventReport
+	} else {
+		if reflect.DeepEqual(current.Spec, eventReport.Spec) {
+			return nil
+		}
+		current.Labels = eventReport.Labels
+		current.Spec = eventReport.Spec
+		if err := m.Update(ctx, current); err != nil {
+			return err
+		}
+	}
+
+	phase := libsveltosv1alpha1.ReportWaitingForDelivery
+	current.Status.Phase = &phase
+	return m.Status().Update(ctx, current)
+}
+
+// buildEventReport returns the EventReport listing resources
+func (m *manager) buildEventReport(resources []corev1.ObjectReference) *libsveltosv1alpha1.EventReport {
+	namespace, name := eventReportNamespace, eventReportSource
+	if eventReportsInManagementCluster {
+		namespace = m.clusterNamespace
+		name = libsveltosv1alpha1.GetEventReportName(eventReportSource, m.clusterName, &m.clusterType)
+	}
+
+	eventReport := &libsveltosv1alpha1.EventReport{
+		Spec: libsveltosv1alpha1.EventReportSpec{
+			ClusterNamespace: m.clusterNamespace,
+			ClusterName:      m.clusterName,
+			ClusterType:      m.clusterType,
+			EventSourceName:  eventReportSource,
+		},
+	}
+	eventReport.Namespace = namespace
+	eventReport.Name = name
+	eventReport.Labels = libsveltosv1alpha1.GetEventReportLabels(eventReportSource, m.clusterName, &m.clusterType)
+	if len(resources) != 0 {
+		eventReport.Spec.MatchingResources = resources
+	}
+	return eventReport
+}
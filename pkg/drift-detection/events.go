@@ -0,0 +1,221 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// maxDriftEvents is the number of most recent drift events kept in memory
+	maxDriftEvents = 1000
+)
+
+// DriftEvent is a configuration drift detected on a tracked resource
+type DriftEvent struct {
+	// Sequence increases by one with each drift event. Use it to only fetch newer events.
+	Sequence uint64 `json:"sequence"`
+
+	Time time.Time `json:"time"`
+
+	Resource corev1.ObjectReference `json:"resource"`
+
+	// Deleted is set if resource was deleted, unset if it was modified
+	Deleted bool `json:"deleted"`
+
+	// Consumers contains the ResourceSummaries tracking resource
+	Consumers []corev1.ObjectReference `json:"consumers"`
+
+	// ReportOnly is set if drift was only recorded: Consumers were not marked for reconciliation
+	// (see SetReportOnly)
+	ReportOnly bool `json:"reportOnly,omitempty"`
+
+	// FluxOwner, set when resource is managed by Flux (see SetFluxOwnership), is the Flux
+	// Kustomization or HelmRelease managing it, as "Kind namespace/name"
+	FluxOwner string `json:"fluxOwner,omitempty"`
+
+	// ValuesDrift is set if values of a Helm release drifted from the ones Sveltos deployed it
+	// with (see SetHelmValuesInterval). Resource is then the release Secret of the drifted revision.
+	ValuesDrift bool `json:"valuesDrift,omitempty"`
+
+	// PrunedBy, set when resource was deleted after being removed from its inventory (see
+	// SetInventoryCorrelation), is such inventory. Pruned resources are never reported to Sveltos.
+	PrunedBy string `json:"prunedBy,omitempty"`
+
+	// Signature, set when a signing key is configured (see SetDriftEventSigningKey), is the hex
+	// encoded HMAC-SHA256 of the JSON encoding of the event with Signature unset
+	Signature string `json:"signature,omitempty"`
+}
+
+// driftEventLog keeps the most recent maxDriftEvents drift events
+type driftEventLog struct {
+	mu     sync.Mutex
+	events []DriftEvent
+	// last is the sequence of the most recent event
+	last uint64
+}
+
+// record assigns sequence and time to event, signs it and keeps it
+func (l *driftEventLog) record(event *DriftEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.last++
+	if len(l.events) == maxDriftEvents {
+		l.events = l.events[1:]
+	}
+	event.Sequence = l.last
+	event.Time = time.Now()
+	if driftEventSigningKey != nil {
+		event.Signature = signDriftEvent(event, driftEventSigningKey)
+	}
+	l.events = append(l.events, *event)
+
+	if driftEventOutput != nil {
+		// Writes are serialized by l.mu, so records are never interleaved.
+		// A failed write must not block drift detection: record is only dropped.
+		_ = json.NewEncoder(driftEventOutput).Encode(formatDriftEvent(event))
+	}
+}
+
+// signDriftEvent returns the signature of event (see DriftEvent.Signature) with key
+func signDriftEvent(event *DriftEvent, key []byte) string {
+	unsigned := *event
+	unsigned.Signature = ""
+	// Encoding a DriftEvent cannot fail
+	data, _ := json.Marshal(&unsigned)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyDriftEvent returns true if event is signed with key and was not altered since
+func VerifyDriftEvent(event *DriftEvent, key []byte) bool {
+	signature, err := hex.DecodeString(event.Signature)
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+	expected, _ := hex.DecodeString(signDriftEvent(event, key))
+	return hmac.Equal(signature, expected)
+}
+
+// after returns the events, oldest first, with a sequence greater than sequence
+func (l *driftEventLog) after(sequence uint64) []DriftEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := make([]DriftEvent, 0)
+	for i := range l.events {
+		if l.events[i].Sequence > sequence {
+			result = append(result, l.events[i])
+		}
+	}
+	return result
+}
+
+// isDrift returns true if event is an actual drift. Pruned and Flux owned resources are not
+// drifts Sveltos is in charge of.
+func (e *DriftEvent) isDrift() bool {
+	return e.PrunedBy == "" && e.FluxOwner == ""
+}
+
+// recordEvent keeps event (see DriftEventsPath) and, if it is an actual drift, hands it to the
+// drift event sinks, if any
+func (m *manager) recordEvent(event *DriftEvent) {
+	m.driftEvents.record(event)
+	if len(driftEventSinks) == 0 || !event.isDrift() {
+		return
+	}
+	for i := range driftEventSinks {
+		driftEventSinks[i].DriftDetected(event)
+	}
+	m.remediations.add(event)
+}
+
+// recordDriftEvent records that resource drifted. Drift is reported to all ResourceSummaries tracking it,
+// unless in report-only mode.
+func (m *manager) recordDriftEvent(resourceRef *corev1.ObjectReference, deleted bool) {
+	m.recordEvent(&DriftEvent{
+		Resource:   *resourceRef,
+		Deleted:    deleted,
+		Consumers:  m.getDriftConsumers(resourceRef),
+		ReportOnly: reportOnly,
+	})
+}
+
+// recordFluxOwnedDriftEvent records that resource, managed by fluxOwner, drifted. Drift is never
+// reported to ResourceSummaries tracking it (see SetFluxOwnership).
+func (m *manager) recordFluxOwnedDriftEvent(resourceRef *corev1.ObjectReference, fluxOwner string) {
+	m.recordEvent(&DriftEvent{
+		Resource:   *resourceRef,
+		Consumers:  m.getDriftConsumers(resourceRef),
+		ReportOnly: true,
+		FluxOwner:  fluxOwner,
+	})
+}
+
+// recordPrunedEvent records that resource was deleted after being removed from inventory.
+// Pruning is never reported to ResourceSummaries tracking resource.
+func (m *manager) recordPrunedEvent(resourceRef *corev1.ObjectReference, inventory string) {
+	m.recordEvent(&DriftEvent{
+		Resource:   *resourceRef,
+		Deleted:    true,
+		Consumers:  m.getDriftConsumers(resourceRef),
+		ReportOnly: true,
+		PrunedBy:   inventory,
+	})
+}
+
+// recordHelmValuesDriftEvent records that values of a Helm release, deployed because of
+// resourceSummary, drifted. releaseRef is the release Secret of the drifted revision.
+func (m *manager) recordHelmValuesDriftEvent(releaseRef, resourceSummary *corev1.ObjectReference) {
+	m.recordEvent(&DriftEvent{
+		Resource:    *releaseRef,
+		Consumers:   []corev1.ObjectReference{*resourceSummary},
+		ReportOnly:  reportOnly,
+		ValuesDrift: true,
+	})
+}
+
+// getDriftConsumers returns the ResourceSummaries tracking resource.
+// Consumer maps are copy-on-write, so no lock is needed.
+func (m *manager) getDriftConsumers(resourceRef *corev1.ObjectReference) []corev1.ObjectReference {
+	consumers := make([]corev1.ObjectReference, 0)
+	seen := make(map[corev1.ObjectReference]bool)
+	for _, sectionConsumers := range []*consumerMap{m.resources, m.helmResources} {
+		rsList, ok := sectionConsumers.get(resourceRef)
+		if !ok {
+			continue
+		}
+		resourceSummaries := rsList.Items()
+		for i := range resourceSummaries {
+			if !seen[resourceSummaries[i]] {
+				seen[resourceSummaries[i]] = true
+				consumers = append(consumers, resourceSummaries[i])
+			}
+		}
+	}
+	return consumers
+}
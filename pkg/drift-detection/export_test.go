@@ -18,9 +18,14 @@ package driftdetection
 
 import (
 	"context"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
 )
@@ -29,44 +34,316 @@ func Reset() {
 	managerInstance = nil
 }
 
+func ResetDriftEventSinks() {
+	driftEventSinks = nil
+}
+
 func (m *manager) GetResources() map[corev1.ObjectReference]*libsveltosset.Set {
-	return m.resources
+	return m.resources.snapshot()
 }
 
 func (m *manager) AddResource(resource, requestor *corev1.ObjectReference) {
-	m.resources[*resource] = &libsveltosset.Set{}
-	m.resources[*resource].Insert(requestor)
+	m.resources.insert(resource, requestor)
 }
 
 func (m *manager) GetHelmResources() map[corev1.ObjectReference]*libsveltosset.Set {
-	return m.helmResources
+	return m.helmResources.snapshot()
 }
 
 func (m *manager) GetResourceHashes() map[corev1.ObjectReference][]byte {
-	return m.resourceHashes
+	result := make(map[corev1.ObjectReference][]byte)
+	m.rangeShards(func(_ schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		for k, v := range shard.resourceHashes {
+			result[k] = v.bytes()
+		}
+	})
+	return result
 }
 
 func (m *manager) SetResourceHashes(resource *corev1.ObjectReference, hash []byte) {
-	m.resourceHashes[*resource] = hash
+	shard := m.getResourceShard(resource)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.resourceHashes[*resource] = newCompactHash(hash)
+}
+
+func (m *manager) SetEvaluatedResourceVersion(resource *corev1.ObjectReference, resourceVersion string) {
+	shard := m.getResourceShard(resource)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.evaluatedRevisions[*resource] = revision{resourceVersion: resourceVersion}
+}
+
+func (m *manager) SetEvaluatedGeneration(resource *corev1.ObjectReference, resourceVersion string,
+	generation int64) {
+
+	shard := m.getResourceShard(resource)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.evaluatedRevisions[*resource] = revision{resourceVersion: resourceVersion, generation: generation}
+}
+
+func (m *manager) GetFromSnapshot(resource *corev1.ObjectReference) (resourceVersion string, hash []byte, ok bool) {
+	r, hash, ok := m.getFromSnapshot(resource)
+	return r.resourceVersion, hash, ok
 }
 
 func (m *manager) GetWatchers() map[schema.GroupVersionKind]context.CancelFunc {
-	return m.watchers
+	result := make(map[schema.GroupVersionKind]context.CancelFunc)
+	m.rangeShards(func(gvk schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		if shard.cancel != nil {
+			result[gvk] = shard.cancel
+		}
+	})
+	return result
 }
 
 func (m *manager) GetGVKResources() map[schema.GroupVersionKind]*libsveltosset.Set {
-	return m.gvkResources
+	result := make(map[schema.GroupVersionKind]*libsveltosset.Set)
+	m.rangeShards(func(gvk schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		if shard.resources.Len() != 0 {
+			result[gvk] = shard.resources
+		}
+	})
+	return result
+}
+
+// TrackResource records resource as tracked in the shard of its GVK, without starting any watcher
+func (m *manager) TrackResource(resource *corev1.ObjectReference) {
+	shard := m.getResourceShard(resource)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.resources.Insert(resource)
+}
+
+// DuePolledResources returns the resources of gvk, among tracked ones, due for evaluation
+func (m *manager) DuePolledResources(gvk schema.GroupVersionKind, tracked []corev1.ObjectReference,
+	now time.Time) []corev1.ObjectReference {
+
+	return m.duePolledResources(m.getShard(gvk), tracked, now)
+}
+
+// ReschedulePolledResources schedules next evaluation of the due resources of gvk
+func (m *manager) ReschedulePolledResources(gvk schema.GroupVersionKind, due, changed []corev1.ObjectReference,
+	now time.Time) {
+
+	m.reschedulePolledResources(m.getShard(gvk), due, changed, now)
+}
+
+// SetWatcher records informers, stopped by cancel, as the watcher of gvk
+func (m *manager) SetWatcher(gvk schema.GroupVersionKind, informers []cache.SharedIndexInformer,
+	cancel context.CancelFunc) {
+
+	shard := m.getShard(gvk)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.informers = informers
+	shard.cancel = cancel
+}
+
+func (m *manager) IsPolled(gvk schema.GroupVersionKind) bool {
+	shard := m.getShard(gvk)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.polled
+}
+
+// SetClient sets the client ResourceSummaries are read and updated with
+func (m *manager) SetClient(c client.Client) {
+	m.Client = c
+}
+
+// GetIgnorePaths returns the field exclusions set on resourceSummary (see SetIgnorePaths), if any
+func (m *manager) GetIgnorePaths(resourceSummary *corev1.ObjectReference) []fieldExclusion {
+	m.ignorePaths.mu.RLock()
+	defer m.ignorePaths.mu.RUnlock()
+	paths, ok := m.ignorePaths.exclusions[types.NamespacedName{Namespace: resourceSummary.Namespace,
+		Name: resourceSummary.Name}]
+	if !ok {
+		return nil
+	}
+	return paths.exclusions
+}
+
+// EvaluateLuaHook returns the outcome of script, as a Lua hook, on the change from oldU to newU
+func EvaluateLuaHook(script string, oldU, newU *unstructured.Unstructured) (bool, error) {
+	proto, err := compileLuaHook(script)
+	if err != nil {
+		return false, err
+	}
+	hook := &compiledLuaHook{LuaHook: LuaHook{Kind: anyValue, Script: script}, proto: proto}
+	return hook.isDrift(oldU, newU)
+}
+
+// GetFetchTimeoutDeadline returns the deadline of GETs of resourceRef (see SetFetchTimeout), if any
+func (m *manager) GetFetchTimeoutDeadline(resourceRef *corev1.ObjectReference) (time.Time, bool) {
+	ctx, cancel, _ := m.withFetchTimeout(context.Background(), resourceRef)
+	defer cancel()
+	return ctx.Deadline()
+}
+
+// ChangeEvaluatorFunc is a changeEvaluator
+type ChangeEvaluatorFunc func(oldU, newU *unstructured.Unstructured) (bool, error)
+
+func (f ChangeEvaluatorFunc) isDrift(oldU, newU *unstructured.Unstructured) (bool, error) {
+	return f(oldU, newU)
+}
+
+func EvaluateChange(evaluator ChangeEvaluatorFunc, oldU, newU *unstructured.Unstructured) (bool, error) {
+	return evaluateChange(evaluator, oldU, newU)
+}
+
+// GetFieldExclusionPointers returns the parsed JSON pointers of the configured field exclusions
+func GetFieldExclusionPointers() [][]string {
+	var pointers [][]string
+	for i := range fieldExclusions {
+		pointers = append(pointers, fieldExclusions[i].pointers...)
+	}
+	return pointers
+}
+
+// GetPointers returns the parsed JSON pointers of e
+func (e *fieldExclusion) GetPointers() [][]string {
+	return e.pointers
 }
 
 func (m *manager) GetJobQueue() *libsveltosset.Set {
 	return m.jobQueue
 }
 
+func (m *manager) GetQueuedAt() map[corev1.ObjectReference]time.Time {
+	return m.queuedAt
+}
+
+func (m *manager) QueueResource(resource *corev1.ObjectReference) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkForConfigurationDrift(resource)
+}
+
+func (m *manager) GetDriftEvents(after uint64) []DriftEvent {
+	return m.driftEvents.after(after)
+}
+
+func Hash(u *unstructured.Unstructured) []byte {
+	return (&manager{}).unstructuredHash(u)
+}
+
+// NewTrackingManager returns a manager which can track resources without being initialized
+func NewTrackingManager() *manager {
+	return &manager{resources: &consumerMap{}, helmResources: &consumerMap{}}
+}
+
+// NewEvaluationManager returns a manager which can evaluate resources without being initialized
+func NewEvaluationManager() *manager {
+	return newBenchmarkManager()
+}
+
+type ResourceSummaryUpdates = resourceSummaryUpdates
+
+func (u resourceSummaryUpdates) Add(resourceSummaryRef, resourceRef *corev1.ObjectReference,
+	currentHash []byte, isHelm bool) {
+
+	u.add(resourceSummaryRef, resourceRef, currentHash, isHelm)
+}
+
+func (u resourceSummaryUpdates) Get(resourceSummaryRef *corev1.ObjectReference) *resourceSummaryUpdate {
+	return u[*resourceSummaryRef]
+}
+
+func (u resourceSummaryUpdates) GetHashes(resourceSummaryRef *corev1.ObjectReference) map[corev1.ObjectReference][]byte {
+	return u[*resourceSummaryRef].hashes
+}
+
+func (u resourceSummaryUpdates) IsMarkedForReconciliation(resourceSummaryRef *corev1.ObjectReference,
+) (resourcesChanged, helmResourcesChanged bool) {
+
+	return u[*resourceSummaryRef].resourcesChanged, u[*resourceSummaryRef].helmResourcesChanged
+}
+
+// NewHelmValuesBaseline returns the baseline of a Helm release deployed by Sveltos at revision with
+// values whose digest is digest
+func NewHelmValuesBaseline(digest []byte, revision int) *helmValuesBaseline {
+	return &helmValuesBaseline{digest: digest, revision: revision}
+}
+
+// Evaluate returns true if revision, deployed with values whose digest is digest, is a values drift
+// not reported yet
+func (b *helmValuesBaseline) Evaluate(revision int, digest []byte) bool {
+	return b.evaluate(&helmReleaseValues{revision: revision, digest: digest})
+}
+
+// SetDeniedVerbs records that verbs, on resource of gvk, are denied in namespace
+func (m *manager) SetDeniedVerbs(gvk schema.GroupVersionKind, resource, namespace string, verbs ...string) {
+	check := &permissionCheck{resource: resource, checkedAt: time.Now()}
+	if v, ok := m.permissions.Load(gvk); ok {
+		check = v.(*permissionCheck)
+	}
+	for _, verb := range verbs {
+		check.denied = append(check.denied, deniedAccess{verb: verb, namespace: namespace})
+	}
+	m.permissions.Store(gvk, check)
+}
+
 var (
 	React                                   = (*manager).react
+	AcceptChange                            = (*manager).acceptChange
 	UnstructuredHash                        = (*manager).unstructuredHash
+	UnstructuredHashWithChangedKeys         = (*manager).unstructuredHashWithChangedKeys
+	LegacyHash                              = legacyUnstructuredHash
+	NewCompactHash                          = newCompactHash
 	GetUnstructured                         = (*manager).getUnstructured
 	EvaluateResource                        = (*manager).evaluateResource
 	RequestReconciliationForResourceSummary = (*manager).requestReconciliationForResourceSummary
 	ReadResourceSummaries                   = (*manager).readResourceSummaries
+	ResetBaselines                          = (*manager).resetBaselines
+	ConfirmDrift                            = (*manager).confirmDrift
+	ObserveAPIResponse                      = (*manager).observeAPIResponse
+	SetPaused                               = (*manager).setPaused
+	EvaluateAndReport                       = (*manager).evaluateAndReport
+	WaitForAPIServer                        = (*manager).waitForAPIServer
+	WriteSnapshot                           = (*manager).writeSnapshot
+	LoadSnapshot                            = (*manager).loadSnapshot
+	TakeDueResources                        = (*manager).takeDueResources
+	ParseEvaluatePath                       = parseEvaluatePath
+	GetTrackedResourceList                  = getTrackedResourceList
+	RecordDriftEvent                        = (*manager).recordDriftEvent
+	RecordFluxOwnedDriftEvent               = (*manager).recordFluxOwnedDriftEvent
+	RecordPrunedEvent                       = (*manager).recordPrunedEvent
+	SkipFluxOwnedDrift                      = (*manager).skipFluxOwnedDrift
+	SkipTerraformOwnedDrift                 = (*manager).skipTerraformOwnedDrift
+	SkipCrossplaneComposedDrift             = (*manager).skipCrossplaneComposedDrift
+	GetKappNextVersion                      = getKappNextVersion
+	GetHelmValuesDigest                     = getHelmValuesDigest
+	GetInventoryRef                         = getInventoryRef
+	GetInventoryEntry                       = getInventoryEntry
+	BuildPolicyReports                      = buildPolicyReports
+	GetDriftedResources                     = getDriftedResources
+	GetComponentList                        = (*manager).getComponentList
+	UpdateResourceSummaries                 = (*manager).updateResourceSummaries
+	GetMissingRules                         = (*manager).getMissingRules
+	ExposedHash                             = exposedHash
+	BufferUpdate                            = (*manager).bufferUpdate
+	TakePendingUpdates                      = (*manager).takePendingUpdates
+	GetLastOfflineWindow                    = (*manager).getLastOfflineWindow
+	QueueChangedSinceRegistration           = (*manager).queueChangedSinceRegistration
+	TakeExistenceCheck                      = (*manager).takeExistenceCheck
+	ExcludeNamespaces                       = excludeNamespaces
+	TweakListOptions                        = tweakListOptions
+	TrackDrift                              = trackDrift
+	TrackEvaluationDuration                 = trackEvaluationDuration
+	RecordEventObject                       = (*manager).recordEventObject
+	ForgetEventObject                       = (*manager).forgetEventObject
+	GetObjectForEvaluation                  = (*manager).getObjectForEvaluation
+	IsDuplicateEvent                        = (*manager).isDuplicateEvent
+	MoveHeaviestGVKToPolling                = (*manager).moveHeaviestGVKToPolling
+	ListInChunks                            = (*manager).listInChunks
+	GetRESTMapping                          = (*manager).getRESTMapping
+	RecordExistenceCheck                    = (*manager).recordExistenceCheck
 )
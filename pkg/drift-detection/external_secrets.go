@@ -0,0 +1,97 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"maps"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// External Secrets Operator (ESO) periodically refreshes the Secrets its ExternalSecrets manage,
+// rewriting their data. When ESO awareness is enabled (see SetExternalSecretsAware), in Secrets
+// managed by an ExternalSecret the fields owned, according to managedFields, by ESO field manager
+// and the annotation ESO bookkeeps data digest in are not considered when hashing. Manual edits
+// take ownership of the edited fields, so they are still configuration drifts. Which
+// ExternalSecret manages the Secret is considered, so ownership changes are configuration drifts too.
+
+const (
+	// externalSecretsGroup is the API group of ExternalSecrets
+	externalSecretsGroup = "external-secrets.io"
+
+	// externalSecretsFieldManager is the field manager ESO writes Secrets with
+	externalSecretsFieldManager = "external-secrets"
+
+	// externalSecretsCreatedByLabel is set by ESO on the Secrets it creates
+	externalSecretsCreatedByLabel = "reconcile.external-secrets.io/created-by"
+
+	// externalSecretsDataHashAnnotation is the digest of Secret data, updated by ESO on each refresh
+	externalSecretsDataHashAnnotation = "reconcile.external-secrets.io/data-hash"
+
+	// externalSecretOwnerField is the field ExternalSecret managing a Secret is hashed as. It is not
+	// a Secret field, so it never conflicts with Secret content.
+	externalSecretOwnerField = "projectsveltos.io/external-secret"
+)
+
+// getExternalSecretOwner returns the ExternalSecret managing u, a Secret. Empty if u is not
+// managed by ESO.
+func getExternalSecretOwner(u *unstructured.Unstructured) string {
+	for _, owner := range u.GetOwnerReferences() {
+		if owner.Kind == "ExternalSecret" && strings.HasPrefix(owner.APIVersion, externalSecretsGroup+"/") {
+			return owner.Name
+		}
+	}
+	// ExternalSecrets with creationPolicy Orphan do not own the Secrets they create
+	return u.GetLabels()[externalSecretsCreatedByLabel]
+}
+
+// excludeExternalSecretsRefresh returns u, if it is a Secret managed by ESO, without the fields
+// ESO rewrites on refresh and with the ExternalSecret managing it. u is returned unchanged otherwise.
+func excludeExternalSecretsRefresh(u *unstructured.Unstructured) *unstructured.Unstructured {
+	if !externalSecretsAware || u.GetKind() != "Secret" || u.GetAPIVersion() != "v1" {
+		return u
+	}
+	owner := getExternalSecretOwner(u)
+	if owner == "" {
+		return u
+	}
+
+	var content map[string]interface{}
+	if hasManagedFields(u, externalSecretsFieldManager) {
+		// Fields owned by ESO can be anywhere in the Secret
+		content = u.DeepCopy().UnstructuredContent()
+		removeManagedFields(content, u, externalSecretsFieldManager)
+	} else {
+		// Only top level fields and annotations are changed: the rest of the content is shared
+		// with u, which is never modified
+		content = maps.Clone(u.Object)
+	}
+	if metadata, ok := content["metadata"].(map[string]interface{}); ok {
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			if _, ok := annotations[externalSecretsDataHashAnnotation]; ok {
+				annotations = maps.Clone(annotations)
+				delete(annotations, externalSecretsDataHashAnnotation)
+				metadata = maps.Clone(metadata)
+				metadata["annotations"] = annotations
+				content["metadata"] = metadata
+			}
+		}
+	}
+	content[externalSecretOwnerField] = owner
+	return &unstructured.Unstructured{Object: content}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+const (
+	// FetchTimeoutAnnotation, set on a ResourceSummary, is the time each GET of a resource it tracks
+	// can take, as a duration (e.g. 2m for huge custom resources or slow aggregated APIs). Resources
+	// tracked because of multiple ResourceSummaries are fetched with the largest timeout set.
+	// ResourceSummary spec is defined by libsveltos, hence the annotation.
+	FetchTimeoutAnnotation = "projectsveltos.io/drift-fetch-timeout"
+)
+
+// fetchTimeoutTracker contains the fetch timeouts set on ResourceSummaries (see FetchTimeoutAnnotation)
+type fetchTimeoutTracker struct {
+	mu sync.RWMutex
+	// Key: ResourceSummary
+	timeouts map[types.NamespacedName]time.Duration
+}
+
+// SetFetchTimeout sets the time each GET of a resource tracked because of resourceSummary can take,
+// as set by its FetchTimeoutAnnotation. Returns the timeout now in effect, zero if none, and whether
+// it changed. On error, previous timeout is kept.
+func (m *manager) SetFetchTimeout(resourceSummary *libsveltosv1alpha1.ResourceSummary,
+) (timeout time.Duration, changed bool, err error) {
+
+	key := types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name}
+
+	if value := resourceSummary.Annotations[FetchTimeoutAnnotation]; value != "" {
+		timeout, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, false, errors.Wrapf(err, "invalid %s annotation", FetchTimeoutAnnotation)
+		}
+		if timeout <= 0 {
+			return 0, false, fmt.Errorf("invalid %s annotation: timeout must be positive", FetchTimeoutAnnotation)
+		}
+	}
+
+	return timeout, m.fetchTimeouts.set(key, timeout), nil
+}
+
+// ClearFetchTimeout forgets the fetch timeout of resourceSummary (see SetFetchTimeout)
+func (m *manager) ClearFetchTimeout(resourceSummary *corev1.ObjectReference) {
+	m.fetchTimeouts.set(types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name}, 0)
+}
+
+// set records timeout of resourceSummary. Zero timeout forgets resourceSummary.
+// Returns true if timeout changed.
+func (t *fetchTimeoutTracker) set(resourceSummary types.NamespacedName, timeout time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previous := t.timeouts[resourceSummary]
+	if timeout == 0 {
+		delete(t.timeouts, resourceSummary)
+	} else {
+		if t.timeouts == nil {
+			t.timeouts = make(map[types.NamespacedName]time.Duration)
+		}
+		t.timeouts[resourceSummary] = timeout
+	}
+	return previous != timeout
+}
+
+// withFetchTimeout returns ctx bound by the largest fetch timeout set by the ResourceSummaries
+// tracking resourceRef, along with that timeout. ctx is returned as it is if none is set.
+func (m *manager) withFetchTimeout(ctx context.Context, resourceRef *corev1.ObjectReference,
+) (context.Context, context.CancelFunc, time.Duration) {
+
+	m.fetchTimeouts.mu.RLock()
+	var timeout time.Duration
+	if len(m.fetchTimeouts.timeouts) != 0 {
+		for _, consumer := range m.getDriftConsumers(resourceRef) {
+			key := types.NamespacedName{Namespace: consumer.Namespace, Name: consumer.Name}
+			timeout = max(timeout, m.fetchTimeouts.timeouts[key])
+		}
+	}
+	m.fetchTimeouts.mu.RUnlock()
+
+	if timeout == 0 {
+		return ctx, func() {}, 0
+	}
+	getCtx, cancel := context.WithTimeout(ctx, timeout)
+	return getCtx, cancel, timeout
+}
+
+// fetchTimeoutError returns err, returned by a GET run with ctx, along with the fetch timeout
+// which stopped it, if any
+func fetchTimeoutError(ctx context.Context, timeout time.Duration, err error) error {
+	if timeout != 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.Wrapf(err, "%s fetch timeout (see %s) exceeded", timeout, FetchTimeoutAnnotation)
+	}
+	return err
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// anyValue, as FieldExclusion Group or Kind, matches any group or kind
+const anyValue = "*"
+
+// FieldExclusion excludes fields of matching resources from drift detection: changes to those
+// fields are not configuration drifts. It is meant for fields legitimately changed by other
+// controllers (e.g. replicas of a Deployment scaled by an HPA).
+type FieldExclusion struct {
+	// Group of matching resources. Empty for the core group, * for any group.
+	Group string `json:"group,omitempty"`
+
+	// Kind of matching resources. * for any kind.
+	Kind string `json:"kind"`
+
+	// Namespace, when set, restricts matching resources to those in this namespace
+	Namespace string `json:"namespace,omitempty"`
+
+	// Name, when set, restricts matching resources to those with this name
+	Name string `json:"name,omitempty"`
+
+	// JSONPointers are RFC 6901 JSON pointers to the excluded fields (e.g. /spec/replicas)
+	JSONPointers []string `json:"jsonPointers,omitempty"`
+
+	// ManagedFieldsManagers excludes all fields owned, according to metadata.managedFields,
+	// by any of those field managers (e.g. kube-controller-manager)
+	ManagedFieldsManagers []string `json:"managedFieldsManagers,omitempty"`
+}
+
+// fieldExclusion is a FieldExclusion with parsed JSON pointers
+type fieldExclusion struct {
+	FieldExclusion
+	pointers [][]string
+}
+
+func (e *fieldExclusion) matches(u *unstructured.Unstructured) bool {
+	gvk := u.GroupVersionKind()
+	return (e.Group == anyValue || e.Group == gvk.Group) && (e.Kind == anyValue || e.Kind == gvk.Kind) &&
+		(e.Namespace == "" || e.Namespace == u.GetNamespace()) && (e.Name == "" || e.Name == u.GetName())
+}
+
+var (
+	// fieldExclusions contains the configured field exclusions
+	fieldExclusions []fieldExclusion
+
+	// fieldExclusionsDigest identifies the configured field exclusions. Empty if none.
+	fieldExclusionsDigest string
+)
+
+// ReadFieldExclusions parses a YAML (or JSON) list of FieldExclusion
+func ReadFieldExclusions(data []byte) ([]FieldExclusion, error) {
+	var exclusions []FieldExclusion
+	if err := yaml.UnmarshalStrict(data, &exclusions); err != nil {
+		return nil, errors.Wrap(err, "invalid field exclusions")
+	}
+	return exclusions, nil
+}
+
+// SetFieldExclusions sets the fields excluded from drift detection. Hashes depend on excluded
+// fields: persisted state taken with different exclusions is ignored, and hashes of resources
+// already tracked are evaluated again without reporting drift (see NormalizationAnnotation).
+// Must be called before InitializeManager.
+func SetFieldExclusions(exclusions []FieldExclusion) error {
+	parsed, err := parseFieldExclusions(exclusions)
+	if err != nil {
+		return err
+	}
+
+	fieldExclusions = parsed
+	fieldExclusionsDigest = ""
+	if len(exclusions) != 0 {
+		// Encoding a list of FieldExclusion cannot fail
+		data, _ := json.Marshal(exclusions)
+		digest := sha256.Sum256(data)
+		fieldExclusionsDigest = hex.EncodeToString(digest[:])
+	}
+	return nil
+}
+
+// parseFieldExclusions validates exclusions and parses their JSON pointers
+func parseFieldExclusions(exclusions []FieldExclusion) ([]fieldExclusion, error) {
+	parsed := make([]fieldExclusion, len(exclusions))
+	for i := range exclusions {
+		if exclusions[i].Kind == "" {
+			return nil, fmt.Errorf("field exclusion %d: kind is required", i)
+		}
+		if len(exclusions[i].JSONPointers) == 0 && len(exclusions[i].ManagedFieldsManagers) == 0 {
+			return nil, fmt.Errorf("field exclusion %d: either jsonPointers or managedFieldsManagers is required", i)
+		}
+		parsed[i].FieldExclusion = exclusions[i]
+		for _, pointer := range exclusions[i].JSONPointers {
+			tokens, err := parseJSONPointer(pointer)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field exclusion %d", i)
+			}
+			parsed[i].pointers = append(parsed[i].pointers, tokens)
+		}
+	}
+	return parsed, nil
+}
+
+// parseJSONPointer returns the reference tokens of pointer
+func parseJSONPointer(pointer string) ([]string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q: must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(tokens[i], "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// excludeFields returns u without the fields excluded by matching field exclusions. u is
+// returned unchanged if none matches, a modified copy otherwise.
+func excludeFields(u *unstructured.Unstructured) *unstructured.Unstructured {
+	return applyFieldExclusions(u, fieldExclusions)
+}
+
+// applyFieldExclusions returns u without the fields excluded by matching exclusions. u is
+// returned unchanged if none matches, a modified copy otherwise.
+func applyFieldExclusions(u *unstructured.Unstructured, exclusions []fieldExclusion) *unstructured.Unstructured {
+	var content map[string]interface{}
+	for i := range exclusions {
+		exclusion := &exclusions[i]
+		if !exclusion.matches(u) {
+			continue
+		}
+		if content == nil {
+			content = u.DeepCopy().UnstructuredContent()
+		}
+		for _, pointer := range exclusion.pointers {
+			removePointer(content, pointer)
+		}
+		for _, manager := range exclusion.ManagedFieldsManagers {
+			removeManagedFields(content, u, manager)
+		}
+	}
+
+	if content == nil {
+		return u
+	}
+	return &unstructured.Unstructured{Object: content}
+}
+
+// removePointer removes from content the value tokens point to, if any
+func removePointer(content interface{}, tokens []string) {
+	for i, token := range tokens {
+		last := i == len(tokens)-1
+		switch value := content.(type) {
+		case map[string]interface{}:
+			if last {
+				delete(value, token)
+				return
+			}
+			content = value[token]
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(value) {
+				return
+			}
+			if last {
+				// Item is replaced by null, so that indexes of other excluded items do not shift
+				value[index] = nil
+				return
+			}
+			content = value[index]
+		default:
+			return
+		}
+	}
+}
+
+// hasManagedFields returns true if manager owns fields of u
+func hasManagedFields(u *unstructured.Unstructured, manager string) bool {
+	for _, entry := range u.GetManagedFields() {
+		if entry.Manager == manager && entry.FieldsV1 != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// removeManagedFields removes from content the fields owned by manager according to the
+// managedFields of u
+func removeManagedFields(content map[string]interface{}, u *unstructured.Unstructured, manager string) {
+	for _, entry := range u.GetManagedFields() {
+		if entry.Manager != manager || entry.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		removeFieldSet(content, fields)
+	}
+}
+
+// removeFieldSet removes from value the fields listed in fields, a managed fields set (FieldsV1):
+//   - "f:<name>" is field name of a map;
+//   - "k:<keys>" is the list item whose fields match the JSON encoded keys;
+//   - "v:<value>" is the list item equal to the JSON encoded value;
+//   - "i:<index>" is the list item at index;
+//   - "." is value itself.
+//
+// A field whose set is empty, or contains ".", is owned as a whole and removed. List items are
+// replaced by null (see removePointer).
+func removeFieldSet(value interface{}, fields map[string]interface{}) {
+	for path, child := range fields {
+		if path == "." {
+			continue
+		}
+		childFields, _ := child.(map[string]interface{})
+		_, whole := childFields["."]
+		whole = whole || len(childFields) == 0
+
+		kind, key, ok := strings.Cut(path, ":")
+		if !ok {
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if kind != "f" {
+				continue
+			}
+			if whole {
+				delete(v, key)
+			} else {
+				removeFieldSet(v[key], childFields)
+			}
+		case []interface{}:
+			index := findListItem(v, kind, key)
+			if index < 0 {
+				continue
+			}
+			if whole {
+				v[index] = nil
+			} else {
+				removeFieldSet(v[index], childFields)
+			}
+		}
+	}
+}
+
+// findListItem returns the index, in list, of the item a managed fields path element
+// ("k:", "v:" or "i:") points to. -1 if not found.
+func findListItem(list []interface{}, kind, key string) int {
+	if kind == "i" {
+		index, err := strconv.Atoi(key)
+		if err != nil || index < 0 || index >= len(list) {
+			return -1
+		}
+		return index
+	}
+
+	var expected interface{}
+	if err := json.Unmarshal([]byte(key), &expected); err != nil {
+		return -1
+	}
+	for i := range list {
+		switch kind {
+		case "v":
+			if reflect.DeepEqual(normalizeJSON(list[i]), expected) {
+				return i
+			}
+		case "k":
+			item, ok := list[i].(map[string]interface{})
+			keys, _ := expected.(map[string]interface{})
+			if ok && len(keys) != 0 && containsKeys(item, keys) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// containsKeys returns true if item has all keys with the same values
+func containsKeys(item, keys map[string]interface{}) bool {
+	for k, v := range keys {
+		if !reflect.DeepEqual(normalizeJSON(item[k]), v) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeJSON returns value with numbers as float64, like encoding/json decodes them
+func normalizeJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	}
+	return value
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// FluxOwnership defines how drifts of resources managed by Flux are handled.
+// In clusters where both Sveltos and Flux deploy resources, a resource can be managed by both.
+// Flux reverts drifts of the resources it manages on its own: reporting them to Sveltos too
+// generates duplicate drift signals, and reconciliations conflicting with Flux ones.
+type FluxOwnership string
+
+const (
+	// ReportFluxOwned reports drifts of resources managed by Flux like any other
+	ReportFluxOwned = FluxOwnership("report")
+
+	// DownrankFluxOwned records drifts of resources managed by Flux as report-only drift events
+	// (see DriftEvent.FluxOwner), but never marks ResourceSummaries for reconciliation
+	DownrankFluxOwned = FluxOwnership("downrank")
+
+	// SkipFluxOwned ignores drifts of resources managed by Flux. Those are only counted in metrics.
+	SkipFluxOwned = FluxOwnership("skip")
+)
+
+// fluxOwnerLabels contains, per kind of Flux object, the labels Flux sets on the resources it applies
+var fluxOwnerLabels = []struct {
+	kind           string
+	nameLabel      string
+	namespaceLabel string
+}{
+	{kind: "Kustomization", nameLabel: "kustomize.toolkit.fluxcd.io/name",
+		namespaceLabel: "kustomize.toolkit.fluxcd.io/namespace"},
+	{kind: "HelmRelease", nameLabel: "helm.toolkit.fluxcd.io/name",
+		namespaceLabel: "helm.toolkit.fluxcd.io/namespace"},
+}
+
+// getFluxOwner returns the Flux Kustomization or HelmRelease managing u, as "Kind namespace/name".
+// Empty if u is not managed by Flux.
+func getFluxOwner(u *unstructured.Unstructured) string {
+	labels := u.GetLabels()
+	for i := range fluxOwnerLabels {
+		if name := labels[fluxOwnerLabels[i].nameLabel]; name != "" {
+			return fmt.Sprintf("%s %s/%s", fluxOwnerLabels[i].kind, labels[fluxOwnerLabels[i].namespaceLabel], name)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"fmt"
+	"time"
+)
+
+// DriftEventFormat is the format drift events are written in (see SetDriftEventOutput)
+type DriftEventFormat string
+
+const (
+	// NativeDriftEventFormat writes drift events as the JSON encoding of DriftEvent
+	NativeDriftEventFormat = DriftEventFormat("native")
+
+	// GatekeeperDriftEventFormat writes drift events like OPA Gatekeeper audit writes violations
+	// in its logs, so that pipelines and dashboards built on Gatekeeper audit data show drifts
+	// next to policy violations. Drifts are violations of the SveltosConfigurationDrift constraint
+	// kind; the drift event itself is in details.
+	GatekeeperDriftEventFormat = DriftEventFormat("gatekeeper")
+)
+
+const (
+	gatekeeperConstraintGroup   = "constraints.gatekeeper.sh"
+	gatekeeperConstraintVersion = "v1beta1"
+	gatekeeperConstraintKind    = "SveltosConfigurationDrift"
+	gatekeeperConstraintName    = "drift-detection"
+
+	// gatekeeperViolationAudited is the event type of violations found by Gatekeeper audit
+	gatekeeperViolationAudited = "violation_audited"
+)
+
+// gatekeeperAuditRecord is a violation as logged by Gatekeeper audit
+type gatekeeperAuditRecord struct {
+	Level     string  `json:"level"`
+	Timestamp float64 `json:"ts"`
+	Message   string  `json:"msg"`
+	Process   string  `json:"process"`
+	AuditID   string  `json:"audit_id"`
+	EventType string  `json:"event_type"`
+
+	ConstraintGroup      string `json:"constraint_group"`
+	ConstraintAPIVersion string `json:"constraint_api_version"`
+	ConstraintKind       string `json:"constraint_kind"`
+	ConstraintName       string `json:"constraint_name"`
+	ConstraintNamespace  string `json:"constraint_namespace"`
+	// ConstraintAction is dryrun for report-only drifts, deny for drifts Sveltos reverts
+	ConstraintAction string `json:"constraint_action"`
+
+	ResourceGroup      string `json:"resource_group"`
+	ResourceAPIVersion string `json:"resource_api_version"`
+	ResourceKind       string `json:"resource_kind"`
+	ResourceNamespace  string `json:"resource_namespace"`
+	ResourceName       string `json:"resource_name"`
+
+	Details *DriftEvent `json:"details"`
+}
+
+// formatDriftEvent returns event in the format drift events are written in
+func formatDriftEvent(event *DriftEvent) interface{} {
+	if driftEventFormat != GatekeeperDriftEventFormat {
+		return event
+	}
+
+	gvk := event.Resource.GroupVersionKind()
+	action := "deny"
+	if event.ReportOnly {
+		action = "dryrun"
+	}
+
+	return &gatekeeperAuditRecord{
+		Level:                "info",
+		Timestamp:            float64(event.Time.UnixNano()) / float64(time.Second),
+		Message:              getDriftEventMessage(event),
+		Process:              "audit",
+		AuditID:              event.Time.UTC().Format(time.RFC3339),
+		EventType:            gatekeeperViolationAudited,
+		ConstraintGroup:      gatekeeperConstraintGroup,
+		ConstraintAPIVersion: gatekeeperConstraintVersion,
+		ConstraintKind:       gatekeeperConstraintKind,
+		ConstraintName:       gatekeeperConstraintName,
+		ConstraintAction:     action,
+		ResourceGroup:        gvk.Group,
+		ResourceAPIVersion:   gvk.Version,
+		ResourceKind:         gvk.Kind,
+		ResourceNamespace:    event.Resource.Namespace,
+		ResourceName:         event.Resource.Name,
+		Details:              event,
+	}
+}
+
+// getDriftEventMessage returns a human readable description of event
+func getDriftEventMessage(event *DriftEvent) string {
+	resource := event.Resource.Name
+	if event.Resource.Namespace != "" {
+		resource = fmt.Sprintf("%s/%s", event.Resource.Namespace, resource)
+	}
+
+	switch {
+	case event.PrunedBy != "":
+		return fmt.Sprintf("%s %s was pruned from %s", event.Resource.Kind, resource, event.PrunedBy)
+	case event.ValuesDrift:
+		return fmt.Sprintf("values of Helm release stored in %s %s drifted", event.Resource.Kind, resource)
+	case event.Deleted:
+		return fmt.Sprintf("configuration drift: %s %s was deleted", event.Resource.Kind, resource)
+	default:
+		return fmt.Sprintf("configuration drift: %s %s was modified", event.Resource.Kind, resource)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/gdexlab/go-render/render"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/dump"
+)
+
+const (
+	// flushThreshold is the buffer size after which encoded content is written to the hash
+	flushThreshold = 4 * 1024
+
+	// HashVersion identifies how hashes are evaluated. Hashes in the status of a ResourceSummary
+	// without HashVersionAnnotation set to it were evaluated by legacyUnstructuredHash.
+	HashVersion = "2"
+
+	// HashVersionAnnotation, set on a ResourceSummary, is the HashVersion hashes in its status
+	// were evaluated with
+	HashVersionAnnotation = "projectsveltos.io/drift-hash-version"
+
+	// NormalizationAnnotation, set on a ResourceSummary, is the NormalizationFingerprint hashes
+	// in its status were evaluated with
+	NormalizationAnnotation = "projectsveltos.io/drift-normalization"
+)
+
+var (
+	encoderPool = sync.Pool{
+		New: func() interface{} {
+			return &canonicalEncoder{buf: make([]byte, 0, 2*flushThreshold)}
+		},
+	}
+)
+
+// canonicalEncoder streams unstructured content, in a canonical form (map keys are sorted),
+// directly into a hash. Content is never re-marshaled nor copied: encoded bytes are
+// accumulated in a pooled buffer which is periodically flushed to the hash.
+// Each value is prefixed with a type tag and, when variable in size, with its length so that
+// different contents can never produce the same encoding.
+type canonicalEncoder struct {
+	h   hash.Hash
+	buf []byte
+}
+
+// NormalizationFingerprint identifies the settings (hash mode, field exclusions and normalizers)
+// resources are normalized with before being hashed. Hashes evaluated with a different
+// fingerprint cannot be compared with current ones.
+func NormalizationFingerprint() string {
+	settings := fmt.Sprintf("hashMode=%s;fieldExclusions=%s;crossplane=%t;sidecars=%t;certManager=%t;externalSecrets=%t",
+		hashMode, fieldExclusionsDigest, crossplaneAware, sidecarNormalization, certManagerRotation,
+		externalSecretsAware)
+	digest := sha256.Sum256([]byte(settings))
+	return hex.EncodeToString(digest[:8])
+}
+
+func getCanonicalEncoder(h hash.Hash) *canonicalEncoder {
+	e := encoderPool.Get().(*canonicalEncoder)
+	e.h = h
+	e.buf = e.buf[:0]
+	return e
+}
+
+// release flushes any pending content to the hash and returns encoder to the pool
+func (e *canonicalEncoder) release() {
+	e.flush()
+	e.h = nil
+	encoderPool.Put(e)
+}
+
+func (e *canonicalEncoder) flush() {
+	if len(e.buf) == 0 {
+		return
+	}
+	e.h.Write(e.buf)
+	e.buf = e.buf[:0]
+}
+
+func (e *canonicalEncoder) maybeFlush() {
+	if len(e.buf) >= flushThreshold {
+		e.flush()
+	}
+}
+
+func (e *canonicalEncoder) writeString(s string) {
+	e.buf = append(e.buf, 's')
+	e.buf = strconv.AppendInt(e.buf, int64(len(s)), 10)
+	e.buf = append(e.buf, ':')
+	e.buf = append(e.buf, s...)
+	e.maybeFlush()
+}
+
+func (e *canonicalEncoder) writeMapHeader(size int) {
+	e.buf = append(e.buf, 'm')
+	e.buf = strconv.AppendInt(e.buf, int64(size), 10)
+	e.buf = append(e.buf, ':')
+}
+
+// writeDigest writes a digest standing for a value hashed separately
+func (e *canonicalEncoder) writeDigest(d []byte) {
+	e.buf = append(e.buf, 'd')
+	e.buf = append(e.buf, d...)
+	e.buf = append(e.buf, ';')
+	e.maybeFlush()
+}
+
+// endValue terminates a value whose content was written with lower level methods
+func (e *canonicalEncoder) endValue() {
+	e.buf = append(e.buf, ';')
+	e.maybeFlush()
+}
+
+func (e *canonicalEncoder) writeMap(m map[string]interface{}) {
+	e.writeMapHeader(len(m))
+	for _, k := range getSortedKeys(m) {
+		e.writeString(k)
+		e.writeValue(m[k])
+	}
+}
+
+func (e *canonicalEncoder) writeValue(v interface{}) {
+	switch value := v.(type) {
+	case nil:
+		e.buf = append(e.buf, 'n')
+	case map[string]interface{}:
+		e.writeMap(value)
+	case []interface{}:
+		e.buf = append(e.buf, 'a')
+		e.buf = strconv.AppendInt(e.buf, int64(len(value)), 10)
+		e.buf = append(e.buf, ':')
+		for i := range value {
+			e.writeValue(value[i])
+		}
+	case string:
+		e.writeString(value)
+	case bool:
+		e.buf = append(e.buf, 'b')
+		e.buf = strconv.AppendBool(e.buf, value)
+	case int64:
+		e.buf = append(e.buf, 'i')
+		e.buf = strconv.AppendInt(e.buf, value, 10)
+	case int:
+		e.buf = append(e.buf, 'i')
+		e.buf = strconv.AppendInt(e.buf, int64(value), 10)
+	case int32:
+		e.buf = append(e.buf, 'i')
+		e.buf = strconv.AppendInt(e.buf, int64(value), 10)
+	case float64:
+		// Integral floats are encoded as integers so that 1 and 1.0 hash the same
+		if value == math.Trunc(value) && math.Abs(value) < math.MaxInt64 {
+			e.buf = append(e.buf, 'i')
+			e.buf = strconv.AppendInt(e.buf, int64(value), 10)
+		} else {
+			e.buf = append(e.buf, 'f')
+			e.buf = strconv.AppendFloat(e.buf, value, 'g', -1, 64)
+		}
+	default:
+		e.buf = append(e.buf, 'x')
+		e.buf = fmt.Appendf(e.buf, "%#v", value)
+	}
+	e.buf = append(e.buf, ';')
+	e.maybeFlush()
+}
+
+// legacyUnstructuredHash returns the hash evaluated, before HashVersion 2, from the textual
+// rendering of resource. It is only used to migrate hashes persisted in ResourceSummary status
+// (see matchesLegacyHash) and must never change.
+func legacyUnstructuredHash(u *unstructured.Unstructured) []byte {
+	h := sha256.New()
+	var config string
+
+	if hashMode != SpecHashMode {
+		labels := u.GetLabels()
+		if labels != nil {
+			config += render.AsCode(labels)
+		}
+
+		if u.GroupVersionKind().Kind != "ConfigMap" {
+			annotations := u.GetAnnotations()
+			if annotations != nil {
+				config += render.AsCode(annotations)
+			}
+		}
+	}
+
+	content := u.UnstructuredContent()
+	sortedKeys := getSortedKeys(content)
+
+	for _, k := range sortedKeys {
+		if k != "metadata" && k != "status" {
+			config += render.AsCode(dump.ForHash(content[k]))
+		}
+	}
+
+	h.Write([]byte(config))
+	return h.Sum(nil)
+}
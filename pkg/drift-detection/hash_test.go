@@ -0,0 +1,519 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/gdexlab/go-render/render"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/dump"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+var _ = Describe("Hash", func() {
+	var u *unstructured.Unstructured
+
+	BeforeEach(func() {
+		u = &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata": map[string]interface{}{
+					"name":            randomString(),
+					"namespace":       randomString(),
+					"resourceVersion": "1",
+					"labels":          map[string]interface{}{"app": "nginx", "tier": "frontend"},
+				},
+				"spec": map[string]interface{}{
+					"replicas": int64(3),
+					"template": map[string]interface{}{
+						"spec": map[string]interface{}{
+							"containers": []interface{}{
+								map[string]interface{}{"name": "nginx", "image": "nginx:1.25"},
+							},
+						},
+					},
+				},
+				"status": map[string]interface{}{
+					"readyReplicas": int64(3),
+				},
+			},
+		}
+	})
+
+	It("unstructuredHash is stable and ignores metadata (but labels) and status", func() {
+		hash := driftdetection.Hash(u)
+		Expect(driftdetection.Hash(u.DeepCopy())).To(Equal(hash))
+
+		u.SetResourceVersion("2")
+		Expect(unstructured.SetNestedField(u.Object, int64(1), "status", "readyReplicas")).To(Succeed())
+		Expect(driftdetection.Hash(u)).To(Equal(hash))
+	})
+
+	It("unstructuredHash detects spec and labels changes", func() {
+		hash := driftdetection.Hash(u)
+
+		modified := u.DeepCopy()
+		Expect(unstructured.SetNestedField(modified.Object, int64(4), "spec", "replicas")).To(Succeed())
+		Expect(driftdetection.Hash(modified)).ToNot(Equal(hash))
+
+		modified = u.DeepCopy()
+		modified.SetLabels(map[string]string{"app": "nginx"})
+		Expect(driftdetection.Hash(modified)).ToNot(Equal(hash))
+	})
+
+	It("unstructuredHash ignores excluded fields", func() {
+		Expect(driftdetection.SetFieldExclusions([]driftdetection.FieldExclusion{
+			{Group: "apps", Kind: "Deployment", JSONPointers: []string{"/spec/replicas"}},
+			{Group: "*", Kind: "*", ManagedFieldsManagers: []string{"image-updater"}},
+		})).To(Succeed())
+		defer func() {
+			Expect(driftdetection.SetFieldExclusions(nil)).To(Succeed())
+		}()
+
+		u.SetManagedFields([]metav1.ManagedFieldsEntry{{
+			Manager: "image-updater",
+			FieldsV1: &metav1.FieldsV1{
+				Raw: []byte(`{"f:spec":{"f:template":{"f:spec":{"f:containers":{"k:{\"name\":\"nginx\"}":{"f:image":{}}}}}}}`),
+			},
+		}})
+		hash := driftdetection.Hash(u)
+
+		modified := u.DeepCopy()
+		Expect(unstructured.SetNestedField(modified.Object, int64(5), "spec", "replicas")).To(Succeed())
+		containers := []interface{}{map[string]interface{}{"name": "nginx", "image": "nginx:1.26"}}
+		Expect(unstructured.SetNestedSlice(modified.Object, containers, "spec", "template", "spec", "containers")).To(Succeed())
+		Expect(driftdetection.Hash(modified)).To(Equal(hash))
+		// Resource hashed is not modified
+		Expect(modified.Object["spec"].(map[string]interface{})["replicas"]).To(Equal(int64(5)))
+
+		// Fields not excluded are still considered
+		containers = []interface{}{map[string]interface{}{"name": "nginx", "image": "nginx:1.26", "command": "sh"}}
+		Expect(unstructured.SetNestedSlice(modified.Object, containers, "spec", "template", "spec", "containers")).To(Succeed())
+		Expect(driftdetection.Hash(modified)).ToNot(Equal(hash))
+
+		Expect(driftdetection.SetFieldExclusions([]driftdetection.FieldExclusion{
+			{Kind: "Deployment", JSONPointers: []string{"spec/replicas"}},
+		})).ToNot(Succeed())
+	})
+
+	It("field exclusions are parsed once, when set", func() {
+		Expect(driftdetection.SetFieldExclusions([]driftdetection.FieldExclusion{
+			{Group: "apps", Kind: "Deployment", JSONPointers: []string{"/spec/replicas", "/metadata/annotations/example.com~1owner"}},
+		})).To(Succeed())
+		defer func() {
+			Expect(driftdetection.SetFieldExclusions(nil)).To(Succeed())
+		}()
+
+		pointers := driftdetection.GetFieldExclusionPointers()
+		Expect(pointers).To(Equal([][]string{{"spec", "replicas"}, {"metadata", "annotations", "example.com/owner"}}))
+
+		// Hashing uses parsed pointers as they are
+		for i := 0; i < 3; i++ {
+			driftdetection.Hash(u)
+		}
+		Expect(&driftdetection.GetFieldExclusionPointers()[0][0]).To(BeIdenticalTo(&pointers[0][0]))
+	})
+
+	It("unstructuredHash ignores fields owned by Terraform with Terraform field exclusion", func() {
+		Expect(driftdetection.SetFieldExclusions([]driftdetection.FieldExclusion{
+			driftdetection.TerraformFieldExclusion(),
+		})).To(Succeed())
+		defer func() {
+			Expect(driftdetection.SetFieldExclusions(nil)).To(Succeed())
+		}()
+
+		u.SetManagedFields([]metav1.ManagedFieldsEntry{{
+			Manager:  "Terraform",
+			FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{}}}`)},
+		}})
+		hash := driftdetection.Hash(u)
+
+		modified := u.DeepCopy()
+		Expect(unstructured.SetNestedField(modified.Object, int64(7), "spec", "replicas")).To(Succeed())
+		Expect(driftdetection.Hash(modified)).To(Equal(hash))
+
+		Expect(unstructured.SetNestedField(modified.Object, "Recreate", "spec", "strategy", "type")).To(Succeed())
+		Expect(driftdetection.Hash(modified)).ToNot(Equal(hash))
+	})
+
+	It("unstructuredHash ignores fields and annotations populated by Crossplane", func() {
+		claim := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "database.example.org/v1alpha1",
+				"kind":       "PostgreSQLInstance",
+				"metadata": map[string]interface{}{
+					"name":      randomString(),
+					"namespace": randomString(),
+				},
+				"spec": map[string]interface{}{
+					"parameters":          map[string]interface{}{"storageGB": int64(20)},
+					"compositionSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"provider": "aws"}},
+				},
+			},
+		}
+		hash := driftdetection.Hash(claim)
+
+		bound := claim.DeepCopy()
+		Expect(unstructured.SetNestedField(bound.Object, "postgres-a1b2c", "spec", "resourceRef", "name")).To(Succeed())
+		Expect(unstructured.SetNestedField(bound.Object, "aws", "spec", "compositionRef", "name")).To(Succeed())
+		Expect(unstructured.SetNestedField(bound.Object, "aws-1", "spec", "compositionRevisionRef", "name")).To(Succeed())
+		bound.SetAnnotations(map[string]string{"crossplane.io/external-name": "postgres-a1b2c"})
+		original := bound.DeepCopy()
+		Expect(driftdetection.Hash(bound)).To(Equal(hash))
+		// Populated fields are only removed from what is hashed
+		Expect(bound).To(Equal(original))
+
+		// Fields set by users are still considered
+		Expect(unstructured.SetNestedField(bound.Object, int64(50), "spec", "parameters", "storageGB")).To(Succeed())
+		Expect(driftdetection.Hash(bound)).ToNot(Equal(hash))
+
+		driftdetection.SetCrossplaneAware(false)
+		defer driftdetection.SetCrossplaneAware(true)
+		Expect(unstructured.SetNestedField(bound.Object, int64(20), "spec", "parameters", "storageGB")).To(Succeed())
+		Expect(driftdetection.Hash(bound)).ToNot(Equal(driftdetection.Hash(claim)))
+	})
+
+	It("unstructuredHash ignores labels Velero sets on restored resources", func() {
+		hash := driftdetection.Hash(u)
+
+		restored := u.DeepCopy()
+		restoredLabels := restored.GetLabels()
+		restoredLabels["velero.io/backup-name"] = "nightly-20240601"
+		restoredLabels["velero.io/restore-name"] = "nightly-20240601-restore"
+		restored.SetLabels(restoredLabels)
+		Expect(driftdetection.Hash(restored)).To(Equal(hash))
+
+		// Resources with no label hash the same once restored
+		u.SetLabels(nil)
+		hash = driftdetection.Hash(u)
+		restored = u.DeepCopy()
+		restored.SetLabels(map[string]string{"velero.io/restore-name": "nightly-20240601-restore"})
+		Expect(driftdetection.Hash(restored)).To(Equal(hash))
+
+		restored.SetLabels(map[string]string{"velero.io/restore-name": "nightly-20240601-restore", "app": "nginx"})
+		Expect(driftdetection.Hash(restored)).ToNot(Equal(hash))
+	})
+
+	It("unstructuredHash ignores service mesh sidecars injected into pod templates", func() {
+		hash := driftdetection.Hash(u)
+
+		injected := u.DeepCopy()
+		Expect(unstructured.SetNestedStringMap(injected.Object,
+			map[string]string{"sidecar.istio.io/status": `{"containers":["istio-proxy"]}`},
+			"spec", "template", "metadata", "annotations")).To(Succeed())
+		Expect(unstructured.SetNestedSlice(injected.Object, []interface{}{
+			map[string]interface{}{"name": "nginx", "image": "nginx:1.25"},
+			map[string]interface{}{"name": "istio-proxy", "image": "istio/proxyv2:1.22.0"},
+		}, "spec", "template", "spec", "containers")).To(Succeed())
+		Expect(unstructured.SetNestedSlice(injected.Object, []interface{}{
+			map[string]interface{}{"name": "istio-init", "image": "istio/proxyv2:1.22.0"},
+		}, "spec", "template", "spec", "initContainers")).To(Succeed())
+		Expect(unstructured.SetNestedSlice(injected.Object, []interface{}{
+			map[string]interface{}{"name": "istio-envoy", "emptyDir": map[string]interface{}{}},
+		}, "spec", "template", "spec", "volumes")).To(Succeed())
+		Expect(driftdetection.Hash(injected)).To(Equal(hash))
+		// Resource hashed is not modified
+		containers, _, _ := unstructured.NestedSlice(injected.Object, "spec", "template", "spec", "containers")
+		Expect(containers).To(HaveLen(2))
+
+		// Other containers are still considered
+		Expect(unstructured.SetNestedSlice(injected.Object, []interface{}{
+			map[string]interface{}{"name": "nginx", "image": "nginx:1.25"},
+			map[string]interface{}{"name": "debug", "image": "busybox"},
+		}, "spec", "template", "spec", "containers")).To(Succeed())
+		Expect(driftdetection.Hash(injected)).ToNot(Equal(hash))
+
+		driftdetection.SetSidecarNormalization(false)
+		defer driftdetection.SetSidecarNormalization(true)
+		Expect(unstructured.SetNestedSlice(injected.Object, containers,
+			"spec", "template", "spec", "containers")).To(Succeed())
+		Expect(driftdetection.Hash(injected)).ToNot(Equal(hash))
+	})
+
+	It("NormalizationFingerprint changes with normalization settings", func() {
+		fingerprint := driftdetection.NormalizationFingerprint()
+		Expect(driftdetection.NormalizationFingerprint()).To(Equal(fingerprint))
+
+		driftdetection.SetSidecarNormalization(false)
+		Expect(driftdetection.NormalizationFingerprint()).ToNot(Equal(fingerprint))
+		driftdetection.SetSidecarNormalization(true)
+		Expect(driftdetection.NormalizationFingerprint()).To(Equal(fingerprint))
+
+		Expect(driftdetection.SetFieldExclusions([]driftdetection.FieldExclusion{
+			{Kind: "ConfigMap", JSONPointers: []string{"/data/key"}},
+		})).To(Succeed())
+		defer func() {
+			Expect(driftdetection.SetFieldExclusions(nil)).To(Succeed())
+		}()
+		Expect(driftdetection.NormalizationFingerprint()).ToNot(Equal(fingerprint))
+	})
+
+	It("unstructuredHash ignores data cert-manager rotates in Certificate Secrets", func() {
+		secret := &unstructured.Unstructured{}
+		secret.SetAPIVersion("v1")
+		secret.SetKind("Secret")
+		secret.SetNamespace(randomString())
+		secret.SetName(randomString())
+		secret.SetAnnotations(map[string]string{"cert-manager.io/certificate-name": "web"})
+		Expect(unstructured.SetNestedStringMap(secret.Object, map[string]string{
+			"tls.crt": "Y2VydC0x", "tls.key": "a2V5LTE=", "extra": "ZXh0cmE=",
+		}, "data")).To(Succeed())
+		hash := driftdetection.Hash(secret)
+
+		renewed := secret.DeepCopy()
+		Expect(unstructured.SetNestedField(renewed.Object, "Y2VydC0y", "data", "tls.crt")).To(Succeed())
+		Expect(unstructured.SetNestedField(renewed.Object, "a2V5LTI=", "data", "tls.key")).To(Succeed())
+		Expect(driftdetection.Hash(renewed)).To(Equal(hash))
+
+		// Non rotating keys and owning Certificate are still considered
+		modified := renewed.DeepCopy()
+		Expect(unstructured.SetNestedField(modified.Object, "bW9kaWZpZWQ=", "data", "extra")).To(Succeed())
+		Expect(driftdetection.Hash(modified)).ToNot(Equal(hash))
+		modified = renewed.DeepCopy()
+		modified.SetAnnotations(map[string]string{"cert-manager.io/certificate-name": "api"})
+		Expect(driftdetection.Hash(modified)).ToNot(Equal(hash))
+
+		driftdetection.SetCertManagerRotation(false)
+		defer driftdetection.SetCertManagerRotation(true)
+		Expect(driftdetection.Hash(renewed)).ToNot(Equal(driftdetection.Hash(secret)))
+	})
+
+	It("unstructuredHash ignores data External Secrets Operator refreshes", func() {
+		driftdetection.SetExternalSecretsAware(true)
+		defer driftdetection.SetExternalSecretsAware(false)
+
+		secret := &unstructured.Unstructured{}
+		secret.SetAPIVersion("v1")
+		secret.SetKind("Secret")
+		secret.SetNamespace(randomString())
+		secret.SetName(randomString())
+		secret.SetOwnerReferences([]metav1.OwnerReference{
+			{APIVersion: "external-secrets.io/v1beta1", Kind: "ExternalSecret", Name: "db", UID: "uid"},
+		})
+		secret.SetAnnotations(map[string]string{"reconcile.external-secrets.io/data-hash": "1"})
+		secret.SetManagedFields([]metav1.ManagedFieldsEntry{{
+			Manager:  "external-secrets",
+			FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:data":{"f:password":{}}}`)},
+		}})
+		Expect(unstructured.SetNestedStringMap(secret.Object, map[string]string{
+			"password": "cGFzc3dvcmQtMQ==", "extra": "ZXh0cmE=",
+		}, "data")).To(Succeed())
+		hash := driftdetection.Hash(secret)
+
+		refreshed := secret.DeepCopy()
+		refreshed.SetAnnotations(map[string]string{"reconcile.external-secrets.io/data-hash": "2"})
+		Expect(unstructured.SetNestedField(refreshed.Object, "cGFzc3dvcmQtMg==", "data", "password")).To(Succeed())
+		original := refreshed.DeepCopy()
+		Expect(driftdetection.Hash(refreshed)).To(Equal(hash))
+		// Refreshed fields are only removed from what is hashed
+		Expect(refreshed).To(Equal(original))
+
+		// Without fields owned by ESO, only the data digest annotation is ignored
+		unmanaged := secret.DeepCopy()
+		unmanaged.SetManagedFields(nil)
+		unmanagedHash := driftdetection.Hash(unmanaged)
+		unmanaged.SetAnnotations(map[string]string{"reconcile.external-secrets.io/data-hash": "2"})
+		original = unmanaged.DeepCopy()
+		Expect(driftdetection.Hash(unmanaged)).To(Equal(unmanagedHash))
+		Expect(unmanaged).To(Equal(original))
+		Expect(unstructured.SetNestedField(unmanaged.Object, "cGFzc3dvcmQtMg==", "data", "password")).To(Succeed())
+		Expect(driftdetection.Hash(unmanaged)).ToNot(Equal(unmanagedHash))
+
+		// Manual edits take ownership of the edited fields
+		edited := refreshed.DeepCopy()
+		edited.SetManagedFields([]metav1.ManagedFieldsEntry{{
+			Manager:  "kubectl-edit",
+			FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:data":{"f:password":{}}}`)},
+		}})
+		Expect(unstructured.SetNestedField(edited.Object, "bWFudWFs", "data", "password")).To(Succeed())
+		Expect(driftdetection.Hash(edited)).ToNot(Equal(hash))
+
+		// Managing ExternalSecret is still considered
+		reowned := refreshed.DeepCopy()
+		reowned.SetOwnerReferences([]metav1.OwnerReference{
+			{APIVersion: "external-secrets.io/v1beta1", Kind: "ExternalSecret", Name: "other", UID: "uid"},
+		})
+		Expect(driftdetection.Hash(reowned)).ToNot(Equal(hash))
+		disowned := refreshed.DeepCopy()
+		disowned.SetOwnerReferences(nil)
+		Expect(driftdetection.Hash(disowned)).ToNot(Equal(hash))
+
+		driftdetection.SetExternalSecretsAware(false)
+		Expect(driftdetection.Hash(refreshed)).ToNot(Equal(driftdetection.Hash(secret)))
+	})
+
+	It("legacyUnstructuredHash is the hash evaluated before HashVersion 2", func() {
+		legacy := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		legacy.SetLabels(map[string]string{"app": "nginx"})
+		legacy.SetAnnotations(map[string]string{"team": "web"})
+		Expect(hex.EncodeToString(driftdetection.LegacyHash(legacy))).To(
+			Equal("4111ca710402537d938dbe8edce7eac01858305af1cce0402642220d8e6a4069"))
+
+		config := render.AsCode(u.GetLabels())
+		for _, k := range []string{"apiVersion", "kind", "spec"} {
+			config += render.AsCode(dump.ForHash(u.Object[k]))
+		}
+		expected := sha256.Sum256([]byte(config))
+		Expect(driftdetection.LegacyHash(u)).To(Equal(expected[:]))
+		Expect(driftdetection.Hash(u)).ToNot(Equal(expected[:]))
+	})
+
+	It("unstructuredHash ignores annotations kapp rewrites on each deploy", func() {
+		u.SetAnnotations(map[string]string{"kapp.k14s.io/nonce": "1700000000", "team": "web"})
+		hash := driftdetection.Hash(u)
+
+		modified := u.DeepCopy()
+		modified.SetAnnotations(map[string]string{"kapp.k14s.io/nonce": "1700000042",
+			"kapp.k14s.io/original": "{}", "team": "web"})
+		Expect(driftdetection.Hash(modified)).To(Equal(hash))
+		Expect(modified.GetAnnotations()).To(HaveKey("kapp.k14s.io/nonce"))
+
+		modified.SetAnnotations(map[string]string{"kapp.k14s.io/nonce": "1700000042", "team": "api"})
+		Expect(driftdetection.Hash(modified)).ToNot(Equal(hash))
+	})
+
+	It("compact hash accepts both raw and hex encoded hashes", func() {
+		hash := driftdetection.Hash(u)
+		compact := driftdetection.NewCompactHash(hash)
+		Expect(driftdetection.NewCompactHash([]byte(fmt.Sprintf("%x", hash)))).To(Equal(compact))
+		Expect(driftdetection.NewCompactHash([]byte(randomString()))).ToNot(Equal(compact))
+		Expect(driftdetection.NewCompactHash(nil)).ToNot(Equal(compact))
+	})
+
+	It("unstructuredHash hashes large ConfigMaps incrementally and reports changed keys", func() {
+		driftdetection.SetIncrementalHashThreshold(1)
+		defer driftdetection.SetIncrementalHashThreshold(1024 * 1024)
+
+		configMap := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata": map[string]interface{}{
+					"name":      randomString(),
+					"namespace": randomString(),
+				},
+				"data": map[string]interface{}{
+					"first":  randomString(),
+					"second": randomString(),
+				},
+			},
+		}
+
+		manager := driftdetection.NewTrackingManager()
+		resourceRef := &corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1",
+			Namespace: configMap.GetNamespace(), Name: configMap.GetName()}
+		manager.AddResource(resourceRef, &corev1.ObjectReference{Name: randomString()})
+
+		hash, _ := driftdetection.UnstructuredHashWithChangedKeys(manager, configMap)
+
+		currentHash, changedKeys := driftdetection.UnstructuredHashWithChangedKeys(manager, configMap.DeepCopy())
+		Expect(currentHash).To(Equal(hash))
+		Expect(changedKeys).To(BeEmpty())
+
+		Expect(unstructured.SetNestedField(configMap.Object, randomString(), "data", "second")).To(Succeed())
+		currentHash, changedKeys = driftdetection.UnstructuredHashWithChangedKeys(manager, configMap)
+		Expect(currentHash).ToNot(Equal(hash))
+		Expect(changedKeys).To(Equal([]string{"data/second"}))
+
+		unstructured.RemoveNestedField(configMap.Object, "data", "first")
+		_, changedKeys = driftdetection.UnstructuredHashWithChangedKeys(manager, configMap)
+		Expect(changedKeys).To(Equal([]string{"data/first"}))
+	})
+
+	It("unstructuredHash of ConfigMaps does not depend on data size nor on checksums", func() {
+		configMap := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata": map[string]interface{}{
+					"name":      randomString(),
+					"namespace": randomString(),
+				},
+				"data": map[string]interface{}{
+					"key": "hhhhhhhhhhhhhhhhhhhhhhhhhhhhhhhh",
+				},
+			},
+		}
+
+		manager := driftdetection.NewTrackingManager()
+		resourceRef := &corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1",
+			Namespace: configMap.GetNamespace(), Name: configMap.GetName()}
+		manager.AddResource(resourceRef, &corev1.ObjectReference{Name: randomString()})
+
+		hash := driftdetection.UnstructuredHash(manager, configMap)
+
+		// Same hash whether data is above incremental threshold or not
+		driftdetection.SetIncrementalHashThreshold(1)
+		defer driftdetection.SetIncrementalHashThreshold(1024 * 1024)
+		Expect(driftdetection.UnstructuredHash(manager, configMap)).To(Equal(hash))
+
+		// Value with same length and CRC-64 (ECMA) checksum is a different value
+		Expect(unstructured.SetNestedField(configMap.Object, "`gcmolcnnogkh`behhhhhhhhhhhhhhhh",
+			"data", "key")).To(Succeed())
+		currentHash, changedKeys := driftdetection.UnstructuredHashWithChangedKeys(manager, configMap)
+		Expect(currentHash).ToNot(Equal(hash))
+		Expect(changedKeys).To(Equal([]string{"data/key"}))
+	})
+
+	It("RedactObject never exposes Secret values", func() {
+		secret := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"metadata": map[string]interface{}{
+					"name":        randomString(),
+					"namespace":   randomString(),
+					"annotations": map[string]interface{}{"kubectl.kubernetes.io/last-applied-configuration": "password"},
+				},
+				"data":       map[string]interface{}{"password": "cGFzc3dvcmQ=", "user": "YWRtaW4="},
+				"stringData": map[string]interface{}{"token": "password"},
+			},
+		}
+
+		redacted := driftdetection.RedactObject(secret)
+		data, _, _ := unstructured.NestedStringMap(redacted.Object, "data")
+		Expect(data).To(HaveKey("password"))
+		Expect(data["password"]).ToNot(Equal("cGFzc3dvcmQ="))
+		Expect(data["password"]).ToNot(Equal(data["user"]))
+		stringData, _, _ := unstructured.NestedStringMap(redacted.Object, "stringData")
+		Expect(stringData["token"]).ToNot(Equal("password"))
+		Expect(redacted.GetAnnotations()["kubectl.kubernetes.io/last-applied-configuration"]).ToNot(Equal("password"))
+
+		// original object is left untouched
+		Expect(secret.Object["data"]).To(HaveKeyWithValue("password", "cGFzc3dvcmQ="))
+
+		// other objects are not redacted
+		Expect(driftdetection.RedactObject(u)).To(Equal(u))
+
+		hash := []byte{1, 2, 3}
+		secretRef := &corev1.ObjectReference{APIVersion: "v1", Kind: "Secret"}
+		Expect(driftdetection.ExposedHash(secretRef, hash)).ToNot(Equal("010203"))
+		configMapRef := &corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap"}
+		Expect(driftdetection.ExposedHash(configMapRef, hash)).To(Equal("010203"))
+	})
+})
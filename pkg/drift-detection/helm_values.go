@@ -0,0 +1,376 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// Helm records each revision of a release in a Secret (sh.helm.release.v1.<release>.v<revision>)
+// containing, among others, the values the release was installed or upgraded with.
+// A manual `helm upgrade --set` creates a new revision with different values, even when the
+// rendered resources are similar (or not tracked at all). Values of the deployed revision are
+// compared against the values of the revision Sveltos deployed: a difference is reported as a
+// values drift, distinct from drifts of the deployed resources.
+// Only the default Helm storage driver (Secrets) is supported.
+
+const (
+	// helmReleaseKey is the key of the release Secret containing the release
+	helmReleaseKey = "release"
+
+	// helmDeployedStatus is the status label of the release Secret of the deployed revision
+	helmDeployedStatus = "deployed"
+)
+
+var (
+	// gzipMagic is the header of gzip compressed content. Helm compresses releases since v3.
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+)
+
+// helmValuesKey identifies a Helm release deployed because of a ResourceSummary
+type helmValuesKey struct {
+	resourceSummary  corev1.ObjectReference
+	releaseNamespace string
+	releaseName      string
+}
+
+// helmValuesBaseline contains the values a Helm release was deployed with by Sveltos
+type helmValuesBaseline struct {
+	// generation is the ResourceSummary generation baseline was taken at
+	generation int64
+
+	// digest is the digest of the values Sveltos deployed the release with
+	digest []byte
+
+	// revision is the last revision evaluated
+	revision int
+
+	// reportedRevision, when not zero, is the revision last reported as values drift
+	reportedRevision int
+}
+
+// helmReleaseValues contains the values of a Helm release revision
+type helmReleaseValues struct {
+	// secret is the release Secret of the revision
+	secret corev1.ObjectReference
+
+	revision int
+
+	// digest is the digest of the values revision was installed or upgraded with
+	digest []byte
+}
+
+// helmValuesTracker contains the baselines of all Helm releases whose values are tracked
+type helmValuesTracker struct {
+	mu        sync.Mutex
+	baselines map[helmValuesKey]*helmValuesBaseline
+}
+
+// evaluate returns true if current, the deployed revision, is a values drift not reported yet
+func (b *helmValuesBaseline) evaluate(current *helmReleaseValues) bool {
+	if current.revision == b.revision {
+		return false
+	}
+	b.revision = current.revision
+
+	if bytes.Equal(current.digest, b.digest) {
+		// Values are back to the ones Sveltos deployed release with
+		b.reportedRevision = 0
+		return false
+	}
+	if current.revision == b.reportedRevision {
+		return false
+	}
+	b.reportedRevision = current.revision
+	return true
+}
+
+// TrackHelmValues requests manager to track values of the Helm releases listed in
+// resourceSummary. Values of each release are taken as baseline when release is first tracked,
+// when resourceSummary generation changes (Sveltos deployed again) and when Sveltos reconciled
+// resourceSummary after a values drift was reported.
+// Does nothing unless values drift detection is enabled (see SetHelmValuesInterval).
+func (m *manager) TrackHelmValues(ctx context.Context, requestor *corev1.ObjectReference,
+	resourceSummary *libsveltosv1alpha1.ResourceSummary) {
+
+	if helmValuesInterval == 0 {
+		return
+	}
+
+	desired := make(map[helmValuesKey]bool)
+	if !IsSectionDisabled(HelmSection) {
+		for i := range resourceSummary.Spec.ChartResources {
+			chart := &resourceSummary.Spec.ChartResources[i]
+			if IsNamespaceExcluded(chart.ReleaseNamespace) {
+				continue
+			}
+			desired[helmValuesKey{resourceSummary: *requestor, releaseNamespace: chart.ReleaseNamespace,
+				releaseName: chart.ReleaseName}] = true
+		}
+	}
+
+	rebaseline := m.updateHelmValuesKeys(requestor, desired, resourceSummary)
+
+	for i := range rebaseline {
+		logger := m.log.WithValues("release", fmt.Sprintf("%s/%s", rebaseline[i].releaseNamespace,
+			rebaseline[i].releaseName))
+		current, err := m.getDeployedHelmRelease(ctx, rebaseline[i].releaseNamespace, rebaseline[i].releaseName)
+		if err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to get helm release values: %v", err))
+			continue
+		}
+		if current == nil {
+			logger.V(logs.LogDebug).Info("no deployed helm release")
+			continue
+		}
+
+		m.helmValues.mu.Lock()
+		if _, ok := m.helmValues.baselines[rebaseline[i]]; ok {
+			m.helmValues.baselines[rebaseline[i]] = &helmValuesBaseline{generation: resourceSummary.Generation,
+				digest: current.digest, revision: current.revision}
+		}
+		m.helmValues.mu.Unlock()
+	}
+}
+
+// StopTrackingHelmValues requests manager to stop tracking values of the Helm releases listed
+// in ResourceSummary requestor
+func (m *manager) StopTrackingHelmValues(requestor *corev1.ObjectReference) {
+	m.updateHelmValuesKeys(requestor, nil, nil)
+}
+
+// updateHelmValuesKeys sets desired as the Helm releases tracked because of requestor. Returns the
+// releases whose baseline must be taken again.
+func (m *manager) updateHelmValuesKeys(requestor *corev1.ObjectReference, desired map[helmValuesKey]bool,
+	resourceSummary *libsveltosv1alpha1.ResourceSummary) []helmValuesKey {
+
+	m.helmValues.mu.Lock()
+	defer m.helmValues.mu.Unlock()
+
+	if m.helmValues.baselines == nil {
+		m.helmValues.baselines = make(map[helmValuesKey]*helmValuesBaseline)
+	}
+
+	for key := range m.helmValues.baselines {
+		if key.resourceSummary == *requestor && !desired[key] {
+			delete(m.helmValues.baselines, key)
+		}
+	}
+
+	var rebaseline []helmValuesKey
+	for key := range desired {
+		b, ok := m.helmValues.baselines[key]
+		if !ok {
+			// Placeholder till baseline is taken: release is not evaluated meanwhile
+			m.helmValues.baselines[key] = &helmValuesBaseline{generation: resourceSummary.Generation}
+			rebaseline = append(rebaseline, key)
+			continue
+		}
+		if b.digest == nil || b.generation != resourceSummary.Generation ||
+			(b.reportedRevision != 0 && !resourceSummary.Status.HelmResourcesChanged) {
+
+			rebaseline = append(rebaseline, key)
+		}
+	}
+	return rebaseline
+}
+
+// evaluateHelmValues periodically evaluates tracked Helm releases for values drift
+func (m *manager) evaluateHelmValues(ctx context.Context) {
+	if helmValuesInterval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(helmValuesInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !m.initialized.Load() || m.paused.Load() || m.resetting.Load() {
+				continue
+			}
+			m.evaluateHelmValuesOnce(ctx)
+		}
+	}
+}
+
+// evaluateHelmValuesOnce compares values of the deployed revision of each tracked Helm release
+// against its baseline. Values drifts are recorded and ResourceSummaries deploying drifted
+// releases are marked for reconciliation.
+func (m *manager) evaluateHelmValuesOnce(ctx context.Context) {
+	m.helmValues.mu.Lock()
+	keys := make([]helmValuesKey, 0, len(m.helmValues.baselines))
+	for key, b := range m.helmValues.baselines {
+		if b.digest != nil {
+			keys = append(keys, key)
+		}
+	}
+	m.helmValues.mu.Unlock()
+
+	// A release is fetched once, even when deployed because of more than one ResourceSummary
+	type release struct{ namespace, name string }
+	fetched := make(map[release]*helmReleaseValues)
+
+	updates := resourceSummaryUpdates{}
+	for i := range keys {
+		r := release{namespace: keys[i].releaseNamespace, name: keys[i].releaseName}
+		current, ok := fetched[r]
+		if !ok {
+			var err error
+			current, err = m.getDeployedHelmRelease(ctx, r.namespace, r.name)
+			if err != nil {
+				m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to get helm release %s/%s values: %v",
+					r.namespace, r.name, err))
+			}
+			fetched[r] = current
+		}
+		if current == nil {
+			continue
+		}
+
+		m.helmValues.mu.Lock()
+		b, ok := m.helmValues.baselines[keys[i]]
+		drifted := ok && b.digest != nil && b.evaluate(current)
+		m.helmValues.mu.Unlock()
+		if !drifted {
+			continue
+		}
+
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("values of helm release %s/%s (revision %d) drifted",
+			r.namespace, r.name, current.revision))
+		trackHelmValuesDrift()
+		m.recordHelmValuesDriftEvent(&current.secret, &keys[i].resourceSummary)
+		updates.add(&keys[i].resourceSummary, &current.secret, nil, true)
+	}
+
+	if len(updates) != 0 {
+		m.updateResourceSummaries(ctx, updates)
+	}
+}
+
+// getDeployedHelmRelease returns the values of the deployed revision of Helm release. Returns nil
+// if release has no deployed revision.
+func (m *manager) getDeployedHelmRelease(ctx context.Context, namespace, name string,
+) (*helmReleaseValues, error) {
+
+	gvk := corev1.SchemeGroupVersion.WithKind("Secret")
+	dr, err := m.getDynamicResourceInterface(gvk, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.waitForAPIServer(ctx); err != nil {
+		return nil, err
+	}
+
+	selector := labels.Set{"owner": "helm", "name": name, "status": helmDeployedStatus}
+	list, err := dr.List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	m.observeAPIResponse(listVerb, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// While upgrading, more than one revision might briefly be labeled as deployed
+	var latest *unstructured.Unstructured
+	latestRevision := 0
+	for i := range list.Items {
+		revision, err := strconv.Atoi(list.Items[i].GetLabels()["version"])
+		if err != nil {
+			continue
+		}
+		if revision > latestRevision {
+			latest = &list.Items[i]
+			latestRevision = revision
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+
+	encoded, _, _ := unstructured.NestedString(latest.Object, "data", helmReleaseKey)
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid release Secret %s", latest.GetName())
+	}
+	digest, err := getHelmValuesDigest(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid release Secret %s", latest.GetName())
+	}
+
+	return &helmReleaseValues{
+		secret: corev1.ObjectReference{Kind: gvk.Kind, APIVersion: gvk.GroupVersion().String(),
+			Namespace: namespace, Name: latest.GetName()},
+		revision: latestRevision,
+		digest:   digest,
+	}, nil
+}
+
+// getHelmValuesDigest returns the digest of the values (config) of release, as encoded by
+// Helm in release Secrets: base64 encoded, gzip compressed, JSON.
+func getHelmValuesDigest(release []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(string(release))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, gzipMagic) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		data, err = io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var content struct {
+		Config map[string]interface{} `json:"config"`
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	e := getCanonicalEncoder(h)
+	e.writeMap(content.Config)
+	e.release()
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// IgnorePathsAnnotation, set on a ResourceSummary, lists the fields of the resources it tracks
+	// excluded from drift detection, as a YAML (or JSON) list of FieldExclusion, e.g.:
+	//
+	//	- group: apps
+	//	  kind: Deployment
+	//	  name: nginx
+	//	  jsonPointers: [/spec/replicas]
+	//
+	// Unlike field exclusions (see SetFieldExclusions), those only apply to resources tracked
+	// because of that ResourceSummary. A resource tracked because of multiple ResourceSummaries
+	// has a single hash, so only exclusions listed by all of them apply to it. ResourceSummary
+	// spec is defined by libsveltos, hence the annotation.
+	IgnorePathsAnnotation = "projectsveltos.io/drift-ignore-paths"
+)
+
+// ignorePathsTracker contains the field exclusions set on ResourceSummaries (see IgnorePathsAnnotation)
+type ignorePathsTracker struct {
+	mu sync.RWMutex
+	// Key: ResourceSummary
+	exclusions map[types.NamespacedName]*ignorePaths
+}
+
+// ignorePaths are the field exclusions parsed from an IgnorePathsAnnotation value. Exclusions are
+// only parsed again when annotation changes, never when resources are evaluated.
+type ignorePaths struct {
+	annotation string
+	exclusions []fieldExclusion
+}
+
+// SetIgnorePaths sets the fields excluded from drift detection for resources tracked because of
+// resourceSummary, as listed by its IgnorePathsAnnotation. On error, previous exclusions are kept.
+// Hashes depend on excluded fields: when annotation changes, resources tracked because of
+// resourceSummary are hashed again and the new hashes written to the Status of the ResourceSummaries
+// tracking them, so that the change itself is not reported as a drift.
+func (m *manager) SetIgnorePaths(ctx context.Context, resourceSummary *libsveltosv1alpha1.ResourceSummary) error {
+	key := types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name}
+
+	value := resourceSummary.Annotations[IgnorePathsAnnotation]
+	if m.ignorePaths.isCurrent(key, value) {
+		return nil
+	}
+
+	var paths *ignorePaths
+	if value != "" {
+		exclusions, err := ReadFieldExclusions([]byte(value))
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s annotation", IgnorePathsAnnotation)
+		}
+		parsed, err := parseFieldExclusions(exclusions)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s annotation", IgnorePathsAnnotation)
+		}
+		paths = &ignorePaths{annotation: value, exclusions: parsed}
+	}
+
+	// Resources are fetched before exclusions change, so that window in which those are
+	// evaluated with new exclusions against old hashes is as short as possible.
+	tracked := m.fetchTrackedResources(ctx, key)
+	m.ignorePaths.set(key, paths)
+	return m.rehashResources(ctx, tracked)
+}
+
+// fetchTrackedResources fetches resources tracked because of resourceSummary. Resources which
+// cannot be fetched are skipped: those are hashed again on their next evaluation.
+func (m *manager) fetchTrackedResources(ctx context.Context, resourceSummary types.NamespacedName,
+) map[corev1.ObjectReference]*unstructured.Unstructured {
+
+	tracked := make(map[corev1.ObjectReference]*unstructured.Unstructured)
+	for _, sectionConsumers := range []*consumerMap{m.resources, m.helmResources} {
+		for resourceRef, consumers := range sectionConsumers.snapshot() {
+			if _, ok := tracked[resourceRef]; ok || !isConsumer(consumers.Items(), resourceSummary) {
+				continue
+			}
+
+			u, err := m.getUnstructured(ctx, &resourceRef)
+			if err != nil {
+				m.log.V(logs.LogDebug).Info(fmt.Sprintf("failed to fetch %s %s/%s: %v",
+					resourceRef.Kind, resourceRef.Namespace, resourceRef.Name, err))
+				continue
+			}
+			tracked[resourceRef] = u
+		}
+	}
+	return tracked
+}
+
+// rehashResources stores current hash of each resource and writes it to the Status of all
+// ResourceSummaries tracking resource. ResourceSummaries are not marked for reconciliation.
+// Resources no longer tracked, or not hashed yet, are skipped.
+func (m *manager) rehashResources(ctx context.Context,
+	resources map[corev1.ObjectReference]*unstructured.Unstructured) error {
+
+	updates := resourceSummaryUpdates{}
+	for ref, u := range resources {
+		resourceRef := &ref
+		if !m.isHashed(resourceRef) {
+			continue
+		}
+
+		currentHash := m.unstructuredHash(u)
+		m.updateResourceHash(resourceRef, currentHash, getRevision(u))
+
+		consumers := m.getDriftConsumers(resourceRef)
+		for i := range consumers {
+			update, ok := updates[consumers[i]]
+			if !ok {
+				update = &resourceSummaryUpdate{hashes: make(map[corev1.ObjectReference][]byte)}
+				updates[consumers[i]] = update
+			}
+			update.hashes[*resourceRef] = currentHash
+			update.resources = append(update.resources, *resourceRef)
+		}
+	}
+
+	for resourceSummaryRef, update := range updates {
+		if err := m.updateResourceSummaryStatus(ctx, &resourceSummaryRef, update); err != nil {
+			return errors.Wrapf(err, "failed to update hashes of ResourceSummary %s/%s",
+				resourceSummaryRef.Namespace, resourceSummaryRef.Name)
+		}
+	}
+	return nil
+}
+
+func (m *manager) isHashed(resourceRef *corev1.ObjectReference) bool {
+	if !m.stillTrackingResource(resourceRef) {
+		return false
+	}
+
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	_, ok := shard.resourceHashes[*resourceRef]
+	return ok
+}
+
+func isConsumer(consumers []corev1.ObjectReference, resourceSummary types.NamespacedName) bool {
+	for i := range consumers {
+		if consumers[i].Kind == libsveltosv1alpha1.ResourceSummaryKind &&
+			consumers[i].Namespace == resourceSummary.Namespace && consumers[i].Name == resourceSummary.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// ClearIgnorePaths forgets the field exclusions of resourceSummary (see SetIgnorePaths)
+func (m *manager) ClearIgnorePaths(resourceSummary *corev1.ObjectReference) {
+	m.ignorePaths.set(types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name}, nil)
+}
+
+func (t *ignorePathsTracker) set(resourceSummary types.NamespacedName, paths *ignorePaths) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if paths == nil || len(paths.exclusions) == 0 {
+		delete(t.exclusions, resourceSummary)
+		return
+	}
+	if t.exclusions == nil {
+		t.exclusions = make(map[types.NamespacedName]*ignorePaths)
+	}
+	t.exclusions[resourceSummary] = paths
+}
+
+// isCurrent returns true if exclusions of resourceSummary were parsed from annotation
+func (t *ignorePathsTracker) isCurrent(resourceSummary types.NamespacedName, annotation string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	paths, ok := t.exclusions[resourceSummary]
+	if !ok {
+		return annotation == ""
+	}
+	return paths.annotation == annotation
+}
+
+// excludeIgnoredPaths returns u without the fields excluded, by all ResourceSummaries tracking
+// it, with IgnorePathsAnnotation. u is returned unchanged if none applies.
+func (m *manager) excludeIgnoredPaths(u *unstructured.Unstructured) *unstructured.Unstructured {
+	m.ignorePaths.mu.RLock()
+	defer m.ignorePaths.mu.RUnlock()
+
+	if len(m.ignorePaths.exclusions) == 0 {
+		return u
+	}
+
+	resourceRef := &corev1.ObjectReference{APIVersion: u.GetAPIVersion(), Kind: u.GetKind(),
+		Namespace: u.GetNamespace(), Name: u.GetName()}
+	consumers := m.getDriftConsumers(resourceRef)
+	if len(consumers) == 0 {
+		return u
+	}
+
+	var exclusions []fieldExclusion
+	for i := range consumers {
+		key := types.NamespacedName{Namespace: consumers[i].Namespace, Name: consumers[i].Name}
+		paths, ok := m.ignorePaths.exclusions[key]
+		if !ok {
+			return u
+		}
+		if i == 0 {
+			exclusions = paths.exclusions
+			continue
+		}
+		exclusions = commonExclusions(exclusions, paths.exclusions)
+		if len(exclusions) == 0 {
+			return u
+		}
+	}
+	return applyFieldExclusions(u, exclusions)
+}
+
+// commonExclusions returns the exclusions listed in both a and b
+func commonExclusions(a, b []fieldExclusion) []fieldExclusion {
+	var common []fieldExclusion
+	for i := range a {
+		for j := range b {
+			if reflect.DeepEqual(a[i].FieldExclusion, b[j].FieldExclusion) {
+				common = append(common, a[i])
+				break
+			}
+		}
+	}
+	return common
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var (
+	// dataFields are the ConfigMap/Secret fields hashed incrementally
+	dataFields = map[string]bool{"data": true, "binaryData": true}
+)
+
+// keyDigest is the sha256 digest of a single ConfigMap/Secret data key
+type keyDigest [sha256.Size]byte
+
+// isDataObject returns true if u is a ConfigMap or Secret. Data fields of those are always
+// hashed per key: each key is hashed separately and only the per-key digests are combined
+// into the resource hash, so hash does not depend on data size.
+func isDataObject(u *unstructured.Unstructured) bool {
+	return u.GetAPIVersion() == "v1" && (u.GetKind() == "ConfigMap" || u.GetKind() == "Secret")
+}
+
+// isLargeData returns true if u is a ConfigMap or Secret whose data size exceeds
+// incrementalHashThreshold. For those, per-key digests are kept so that changed keys
+// can be reported.
+func isLargeData(u *unstructured.Unstructured) bool {
+	if incrementalHashThreshold == 0 || !isDataObject(u) {
+		return false
+	}
+
+	content := u.UnstructuredContent()
+	size := uint64(0)
+	for field := range dataFields {
+		data, _ := content[field].(map[string]interface{})
+		for _, v := range data {
+			if value, ok := v.(string); ok {
+				size += uint64(len(value))
+			}
+		}
+	}
+
+	return size > incrementalHashThreshold
+}
+
+// writeDataDigests writes to e the per-key digests of data, a ConfigMap/Secret data field.
+// When current is not nil, all digests are stored in it and names of the keys which changed,
+// were added or were removed since previous are appended to changedKeys.
+// Every key is hashed: digests are never reused, as no cheaper check can tell a value is unchanged.
+func writeDataDigests(e *canonicalEncoder, field string, data map[string]interface{},
+	previous, current map[string]keyDigest, changedKeys *[]string) {
+
+	e.writeMapHeader(len(data))
+	for _, k := range getSortedKeys(data) {
+		value, ok := data[k].(string)
+		if !ok {
+			value = fmt.Sprintf("%v", data[k])
+		}
+
+		d := keyDigest(sha256.Sum256(stringBytes(value)))
+		if current != nil {
+			name := field + "/" + k
+			if old, ok := previous[name]; !ok || old != d {
+				*changedKeys = append(*changedKeys, name)
+			}
+			current[name] = d
+		}
+
+		e.writeString(k)
+		e.writeDigest(d[:])
+	}
+	e.endValue()
+
+	if current == nil {
+		return
+	}
+
+	for name := range previous {
+		if _, ok := current[name]; !ok && strings.HasPrefix(name, field+"/") {
+			*changedKeys = append(*changedKeys, name)
+		}
+	}
+}
+
+// getDataDigests returns, for a large ConfigMap/Secret, the per-key digests computed
+// on last evaluation
+func (m *manager) getDataDigests(resourceRef *corev1.ObjectReference) map[string]keyDigest {
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return shard.dataDigests[*resourceRef]
+}
+
+// storeDataDigests stores, for a tracked large ConfigMap/Secret, the per-key digests
+// computed on last evaluation
+func (m *manager) storeDataDigests(resourceRef *corev1.ObjectReference, digests map[string]keyDigest) {
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if m.stillTrackingResource(resourceRef) {
+		shard.dataDigests[*resourceRef] = digests
+	}
+}
+
+// stringBytes returns the bytes of s without copying them. Returned slice must not be modified.
+func stringBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
+)
+
+// StatePath is the path, on the diagnostics endpoint, serving manager State
+const StatePath = "/debug/state"
+
+// Watcher modes reported in WatcherState
+const (
+	WatchMode   = "watch"
+	PollingMode = "polling"
+	PendingMode = "pending"
+	StoppedMode = "stopped"
+)
+
+// State is a point in time view of drift detection internal state, used for troubleshooting
+type State struct {
+	// Resources contains all tracked resources
+	Resources []ResourceState `json:"resources"`
+
+	// Watchers contains, per GVK, the state of its watcher
+	Watchers []WatcherState `json:"watchers"`
+
+	// Queue contains the resources waiting to be evaluated
+	Queue []QueuedResource `json:"queue"`
+}
+
+// ResourceState is the state of a tracked resource
+type ResourceState struct {
+	Resource corev1.ObjectReference `json:"resource"`
+
+	// Hash is the hex encoded hash resource is compared against (a keyed digest of it for Secrets,
+	// see exposedHash). Empty if resource does not exist.
+	Hash string `json:"hash,omitempty"`
+
+	// ResourceVersion is the resourceVersion hash was evaluated from
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+
+	// Consumers contains the ResourceSummaries tracking resource
+	Consumers []corev1.ObjectReference `json:"consumers,omitempty"`
+
+	// HelmConsumers contains the ResourceSummaries tracking resource as a helm resource
+	HelmConsumers []corev1.ObjectReference `json:"helmConsumers,omitempty"`
+}
+
+// WatcherState is the state of the watcher of a GVK
+type WatcherState struct {
+	GroupVersionKind schema.GroupVersionKind `json:"gvk"`
+
+	// Mode is one of watch, polling, pending (watcher starts once internal state is rebuilt)
+	// or stopped
+	Mode string `json:"mode"`
+
+	// Synced is set once watcher has synced its cache
+	Synced bool `json:"synced"`
+
+	// CachedObjects is the number of objects cached by watcher
+	CachedObjects int `json:"cachedObjects"`
+
+	// TrackedResources is the number of tracked resources of the GVK
+	TrackedResources int `json:"trackedResources"`
+}
+
+// QueuedResource is a resource waiting to be evaluated
+type QueuedResource struct {
+	Resource corev1.ObjectReference `json:"resource"`
+	QueuedAt time.Time              `json:"queuedAt,omitempty"`
+}
+
+// GetState returns a point in time view of internal state. Resources, watchers and queue
+// are read separately, so they might be slightly inconsistent with each other.
+func (m *manager) GetState() *State {
+	state := &State{}
+
+	resources := m.resources.snapshot()
+	helmResources := m.helmResources.snapshot()
+
+	m.rangeShards(func(gvk schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+
+		tracked := shard.resources.Items()
+		if len(tracked) == 0 && shard.informers == nil {
+			return
+		}
+
+		state.Watchers = append(state.Watchers, getWatcherState(gvk, shard, len(tracked)))
+
+		for i := range tracked {
+			resourceState := ResourceState{
+				Resource:        tracked[i],
+				ResourceVersion: shard.evaluatedRevisions[tracked[i]].resourceVersion,
+				Consumers:       getConsumers(resources, &tracked[i]),
+				HelmConsumers:   getConsumers(helmResources, &tracked[i]),
+			}
+			resourceState.Hash = exposedHash(&tracked[i], shard.resourceHashes[tracked[i]].bytes())
+			state.Resources = append(state.Resources, resourceState)
+		}
+	})
+
+	m.mu.RLock()
+	queued := m.jobQueue.Items()
+	for i := range queued {
+		state.Queue = append(state.Queue, QueuedResource{Resource: queued[i], QueuedAt: m.queuedAt[queued[i]]})
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(state.Resources, func(i, j int) bool {
+		return lessObjectRef(&state.Resources[i].Resource, &state.Resources[j].Resource)
+	})
+	sort.Slice(state.Watchers, func(i, j int) bool {
+		return state.Watchers[i].GroupVersionKind.String() < state.Watchers[j].GroupVersionKind.String()
+	})
+	sort.Slice(state.Queue, func(i, j int) bool {
+		return state.Queue[i].QueuedAt.Before(state.Queue[j].QueuedAt)
+	})
+
+	return state
+}
+
+// getWatcherState returns the state of the watcher of gvk. Shard lock must be held.
+func getWatcherState(gvk schema.GroupVersionKind, shard *gvkShard, trackedResources int) WatcherState {
+	watcherState := WatcherState{GroupVersionKind: gvk, TrackedResources: trackedResources}
+	switch {
+	case shard.polled:
+		watcherState.Mode = PollingMode
+	case shard.pendingWatcher:
+		watcherState.Mode = PendingMode
+	case shard.informers != nil:
+		watcherState.Mode = WatchMode
+		watcherState.Synced = shard.informers.hasSynced()
+		watcherState.CachedObjects = shard.informers.size()
+	default:
+		watcherState.Mode = StoppedMode
+	}
+	return watcherState
+}
+
+func getConsumers(consumers map[corev1.ObjectReference]*libsveltosset.Set,
+	resourceRef *corev1.ObjectReference) []corev1.ObjectReference {
+
+	if set, ok := consumers[*resourceRef]; ok {
+		return set.Items()
+	}
+	return nil
+}
+
+func lessObjectRef(a, b *corev1.ObjectReference) bool {
+	if a.APIVersion != b.APIVersion {
+		return a.APIVersion < b.APIVersion
+	}
+	if a.Kind != b.Kind {
+		return a.Kind < b.Kind
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+// StateHandler returns an handler serving, in JSON format, manager State.
+// Must only be served behind authentication/authorization: State contains names
+// and hashes of all tracked resources.
+func StateHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		m, err := GetManager()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(m.GetState()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
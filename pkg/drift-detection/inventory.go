@@ -0,0 +1,185 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// Kustomize based appliers (kpt, cli-utils) and Flux keep an inventory of the resources they
+// applied, and prune resources once removed from it. A tracked resource deleted after being
+// removed from its inventory was intentionally pruned: it is recorded as such (see
+// DriftEvent.PrunedBy) instead of being reported as a configuration drift.
+// Supported inventories are:
+//   - Flux Kustomizations (status.inventory), for resources labeled by Flux kustomize-controller;
+//   - cli-utils inventory ConfigMaps, for resources annotated with config.k8s.io/owning-inventory.
+// Appliers update inventories after pruning, so a deletion might be evaluated while the resource
+// is still listed: drift confirmations (see RuntimeSettings) should span the time this takes.
+
+const (
+	// owningInventoryAnnotation contains the ID of the cli-utils inventory listing a resource
+	owningInventoryAnnotation = "config.k8s.io/owning-inventory"
+
+	// inventoryIDLabel contains the ID of a cli-utils inventory ConfigMap
+	inventoryIDLabel = "cli-utils.sigs.k8s.io/inventory-id"
+
+	fluxKustomizationNameLabel      = "kustomize.toolkit.fluxcd.io/name"
+	fluxKustomizationNamespaceLabel = "kustomize.toolkit.fluxcd.io/namespace"
+)
+
+var (
+	fluxKustomizationGVK = schema.GroupVersionKind{Group: "kustomize.toolkit.fluxcd.io", Version: "v1",
+		Kind: "Kustomization"}
+)
+
+// inventoryRef identifies the inventory listing a resource: either a Flux Kustomization (namespace
+// and name) or a cli-utils inventory (id)
+type inventoryRef struct {
+	namespace string
+	name      string
+	id        string
+}
+
+func (r *inventoryRef) String() string {
+	if r.id != "" {
+		return fmt.Sprintf("inventory %s", r.id)
+	}
+	return fmt.Sprintf("Kustomization %s/%s", r.namespace, r.name)
+}
+
+// getInventoryRef returns the inventory listing u. Nil if u is not listed by any inventory or
+// inventory correlation is disabled.
+func getInventoryRef(u *unstructured.Unstructured) *inventoryRef {
+	if !inventoryCorrelation {
+		return nil
+	}
+	if id := u.GetAnnotations()[owningInventoryAnnotation]; id != "" {
+		return &inventoryRef{id: id}
+	}
+	objLabels := u.GetLabels()
+	if name := objLabels[fluxKustomizationNameLabel]; name != "" {
+		return &inventoryRef{namespace: objLabels[fluxKustomizationNamespaceLabel], name: name}
+	}
+	return nil
+}
+
+// getInventoryEntry returns how resource is listed in inventories (namespace_name_group_kind,
+// like cli-utils ObjMetadata)
+func getInventoryEntry(resourceRef *corev1.ObjectReference) string {
+	// cli-utils escapes colons, which RBAC resource names can contain
+	name := strings.ReplaceAll(resourceRef.Name, ":", "__")
+	return fmt.Sprintf("%s_%s_%s_%s", resourceRef.Namespace, name,
+		resourceRef.GroupVersionKind().Group, resourceRef.Kind)
+}
+
+// recordInventory records the inventory listing u, the current state of resource
+func (m *manager) recordInventory(resourceRef *corev1.ObjectReference, u *unstructured.Unstructured) {
+	if !inventoryCorrelation {
+		return
+	}
+
+	inventory := getInventoryRef(u)
+
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, ok := shard.resourceHashes[*resourceRef]; !ok {
+		// not tracked anymore
+		return
+	}
+	if inventory == nil {
+		delete(shard.inventories, *resourceRef)
+		return
+	}
+	shard.inventories[*resourceRef] = *inventory
+}
+
+// isPrunedFromInventory returns true if resource, not found, is not listed anymore by the
+// inventory which listed it. Also returns such inventory.
+func (m *manager) isPrunedFromInventory(ctx context.Context, resourceRef *corev1.ObjectReference,
+) (string, bool) {
+
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.RLock()
+	inventory, ok := shard.inventories[*resourceRef]
+	shard.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+
+	listed, err := m.isListedInInventory(ctx, &inventory, getInventoryEntry(resourceRef))
+	if err != nil {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to read %s: %v", inventory.String(), err))
+		return "", false
+	}
+	return inventory.String(), !listed
+}
+
+// isListedInInventory returns true if inventory contains entry
+func (m *manager) isListedInInventory(ctx context.Context, inventory *inventoryRef, entry string,
+) (bool, error) {
+
+	if inventory.id == "" {
+		kustomization, err := m.getUnstructured(ctx, &corev1.ObjectReference{
+			APIVersion: fluxKustomizationGVK.GroupVersion().String(), Kind: fluxKustomizationGVK.Kind,
+			Namespace: inventory.namespace, Name: inventory.name})
+		if err != nil {
+			return false, err
+		}
+		entries, _, _ := unstructured.NestedSlice(kustomization.Object, "status", "inventory", "entries")
+		for i := range entries {
+			if e, ok := entries[i].(map[string]interface{}); ok && e["id"] == entry {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	dr, err := m.getDynamicResourceInterface(corev1.SchemeGroupVersion.WithKind("ConfigMap"), metav1.NamespaceAll)
+	if err != nil {
+		return false, err
+	}
+	if err := m.waitForAPIServer(ctx); err != nil {
+		return false, err
+	}
+	selector := labels.Set{inventoryIDLabel: inventory.id}
+	list, err := dr.List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	m.observeAPIResponse(listVerb, err)
+	if err != nil {
+		return false, err
+	}
+	if len(list.Items) == 0 {
+		return false, fmt.Errorf("inventory ConfigMap not found")
+	}
+	for i := range list.Items {
+		if _, ok, _ := unstructured.NestedString(list.Items[i].Object, "data", entry); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Resources deployed by Carvel kapp (or kapp-controller packages) carry annotations kapp rewrites
+// on each deploy, even when the resource itself does not change. Those are not considered when
+// hashing, otherwise each kapp deploy would be reported as a configuration drift.
+// kapp versioned resources (e.g. ConfigMaps annotated with kapp.k14s.io/versioned) are deployed
+// as a new object, named <name>-ver-<N>, on each change, while old versions are eventually
+// deleted: an old version which is deleted after being superseded is not a configuration drift.
+
+const (
+	// kappVersionedAnnotation marks resources kapp deploys as a new version on each change
+	kappVersionedAnnotation = "kapp.k14s.io/versioned"
+
+	// kappVersionSeparator separates name from version in kapp versioned resource names
+	kappVersionSeparator = "-ver-"
+)
+
+// kappBookkeepingAnnotations contains the annotations kapp rewrites on each deploy:
+//   - nonce is replaced by a unique value on each deploy;
+//   - original contains the applied configuration (nonce included), original-diff-md5 its digest.
+var kappBookkeepingAnnotations = []string{
+	"kapp.k14s.io/nonce",
+	"kapp.k14s.io/original",
+	"kapp.k14s.io/original-diff-md5",
+}
+
+// hashedAnnotations returns the annotations considered when hashing: annotations without kapp
+// (and, if enabled, Crossplane) bookkeeping ones. annotations is returned as is if it contains
+// none, a copy otherwise.
+func hashedAnnotations(annotations map[string]interface{}) map[string]interface{} {
+	var filtered map[string]interface{}
+	for _, keys := range [][]string{kappBookkeepingAnnotations, getCrossplaneBookkeepingAnnotations()} {
+		for _, key := range keys {
+			if _, ok := annotations[key]; !ok {
+				continue
+			}
+			if filtered == nil {
+				filtered = make(map[string]interface{}, len(annotations))
+				for k, v := range annotations {
+					filtered[k] = v
+				}
+			}
+			delete(filtered, key)
+		}
+	}
+	if filtered == nil {
+		return annotations
+	}
+	return filtered
+}
+
+// getKappNextVersion returns the name of the kapp version following name. Returns false if
+// name is not the name of a kapp versioned resource.
+func getKappNextVersion(name string) (string, bool) {
+	i := strings.LastIndex(name, kappVersionSeparator)
+	if i <= 0 {
+		return "", false
+	}
+	version, err := strconv.Atoi(name[i+len(kappVersionSeparator):])
+	if err != nil || version < 0 {
+		return "", false
+	}
+	return fmt.Sprintf("%s%s%d", name[:i], kappVersionSeparator, version+1), true
+}
+
+// isKappSuperseded returns true if resource, not found, is a kapp versioned resource deleted
+// by kapp because newer versions were deployed
+func (m *manager) isKappSuperseded(ctx context.Context, resourceRef *corev1.ObjectReference) bool {
+	nextVersion, ok := getKappNextVersion(resourceRef.Name)
+	if !ok {
+		return false
+	}
+
+	nextRef := *resourceRef
+	nextRef.Name = nextVersion
+	metadata, err := m.getMetadata(ctx, &nextRef)
+	if err != nil {
+		return false
+	}
+	_, versioned := metadata.Annotations[kappVersionedAnnotation]
+	return versioned
+}
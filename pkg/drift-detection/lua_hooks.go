@@ -0,0 +1,315 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+const (
+	// LuaHooksAnnotation, set on a ResourceSummary, lists the Lua hooks deciding whether changes to
+	// the resources it tracks are configuration drifts, as a YAML (or JSON) list of LuaHook, e.g.:
+	//
+	//	- group: apps
+	//	  kind: Deployment
+	//	  script: |
+	//	    function evaluate()
+	//	      local hs = {}
+	//	      hs.drift = obj.spec.template.spec.containers[1].image ~= oldObj.spec.template.spec.containers[1].image
+	//	      return hs
+	//	    end
+	//
+	// ResourceSummary spec is defined by libsveltos, hence the annotation.
+	LuaHooksAnnotation = "projectsveltos.io/drift-lua-hooks"
+
+	// luaHookTimeout is the time a Lua hook can take to evaluate
+	luaHookTimeout = 100 * time.Millisecond
+
+	// luaCallStackSize and luaRegistrySize bound the resources a Lua hook can use
+	luaCallStackSize = 64
+	luaRegistrySize  = 1024 * 20
+)
+
+var (
+	// luaUnsafeFunctions are the functions of the Lua base library not available to Lua hooks, as
+	// they give access to the file system, load arbitrary code or write to stdout
+	luaUnsafeFunctions = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "print"}
+)
+
+// LuaHook is a Lua script deciding whether a change to matching resources is a configuration drift.
+// As other Sveltos Lua scripts, it must define a function evaluate, which is given the object before
+// the change as oldObj and the object after the change as obj, and returns a table whose bool field
+// drift is the outcome.
+// When drift is false, change is not a drift: resource current state becomes the reference.
+// When drift is true or script fails, resource is evaluated as usual, comparing its hash.
+// Scripts run in a sandbox: only base (without file system access and code loading), table,
+// string and math libraries are available, and evaluation is bound in time and memory.
+type LuaHook struct {
+	// Group of matching resources. Empty for the core group, * for any group.
+	Group string `json:"group,omitempty"`
+
+	// Kind of matching resources. * for any kind.
+	Kind string `json:"kind"`
+
+	// Script is the Lua script
+	Script string `json:"script"`
+}
+
+func (h *LuaHook) matches(gvk *schema.GroupVersionKind) bool {
+	return (h.Group == anyValue || h.Group == gvk.Group) && (h.Kind == anyValue || h.Kind == gvk.Kind)
+}
+
+// compiledLuaHook is a LuaHook along with its compiled script
+type compiledLuaHook struct {
+	LuaHook
+	proto *lua.FunctionProto
+}
+
+// luaHookTracker contains the Lua hooks set on ResourceSummaries (see LuaHooksAnnotation)
+type luaHookTracker struct {
+	mu sync.RWMutex
+	// Key: ResourceSummary
+	hooks map[types.NamespacedName][]compiledLuaHook
+	// protos caches compiled scripts, so each is compiled once however many ResourceSummaries
+	// use it. Key: script
+	protos map[string]*lua.FunctionProto
+}
+
+// ReadLuaHooks parses a YAML (or JSON) list of LuaHook
+func ReadLuaHooks(data []byte) ([]LuaHook, error) {
+	var hooks []LuaHook
+	if err := yaml.UnmarshalStrict(data, &hooks); err != nil {
+		return nil, errors.Wrap(err, "invalid lua hooks")
+	}
+	return hooks, nil
+}
+
+// compileLuaHook compiles script
+func compileLuaHook(script string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(script), "hook")
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, "hook")
+}
+
+// SetLuaHooks sets the Lua hooks for resources tracked because of resourceSummary, as listed by its
+// LuaHooksAnnotation. On error, previous hooks are kept.
+func (m *manager) SetLuaHooks(resourceSummary *libsveltosv1alpha1.ResourceSummary) error {
+	key := types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name}
+
+	value := resourceSummary.Annotations[LuaHooksAnnotation]
+	if value == "" {
+		m.luaHooks.set(key, nil)
+		return nil
+	}
+
+	hooks, err := ReadLuaHooks([]byte(value))
+	if err != nil {
+		return errors.Wrapf(err, "invalid %s annotation", LuaHooksAnnotation)
+	}
+	return m.luaHooks.compileAndSet(key, hooks)
+}
+
+// ClearLuaHooks forgets the Lua hooks of resourceSummary (see SetLuaHooks)
+func (m *manager) ClearLuaHooks(resourceSummary *corev1.ObjectReference) {
+	m.luaHooks.set(types.NamespacedName{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name}, nil)
+}
+
+// compileAndSet compiles hooks, reusing cached scripts, and sets them for resourceSummary
+func (t *luaHookTracker) compileAndSet(resourceSummary types.NamespacedName, hooks []LuaHook) error {
+	t.mu.RLock()
+	compiled := make([]compiledLuaHook, len(hooks))
+	for i := range hooks {
+		compiled[i].LuaHook = hooks[i]
+		compiled[i].proto = t.protos[hooks[i].Script]
+	}
+	t.mu.RUnlock()
+
+	for i := range compiled {
+		if compiled[i].Kind == "" {
+			return fmt.Errorf("lua hook %d: kind is required", i)
+		}
+		if compiled[i].proto != nil {
+			continue
+		}
+		proto, err := compileLuaHook(compiled[i].Script)
+		if err != nil {
+			return errors.Wrapf(err, "lua hook %d", i)
+		}
+		compiled[i].proto = proto
+	}
+
+	t.set(resourceSummary, compiled)
+	return nil
+}
+
+func (t *luaHookTracker) set(resourceSummary types.NamespacedName, hooks []compiledLuaHook) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(hooks) == 0 {
+		delete(t.hooks, resourceSummary)
+	} else {
+		if t.hooks == nil {
+			t.hooks = make(map[types.NamespacedName][]compiledLuaHook)
+		}
+		t.hooks[resourceSummary] = hooks
+	}
+
+	// Only scripts in use are cached
+	t.protos = make(map[string]*lua.FunctionProto)
+	for _, compiled := range t.hooks {
+		for i := range compiled {
+			t.protos[compiled[i].Script] = compiled[i].proto
+		}
+	}
+}
+
+// getLuaHooks returns the Lua hooks, set by ResourceSummaries tracking resourceRef, matching gvk
+func (m *manager) getLuaHooks(gvk *schema.GroupVersionKind, resourceRef *corev1.ObjectReference,
+) []changeEvaluator {
+
+	m.luaHooks.mu.RLock()
+	defer m.luaHooks.mu.RUnlock()
+
+	if len(m.luaHooks.hooks) == 0 {
+		return nil
+	}
+
+	var result []changeEvaluator
+	for _, consumer := range m.getDriftConsumers(resourceRef) {
+		hooks := m.luaHooks.hooks[types.NamespacedName{Namespace: consumer.Namespace, Name: consumer.Name}]
+		for i := range hooks {
+			if hooks[i].matches(gvk) {
+				result = append(result, &hooks[i])
+			}
+		}
+	}
+	return result
+}
+
+// newLuaSandbox returns a Lua VM with only the libraries available to Lua hooks
+func newLuaSandbox() *lua.LState {
+	l := lua.NewState(lua.Options{
+		SkipOpenLibs:  true,
+		CallStackSize: luaCallStackSize,
+		RegistrySize:  luaRegistrySize,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		l.Push(l.NewFunction(lib.open))
+		l.Push(lua.LString(lib.name))
+		l.Call(1, 0)
+	}
+	for _, name := range luaUnsafeFunctions {
+		l.SetGlobal(name, lua.LNil)
+	}
+	boundLuaLibraries(l)
+	return l
+}
+
+// isDrift returns the outcome of hook on the change from oldU to newU. Each evaluation runs in a
+// new sandbox, so evaluations never share state, and is stopped once it allocates more than
+// luaMaxAllocations bytes.
+func (h *compiledLuaHook) isDrift(oldU, newU *unstructured.Unstructured) (bool, error) {
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), luaHookTimeout)
+	defer cancel()
+	ctx, cancelCause := context.WithCancelCause(timeoutCtx)
+	defer cancelCause(nil)
+	if start, ok := heapAllocs(); ok {
+		go watchLuaAllocations(ctx, cancelCause, start)
+	}
+
+	l := newLuaSandbox()
+	defer l.Close()
+	l.SetContext(ctx)
+
+	l.Push(l.NewFunctionFromProto(h.proto))
+	if err := l.PCall(0, lua.MultRet, nil); err != nil {
+		return false, luaHookError(ctx, err)
+	}
+
+	l.SetGlobal("oldObj", toLuaValue(l, oldU.UnstructuredContent()))
+	l.SetGlobal("obj", toLuaValue(l, newU.UnstructuredContent()))
+	if err := l.CallByParam(lua.P{Fn: l.GetGlobal("evaluate"), NRet: 1, Protect: true}); err != nil {
+		return false, luaHookError(ctx, err)
+	}
+	result := l.Get(-1)
+	l.Pop(1)
+
+	table, ok := result.(*lua.LTable)
+	if !ok {
+		return false, fmt.Errorf("lua hook returned %s, not a table", result.Type())
+	}
+	drift, ok := table.RawGetString("drift").(lua.LBool)
+	if !ok {
+		return false, errors.New("lua hook returned no bool drift field")
+	}
+	return bool(drift), nil
+}
+
+// toLuaValue converts value, as found in unstructured content, to a Lua value. Lists are
+// indexed starting from 1, as Lua arrays.
+func toLuaValue(l *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		table := l.NewTable()
+		for key, item := range v {
+			table.RawSetString(key, toLuaValue(l, item))
+		}
+		return table
+	case []interface{}:
+		table := l.CreateTable(len(v), 0)
+		for i := range v {
+			table.RawSetInt(i+1, toLuaValue(l, v[i]))
+		}
+		return table
+	case string:
+		return lua.LString(v)
+	case bool:
+		return lua.LBool(v)
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	default:
+		return lua.LNil
+	}
+}
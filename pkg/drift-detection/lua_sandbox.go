@@ -0,0 +1,214 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"runtime/metrics"
+	"time"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+const (
+	// luaMaxStringSize is the size of the largest string the string and table libraries build
+	// for a Lua hook
+	luaMaxStringSize = 1 << 20
+
+	// luaMaxAllocations is the memory a Lua hook can allocate. Strings concatenated with .. and
+	// tables are only bound by it.
+	luaMaxAllocations = 64 << 20
+
+	// luaAllocationsCheckInterval is how often memory allocated by a Lua hook is checked
+	luaAllocationsCheckInterval = time.Millisecond
+
+	heapAllocsMetric = "/gc/heap/allocs:bytes"
+)
+
+var (
+	errLuaMemoryLimit = fmt.Errorf("lua hook allocated more than %d bytes", luaMaxAllocations)
+
+	// luaFormatWidth matches width and precision of string.format directives
+	luaFormatWidth = regexp.MustCompile(`%[-+ #0]*(\d*)(?:\.(\d*))?`)
+)
+
+// boundLuaLibraries replaces the functions of the string and table libraries able to build strings
+// much larger than their arguments with ones failing when result would exceed luaMaxStringSize
+func boundLuaLibraries(l *lua.LState) {
+	stringLib := l.GetGlobal(lua.StringLibName).(*lua.LTable)
+	bound(l, stringLib, "rep", checkLuaRep)
+	bound(l, stringLib, "format", checkLuaFormat)
+	bound(l, stringLib, "gsub", checkLuaGsub)
+
+	tableLib := l.GetGlobal(lua.TabLibName).(*lua.LTable)
+	bound(l, tableLib, "concat", checkLuaConcat)
+}
+
+// bound replaces function name of lib with one calling check before it
+func bound(l *lua.LState, lib *lua.LTable, name string, check func(l *lua.LState)) {
+	original := lib.RawGetString(name).(*lua.LFunction).GFunction
+	lib.RawSetString(name, l.NewFunction(func(l *lua.LState) int {
+		check(l)
+		return original(l)
+	}))
+}
+
+func raiseLuaStringTooLarge(l *lua.LState, name string) {
+	l.RaiseError("%s: resulting string exceeds %d bytes", name, luaMaxStringSize)
+}
+
+func checkLuaRep(l *lua.LState) {
+	str := l.CheckString(1)
+	n := l.CheckInt(2)
+	if n > 0 && len(str) > 0 && n > luaMaxStringSize/len(str) {
+		raiseLuaStringTooLarge(l, "string.rep")
+	}
+}
+
+// checkLuaFormat rejects, as Lua does, widths and precisions longer than two digits
+func checkLuaFormat(l *lua.LState) {
+	format := l.CheckString(1)
+	for _, directive := range luaFormatWidth.FindAllStringSubmatch(format, -1) {
+		if len(directive[1]) > 2 || len(directive[2]) > 2 {
+			l.RaiseError("string.format: invalid format (width or precision too long)")
+		}
+	}
+}
+
+func checkLuaConcat(l *lua.LState) {
+	tbl := l.CheckTable(1)
+	sep := l.OptString(2, "")
+	i := max(l.OptInt(3, 1), 1)
+	j := min(l.OptInt(4, tbl.Len()), tbl.Len())
+
+	size := 0
+	for ; i <= j; i++ {
+		size += len(lua.LVAsString(tbl.RawGetInt(i))) + len(sep)
+		if size > luaMaxStringSize {
+			raiseLuaStringTooLarge(l, "table.concat")
+		}
+	}
+}
+
+// checkLuaGsub bounds the size of the replacements. A string replacement is checked upfront, while
+// a table or function replacement is replaced by a function checking each value it returns.
+func checkLuaGsub(l *lua.LState) {
+	str := l.CheckString(1)
+	pattern := l.CheckString(2)
+	l.CheckTypes(3, lua.LTString, lua.LTTable, lua.LTFunction)
+	limit := l.OptInt(4, -1)
+
+	size := len(str)
+	switch repl := l.Get(3).(type) {
+	case lua.LString:
+		matches, err := pm.Find(pattern, []byte(str), 0, limit)
+		if err != nil {
+			l.RaiseError(err.Error())
+		}
+		for _, match := range matches {
+			size += gsubReplacementSize(string(repl), match.Capture(1)-match.Capture(0))
+			if size > luaMaxStringSize {
+				raiseLuaStringTooLarge(l, "string.gsub")
+			}
+		}
+	case *lua.LTable, *lua.LFunction:
+		l.Replace(3, l.NewFunction(func(l *lua.LState) int {
+			var value lua.LValue
+			if table, ok := repl.(*lua.LTable); ok {
+				value = l.GetTable(table, l.Get(1))
+			} else {
+				args := make([]lua.LValue, l.GetTop())
+				for i := range args {
+					args[i] = l.Get(i + 1)
+				}
+				l.Push(repl)
+				for i := range args {
+					l.Push(args[i])
+				}
+				l.Call(len(args), 1)
+				value = l.Get(-1)
+			}
+			if !lua.LVIsFalse(value) {
+				size += len(lua.LVAsString(value))
+				if size > luaMaxStringSize {
+					raiseLuaStringTooLarge(l, "string.gsub")
+				}
+			}
+			l.Push(value)
+			return 1
+		}))
+	}
+}
+
+// gsubReplacementSize returns the largest size repl can expand to for a match of matchSize bytes.
+// A capture is at most the whole match or, for a position capture, a number.
+func gsubReplacementSize(repl string, matchSize int) int {
+	const maxPositionSize = 20
+
+	size := 0
+	for i := 0; i < len(repl); i++ {
+		if repl[i] == '%' && i+1 < len(repl) && repl[i+1] >= '0' && repl[i+1] <= '9' {
+			size += max(matchSize, maxPositionSize)
+			i++
+			continue
+		}
+		size++
+	}
+	return size
+}
+
+// watchLuaAllocations cancels ctx with errLuaMemoryLimit once more than luaMaxAllocations bytes
+// were allocated since start. Allocations are measured process wide: work running meanwhile counts
+// against the hook, which is safe as a failed hook leaves evaluation to resource hash.
+func watchLuaAllocations(ctx context.Context, cancel context.CancelCauseFunc, start uint64) {
+	ticker := time.NewTicker(luaAllocationsCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if allocated, ok := heapAllocs(); ok && allocated-start > luaMaxAllocations {
+				cancel(errLuaMemoryLimit)
+				return
+			}
+		}
+	}
+}
+
+// heapAllocs returns the bytes allocated on the heap since process started
+func heapAllocs() (uint64, bool) {
+	sample := []metrics.Sample{{Name: heapAllocsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0, false
+	}
+	return sample[0].Value.Uint64(), true
+}
+
+// luaHookError returns err, raised while running a Lua hook, along with the reason ctx was canceled
+func luaHookError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errLuaMemoryLimit) {
+		return errors.Wrap(cause, "lua hook")
+	}
+	return errors.Wrap(err, "lua hook")
+}
@@ -20,27 +20,25 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
-	"reflect"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gdexlab/go-render/render"
 	"github.com/go-logr/logr"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/util/dump"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
 	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
 	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
-	"github.com/projectsveltos/libsveltos/lib/utils"
 )
 
 var (
@@ -48,6 +46,16 @@ var (
 	managerInstance *manager
 )
 
+// revision identifies the revision of a resource a hash was evaluated from
+type revision struct {
+	resourceVersion string
+	generation      int64
+}
+
+func getRevision(u *unstructured.Unstructured) revision {
+	return revision{resourceVersion: u.GetResourceVersion(), generation: u.GetGeneration()}
+}
+
 // manager is used to detect configuration drift.
 // - Manager is notified about any resource deployed by Sveltos (via RegisterResource method
 // and the counterpart UnRegisterResource);
@@ -68,39 +76,111 @@ type manager struct {
 	clusterName      string
 	clusterType      libsveltosv1alpha1.ClusterType
 
+	// mu protects jobQueue and queuedAt and serializes writes to the consumer maps.
+	// Per-resource bookkeeping is kept in per-GVK shards, each with its own lock.
 	mu *sync.RWMutex
 
 	// jobQueue contains name of all Resources instances that need to be evaluated
 	// for drift
 	jobQueue *libsveltosset.Set
 
+	// queuedAt contains, for each resource in jobQueue, the time it was queued.
+	// Used to measure how long resources wait before being evaluated.
+	queuedAt map[corev1.ObjectReference]time.Time
+
 	// interval is the interval at which queued resources are evaluated for configuration
-	// drift
+	// drift, unless overridden via RuntimeSettings
 	interval time.Duration
 
-	// Contains hash for a resource. This hash is used to detect where a configuration
-	// drift has happened.
-	// Set first time a resource starts being watched for change and any time a configuration
-	// drift is detected and reported.
-	resourceHashes map[corev1.ObjectReference][]byte
+	// Key: resource to watch, Value: list of ResourceSummary referencing it.
+	// Copy-on-write: read without holding mu, modified only while holding mu.
+	resources *consumerMap
+
+	// Key: resource to watch, Value: list of ResourceSummary referencing it.
+	// Copy-on-write: read without holding mu, modified only while holding mu.
+	helmResources *consumerMap
+
+	// Key: GVK, Value: *gvkShard containing bookkeeping (hashes, tracked resources,
+	// watcher) for all tracked resources of that GVK
+	shards sync.Map
+
+	// polledGVKCount is the number of GVKs whose watcher was stopped because memory
+	// budget was exceeded
+	polledGVKCount atomic.Int32
+
+	// pacer holds requests while API server is throttling
+	pacer apiPacer
+
+	// fetches deduplicates concurrent fetches of the same resource
+	fetches singleflight.Group
+
+	// discovery caches discovery results and dynamic client
+	discovery discoveryCache
+
+	// driftEvents keeps the most recent drift events (see DriftEventsPath)
+	driftEvents driftEventLog
+
+	// helmValues contains the values baselines of tracked Helm releases (see TrackHelmValues)
+	helmValues helmValuesTracker
+
+	// remediations contains the drifts reported to ResourceSummaries not remediated yet
+	// (see ObserveRemediations)
+	remediations remediationTracker
+
+	// ignorePaths contains the field exclusions set on ResourceSummaries (see SetIgnorePaths)
+	ignorePaths ignorePathsTracker
+
+	// driftExpressions contains the drift expressions set on ResourceSummaries (see SetDriftExpressions)
+	driftExpressions driftExpressionTracker
+
+	// luaHooks contains the Lua hooks set on ResourceSummaries (see SetLuaHooks)
+	luaHooks luaHookTracker
+
+	// fetchTimeouts contains the fetch timeouts set on ResourceSummaries (see SetFetchTimeout)
+	fetchTimeouts fetchTimeoutTracker
 
-	// Key: resource to watch, Value: list of ResourceSummary referencing it
-	resources map[corev1.ObjectReference]*libsveltosset.Set
+	// permissions contains, per GVK, the outcome of last permission check (see MissingPermissions).
+	// Key: GVK, Value: *permissionCheck
+	permissions sync.Map
 
-	// Key: resource to watch, Value: list of ResourceSummary referencing it
-	helmResources map[corev1.ObjectReference]*libsveltosset.Set
+	// snapshot contains, while rebuilding internal state on startup, the persisted state of
+	// tracked resources (see loadSnapshot). Key: resource, Value: *snapshotEntry
+	snapshot sync.Map
 
-	// List of gvk with a watcher
-	// Key: GroupResourceVersion currently being watched
-	// Value: stop channel
-	watchers map[schema.GroupVersionKind]context.CancelFunc
+	// snapshotMu serializes writes of the persisted state
+	snapshotMu sync.Mutex
 
-	// key: GVK, Value: list of tracked resources in that GVK
-	// GVKs are all the ones to watch.
-	gvkResources map[schema.GroupVersionKind]*libsveltosset.Set
+	// pending contains the changes to ResourceSummaries which could not be applied yet
+	pending pendingUpdates
+
+	// connectivity tracks whether API server is reachable
+	connectivity connectivity
+
+	// baseline contains, while rebuilding internal state on startup, the tracked resources
+	// listed in chunks (see prefetchBaseline). Key: resource, Value: *unstructured.Unstructured
+	baseline sync.Map
+
+	// baselineGVKs contains the GVKs listed by prefetchBaseline
+	baselineGVKs sync.Map
+
+	// initialized is set once internal state has been rebuilt from existing
+	// ResourceSummaries. Till then, watchers are not started (see startDeferredWatchers).
+	initialized atomic.Bool
+
+	// paused is set while cluster is paused (see SetPaused)
+	paused atomic.Bool
+
+	// clusterUID is the UID of kube-system namespace last seen (see followClusterIdentity).
+	// Value: types.UID
+	clusterUID atomic.Value
+
+	// resetting is set while baselines are reset because cluster was re-provisioned
+	resetting atomic.Bool
 }
 
-// InitializeManager initializes a manager
+// InitializeManager initializes a manager. Tracked resources are read with config, while
+// ResourceSummaries are read and updated with c: those can be different API servers, for
+// instance when tracked workloads live in a hosted control plane or a virtual cluster.
 func InitializeManager(ctx context.Context, l logr.Logger, config *rest.Config, c client.Client,
 	scheme *runtime.Scheme, clusterNamespace, clusterName string, cluserType libsveltosv1alpha1.ClusterType,
 	intervalInSecond uint, sendUpdates bool) error {
@@ -112,29 +192,55 @@ func InitializeManager(ctx context.Context, l logr.Logger, config *rest.Config,
 			l.V(logs.LogInfo).Info("Creating manager now.")
 			managerInstance = &manager{log: l, Client: c, config: config, scheme: scheme}
 			managerInstance.jobQueue = &libsveltosset.Set{}
+			managerInstance.queuedAt = make(map[corev1.ObjectReference]time.Time)
 			managerInstance.mu = &sync.RWMutex{}
 
 			managerInstance.interval = time.Duration(intervalInSecond) * time.Second
 
-			managerInstance.watchers = make(map[schema.GroupVersionKind]context.CancelFunc)
-
 			managerInstance.sendUpdates = sendUpdates
 
 			managerInstance.clusterNamespace = clusterNamespace
 			managerInstance.clusterName = clusterName
 			managerInstance.clusterType = cluserType
 
-			managerInstance.resourceHashes = make(map[corev1.ObjectReference][]byte)
-			managerInstance.resources = make(map[corev1.ObjectReference]*libsveltosset.Set)
-			managerInstance.helmResources = make(map[corev1.ObjectReference]*libsveltosset.Set)
-			managerInstance.gvkResources = make(map[schema.GroupVersionKind]*libsveltosset.Set)
+			interner := newRefInterner()
+			managerInstance.resources = &consumerMap{interner: interner}
+			managerInstance.helmResources = &consumerMap{interner: interner}
+
+			// Cluster identity is needed to tell whether persisted state is the one of this cluster
+			if uid, err := managerInstance.getClusterUID(ctx); err != nil {
+				l.V(logs.LogInfo).Info(err.Error())
+			} else {
+				managerInstance.clusterUID.Store(uid)
+			}
 
+			start := time.Now()
 			if err := managerInstance.readResourceSummaries(ctx); err != nil {
 				managerInstance = nil
 				return err
 			}
+			trackStartupPhase(readResourceSummariesPhase, time.Since(start))
+
+			// initialized must be set before starting deferred watchers, so that any GVK
+			// registered from now on gets its watcher started right away
+			managerInstance.initialized.Store(true)
+			start = time.Now()
+			if err := managerInstance.startDeferredWatchers(ctx); err != nil {
+				managerInstance = nil
+				return err
+			}
+			trackStartupPhase(watcherEstablishmentPhase, time.Since(start))
+
+			// Missing permissions would otherwise result in silently empty watches
+			go managerInstance.verifyPermissions(ctx)
 
 			go managerInstance.evaluateConfigurationDrift(ctx)
+			go managerInstance.enforceMemoryBudget(ctx)
+			go managerInstance.persistSnapshot(ctx)
+			go managerInstance.followClusterIdentity(ctx)
+			go managerInstance.evaluateHelmValues(ctx)
+			go managerInstance.writePolicyReports(ctx)
+			go managerInstance.writeEventReports(ctx)
 		}
 	}
 
@@ -164,23 +270,50 @@ func (m *manager) RegisterResource(ctx context.Context, resourceRef *corev1.Obje
 	logger.V(logs.LogDebug).Info("track resource")
 
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	// From now on use the interned reference, so that internal maps share its strings
+	resourceRef = m.trackResource(resourceRef, isHelmResource, requestor)
+	m.mu.Unlock()
 
-	m.trackResource(resourceRef, isHelmResource, requestor)
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.RLock()
+	v, ok := shard.resourceHashes[*resourceRef]
+	shard.mu.RUnlock()
 
-	v, ok := m.resourceHashes[*resourceRef]
 	if ok {
-		return v, nil
+		return v.bytes(), nil
 	}
 
-	u, err := m.getUnstructured(ctx, resourceRef)
-	if err != nil {
-		return nil, err
+	// On a warm restart, persisted state is trusted: resource is neither fetched nor hashed.
+	// Changes happened meanwhile are detected once watchers are established.
+	evaluatedRevision, currentHash, ok := m.getFromSnapshot(resourceRef)
+	var inventory *inventoryRef
+	if !ok {
+		// Do not hold lock while fetching resource so that multiple resources
+		// can be registered concurrently
+		fetched, err := m.fetchAndHash(ctx, resourceRef)
+		if err != nil {
+			return nil, err
+		}
+		evaluatedRevision, currentHash, inventory = fetched.revision, fetched.hash, fetched.inventory
 	}
 
-	currentHash := m.unstructuredHash(u)
-	m.resourceHashes[*resourceRef] = currentHash
-	if err := m.updateGVKMapAndStartWatcher(ctx, resourceRef); err != nil {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// Resource might have been registered or unregistered while lock was released
+	if v, ok := shard.resourceHashes[*resourceRef]; ok {
+		return v.bytes(), nil
+	}
+	if !m.stillTrackingResource(resourceRef) {
+		return currentHash, nil
+	}
+
+	shard.resourceHashes[*resourceRef] = newCompactHash(currentHash)
+	shard.evaluatedRevisions[*resourceRef] = evaluatedRevision
+	if inventory != nil {
+		shard.inventories[*resourceRef] = *inventory
+	}
+	if err := m.updateGVKMapAndStartWatcher(ctx, shard, resourceRef); err != nil {
 		return nil, err
 	}
 	return currentHash, nil
@@ -195,115 +328,193 @@ func (m *manager) UnRegisterResource(resourceRef *corev1.ObjectReference, isHelm
 
 	logger.V(logs.LogDebug).Info("stop tracking resource")
 
+	consumers := m.resources
+	if isHelmResource {
+		consumers = m.helmResources
+	}
+
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	tracked := consumers.has(resourceRef)
+	if tracked {
+		consumers.erase(resourceRef, requestor)
+	}
+	m.mu.Unlock()
 
-	if isHelmResource {
-		if _, ok := m.helmResources[*resourceRef]; !ok {
-			return nil
-		}
-		m.helmResources[*resourceRef].Erase(requestor)
-		if m.helmResources[*resourceRef].Len() == 0 {
-			delete(m.helmResources, *resourceRef)
-		}
-	} else {
-		if _, ok := m.resources[*resourceRef]; !ok {
-			return nil
-		}
-		m.resources[*resourceRef].Erase(requestor)
-		if m.resources[*resourceRef].Len() == 0 {
-			delete(m.resources, *resourceRef)
-		}
+	if !tracked {
+		return nil
 	}
 
+	// Whether resource is still tracked is checked while holding shard lock, same as
+	// RegisterResource does before storing resource hash.
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
 	// check if resource is not tracked anymore
 	if !m.stillTrackingResource(resourceRef) {
 		logger.V(logs.LogInfo).Info("not tracked anymore")
-		m.stopTrackingResource(resourceRef)
+		m.stopTrackingResource(shard, resourceRef)
 	}
 
 	return nil
 }
 
-func (m *manager) trackResource(resourceRef *corev1.ObjectReference, isHelmResource bool,
-	requestor *corev1.ObjectReference) {
+// fetchedResource is the result of fetching and hashing a resource
+type fetchedResource struct {
+	revision revision
+	hash     []byte
+	// inventory is the inventory listing resource, if any (see SetInventoryCorrelation)
+	inventory *inventoryRef
+}
 
-	if isHelmResource {
-		if _, ok := m.helmResources[*resourceRef]; !ok {
-			m.helmResources[*resourceRef] = &libsveltosset.Set{}
+// fetchAndHash fetches resource and evaluates its hash, along with the revision hash was evaluated from.
+// When many ResourceSummaries reference the same resource (for instance a shared ConfigMap) and
+// register it concurrently, resource is fetched and hashed only once and result is shared by
+// all of them.
+func (m *manager) fetchAndHash(ctx context.Context, resourceRef *corev1.ObjectReference,
+) (*fetchedResource, error) {
+
+	key := fmt.Sprintf("%s/%s/%s/%s", resourceRef.APIVersion, resourceRef.Kind,
+		resourceRef.Namespace, resourceRef.Name)
+	v, err, _ := m.fetches.Do(key, func() (interface{}, error) {
+		u, err := m.getUnstructured(ctx, resourceRef)
+		if err != nil {
+			return nil, err
 		}
-		m.helmResources[*resourceRef].Insert(requestor)
-		return
+		return &fetchedResource{revision: getRevision(u), hash: m.unstructuredHash(u),
+			inventory: getInventoryRef(u)}, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if _, ok := m.resources[*resourceRef]; !ok {
-		m.resources[*resourceRef] = &libsveltosset.Set{}
+	return v.(*fetchedResource), nil
+}
+
+// trackResource records requestor is referencing resource. Returns the interned resource reference.
+func (m *manager) trackResource(resourceRef *corev1.ObjectReference, isHelmResource bool,
+	requestor *corev1.ObjectReference) *corev1.ObjectReference {
+
+	if isHelmResource {
+		return m.helmResources.insert(resourceRef, requestor)
 	}
-	m.resources[*resourceRef].Insert(requestor)
+
+	return m.resources.insert(resourceRef, requestor)
 }
 
 // stillTrackingResource returns true if resource is still
 // being tracked. False otherwise
 func (m *manager) stillTrackingResource(resourceRef *corev1.ObjectReference) bool {
-	if _, ok := m.helmResources[*resourceRef]; ok {
-		return true
-	}
-
-	_, ok := m.resources[*resourceRef]
-	return ok
+	return m.helmResources.has(resourceRef) || m.resources.has(resourceRef)
 }
 
 // stopTrackingResource stops tracking a resource.
-// If no other resource of the same GVK is being tracked, GVK watcher is also stopped
-func (m *manager) stopTrackingResource(resourceRef *corev1.ObjectReference) {
-	delete(m.resourceHashes, *resourceRef)
+// If no other resource of the same GVK is being tracked, GVK watcher is also stopped.
+// Must be called with shard lock held.
+func (m *manager) stopTrackingResource(shard *gvkShard, resourceRef *corev1.ObjectReference) {
+	delete(shard.resourceHashes, *resourceRef)
+	delete(shard.evaluatedRevisions, *resourceRef)
+	delete(shard.eventObjects, *resourceRef)
+	delete(shard.dataDigests, *resourceRef)
+	delete(shard.driftStreaks, *resourceRef)
+	delete(shard.pollSchedules, *resourceRef)
+	delete(shard.existenceChecks, *resourceRef)
+	delete(shard.inventories, *resourceRef)
+
+	if !shard.resources.Has(resourceRef) {
+		return
+	}
 
-	gvk := resourceRef.GroupVersionKind()
-	if _, ok := m.gvkResources[gvk]; ok {
-		m.gvkResources[gvk].Erase(resourceRef)
-		if m.gvkResources[gvk].Len() == 0 {
-			logger := m.log.WithValues("gvk", gvk.String())
-			logger.V(logs.LogInfo).Info("stop tracking gvk")
-			delete(m.gvkResources, gvk)
-			m.stopWatcher(gvk)
-			delete(m.watchers, gvk)
+	shard.resources.Erase(resourceRef)
+	if shard.resources.Len() == 0 {
+		gvk := resourceRef.GroupVersionKind()
+		logger := m.log.WithValues("gvk", gvk.String())
+		logger.V(logs.LogInfo).Info("stop tracking gvk")
+		m.stopWatcher(gvk, shard)
+		shard.pendingWatcher = false
+		if shard.polled {
+			shard.polled = false
+			trackPolledGVKs(int(m.polledGVKCount.Add(-1)))
 		}
 	}
 }
 
-// updateGVKMapAndStartWatcher updates gvkResources map. For any new GVK, a watcher is started.
-func (m *manager) updateGVKMapAndStartWatcher(ctx context.Context, resourceRef *corev1.ObjectReference) error {
-	gvk := resourceRef.GroupVersionKind()
-
-	_, ok := m.gvkResources[gvk]
-	if !ok {
-		m.gvkResources[gvk] = &libsveltosset.Set{}
-		if err := m.startWatcher(ctx, &gvk, m.react); err != nil {
-			return err
+// updateGVKMapAndStartWatcher adds resource to the tracked resources of its GVK.
+// For any new GVK, a watcher is started. While internal state is being rebuilt on
+// startup, or while cluster is paused and watchers are stopped, watcher is only marked as
+// pending (see startDeferredWatchers).
+// Must be called with shard lock held.
+func (m *manager) updateGVKMapAndStartWatcher(ctx context.Context, shard *gvkShard,
+	resourceRef *corev1.ObjectReference) error {
+
+	if shard.resources.Len() == 0 {
+		if m.deferWatchers() {
+			shard.pendingWatcher = true
+		} else {
+			gvk := resourceRef.GroupVersionKind()
+			if err := m.startWatcher(ctx, shard, &gvk, m.react); err != nil {
+				return err
+			}
 		}
 	}
-	m.gvkResources[gvk].Insert(resourceRef)
+	shard.resources.Insert(resourceRef)
 	return nil
 }
 
 func (m *manager) getUnstructured(ctx context.Context, resourceRef *corev1.ObjectReference,
 ) (*unstructured.Unstructured, error) {
 
+	if u, ok, err := m.getFromBaseline(resourceRef); ok {
+		return u, err
+	}
+
 	gvk := resourceRef.GroupVersionKind()
 
-	dr, err := utils.GetDynamicResourceInterface(m.config, gvk, resourceRef.Namespace)
+	dr, err := m.getDynamicResourceInterface(gvk, resourceRef.Namespace)
 	if err != nil {
 		return nil, err
 	}
 
-	u, err := dr.Get(ctx, resourceRef.Name, metav1.GetOptions{})
-	if err != nil {
+	if err := m.waitForAPIServer(ctx); err != nil {
 		return nil, err
 	}
 
+	getCtx, cancel, timeout := m.withFetchTimeout(ctx, resourceRef)
+	defer cancel()
+	u, err := dr.Get(getCtx, resourceRef.Name, metav1.GetOptions{})
+	m.observeAPIResponse(getVerb, err)
+	if err != nil {
+		return nil, fetchTimeoutError(getCtx, timeout, err)
+	}
+
 	return u, nil
 }
 
+// getMetadata fetches only metadata of resource. Used to verify a resource still exists and
+// whether it changed, without fetching the whole object.
+func (m *manager) getMetadata(ctx context.Context, resourceRef *corev1.ObjectReference,
+) (*metav1.PartialObjectMetadata, error) {
+
+	mr, err := m.getMetadataResourceInterface(resourceRef.GroupVersionKind(), resourceRef.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.waitForAPIServer(ctx); err != nil {
+		return nil, err
+	}
+
+	getCtx, cancel, timeout := m.withFetchTimeout(ctx, resourceRef)
+	defer cancel()
+	metadata, err := mr.Get(getCtx, resourceRef.Name, metav1.GetOptions{})
+	m.observeAPIResponse(getVerb, err)
+	if err != nil {
+		return nil, fetchTimeoutError(getCtx, timeout, err)
+	}
+
+	return metadata, nil
+}
+
 func getSortedKeys(inputMap map[string]interface{}) []string {
 	keys := make([]string, 0, len(inputMap))
 	for k := range inputMap {
@@ -318,40 +529,97 @@ func getSortedKeys(inputMap map[string]interface{}) []string {
 // - labels from metadata
 // - any content but metadata and status
 // - does not consider annotation in ConfigMap: annotations are used for leader-election so frequently change
+// - does not consider annotations kapp rewrites on each deploy (see hashedAnnotations)
+// With SpecHashMode, labels and annotations are not considered.
+// Content is streamed into the hash by a canonicalEncoder, so no intermediate representation
+// of the resource is ever built.
 func (m *manager) unstructuredHash(u *unstructured.Unstructured) []byte {
+	hash, _ := m.unstructuredHashWithChangedKeys(u)
+	return hash
+}
+
+// unstructuredHashWithChangedKeys returns resource hash (see unstructuredHash).
+// ConfigMaps/Secrets data is hashed per key (see isDataObject). For those whose data exceeds
+// incrementalHashThreshold, the names of the keys which changed since last evaluation are
+// also returned.
+// Fields excluded by field exclusions (see SetFieldExclusions) or by ResourceSummaries tracking
+// resource (see SetIgnorePaths), fields populated by Crossplane (see SetCrossplaneAware), service
+// mesh sidecars (see SetSidecarNormalization) and data rotated by cert-manager (see
+// SetCertManagerRotation) or refreshed by External Secrets Operator (see SetExternalSecretsAware)
+// are not considered.
+func (m *manager) unstructuredHashWithChangedKeys(u *unstructured.Unstructured) (hash []byte, changedKeys []string) {
+	u = excludeCertManagerRotation(normalizeSidecars(excludeCrossplaneFields(excludeFields(m.excludeIgnoredPaths(u)))))
+	u = excludeExternalSecretsRefresh(u)
+
 	h := sha256.New()
-	var config string
+	e := getCanonicalEncoder(h)
+
+	content := u.UnstructuredContent()
 
-	labels := u.GetLabels()
-	if labels != nil {
-		config += render.AsCode(labels)
+	var resourceRef *corev1.ObjectReference
+	var previousDigests, currentDigests map[string]keyDigest
+	largeData := isLargeData(u)
+	if largeData {
+		resourceRef = &corev1.ObjectReference{Kind: u.GetKind(), APIVersion: u.GetAPIVersion(),
+			Namespace: u.GetNamespace(), Name: u.GetName()}
+		previousDigests = m.getDataDigests(resourceRef)
+		currentDigests = make(map[string]keyDigest, len(previousDigests))
 	}
 
-	if u.GroupVersionKind().Kind != "ConfigMap" {
-		// In ConfigMap annotations are used for leader-election info
-		// so frequently change. Ignore those to avoid continuous up reconciliation
-		annotations := u.GetAnnotations()
-		if annotations != nil {
-			config += render.AsCode(annotations)
+	if hashMode != SpecHashMode {
+		// labels and annotations are read directly from content to avoid
+		// the copies made by GetLabels/GetAnnotations
+		metadata, _ := content["metadata"].(map[string]interface{})
+
+		if labels, ok := metadata["labels"].(map[string]interface{}); ok {
+			// Labels only containing Velero restore ones hash as no labels
+			if hashed := hashedLabels(labels); len(hashed) != 0 || len(labels) == 0 {
+				e.writeString("labels")
+				e.writeMap(hashed)
+			}
+		}
+
+		if u.GetKind() != "ConfigMap" {
+			// In ConfigMap annotations are used for leader-election info
+			// so frequently change. Ignore those to avoid continuous up reconciliation
+			if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+				e.writeString("annotations")
+				e.writeMap(hashedAnnotations(annotations))
+			}
 		}
 	}
 
-	content := u.UnstructuredContent()
 	sortedKeys := getSortedKeys(content)
 
 	for _, k := range sortedKeys {
-		if k != "metadata" && k != "status" {
-			config += render.AsCode(dump.ForHash(content[k]))
+		if k == "metadata" || k == "status" {
+			continue
+		}
+		e.writeString(k)
+		if data, ok := content[k].(map[string]interface{}); ok && dataFields[k] && isDataObject(u) {
+			writeDataDigests(e, k, data, previousDigests, currentDigests, &changedKeys)
+			continue
 		}
+		e.writeValue(content[k])
 	}
 
-	h.Write([]byte(config))
-	return h.Sum(nil)
+	e.release()
+
+	if largeData {
+		m.storeDataDigests(resourceRef, currentDigests)
+		sort.Strings(changedKeys)
+	}
+
+	return h.Sum(nil), changedKeys
 }
 
 // checkForConfigurationDrift queue resource to be evaluated for configuration drift
 func (m *manager) checkForConfigurationDrift(resourceRef *corev1.ObjectReference) {
 	m.jobQueue.Insert(resourceRef)
+	if _, ok := m.queuedAt[*resourceRef]; !ok {
+		m.queuedAt[*resourceRef] = time.Now()
+	}
+	trackQueueLength(m.jobQueue.Len())
 }
 
 // readResourceSummaries reads all ResourceSummary and rebuilds internal maps.
@@ -375,22 +643,52 @@ func (m *manager) readResourceSummaries(ctx context.Context) error {
 		return err
 	}
 
+	// On a warm restart, resources in persisted state are neither fetched nor hashed
+	m.loadSnapshot()
+	defer m.clearSnapshot()
+
+	// Instead of fetching each tracked resource, list all instances of tracked GVKs in chunks
+	m.prefetchBaseline(ctx, list.Items)
+	defer m.clearBaseline()
+
+	// ResourceSummaries are processed concurrently. Context passed to readResourceSummary
+	// must not be canceled when processing is over, as it is used to run watchers.
+	g := &errgroup.Group{}
+	g.SetLimit(readResourceSummariesConcurrency)
+
 	for i := range list.Items {
-		resourceSummary := list.Items[i]
+		resourceSummary := &list.Items[i]
 		if !resourceSummary.DeletionTimestamp.IsZero() {
 			continue
 		}
-		if err := m.readResourceSummary(ctx, &resourceSummary); err != nil {
-			return err
-		}
+		g.Go(func() error {
+			return m.readResourceSummary(ctx, resourceSummary)
+		})
 	}
 
-	return nil
+	return g.Wait()
 }
 
 func (m *manager) readResourceSummary(ctx context.Context, resourceSummary *libsveltosv1alpha1.ResourceSummary,
 ) error {
 
+	if err := m.SetIgnorePaths(ctx, resourceSummary); err != nil {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("ResourceSummary %s/%s: %v",
+			resourceSummary.Namespace, resourceSummary.Name, err))
+	}
+	if err := m.SetDriftExpressions(resourceSummary); err != nil {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("ResourceSummary %s/%s: %v",
+			resourceSummary.Namespace, resourceSummary.Name, err))
+	}
+	if err := m.SetLuaHooks(resourceSummary); err != nil {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("ResourceSummary %s/%s: %v",
+			resourceSummary.Namespace, resourceSummary.Name, err))
+	}
+	if _, _, err := m.SetFetchTimeout(resourceSummary); err != nil {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("ResourceSummary %s/%s: %v",
+			resourceSummary.Namespace, resourceSummary.Name, err))
+	}
+
 	if err := m.processResourceHashes(ctx, resourceSummary.Status.ResourceHashes,
 		false, resourceSummary); err != nil {
 		return err
@@ -407,37 +705,84 @@ func (m *manager) readResourceSummary(ctx context.Context, resourceSummary *libs
 func (m *manager) processResourceHashes(ctx context.Context, resourceHashes []libsveltosv1alpha1.ResourceHash,
 	isHelm bool, resourceSummary *libsveltosv1alpha1.ResourceSummary) error {
 
+	if IsSectionDisabled(getSection(isHelm)) {
+		return nil
+	}
+
 	resourceSummaryDef := m.getObjectReference(resourceSummary)
 
+	// Hashes in status might have been evaluated before HashVersion changed
+	legacyHashes := resourceSummary.Annotations[HashVersionAnnotation] != HashVersion
+	// Hashes in status might have been evaluated with different normalization settings. Those
+	// are not known anymore: current hashes become the reference.
+	fingerprint, ok := resourceSummary.Annotations[NormalizationAnnotation]
+	rebaseline := ok && fingerprint != NormalizationFingerprint()
+
 	for i := range resourceHashes {
 		resource := resourceHashes[i].Resource
 		resourceRef := m.getObjectRef(&resource)
-		lastKnownHash := resourceHashes[i].Hash
+		if IsNamespaceExcluded(resource.Namespace) || IsKindDenied(resourceRef.GroupVersionKind().GroupKind()) {
+			continue
+		}
+		lastKnownHash := newCompactHash([]byte(resourceHashes[i].Hash))
 
 		currentHash, err := m.RegisterResource(ctx, resourceRef, isHelm, resourceSummaryDef)
+		if err == nil && legacyHashes && newCompactHash(currentHash) != lastKnownHash &&
+			m.matchesLegacyHash(ctx, resourceRef, lastKnownHash) {
+			// Resource did not change since last known hash was evaluated: it only differs
+			// because of HashVersion. Current hash becomes the reference, no drift is reported.
+			lastKnownHash = newCompactHash(currentHash)
+		}
+		if err == nil && rebaseline && newCompactHash(currentHash) != lastKnownHash {
+			m.log.V(logs.LogInfo).Info(fmt.Sprintf("resource %s/%s hash evaluated with different normalization settings",
+				resourceRef.Namespace, resourceRef.Name))
+			lastKnownHash = newCompactHash(currentHash)
+		}
 		// Override with last known hash
-		m.resourceHashes[*resourceRef] = []byte(resourceHashes[i].Hash)
+		shard := m.getResourceShard(resourceRef)
+		shard.mu.Lock()
+		shard.resourceHashes[*resourceRef] = lastKnownHash
+		if err != nil || newCompactHash(currentHash) != lastKnownHash {
+			// Hash is not the one evaluated from current resourceVersion anymore
+			delete(shard.evaluatedRevisions, *resourceRef)
+		}
+		shard.mu.Unlock()
 
 		if err != nil {
 			if apierrors.IsNotFound(err) {
 				m.log.V(logs.LogInfo).Info(fmt.Sprintf("resource %s/%s not found",
 					resourceRef.Namespace, resourceRef.Name))
+				m.mu.Lock()
 				m.checkForConfigurationDrift(resourceRef)
+				m.mu.Unlock()
 				continue
 			}
 			return err
 		}
 
-		if !reflect.DeepEqual(currentHash, lastKnownHash) {
+		if newCompactHash(currentHash) != lastKnownHash {
 			m.log.V(logs.LogInfo).Info(fmt.Sprintf("resource %s/%s found with different hash",
 				resourceRef.Namespace, resourceRef.Name))
+			m.mu.Lock()
 			m.checkForConfigurationDrift(resourceRef)
+			m.mu.Unlock()
 		}
 	}
 
 	return nil
 }
 
+// matchesLegacyHash returns true if resource, hashed by legacyUnstructuredHash, has hash
+func (m *manager) matchesLegacyHash(ctx context.Context, resourceRef *corev1.ObjectReference,
+	hash compactHash) bool {
+
+	u, err := m.getUnstructured(ctx, resourceRef)
+	if err != nil {
+		return false
+	}
+	return newCompactHash(legacyUnstructuredHash(u)) == hash
+}
+
 // getKeyFromObject returns the Key that can be used in the internal reconciler maps.
 func (m *manager) getObjectReference(obj client.Object) *corev1.ObjectReference {
 	m.addTypeInformationToObject(m.Scheme(), obj)
@@ -18,19 +18,36 @@ package driftdetection_test
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/kms"
 	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
 )
 
@@ -102,12 +119,33 @@ var _ = Describe("Manager: registration", func() {
 		_, ok = watchers[gvk]
 		Expect(ok).To(BeTrue())
 
+		missing, err := manager.MissingPermissions(watcherCtx, gvk)
+		Expect(err).To(BeNil())
+		Expect(missing).To(BeEmpty())
+
 		gvks := manager.GetGVKResources()
 		Expect(len(gvks)).To(Equal(1))
 		gvkResources := gvks[resourceRef.GroupVersionKind()]
 		Expect(gvkResources.Len()).To(Equal(1))
 		Expect(gvkResources.Items()).To(ContainElement(resourceRef))
 
+		state := manager.GetState()
+		Expect(state.Resources).To(HaveLen(1))
+		Expect(state.Resources[0].Resource).To(Equal(resourceRef))
+		Expect(state.Resources[0].Hash).To(Equal(hex.EncodeToString(hash)))
+		Expect(state.Resources[0].Consumers).To(ConsistOf(*resourceSummaryRef))
+		Expect(state.Watchers).To(HaveLen(1))
+		Expect(state.Watchers[0].GroupVersionKind).To(Equal(gvk))
+		Expect(state.Watchers[0].TrackedResources).To(Equal(1))
+
+		driftdetection.SetSnapshot(filepath.Join(GinkgoT().TempDir(), "state.json"), 0)
+		report := driftdetection.Shutdown()
+		driftdetection.SetSnapshot("", 0)
+		Expect(report.Initialized).To(BeTrue())
+		Expect(report.TrackedResources).To(Equal(1))
+		Expect(report.Checkpoint).To(Equal(driftdetection.CheckpointWritten))
+		Expect(report.Degraded()).To(BeFalse())
+
 		Expect(manager.UnRegisterResource(&resourceRef, false, resourceSummaryRef)).To(Succeed())
 		resources = manager.GetResources()
 		Expect(len(resources)).To(Equal(0))
@@ -121,6 +159,138 @@ var _ = Describe("Manager: registration", func() {
 		Expect(len(gvks)).To(Equal(0))
 	})
 
+	It("writeSnapshot persists state of tracked resources, loadSnapshot restores it", func() {
+		driftdetection.SetSnapshot(filepath.Join(GinkgoT().TempDir(), "state.json"), 0)
+		defer driftdetection.SetSnapshot("", 0)
+
+		evaluated := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		pending := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+
+		hash := sha256.Sum256([]byte(randomString()))
+		resourceVersion := randomString()
+
+		m := driftdetection.NewEvaluationManager()
+		m.SetResourceHashes(evaluated, hash[:])
+		m.SetEvaluatedResourceVersion(evaluated, resourceVersion)
+		// Resources whose revision is not known are not persisted
+		m.SetResourceHashes(pending, hash[:])
+		Expect(driftdetection.WriteSnapshot(m)).To(Succeed())
+
+		restarted := driftdetection.NewEvaluationManager()
+		driftdetection.LoadSnapshot(restarted)
+
+		currentResourceVersion, currentHash, ok := restarted.GetFromSnapshot(evaluated)
+		Expect(ok).To(BeTrue())
+		Expect(currentResourceVersion).To(Equal(resourceVersion))
+		Expect(currentHash).To(Equal(hash[:]))
+
+		_, _, ok = restarted.GetFromSnapshot(pending)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("writeSnapshot encrypts persisted state when a key encryption service is set", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "state.json")
+		driftdetection.SetSnapshot(path, 0)
+		defer driftdetection.SetSnapshot("", 0)
+
+		kekFile := filepath.Join(GinkgoT().TempDir(), "kek")
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		Expect(err).To(BeNil())
+		Expect(os.WriteFile(kekFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600)).To(Succeed())
+		kek, err := kms.NewLocal(kekFile)
+		Expect(err).To(BeNil())
+		driftdetection.SetSnapshotEncryption(kek)
+		defer driftdetection.SetSnapshotEncryption(nil)
+
+		evaluated := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		hash := sha256.Sum256([]byte(randomString()))
+		resourceVersion := randomString()
+
+		m := driftdetection.NewEvaluationManager()
+		m.SetResourceHashes(evaluated, hash[:])
+		m.SetEvaluatedResourceVersion(evaluated, resourceVersion)
+		Expect(driftdetection.WriteSnapshot(m)).To(Succeed())
+
+		content, err := os.ReadFile(path)
+		Expect(err).To(BeNil())
+		Expect(string(content)).ToNot(ContainSubstring(evaluated.Name))
+
+		restarted := driftdetection.NewEvaluationManager()
+		driftdetection.LoadSnapshot(restarted)
+		currentResourceVersion, currentHash, ok := restarted.GetFromSnapshot(evaluated)
+		Expect(ok).To(BeTrue())
+		Expect(currentResourceVersion).To(Equal(resourceVersion))
+		Expect(currentHash).To(Equal(hash[:]))
+
+		// Encrypted state cannot be loaded without the key encryption service
+		driftdetection.SetSnapshotEncryption(nil)
+		restarted = driftdetection.NewEvaluationManager()
+		driftdetection.LoadSnapshot(restarted)
+		_, _, ok = restarted.GetFromSnapshot(evaluated)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("loadSnapshot rejects persisted state in plaintext when encryption is enabled", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "state.json")
+		driftdetection.SetSnapshot(path, 0)
+		defer driftdetection.SetSnapshot("", 0)
+
+		evaluated := &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: "ConfigMap", APIVersion: "v1"}
+		hash := sha256.Sum256([]byte(randomString()))
+
+		// State persisted before encryption was enabled
+		m := driftdetection.NewEvaluationManager()
+		m.SetResourceHashes(evaluated, hash[:])
+		m.SetEvaluatedResourceVersion(evaluated, randomString())
+		Expect(driftdetection.WriteSnapshot(m)).To(Succeed())
+
+		kekFile := filepath.Join(GinkgoT().TempDir(), "kek")
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		Expect(err).To(BeNil())
+		Expect(os.WriteFile(kekFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600)).To(Succeed())
+		kek, err := kms.NewLocal(kekFile)
+		Expect(err).To(BeNil())
+		driftdetection.SetSnapshotEncryption(kek)
+		defer driftdetection.SetSnapshotEncryption(nil)
+
+		restarted := driftdetection.NewEvaluationManager()
+		driftdetection.LoadSnapshot(restarted)
+		_, _, ok := restarted.GetFromSnapshot(evaluated)
+		Expect(ok).To(BeFalse())
+
+		// Migration accepts state in plaintext only once
+		driftdetection.SetPlaintextSnapshotMigration(true)
+		defer driftdetection.SetPlaintextSnapshotMigration(false)
+		restarted = driftdetection.NewEvaluationManager()
+		driftdetection.LoadSnapshot(restarted)
+		_, currentHash, ok := restarted.GetFromSnapshot(evaluated)
+		Expect(ok).To(BeTrue())
+		Expect(currentHash).To(Equal(hash[:]))
+
+		restarted = driftdetection.NewEvaluationManager()
+		driftdetection.LoadSnapshot(restarted)
+		_, _, ok = restarted.GetFromSnapshot(evaluated)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("InitializeManager records the duration of startup phases", func() {
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, testEnv.Config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+
+		for _, phase := range []string{"read_resource_summaries", "watcher_establishment"} {
+			Eventually(func() bool {
+				metric := getMetric("projectsveltos_drift_detection_startup_phase_duration_seconds", "phase", phase)
+				return metric != nil && metric.GetGauge().GetValue() >= 0
+			}, timeout, pollingInterval).Should(BeTrue())
+		}
+	})
+
 	It("readResourceSummaries processes all existing ResourceSummaries", func() {
 		Expect(driftdetection.InitializeManager(watcherCtx, logger, testEnv.Config, testEnv.Client, scheme,
 			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
@@ -198,6 +368,643 @@ var _ = Describe("Manager: registration", func() {
 		// Resource has not been created by this test. So manager needs to detect that condition
 		// (resource missing) as potential configuration drift which needs evaluation.
 		Expect(manager.GetJobQueue().Len()).To(Equal(1))
+
+		// When cluster is re-provisioned, anything not referenced by a ResourceSummary is dropped
+		stale := &corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1", Namespace: randomString(), Name: randomString()}
+		manager.AddResource(stale, &resourceRef)
+		manager.QueueResource(stale)
+		Expect(driftdetection.ResetBaselines(manager, watcherCtx)).To(Succeed())
+		Expect(len(manager.GetResources())).To(Equal(1))
+		Expect(manager.GetResources()).ToNot(HaveKey(*stale))
+		Expect(len(manager.GetHelmResources())).To(Equal(1))
+		Expect(manager.GetJobQueue().Len()).To(Equal(1))
+		Expect(manager.GetJobQueue().Has(stale)).To(BeFalse())
+	})
+
+	It("readResourceSummaries processes ResourceSummaries concurrently", func() {
+		driftdetection.SetReadResourceSummariesConcurrency(2)
+		defer driftdetection.SetReadResourceSummariesConcurrency(0)
+
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, testEnv.Config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, namespace)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, namespace)).To(Succeed())
+
+		// Each ResourceSummary tracks its own ConfigMap plus one shared by all
+		shared := corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1", Namespace: namespace.Name, Name: randomString()}
+		toResource := func(ref *corev1.ObjectReference) libsveltosv1alpha1.Resource {
+			return libsveltosv1alpha1.Resource{Kind: ref.Kind, Version: "v1", Namespace: ref.Namespace, Name: ref.Name}
+		}
+
+		const resourceSummaries = 6
+		owned := make([]corev1.ObjectReference, resourceSummaries)
+		created := make([]*libsveltosv1alpha1.ResourceSummary, 0, resourceSummaries)
+		defer func() {
+			// Other tests expect only their own ResourceSummaries
+			for i := range created {
+				Expect(testEnv.Delete(context.TODO(), created[i])).To(Succeed())
+			}
+		}()
+		for i := 0; i < resourceSummaries; i++ {
+			owned[i] = corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1", Namespace: namespace.Name,
+				Name: randomString()}
+			resourceSummary := getResourceSummary(nil, nil)
+			resourceSummary.Namespace = namespace.Name
+			resourceSummary.Spec.Resources = []libsveltosv1alpha1.Resource{toResource(&owned[i]), toResource(&shared)}
+			Expect(testEnv.Create(watcherCtx, resourceSummary)).To(Succeed())
+			Expect(waitForObject(watcherCtx, testEnv.Client, resourceSummary)).To(Succeed())
+			created = append(created, resourceSummary)
+
+			resourceSummary.Status.ResourceHashes = []libsveltosv1alpha1.ResourceHash{
+				{Hash: randomString(), Resource: toResource(&owned[i])},
+				{Hash: randomString(), Resource: toResource(&shared)},
+			}
+			Expect(testEnv.Status().Update(watcherCtx, resourceSummary)).To(Succeed())
+		}
+
+		// wait for cache to sync
+		Eventually(func() bool {
+			list := &libsveltosv1alpha1.ResourceSummaryList{}
+			if err := testEnv.List(watcherCtx, list, client.InNamespace(namespace.Name)); err != nil {
+				return false
+			}
+			synced := 0
+			for i := range list.Items {
+				if len(list.Items[i].Status.ResourceHashes) != 0 {
+					synced++
+				}
+			}
+			return synced == resourceSummaries
+		}, timeout, pollingInterval).Should(BeTrue())
+
+		Expect(driftdetection.ReadResourceSummaries(manager, watcherCtx)).To(Succeed())
+
+		resources := manager.GetResources()
+		for i := range owned {
+			Expect(resources).To(HaveKey(owned[i]))
+			Expect(resources[owned[i]].Len()).To(Equal(1))
+			// Hashes in status do not match: resources are queued for evaluation
+			Expect(manager.GetJobQueue().Has(&owned[i])).To(BeTrue())
+		}
+		Expect(resources).To(HaveKey(shared))
+		Expect(resources[shared].Len()).To(Equal(resourceSummaries))
+		Expect(manager.GetJobQueue().Has(&shared)).To(BeTrue())
+	})
+
+	It("readResourceSummaries migrates hashes evaluated before HashVersion 2 without reporting drift", func() {
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, testEnv.Config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, namespace)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, namespace)).To(Succeed())
+
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: randomString(),
+				Labels: map[string]string{"app": "nginx"}},
+			Data: map[string]string{"key": randomString()},
+		}
+		Expect(testEnv.Create(watcherCtx, configMap)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, configMap)).To(Succeed())
+
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("v1")
+		u.SetKind("ConfigMap")
+		Expect(testEnv.Get(watcherCtx, types.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name},
+			u)).To(Succeed())
+
+		resourceRef := corev1.ObjectReference{Namespace: configMap.Namespace, Name: configMap.Name,
+			Kind: "ConfigMap", APIVersion: "v1"}
+		resourceSummary := getResourceSummary(&resourceRef, nil)
+		resourceSummary.Namespace = namespace.Name
+		Expect(testEnv.Create(watcherCtx, resourceSummary)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, resourceSummary)).To(Succeed())
+
+		// Status contains the hash ResourceSummary reconciler set before HashVersion 2
+		resourceSummary.Status.ResourceHashes = []libsveltosv1alpha1.ResourceHash{
+			{Hash: hex.EncodeToString(driftdetection.LegacyHash(u)), Resource: resourceSummary.Spec.Resources[0]},
+		}
+		Expect(testEnv.Status().Update(watcherCtx, resourceSummary)).To(Succeed())
+		Eventually(func() bool {
+			current := &libsveltosv1alpha1.ResourceSummary{}
+			err := testEnv.Get(watcherCtx, types.NamespacedName{Namespace: resourceSummary.Namespace,
+				Name: resourceSummary.Name}, current)
+			return err == nil && current.Status.ResourceHashes != nil
+		}, timeout, pollingInterval).Should(BeTrue())
+
+		Expect(driftdetection.ReadResourceSummaries(manager, watcherCtx)).To(Succeed())
+		Expect(manager.GetJobQueue().Has(&resourceRef)).To(BeFalse())
+		Expect(manager.GetResourceHashes()[resourceRef]).To(Equal(driftdetection.UnstructuredHash(manager, u)))
+
+		// Once hashes are marked as evaluated with current HashVersion, a legacy hash is a drift
+		current := &libsveltosv1alpha1.ResourceSummary{}
+		Expect(testEnv.Get(watcherCtx, types.NamespacedName{Namespace: resourceSummary.Namespace,
+			Name: resourceSummary.Name}, current)).To(Succeed())
+		current.Annotations = map[string]string{driftdetection.HashVersionAnnotation: driftdetection.HashVersion}
+		Expect(testEnv.Update(watcherCtx, current)).To(Succeed())
+		Eventually(func() bool {
+			err := testEnv.Get(watcherCtx, types.NamespacedName{Namespace: resourceSummary.Namespace,
+				Name: resourceSummary.Name}, current)
+			return err == nil && current.Annotations[driftdetection.HashVersionAnnotation] == driftdetection.HashVersion
+		}, timeout, pollingInterval).Should(BeTrue())
+
+		Expect(driftdetection.ReadResourceSummaries(manager, watcherCtx)).To(Succeed())
+		Expect(manager.GetJobQueue().Has(&resourceRef)).To(BeTrue())
+	})
+
+	It("readResourceSummaries takes current hashes as reference when normalization settings changed", func() {
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, testEnv.Config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, namespace)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, namespace)).To(Succeed())
+
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: randomString()},
+			Data:       map[string]string{"key": randomString()},
+		}
+		Expect(testEnv.Create(watcherCtx, configMap)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, configMap)).To(Succeed())
+
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("v1")
+		u.SetKind("ConfigMap")
+		Expect(testEnv.Get(watcherCtx, types.NamespacedName{Namespace: configMap.Namespace, Name: configMap.Name},
+			u)).To(Succeed())
+
+		resourceRef := corev1.ObjectReference{Namespace: configMap.Namespace, Name: configMap.Name,
+			Kind: "ConfigMap", APIVersion: "v1"}
+		resourceSummary := getResourceSummary(&resourceRef, nil)
+		resourceSummary.Namespace = namespace.Name
+		// Hashes were evaluated with other normalization settings
+		resourceSummary.Annotations = map[string]string{
+			driftdetection.HashVersionAnnotation:   driftdetection.HashVersion,
+			driftdetection.NormalizationAnnotation: randomString(),
+		}
+		Expect(testEnv.Create(watcherCtx, resourceSummary)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, resourceSummary)).To(Succeed())
+
+		resourceSummary.Status.ResourceHashes = []libsveltosv1alpha1.ResourceHash{
+			{Hash: randomString(), Resource: resourceSummary.Spec.Resources[0]},
+		}
+		Expect(testEnv.Status().Update(watcherCtx, resourceSummary)).To(Succeed())
+		Eventually(func() bool {
+			current := &libsveltosv1alpha1.ResourceSummary{}
+			err := testEnv.Get(watcherCtx, types.NamespacedName{Namespace: resourceSummary.Namespace,
+				Name: resourceSummary.Name}, current)
+			return err == nil && current.Status.ResourceHashes != nil
+		}, timeout, pollingInterval).Should(BeTrue())
+
+		Expect(driftdetection.ReadResourceSummaries(manager, watcherCtx)).To(Succeed())
+		Expect(manager.GetJobQueue().Has(&resourceRef)).To(BeFalse())
+		Expect(manager.GetResourceHashes()[resourceRef]).To(Equal(driftdetection.UnstructuredHash(manager, u)))
+
+		// Once hashes are marked as evaluated with current normalization settings, a different hash is a drift
+		current := &libsveltosv1alpha1.ResourceSummary{}
+		Expect(testEnv.Get(watcherCtx, types.NamespacedName{Namespace: resourceSummary.Namespace,
+			Name: resourceSummary.Name}, current)).To(Succeed())
+		fingerprint := driftdetection.NormalizationFingerprint()
+		current.Annotations[driftdetection.NormalizationAnnotation] = fingerprint
+		Expect(testEnv.Update(watcherCtx, current)).To(Succeed())
+		Eventually(func() bool {
+			err := testEnv.Get(watcherCtx, types.NamespacedName{Namespace: resourceSummary.Namespace,
+				Name: resourceSummary.Name}, current)
+			return err == nil && current.Annotations[driftdetection.NormalizationAnnotation] == fingerprint
+		}, timeout, pollingInterval).Should(BeTrue())
+
+		Expect(driftdetection.ReadResourceSummaries(manager, watcherCtx)).To(Succeed())
+		Expect(manager.GetJobQueue().Has(&resourceRef)).To(BeTrue())
+	})
+
+	It("getComponentList groups current drift by component label", func() {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, namespace)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, namespace)).To(Succeed())
+
+		const partOf = "app.kubernetes.io/part-of"
+		configMaps := []*corev1.ConfigMap{
+			{ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: randomString(),
+				Labels: map[string]string{partOf: "checkout"}}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: randomString(),
+				Labels: map[string]string{partOf: "checkout"}}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: randomString()}},
+		}
+
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, testEnv.Config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		refs := make([]corev1.ObjectReference, len(configMaps))
+		for i := range configMaps {
+			Expect(testEnv.Create(watcherCtx, configMaps[i])).To(Succeed())
+			Expect(waitForObject(watcherCtx, testEnv.Client, configMaps[i])).To(Succeed())
+			refs[i] = corev1.ObjectReference{Namespace: namespace.Name, Name: configMaps[i].Name,
+				Kind: "ConfigMap", APIVersion: "v1"}
+			resourceSummary := getResourceSummary(&refs[i], nil)
+			_, err = manager.RegisterResource(watcherCtx, &refs[i], false, getObjRefFromResourceSummary(resourceSummary))
+			Expect(err).To(BeNil())
+		}
+
+		// Labels are read from watcher cache
+		Eventually(func() bool {
+			list := driftdetection.GetComponentList(manager, partOf)
+			return len(list.Items) == 2 && list.Items[1].TrackedResources == 2
+		}, timeout, pollingInterval).Should(BeTrue())
+
+		driftdetection.RecordDriftEvent(manager, &refs[1], false)
+
+		list := driftdetection.GetComponentList(manager, partOf)
+		Expect(list.Label).To(Equal(partOf))
+		Expect(list.Items[0].Component).To(BeEmpty())
+		Expect(list.Items[0].Status).To(Equal(driftdetection.ComponentInSync))
+		Expect(list.Items[0].TrackedResources).To(Equal(1))
+		Expect(list.Items[1].Component).To(Equal("checkout"))
+		Expect(list.Items[1].Status).To(Equal(driftdetection.ComponentDrifted))
+		Expect(list.Items[1].DriftedResources).To(HaveLen(1))
+		Expect(list.Items[1].DriftedResources[0].Resource).To(Equal(refs[1]))
+	})
+
+	It("getTrackedResourceList returns pages of tracked resources", func() {
+		consumer := corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String()}
+		state := &driftdetection.State{
+			Resources: []driftdetection.ResourceState{
+				{Resource: corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "a", Name: "a"},
+					Consumers: []corev1.ObjectReference{consumer}},
+				{Resource: corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "a", Name: "b"},
+					Consumers: []corev1.ObjectReference{consumer}, HelmConsumers: []corev1.ObjectReference{consumer}},
+				{Resource: corev1.ObjectReference{APIVersion: "v1", Kind: "Secret", Namespace: "a", Name: "a"},
+					HelmConsumers: []corev1.ObjectReference{consumer}},
+			},
+		}
+
+		list, err := driftdetection.GetTrackedResourceList(state, 2, "")
+		Expect(err).To(BeNil())
+		Expect(list.APIVersion).To(Equal(driftdetection.TrackedAPIVersion))
+		Expect(list.Items).To(HaveLen(2))
+		Expect(list.Items[1].Resource).To(Equal(state.Resources[1].Resource))
+		Expect(list.Items[1].Sections).To(Equal([]driftdetection.Section{driftdetection.ResourcesSection,
+			driftdetection.HelmSection}))
+		Expect(list.Items[1].Consumers).To(HaveLen(2))
+		Expect(list.Continue).ToNot(BeEmpty())
+
+		list, err = driftdetection.GetTrackedResourceList(state, 2, list.Continue)
+		Expect(err).To(BeNil())
+		Expect(list.Items).To(HaveLen(1))
+		Expect(list.Items[0].Resource).To(Equal(state.Resources[2].Resource))
+		Expect(list.Items[0].Consumers).To(ConsistOf(driftdetection.Consumer{ResourceSummary: consumer,
+			Section: driftdetection.HelmSection}))
+		Expect(list.Continue).To(BeEmpty())
+
+		_, err = driftdetection.GetTrackedResourceList(state, 2, randomString())
+		Expect(err).ToNot(BeNil())
+	})
+	It("listInChunks lists all objects using LIST requests of at most listPageSize objects", func() {
+		const pageSize = 2
+		driftdetection.SetListPageSize(pageSize)
+		defer driftdetection.SetListPageSize(0)
+
+		recorder := &requestRecorder{}
+		config := rest.CopyConfig(testEnv.Config)
+		config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			return &recordingTransport{next: rt, recorder: recorder}
+		}
+
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, namespace)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, namespace)).To(Succeed())
+
+		const configMaps = 5
+		created := make(map[string]bool, configMaps)
+		for i := 0; i < configMaps; i++ {
+			configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: randomString()}}
+			Expect(testEnv.Create(watcherCtx, configMap)).To(Succeed())
+			Expect(waitForObject(watcherCtx, testEnv.Client, configMap)).To(Succeed())
+			created[configMap.Name] = true
+		}
+
+		recorder.reset()
+		listed := make(map[string]bool)
+		gvk := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+		Expect(driftdetection.ListInChunks(manager, watcherCtx, gvk, func(u *unstructured.Unstructured) {
+			if u.GetNamespace() == namespace.Name {
+				listed[u.GetName()] = true
+			}
+		})).To(Succeed())
+		Expect(listed).To(Equal(created))
+
+		lists := recorder.getRequests(func(req *http.Request) bool {
+			return req.URL.Path == "/api/v1/configmaps" && req.URL.Query().Get("watch") == ""
+		})
+		Expect(len(lists)).To(BeNumerically(">=", (configMaps+pageSize-1)/pageSize))
+		for i := range lists {
+			Expect(lists[i].URL.Query().Get("limit")).To(Equal("2"))
+		}
+	})
+
+	It("RegisterResource fetches and hashes a resource shared by many ResourceSummaries once", func() {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, namespace)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, namespace)).To(Succeed())
+
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: randomString()},
+			Data:       map[string]string{randomString(): randomString()},
+		}
+		Expect(testEnv.Create(watcherCtx, configMap)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, configMap)).To(Succeed())
+
+		configMapPath := fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", namespace.Name, configMap.Name)
+		recorder := &requestRecorder{holdPath: configMapPath, hold: make(chan struct{})}
+		config := rest.CopyConfig(testEnv.Config)
+		config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			return &recordingTransport{next: rt, recorder: recorder}
+		}
+
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		resourceRef := corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1",
+			Namespace: namespace.Name, Name: configMap.Name}
+		isConfigMapGet := func(req *http.Request) bool { return req.URL.Path == configMapPath }
+
+		// ResourceSummaries register the shared resource concurrently. Fetch is held so that
+		// all registrations are in flight at the same time.
+		const resourceSummaries = 5
+		hashes := make([][]byte, resourceSummaries)
+		errs := make([]error, resourceSummaries)
+		var wg sync.WaitGroup
+		for i := 0; i < resourceSummaries; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ref := resourceRef
+				requestor := &corev1.ObjectReference{Kind: libsveltosv1alpha1.ResourceSummaryKind,
+					APIVersion: libsveltosv1alpha1.GroupVersion.String(), Namespace: namespace.Name, Name: randomString()}
+				hashes[i], errs[i] = manager.RegisterResource(watcherCtx, &ref, false, requestor)
+			}(i)
+		}
+		Eventually(func() int { return len(recorder.getRequests(isConfigMapGet)) },
+			timeout, time.Second).Should(Equal(1))
+		time.Sleep(time.Second)
+		close(recorder.hold)
+		wg.Wait()
+
+		for i := 0; i < resourceSummaries; i++ {
+			Expect(errs[i]).To(BeNil())
+			Expect(hashes[i]).To(Equal(hashes[0]))
+		}
+		Expect(recorder.getRequests(isConfigMapGet)).To(HaveLen(1))
+		Expect(manager.GetResources()[resourceRef].Len()).To(Equal(resourceSummaries))
+
+		// Once tracked, registering resource for another ResourceSummary does not fetch it
+		hash, err := manager.RegisterResource(watcherCtx, &resourceRef, false, &corev1.ObjectReference{
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String(),
+			Namespace: namespace.Name, Name: randomString()})
+		Expect(err).To(BeNil())
+		Expect(hash).To(Equal(hashes[0]))
+		Expect(recorder.getRequests(isConfigMapGet)).To(HaveLen(1))
+		Expect(manager.GetResources()[resourceRef].Len()).To(Equal(resourceSummaries + 1))
+	})
+
+	It("getObjectForEvaluation checks existence with metadata GETs and only fetches changed resources", func() {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, namespace)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, namespace)).To(Succeed())
+
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: randomString()},
+			Data:       map[string]string{randomString(): randomString()},
+		}
+		Expect(testEnv.Create(watcherCtx, configMap)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, configMap)).To(Succeed())
+
+		recorder := &requestRecorder{}
+		config := rest.CopyConfig(testEnv.Config)
+		config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			return &recordingTransport{next: rt, recorder: recorder}
+		}
+
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		resourceRef := corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1",
+			Namespace: namespace.Name, Name: configMap.Name}
+		_, err = manager.RegisterResource(watcherCtx, &resourceRef, false, &corev1.ObjectReference{
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String(),
+			Namespace: namespace.Name, Name: randomString()})
+		Expect(err).To(BeNil())
+
+		configMapPath := fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", namespace.Name, configMap.Name)
+		isMetadataGet := func(req *http.Request) bool {
+			return req.URL.Path == configMapPath && strings.Contains(req.Header.Get("Accept"), "as=PartialObjectMetadata")
+		}
+		isFullGet := func(req *http.Request) bool {
+			return req.URL.Path == configMapPath && !strings.Contains(req.Header.Get("Accept"), "as=PartialObjectMetadata")
+		}
+
+		// Unchanged resource: only metadata are fetched
+		recorder.reset()
+		driftdetection.RecordExistenceCheck(manager, &resourceRef)
+		u, unchanged, err := driftdetection.GetObjectForEvaluation(manager, watcherCtx, &resourceRef)
+		Expect(err).To(BeNil())
+		Expect(unchanged).To(BeTrue())
+		Expect(u).To(BeNil())
+		Expect(recorder.getRequests(isMetadataGet)).To(HaveLen(1))
+		Expect(recorder.getRequests(isFullGet)).To(BeEmpty())
+
+		// Changed resource: full object is fetched to evaluate its hash
+		configMap.Data = map[string]string{randomString(): randomString()}
+		Expect(testEnv.Update(watcherCtx, configMap)).To(Succeed())
+		recorder.reset()
+		driftdetection.RecordExistenceCheck(manager, &resourceRef)
+		u, unchanged, err = driftdetection.GetObjectForEvaluation(manager, watcherCtx, &resourceRef)
+		Expect(err).To(BeNil())
+		Expect(unchanged).To(BeFalse())
+		Expect(u).ToNot(BeNil())
+		Expect(recorder.getRequests(isMetadataGet)).To(HaveLen(1))
+		Expect(recorder.getRequests(isFullGet)).To(HaveLen(1))
+
+		// Deleted resource: metadata GET is enough
+		Expect(testEnv.Delete(watcherCtx, configMap)).To(Succeed())
+		recorder.reset()
+		driftdetection.RecordExistenceCheck(manager, &resourceRef)
+		_, _, err = driftdetection.GetObjectForEvaluation(manager, watcherCtx, &resourceRef)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(recorder.getRequests(isFullGet)).To(BeEmpty())
+	})
+
+	It("tracked resources are read impersonating the identity set via SetImpersonation", func() {
+		userName := randomString()
+		group := randomString()
+		driftdetection.SetImpersonation(userName, []string{group})
+		defer driftdetection.SetImpersonation("", nil)
+
+		// Impersonated identity is only allowed to read ConfigMaps
+		clusterRole := &rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: randomString()},
+			Rules: []rbacv1.PolicyRule{
+				{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "list", "watch"}},
+			},
+		}
+		Expect(testEnv.Create(watcherCtx, clusterRole)).To(Succeed())
+		clusterRoleBinding := &rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: randomString()},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: clusterRole.Name},
+			Subjects:   []rbacv1.Subject{{APIGroup: rbacv1.GroupName, Kind: rbacv1.UserKind, Name: userName}},
+		}
+		Expect(testEnv.Create(watcherCtx, clusterRoleBinding)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, clusterRoleBinding)).To(Succeed())
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, namespace)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, namespace)).To(Succeed())
+
+		configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, configMap)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, configMap)).To(Succeed())
+
+		recorder := &requestRecorder{}
+		config := rest.CopyConfig(testEnv.Config)
+		config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			return &recordingTransport{next: rt, recorder: recorder}
+		}
+
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		resourceRef := corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1",
+			Namespace: namespace.Name, Name: configMap.Name}
+		_, err = manager.RegisterResource(watcherCtx, &resourceRef, false, &corev1.ObjectReference{
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String(),
+			Namespace: namespace.Name, Name: randomString()})
+		Expect(err).To(BeNil())
+
+		configMapPath := fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", namespace.Name, configMap.Name)
+		gets := recorder.getRequests(func(req *http.Request) bool { return req.URL.Path == configMapPath })
+		Expect(gets).ToNot(BeEmpty())
+		for i := range gets {
+			Expect(gets[i].Header.Get("Impersonate-User")).To(Equal(userName))
+			Expect(gets[i].Header.Values("Impersonate-Group")).To(ConsistOf(group))
+		}
+
+		// Discovery is not impersonated
+		discovery := recorder.getRequests(isDiscoveryRequest)
+		for i := range discovery {
+			Expect(discovery[i].Header.Get("Impersonate-User")).To(BeEmpty())
+		}
+
+		Expect(testEnv.Delete(watcherCtx, clusterRoleBinding)).To(Succeed())
+		Expect(testEnv.Delete(watcherCtx, clusterRole)).To(Succeed())
+	})
+
+	It("with included namespaces, resources are only watched and listed in those namespaces", func() {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, namespace)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, namespace)).To(Succeed())
+
+		driftdetection.SetIncludedNamespaces([]string{namespace.Name})
+		defer driftdetection.SetIncludedNamespaces(nil)
+
+		Expect(driftdetection.IsNamespaceExcluded(namespace.Name)).To(BeFalse())
+		Expect(driftdetection.IsNamespaceExcluded(randomString())).To(BeTrue())
+		// Cluster wide resources are never tracked
+		Expect(driftdetection.IsNamespaceExcluded("")).To(BeTrue())
+
+		configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace.Name, Name: randomString()}}
+		Expect(testEnv.Create(watcherCtx, configMap)).To(Succeed())
+		Expect(waitForObject(watcherCtx, testEnv.Client, configMap)).To(Succeed())
+
+		recorder := &requestRecorder{}
+		config := rest.CopyConfig(testEnv.Config)
+		config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			return &recordingTransport{next: rt, recorder: recorder}
+		}
+
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		resourceRef := corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1",
+			Namespace: namespace.Name, Name: configMap.Name}
+		_, err = manager.RegisterResource(watcherCtx, &resourceRef, false, &corev1.ObjectReference{
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String(),
+			Namespace: namespace.Name, Name: randomString()})
+		Expect(err).To(BeNil())
+
+		namespacedPath := fmt.Sprintf("/api/v1/namespaces/%s/configmaps", namespace.Name)
+		Eventually(func() int {
+			return len(recorder.getRequests(func(req *http.Request) bool { return req.URL.Path == namespacedPath }))
+		}, timeout, pollingInterval).ShouldNot(BeZero())
+		Expect(recorder.getRequests(func(req *http.Request) bool {
+			return req.URL.Path == "/api/v1/configmaps"
+		})).To(BeEmpty())
+	})
+
+	It("getRESTMapping caches discovery results till TTL expires or a mapping error occurs", func() {
+		recorder := &requestRecorder{}
+		config := rest.CopyConfig(testEnv.Config)
+		config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			return &recordingTransport{next: rt, recorder: recorder}
+		}
+
+		Expect(driftdetection.InitializeManager(watcherCtx, logger, config, testEnv.Client, scheme,
+			randomString(), randomString(), libsveltosv1alpha1.ClusterTypeCapi, evaluateTimeout, false)).To(Succeed())
+		manager, err := driftdetection.GetManager()
+		Expect(err).To(BeNil())
+
+		configMapGVK := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+		mapping, err := driftdetection.GetRESTMapping(manager, configMapGVK)
+		Expect(err).To(BeNil())
+		Expect(mapping.Resource.Resource).To(Equal("configmaps"))
+
+		// Cached: no discovery request
+		recorder.reset()
+		for i := 0; i < 3; i++ {
+			_, err = driftdetection.GetRESTMapping(manager, configMapGVK)
+			Expect(err).To(BeNil())
+		}
+		Expect(recorder.getRequests(isDiscoveryRequest)).To(BeEmpty())
+
+		// Mapping error invalidates cached discovery results
+		_, err = driftdetection.GetRESTMapping(manager,
+			schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: randomString()})
+		Expect(err).ToNot(BeNil())
+		recorder.reset()
+		_, err = driftdetection.GetRESTMapping(manager, configMapGVK)
+		Expect(err).To(BeNil())
+		Expect(recorder.getRequests(isDiscoveryRequest)).ToNot(BeEmpty())
+
+		// Expired TTL
+		driftdetection.ApplyRuntimeSettings(driftdetection.RuntimeSettings{DiscoveryCacheTTL: time.Millisecond})
+		defer driftdetection.ApplyRuntimeSettings(driftdetection.RuntimeSettings{})
+		time.Sleep(10 * time.Millisecond)
+		recorder.reset()
+		_, err = driftdetection.GetRESTMapping(manager, configMapGVK)
+		Expect(err).To(BeNil())
+		Expect(recorder.getRequests(isDiscoveryRequest)).ToNot(BeEmpty())
 	})
 })
 
@@ -217,3 +1024,62 @@ func getObjRefFromResourceSummary(resourceSummary *libsveltosv1alpha1.ResourceSu
 		Kind:       kind,
 	}
 }
+
+// requestRecorder records all GET requests. GET requests for holdPath, if set,
+// are held till hold is closed.
+type requestRecorder struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	holdPath string
+	hold     chan struct{}
+}
+
+// recordingTransport hands all requests to recorder before sending them
+type recordingTransport struct {
+	next     http.RoundTripper
+	recorder *requestRecorder
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet {
+		t.recorder.mu.Lock()
+		t.recorder.requests = append(t.recorder.requests, req)
+		t.recorder.mu.Unlock()
+		if t.recorder.holdPath != "" && req.URL.Path == t.recorder.holdPath {
+			<-t.recorder.hold
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+func (r *requestRecorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = nil
+}
+
+// getRequests returns the recorded requests matching filter
+func (r *requestRecorder) getRequests(filter func(req *http.Request) bool) []*http.Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]*http.Request, 0)
+	for i := range r.requests {
+		if filter(r.requests[i]) {
+			result = append(result, r.requests[i])
+		}
+	}
+	return result
+}
+
+// isDiscoveryRequest returns true for discovery requests: /api, /api/<version>, /apis and
+// /apis/<group>/<version>
+func isDiscoveryRequest(req *http.Request) bool {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch segments[0] {
+	case "api":
+		return len(segments) <= 2
+	case "apis":
+		return len(segments) <= 3
+	}
+	return false
+}
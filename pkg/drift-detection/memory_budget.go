@@ -0,0 +1,150 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// memoryCheckInterval is the interval at which memory in use is compared with memory budget
+	memoryCheckInterval = 30 * time.Second
+)
+
+// enforceMemoryBudget periodically compares memory in use with the configured memory budget.
+// Every time budget is exceeded, the watcher caching most objects is stopped and corresponding
+// GVK is moved to polling mode: its resources are queued for evaluation every pollingInterval.
+// This trades detection latency for memory, while keeping drift detection functional.
+// A GVK stays in polling mode till no resource of that GVK is tracked anymore.
+func (m *manager) enforceMemoryBudget(ctx context.Context) {
+	if memoryBudget == 0 {
+		return
+	}
+
+	memoryTicker := time.NewTicker(memoryCheckInterval)
+	defer memoryTicker.Stop()
+
+	pollingTicker := time.NewTicker(pollingInterval)
+	defer pollingTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-memoryTicker.C:
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > memoryBudget {
+				m.log.V(logs.LogInfo).Info(fmt.Sprintf("memory in use %d above budget %d",
+					stats.HeapAlloc, memoryBudget))
+				trackMemoryBudgetExceeded()
+				m.moveHeaviestGVKToPolling()
+			}
+		case <-pollingTicker.C:
+			m.queuePolledResources(ctx)
+		}
+	}
+}
+
+// moveHeaviestGVKToPolling stops the watcher whose informer caches most objects.
+// Resources of that GVK will be evaluated by polling from now on.
+func (m *manager) moveHeaviestGVKToPolling() {
+	var heaviest *gvkShard
+	var heaviestGVK schema.GroupVersionKind
+	heaviestSize := -1
+	m.rangeShards(func(gvk schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		if shard.informers == nil {
+			return
+		}
+		size := shard.informers.size()
+		if size > heaviestSize {
+			heaviestSize = size
+			heaviest = shard
+			heaviestGVK = gvk
+		}
+	})
+
+	if heaviest == nil {
+		m.log.V(logs.LogInfo).Info("memory budget exceeded but no watcher left to stop")
+		return
+	}
+
+	heaviest.mu.Lock()
+	defer heaviest.mu.Unlock()
+
+	// GVK might have stopped being tracked meanwhile
+	if heaviest.informers == nil {
+		return
+	}
+
+	logger := m.log.WithValues("gvk", heaviestGVK.String())
+	logger.V(logs.LogInfo).Info(fmt.Sprintf("moving gvk to polling mode (%d cached objects)", heaviestSize))
+
+	m.stopWatcher(heaviestGVK, heaviest)
+	heaviest.polled = true
+	trackPolledGVKs(int(m.polledGVKCount.Add(1)))
+}
+
+// queuePolledResources queues for evaluation all tracked resources of GVKs in polling mode
+// which are due for evaluation and changed since last evaluation. GVKs are listed in chunks;
+// if listing fails, all due resources of the GVK are queued.
+func (m *manager) queuePolledResources(ctx context.Context) {
+	var resources []corev1.ObjectReference
+	m.rangeShards(func(gvk schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.RLock()
+		polled := shard.polled
+		tracked := shard.resources.Items()
+		shard.mu.RUnlock()
+
+		if !polled {
+			return
+		}
+
+		now := time.Now()
+		due := m.duePolledResources(shard, tracked, now)
+		if len(due) == 0 {
+			return
+		}
+
+		changed, err := m.scanPolledGVK(ctx, gvk, shard, due)
+		if err != nil {
+			m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to list %s: %v", gvk.String(), err))
+			resources = append(resources, due...)
+			return
+		}
+		m.reschedulePolledResources(shard, due, changed, now)
+		resources = append(resources, changed...)
+	})
+
+	// Shard locks must not be held while acquiring manager lock
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range resources {
+		m.checkForConfigurationDrift(&resources[i])
+	}
+}
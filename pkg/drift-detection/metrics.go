@@ -0,0 +1,303 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/tracing"
+)
+
+var (
+	queueWaitTimeHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_queue_wait_time_seconds",
+			Help:      "Time a resource waits in the evaluation queue before being evaluated for configuration drift",
+			Buckets:   []float64{0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+		},
+	)
+
+	startupPhaseDurationGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_startup_phase_duration_seconds",
+			Help:      "Time spent by drift-detection-manager in each startup phase",
+		},
+		[]string{"phase"},
+	)
+
+	driftDetectedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_drifts_total",
+			Help:      "Number of configuration drifts detected",
+		},
+		[]string{"gvk"},
+	)
+
+	polledGVKsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_polled_gvks",
+			Help:      "Number of GVKs evaluated by polling because memory budget was exceeded",
+		},
+	)
+
+	memoryBudgetExceededCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_memory_budget_exceeded_total",
+			Help:      "Number of times memory in use was found above the configured memory budget",
+		},
+	)
+
+	throttledRequestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_throttled_requests_total",
+			Help:      "Number of requests rejected by API server with 429 (Too Many Requests)",
+		},
+		[]string{"verb"},
+	)
+
+	throttleWaitHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_throttle_wait_seconds",
+			Help:      "Time requests were held because API server was throttling requests",
+			Buckets:   []float64{0.5, 1, 2, 5, 10, 30, 60},
+		},
+	)
+
+	clusterRecreatedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_cluster_recreated_total",
+			Help:      "Number of times the cluster was found re-provisioned and baselines were reset",
+		},
+	)
+
+	fluxOwnedDriftCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_flux_owned_drifts_total",
+			Help:      "Number of configuration drifts on resources managed by Flux, not reported to Sveltos",
+		},
+		[]string{"gvk"},
+	)
+
+	terraformOwnedDriftCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_terraform_owned_drifts_total",
+			Help:      "Number of configuration drifts on resources managed by Terraform, ignored",
+		},
+		[]string{"gvk"},
+	)
+
+	helmValuesDriftCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_helm_values_drifts_total",
+			Help:      "Number of Helm release revisions whose values drifted from the ones Sveltos deployed",
+		},
+	)
+
+	prunedResourcesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_pruned_resources_total",
+			Help:      "Number of tracked resources deleted after being removed from their inventory, not reported to Sveltos",
+		},
+		[]string{"gvk"},
+	)
+
+	evaluationBudgetWaitCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_evaluation_budget_wait_seconds_total",
+			Help:      "Time evaluations were held because evaluation budget was exhausted",
+		},
+	)
+
+	evaluationDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_evaluation_duration_seconds",
+			Help:      "Time taken to evaluate a resource for configuration drift",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		},
+		[]string{"gvk"},
+	)
+
+	missingPermissionsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_missing_permissions",
+			Help:      "Number of permissions (get, list, watch) drift-detection-manager lacks on a tracked GVK",
+		},
+		[]string{"gvk"},
+	)
+
+	queueLengthGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_queue_length",
+			Help:      "Number of resources waiting in the evaluation queue",
+		},
+	)
+
+	watcherErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Name:      "drift_detection_watcher_errors_total",
+			Help:      "Number of times a watcher failed to list or watch tracked resources",
+		},
+		[]string{"gvk"},
+	)
+)
+
+const (
+	// readResourceSummariesPhase is the time spent rebuilding internal state from existing ResourceSummaries
+	readResourceSummariesPhase = "read_resource_summaries"
+	// watcherEstablishmentPhase is the time spent starting watchers once internal state has been rebuilt
+	watcherEstablishmentPhase = "watcher_establishment"
+	// initialEvaluationPhase is the time spent evaluating resources queued while rebuilding internal state
+	initialEvaluationPhase = "initial_evaluation"
+)
+
+func init() {
+	// Register custom metrics with the global prometheus registry
+	metrics.Registry.MustRegister(queueWaitTimeHistogram, startupPhaseDurationGauge,
+		driftDetectedCounter, evaluationDurationHistogram, polledGVKsGauge, memoryBudgetExceededCounter,
+		throttledRequestsCounter, throttleWaitHistogram, missingPermissionsGauge, evaluationBudgetWaitCounter,
+		clusterRecreatedCounter, fluxOwnedDriftCounter, terraformOwnedDriftCounter, helmValuesDriftCounter,
+		prunedResourcesCounter, queueLengthGauge, watcherErrorsCounter)
+}
+
+// trackQueueWaitTime records how long a resource sat in the evaluation queue
+func trackQueueWaitTime(queuedAt time.Time) {
+	queueWaitTimeHistogram.Observe(time.Since(queuedAt).Seconds())
+}
+
+// trackQueueLength records the number of resources waiting in the evaluation queue
+func trackQueueLength(length int) {
+	queueLengthGauge.Set(float64(length))
+}
+
+// trackWatcherError records a list or watch failure of the watcher for gvk
+func trackWatcherError(gvk string) {
+	watcherErrorsCounter.WithLabelValues(gvk).Inc()
+}
+
+// trackMissingPermissions records how many permissions are missing on gvk
+func trackMissingPermissions(gvk string, missing int) {
+	missingPermissionsGauge.WithLabelValues(gvk).Set(float64(missing))
+}
+
+// forgetMissingPermissions removes missing permissions of gvk, not tracked anymore
+func forgetMissingPermissions(gvk string) {
+	missingPermissionsGauge.DeleteLabelValues(gvk)
+}
+
+// trackStartupPhase records how long a startup phase took
+func trackStartupPhase(phase string, elapsed time.Duration) {
+	startupPhaseDurationGauge.WithLabelValues(phase).Set(elapsed.Seconds())
+}
+
+// trackDrift records a configuration drift for a resource of the given gvk.
+// When ctx carries a sampled trace, trace ID is attached as exemplar.
+func trackDrift(ctx context.Context, gvk string) {
+	counter := driftDetectedCounter.WithLabelValues(gvk)
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		if adder, ok := counter.(prometheus.ExemplarAdder); ok {
+			adder.AddWithExemplar(1, prometheus.Labels{"trace_id": traceID})
+			return
+		}
+	}
+	counter.Inc()
+}
+
+// trackEvaluationDuration records how long evaluating a resource of the given gvk took.
+// When ctx carries a sampled trace, trace ID is attached as exemplar.
+func trackEvaluationDuration(ctx context.Context, gvk string, elapsed time.Duration) {
+	observer := evaluationDurationHistogram.WithLabelValues(gvk)
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok {
+			exemplarObserver.ObserveWithExemplar(elapsed.Seconds(), prometheus.Labels{"trace_id": traceID})
+			return
+		}
+	}
+	observer.Observe(elapsed.Seconds())
+}
+
+// trackPolledGVKs records the number of GVKs evaluated by polling
+func trackPolledGVKs(count int) {
+	polledGVKsGauge.Set(float64(count))
+}
+
+// trackThrottledRequest records a request rejected by API server with 429
+func trackThrottledRequest(verb string) {
+	throttledRequestsCounter.WithLabelValues(verb).Inc()
+}
+
+// trackThrottleWait records how long a request was held because API server was throttling requests
+func trackThrottleWait(wait time.Duration) {
+	throttleWaitHistogram.Observe(wait.Seconds())
+}
+
+// trackEvaluationBudgetWait records how long an evaluation was held by evaluation budget
+func trackEvaluationBudgetWait(wait time.Duration) {
+	evaluationBudgetWaitCounter.Add(wait.Seconds())
+}
+
+// trackMemoryBudgetExceeded records memory in use was found above budget
+func trackClusterRecreated() {
+	clusterRecreatedCounter.Inc()
+}
+
+// trackFluxOwnedDrift records a configuration drift, on a resource of the given gvk managed by
+// Flux, which was not reported to Sveltos
+func trackFluxOwnedDrift(gvk string) {
+	fluxOwnedDriftCounter.WithLabelValues(gvk).Inc()
+}
+
+// trackTerraformOwnedDrift records an ignored configuration drift on a resource of the given gvk
+// managed by Terraform
+func trackTerraformOwnedDrift(gvk string) {
+	terraformOwnedDriftCounter.WithLabelValues(gvk).Inc()
+}
+
+// trackHelmValuesDrift records a values drift of a Helm release
+func trackHelmValuesDrift() {
+	helmValuesDriftCounter.Inc()
+}
+
+// trackPrunedResource records the deletion, not reported to Sveltos, of a resource of the given
+// gvk removed from its inventory
+func trackPrunedResource(gvk string) {
+	prunedResourcesCounter.WithLabelValues(gvk).Inc()
+}
+
+func trackMemoryBudgetExceeded() {
+	memoryBudgetExceededCounter.Inc()
+}
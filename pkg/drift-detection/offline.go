@@ -0,0 +1,198 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// OfflineWindow is a period during which the cluster, whose resources are tracked and whose
+// ResourceSummaries are updated, was unreachable
+type OfflineWindow struct {
+	// Start is when cluster was first found unreachable
+	Start time.Time
+
+	// End is when cluster was reachable again. Zero while cluster is still unreachable.
+	End time.Time
+
+	// BufferedDrifts is the highest number of drifted resources whose ResourceSummaries could
+	// not be updated during the window. Those updates are applied once cluster is reachable again.
+	BufferedDrifts int
+}
+
+// connectivity tracks whether cluster is reachable
+type connectivity struct {
+	mu sync.Mutex
+
+	// current is the ongoing offline window. Nil while cluster is reachable.
+	current *OfflineWindow
+
+	// last is the most recent offline window
+	last *OfflineWindow
+}
+
+// pendingUpdates contains the changes to ResourceSummaries which could not be applied yet
+type pendingUpdates struct {
+	mu      sync.Mutex
+	updates resourceSummaryUpdates
+
+	// persisted is the number of drifted resources in pending updates last persisted
+	persisted int
+}
+
+// GetLastOfflineWindow returns the most recent period during which cluster was unreachable.
+// Nil if cluster was always reachable or manager is not initialized.
+func GetLastOfflineWindow() *OfflineWindow {
+	m, err := GetManager()
+	if err != nil {
+		return nil
+	}
+	return m.getLastOfflineWindow()
+}
+
+func (m *manager) getLastOfflineWindow() *OfflineWindow {
+	m.connectivity.mu.Lock()
+	defer m.connectivity.mu.Unlock()
+	if m.connectivity.last == nil {
+		return nil
+	}
+	window := *m.connectivity.last
+	return &window
+}
+
+// isUnreachable returns true if err means API server could not be reached
+func isUnreachable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || utilnet.IsConnectionRefused(err) || utilnet.IsConnectionReset(err) ||
+		apierrors.IsServiceUnavailable(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err)
+}
+
+// observeConnectivity opens an offline window when err means API server could not be reached,
+// and closes it on the first request which succeeds afterwards
+func (m *manager) observeConnectivity(err error) {
+	m.connectivity.mu.Lock()
+	defer m.connectivity.mu.Unlock()
+
+	switch {
+	case err != nil && isUnreachable(err):
+		if m.connectivity.current == nil {
+			m.connectivity.current = &OfflineWindow{Start: time.Now()}
+			m.connectivity.last = m.connectivity.current
+			m.log.V(logs.LogInfo).Info(fmt.Sprintf("API server is unreachable: %v", err))
+		}
+	case err == nil && m.connectivity.current != nil:
+		m.connectivity.current.End = time.Now()
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("API server is reachable again after %s",
+			m.connectivity.current.End.Sub(m.connectivity.current.Start).Round(time.Second)))
+		m.connectivity.current = nil
+	}
+}
+
+// trackBufferedDrifts records that drifts of count resources are buffered during the ongoing
+// offline window, if any
+func (m *manager) trackBufferedDrifts(count int) {
+	m.connectivity.mu.Lock()
+	defer m.connectivity.mu.Unlock()
+	if m.connectivity.current != nil && count > m.connectivity.current.BufferedDrifts {
+		m.connectivity.current.BufferedDrifts = count
+	}
+}
+
+// persistPendingUpdates persists state, so that buffered changes to ResourceSummaries survive
+// a restart, unless no change was buffered since state was last persisted
+func (m *manager) persistPendingUpdates() {
+	count := m.countPendingDrifts()
+	m.trackBufferedDrifts(count)
+
+	m.pending.mu.Lock()
+	persisted := m.pending.persisted
+	m.pending.mu.Unlock()
+	if snapshotStore == nil || count == persisted {
+		return
+	}
+
+	if err := m.writeSnapshot(); err != nil {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to persist buffered drifts: %v", err))
+	}
+}
+
+// takePendingUpdates merges, into updates, all changes to ResourceSummaries which could not be
+// applied before. Changes in updates, being more recent, take precedence.
+func (m *manager) takePendingUpdates(updates resourceSummaryUpdates) {
+	m.pending.mu.Lock()
+	defer m.pending.mu.Unlock()
+
+	for ref, pending := range m.pending.updates {
+		if update, ok := updates[ref]; ok {
+			pending.merge(update)
+		}
+		updates[ref] = pending
+	}
+	m.pending.updates = nil
+}
+
+// bufferUpdate keeps update of resourceSummaryRef, which could not be applied, till next flush
+func (m *manager) bufferUpdate(resourceSummaryRef *corev1.ObjectReference, update *resourceSummaryUpdate) {
+	m.pending.mu.Lock()
+	defer m.pending.mu.Unlock()
+
+	if m.pending.updates == nil {
+		m.pending.updates = resourceSummaryUpdates{}
+	}
+	if pending, ok := m.pending.updates[*resourceSummaryRef]; ok {
+		// Updated concurrently (see evaluateAndReport) with a more recent change
+		update.merge(pending)
+	}
+	m.pending.updates[*resourceSummaryRef] = update
+}
+
+// getPendingUpdates returns a copy of the changes to ResourceSummaries not applied yet
+func (m *manager) getPendingUpdates() resourceSummaryUpdates {
+	m.pending.mu.Lock()
+	defer m.pending.mu.Unlock()
+
+	updates := resourceSummaryUpdates{}
+	for ref, pending := range m.pending.updates {
+		update := &resourceSummaryUpdate{hashes: make(map[corev1.ObjectReference][]byte)}
+		update.merge(pending)
+		updates[ref] = update
+	}
+	return updates
+}
+
+// countPendingDrifts returns the number of drifted resources whose ResourceSummaries could not
+// be updated yet
+func (m *manager) countPendingDrifts() int {
+	m.pending.mu.Lock()
+	defer m.pending.mu.Unlock()
+
+	count := 0
+	for _, pending := range m.pending.updates {
+		count += len(pending.resources)
+	}
+	return count
+}
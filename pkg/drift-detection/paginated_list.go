@@ -0,0 +1,195 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/pager"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// listInChunks lists all instances of gvk, in all watched namespaces, using chunks (limit/continue)
+// of at most listPageSize objects, so that no single request returns a huge list.
+// f is called for each listed object.
+func (m *manager) listInChunks(ctx context.Context, gvk schema.GroupVersionKind,
+	f func(u *unstructured.Unstructured)) error {
+
+	namespaces := getWatchedNamespaces()
+	for i := range namespaces {
+		if err := m.listNamespaceInChunks(ctx, gvk, namespaces[i], f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listNamespaceInChunks lists all instances of gvk in namespace using chunks (see listInChunks).
+func (m *manager) listNamespaceInChunks(ctx context.Context, gvk schema.GroupVersionKind, namespace string,
+	f func(u *unstructured.Unstructured)) error {
+
+	dr, err := m.getDynamicResourceInterface(gvk, namespace)
+	if err != nil {
+		return err
+	}
+
+	p := pager.New(func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+		if err := m.waitForAPIServer(ctx); err != nil {
+			return nil, err
+		}
+		list, err := dr.List(ctx, options)
+		m.observeAPIResponse(listVerb, err)
+		if err != nil {
+			return nil, err
+		}
+		return list, nil
+	})
+	p.PageSize = listPageSize
+
+	return p.EachListItem(ctx, metav1.ListOptions{}, func(obj runtime.Object) error {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			f(u)
+		}
+		return nil
+	})
+}
+
+// prefetchBaseline lists, in chunks, all GVKs referenced by existing ResourceSummaries and keeps
+// the referenced resources. While rebuilding internal state on startup, resources are then registered
+// using those objects instead of fetching each one of them.
+// GVKs which cannot be listed are skipped: their resources are fetched one by one.
+// Resources in persisted state (see loadSnapshot) are skipped.
+func (m *manager) prefetchBaseline(ctx context.Context, resourceSummaries []libsveltosv1alpha1.ResourceSummary) {
+	wanted := make(map[schema.GroupVersionKind]map[corev1.ObjectReference]bool)
+	for i := range resourceSummaries {
+		sections := map[Section][]libsveltosv1alpha1.ResourceHash{
+			ResourcesSection: resourceSummaries[i].Status.ResourceHashes,
+			HelmSection:      resourceSummaries[i].Status.HelmResourceHashes,
+		}
+		for section, hashes := range sections {
+			if IsSectionDisabled(section) {
+				// resources in disabled sections are not tracked
+				continue
+			}
+
+			for j := range hashes {
+				ref := m.getObjectRef(&hashes[j].Resource)
+				if IsNamespaceExcluded(ref.Namespace) || IsKindDenied(ref.GroupVersionKind().GroupKind()) {
+					continue
+				}
+				if _, _, ok := m.getFromSnapshot(ref); ok {
+					// no need to fetch resources in persisted state
+					continue
+				}
+				gvk := ref.GroupVersionKind()
+				if wanted[gvk] == nil {
+					wanted[gvk] = make(map[corev1.ObjectReference]bool)
+				}
+				wanted[gvk][*ref] = true
+			}
+		}
+	}
+
+	for gvk := range wanted {
+		err := m.listInChunks(ctx, gvk, func(u *unstructured.Unstructured) {
+			ref := getObjectRefFromEvent(&gvk, u)
+			if wanted[gvk][*ref] {
+				m.baseline.Store(*ref, u)
+			}
+		})
+		if err != nil {
+			m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to list %s: %v", gvk.String(), err))
+			continue
+		}
+		m.baselineGVKs.Store(gvk, true)
+	}
+}
+
+// getFromBaseline returns the object prefetched for resource. Returns false if resource's GVK was not
+// prefetched. If it was, but resource was not listed, a NotFound error is returned.
+func (m *manager) getFromBaseline(resourceRef *corev1.ObjectReference) (*unstructured.Unstructured, bool, error) {
+	gvk := resourceRef.GroupVersionKind()
+	if _, ok := m.baselineGVKs.Load(gvk); !ok {
+		return nil, false, nil
+	}
+
+	if v, ok := m.baseline.Load(*resourceRef); ok {
+		return v.(*unstructured.Unstructured), true, nil
+	}
+
+	return nil, true, apierrors.NewNotFound(schema.GroupResource{Group: gvk.Group, Resource: gvk.Kind},
+		resourceRef.Name)
+}
+
+// clearBaseline drops all prefetched objects
+func (m *manager) clearBaseline() {
+	m.baseline.Range(func(key, _ any) bool {
+		m.baseline.Delete(key)
+		return true
+	})
+	m.baselineGVKs.Range(func(key, _ any) bool {
+		m.baselineGVKs.Delete(key)
+		return true
+	})
+}
+
+// scanPolledGVK lists, in chunks, all instances of a GVK in polling mode and returns the tracked resources
+// which need to be evaluated: the ones whose resourceVersion was not evaluated yet and the ones which were
+// not listed (deleted). Listed objects are kept so that evaluation does not need to fetch them again.
+func (m *manager) scanPolledGVK(ctx context.Context, gvk schema.GroupVersionKind, shard *gvkShard,
+	tracked []corev1.ObjectReference) ([]corev1.ObjectReference, error) {
+
+	notListed := make(map[corev1.ObjectReference]bool, len(tracked))
+	for i := range tracked {
+		notListed[tracked[i]] = true
+	}
+
+	var toEvaluate []corev1.ObjectReference
+	err := m.listInChunks(ctx, gvk, func(u *unstructured.Unstructured) {
+		ref := getObjectRefFromEvent(&gvk, u)
+		if !notListed[*ref] {
+			return
+		}
+		delete(notListed, *ref)
+		if m.isVersionEvaluated(ref, u.GetResourceVersion()) {
+			return
+		}
+		shard.mu.Lock()
+		shard.eventObjects[*ref] = u
+		shard.mu.Unlock()
+		toEvaluate = append(toEvaluate, *ref)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Not listed resources were possibly deleted
+	for ref := range notListed {
+		m.recordExistenceCheck(&ref)
+		toEvaluate = append(toEvaluate, ref)
+	}
+	return toEvaluate, nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// PausedWatchers defines what happens to watchers while cluster is paused
+type PausedWatchers string
+
+const (
+	// KeepPausedWatchers keeps watchers running while cluster is paused. Changes keep being
+	// queued and are evaluated as soon as cluster is unpaused.
+	KeepPausedWatchers = PausedWatchers("keep")
+
+	// StopPausedWatchers stops watchers while cluster is paused, releasing their caches.
+	// When cluster is unpaused, watchers are started again and any resource changed
+	// meanwhile is queued for evaluation.
+	StopPausedWatchers = PausedWatchers("stop")
+)
+
+// IsPaused returns true if drift detection is paused (see SetPaused)
+func IsPaused() bool {
+	m, err := GetManager()
+	if err != nil {
+		return false
+	}
+	return m.paused.Load()
+}
+
+// SetPaused pauses or resumes drift detection. Meant to follow the paused state of the cluster
+// (SveltosCluster or ClusterAPI Cluster): while paused, resources are neither evaluated nor are
+// ResourceSummaries updated. Resources queued meanwhile are evaluated once resumed. ctx must be
+// the one manager was initialized with, as watchers stopped on pause (see SetPausedWatchers)
+// are started again with it on resume.
+func SetPaused(ctx context.Context, paused bool) error {
+	m, err := GetManager()
+	if err != nil {
+		return err
+	}
+	return m.setPaused(ctx, paused)
+}
+
+func (m *manager) setPaused(ctx context.Context, paused bool) error {
+	if m.paused.Swap(paused) == paused {
+		return nil
+	}
+
+	if paused {
+		m.log.V(logs.LogInfo).Info("cluster is paused. Suspending drift detection.")
+		if pausedWatchers == StopPausedWatchers {
+			m.stopWatchersOnPause()
+		}
+		return nil
+	}
+
+	m.log.V(logs.LogInfo).Info("cluster is not paused anymore. Resuming drift detection.")
+	// Watchers stopped on pause were marked as pending. Once restarted, resources changed
+	// meanwhile are queued for evaluation.
+	if err := m.startDeferredWatchers(ctx); err != nil {
+		return errors.Wrap(err, "failed to restart watchers")
+	}
+	return nil
+}
+
+// stopWatchersOnPause stops all watchers, marking them as pending so that they are started
+// again on resume
+func (m *manager) stopWatchersOnPause() {
+	m.rangeShards(func(gvk schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+
+		if shard.cancel != nil {
+			m.stopWatcher(gvk, shard)
+			shard.pendingWatcher = true
+		}
+	})
+}
+
+// deferWatchers returns true if watchers of newly tracked GVKs must not be started yet
+func (m *manager) deferWatchers() bool {
+	return !m.initialized.Load() || (m.paused.Load() && pausedWatchers == StopPausedWatchers)
+}
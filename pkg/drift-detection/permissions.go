@@ -0,0 +1,289 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/features"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// permissionCheckTTL is how long the outcome of a permission check is reused, so that
+	// permissions granted (or revoked) meanwhile are eventually noticed
+	permissionCheckTTL = 5 * time.Minute
+)
+
+// watchVerbs are the verbs needed to track resources of a GVK
+var watchVerbs = []string{"get", "list", "watch"}
+
+// deniedAccess is a verb drift-detection-manager is not allowed to use on a resource
+type deniedAccess struct {
+	verb string
+	// namespace is empty when verb is denied cluster wide
+	namespace string
+}
+
+func (d *deniedAccess) String() string {
+	if d.namespace != corev1.NamespaceAll {
+		return fmt.Sprintf("%s in namespace %s", d.verb, d.namespace)
+	}
+	return d.verb
+}
+
+// permissionCheck is the outcome of verifying permissions on a GVK
+type permissionCheck struct {
+	// resource is the plural name of GVK resource, as used in RBAC rules
+	resource  string
+	denied    []deniedAccess
+	checkedAt time.Time
+}
+
+// missing returns the missing permissions (verb, plus namespace when included namespaces are set)
+func (c *permissionCheck) missing() []string {
+	missing := make([]string, len(c.denied))
+	for i := range c.denied {
+		missing[i] = c.denied[i].String()
+	}
+	return missing
+}
+
+// MissingRule is an RBAC rule drift-detection-manager lacks to detect drifts of tracked resources
+type MissingRule struct {
+	// Namespace is where Rule must be granted (via a Role). Empty means cluster wide (ClusterRole).
+	Namespace string `json:"namespace,omitempty"`
+
+	Rule rbacv1.PolicyRule `json:"rule"`
+}
+
+func (r *MissingRule) String() string {
+	rule := fmt.Sprintf("apiGroups=[%s] resources=[%s] verbs=[%s]", strings.Join(r.Rule.APIGroups, ","),
+		strings.Join(r.Rule.Resources, ","), strings.Join(r.Rule.Verbs, ","))
+	if r.Namespace != "" {
+		return fmt.Sprintf("%s in namespace %s", rule, r.Namespace)
+	}
+	return rule
+}
+
+// MissingPermissions returns the permissions, among get, list and watch, drift-detection-manager
+// (or the identity it impersonates, see SetImpersonation) lacks on resources of gvk. Without those, resources of gvk are silently never seen as changed
+// (watches are empty) or never fetched. Outcome is cached for permissionCheckTTL.
+// Returns nil if PermissionSelfTest feature gate is disabled.
+func (m *manager) MissingPermissions(ctx context.Context, gvk schema.GroupVersionKind) ([]string, error) {
+	if !features.Enabled(features.PermissionSelfTest) {
+		return nil, nil
+	}
+
+	if v, ok := m.permissions.Load(gvk); ok {
+		check := v.(*permissionCheck)
+		if time.Since(check.checkedAt) < permissionCheckTTL {
+			return check.missing(), nil
+		}
+	}
+
+	check, err := m.checkPermissions(ctx, gvk)
+	if err != nil {
+		return nil, err
+	}
+	return check.missing(), nil
+}
+
+// checkPermissions verifies, via SelfSubjectAccessReviews, permissions on gvk and caches the outcome
+func (m *manager) checkPermissions(ctx context.Context, gvk schema.GroupVersionKind) (*permissionCheck, error) {
+	mapping, err := m.getRESTMapping(gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := []string{corev1.NamespaceAll}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		namespaces = getWatchedNamespaces()
+	}
+
+	check := &permissionCheck{resource: mapping.Resource.Resource, denied: make([]deniedAccess, 0)}
+	for _, namespace := range namespaces {
+		for _, verb := range watchVerbs {
+			attributes := &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     gvk.Group,
+				Version:   gvk.Version,
+				Resource:  mapping.Resource.Resource,
+			}
+			allowed, err := m.isAllowed(ctx, attributes)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				check.denied = append(check.denied, deniedAccess{verb: verb, namespace: namespace})
+			}
+		}
+	}
+
+	check.checkedAt = time.Now()
+	m.permissions.Store(gvk, check)
+	trackMissingPermissions(gvk.String(), len(check.denied))
+	return check, nil
+}
+
+// isAllowed returns true if the identity tracked resources are read with (see SetImpersonation)
+// is allowed to access attributes
+func (m *manager) isAllowed(ctx context.Context, attributes *authorizationv1.ResourceAttributes) (bool, error) {
+	if impersonation.UserName == "" {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attributes},
+		}
+		if err := m.Create(ctx, review); err != nil {
+			return false, err
+		}
+		return review.Status.Allowed, nil
+	}
+
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: attributes,
+			User:               impersonation.UserName,
+			Groups:             impersonation.Groups,
+		},
+	}
+	if err := m.Create(ctx, review); err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
+
+// verifyPermissions verifies, every permissionCheckTTL till ctx is canceled, permissions on all
+// tracked GVKs. Missing RBAC rules are logged whenever they change.
+func (m *manager) verifyPermissions(ctx context.Context) {
+	if !features.Enabled(features.PermissionSelfTest) {
+		return
+	}
+
+	var lastReport string
+	for {
+		tracked := make(map[schema.GroupVersionKind]bool)
+		m.rangeShards(func(gvk schema.GroupVersionKind, _ *gvkShard) {
+			tracked[gvk] = true
+			if _, err := m.checkPermissions(ctx, gvk); err != nil {
+				m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to verify permissions on %s: %v", gvk, err))
+			}
+		})
+
+		// GVKs not tracked anymore must not be reported
+		m.permissions.Range(func(key, _ any) bool {
+			gvk := key.(schema.GroupVersionKind)
+			if !tracked[gvk] {
+				m.permissions.Delete(gvk)
+				forgetMissingPermissions(gvk.String())
+			}
+			return true
+		})
+
+		rules := m.getMissingRules()
+		report := make([]string, len(rules))
+		for i := range rules {
+			report[i] = rules[i].String()
+		}
+		if current := strings.Join(report, "; "); current != lastReport {
+			lastReport = current
+			if len(rules) != 0 {
+				m.log.V(logs.LogInfo).Info(fmt.Sprintf("missing RBAC rules, drift of affected resources "+
+					"cannot be detected: %s", current))
+			} else {
+				m.log.V(logs.LogInfo).Info("all tracked resources can be watched")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(permissionCheckTTL):
+		}
+	}
+}
+
+// getMissingRules returns the minimal RBAC rules which, granted, would allow watching all
+// verified GVKs. Resources of the same API group, missing the same verbs in the same
+// namespace, are merged in a single rule.
+func (m *manager) getMissingRules() []MissingRule {
+	type ruleKey struct {
+		namespace string
+		group     string
+		verbs     string
+	}
+
+	resources := make(map[ruleKey]map[string]bool)
+	m.permissions.Range(func(key, value any) bool {
+		gvk := key.(schema.GroupVersionKind)
+		check := value.(*permissionCheck)
+
+		verbs := make(map[string][]string)
+		for i := range check.denied {
+			verbs[check.denied[i].namespace] = append(verbs[check.denied[i].namespace], check.denied[i].verb)
+		}
+		for namespace := range verbs {
+			k := ruleKey{namespace: namespace, group: gvk.Group, verbs: strings.Join(verbs[namespace], ",")}
+			if resources[k] == nil {
+				resources[k] = make(map[string]bool)
+			}
+			resources[k][check.resource] = true
+		}
+		return true
+	})
+
+	rules := make([]MissingRule, 0, len(resources))
+	for k := range resources {
+		rule := MissingRule{
+			Namespace: k.namespace,
+			Rule: rbacv1.PolicyRule{
+				APIGroups: []string{k.group},
+				Verbs:     strings.Split(k.verbs, ","),
+			},
+		}
+		for resource := range resources[k] {
+			rule.Rule.Resources = append(rule.Rule.Resources, resource)
+		}
+		sort.Strings(rule.Rule.Resources)
+		rules = append(rules, rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].String() < rules[j].String()
+	})
+	return rules
+}
+
+// GetMissingRules returns the RBAC rules drift-detection-manager lacks to detect drifts of all
+// tracked resources (see MissingRule). Returns nil if manager is not initialized.
+func GetMissingRules() []MissingRule {
+	m, err := GetManager()
+	if err != nil {
+		return nil
+	}
+	return m.getMissingRules()
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// Drift events are periodically written, in the managed cluster, as PolicyReports (resources
+// of a namespace) and a ClusterPolicyReport (cluster wide resources) following the Kubernetes
+// policy working group schema (wgpolicyk8s.io/v1alpha2), so that tools like Policy Reporter
+// show drifts with no custom integration. Each drifted resource has one result, from its most
+// recent drift event (see DriftEventsPath): fail if drift was reported to Sveltos, warn if only
+// recorded (report-only) and skip if resource was intentionally pruned.
+// Reports no longer containing any result are deleted.
+
+const (
+	// policyReportName is the name of the PolicyReports and ClusterPolicyReport drifts are written to
+	policyReportName = "sveltos-drift-detection"
+
+	// policyReportSource is the source of results
+	policyReportSource = "sveltos-drift-detection"
+
+	// policyReportPolicy is the policy drifted resources violate
+	policyReportPolicy = "configuration-drift"
+
+	// policyReportManagedByLabel identifies the reports written by drift-detection-manager
+	policyReportManagedByLabel = "app.kubernetes.io/managed-by"
+	policyReportManagedBy      = "drift-detection-manager"
+)
+
+var (
+	policyReportGVR = schema.GroupVersionResource{Group: "wgpolicyk8s.io", Version: "v1alpha2",
+		Resource: "policyreports"}
+	clusterPolicyReportGVR = schema.GroupVersionResource{Group: "wgpolicyk8s.io", Version: "v1alpha2",
+		Resource: "clusterpolicyreports"}
+)
+
+// writePolicyReports periodically writes drift events as PolicyReports (see SetPolicyReportInterval)
+func (m *manager) writePolicyReports(ctx context.Context) {
+	if policyReportInterval == 0 {
+		return
+	}
+
+	// Reports are written with drift-detection-manager own identity: impersonated identity, if
+	// any, is only meant to read tracked resources
+	client, err := dynamic.NewForConfig(m.config)
+	if err != nil {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to create client for policy reports: %v", err))
+		return
+	}
+
+	ticker := time.NewTicker(policyReportInterval)
+	defer ticker.Stop()
+
+	// written is the sequence of the most recent drift event written. Reports are first written
+	// on startup, so that reports left by a previous run are updated.
+	written := uint64(0)
+	first := true
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			events := m.driftEvents.after(0)
+			last := uint64(0)
+			if len(events) != 0 {
+				last = events[len(events)-1].Sequence
+			}
+			if !first && last == written {
+				continue
+			}
+			if err := writePolicyReportsOnce(ctx, client, events); err != nil {
+				m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to write policy reports: %v", err))
+				continue
+			}
+			written = last
+			first = false
+		}
+	}
+}
+
+// writePolicyReportsOnce writes events as PolicyReports and deletes reports with no result anymore
+func writePolicyReportsOnce(ctx context.Context, client dynamic.Interface, events []DriftEvent) error {
+	reports := buildPolicyReports(events)
+
+	// Reports are only written by drift-detection-manager: take over any conflicting field
+	force := true
+	for namespace, report := range reports {
+		var ri dynamic.ResourceInterface = client.Resource(clusterPolicyReportGVR)
+		if namespace != "" {
+			ri = client.Resource(policyReportGVR).Namespace(namespace)
+		}
+		data, err := report.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		_, err = ri.Patch(ctx, policyReportName, types.ApplyPatchType, data,
+			metav1.PatchOptions{FieldManager: policyReportManagedBy, Force: &force})
+		if err != nil {
+			return err
+		}
+	}
+
+	selector := metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", policyReportManagedByLabel, policyReportManagedBy)}
+	for _, gvr := range []schema.GroupVersionResource{policyReportGVR, clusterPolicyReportGVR} {
+		list, err := client.Resource(gvr).Namespace(metav1.NamespaceAll).List(ctx, selector)
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			if _, ok := reports[list.Items[i].GetNamespace()]; ok {
+				continue
+			}
+			var ri dynamic.ResourceInterface = client.Resource(gvr)
+			if gvr == policyReportGVR {
+				ri = client.Resource(gvr).Namespace(list.Items[i].GetNamespace())
+			}
+			err = ri.Delete(ctx, list.Items[i].GetName(), metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// buildPolicyReports returns, per namespace, the report containing a result for each resource
+// of the namespace which drifted. Empty namespace is the ClusterPolicyReport.
+func buildPolicyReports(events []DriftEvent) map[string]*unstructured.Unstructured {
+	// Most recent drift event of each resource
+	latest := make(map[corev1.ObjectReference]*DriftEvent)
+	for i := range events {
+		latest[events[i].Resource] = &events[i]
+	}
+
+	resources := make([]corev1.ObjectReference, 0, len(latest))
+	for resource := range latest {
+		resources = append(resources, resource)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return getInventoryEntry(&resources[i]) < getInventoryEntry(&resources[j])
+	})
+
+	results := make(map[string][]interface{})
+	// Key: namespace, Value: number of results per status
+	counts := make(map[string]map[string]int64)
+	for i := range resources {
+		namespace := resources[i].Namespace
+		result, status := getPolicyReportResult(latest[resources[i]])
+		results[namespace] = append(results[namespace], result)
+		if counts[namespace] == nil {
+			counts[namespace] = make(map[string]int64)
+		}
+		counts[namespace][status]++
+	}
+
+	reports := make(map[string]*unstructured.Unstructured, len(results))
+	for namespace := range results {
+		summary := make(map[string]interface{})
+		for _, status := range []string{"pass", "fail", "warn", "error", "skip"} {
+			summary[status] = counts[namespace][status]
+		}
+		report := &unstructured.Unstructured{Object: map[string]interface{}{
+			"results": results[namespace],
+			"summary": summary,
+		}}
+		report.SetAPIVersion(policyReportGVR.GroupVersion().String())
+		report.SetKind("ClusterPolicyReport")
+		if namespace != "" {
+			report.SetKind("PolicyReport")
+			report.SetNamespace(namespace)
+		}
+		report.SetName(policyReportName)
+		report.SetLabels(map[string]string{policyReportManagedByLabel: policyReportManagedBy})
+		reports[namespace] = report
+	}
+	return reports
+}
+
+// getPolicyReportResult returns the PolicyReport result of event, along with its status
+func getPolicyReportResult(event *DriftEvent) (result map[string]interface{}, status string) {
+	status = "fail"
+	rule := "modified"
+	switch {
+	case event.PrunedBy != "":
+		status, rule = "skip", "pruned"
+	case event.ValuesDrift:
+		rule = "helm-values"
+	case event.Deleted:
+		rule = "deleted"
+	}
+	if event.ReportOnly && status == "fail" {
+		status = "warn"
+	}
+
+	consumers := make([]string, len(event.Consumers))
+	for i := range event.Consumers {
+		consumers[i] = fmt.Sprintf("%s/%s", event.Consumers[i].Namespace, event.Consumers[i].Name)
+	}
+
+	resource := map[string]interface{}{
+		"apiVersion": event.Resource.APIVersion,
+		"kind":       event.Resource.Kind,
+		"name":       event.Resource.Name,
+	}
+	if event.Resource.Namespace != "" {
+		resource["namespace"] = event.Resource.Namespace
+	}
+
+	result = map[string]interface{}{
+		"source":   policyReportSource,
+		"policy":   policyReportPolicy,
+		"rule":     rule,
+		"category": "Configuration Drift",
+		"result":   status,
+		"message":  getDriftEventMessage(event),
+		"timestamp": map[string]interface{}{
+			"seconds": event.Time.Unix(),
+			"nanos":   int64(event.Time.Nanosecond()),
+		},
+		"resources": []interface{}{resource},
+		"properties": map[string]interface{}{
+			"sequence":  strconv.FormatUint(event.Sequence, 10),
+			"consumers": strings.Join(consumers, ","),
+		},
+	}
+	return result, status
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Secret values must never leave drift-detection-manager: not in logs, drift details, API
+// responses nor debug dumps. Anything derived from Secret content and exposed goes through
+// this file:
+//   - hashes of Secrets are replaced by keyed digests (see exposedHash). A plain SHA-256 of a
+//     Secret with low entropy values could be brute-forced offline;
+//   - Secret objects are redacted (see RedactObject): only keys are kept, with values replaced
+//     by keyed per-key digests, so that changed keys can still be told apart. Drift expressions
+//     and Lua hooks, whose errors are logged, are only given redacted objects;
+//   - drift events and inspect output (see GetState) contain references and exposed hashes only.
+// Digests are keyed with a random per-process key: they can be compared with each other while
+// drift-detection-manager runs, but reveal nothing about values.
+// Persisted state (see SetSnapshot) contains hashes only, never values, and is written with
+// owner-only permissions.
+
+const (
+	redactedDigestPrefix = "redacted:"
+
+	// lastAppliedAnnotation contains, when set by kubectl apply, the whole object, values included
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+// secretDataFields are the Secret fields containing values
+var secretDataFields = []string{"data", "stringData"}
+
+// redactionKey keys the digests of Secret content
+var redactionKey = newRedactionKey()
+
+func newRedactionKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to generate redaction key: %v", err))
+	}
+	return key
+}
+
+// redactedDigest returns a keyed digest of value
+func redactedDigest(value []byte) string {
+	mac := hmac.New(sha256.New, redactionKey)
+	mac.Write(value)
+	// 16 bytes are enough to tell values apart
+	return redactedDigestPrefix + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// isSecret returns true if resource is a Secret
+func isSecret(resourceRef *corev1.ObjectReference) bool {
+	return resourceRef.Kind == "Secret" && resourceRef.GroupVersionKind().Group == ""
+}
+
+// exposedHash returns the hex encoded hash of resource as it can be exposed (logs, API).
+// For Secrets, a keyed digest of hash is returned instead.
+func exposedHash(resourceRef *corev1.ObjectReference, hash []byte) string {
+	if hash == nil {
+		return ""
+	}
+	if isSecret(resourceRef) {
+		return redactedDigest(hash)
+	}
+	return hex.EncodeToString(hash)
+}
+
+// RedactObject returns u as it can be exposed (logs, drift details, debug dumps). For Secrets, a
+// copy is returned where values are replaced by keyed per-key digests and the last applied
+// configuration annotation is redacted. Any other object is returned unchanged.
+func RedactObject(u *unstructured.Unstructured) *unstructured.Unstructured {
+	resourceRef := &corev1.ObjectReference{APIVersion: u.GetAPIVersion(), Kind: u.GetKind()}
+	if !isSecret(resourceRef) {
+		return u
+	}
+
+	redacted := u.DeepCopy()
+	content := redacted.UnstructuredContent()
+	for _, field := range secretDataFields {
+		data, ok := content[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for k, v := range data {
+			data[k] = redactedDigest([]byte(fmt.Sprintf("%v", v)))
+		}
+	}
+
+	annotations := redacted.GetAnnotations()
+	if value, ok := annotations[lastAppliedAnnotation]; ok {
+		annotations[lastAppliedAnnotation] = redactedDigest([]byte(value))
+		redacted.SetAnnotations(annotations)
+	}
+
+	return redacted
+}
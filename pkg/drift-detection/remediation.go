@@ -0,0 +1,136 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+const (
+	// maxPendingRemediations is the number of drift events kept, per ResourceSummary, while
+	// waiting for Sveltos to remediate them. Older ones are dropped.
+	maxPendingRemediations = 100
+)
+
+// DriftEventSink receives drift events as they are recorded, and remediations of those by Sveltos
+// (see AddDriftEventSink). Methods must not block.
+type DriftEventSink interface {
+	// DriftDetected is called for each drift event
+	DriftDetected(event *DriftEvent)
+
+	// DriftRemediated is called once Sveltos reconciled resourceSummary, marked for reconciliation
+	// because of event
+	DriftRemediated(event *DriftEvent, resourceSummary *corev1.ObjectReference)
+}
+
+// pendingRemediation contains the drift events a ResourceSummary was marked for reconciliation for
+type pendingRemediation struct {
+	events []DriftEvent
+
+	// marked is set once ResourceSummary was seen marked for reconciliation. Drifts are
+	// remediated when, after that, ResourceSummary is seen not marked anymore.
+	marked bool
+}
+
+// remediationTracker tracks drift events reported to ResourceSummaries till Sveltos remediates them
+type remediationTracker struct {
+	mu sync.Mutex
+	// Key: ResourceSummary
+	pending map[corev1.ObjectReference]*pendingRemediation
+}
+
+// add records that event was reported to its consumers. Report-only events are never remediated.
+func (t *remediationTracker) add(event *DriftEvent) {
+	if event.ReportOnly {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pending == nil {
+		t.pending = make(map[corev1.ObjectReference]*pendingRemediation)
+	}
+	for i := range event.Consumers {
+		p, ok := t.pending[event.Consumers[i]]
+		if !ok {
+			p = &pendingRemediation{}
+			t.pending[event.Consumers[i]] = p
+		}
+		if len(p.events) == maxPendingRemediations {
+			p.events = p.events[1:]
+		}
+		p.events = append(p.events, *event)
+	}
+}
+
+// take returns the drift events remediated by the reconciliation of resourceSummary, if any
+func (t *remediationTracker) take(requestor *corev1.ObjectReference, resourceSummary *libsveltosv1alpha1.ResourceSummary,
+) []DriftEvent {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.pending[*requestor]
+	if !ok {
+		return nil
+	}
+	if resourceSummary.Status.ResourcesChanged || resourceSummary.Status.HelmResourcesChanged {
+		p.marked = true
+		return nil
+	}
+	if !p.marked {
+		// Drifts were recorded but ResourceSummary was not marked for reconciliation yet
+		return nil
+	}
+	delete(t.pending, *requestor)
+	return p.events
+}
+
+// forget drops drift events pending for requestor
+func (t *remediationTracker) forget(requestor *corev1.ObjectReference) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, *requestor)
+}
+
+// ObserveRemediations hands to the drift event sinks, if any, the drifts remediated by Sveltos:
+// drifts ResourceSummary requestor was marked for reconciliation for, once it is not marked anymore.
+func (m *manager) ObserveRemediations(requestor *corev1.ObjectReference,
+	resourceSummary *libsveltosv1alpha1.ResourceSummary) {
+
+	if len(driftEventSinks) == 0 {
+		return
+	}
+
+	events := m.remediations.take(requestor, resourceSummary)
+	for i := range events {
+		for j := range driftEventSinks {
+			driftEventSinks[j].DriftRemediated(&events[i], requestor)
+		}
+	}
+}
+
+// ForgetRemediations drops drifts, reported to ResourceSummary requestor, not remediated yet
+func (m *manager) ForgetRemediations(requestor *corev1.ObjectReference) {
+	m.remediations.forget(requestor)
+}
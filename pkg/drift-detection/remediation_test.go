@@ -0,0 +1,99 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+type fakeDriftEventSink struct {
+	detected   []driftdetection.DriftEvent
+	remediated []driftdetection.DriftEvent
+}
+
+func (s *fakeDriftEventSink) DriftDetected(event *driftdetection.DriftEvent) {
+	s.detected = append(s.detected, *event)
+}
+
+func (s *fakeDriftEventSink) DriftRemediated(event *driftdetection.DriftEvent, _ *corev1.ObjectReference) {
+	s.remediated = append(s.remediated, *event)
+}
+
+var _ = Describe("Remediation", func() {
+	var sink *fakeDriftEventSink
+	var resource, requestor *corev1.ObjectReference
+
+	BeforeEach(func() {
+		sink = &fakeDriftEventSink{}
+		driftdetection.AddDriftEventSink(sink)
+
+		resource = &corev1.ObjectReference{
+			APIVersion: "v1", Kind: "ConfigMap", Namespace: randomString(), Name: randomString(),
+		}
+		requestor = &corev1.ObjectReference{
+			APIVersion: libsveltosv1alpha1.GroupVersion.String(), Kind: libsveltosv1alpha1.ResourceSummaryKind,
+			Namespace: randomString(), Name: randomString(),
+		}
+	})
+
+	AfterEach(func() {
+		driftdetection.ResetDriftEventSinks()
+	})
+
+	It("only hands actual drifts to the drift event sink", func() {
+		manager := driftdetection.NewTrackingManager()
+		manager.AddResource(resource, requestor)
+
+		driftdetection.RecordPrunedEvent(manager, resource, "Kustomization default/apps")
+		driftdetection.RecordFluxOwnedDriftEvent(manager, resource, "Kustomization default/apps")
+		Expect(sink.detected).To(BeEmpty())
+
+		driftdetection.RecordDriftEvent(manager, resource, false)
+		Expect(sink.detected).To(HaveLen(1))
+		Expect(sink.detected[0].Resource).To(Equal(*resource))
+	})
+
+	It("reports drifts remediated once ResourceSummary is reconciled", func() {
+		manager := driftdetection.NewTrackingManager()
+		manager.AddResource(resource, requestor)
+		driftdetection.RecordDriftEvent(manager, resource, false)
+
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{}
+		// Not marked for reconciliation yet
+		manager.ObserveRemediations(requestor, resourceSummary)
+		Expect(sink.remediated).To(BeEmpty())
+
+		resourceSummary.Status.ResourcesChanged = true
+		manager.ObserveRemediations(requestor, resourceSummary)
+		Expect(sink.remediated).To(BeEmpty())
+
+		resourceSummary.Status.ResourcesChanged = false
+		manager.ObserveRemediations(requestor, resourceSummary)
+		Expect(sink.remediated).To(HaveLen(1))
+
+		// Remediations are only reported once
+		manager.ObserveRemediations(requestor, resourceSummary)
+		Expect(sink.remediated).To(HaveLen(1))
+	})
+})
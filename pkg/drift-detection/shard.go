@@ -0,0 +1,172 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+
+	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
+)
+
+// gvkShard contains the internal bookkeeping for all tracked resources of a GVK.
+// Each shard has its own lock, so registering resources of one kind does not block
+// evaluations and watch notifications for unrelated kinds.
+//
+// Lock ordering: manager lock, when needed, must be acquired before a shard lock.
+// A shard lock is never held while acquiring the manager lock or another shard lock.
+type gvkShard struct {
+	mu sync.RWMutex
+
+	// Contains hash for a resource. This hash is used to detect where a configuration
+	// drift has happened.
+	// Set first time a resource starts being watched for change and any time a configuration
+	// drift is detected and reported.
+	resourceHashes map[corev1.ObjectReference]compactHash
+
+	// Contains, for a resource, the revision its hash in resourceHashes was
+	// evaluated from. Used to skip duplicate events (relists, resyncs) for a revision
+	// already evaluated.
+	evaluatedRevisions map[corev1.ObjectReference]revision
+
+	// eventObjects contains, for queued resources, the latest object carried
+	// by an update watch event. Only populated with SpecHashMode, in which case
+	// resources are evaluated from it instead of being fetched again.
+	eventObjects map[corev1.ObjectReference]*unstructured.Unstructured
+
+	// dataDigests contains, for large ConfigMaps/Secrets hashed incrementally, the digest
+	// of each data key. Key: field/key (e.g. data/config.yaml)
+	dataDigests map[corev1.ObjectReference]map[string]keyDigest
+
+	// driftStreaks contains, for resources found drifted but whose drift has not been
+	// reported yet, the number of consecutive evaluations which found them drifted
+	driftStreaks map[corev1.ObjectReference]uint
+
+	// pollSchedules contains, for resources of a GVK in polling mode, when resource
+	// is next evaluated. Only used with adaptive polling.
+	pollSchedules map[corev1.ObjectReference]pollSchedule
+
+	// existenceChecks contains resources queued because they were possibly deleted.
+	// Those are evaluated by fetching their metadata first (see getObjectForEvaluation).
+	existenceChecks map[corev1.ObjectReference]bool
+
+	// inventories contains, for resources listed by an inventory, such inventory.
+	// Only populated when inventory correlation is enabled (see SetInventoryCorrelation).
+	inventories map[corev1.ObjectReference]inventoryRef
+
+	// resources contains all tracked resources of the GVK. GVK is watched (or polled)
+	// as long as this is not empty.
+	resources *libsveltosset.Set
+
+	// cancel stops the GVK watcher. Nil if no watcher is running.
+	cancel context.CancelFunc
+
+	// pendingWatcher is set when GVK started being tracked while internal state was
+	// being rebuilt on startup. Watcher is started once rebuilding is over.
+	pendingWatcher bool
+
+	// informers caching all instances of the GVK. Nil if no watcher is running.
+	informers informerSet
+
+	// polled is set when watcher was stopped because memory budget was exceeded.
+	// Resources of the GVK are periodically queued for evaluation instead.
+	polled bool
+}
+
+// informerSet contains the informers watching a GVK: a single one for all namespaces or,
+// when included namespaces are set, one per included namespace
+type informerSet []cache.SharedIndexInformer
+
+// hasSynced returns true once all informers have synced
+func (s informerSet) hasSynced() bool {
+	for i := range s {
+		if !s[i].HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// size returns the number of cached objects
+func (s informerSet) size() int {
+	size := 0
+	for i := range s {
+		size += len(s[i].GetStore().ListKeys())
+	}
+	return size
+}
+
+// getByKey returns the cached object with key (namespace/name or name)
+func (s informerSet) getByKey(key string) (item interface{}, exists bool, err error) {
+	for i := range s {
+		item, exists, err = s[i].GetStore().GetByKey(key)
+		if err != nil || exists {
+			return item, exists, err
+		}
+	}
+	return nil, false, nil
+}
+
+func newGVKShard() *gvkShard {
+	shard := &gvkShard{}
+	shard.reset()
+	return shard
+}
+
+// reset drops all bookkeeping. Watcher, if any, must be stopped first.
+// Must be called with shard lock held (or on a shard not shared yet).
+func (s *gvkShard) reset() {
+	s.resourceHashes = make(map[corev1.ObjectReference]compactHash)
+	s.evaluatedRevisions = make(map[corev1.ObjectReference]revision)
+	s.eventObjects = make(map[corev1.ObjectReference]*unstructured.Unstructured)
+	s.dataDigests = make(map[corev1.ObjectReference]map[string]keyDigest)
+	s.driftStreaks = make(map[corev1.ObjectReference]uint)
+	s.pollSchedules = make(map[corev1.ObjectReference]pollSchedule)
+	s.existenceChecks = make(map[corev1.ObjectReference]bool)
+	s.inventories = make(map[corev1.ObjectReference]inventoryRef)
+	s.resources = &libsveltosset.Set{}
+	s.pendingWatcher = false
+	s.polled = false
+}
+
+// getShard returns the shard for gvk, creating it if it does not exist yet.
+// Shards are never removed: number of GVKs is bounded.
+func (m *manager) getShard(gvk schema.GroupVersionKind) *gvkShard {
+	if v, ok := m.shards.Load(gvk); ok {
+		return v.(*gvkShard)
+	}
+	v, _ := m.shards.LoadOrStore(gvk, newGVKShard())
+	return v.(*gvkShard)
+}
+
+// getResourceShard returns the shard for the GVK of resourceRef
+func (m *manager) getResourceShard(resourceRef *corev1.ObjectReference) *gvkShard {
+	return m.getShard(resourceRef.GroupVersionKind())
+}
+
+// rangeShards calls f for each shard. f is responsible for locking the shard.
+func (m *manager) rangeShards(f func(gvk schema.GroupVersionKind, shard *gvkShard)) {
+	m.shards.Range(func(key, value any) bool {
+		f(key.(schema.GroupVersionKind), value.(*gvkShard))
+		return true
+	})
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// CheckpointStatus is the outcome of persisting state on termination
+type CheckpointStatus string
+
+const (
+	// CheckpointDisabled means state is not persisted (see SetSnapshot)
+	CheckpointDisabled = CheckpointStatus("disabled")
+
+	// CheckpointSkipped means state was not persisted because internal state was not rebuilt
+	// yet: persisting it would overwrite a complete snapshot with a partial one
+	CheckpointSkipped = CheckpointStatus("skipped")
+
+	// CheckpointWritten means state was persisted
+	CheckpointWritten = CheckpointStatus("written")
+
+	// CheckpointFailed means persisting state failed
+	CheckpointFailed = CheckpointStatus("failed")
+)
+
+// ShutdownReport summarizes drift detection state on termination
+type ShutdownReport struct {
+	// Initialized is set if internal state was rebuilt from existing ResourceSummaries
+	Initialized bool `json:"initialized"`
+
+	// TrackedResources is the number of tracked resources
+	TrackedResources int `json:"trackedResources"`
+
+	// PendingEvaluations is the number of resources waiting to be evaluated
+	PendingEvaluations int `json:"pendingEvaluations"`
+
+	// UnflushedDrifts is the number of drifted resources whose ResourceSummaries could not be
+	// updated yet. Those are persisted with state of tracked resources, if any.
+	UnflushedDrifts int `json:"unflushedDrifts"`
+
+	Checkpoint CheckpointStatus `json:"checkpoint"`
+
+	CheckpointError string `json:"checkpointError,omitempty"`
+}
+
+// Degraded returns true if state was lost on termination: detected drifts were neither
+// reported nor persisted, or state could not be persisted
+func (r *ShutdownReport) Degraded() bool {
+	return (r.UnflushedDrifts != 0 && r.Checkpoint != CheckpointWritten) || r.Checkpoint == CheckpointFailed
+}
+
+// Shutdown persists, one last time, state of tracked resources (see SetSnapshot) and returns
+// a report of drift detection state. Must be called on termination, once manager context
+// is canceled.
+func Shutdown() *ShutdownReport {
+	report := &ShutdownReport{Checkpoint: CheckpointDisabled}
+
+	m, err := GetManager()
+	if err != nil || !m.initialized.Load() {
+		if snapshotStore != nil {
+			report.Checkpoint = CheckpointSkipped
+		}
+		return report
+	}
+
+	report.Initialized = true
+	report.TrackedResources = m.countTrackedResources()
+	report.UnflushedDrifts = m.countPendingDrifts()
+
+	m.mu.RLock()
+	report.PendingEvaluations = m.jobQueue.Len()
+	m.mu.RUnlock()
+
+	if snapshotStore != nil {
+		report.Checkpoint = CheckpointWritten
+		if err := m.writeSnapshot(); err != nil {
+			report.Checkpoint = CheckpointFailed
+			report.CheckpointError = err.Error()
+		}
+	}
+
+	return report
+}
+
+// countTrackedResources returns the number of tracked resources
+func (m *manager) countTrackedResources() int {
+	count := 0
+	m.rangeShards(func(_ schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		count += shard.resources.Len()
+	})
+	return count
+}
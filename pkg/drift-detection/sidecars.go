@@ -0,0 +1,174 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Istio and Linkerd inject their proxy, as sidecar container plus init containers, volumes,
+// labels and annotations, into pods. When injection also ends up in pod templates (e.g. istioctl
+// kube-inject, or mutating webhooks matching workloads), every injection would be reported as a
+// configuration drift. When sidecar normalization is enabled (see SetSidecarNormalization), what
+// service meshes inject is removed from pod templates before hashing.
+
+// injectedContainers contains the containers and init containers injected by service meshes
+var injectedContainers = map[string]bool{
+	"istio-proxy":               true,
+	"istio-init":                true,
+	"istio-validation":          true,
+	"linkerd-proxy":             true,
+	"linkerd-init":              true,
+	"linkerd-network-validator": true,
+	"linkerd-debug":             true,
+}
+
+// injectedVolumes contains the volumes injected by service meshes
+var injectedVolumes = map[string]bool{
+	"istio-envoy":                     true,
+	"istio-data":                      true,
+	"istio-podinfo":                   true,
+	"istio-token":                     true,
+	"istiod-ca-cert":                  true,
+	"workload-socket":                 true,
+	"credential-socket":               true,
+	"workload-certs":                  true,
+	"linkerd-proxy-init-xtables-lock": true,
+	"linkerd-identity-end-entity":     true,
+	"linkerd-identity-token":          true,
+}
+
+// injectedMetadata contains the pod template labels and annotations set by service meshes on injection
+var injectedMetadata = map[string]bool{
+	"sidecar.istio.io/status":                      true,
+	"security.istio.io/tlsMode":                    true,
+	"service.istio.io/canonical-name":              true,
+	"service.istio.io/canonical-revision":          true,
+	"kubectl.kubernetes.io/default-container":      true,
+	"kubectl.kubernetes.io/default-logs-container": true,
+	"linkerd.io/created-by":                        true,
+	"linkerd.io/proxy-version":                     true,
+	"linkerd.io/trust-root-sha256":                 true,
+	"linkerd.io/identity-mode":                     true,
+	"linkerd.io/control-plane-ns":                  true,
+	"linkerd.io/proxy-deployment":                  true,
+	"linkerd.io/proxy-statefulset":                 true,
+	"linkerd.io/proxy-daemonset":                   true,
+	"linkerd.io/workload-ns":                       true,
+	"viz.linkerd.io/tap-enabled":                   true,
+}
+
+// podTemplatePaths contains where pod templates are, in workloads
+var podTemplatePaths = [][]string{
+	// Deployment, StatefulSet, DaemonSet, ReplicaSet, Job
+	{"spec", "template"},
+	// CronJob
+	{"spec", "jobTemplate", "spec", "template"},
+}
+
+// normalizeSidecars returns u without what service meshes inject into its pod template, if any.
+// u is returned unchanged if nothing was injected, a modified copy otherwise.
+func normalizeSidecars(u *unstructured.Unstructured) *unstructured.Unstructured {
+	if !sidecarNormalization {
+		return u
+	}
+
+	var normalized *unstructured.Unstructured
+	for _, path := range podTemplatePaths {
+		template, ok := getNestedMap(u.Object, path)
+		if !ok || !removeInjected(template, true) {
+			continue
+		}
+		if normalized == nil {
+			normalized = u.DeepCopy()
+		}
+		copied, _ := getNestedMap(normalized.Object, path)
+		removeInjected(copied, false)
+	}
+
+	if normalized == nil {
+		return u
+	}
+	return normalized
+}
+
+// removeInjected removes, from a pod template, what service meshes inject. With dryRun template
+// is not modified. Returns true if anything was (or would be) removed.
+func removeInjected(template map[string]interface{}, dryRun bool) bool {
+	removed := false
+	if metadata, ok := template["metadata"].(map[string]interface{}); ok {
+		for _, field := range []string{"labels", "annotations"} {
+			values, ok := metadata[field].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for key := range values {
+				if injectedMetadata[key] {
+					removed = true
+					if !dryRun {
+						delete(values, key)
+					}
+				}
+			}
+		}
+	}
+
+	spec, ok := template["spec"].(map[string]interface{})
+	if !ok {
+		return removed
+	}
+	for field, injected := range map[string]map[string]bool{
+		"containers":     injectedContainers,
+		"initContainers": injectedContainers,
+		"volumes":        injectedVolumes,
+	} {
+		items, ok := spec[field].([]interface{})
+		if !ok {
+			continue
+		}
+		kept := make([]interface{}, 0, len(items))
+		for i := range items {
+			item, _ := items[i].(map[string]interface{})
+			if name, _ := item["name"].(string); injected[name] {
+				removed = true
+				continue
+			}
+			kept = append(kept, items[i])
+		}
+		if !dryRun && len(kept) != len(items) {
+			if len(kept) == 0 {
+				delete(spec, field)
+			} else {
+				spec[field] = kept
+			}
+		}
+	}
+	return removed
+}
+
+// getNestedMap returns the map at path in content
+func getNestedMap(content map[string]interface{}, path []string) (map[string]interface{}, bool) {
+	current := content
+	for _, field := range path {
+		next, ok := current[field].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current = next
+	}
+	return current, true
+}
@@ -0,0 +1,308 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// snapshotStoreTimeout bounds reads and writes of persisted state
+const snapshotStoreTimeout = time.Minute
+
+// SnapshotStore is where state of tracked resources is persisted (see SetSnapshotStore).
+// Data is opaque (and possibly encrypted, see SetSnapshotEncryption).
+type SnapshotStore interface {
+	// Write replaces the persisted state with data
+	Write(ctx context.Context, data []byte) error
+
+	// Read returns the persisted state. Nil if none was persisted yet.
+	Read(ctx context.Context) ([]byte, error)
+}
+
+// fileSnapshotStore persists state to a local file (see SetSnapshot)
+type fileSnapshotStore struct {
+	path string
+}
+
+// Write replaces file atomically
+func (s *fileSnapshotStore) Write(_ context.Context, data []byte) error {
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write snapshot file")
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+func (s *fileSnapshotStore) Read(_ context.Context) ([]byte, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// snapshotEntry is the persisted state of a tracked resource
+type snapshotEntry struct {
+	Resource        corev1.ObjectReference `json:"resource"`
+	ResourceVersion string                 `json:"resourceVersion"`
+	Generation      int64                  `json:"generation,omitempty"`
+	Hash            []byte                 `json:"hash"`
+}
+
+// stateSnapshot is the persisted state of all tracked resources. It allows a warm restart:
+// on startup, resources present in the snapshot are neither fetched nor hashed again. Once
+// watchers are established, any resource whose resourceVersion does not match the persisted
+// one is queued for evaluation (see queueChangedSinceRegistration).
+type stateSnapshot struct {
+	// HashMode and FieldExclusions (digest of field exclusions) the hashes were evaluated with.
+	// A snapshot taken with different settings is ignored.
+	HashMode        HashMode `json:"hashMode"`
+	FieldExclusions string   `json:"fieldExclusions,omitempty"`
+
+	// ClusterUID identifies the cluster (see getClusterUID) snapshot was taken on. A snapshot
+	// taken before cluster was re-provisioned is ignored.
+	ClusterUID types.UID `json:"clusterUID,omitempty"`
+
+	Entries []snapshotEntry `json:"entries"`
+
+	// PendingUpdates contains the changes to ResourceSummaries which could not be applied yet.
+	// Hashes in Entries already account for those drifts, so they would be lost on restart
+	// if not persisted.
+	PendingUpdates []snapshotUpdate `json:"pendingUpdates,omitempty"`
+}
+
+// snapshotUpdate is a persisted change to a ResourceSummary which could not be applied yet
+type snapshotUpdate struct {
+	ResourceSummary      corev1.ObjectReference `json:"resourceSummary"`
+	ResourcesChanged     bool                   `json:"resourcesChanged,omitempty"`
+	HelmResourcesChanged bool                   `json:"helmResourcesChanged,omitempty"`
+	Hashes               []snapshotHash         `json:"hashes"`
+}
+
+// snapshotHash is the hash of a drifted resource. Nil if resource was deleted.
+type snapshotHash struct {
+	Resource corev1.ObjectReference `json:"resource"`
+	Hash     []byte                 `json:"hash,omitempty"`
+}
+
+// persistSnapshot periodically persists the state of all tracked resources till ctx is canceled.
+// Last snapshot is written on termination (see Shutdown).
+func (m *manager) persistSnapshot(ctx context.Context) {
+	if snapshotStore == nil {
+		return
+	}
+
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Internal state is being rebuilt (see resetBaselines): it would be persisted partially
+			if !m.initialized.Load() {
+				continue
+			}
+			if err := m.writeSnapshot(); err != nil {
+				m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to persist state: %v", err))
+			}
+		}
+	}
+}
+
+// writeSnapshot persists the state of all tracked resources
+func (m *manager) writeSnapshot() error {
+	m.snapshotMu.Lock()
+	defer m.snapshotMu.Unlock()
+
+	snapshot := &stateSnapshot{HashMode: hashMode, FieldExclusions: fieldExclusionsDigest,
+		ClusterUID: m.loadClusterUID()}
+	m.rangeShards(func(_ schema.GroupVersionKind, shard *gvkShard) {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		for ref, hash := range shard.resourceHashes {
+			evaluated, ok := shard.evaluatedRevisions[ref]
+			// Resources pending evaluation or deleted are not persisted
+			if !ok || evaluated.resourceVersion == "" || hash == (compactHash{}) {
+				continue
+			}
+			snapshot.Entries = append(snapshot.Entries, snapshotEntry{Resource: ref,
+				ResourceVersion: evaluated.resourceVersion, Generation: evaluated.generation, Hash: hash.bytes()})
+		}
+	})
+
+	pending := m.getPendingUpdates()
+	for ref, update := range pending {
+		persisted := snapshotUpdate{ResourceSummary: ref, ResourcesChanged: update.resourcesChanged,
+			HelmResourcesChanged: update.helmResourcesChanged}
+		for i := range update.resources {
+			persisted.Hashes = append(persisted.Hashes,
+				snapshotHash{Resource: update.resources[i], Hash: update.hashes[update.resources[i]]})
+		}
+		snapshot.PendingUpdates = append(snapshot.PendingUpdates, persisted)
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	data, err = sealSnapshot(data)
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt snapshot")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotStoreTimeout)
+	defer cancel()
+	if err := snapshotStore.Write(ctx, data); err != nil {
+		return err
+	}
+
+	persisted := 0
+	for _, update := range pending {
+		persisted += len(update.resources)
+	}
+	m.pending.mu.Lock()
+	m.pending.persisted = persisted
+	m.pending.mu.Unlock()
+	return nil
+}
+
+// loadSnapshot loads the persisted state, if any, so that resources can be registered from it
+func (m *manager) loadSnapshot() {
+	// Persisted state predates re-provisioning of the cluster if baselines are being reset
+	if snapshotStore == nil || m.resetting.Load() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotStoreTimeout)
+	defer cancel()
+	data, err := snapshotStore.Read(ctx)
+	if err != nil {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to read snapshot: %v", err))
+		return
+	}
+	if data == nil {
+		return
+	}
+
+	data, err = openSnapshot(data)
+	if err != nil {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to decrypt snapshot: %v", err))
+		return
+	}
+
+	snapshot := &stateSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to parse snapshot: %v", err))
+		return
+	}
+
+	if snapshot.HashMode != hashMode || snapshot.FieldExclusions != fieldExclusionsDigest {
+
+		m.log.V(logs.LogInfo).Info("snapshot was taken with different hash settings. Ignoring it.")
+		return
+	}
+
+	if current := m.loadClusterUID(); snapshot.ClusterUID != "" && current != "" && snapshot.ClusterUID != current {
+		m.reportClusterRecreated(snapshot.ClusterUID, current)
+		m.log.V(logs.LogInfo).Info("snapshot was taken before cluster was re-provisioned. Ignoring it.")
+		return
+	}
+
+	for i := range snapshot.Entries {
+		m.snapshot.Store(snapshot.Entries[i].Resource, &snapshot.Entries[i])
+	}
+	m.log.V(logs.LogInfo).Info(fmt.Sprintf("loaded snapshot with %d resources", len(snapshot.Entries)))
+
+	// Buffered changes are flushed by first evaluation cycle
+	for i := range snapshot.PendingUpdates {
+		persisted := &snapshot.PendingUpdates[i]
+		update := &resourceSummaryUpdate{resourcesChanged: persisted.ResourcesChanged,
+			helmResourcesChanged: persisted.HelmResourcesChanged, hashes: make(map[corev1.ObjectReference][]byte)}
+		for j := range persisted.Hashes {
+			update.hashes[persisted.Hashes[j].Resource] = persisted.Hashes[j].Hash
+			update.resources = append(update.resources, persisted.Hashes[j].Resource)
+		}
+		m.bufferUpdate(&persisted.ResourceSummary, update)
+	}
+	if len(snapshot.PendingUpdates) != 0 {
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("loaded %d buffered ResourceSummary updates", len(snapshot.PendingUpdates)))
+	}
+}
+
+// PersistedHashes are the hashes of the resources tracked in a cluster, read from its persisted
+// state. Hashes can be compared across clusters only if evaluated with same hash settings.
+type PersistedHashes struct {
+	HashMode HashMode
+	// FieldExclusions identifies the field exclusions (see SetFieldExclusions) hashes were evaluated with
+	FieldExclusions string
+	Hashes          map[corev1.ObjectReference][]byte
+}
+
+// ReadPersistedHashes returns the hashes of tracked resources in data, state persisted by a
+// drift-detection-manager (see SetSnapshot). Encrypted state requires the KeyEncryptionService
+// it was encrypted with (see SetSnapshotEncryption).
+func ReadPersistedHashes(data []byte) (*PersistedHashes, error) {
+	data, err := openSnapshot(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt snapshot")
+	}
+
+	snapshot := &stateSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, errors.Wrap(err, "failed to parse snapshot")
+	}
+
+	persisted := &PersistedHashes{HashMode: snapshot.HashMode, FieldExclusions: snapshot.FieldExclusions,
+		Hashes: make(map[corev1.ObjectReference][]byte, len(snapshot.Entries))}
+	for i := range snapshot.Entries {
+		persisted.Hashes[snapshot.Entries[i].Resource] = snapshot.Entries[i].Hash
+	}
+	return persisted, nil
+}
+
+// getFromSnapshot returns the persisted revision and hash of resource, if any
+func (m *manager) getFromSnapshot(resourceRef *corev1.ObjectReference) (revision, []byte, bool) {
+	v, ok := m.snapshot.Load(*resourceRef)
+	if !ok {
+		return revision{}, nil, false
+	}
+
+	entry := v.(*snapshotEntry)
+	return revision{resourceVersion: entry.ResourceVersion, generation: entry.Generation}, entry.Hash, true
+}
+
+// clearSnapshot drops the persisted state loaded on startup
+func (m *manager) clearSnapshot() {
+	m.snapshot.Range(func(key, _ any) bool {
+		m.snapshot.Delete(key)
+		return true
+	})
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// TerraformOwnership defines how drifts of resources managed by Terraform are handled.
+// In clusters where both Sveltos and Terraform (Kubernetes provider) manage resources, each tool
+// reverting the other's changes would be reported as a never ending sequence of drifts.
+type TerraformOwnership string
+
+const (
+	// ReportTerraformOwned reports drifts of resources managed by Terraform like any other
+	ReportTerraformOwned = TerraformOwnership("report")
+
+	// ExcludeTerraformFields ignores changes to fields owned, according to managedFields, by
+	// Terraform: only fields managed by Sveltos (or nobody) are evaluated (see TerraformFieldExclusion)
+	ExcludeTerraformFields = TerraformOwnership("exclude-fields")
+
+	// SkipTerraformOwned ignores drifts of whole resources managed by Terraform. Those are only
+	// counted in metrics.
+	SkipTerraformOwned = TerraformOwnership("skip")
+)
+
+const (
+	// managedByLabel is the recommended label identifying the tool managing a resource
+	managedByLabel = "app.kubernetes.io/managed-by"
+
+	// terraformManagedBy is the managedByLabel value of resources managed by Terraform
+	terraformManagedBy = "terraform"
+)
+
+// terraformFieldManagers contains the field managers Terraform Kubernetes provider applies resources
+// with: Terraform for kubernetes_manifest (server-side apply), HashiCorp (from its user agent) for
+// all other resources.
+var terraformFieldManagers = []string{"Terraform", "HashiCorp"}
+
+// TerraformFieldExclusion returns the field exclusion (see SetFieldExclusions) excluding, from any
+// resource, the fields owned by Terraform
+func TerraformFieldExclusion() FieldExclusion {
+	managers := make([]string, len(terraformFieldManagers))
+	copy(managers, terraformFieldManagers)
+	return FieldExclusion{Group: anyValue, Kind: anyValue, ManagedFieldsManagers: managers}
+}
+
+// isTerraformOwned returns true if u is managed by Terraform: either labeled as such, or with
+// fields owned by a Terraform field manager
+func isTerraformOwned(u *unstructured.Unstructured) bool {
+	if strings.EqualFold(u.GetLabels()[managedByLabel], terraformManagedBy) {
+		return true
+	}
+	for _, entry := range u.GetManagedFields() {
+		for _, manager := range terraformFieldManagers {
+			if entry.Manager == manager {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// minThrottleDelay is the pause applied when API server throttles a request
+	// without suggesting how long to wait
+	minThrottleDelay = time.Second
+
+	// maxThrottleDelay bounds the pause applied when API server keeps throttling requests
+	maxThrottleDelay = time.Minute
+)
+
+const (
+	getVerb  = "get"
+	listVerb = "list"
+)
+
+// apiPacer paces GET and LIST requests issued while evaluating and baselining resources.
+// When API server rejects a request with 429 (Too Many Requests), for instance because of
+// API Priority and Fairness, all subsequent requests are held till the delay suggested by
+// API server (Retry-After) has elapsed. If API server does not suggest any delay, the delay
+// doubles every time a request is throttled and halves every time a request succeeds.
+type apiPacer struct {
+	mu sync.Mutex
+
+	// pausedUntil is the time before which no request should be sent
+	pausedUntil time.Time
+
+	// delay is the pause applied next time a request is throttled without Retry-After
+	delay time.Duration
+}
+
+// waitForAPIServer blocks till requests can be sent to API server again.
+// Returns an error only if ctx is canceled meanwhile.
+func (m *manager) waitForAPIServer(ctx context.Context) error {
+	m.pacer.mu.Lock()
+	wait := time.Until(m.pacer.pausedUntil)
+	m.pacer.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	trackThrottleWait(wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// waitForEvaluationBudget blocks till evaluation budget (see SetEvaluationBudget) allows
+// one more evaluation. Returns an error only if ctx is canceled meanwhile.
+func waitForEvaluationBudget(ctx context.Context) error {
+	if evaluationBudget == nil {
+		return nil
+	}
+
+	start := time.Now()
+	if err := evaluationBudget.Wait(ctx); err != nil {
+		return err
+	}
+	trackEvaluationBudgetWait(time.Since(start))
+	return nil
+}
+
+// observeAPIResponse adapts pacing based on the outcome of a request
+func (m *manager) observeAPIResponse(verb string, err error) {
+	m.observeConnectivity(err)
+
+	m.pacer.mu.Lock()
+	defer m.pacer.mu.Unlock()
+
+	if !apierrors.IsTooManyRequests(err) {
+		if err == nil && m.pacer.delay > minThrottleDelay {
+			m.pacer.delay /= 2
+		}
+		return
+	}
+
+	trackThrottledRequest(verb)
+
+	if m.pacer.delay < minThrottleDelay {
+		m.pacer.delay = minThrottleDelay
+	}
+
+	delay := m.pacer.delay
+	if seconds, ok := apierrors.SuggestsClientDelay(err); ok && seconds > 0 {
+		delay = time.Duration(seconds) * time.Second
+	} else {
+		m.pacer.delay *= 2
+		if m.pacer.delay > maxThrottleDelay {
+			m.pacer.delay = maxThrottleDelay
+		}
+	}
+
+	if until := time.Now().Add(delay); until.After(m.pacer.pausedUntil) {
+		m.pacer.pausedUntil = until
+		m.log.V(logs.LogInfo).Info(fmt.Sprintf("API server is throttling %s requests. Pausing for %s", verb, delay))
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driftdetection
+
+// Velero labels each resource it restores with the backup and the restore it comes from. Those
+// labels are not considered when hashing, otherwise a disaster-recovery restore would report every
+// restored resource as drifted, even when restored exactly as Sveltos deployed it.
+
+// veleroRestoreLabels contains the labels Velero sets on restored resources
+var veleroRestoreLabels = []string{
+	"velero.io/backup-name",
+	"velero.io/restore-name",
+}
+
+// hashedLabels returns the labels considered when hashing: labels without Velero restore ones.
+// labels is returned as is if it contains none, a copy otherwise.
+func hashedLabels(labels map[string]interface{}) map[string]interface{} {
+	var filtered map[string]interface{}
+	for _, key := range veleroRestoreLabels {
+		if _, ok := labels[key]; !ok {
+			continue
+		}
+		if filtered == nil {
+			filtered = make(map[string]interface{}, len(labels))
+			for k, v := range labels {
+				filtered[k] = v
+			}
+		}
+		delete(filtered, key)
+	}
+	if filtered == nil {
+		return labels
+	}
+	return filtered
+}
@@ -22,12 +22,13 @@ import (
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/discovery"
-	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
-	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/cache"
 
 	"github.com/projectsveltos/libsveltos/lib/logsettings"
@@ -49,6 +50,9 @@ func (m *manager) react(gvk *schema.GroupVersionKind, obj interface{},
 	logger = logger.WithValues("key", key)
 
 	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	if IsNamespaceExcluded(namespace) {
+		return
+	}
 
 	apiVersion, _ := gvk.ToAPIVersionAndKind()
 
@@ -59,73 +63,169 @@ func (m *manager) react(gvk *schema.GroupVersionKind, obj interface{},
 		Name:       name,
 	}
 
+	// Consumer maps are copy-on-write, so they are read without holding the lock.
+	// Lock is only needed to queue the resource.
+	consumers, ok := m.resources.get(objRef)
+	if !ok {
+		consumers, ok = m.helmResources.get(objRef)
+		if !ok {
+			return
+		}
+	}
+
+	resourceSummaries := consumers.Items()
+	for i := range resourceSummaries {
+		logger.V(logsettings.LogInfo).Info(
+			fmt.Sprintf("Resource in ResourceSummary %s potentially drifted (%s %s/%s)",
+				resourceSummaries[i].Name, objRef.Kind, objRef.Namespace, objRef.Name))
+	}
+
+	// Potential configuration drift here. Queue resource (along with its hash and ResourceSummaries)
+	// to be evaluated. This operation happens in a separate context where errors can be retried.
+
+	// Even if pod restarts by the time operation is queued and before it is processed, all is ok.
+	// on restarts, manager will rebuild its internal state by reading ResourceSummary status, fetching
+	// tracked resources and detecting any resource whose hash has changed.
+
+	// Queuing once is enough
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.checkForConfigurationDrift(objRef)
+}
+
+// isDuplicateEvent returns true if an update watch event does not carry a new revision
+// of the resource (resync) or carries a revision which was already evaluated (relist).
+// With SpecHashMode, for generation aware resources, events not changing generation are
+// also considered duplicated.
+func (m *manager) isDuplicateEvent(gvk *schema.GroupVersionKind, oldObj, newObj interface{}) bool {
+	newU, ok := newObj.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
 
-	if v, ok := m.resources[*objRef]; ok {
-		resourceSummaries := v.Items()
-		for i := range resourceSummaries {
-			resourceSummary := resourceSummaries[i]
+	if oldU, ok := oldObj.(*unstructured.Unstructured); ok {
+		if oldU.GetResourceVersion() == newU.GetResourceVersion() {
+			return true
+		}
+	}
 
-			logger.V(logsettings.LogInfo).Info(
-				fmt.Sprintf("Resource in ResourceSummary %s potentially drifted (%s %s/%s)",
-					resourceSummary.Name, objRef.Kind, objRef.Namespace, objRef.Name))
+	objRef := getObjectRefFromEvent(gvk, newU)
+	return m.isVersionEvaluated(objRef, newU.GetResourceVersion()) ||
+		m.isGenerationEvaluated(objRef, newU.GetGeneration())
+}
 
-			// Potential configuration drift here. Queue resource (along with its hash and ResourceSummaries)
-			// to be evaluated. This operation happens in a separate context where errors can be retried.
+// recordEventObject stores the object carried by an update watch event so that, with
+// SpecHashMode, resource can be evaluated without being fetched again.
+// Only objects of tracked resources are stored.
+func (m *manager) recordEventObject(gvk *schema.GroupVersionKind, obj interface{}) {
+	if hashMode != SpecHashMode {
+		return
+	}
 
-			// Even if pod restarts by the time operation is queued and before it is processed, all is ok.
-			// on restarts, manager will rebuild its internal state by reading ResourceSummary status, fetching
-			// tracked resources and detecting any resource whose hash has changed.
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
 
-			m.checkForConfigurationDrift(objRef)
+	objRef := getObjectRefFromEvent(gvk, u)
 
-			// Queuing once is enough
-			return
-		}
+	shard := m.getShard(*gvk)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if m.stillTrackingResource(objRef) {
+		shard.eventObjects[*objRef] = u
 	}
+}
 
-	if v, ok := m.helmResources[*objRef]; ok {
-		resourceSummaries := v.Items()
-		for i := range resourceSummaries {
-			resourceSummary := resourceSummaries[i]
+// forgetEventObject removes any stored object for a deleted resource. Deleted resources
+// are always fetched again when evaluated.
+func (m *manager) forgetEventObject(gvk *schema.GroupVersionKind, obj interface{}) {
+	if hashMode != SpecHashMode {
+		return
+	}
 
-			logger.V(logsettings.LogInfo).Info(
-				fmt.Sprintf("Resource in ResourceSummary %s potentially drifted (%s %s/%s)",
-					resourceSummary.Name, objRef.Kind, objRef.Namespace, objRef.Name))
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
 
-			// Potential configuration drift here. Queue resource (along with its hash and ResourceSummaries)
-			// to be evaluated. This operation happens in a separate context where errors can be retried.
+	objRef := getObjectRefFromEvent(gvk, u)
 
-			// Even if pod restarts by the time operation is queued and before it is processed, all is ok.
-			// on restarts, manager will rebuild its internal state by reading ResourceSummary status, fetching
-			// tracked resources and detecting any resource whose hash has changed.
+	shard := m.getShard(*gvk)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-			m.checkForConfigurationDrift(objRef)
-		}
+	delete(shard.eventObjects, *objRef)
+}
+
+// recordDeleteEvent records that resource deleted according to a watch event must be
+// evaluated by verifying it still exists first
+func (m *manager) recordDeleteEvent(gvk *schema.GroupVersionKind, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
 	}
+
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	m.recordExistenceCheck(getObjectRefFromEvent(gvk, u))
 }
 
-func (m *manager) stopWatcher(gvk schema.GroupVersionKind) {
-	if cancel, ok := m.watchers[gvk]; ok {
+// takeEventObject returns, and removes, the object stored for resourceRef by last update
+// watch event. Returns nil if none is stored.
+func (m *manager) takeEventObject(resourceRef *corev1.ObjectReference) *unstructured.Unstructured {
+	shard := m.getResourceShard(resourceRef)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	u, ok := shard.eventObjects[*resourceRef]
+	if !ok {
+		return nil
+	}
+	delete(shard.eventObjects, *resourceRef)
+	return u
+}
+
+func getObjectRefFromEvent(gvk *schema.GroupVersionKind, u *unstructured.Unstructured) *corev1.ObjectReference {
+	apiVersion, _ := gvk.ToAPIVersionAndKind()
+
+	return &corev1.ObjectReference{
+		Kind:       gvk.Kind,
+		APIVersion: apiVersion,
+		Namespace:  u.GetNamespace(),
+		Name:       u.GetName(),
+	}
+}
+
+// stopWatcher stops the watcher for gvk, if any.
+// Must be called with shard lock held.
+func (m *manager) stopWatcher(gvk schema.GroupVersionKind, shard *gvkShard) {
+	if shard.cancel != nil {
 		logger := m.log.WithValues("gvk", gvk.String())
 		logger.V(logs.LogInfo).Info("stop watcher for gvk")
-		cancel()
+		shard.cancel()
+		shard.cancel = nil
+		shard.informers = nil
 	}
 }
 
-func (m *manager) startWatcher(ctx context.Context, gvk *schema.GroupVersionKind,
+// startWatcher starts a watcher for gvk.
+// Must be called with shard lock held.
+func (m *manager) startWatcher(ctx context.Context, shard *gvkShard, gvk *schema.GroupVersionKind,
 	react ReactToNotification) error {
 
 	logger := m.log.WithValues("gvk", gvk.String())
 
-	if _, ok := m.watchers[*gvk]; ok {
+	if shard.cancel != nil {
 		logger.V(logsettings.LogDebug).Info("watcher already present")
 		return nil
 	}
 
-	// dynamic informer needs to be told which type to watch
-	dcinformer, err := m.getDynamicInformer(gvk)
+	// dynamic informers need to be told which type to watch
+	dcinformers, err := m.getDynamicInformers(gvk)
 	if err != nil {
 		logger.Error(err, "Failed to get informer")
 		return err
@@ -133,47 +233,171 @@ func (m *manager) startWatcher(ctx context.Context, gvk *schema.GroupVersionKind
 
 	logger.V(logsettings.LogInfo).Info(fmt.Sprintf("start watcher for gvk %s", gvk))
 	watcherCtx, cancel := context.WithCancel(ctx)
-	m.watchers[*gvk] = cancel
-	go m.runInformer(watcherCtx.Done(), dcinformer.Informer(), gvk, react, logger)
+	shard.cancel = cancel
+	shard.informers = make(informerSet, len(dcinformers))
+	for i := range dcinformers {
+		shard.informers[i] = dcinformers[i].Informer()
+		go m.runInformer(watcherCtx.Done(), dcinformers[i].Informer(), gvk, react, logger)
+	}
+	shard.pendingWatcher = false
 	return nil
 }
 
-func (m *manager) getDynamicInformer(gvk *schema.GroupVersionKind) (informers.GenericInformer, error) {
-	// Grab a dynamic interface that we can create informers from
-	d, err := dynamic.NewForConfig(m.config)
-	if err != nil {
-		return nil, err
+// startDeferredWatchers starts, once internal state has been rebuilt on startup, the watchers
+// for all GVKs tracked meanwhile. Starting one watcher per GVK after all existing ResourceSummaries
+// have been processed, instead of as each resource is registered, avoids a burst of LIST calls
+// against the API server on restart.
+// Changes happening between resource registration and watcher establishment are not notified
+// by watchers, so once a watcher has synced, any resource changed meanwhile is queued for evaluation.
+func (m *manager) startDeferredWatchers(ctx context.Context) error {
+	var err error
+	m.rangeShards(func(gvk schema.GroupVersionKind, shard *gvkShard) {
+		if err != nil {
+			return
+		}
+
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+
+		if !shard.pendingWatcher || shard.resources.Len() == 0 {
+			return
+		}
+
+		if err = m.startWatcher(ctx, shard, &gvk, m.react); err != nil {
+			return
+		}
+		go m.queueChangedSinceRegistration(ctx, gvk, shard.informers)
+	})
+
+	return err
+}
+
+// queueChangedSinceRegistration waits for informer to sync and queues for evaluation any tracked
+// resource of gvk which was deleted, or whose resourceVersion is not the one evaluated on registration.
+func (m *manager) queueChangedSinceRegistration(ctx context.Context, gvk schema.GroupVersionKind,
+	watched informerSet) {
+
+	if !cache.WaitForCacheSync(ctx.Done(), watched.hasSynced) {
+		return
+	}
+
+	shard := m.getShard(gvk)
+	var changed, missing []corev1.ObjectReference
+
+	shard.mu.RLock()
+	resources := shard.resources.Items()
+	for i := range resources {
+		key := resources[i].Name
+		if resources[i].Namespace != "" {
+			key = resources[i].Namespace + "/" + key
+		}
+		obj, exists, err := watched.getByKey(key)
+		if err != nil || !exists {
+			missing = append(missing, resources[i])
+			continue
+		}
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			changed = append(changed, resources[i])
+			continue
+		}
+		if evaluated, ok := shard.evaluatedRevisions[resources[i]]; !ok ||
+			evaluated.resourceVersion != u.GetResourceVersion() {
+
+			changed = append(changed, resources[i])
+		}
+	}
+	shard.mu.RUnlock()
+
+	// Missing resources were possibly deleted
+	for i := range missing {
+		m.recordExistenceCheck(&missing[i])
+	}
+	changed = append(changed, missing...)
+
+	if len(changed) == 0 {
+		return
 	}
-	// Create a factory object that can generate informers for resource types
-	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(
-		d,
-		0,
-		corev1.NamespaceAll,
-		nil,
-	)
 
-	dc := discovery.NewDiscoveryClientForConfigOrDie(m.config)
-	groupResources, err := restmapper.GetAPIGroupResources(dc)
+	logger := m.log.WithValues("gvk", gvk.String())
+	logger.V(logs.LogInfo).Info(fmt.Sprintf("%d resources changed before watcher was established", len(changed)))
+
+	// Shard locks must not be held while acquiring manager lock
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range changed {
+		m.checkForConfigurationDrift(&changed[i])
+	}
+}
+
+// getDynamicInformers returns the informers watching gvk: a single one for all namespaces or,
+// when included namespaces are set, one per included namespace.
+func (m *manager) getDynamicInformers(gvk *schema.GroupVersionKind) ([]informers.GenericInformer, error) {
+	// Grab a dynamic interface that we can create informers from
+	d, err := m.getDynamicClient()
 	if err != nil {
 		return nil, err
 	}
-	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
 
-	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	mapping, err := m.getRESTMapping(*gvk)
 	if err != nil {
-		// getDynamicInformer is only called after verifying resource
+		// getDynamicInformers is only called after verifying resource
 		// is installed.
 		return nil, err
 	}
 
+	namespaces := getWatchedNamespaces()
+	if namespaces[0] != corev1.NamespaceAll && mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return nil, fmt.Errorf("cluster wide resources are not tracked when included namespaces are set")
+	}
+
 	resourceId := schema.GroupVersionResource{
 		Group:    gvk.Group,
 		Version:  gvk.Version,
 		Resource: mapping.Resource.Resource,
 	}
 
-	informer := factory.ForResource(resourceId)
-	return informer, nil
+	result := make([]informers.GenericInformer, len(namespaces))
+	for i := range namespaces {
+		// Create a factory object that can generate informers for resource types.
+		// Resources in excluded namespaces are never watched.
+		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(
+			d,
+			0,
+			namespaces[i],
+			tweakListOptions(mapping),
+		)
+		result[i] = factory.ForResource(resourceId)
+	}
+	return result, nil
+}
+
+// tweakListOptions returns the function filtering out resources in excluded namespaces, for
+// namespaced resources only: API server rejects metadata.namespace field selectors on cluster
+// wide resources, which have no namespace anyway.
+func tweakListOptions(mapping *meta.RESTMapping) dynamicinformer.TweakListOptionsFunc {
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return nil
+	}
+	return excludeNamespaces(getRuntimeSettings().ExcludedNamespaces)
+}
+
+// excludeNamespaces returns a function filtering out, via field selector, resources in namespaces.
+// Returns nil if namespaces is empty.
+func excludeNamespaces(namespaces []string) dynamicinformer.TweakListOptionsFunc {
+	if len(namespaces) == 0 {
+		return nil
+	}
+
+	selectors := make([]fields.Selector, len(namespaces))
+	for i := range namespaces {
+		selectors[i] = fields.OneTermNotEqualSelector("metadata.namespace", namespaces[i])
+	}
+	fieldSelector := fields.AndSelectors(selectors...).String()
+
+	return func(options *metav1.ListOptions) {
+		options.FieldSelector = fieldSelector
+	}
 }
 
 func (m *manager) runInformer(stopCh <-chan struct{}, s cache.SharedIndexInformer,
@@ -185,15 +409,30 @@ func (m *manager) runInformer(stopCh <-chan struct{}, s cache.SharedIndexInforme
 		},
 		DeleteFunc: func(obj interface{}) {
 			logger.V(logsettings.LogDebug).Info("got delete notification")
+			m.forgetEventObject(gvk, obj)
+			m.recordDeleteEvent(gvk, obj)
 			react(gvk, obj, logger)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			logger.V(logsettings.LogDebug).Info("got update notification")
+			if m.isDuplicateEvent(gvk, oldObj, newObj) {
+				logger.V(logsettings.LogVerbose).Info("resourceVersion already evaluated. Ignoring notification")
+				return
+			}
+			if m.acceptChange(gvk, oldObj, newObj, logger) {
+				return
+			}
+			m.recordEventObject(gvk, newObj)
 			react(gvk, newObj, logger)
 		},
 	}
 	if _, err := s.AddEventHandler(handlers); err != nil {
 		panic(1)
 	}
+	// Error handler can only be set before informer is started
+	_ = s.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		trackWatcherError(gvk.String())
+		cache.DefaultWatchErrorHandler(r, err)
+	})
 	s.Run(stopCh)
 }
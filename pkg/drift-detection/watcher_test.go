@@ -17,14 +17,27 @@ limitations under the License.
 package driftdetection_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
 
 	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2/textlogger"
 
 	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
@@ -87,5 +100,493 @@ var _ = Describe("Manager: react", func() {
 		jobs = manager.GetJobQueue()
 		resourceQueued = jobs.Items()
 		Expect(resourceQueued).To(ContainElement(resourceRef))
+
+		// Time resource was queued is tracked to measure queue wait time
+		_, ok := manager.GetQueuedAt()[resourceRef]
+		Expect(ok).To(BeTrue())
+	})
+
+	It("acceptChange applies drift expressions to update watch events", func() {
+		m := driftdetection.NewTrackingManager()
+
+		gvk := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+		oldU := &unstructured.Unstructured{}
+		oldU.SetGroupVersionKind(gvk)
+		oldU.SetNamespace(randomString())
+		oldU.SetName(randomString())
+		oldU.SetResourceVersion("1")
+		Expect(unstructured.SetNestedField(oldU.Object, int64(1), "spec", "replicas")).To(Succeed())
+		Expect(unstructured.SetNestedField(oldU.Object, "nginx:1.25", "spec", "template", "image")).To(Succeed())
+
+		scaled := oldU.DeepCopy()
+		scaled.SetResourceVersion("2")
+		Expect(unstructured.SetNestedField(scaled.Object, int64(3), "spec", "replicas")).To(Succeed())
+		upgraded := oldU.DeepCopy()
+		upgraded.SetResourceVersion("2")
+		Expect(unstructured.SetNestedField(upgraded.Object, "nginx:1.26", "spec", "template", "image")).To(Succeed())
+
+		resourceRef := &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment",
+			Namespace: oldU.GetNamespace(), Name: oldU.GetName()}
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+				Annotations: map[string]string{
+					driftdetection.DriftExpressionsAnnotation: "- group: apps\n  kind: Deployment\n" +
+						"  expression: object.spec.template != oldObject.spec.template",
+				},
+			},
+		}
+		m.AddResource(resourceRef, &corev1.ObjectReference{Namespace: resourceSummary.Namespace,
+			Name: resourceSummary.Name, Kind: libsveltosv1alpha1.ResourceSummaryKind,
+			APIVersion: libsveltosv1alpha1.GroupVersion.String()})
+		m.SetResourceHashes(resourceRef, driftdetection.UnstructuredHash(m, oldU))
+
+		// Without drift expressions, changes are always evaluated
+		Expect(driftdetection.AcceptChange(m, &gvk, oldU, scaled, logger)).To(BeFalse())
+
+		Expect(m.SetDriftExpressions(resourceSummary)).To(Succeed())
+		Expect(driftdetection.AcceptChange(m, &gvk, oldU, upgraded, logger)).To(BeFalse())
+		Expect(m.GetResourceHashes()[*resourceRef]).To(Equal(driftdetection.UnstructuredHash(m, oldU)))
+
+		// Accepted change becomes the reference
+		Expect(driftdetection.AcceptChange(m, &gvk, oldU, scaled, logger)).To(BeTrue())
+		Expect(m.GetResourceHashes()[*resourceRef]).To(Equal(driftdetection.UnstructuredHash(m, scaled)))
+
+		// A change is only accepted from the reference
+		Expect(driftdetection.AcceptChange(m, &gvk, oldU, scaled, logger)).To(BeFalse())
+
+		// Invalid expressions are rejected, previous ones are kept
+		resourceSummary.Annotations[driftdetection.DriftExpressionsAnnotation] = "- kind: Deployment\n  expression: object.("
+		Expect(m.SetDriftExpressions(resourceSummary)).ToNot(Succeed())
+		rescaled := scaled.DeepCopy()
+		rescaled.SetResourceVersion("3")
+		Expect(unstructured.SetNestedField(rescaled.Object, int64(5), "spec", "replicas")).To(Succeed())
+		Expect(driftdetection.AcceptChange(m, &gvk, scaled, rescaled, logger)).To(BeTrue())
+
+		// Expressions not returning a bool fall back to hash comparison
+		resourceSummary.Annotations[driftdetection.DriftExpressionsAnnotation] = "- kind: '*'\n  expression: object.spec.replicas"
+		Expect(m.SetDriftExpressions(resourceSummary)).To(Succeed())
+		Expect(driftdetection.AcceptChange(m, &gvk, rescaled, scaled, logger)).To(BeFalse())
+	})
+
+	It("acceptChange applies Lua hooks to update watch events", func() {
+		m := driftdetection.NewTrackingManager()
+
+		gvk := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+		oldU := &unstructured.Unstructured{}
+		oldU.SetGroupVersionKind(gvk)
+		oldU.SetNamespace(randomString())
+		oldU.SetName(randomString())
+		oldU.SetResourceVersion("1")
+		Expect(unstructured.SetNestedField(oldU.Object, int64(1), "spec", "replicas")).To(Succeed())
+		Expect(unstructured.SetNestedField(oldU.Object, "nginx:1.25", "spec", "template", "image")).To(Succeed())
+
+		scaled := oldU.DeepCopy()
+		scaled.SetResourceVersion("2")
+		Expect(unstructured.SetNestedField(scaled.Object, int64(3), "spec", "replicas")).To(Succeed())
+		upgraded := oldU.DeepCopy()
+		upgraded.SetResourceVersion("2")
+		Expect(unstructured.SetNestedField(upgraded.Object, "nginx:1.26", "spec", "template", "image")).To(Succeed())
+
+		resourceRef := &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment",
+			Namespace: oldU.GetNamespace(), Name: oldU.GetName()}
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+				Annotations: map[string]string{
+					driftdetection.LuaHooksAnnotation: `- group: apps
+  kind: Deployment
+  script: |
+    function evaluate()
+      local hs = {}
+      hs.drift = obj.spec.template.image ~= oldObj.spec.template.image
+      return hs
+    end`,
+				},
+			},
+		}
+		m.AddResource(resourceRef, &corev1.ObjectReference{Namespace: resourceSummary.Namespace,
+			Name: resourceSummary.Name, Kind: libsveltosv1alpha1.ResourceSummaryKind,
+			APIVersion: libsveltosv1alpha1.GroupVersion.String()})
+		m.SetResourceHashes(resourceRef, driftdetection.UnstructuredHash(m, oldU))
+
+		Expect(m.SetLuaHooks(resourceSummary)).To(Succeed())
+		Expect(driftdetection.AcceptChange(m, &gvk, oldU, upgraded, logger)).To(BeFalse())
+		Expect(driftdetection.AcceptChange(m, &gvk, oldU, scaled, logger)).To(BeTrue())
+		Expect(m.GetResourceHashes()[*resourceRef]).To(Equal(driftdetection.UnstructuredHash(m, scaled)))
+
+		rescaled := scaled.DeepCopy()
+		rescaled.SetResourceVersion("3")
+		Expect(unstructured.SetNestedField(rescaled.Object, int64(5), "spec", "replicas")).To(Succeed())
+
+		// Scripts failing, not terminating or accessing the file system fall back to hash comparison
+		for _, script := range []string{
+			"function evaluate() error('failed') end",
+			"function evaluate() while true do end end",
+			"function evaluate() dofile('/etc/passwd') return {drift = false} end",
+			"function evaluate() return {} end",
+		} {
+			resourceSummary.Annotations[driftdetection.LuaHooksAnnotation] =
+				fmt.Sprintf("- kind: Deployment\n  script: %q", script)
+			Expect(m.SetLuaHooks(resourceSummary)).To(Succeed())
+			Expect(driftdetection.AcceptChange(m, &gvk, scaled, rescaled, logger)).To(BeFalse())
+		}
+
+		m.ClearLuaHooks(&corev1.ObjectReference{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name})
+		Expect(driftdetection.AcceptChange(m, &gvk, scaled, rescaled, logger)).To(BeFalse())
+	})
+
+	It("Secret values never leave through drift hooks, drift events nor inspect output", func() {
+		m := driftdetection.NewEvaluationManager()
+
+		gvk := schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+		oldU := &unstructured.Unstructured{}
+		oldU.SetGroupVersionKind(gvk)
+		oldU.SetNamespace(randomString())
+		oldU.SetName(randomString())
+		oldU.SetResourceVersion("1")
+		Expect(unstructured.SetNestedField(oldU.Object, "cGFzc3dvcmQ=", "data", "password")).To(Succeed())
+		rotated := oldU.DeepCopy()
+		rotated.SetResourceVersion("2")
+		Expect(unstructured.SetNestedField(rotated.Object, "cm90YXRlZA==", "data", "password")).To(Succeed())
+
+		resourceRef := &corev1.ObjectReference{APIVersion: "v1", Kind: "Secret",
+			Namespace: oldU.GetNamespace(), Name: oldU.GetName()}
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+				Annotations: map[string]string{
+					driftdetection.DriftExpressionsAnnotation: "- kind: Secret\n" +
+						"  expression: \"!object.data.password.startsWith('redacted:')\"",
+				},
+			},
+		}
+		m.AddResource(resourceRef, &corev1.ObjectReference{Namespace: resourceSummary.Namespace,
+			Name: resourceSummary.Name, Kind: libsveltosv1alpha1.ResourceSummaryKind,
+			APIVersion: libsveltosv1alpha1.GroupVersion.String()})
+		hash := driftdetection.UnstructuredHash(m, oldU)
+		m.SetResourceHashes(resourceRef, hash)
+
+		// Drift expressions only see redacted values
+		Expect(m.SetDriftExpressions(resourceSummary)).To(Succeed())
+		Expect(driftdetection.AcceptChange(m, &gvk, oldU, rotated, logger)).To(BeTrue())
+		m.ClearDriftExpressions(&corev1.ObjectReference{Namespace: resourceSummary.Namespace, Name: resourceSummary.Name})
+
+		// Errors of Lua hooks, which are logged, cannot carry values
+		var logged strings.Builder
+		captured := funcr.New(func(prefix, args string) { logged.WriteString(args) }, funcr.Options{Verbosity: 10})
+		resourceSummary.Annotations[driftdetection.LuaHooksAnnotation] =
+			"- kind: Secret\n  script: \"function evaluate() error(obj.data.password) end\""
+		Expect(m.SetLuaHooks(resourceSummary)).To(Succeed())
+		Expect(driftdetection.AcceptChange(m, &gvk, rotated, oldU, captured)).To(BeFalse())
+		Expect(logged.String()).To(ContainSubstring("redacted:"))
+		Expect(logged.String()).ToNot(ContainSubstring("cm90YXRlZA=="))
+		Expect(logged.String()).ToNot(ContainSubstring("cGFzc3dvcmQ="))
+
+		// Drift events contain references only
+		var output bytes.Buffer
+		driftdetection.SetDriftEventOutput(&output)
+		defer driftdetection.SetDriftEventOutput(nil)
+		driftdetection.RecordDriftEvent(m, resourceRef, false)
+		Expect(output.String()).To(ContainSubstring(resourceRef.Name))
+		Expect(output.String()).ToNot(ContainSubstring("cm90YXRlZA=="))
+
+		// Inspect output contains keyed digests of Secret hashes
+		state := m.GetState()
+		Expect(state.Resources).To(HaveLen(1))
+		Expect(state.Resources[0].Hash).To(HavePrefix("redacted:"))
+		Expect(state.Resources[0].Hash).ToNot(Equal(hex.EncodeToString(driftdetection.UnstructuredHash(m, rotated))))
+		data, err := json.Marshal(state)
+		Expect(err).To(BeNil())
+		Expect(string(data)).ToNot(ContainSubstring("cm90YXRlZA=="))
+	})
+
+	It("queueChangedSinceRegistration queues resources changed before deferred watcher was established", func() {
+		m := driftdetection.NewEvaluationManager()
+
+		gvk := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+		namespace := randomString()
+		newConfigMap := func(name, resourceVersion string) unstructured.Unstructured {
+			u := unstructured.Unstructured{}
+			u.SetGroupVersionKind(gvk)
+			u.SetNamespace(namespace)
+			u.SetName(name)
+			u.SetResourceVersion(resourceVersion)
+			return u
+		}
+		unchanged := newConfigMap(randomString(), "1")
+		changed := newConfigMap(randomString(), "3")
+		deletedName := randomString()
+
+		listWatch := &cache.ListWatch{
+			ListFunc: func(_ metav1.ListOptions) (runtime.Object, error) {
+				list := &unstructured.UnstructuredList{Items: []unstructured.Unstructured{unchanged, changed}}
+				list.SetResourceVersion("3")
+				return list, nil
+			},
+			WatchFunc: func(_ metav1.ListOptions) (watch.Interface, error) {
+				return watch.NewFake(), nil
+			},
+		}
+		informer := cache.NewSharedIndexInformer(listWatch, &unstructured.Unstructured{}, 0, cache.Indexers{})
+
+		refs := make(map[string]*corev1.ObjectReference)
+		for _, name := range []string{unchanged.GetName(), changed.GetName(), deletedName} {
+			refs[name] = &corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: namespace, Name: name}
+			m.TrackResource(refs[name])
+			m.SetEvaluatedResourceVersion(refs[name], "1")
+			m.SetResourceHashes(refs[name], []byte(randomString()))
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go informer.Run(ctx.Done())
+
+		// Returns once informer has synced
+		driftdetection.QueueChangedSinceRegistration(m, ctx, gvk, []cache.SharedIndexInformer{informer})
+
+		queued := m.GetJobQueue()
+		Expect(queued.Has(refs[unchanged.GetName()])).To(BeFalse())
+		Expect(queued.Has(refs[changed.GetName()])).To(BeTrue())
+		Expect(queued.Has(refs[deletedName])).To(BeTrue())
+		Expect(queued.Len()).To(Equal(2))
+
+		// Resources not found by watcher are verified to still exist
+		Expect(driftdetection.TakeExistenceCheck(m, refs[deletedName])).To(BeTrue())
+		Expect(driftdetection.TakeExistenceCheck(m, refs[changed.GetName()])).To(BeFalse())
+	})
+
+	It("excludeNamespaces filters out resources in excluded namespaces via field selector", func() {
+		Expect(driftdetection.ExcludeNamespaces(nil)).To(BeNil())
+
+		options := &metav1.ListOptions{}
+		driftdetection.ExcludeNamespaces([]string{"kube-system", "monitoring"})(options)
+		Expect(options.FieldSelector).To(Equal("metadata.namespace!=kube-system,metadata.namespace!=monitoring"))
+
+		selector, err := fields.ParseSelector(options.FieldSelector)
+		Expect(err).To(BeNil())
+		Expect(selector.Matches(fields.Set{"metadata.namespace": "kube-system"})).To(BeFalse())
+		Expect(selector.Matches(fields.Set{"metadata.namespace": "monitoring"})).To(BeFalse())
+		Expect(selector.Matches(fields.Set{"metadata.namespace": "default"})).To(BeTrue())
+		// Cluster wide resources are never filtered out
+		Expect(selector.Matches(fields.Set{"metadata.namespace": ""})).To(BeTrue())
+
+		// Field selector is only set when listing namespaced resources
+		driftdetection.SetExcludedNamespaces([]string{"kube-system"})
+		configMaps := &meta.RESTMapping{
+			Resource:         schema.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+			GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+			Scope:            meta.RESTScopeNamespace,
+		}
+		options = &metav1.ListOptions{}
+		driftdetection.TweakListOptions(configMaps)(options)
+		Expect(options.FieldSelector).To(Equal("metadata.namespace!=kube-system"))
+		namespaces := &meta.RESTMapping{
+			Resource:         schema.GroupVersionResource{Version: "v1", Resource: "namespaces"},
+			GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "Namespace"},
+			Scope:            meta.RESTScopeRoot,
+		}
+		Expect(driftdetection.TweakListOptions(namespaces)).To(BeNil())
+		driftdetection.SetExcludedNamespaces(nil)
+
+		// Events received for namespaces excluded after watcher started are dropped
+		m := driftdetection.NewEvaluationManager()
+		excluded := randomString()
+		u := &unstructured.Unstructured{}
+		u.SetAPIVersion("v1")
+		u.SetKind("ConfigMap")
+		u.SetNamespace(excluded)
+		u.SetName(randomString())
+		resourceRef := &corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: excluded, Name: u.GetName()}
+		m.AddResource(resourceRef, &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String()})
+
+		driftdetection.SetExcludedNamespaces([]string{excluded})
+		defer driftdetection.SetExcludedNamespaces(nil)
+		gvk := resourceRef.GroupVersionKind()
+		driftdetection.React(m, &gvk, u, logger)
+		Expect(m.GetJobQueue().Len()).To(BeZero())
+
+		driftdetection.SetExcludedNamespaces(nil)
+		driftdetection.React(m, &gvk, u, logger)
+		Expect(m.GetJobQueue().Has(resourceRef)).To(BeTrue())
+	})
+
+	It("with SpecHashMode resources are evaluated from the object carried by the watch event", func() {
+		driftdetection.SetHashMode(driftdetection.SpecHashMode)
+		defer driftdetection.SetHashMode(driftdetection.FullHashMode)
+
+		// No client is set: any GET would fail
+		m := driftdetection.NewEvaluationManager()
+
+		gvk := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(gvk)
+		u.SetNamespace(randomString())
+		u.SetName(randomString())
+		u.SetResourceVersion("2")
+		Expect(unstructured.SetNestedField(u.Object, int64(3), "spec", "replicas")).To(Succeed())
+		resourceRef := &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment",
+			Namespace: u.GetNamespace(), Name: u.GetName()}
+
+		// Objects of resources not tracked are not kept
+		driftdetection.RecordEventObject(m, &gvk, u)
+		evaluated, _, err := driftdetection.GetObjectForEvaluation(m, context.TODO(), resourceRef)
+		Expect(err).ToNot(BeNil())
+		Expect(evaluated).To(BeNil())
+
+		m.AddResource(resourceRef, &corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1alpha1.ResourceSummaryKind, APIVersion: libsveltosv1alpha1.GroupVersion.String()})
+		driftdetection.RecordEventObject(m, &gvk, u)
+		evaluated, unchanged, err := driftdetection.GetObjectForEvaluation(m, context.TODO(), resourceRef)
+		Expect(err).To(BeNil())
+		Expect(unchanged).To(BeFalse())
+		Expect(evaluated).To(Equal(u))
+
+		// Event object is only used once
+		_, _, err = driftdetection.GetObjectForEvaluation(m, context.TODO(), resourceRef)
+		Expect(err).ToNot(BeNil())
+
+		// Deleted resources are always fetched again
+		driftdetection.RecordEventObject(m, &gvk, u)
+		driftdetection.ForgetEventObject(m, &gvk, u)
+		_, _, err = driftdetection.GetObjectForEvaluation(m, context.TODO(), resourceRef)
+		Expect(err).ToNot(BeNil())
+
+		// Labels and annotations are not considered
+		relabeled := u.DeepCopy()
+		relabeled.SetLabels(map[string]string{"app": randomString()})
+		relabeled.SetAnnotations(map[string]string{"owner": randomString()})
+		Expect(driftdetection.UnstructuredHash(m, relabeled)).To(Equal(driftdetection.UnstructuredHash(m, u)))
+		driftdetection.SetHashMode(driftdetection.FullHashMode)
+		Expect(driftdetection.UnstructuredHash(m, relabeled)).ToNot(Equal(driftdetection.UnstructuredHash(m, u)))
+	})
+
+	It("isDuplicateEvent ignores update watch events carrying a resourceVersion already evaluated", func() {
+		m := driftdetection.NewEvaluationManager()
+
+		gvk := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+		oldU := &unstructured.Unstructured{}
+		oldU.SetGroupVersionKind(gvk)
+		oldU.SetNamespace(randomString())
+		oldU.SetName(randomString())
+		oldU.SetResourceVersion("1")
+		resourceRef := &corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap",
+			Namespace: oldU.GetNamespace(), Name: oldU.GetName()}
+		m.SetResourceHashes(resourceRef, []byte(randomString()))
+
+		// Resync: resourceVersion did not change
+		Expect(driftdetection.IsDuplicateEvent(m, &gvk, oldU, oldU.DeepCopy())).To(BeTrue())
+
+		newU := oldU.DeepCopy()
+		newU.SetResourceVersion("2")
+		Expect(driftdetection.IsDuplicateEvent(m, &gvk, oldU, newU)).To(BeFalse())
+
+		// Relist: resourceVersion was already evaluated (e.g. resource was evaluated by polling)
+		m.SetEvaluatedResourceVersion(resourceRef, "2")
+		Expect(driftdetection.IsDuplicateEvent(m, &gvk, oldU, newU)).To(BeTrue())
+
+		newU.SetResourceVersion("3")
+		Expect(driftdetection.IsDuplicateEvent(m, &gvk, oldU, newU)).To(BeFalse())
+	})
+
+	It("isDuplicateEvent ignores update watch events not bumping generation of generation aware GroupKinds", func() {
+		driftdetection.SetHashMode(driftdetection.SpecHashMode)
+		driftdetection.SetGenerationAwareGroupKinds([]schema.GroupKind{{Group: "apps", Kind: "Deployment"}})
+		defer func() {
+			driftdetection.SetHashMode(driftdetection.FullHashMode)
+			driftdetection.SetGenerationAwareGroupKinds(nil)
+		}()
+
+		m := driftdetection.NewEvaluationManager()
+
+		newObject := func(gvk schema.GroupVersionKind) *unstructured.Unstructured {
+			u := &unstructured.Unstructured{}
+			u.SetGroupVersionKind(gvk)
+			u.SetNamespace(randomString())
+			u.SetName(randomString())
+			u.SetResourceVersion("1")
+			u.SetGeneration(1)
+			apiVersion, kind := gvk.ToAPIVersionAndKind()
+			ref := &corev1.ObjectReference{APIVersion: apiVersion, Kind: kind,
+				Namespace: u.GetNamespace(), Name: u.GetName()}
+			m.SetResourceHashes(ref, []byte(randomString()))
+			m.SetEvaluatedGeneration(ref, "1", 1)
+			return u
+		}
+
+		deploymentGVK := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+		oldU := newObject(deploymentGVK)
+
+		// Only metadata/status changed
+		newU := oldU.DeepCopy()
+		newU.SetResourceVersion("2")
+		Expect(driftdetection.IsDuplicateEvent(m, &deploymentGVK, oldU, newU)).To(BeTrue())
+
+		// Spec changed
+		newU.SetGeneration(2)
+		Expect(driftdetection.IsDuplicateEvent(m, &deploymentGVK, oldU, newU)).To(BeFalse())
+
+		// FullHashMode considers labels and annotations, which do not bump generation
+		driftdetection.SetHashMode(driftdetection.FullHashMode)
+		newU.SetGeneration(1)
+		Expect(driftdetection.IsDuplicateEvent(m, &deploymentGVK, oldU, newU)).To(BeFalse())
+		driftdetection.SetHashMode(driftdetection.SpecHashMode)
+
+		// GroupKind not configured as generation aware
+		statefulSetGVK := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}
+		oldU = newObject(statefulSetGVK)
+		newU = oldU.DeepCopy()
+		newU.SetResourceVersion("2")
+		Expect(driftdetection.IsDuplicateEvent(m, &statefulSetGVK, oldU, newU)).To(BeFalse())
+	})
+
+	It("moveHeaviestGVKToPolling stops watchers, heaviest first, and moves their GVKs to polling", func() {
+		m := driftdetection.NewEvaluationManager()
+
+		// newWatcher records a watcher for gvk whose informer caches size objects
+		newWatcher := func(gvk schema.GroupVersionKind, size int) *bool {
+			informer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &unstructured.Unstructured{}, 0,
+				cache.Indexers{})
+			for i := 0; i < size; i++ {
+				u := &unstructured.Unstructured{}
+				u.SetGroupVersionKind(gvk)
+				u.SetNamespace(randomString())
+				u.SetName(randomString())
+				Expect(informer.GetStore().Add(u)).To(Succeed())
+			}
+			stopped := false
+			m.SetWatcher(gvk, []cache.SharedIndexInformer{informer}, func() { stopped = true })
+			return &stopped
+		}
+
+		configMapGVK := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+		secretGVK := schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+		configMapStopped := newWatcher(configMapGVK, 2)
+		secretStopped := newWatcher(secretGVK, 5)
+
+		driftdetection.MoveHeaviestGVKToPolling(m)
+		Expect(*secretStopped).To(BeTrue())
+		Expect(*configMapStopped).To(BeFalse())
+		Expect(m.IsPolled(secretGVK)).To(BeTrue())
+		Expect(m.IsPolled(configMapGVK)).To(BeFalse())
+		Expect(m.GetWatchers()).ToNot(HaveKey(secretGVK))
+		Expect(getMetric("projectsveltos_drift_detection_polled_gvks", "", "").GetGauge().GetValue()).
+			To(Equal(float64(1)))
+
+		driftdetection.MoveHeaviestGVKToPolling(m)
+		Expect(*configMapStopped).To(BeTrue())
+		Expect(m.IsPolled(configMapGVK)).To(BeTrue())
+		Expect(m.GetWatchers()).To(BeEmpty())
+		Expect(getMetric("projectsveltos_drift_detection_polled_gvks", "", "").GetGauge().GetValue()).
+			To(Equal(float64(2)))
+
+		// No watcher left to stop
+		driftdetection.MoveHeaviestGVKToPolling(m)
+		Expect(getMetric("projectsveltos_drift_detection_polled_gvks", "", "").GetGauge().GetValue()).
+			To(Equal(float64(2)))
 	})
 })
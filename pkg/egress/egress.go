@@ -0,0 +1,141 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package egress centralizes the destinations, outside of the cluster API server, drift data
+// is sent to (for instance the OTLP endpoint traces are exported to). Each outbound integration
+// must register its destination before sending anything. When an allowlist is set (see
+// SetAllowlist), destinations not in it are rejected, so that security teams can constrain and
+// audit where drift-detection-manager sends data.
+package egress
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	mu sync.Mutex
+
+	// allowlist contains the allowed destinations. Empty means any destination is allowed.
+	allowlist []pattern
+
+	// destinations contains, per integration, the registered destination
+	destinations = map[string]string{}
+)
+
+// pattern is an allowed destination
+type pattern struct {
+	// host is either a host name (or IP) or, when starting with "*.", any subdomain of a domain
+	host string
+	// port, when set, is the only allowed port
+	port string
+}
+
+func (p *pattern) matches(host, port string) bool {
+	if p.port != "" && p.port != port {
+		return false
+	}
+	if strings.HasPrefix(p.host, "*.") {
+		return strings.HasSuffix(host, p.host[1:])
+	}
+	return host == p.host
+}
+
+// SetAllowlist sets the allowed destinations. Each entry is host, host:port, *.domain or
+// *.domain:port. An empty list allows any destination. Must be called before any integration
+// registers its destination.
+func SetAllowlist(entries []string) error {
+	patterns := make([]pattern, 0, len(entries))
+	for _, entry := range entries {
+		host, port, err := splitHostPort(entry)
+		if err != nil || host == "" || strings.Contains(host[1:], "*") ||
+			(strings.HasPrefix(host, "*") && !strings.HasPrefix(host, "*.")) {
+
+			return fmt.Errorf("invalid egress allowlist entry %q: expected host, host:port, *.domain or *.domain:port",
+				entry)
+		}
+		patterns = append(patterns, pattern{host: host, port: port})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	allowlist = patterns
+	return nil
+}
+
+// Register records that integration sends data to destination (a URL or host:port). Returns an
+// error if destination is not allowed: integration must then not send anything.
+func Register(integration, destination string) error {
+	host, port, err := splitHostPort(destination)
+	if err != nil || host == "" {
+		return fmt.Errorf("invalid %s destination %q", integration, destination)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(allowlist) != 0 {
+		allowed := false
+		for i := range allowlist {
+			if allowlist[i].matches(host, port) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%s destination %q is not in egress allowlist", integration, destination)
+		}
+	}
+
+	destinations[integration] = destination
+	return nil
+}
+
+// Destinations returns the registered destinations, as "integration=destination", sorted
+func Destinations() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	result := make([]string, 0, len(destinations))
+	for integration, destination := range destinations {
+		result = append(result, integration+"="+destination)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// splitHostPort returns the lowercase host and the port (empty if not set) of destination,
+// either a URL or host[:port]
+func splitHostPort(destination string) (host, port string, err error) {
+	if strings.Contains(destination, "://") {
+		u, err := url.Parse(destination)
+		if err != nil {
+			return "", "", err
+		}
+		return strings.ToLower(u.Hostname()), u.Port(), nil
+	}
+
+	host, port, err = net.SplitHostPort(destination)
+	if err != nil {
+		// no port
+		return strings.ToLower(strings.Trim(destination, "[]")), "", nil //nolint: nilerr // port is optional
+	}
+	return strings.ToLower(host), port, nil
+}
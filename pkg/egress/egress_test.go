@@ -0,0 +1,50 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package egress_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/egress"
+)
+
+var _ = Describe("Egress", func() {
+	AfterEach(func() {
+		Expect(egress.SetAllowlist(nil)).To(Succeed())
+	})
+
+	It("SetAllowlist rejects invalid entries", func() {
+		Expect(egress.SetAllowlist([]string{"collector.example.com:4317", "*.example.com"})).To(Succeed())
+		Expect(egress.SetAllowlist([]string{"collector.*.com"})).ToNot(Succeed())
+		Expect(egress.SetAllowlist([]string{"*example.com"})).ToNot(Succeed())
+	})
+
+	It("Register only accepts allowed destinations", func() {
+		Expect(egress.Register("any", "collector.example.com:4317")).To(Succeed())
+
+		Expect(egress.SetAllowlist([]string{"otel.monitoring:4317", "*.example.com"})).To(Succeed())
+		Expect(egress.Register("tracing", "otel.monitoring:4317")).To(Succeed())
+		Expect(egress.Register("tracing", "otel.monitoring:4318")).ToNot(Succeed())
+		Expect(egress.Register("webhook", "https://hooks.example.com/drift")).To(Succeed())
+		Expect(egress.Register("webhook", "https://example.com/drift")).ToNot(Succeed())
+		Expect(egress.Register("webhook", "https://hooks.example.org/drift")).ToNot(Succeed())
+
+		Expect(egress.Destinations()).To(ContainElements("tracing=otel.monitoring:4317",
+			"webhook=https://hooks.example.com/drift"))
+	})
+})
@@ -0,0 +1,294 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fanout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/kms"
+)
+
+// CompareName is the name of the subcommand comparing managed clusters tracked by fanout
+const CompareName = "fleet-compare"
+
+const (
+	humanOutput = "human"
+	jsonOutput  = "json"
+)
+
+// FleetReport compares the live state of the same resources across managed clusters
+type FleetReport struct {
+	// Clusters are the managed clusters compared
+	Clusters []string `json:"clusters"`
+
+	// Skipped are the managed clusters whose state could not be read, with the reason
+	Skipped map[string]string `json:"skipped,omitempty"`
+
+	// Snowflakes are the managed clusters with at least a resource diverging from the fleet
+	// norm, most divergent first
+	Snowflakes []ClusterDivergence `json:"snowflakes"`
+
+	// Resources are the resources whose live state is not the same in all clusters tracking them
+	Resources []ResourceDivergence `json:"resources"`
+}
+
+// ClusterDivergence is the number of resources of a managed cluster diverging from the fleet norm
+type ClusterDivergence struct {
+	Cluster            string `json:"cluster"`
+	DivergentResources int    `json:"divergentResources"`
+}
+
+// ResourceDivergence is a resource whose live state differs across managed clusters
+type ResourceDivergence struct {
+	Resource corev1.ObjectReference `json:"resource"`
+
+	// Clusters is the number of managed clusters tracking the resource
+	Clusters int `json:"clusters"`
+
+	// Norm is the number of managed clusters sharing the most common live state. Zero if no
+	// live state is more common than all others.
+	Norm int `json:"norm"`
+
+	// Divergent are the managed clusters whose live state differs from the norm. All clusters
+	// tracking the resource when there is no norm.
+	Divergent []string `json:"divergent"`
+}
+
+// RunCompare parses args, reads the state persisted by each child of fanout (see --state-dir)
+// and writes to out which managed clusters diverge from the rest of the fleet, e.g.
+//
+//	drift-detection-manager fleet-compare --state-dir=/var/lib/drift-detection
+func RunCompare(_ context.Context, args []string, out io.Writer) error {
+	fs := pflag.NewFlagSet(CompareName, pflag.ContinueOnError)
+
+	var stateDir, kekFile, output string
+	var minClusters int
+	fs.StringVar(&stateDir, "state-dir", "", "Directory where fanout children persist their state (see fanout --state-dir).")
+	fs.StringVar(&kekFile, "state-snapshot-kek-file", "",
+		"Key encryption key persisted state was encrypted with, if any (see --state-snapshot-kek-file).")
+	fs.IntVar(&minClusters, "min-clusters", 3,
+		"Minimum number of managed clusters a resource must be tracked in to be compared. With fewer clusters, "+
+			"there is no meaningful fleet norm.")
+	fs.StringVarP(&output, "output", "o", humanOutput, "Output format. Possible options are human or json.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if stateDir == "" {
+		return fmt.Errorf("state-dir is required")
+	}
+	if output != humanOutput && output != jsonOutput {
+		return fmt.Errorf("unsupported output %q", output)
+	}
+	if kekFile != "" {
+		kek, err := kms.NewLocal(kekFile)
+		if err != nil {
+			return errors.Wrap(err, "invalid state-snapshot-kek-file")
+		}
+		driftdetection.SetSnapshotEncryption(kek)
+	}
+
+	states, skipped, err := readClusterStates(stateDir)
+	if err != nil {
+		return err
+	}
+	report, err := CompareClusters(states, minClusters)
+	if err != nil {
+		return err
+	}
+	report.Skipped = skipped
+
+	if output == jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	return printFleetReport(report, out)
+}
+
+// readClusterStates returns the hashes persisted by each child in stateDir, per managed cluster,
+// along with the clusters whose state could not be read
+func readClusterStates(stateDir string) (map[string]*driftdetection.PersistedHashes, map[string]string, error) {
+	files, err := filepath.Glob(filepath.Join(stateDir, "*.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	states := make(map[string]*driftdetection.PersistedHashes, len(files))
+	skipped := make(map[string]string)
+	for _, file := range files {
+		cluster := strings.TrimSuffix(filepath.Base(file), ".json")
+		data, err := os.ReadFile(file)
+		if err == nil {
+			states[cluster], err = driftdetection.ReadPersistedHashes(data)
+		}
+		if err != nil {
+			delete(states, cluster)
+			skipped[cluster] = err.Error()
+		}
+	}
+	if len(skipped) == 0 {
+		skipped = nil
+	}
+	return states, skipped, nil
+}
+
+// CompareClusters compares, for each resource tracked in at least minClusters managed clusters,
+// its hash across clusters. The most common hash is the fleet norm and clusters with any other
+// hash diverge from it. All states must have been evaluated with the same hash settings.
+func CompareClusters(states map[string]*driftdetection.PersistedHashes, minClusters int) (*FleetReport, error) {
+	report := &FleetReport{Clusters: make([]string, 0, len(states)), Snowflakes: make([]ClusterDivergence, 0),
+		Resources: make([]ResourceDivergence, 0)}
+
+	// Per resource, clusters grouped by hash
+	resources := make(map[corev1.ObjectReference]map[string][]string)
+	var reference *driftdetection.PersistedHashes
+	for cluster, state := range states {
+		if reference == nil {
+			reference = state
+		} else if state.HashMode != reference.HashMode || state.FieldExclusions != reference.FieldExclusions {
+			return nil, fmt.Errorf("state of cluster %s was evaluated with different hash settings", cluster)
+		}
+
+		report.Clusters = append(report.Clusters, cluster)
+		for ref, hash := range state.Hashes {
+			if resources[ref] == nil {
+				resources[ref] = make(map[string][]string)
+			}
+			resources[ref][string(hash)] = append(resources[ref][string(hash)], cluster)
+		}
+	}
+	sort.Strings(report.Clusters)
+
+	divergentResources := make(map[string]int)
+	for ref, byHash := range resources {
+		divergence := compareResource(byHash)
+		if divergence == nil || divergence.Clusters < minClusters {
+			continue
+		}
+		divergence.Resource = ref
+		report.Resources = append(report.Resources, *divergence)
+		if divergence.Norm != 0 {
+			for _, cluster := range divergence.Divergent {
+				divergentResources[cluster]++
+			}
+		}
+	}
+
+	for cluster, count := range divergentResources {
+		report.Snowflakes = append(report.Snowflakes, ClusterDivergence{Cluster: cluster, DivergentResources: count})
+	}
+	sort.Slice(report.Snowflakes, func(i, j int) bool {
+		if report.Snowflakes[i].DivergentResources != report.Snowflakes[j].DivergentResources {
+			return report.Snowflakes[i].DivergentResources > report.Snowflakes[j].DivergentResources
+		}
+		return report.Snowflakes[i].Cluster < report.Snowflakes[j].Cluster
+	})
+	sort.Slice(report.Resources, func(i, j int) bool {
+		return formatResource(&report.Resources[i].Resource) < formatResource(&report.Resources[j].Resource)
+	})
+	return report, nil
+}
+
+// compareResource returns how clusters, grouped by the hash of a resource, diverge.
+// Nil if all clusters have the same hash.
+func compareResource(byHash map[string][]string) *ResourceDivergence {
+	if len(byHash) < 2 {
+		return nil
+	}
+
+	divergence := &ResourceDivergence{Divergent: make([]string, 0)}
+	var norm string
+	tie := false
+	for hash, clusters := range byHash {
+		divergence.Clusters += len(clusters)
+		switch {
+		case len(clusters) > divergence.Norm:
+			norm, divergence.Norm, tie = hash, len(clusters), false
+		case len(clusters) == divergence.Norm:
+			tie = true
+		}
+	}
+	if tie {
+		divergence.Norm = 0
+	}
+
+	for hash, clusters := range byHash {
+		if tie || hash != norm {
+			divergence.Divergent = append(divergence.Divergent, clusters...)
+		}
+	}
+	sort.Strings(divergence.Divergent)
+	return divergence
+}
+
+func printFleetReport(report *FleetReport, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "%d clusters compared\n", len(report.Clusters))
+	skipped := make([]string, 0, len(report.Skipped))
+	for cluster := range report.Skipped {
+		skipped = append(skipped, cluster)
+	}
+	sort.Strings(skipped)
+	for _, cluster := range skipped {
+		fmt.Fprintf(w, "skipped cluster %s: %s\n", cluster, report.Skipped[cluster])
+	}
+
+	fmt.Fprintln(w, "\nSNOWFLAKES")
+	fmt.Fprintln(w, "CLUSTER\tDIVERGENT RESOURCES")
+	for i := range report.Snowflakes {
+		fmt.Fprintf(w, "%s\t%d\n", report.Snowflakes[i].Cluster, report.Snowflakes[i].DivergentResources)
+	}
+
+	fmt.Fprintln(w, "\nDIVERGENT RESOURCES")
+	fmt.Fprintln(w, "RESOURCE\tCLUSTERS\tNORM\tDIVERGENT")
+	for i := range report.Resources {
+		resource := &report.Resources[i]
+		norm := fmt.Sprintf("%d", resource.Norm)
+		if resource.Norm == 0 {
+			norm = "<none>"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", formatResource(&resource.Resource), resource.Clusters, norm,
+			strings.Join(resource.Divergent, ","))
+	}
+
+	return w.Flush()
+}
+
+// formatResource returns Kind.group namespace/name (or Kind.group name for cluster wide resources)
+func formatResource(ref *corev1.ObjectReference) string {
+	gk := ref.GroupVersionKind().GroupKind().String()
+	if ref.Namespace == "" {
+		return fmt.Sprintf("%s %s", gk, ref.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", gk, ref.Namespace, ref.Name)
+}
@@ -0,0 +1,37 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fanout
+
+var (
+	NewSupervisor = newSupervisor
+	Reconcile     = (*supervisor).reconcile
+	Stop          = (*supervisor).stop
+
+	NewMembership = newMembership
+	Renew         = (*membership).renew
+	Members       = (*membership).members
+	Release       = (*membership).release
+)
+
+// GetChildren returns the clusters a child was started for
+func GetChildren(s *supervisor) []Cluster {
+	clusters := make([]Cluster, 0, len(s.children))
+	for cluster := range s.children {
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
@@ -0,0 +1,476 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fanout implements the fanout subcommand, which lets a single deployment, running in
+// the management cluster, track drift across many managed clusters. Managed clusters
+// (SveltosClusters and/or ClusterAPI Clusters matching a label selector) are listed periodically
+// and, for each one, a drift-detection-manager is run as a child process in management cluster
+// mode (--current-cluster=management-cluster), consuming the cluster kubeconfig Secret.
+//
+// Drift detection state is process wide, so each child process owns the watchers and evaluation
+// queue of exactly one managed cluster. Children are started when a cluster appears, stopped
+// (SIGTERM, so state is persisted) when it is deleted, paused or no longer matches, and started
+// again if they exit. Children do not serve diagnostics nor health endpoints.
+//
+// Managed clusters can be split between fanout replicas:
+//   - statically, following sveltos sharding: a replica started with --shard-key only tracks
+//     clusters whose sharding.projectsveltos.io/key annotation matches it (replicas with no
+//     shard key track clusters without the annotation);
+//   - automatically, with --replica-lease-namespace: replicas sharing a shard key keep a Lease
+//     each and clusters are assigned to live replicas via rendezvous hashing. When replicas are
+//     scaled, clusters are rebalanced at next resync, and only clusters whose owner changed move.
+//
+// Since each managed cluster has its own process, per cluster budgets (--cluster-evaluation-qps,
+// --cluster-max-procs) keep a drift storm in a noisy cluster from starving evaluations for the
+// others.
+//
+// With --state-dir, the fleet-compare subcommand compares the state persisted by children: for
+// each resource tracked in several managed clusters, the most common live state is the fleet
+// norm, and managed clusters diverging from it are reported, most divergent first.
+//
+// Fanout process needs to list SveltosClusters and Clusters, and children to get Secrets, in the
+// management cluster. With --replica-lease-namespace, fanout process also needs to manage Leases
+// in that namespace.
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	"github.com/projectsveltos/libsveltos/lib/sharding"
+)
+
+// Name is the name of the subcommand
+const Name = "fanout"
+
+const (
+	// childGracePeriod is how long a child is given to persist its state once asked to stop
+	childGracePeriod = 30 * time.Second
+)
+
+// Cluster is a managed cluster drift is tracked for
+type Cluster struct {
+	Type      libsveltosv1alpha1.ClusterType
+	Namespace string
+	Name      string
+}
+
+func (c Cluster) String() string {
+	return fmt.Sprintf("%s:%s/%s", c.Type, c.Namespace, c.Name)
+}
+
+type options struct {
+	kubeconfig      string
+	clusterTypes    []string
+	clusterSelector string
+	resyncPeriod    time.Duration
+	stateDir        string
+	shardKey        string
+	leaseNamespace  string
+	identity        string
+	budget          Budget
+}
+
+// Budget limits the resources each child, hence each managed cluster, can use, so that a drift
+// storm in one managed cluster does not starve evaluations for the others
+type Budget struct {
+	// EvaluationQPS is the maximum number of resources evaluated per second. No limit when 0.
+	EvaluationQPS float32
+
+	// EvaluationBurst is the maximum number of resources evaluated in one burst
+	EvaluationBurst int
+
+	// MaxProcs is the maximum number of CPUs executing simultaneously (GOMAXPROCS). No limit when 0.
+	MaxProcs int
+}
+
+// Run parses args and supervises one drift-detection-manager per managed cluster till ctx is
+// canceled. Arguments after "--" are passed to each drift-detection-manager, e.g.
+//
+//	drift-detection-manager fanout --cluster-selector=env=prod -- --run-mode=send-updates
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	fs := pflag.NewFlagSet(Name, pflag.ContinueOnError)
+
+	o := &options{}
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "",
+		"Path to the kubeconfig of the management cluster. In-cluster config is used when empty.")
+	fs.StringSliceVar(&o.clusterTypes, "cluster-types",
+		[]string{string(libsveltosv1alpha1.ClusterTypeSveltos), string(libsveltosv1alpha1.ClusterTypeCapi)},
+		"Comma separated list of the types of managed clusters to track. Possible options are Sveltos and Capi.")
+	fs.StringVar(&o.clusterSelector, "cluster-selector", "",
+		"Label selector managed clusters must match to be tracked (e.g. env=prod). All clusters when empty.")
+	fs.DurationVar(&o.resyncPeriod, "resync-period", time.Minute,
+		"How often managed clusters are listed. It is also the delay before a child which exited is started again.")
+	fs.StringVar(&o.stateDir, "state-dir", "",
+		"Directory where each child persists its state (see --state-snapshot-path), in a file named after the cluster. "+
+			"State is not persisted when empty.")
+	fs.StringVar(&o.shardKey, "shard-key", "",
+		"Only track managed clusters whose sharding.projectsveltos.io/key annotation is this value. "+
+			"When empty, only managed clusters without the annotation are tracked.")
+	fs.StringVar(&o.leaseNamespace, "replica-lease-namespace", "",
+		"When set, replicas with the same --shard-key split managed clusters between them, each renewing a Lease "+
+			"in this namespace. Clusters are rebalanced when replicas are scaled.")
+	fs.StringVar(&o.identity, "replica-identity", "",
+		"Identity of this replica (see --replica-lease-namespace). Must be unique. Hostname is used when empty.")
+	fs.Float32Var(&o.budget.EvaluationQPS, "cluster-evaluation-qps", 0,
+		"Maximum number of resources evaluated per second for each managed cluster (see --evaluation-qps). No limit when 0.")
+	fs.IntVar(&o.budget.EvaluationBurst, "cluster-evaluation-burst", 0,
+		"Maximum number of resources evaluated in one burst for each managed cluster (see --evaluation-burst). "+
+			"Default of drift-detection-manager when 0.")
+	fs.IntVar(&o.budget.MaxProcs, "cluster-max-procs", 0,
+		"Maximum number of CPUs simultaneously used by each managed cluster (GOMAXPROCS of its drift-detection-manager). "+
+			"No limit when 0.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	selector, err := labels.Parse(o.clusterSelector)
+	if err != nil {
+		return errors.Wrap(err, "invalid cluster-selector")
+	}
+	clusterTypes := make([]libsveltosv1alpha1.ClusterType, len(o.clusterTypes))
+	for i := range o.clusterTypes {
+		clusterTypes[i] = libsveltosv1alpha1.ClusterType(o.clusterTypes[i])
+		if clusterTypes[i] != libsveltosv1alpha1.ClusterTypeSveltos && clusterTypes[i] != libsveltosv1alpha1.ClusterTypeCapi {
+			return fmt.Errorf("unsupported cluster type %q", o.clusterTypes[i])
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to get drift-detection-manager executable")
+	}
+
+	c, err := getClient(o.kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	m, err := getMembership(c, o)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		defer func() {
+			// Use a new context: ctx is canceled already
+			if err := m.release(context.Background()); err != nil {
+				fmt.Fprintf(out, "failed to release lease: %v\n", err)
+			}
+		}()
+	}
+
+	passThrough := fs.Args()
+	outMu := &sync.Mutex{}
+	s := newSupervisor(func(ctx context.Context, cluster Cluster) error {
+		w := &prefixWriter{mu: outMu, out: out, prefix: []byte(fmt.Sprintf("[%s] ", cluster))}
+		return runChild(ctx, executable, ChildArgs(cluster, passThrough, o.stateDir, o.budget), ChildEnv(o.budget), w)
+	}, out)
+	defer s.stop()
+
+	ticker := time.NewTicker(o.resyncPeriod)
+	defer ticker.Stop()
+	for {
+		if clusters, err := assignedClusters(ctx, c, clusterTypes, selector, o.shardKey, m); err != nil {
+			fmt.Fprintf(out, "failed to get managed clusters: %v\n", err)
+		} else {
+			s.reconcile(ctx, clusters)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// getMembership returns the membership of this replica. Nil if managed clusters are not
+// automatically split between replicas.
+func getMembership(c client.Client, o *options) (*membership, error) {
+	if o.leaseNamespace == "" {
+		return nil, nil
+	}
+
+	identity := o.identity
+	if identity == "" {
+		var err error
+		if identity, err = os.Hostname(); err != nil {
+			return nil, errors.Wrap(err, "failed to get hostname")
+		}
+	}
+
+	// A replica is considered gone after missing a couple of resyncs
+	const missedResyncs = 3
+	return newMembership(c, o.leaseNamespace, identity, o.shardKey, missedResyncs*o.resyncPeriod), nil
+}
+
+func getClient(kubeconfig string) (client.Client, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get rest config")
+	}
+
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		return nil, err
+	}
+	if err := clusterv1.AddToScheme(s); err != nil {
+		return nil, err
+	}
+	if err := libsveltosv1alpha1.AddToScheme(s); err != nil {
+		return nil, err
+	}
+
+	return client.New(config, client.Options{Scheme: s})
+}
+
+// assignedClusters returns the managed clusters this replica must track. When m is not nil,
+// clusters are split between live replicas.
+func assignedClusters(ctx context.Context, c client.Client, clusterTypes []libsveltosv1alpha1.ClusterType,
+	selector labels.Selector, shardKey string, m *membership) ([]Cluster, error) {
+
+	clusters, err := ListClusters(ctx, c, clusterTypes, selector, shardKey)
+	if err != nil || m == nil {
+		return clusters, err
+	}
+
+	if err := m.renew(ctx); err != nil {
+		return nil, err
+	}
+	members, err := m.members(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return owned(clusters, members, m.identity), nil
+}
+
+// ListClusters returns, sorted, the managed clusters of clusterTypes matching selector and
+// shardKey (see sharding.IsShardAMatch) which are neither paused nor being deleted. Cluster types
+// whose CRD is not installed are skipped.
+func ListClusters(ctx context.Context, c client.Client, clusterTypes []libsveltosv1alpha1.ClusterType,
+	selector labels.Selector, shardKey string) ([]Cluster, error) {
+
+	clusters := make([]Cluster, 0)
+	for _, clusterType := range clusterTypes {
+		var err error
+		switch clusterType {
+		case libsveltosv1alpha1.ClusterTypeSveltos:
+			list := &libsveltosv1alpha1.SveltosClusterList{}
+			if err = c.List(ctx, list, client.MatchingLabelsSelector{Selector: selector}); err == nil {
+				for i := range list.Items {
+					if isTracked(&list.Items[i], list.Items[i].Spec.Paused, shardKey) {
+						clusters = append(clusters, Cluster{Type: clusterType,
+							Namespace: list.Items[i].Namespace, Name: list.Items[i].Name})
+					}
+				}
+			}
+		case libsveltosv1alpha1.ClusterTypeCapi:
+			list := &clusterv1.ClusterList{}
+			if err = c.List(ctx, list, client.MatchingLabelsSelector{Selector: selector}); err == nil {
+				for i := range list.Items {
+					if isTracked(&list.Items[i], list.Items[i].Spec.Paused, shardKey) {
+						clusters = append(clusters, Cluster{Type: clusterType,
+							Namespace: list.Items[i].Namespace, Name: list.Items[i].Name})
+					}
+				}
+			}
+		}
+		if err != nil && !meta.IsNoMatchError(err) {
+			return nil, errors.Wrapf(err, "failed to list %s clusters", clusterType)
+		}
+	}
+
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].String() < clusters[j].String() })
+	return clusters, nil
+}
+
+func isTracked(cluster client.Object, paused bool, shardKey string) bool {
+	return !paused && cluster.GetDeletionTimestamp().IsZero() && sharding.IsShardAMatch(shardKey, cluster)
+}
+
+// ChildArgs returns the arguments the drift-detection-manager tracking cluster is started with:
+// budget flags, which passThrough can override, then passThrough, then the flags selecting cluster
+// (which, coming last, take precedence)
+func ChildArgs(cluster Cluster, passThrough []string, stateDir string, budget Budget) []string {
+	args := make([]string, 0)
+	if budget.EvaluationQPS > 0 {
+		args = append(args, fmt.Sprintf("--evaluation-qps=%g", budget.EvaluationQPS))
+	}
+	if budget.EvaluationBurst > 0 {
+		args = append(args, fmt.Sprintf("--evaluation-burst=%d", budget.EvaluationBurst))
+	}
+	args = append(args, passThrough...)
+	args = append(args,
+		"--current-cluster=management-cluster",
+		"--cluster-type="+string(cluster.Type),
+		"--cluster-namespace="+cluster.Namespace,
+		"--cluster-name="+cluster.Name,
+		// Children would all bind the same ports
+		"--diagnostics-address=0",
+		"--health-addr=0",
+	)
+	if stateDir != "" {
+		args = append(args, "--state-snapshot-path="+
+			filepath.Join(stateDir, fmt.Sprintf("%s-%s-%s.json", cluster.Type, cluster.Namespace, cluster.Name)))
+	}
+	return args
+}
+
+// ChildEnv returns the environment the drift-detection-manager tracking a cluster is started
+// with: the one of this process, plus GOMAXPROCS when budget limits CPUs
+func ChildEnv(budget Budget) []string {
+	env := os.Environ()
+	if budget.MaxProcs > 0 {
+		env = append(env, fmt.Sprintf("GOMAXPROCS=%d", budget.MaxProcs))
+	}
+	return env
+}
+
+// runChild runs executable till it exits or ctx is canceled. On cancellation the child is sent
+// SIGTERM and given childGracePeriod to exit.
+func runChild(ctx context.Context, executable string, args, env []string, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Env = env
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = childGracePeriod
+	cmd.Stdout = w
+	cmd.Stderr = w
+	return cmd.Run()
+}
+
+// supervisor keeps one child running per managed cluster
+type supervisor struct {
+	run      func(ctx context.Context, cluster Cluster) error
+	out      io.Writer
+	children map[Cluster]*child
+}
+
+type child struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSupervisor(run func(ctx context.Context, cluster Cluster) error, out io.Writer) *supervisor {
+	return &supervisor{run: run, out: out, children: make(map[Cluster]*child)}
+}
+
+// reconcile stops children of clusters not listed anymore and starts one for each listed cluster
+// without a running child
+func (s *supervisor) reconcile(ctx context.Context, clusters []Cluster) {
+	wanted := make(map[Cluster]bool, len(clusters))
+	for i := range clusters {
+		wanted[clusters[i]] = true
+	}
+
+	for cluster, ch := range s.children {
+		select {
+		case <-ch.done:
+			// Exited. Started again below if still wanted.
+			delete(s.children, cluster)
+			continue
+		default:
+		}
+		if !wanted[cluster] {
+			fmt.Fprintf(s.out, "stopping drift detection for cluster %s\n", cluster)
+			ch.cancel()
+			<-ch.done
+			delete(s.children, cluster)
+		}
+	}
+
+	for i := range clusters {
+		if _, ok := s.children[clusters[i]]; ok {
+			continue
+		}
+		s.start(ctx, clusters[i])
+	}
+}
+
+func (s *supervisor) start(ctx context.Context, cluster Cluster) {
+	fmt.Fprintf(s.out, "starting drift detection for cluster %s\n", cluster)
+
+	childCtx, cancel := context.WithCancel(ctx)
+	ch := &child{cancel: cancel, done: make(chan struct{})}
+	s.children[cluster] = ch
+
+	go func() {
+		defer close(ch.done)
+		err := s.run(childCtx, cluster)
+		if childCtx.Err() == nil {
+			fmt.Fprintf(s.out, "drift detection for cluster %s exited: %v\n", cluster, err)
+		}
+	}()
+}
+
+// stop stops all children and waits for them to exit
+func (s *supervisor) stop() {
+	for _, ch := range s.children {
+		ch.cancel()
+	}
+	for cluster, ch := range s.children {
+		<-ch.done
+		delete(s.children, cluster)
+	}
+}
+
+// prefixWriter writes each line prefixed, so output of children can be told apart.
+// Writes are serialized with mu, shared by all children.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := append(append([]byte{}, w.prefix...), w.buf[:i+1]...)
+		w.buf = w.buf[i+1:]
+
+		w.mu.Lock()
+		_, err := w.out.Write(line)
+		w.mu.Unlock()
+		if err != nil {
+			return len(p), err
+		}
+	}
+}
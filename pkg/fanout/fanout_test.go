@@ -0,0 +1,246 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fanout_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/fanout"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+	"github.com/projectsveltos/libsveltos/lib/sharding"
+)
+
+var _ = Describe("Fanout", func() {
+	It("ListClusters returns matching clusters which are not paused", func() {
+		s := runtime.NewScheme()
+		Expect(libsveltosv1alpha1.AddToScheme(s)).To(Succeed())
+		Expect(clusterv1.AddToScheme(s)).To(Succeed())
+
+		objects := []runtime.Object{
+			&libsveltosv1alpha1.SveltosCluster{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "prod", Labels: map[string]string{"env": "prod"}},
+			},
+			&libsveltosv1alpha1.SveltosCluster{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "dev", Labels: map[string]string{"env": "dev"}},
+			},
+			&libsveltosv1alpha1.SveltosCluster{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "paused", Labels: map[string]string{"env": "prod"}},
+				Spec:       libsveltosv1alpha1.SveltosClusterSpec{Paused: true},
+			},
+			&libsveltosv1alpha1.SveltosCluster{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "shard", Labels: map[string]string{"env": "prod"},
+					Annotations: map[string]string{sharding.ShardAnnotation: "shard1"}},
+			},
+			&clusterv1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "b", Name: "prod", Labels: map[string]string{"env": "prod"}},
+			},
+		}
+		c := fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(objects...).Build()
+
+		selector, err := labels.Parse("env=prod")
+		Expect(err).To(BeNil())
+
+		clusters, err := fanout.ListClusters(context.TODO(), c,
+			[]libsveltosv1alpha1.ClusterType{libsveltosv1alpha1.ClusterTypeSveltos, libsveltosv1alpha1.ClusterTypeCapi},
+			selector, "")
+		Expect(err).To(BeNil())
+		Expect(clusters).To(Equal([]fanout.Cluster{
+			{Type: libsveltosv1alpha1.ClusterTypeCapi, Namespace: "b", Name: "prod"},
+			{Type: libsveltosv1alpha1.ClusterTypeSveltos, Namespace: "a", Name: "prod"},
+		}))
+
+		clusters, err = fanout.ListClusters(context.TODO(), c,
+			[]libsveltosv1alpha1.ClusterType{libsveltosv1alpha1.ClusterTypeSveltos}, selector, "shard1")
+		Expect(err).To(BeNil())
+		Expect(clusters).To(Equal([]fanout.Cluster{
+			{Type: libsveltosv1alpha1.ClusterTypeSveltos, Namespace: "a", Name: "shard"},
+		}))
+	})
+
+	It("Owner only moves clusters of members which left", func() {
+		clusters := make([]fanout.Cluster, 100)
+		for i := range clusters {
+			clusters[i] = fanout.Cluster{Type: libsveltosv1alpha1.ClusterTypeSveltos, Namespace: "a", Name: fmt.Sprintf("c%d", i)}
+		}
+
+		members := []string{"replica-0", "replica-1", "replica-2"}
+		owners := map[string]int{}
+		for i := range clusters {
+			owners[fanout.Owner(clusters[i], members)]++
+		}
+		// Clusters are spread across all members
+		Expect(owners).To(HaveLen(len(members)))
+
+		for i := range clusters {
+			owner := fanout.Owner(clusters[i], members)
+			if owner != "replica-2" {
+				Expect(fanout.Owner(clusters[i], members[:2])).To(Equal(owner))
+			}
+		}
+	})
+
+	It("membership returns live replicas with the same shard key", func() {
+		s := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		c := fake.NewClientBuilder().WithScheme(s).Build()
+
+		const namespace = "projectsveltos"
+		a := fanout.NewMembership(c, namespace, "replica-a", "", time.Minute)
+		b := fanout.NewMembership(c, namespace, "replica-b", "", time.Minute)
+		other := fanout.NewMembership(c, namespace, "replica-c", "shard1", time.Minute)
+		Expect(fanout.Renew(a, context.TODO())).To(Succeed())
+		Expect(fanout.Renew(b, context.TODO())).To(Succeed())
+		Expect(fanout.Renew(other, context.TODO())).To(Succeed())
+		// Renewing an existing lease
+		Expect(fanout.Renew(a, context.TODO())).To(Succeed())
+
+		Expect(fanout.Members(a, context.TODO())).To(Equal([]string{"replica-a", "replica-b"}))
+
+		Expect(fanout.Release(b, context.TODO())).To(Succeed())
+		Expect(fanout.Members(a, context.TODO())).To(Equal([]string{"replica-a"}))
+	})
+
+	It("ChildArgs selects cluster after pass through arguments", func() {
+		cluster := fanout.Cluster{Type: libsveltosv1alpha1.ClusterTypeSveltos, Namespace: "a", Name: "prod"}
+
+		Expect(fanout.ChildArgs(cluster, []string{"--cluster-name=other", "--report-only"}, "/state",
+			fanout.Budget{})).To(Equal([]string{
+			"--cluster-name=other",
+			"--report-only",
+			"--current-cluster=management-cluster",
+			"--cluster-type=Sveltos",
+			"--cluster-namespace=a",
+			"--cluster-name=prod",
+			"--diagnostics-address=0",
+			"--health-addr=0",
+			"--state-snapshot-path=/state/Sveltos-a-prod.json",
+		}))
+	})
+
+	It("ChildArgs and ChildEnv apply per cluster budget", func() {
+		cluster := fanout.Cluster{Type: libsveltosv1alpha1.ClusterTypeCapi, Namespace: "a", Name: "prod"}
+		budget := fanout.Budget{EvaluationQPS: 2.5, EvaluationBurst: 5, MaxProcs: 2}
+
+		Expect(fanout.ChildArgs(cluster, []string{"--evaluation-burst=20"}, "", budget)).To(Equal([]string{
+			"--evaluation-qps=2.5",
+			"--evaluation-burst=5",
+			"--evaluation-burst=20",
+			"--current-cluster=management-cluster",
+			"--cluster-type=Capi",
+			"--cluster-namespace=a",
+			"--cluster-name=prod",
+			"--diagnostics-address=0",
+			"--health-addr=0",
+		}))
+
+		Expect(fanout.ChildEnv(budget)).To(ContainElement("GOMAXPROCS=2"))
+		Expect(fanout.ChildEnv(fanout.Budget{})).ToNot(ContainElement(HavePrefix("GOMAXPROCS=")))
+	})
+
+	It("supervisor starts, restarts and stops one child per cluster", func() {
+		a := fanout.Cluster{Type: libsveltosv1alpha1.ClusterTypeSveltos, Namespace: "a", Name: "a"}
+		b := fanout.Cluster{Type: libsveltosv1alpha1.ClusterTypeSveltos, Namespace: "b", Name: "b"}
+
+		var mu sync.Mutex
+		starts := map[fanout.Cluster]int{}
+		exit := make(chan struct{})
+		s := fanout.NewSupervisor(func(ctx context.Context, cluster fanout.Cluster) error {
+			mu.Lock()
+			starts[cluster]++
+			mu.Unlock()
+			select {
+			case <-ctx.Done():
+			case <-exit:
+			}
+			return nil
+		}, io.Discard)
+		defer fanout.Stop(s)
+
+		getStarts := func(cluster fanout.Cluster) int {
+			mu.Lock()
+			defer mu.Unlock()
+			return starts[cluster]
+		}
+
+		fanout.Reconcile(s, context.TODO(), []fanout.Cluster{a, b})
+		Expect(fanout.GetChildren(s)).To(ConsistOf(a, b))
+		Eventually(func() int { return getStarts(a) + getStarts(b) }, time.Second).Should(Equal(2))
+
+		// Children of clusters not listed anymore are stopped
+		fanout.Reconcile(s, context.TODO(), []fanout.Cluster{a})
+		Expect(fanout.GetChildren(s)).To(ConsistOf(a))
+
+		// Children which exited are started again
+		close(exit)
+		Eventually(func() int {
+			fanout.Reconcile(s, context.TODO(), []fanout.Cluster{a})
+			return getStarts(a)
+		}, time.Second).Should(BeNumerically(">", 1))
+		Expect(fanout.GetChildren(s)).To(ConsistOf(a))
+		Expect(getStarts(b)).To(Equal(1))
+	})
+
+	It("CompareClusters reports clusters diverging from the fleet norm", func() {
+		deployment := corev1.ObjectReference{Kind: "Deployment", APIVersion: "apps/v1", Namespace: "kube-system", Name: "coredns"}
+		configMap := corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1", Namespace: "kube-system", Name: "coredns"}
+		role := corev1.ObjectReference{Kind: "ClusterRole", APIVersion: "rbac.authorization.k8s.io/v1", Name: "view"}
+
+		newState := func(hashes map[corev1.ObjectReference][]byte) *driftdetection.PersistedHashes {
+			return &driftdetection.PersistedHashes{HashMode: driftdetection.FullHashMode, Hashes: hashes}
+		}
+		states := map[string]*driftdetection.PersistedHashes{
+			"a": newState(map[corev1.ObjectReference][]byte{deployment: []byte("1"), configMap: []byte("1"), role: []byte("1")}),
+			"b": newState(map[corev1.ObjectReference][]byte{deployment: []byte("1"), configMap: []byte("1"), role: []byte("2")}),
+			"c": newState(map[corev1.ObjectReference][]byte{deployment: []byte("1"), configMap: []byte("2")}),
+			"d": newState(map[corev1.ObjectReference][]byte{deployment: []byte("2"), configMap: []byte("2")}),
+		}
+
+		report, err := fanout.CompareClusters(states, 3)
+		Expect(err).To(BeNil())
+		Expect(report.Clusters).To(Equal([]string{"a", "b", "c", "d"}))
+
+		// ClusterRole is only tracked in two clusters. No norm for ConfigMap.
+		Expect(report.Resources).To(HaveLen(2))
+		Expect(report.Resources[0].Resource).To(Equal(configMap))
+		Expect(report.Resources[0].Norm).To(BeZero())
+		Expect(report.Resources[0].Divergent).To(Equal([]string{"a", "b", "c", "d"}))
+		Expect(report.Resources[1].Resource).To(Equal(deployment))
+		Expect(report.Resources[1].Norm).To(Equal(3))
+		Expect(report.Resources[1].Divergent).To(Equal([]string{"d"}))
+		Expect(report.Snowflakes).To(Equal([]fanout.ClusterDivergence{{Cluster: "d", DivergentResources: 1}}))
+
+		states["d"].HashMode = driftdetection.SpecHashMode
+		_, err = fanout.CompareClusters(states, 3)
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,160 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fanout
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/projectsveltos/libsveltos/lib/sharding"
+)
+
+const (
+	// memberLabel is set on the Lease of each fanout replica
+	memberLabel = "projectsveltos.io/drift-detection-fanout"
+
+	leaseNamePrefix = "drift-detection-fanout-"
+)
+
+// membership tracks the live fanout replicas sharing a shard key, so managed clusters can be
+// split between them. Each replica keeps its own Lease renewed. Replicas whose Lease is not
+// renewed within its duration are considered gone.
+type membership struct {
+	c             client.Client
+	namespace     string
+	identity      string
+	shardKey      string
+	leaseDuration time.Duration
+}
+
+func newMembership(c client.Client, namespace, identity, shardKey string, leaseDuration time.Duration) *membership {
+	return &membership{c: c, namespace: namespace, identity: identity, shardKey: shardKey,
+		leaseDuration: leaseDuration}
+}
+
+// renew creates or renews the Lease of this replica
+func (m *membership) renew(ctx context.Context) error {
+	lease := &coordinationv1.Lease{}
+	err := m.c.Get(ctx, client.ObjectKey{Namespace: m.namespace, Name: leaseNamePrefix + m.identity}, lease)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "failed to get lease")
+	}
+
+	now := metav1.NewMicroTime(time.Now())
+	identity := m.identity
+	leaseDurationSeconds := int32(m.leaseDuration.Seconds())
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   m.namespace,
+				Name:        leaseNamePrefix + m.identity,
+				Labels:      map[string]string{memberLabel: "true"},
+				Annotations: map[string]string{sharding.ShardAnnotation: m.shardKey},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &leaseDurationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		return errors.Wrap(m.c.Create(ctx, lease), "failed to create lease")
+	}
+
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &leaseDurationSeconds
+	lease.Spec.RenewTime = &now
+	return errors.Wrap(m.c.Update(ctx, lease), "failed to renew lease")
+}
+
+// members returns, sorted, the identities of the live replicas with the same shard key,
+// this replica included
+func (m *membership) members(ctx context.Context) ([]string, error) {
+	leases := &coordinationv1.LeaseList{}
+	if err := m.c.List(ctx, leases, client.InNamespace(m.namespace), client.MatchingLabels{memberLabel: "true"}); err != nil {
+		return nil, errors.Wrap(err, "failed to list leases")
+	}
+
+	now := time.Now()
+	members := []string{m.identity}
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		if lease.Annotations[sharding.ShardAnnotation] != m.shardKey || lease.Spec.HolderIdentity == nil ||
+			*lease.Spec.HolderIdentity == m.identity || !isLive(lease, now) {
+
+			continue
+		}
+		members = append(members, *lease.Spec.HolderIdentity)
+	}
+
+	sort.Strings(members)
+	return members, nil
+}
+
+// release deletes the Lease of this replica, so that other replicas take over its clusters
+// without waiting for Lease to expire
+func (m *membership) release(ctx context.Context) error {
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: m.namespace, Name: leaseNamePrefix + m.identity},
+	}
+	return client.IgnoreNotFound(m.c.Delete(ctx, lease))
+}
+
+func isLive(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return now.Before(expiry)
+}
+
+// Owner returns the member cluster is assigned to, using rendezvous (highest random weight)
+// hashing: when members change only the clusters of the members which left, or a fair share
+// of clusters for the members which joined, are moved.
+func Owner(cluster Cluster, members []string) string {
+	var owner string
+	var highest uint64
+	for i := range members {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(members[i]))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(cluster.String()))
+		if weight := h.Sum64(); owner == "" || weight > highest {
+			owner, highest = members[i], weight
+		}
+	}
+	return owner
+}
+
+// owned returns the clusters assigned to identity
+func owned(clusters []Cluster, members []string, identity string) []Cluster {
+	result := make([]Cluster, 0, len(clusters))
+	for i := range clusters {
+		if Owner(clusters[i], members) == identity {
+			result = append(result, clusters[i])
+		}
+	}
+	return result
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package features contains drift-detection-manager feature gates. Experimental capabilities
+// ship behind an Alpha gate (disabled by default) and are enabled per cluster via
+// --feature-gates (e.g. --feature-gates=PermissionSelfTest=false).
+//
+// To add a feature gate, define its name below, add it to defaultFeatureGates and check it with
+// Enabled wherever the capability is wired in.
+package features
+
+import (
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/component-base/featuregate"
+)
+
+const (
+	// PermissionSelfTest verifies, via SelfSubjectAccessReview, that drift-detection-manager can get,
+	// list and watch each tracked GVK, reporting missing permissions.
+	PermissionSelfTest featuregate.Feature = "PermissionSelfTest"
+)
+
+// defaultFeatureGates contains all known feature gates and their default settings
+var defaultFeatureGates = map[featuregate.Feature]featuregate.FeatureSpec{
+	PermissionSelfTest: {Default: true, PreRelease: featuregate.Beta},
+}
+
+// MutableFeatureGate is the feature gate to set from --feature-gates
+var MutableFeatureGate featuregate.MutableFeatureGate = featuregate.NewFeatureGate()
+
+func init() {
+	runtime.Must(MutableFeatureGate.Add(defaultFeatureGates))
+}
+
+// Enabled returns true if feature is enabled
+func Enabled(feature featuregate.Feature) bool {
+	return MutableFeatureGate.Enabled(feature)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package features_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/spf13/pflag"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/features"
+)
+
+var _ = Describe("Feature gates", func() {
+	AfterEach(func() {
+		Expect(features.MutableFeatureGate.Set(string(features.PermissionSelfTest) + "=true")).To(Succeed())
+	})
+
+	It("PermissionSelfTest is enabled by default", func() {
+		Expect(features.Enabled(features.PermissionSelfTest)).To(BeTrue())
+	})
+
+	It("--feature-gates enables and disables feature gates", func() {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		features.MutableFeatureGate.AddFlag(fs)
+
+		Expect(fs.Parse([]string{"--feature-gates=PermissionSelfTest=false"})).To(Succeed())
+		Expect(features.Enabled(features.PermissionSelfTest)).To(BeFalse())
+
+		Expect(fs.Parse([]string{"--feature-gates=PermissionSelfTest=true"})).To(Succeed())
+		Expect(features.Enabled(features.PermissionSelfTest)).To(BeTrue())
+	})
+
+	It("--feature-gates rejects unknown feature gates", func() {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		features.MutableFeatureGate.AddFlag(fs)
+
+		Expect(fs.Parse([]string{"--feature-gates=UnknownFeature=true"})).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,40 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fips reports whether drift-detection-manager runs in FIPS mode: built with
+// GOEXPERIMENT=boringcrypto (see make build-fips), so that all cryptography (SHA-256 hashing of
+// tracked resources, HMACs, TLS) goes through the FIPS validated BoringCrypto module and TLS is
+// restricted to FIPS approved settings.
+// drift-detection-manager only uses FIPS approved algorithms (SHA-256 family) regardless of mode.
+package fips
+
+import (
+	"errors"
+)
+
+// Enabled returns true if cryptography goes through the FIPS validated module
+func Enabled() bool {
+	return enabled()
+}
+
+// Assert returns an error if drift-detection-manager does not run in FIPS mode
+func Assert() error {
+	if !Enabled() {
+		return errors.New("FIPS mode requested but binary was not built with GOEXPERIMENT=boringcrypto " +
+			"or BoringCrypto is not available on this platform")
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build !boringcrypto
+
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fips_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/fips"
+)
+
+var _ = Describe("FIPS", func() {
+	It("FIPS mode is disabled unless built with GOEXPERIMENT=boringcrypto", func() {
+		Expect(fips.Enabled()).To(BeFalse())
+		Expect(fips.Assert()).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,192 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package inspect implements the inspect subcommand, which fetches the live state of a running
+// drift-detection-manager from its diagnostics endpoint and prints it, for troubleshooting.
+// It can be run inside the pod (kubectl exec) or locally against a port-forwarded endpoint.
+package inspect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/mtls"
+)
+
+// Name is the name of the subcommand
+const Name = "inspect"
+
+const (
+	humanOutput = "human"
+	jsonOutput  = "json"
+
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	requestTimeout          = 30 * time.Second
+)
+
+type options struct {
+	address               string
+	tokenFile             string
+	insecureSkipTLSVerify bool
+	tls                   mtls.ClientOptions
+	output                string
+}
+
+// Run parses args, fetches state from drift-detection-manager and writes it to out
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	fs := pflag.NewFlagSet(Name, pflag.ContinueOnError)
+
+	o := &options{}
+	fs.StringVar(&o.address, "address", "https://localhost:8443",
+		"Address of drift-detection-manager diagnostics endpoint (see --diagnostics-address).")
+	fs.StringVar(&o.tokenFile, "token-file", serviceAccountTokenFile,
+		"File containing the bearer token used to authenticate. Ignored if it does not exist.")
+	fs.BoolVar(&o.insecureSkipTLSVerify, "insecure-skip-tls-verify", true,
+		"Skip verification of the diagnostics endpoint certificate, which is self-signed by default.")
+	o.tls.AddFlags(fs)
+	fs.StringVarP(&o.output, "output", "o", humanOutput, "Output format. Possible options are human or json.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if o.output != humanOutput && o.output != jsonOutput {
+		return fmt.Errorf("unsupported output %q", o.output)
+	}
+
+	state, err := fetchState(ctx, o)
+	if err != nil {
+		return err
+	}
+
+	if o.output == jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(state)
+	}
+
+	return printState(state, out)
+}
+
+func fetchState(ctx context.Context, o *options) (*driftdetection.State, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(o.address, "/")+driftdetection.StatePath, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := os.ReadFile(o.tokenFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to read token file")
+	}
+	if len(token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	tlsConfig, err := o.tls.TLSConfig(o.insecureSkipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Client{
+		Timeout:   requestTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to contact drift-detection-manager")
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	state := &driftdetection.State{}
+	if err := json.NewDecoder(resp.Body).Decode(state); err != nil {
+		return nil, errors.Wrap(err, "failed to decode state")
+	}
+	return state, nil
+}
+
+func printState(state *driftdetection.State, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "WATCHERS")
+	fmt.Fprintln(w, "GVK\tMODE\tSYNCED\tCACHED\tTRACKED")
+	for i := range state.Watchers {
+		watcher := &state.Watchers[i]
+		fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%d\n", watcher.GroupVersionKind.String(), watcher.Mode,
+			watcher.Synced, watcher.CachedObjects, watcher.TrackedResources)
+	}
+
+	fmt.Fprintln(w, "\nTRACKED RESOURCES")
+	fmt.Fprintln(w, "RESOURCE\tRESOURCE VERSION\tHASH\tCONSUMERS\tHELM CONSUMERS")
+	for i := range state.Resources {
+		resource := &state.Resources[i]
+		hash := resource.Hash
+		if hash == "" {
+			hash = "<none>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", formatRef(&resource.Resource), resource.ResourceVersion,
+			hash, formatRefs(resource.Consumers), formatRefs(resource.HelmConsumers))
+	}
+
+	fmt.Fprintln(w, "\nQUEUE")
+	fmt.Fprintln(w, "RESOURCE\tQUEUED")
+	for i := range state.Queue {
+		queued := &state.Queue[i]
+		fmt.Fprintf(w, "%s\t%s\n", formatRef(&queued.Resource), time.Since(queued.QueuedAt).Round(time.Second))
+	}
+
+	return w.Flush()
+}
+
+// formatRef returns Kind.group namespace/name (or Kind.group name for cluster wide resources)
+func formatRef(ref *corev1.ObjectReference) string {
+	gk := ref.GroupVersionKind().GroupKind().String()
+	if ref.Namespace == "" {
+		return fmt.Sprintf("%s %s", gk, ref.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", gk, ref.Namespace, ref.Name)
+}
+
+func formatRefs(refs []corev1.ObjectReference) string {
+	if len(refs) == 0 {
+		return "-"
+	}
+	result := make([]string, len(refs))
+	for i := range refs {
+		result[i] = refs[i].Name
+		if refs[i].Namespace != "" {
+			result[i] = refs[i].Namespace + "/" + refs[i].Name
+		}
+	}
+	return strings.Join(result, ",")
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package issues opens an issue, on GitHub or GitLab, for each resource whose drift persists
+// beyond a configurable duration, so that drifts Sveltos does not remediate on its own (for
+// instance in report-only mode) enter ticket-driven workflows. There is at most one open issue
+// per resource: issues are titled after the resource and the managed cluster, and an open issue
+// with the same title is reused, also across restarts. Once Sveltos remediated the drift, issue
+// is commented and closed.
+package issues
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/egress"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// Provider is the Git provider issues are opened on
+type Provider string
+
+const (
+	// GitHubProvider opens GitHub issues
+	GitHubProvider = Provider("github")
+
+	// GitLabProvider opens GitLab issues
+	GitLabProvider = Provider("gitlab")
+)
+
+const (
+	defaultGitHubURL = "https://api.github.com"
+	defaultGitLabURL = "https://gitlab.com/api/v4"
+
+	defaultLabel = "sveltos-drift"
+
+	// maxCheckInterval bounds how often persistent drifts are looked for
+	maxCheckInterval = time.Minute
+)
+
+// Options configures a Sink
+type Options struct {
+	// Provider is the Git provider issues are opened on
+	Provider Provider
+
+	// URL is the API URL of the Git provider. Public GitHub or GitLab if not set.
+	URL string
+
+	// Repository is the repository issues are opened in: owner/name on GitHub, the project ID
+	// or path on GitLab
+	Repository string
+
+	// TokenFile is the file (e.g. mounted from a Secret) containing the token issues are
+	// opened with
+	TokenFile string
+
+	// Label is the label of opened issues
+	Label string
+
+	// After is how long drift of a resource must persist before an issue is opened
+	After time.Duration
+
+	// Cluster identifies the managed cluster, as type:namespace/name
+	Cluster string
+}
+
+// drift is a drift which was not remediated yet
+type drift struct {
+	event driftdetection.DriftEvent
+	// since is when resource first drifted
+	since time.Time
+	// issue, once opened, is the ID of the issue
+	issue string
+	// remediated is set once Sveltos remediated drift: issue, if any, must be closed
+	remediated bool
+	// remediatedBy is the ResourceSummary which remediated drift
+	remediatedBy corev1.ObjectReference
+}
+
+// Sink opens issues for persistent drifts (see driftdetection.AddDriftEventSink)
+type Sink struct {
+	provider provider
+	label    string
+	after    time.Duration
+	cluster  string
+
+	mu     sync.Mutex
+	drifts map[corev1.ObjectReference]*drift
+	log    logr.Logger
+}
+
+// New returns a Sink opening issues as described by options. Fails if options are invalid or
+// Git provider is not allowed (see egress.SetAllowlist). Issues are only opened once Run is called.
+func New(options *Options, logger logr.Logger) (*Sink, error) {
+	if options.Repository == "" {
+		return nil, fmt.Errorf("repository must be set")
+	}
+	if options.After <= 0 {
+		return nil, fmt.Errorf("drift duration must be positive")
+	}
+
+	data, err := os.ReadFile(options.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("no token found in %s", options.TokenFile)
+	}
+
+	label := options.Label
+	if label == "" {
+		label = defaultLabel
+	}
+
+	apiURL := options.URL
+	var p provider
+	switch options.Provider {
+	case GitHubProvider:
+		if apiURL == "" {
+			apiURL = defaultGitHubURL
+		}
+		if strings.Count(options.Repository, "/") != 1 {
+			return nil, fmt.Errorf("invalid repository %q: must be owner/name", options.Repository)
+		}
+		p = &gitHub{client: newClient("Authorization", "Bearer "+token),
+			url: fmt.Sprintf("%s/repos/%s", strings.TrimSuffix(apiURL, "/"), options.Repository), label: label}
+	case GitLabProvider:
+		if apiURL == "" {
+			apiURL = defaultGitLabURL
+		}
+		p = &gitLab{client: newClient("PRIVATE-TOKEN", token),
+			url: fmt.Sprintf("%s/projects/%s", strings.TrimSuffix(apiURL, "/"),
+				url.PathEscape(options.Repository)), label: label}
+	default:
+		return nil, fmt.Errorf("unsupported provider %q", options.Provider)
+	}
+
+	if err := egress.Register("issues", apiURL); err != nil {
+		return nil, err
+	}
+
+	return &Sink{
+		provider: p,
+		label:    label,
+		after:    options.After,
+		cluster:  options.Cluster,
+		drifts:   make(map[corev1.ObjectReference]*drift),
+		log:      logger,
+	}, nil
+}
+
+// Run opens issues for persistent drifts, and closes the ones of remediated drifts, till ctx is
+// canceled
+func (s *Sink) Run(ctx context.Context) {
+	interval := s.after
+	if interval > maxCheckInterval {
+		interval = maxCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sync(ctx)
+		}
+	}
+}
+
+// DriftDetected starts tracking how long resource has been drifted, unless it already is
+func (s *Sink) DriftDetected(event *driftdetection.DriftEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.drifts[event.Resource]; ok && !d.remediated {
+		// Keep the time resource first drifted and report its most recent drift
+		d.event = *event
+		return
+	}
+	s.drifts[event.Resource] = &drift{event: *event, since: event.Time}
+}
+
+// DriftRemediated marks drift as remediated: its issue, if any, is closed
+func (s *Sink) DriftRemediated(event *driftdetection.DriftEvent, resourceSummary *corev1.ObjectReference) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.drifts[event.Resource]
+	if !ok {
+		return
+	}
+	if d.issue == "" {
+		delete(s.drifts, event.Resource)
+		return
+	}
+	d.remediated = true
+	d.remediatedBy = *resourceSummary
+}
+
+// sync opens issues for drifts persisting beyond s.after and closes issues of remediated drifts.
+// Calls to the Git provider are made without holding s.mu, so that drift detection is never
+// blocked by the Git provider.
+func (s *Sink) sync(ctx context.Context) {
+	now := time.Now()
+	toOpen := make([]drift, 0)
+	toClose := make([]drift, 0)
+
+	s.mu.Lock()
+	for _, d := range s.drifts {
+		switch {
+		case d.remediated:
+			toClose = append(toClose, *d)
+		case d.issue == "" && now.Sub(d.since) >= s.after:
+			toOpen = append(toOpen, *d)
+		}
+	}
+	s.mu.Unlock()
+
+	for i := range toOpen {
+		issue, err := s.openIssue(ctx, &toOpen[i])
+		if err != nil {
+			s.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to open issue for %s: %v",
+				getResourceID(&toOpen[i].event.Resource), err))
+			continue
+		}
+		s.mu.Lock()
+		if d, ok := s.drifts[toOpen[i].event.Resource]; ok {
+			d.issue = issue
+		}
+		s.mu.Unlock()
+	}
+
+	for i := range toClose {
+		comment := fmt.Sprintf("Drift was remediated by Sveltos (ResourceSummary %s/%s).",
+			toClose[i].remediatedBy.Namespace, toClose[i].remediatedBy.Name)
+		if err := s.provider.close(ctx, toClose[i].issue, comment); err != nil {
+			s.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to close issue %s: %v", toClose[i].issue, err))
+			continue
+		}
+		s.mu.Lock()
+		if d, ok := s.drifts[toClose[i].event.Resource]; ok && d.remediated && d.issue == toClose[i].issue {
+			delete(s.drifts, toClose[i].event.Resource)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// openIssue returns the open issue of drift, opening it if none exists yet
+func (s *Sink) openIssue(ctx context.Context, d *drift) (string, error) {
+	title := s.getTitle(&d.event.Resource)
+	issue, found, err := s.provider.find(ctx, title)
+	if err != nil || found {
+		return issue, err
+	}
+	return s.provider.open(ctx, title, s.getBody(d))
+}
+
+// getTitle returns the title of the issue of resource. It identifies the issue: it must never
+// change for the same resource and cluster.
+func (s *Sink) getTitle(resourceRef *corev1.ObjectReference) string {
+	return fmt.Sprintf("Configuration drift: %s in %s", getResourceID(resourceRef), s.cluster)
+}
+
+func (s *Sink) getBody(d *drift) string {
+	var b strings.Builder
+	description := "was modified"
+	switch {
+	case d.event.ValuesDrift:
+		description = "is a Helm release whose values drifted"
+	case d.event.Deleted:
+		description = "was deleted"
+	}
+
+	fmt.Fprintf(&b, "Resource `%s` in cluster `%s` %s, and has been drifted since %s.\n\n",
+		getResourceID(&d.event.Resource), s.cluster, description, d.since.UTC().Format(time.RFC3339))
+	if d.event.ReportOnly {
+		b.WriteString("Drift was only recorded: Sveltos will not remediate it.\n\n")
+	}
+	if len(d.event.Consumers) != 0 {
+		b.WriteString("Resource is deployed by ResourceSummaries:\n")
+		for i := range d.event.Consumers {
+			fmt.Fprintf(&b, "- %s/%s\n", d.event.Consumers[i].Namespace, d.event.Consumers[i].Name)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("This issue is closed once Sveltos remediates the drift.\n")
+	return b.String()
+}
+
+// getResourceID returns apiVersion/kind/namespace/name (no namespace for cluster wide resources)
+func getResourceID(resourceRef *corev1.ObjectReference) string {
+	if resourceRef.Namespace == "" {
+		return fmt.Sprintf("%s/%s/%s", resourceRef.APIVersion, resourceRef.Kind, resourceRef.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", resourceRef.APIVersion, resourceRef.Kind, resourceRef.Namespace,
+		resourceRef.Name)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package issues_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/issues"
+)
+
+// gitHub is a fake GitHub repository API
+type gitHub struct {
+	mu     sync.Mutex
+	issues map[string]map[string]interface{}
+	// comments contains, per issue number, its comments
+	comments map[string][]string
+}
+
+func (g *gitHub) handle(w http.ResponseWriter, r *http.Request) {
+	defer GinkgoRecover()
+	Expect(r.Header.Get("Authorization")).To(Equal("Bearer secret"))
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	body := map[string]interface{}{}
+	if r.Method != http.MethodGet {
+		Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/repos/org/repo/issues":
+		Expect(r.URL.Query().Get("labels")).To(Equal("drift"))
+		open := make([]map[string]interface{}, 0)
+		for _, issue := range g.issues {
+			if issue["state"] == "open" {
+				open = append(open, issue)
+			}
+		}
+		Expect(json.NewEncoder(w).Encode(open)).To(Succeed())
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/org/repo/issues":
+		Expect(body["labels"]).To(ConsistOf("drift"))
+		number := len(g.issues) + 1
+		issue := map[string]interface{}{"number": number, "title": body["title"], "state": "open"}
+		g.issues[strconv.Itoa(number)] = issue
+		Expect(json.NewEncoder(w).Encode(issue)).To(Succeed())
+	case r.Method == http.MethodPost:
+		number := filepath.Base(filepath.Dir(r.URL.Path))
+		g.comments[number] = append(g.comments[number], body["body"].(string))
+	case r.Method == http.MethodPatch:
+		g.issues[filepath.Base(r.URL.Path)]["state"] = body["state"]
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (g *gitHub) getIssues() map[string]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	result := make(map[string]string)
+	for _, issue := range g.issues {
+		result[issue["title"].(string)] = issue["state"].(string)
+	}
+	return result
+}
+
+var _ = Describe("Issues", func() {
+	var fake *gitHub
+	var server *httptest.Server
+	var options *issues.Options
+
+	BeforeEach(func() {
+		fake = &gitHub{issues: map[string]map[string]interface{}{}, comments: map[string][]string{}}
+		server = httptest.NewServer(http.HandlerFunc(fake.handle))
+
+		tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+		Expect(os.WriteFile(tokenFile, []byte("secret\n"), 0600)).To(Succeed())
+
+		options = &issues.Options{Provider: issues.GitHubProvider, URL: server.URL, Repository: "org/repo",
+			TokenFile: tokenFile, Label: "drift", After: 200 * time.Millisecond, Cluster: "sveltos:default/cluster"}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("opens one issue per persistent drift and closes it once drift is remediated", func() {
+		sink, err := issues.New(options, logr.Discard())
+		Expect(err).To(BeNil())
+
+		ctx, cancel := context.WithCancel(context.TODO())
+		defer cancel()
+		go sink.Run(ctx)
+
+		drift := &driftdetection.DriftEvent{
+			Time:     time.Now(),
+			Resource: corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm"},
+		}
+		title := "Configuration drift: v1/ConfigMap/default/cm in sveltos:default/cluster"
+
+		sink.DriftDetected(drift)
+		Eventually(fake.getIssues, time.Minute, 100*time.Millisecond).Should(
+			Equal(map[string]string{title: "open"}))
+
+		// Resource drifting again is deduplicated
+		sink.DriftDetected(drift)
+		Consistently(fake.getIssues, time.Second, 100*time.Millisecond).Should(
+			Equal(map[string]string{title: "open"}))
+
+		sink.DriftRemediated(drift, &corev1.ObjectReference{Namespace: "projectsveltos", Name: "summary"})
+		Eventually(fake.getIssues, time.Minute, 100*time.Millisecond).Should(
+			Equal(map[string]string{title: "closed"}))
+		fake.mu.Lock()
+		Expect(fake.comments["1"]).To(ConsistOf(ContainSubstring("projectsveltos/summary")))
+		fake.mu.Unlock()
+	})
+
+	It("reuses the open issue of a resource and ignores drifts remediated before persisting", func() {
+		title := "Configuration drift: v1/ConfigMap/default/cm in sveltos:default/cluster"
+		fake.issues["1"] = map[string]interface{}{"number": 1, "title": title, "state": "open"}
+
+		sink, err := issues.New(options, logr.Discard())
+		Expect(err).To(BeNil())
+
+		ctx, cancel := context.WithCancel(context.TODO())
+		defer cancel()
+		go sink.Run(ctx)
+
+		shortLived := &driftdetection.DriftEvent{
+			Time:     time.Now(),
+			Resource: corev1.ObjectReference{APIVersion: "v1", Kind: "Secret", Namespace: "default", Name: "s"},
+		}
+		sink.DriftDetected(shortLived)
+		sink.DriftRemediated(shortLived, &corev1.ObjectReference{Namespace: "projectsveltos", Name: "summary"})
+
+		sink.DriftDetected(&driftdetection.DriftEvent{
+			Time:     time.Now(),
+			Resource: corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "cm"},
+		})
+		Consistently(fake.getIssues, time.Second, 100*time.Millisecond).Should(
+			Equal(map[string]string{title: "open"}))
+	})
+
+	It("rejects invalid options", func() {
+		options.Repository = "repo"
+		_, err := issues.New(options, logr.Discard())
+		Expect(err).ToNot(BeNil())
+
+		options.Repository = "org/repo"
+		options.Provider = "bitbucket"
+		_, err = issues.New(options, logr.Discard())
+		Expect(err).ToNot(BeNil())
+
+		options.Provider = issues.GitLabProvider
+		options.After = 0
+		_, err = issues.New(options, logr.Discard())
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,214 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package issues
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// requestTimeout bounds each request to the Git provider
+	requestTimeout = 10 * time.Second
+
+	// pageSize is the number of issues listed per request
+	pageSize = 100
+
+	// maxPages bounds the number of pages of open issues looked at when looking for an issue
+	maxPages = 10
+)
+
+// provider opens and closes issues on a Git provider
+type provider interface {
+	// find returns the open issue, labeled with drift label, with title
+	find(ctx context.Context, title string) (issue string, found bool, err error)
+
+	// open opens an issue and returns its ID
+	open(ctx context.Context, title, body string) (issue string, err error)
+
+	// close comments and closes issue
+	close(ctx context.Context, issue, comment string) error
+}
+
+// client sends authenticated requests to a Git provider
+type client struct {
+	http *http.Client
+	// header, set to value, authenticates requests
+	header string
+	value  string
+}
+
+func newClient(header, value string) *client {
+	return &client{http: &http.Client{Timeout: requestTimeout}, header: header, value: value}
+}
+
+// do sends a request with body, if any, encoded as JSON and decodes response, if result is not nil
+func (c *client) do(ctx context.Context, method, requestURL string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(c.header, c.value)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: unexpected status %s", method, req.URL.Path, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// gitHub opens issues in a GitHub repository
+type gitHub struct {
+	client *client
+	// url is the repository API URL
+	url   string
+	label string
+}
+
+type gitHubIssue struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+}
+
+func (g *gitHub) find(ctx context.Context, title string) (issue string, found bool, err error) {
+	for page := 1; page <= maxPages; page++ {
+		query := url.Values{}
+		query.Set("state", "open")
+		query.Set("labels", g.label)
+		query.Set("per_page", strconv.Itoa(pageSize))
+		query.Set("page", strconv.Itoa(page))
+
+		var issues []gitHubIssue
+		if err := g.client.do(ctx, http.MethodGet, g.url+"/issues?"+query.Encode(), nil, &issues); err != nil {
+			return "", false, err
+		}
+		for i := range issues {
+			if issues[i].Title == title {
+				return strconv.Itoa(issues[i].Number), true, nil
+			}
+		}
+		if len(issues) < pageSize {
+			break
+		}
+	}
+	return "", false, nil
+}
+
+func (g *gitHub) open(ctx context.Context, title, body string) (string, error) {
+	request := map[string]interface{}{"title": title, "body": body, "labels": []string{g.label}}
+	var created gitHubIssue
+	if err := g.client.do(ctx, http.MethodPost, g.url+"/issues", request, &created); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(created.Number), nil
+}
+
+func (g *gitHub) close(ctx context.Context, issue, comment string) error {
+	issueURL := fmt.Sprintf("%s/issues/%s", g.url, issue)
+	if err := g.client.do(ctx, http.MethodPost, issueURL+"/comments",
+		map[string]string{"body": comment}, nil); err != nil {
+
+		return err
+	}
+	return g.client.do(ctx, http.MethodPatch, issueURL, map[string]string{"state": "closed"}, nil)
+}
+
+// gitLab opens issues in a GitLab project
+type gitLab struct {
+	client *client
+	// url is the project API URL
+	url   string
+	label string
+}
+
+type gitLabIssue struct {
+	IID   int    `json:"iid"`
+	Title string `json:"title"`
+}
+
+func (g *gitLab) find(ctx context.Context, title string) (issue string, found bool, err error) {
+	for page := 1; page <= maxPages; page++ {
+		query := url.Values{}
+		query.Set("state", "opened")
+		query.Set("labels", g.label)
+		query.Set("search", title)
+		query.Set("in", "title")
+		query.Set("per_page", strconv.Itoa(pageSize))
+		query.Set("page", strconv.Itoa(page))
+
+		var issues []gitLabIssue
+		if err := g.client.do(ctx, http.MethodGet, g.url+"/issues?"+query.Encode(), nil, &issues); err != nil {
+			return "", false, err
+		}
+		for i := range issues {
+			if issues[i].Title == title {
+				return strconv.Itoa(issues[i].IID), true, nil
+			}
+		}
+		if len(issues) < pageSize {
+			break
+		}
+	}
+	return "", false, nil
+}
+
+func (g *gitLab) open(ctx context.Context, title, body string) (string, error) {
+	request := map[string]string{"title": title, "description": body, "labels": g.label}
+	var created gitLabIssue
+	if err := g.client.do(ctx, http.MethodPost, g.url+"/issues", request, &created); err != nil {
+		return "", err
+	}
+	return strconv.Itoa(created.IID), nil
+}
+
+func (g *gitLab) close(ctx context.Context, issue, comment string) error {
+	issueURL := fmt.Sprintf("%s/issues/%s", g.url, issue)
+	if err := g.client.do(ctx, http.MethodPost, issueURL+"/notes",
+		map[string]string{"body": comment}, nil); err != nil {
+
+		return err
+	}
+	return g.client.do(ctx, http.MethodPut, issueURL, map[string]string{"state_event": "close"}, nil)
+}
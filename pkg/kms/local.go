@@ -0,0 +1,99 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kms contains key encryption services (see driftdetection.KeyEncryptionService) persisted
+// state can be encrypted with. Any external KMS can be used by implementing that interface.
+package kms
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// localKeySize is the size, in bytes, of the key encryption key
+const localKeySize = 32
+
+// Local wraps data keys with a key encryption key read from a file, for instance mounted from a
+// Secret managed by an external secret store. Data keys are wrapped with AES-256-GCM.
+type Local struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+// NewLocal returns a Local using the base64 encoded 32 bytes key encryption key contained in path
+// (e.g. generated with: head -c 32 /dev/urandom | base64)
+func NewLocal(path string) (*Local, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key encryption key")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, errors.Wrap(err, "key encryption key is not base64 encoded")
+	}
+	if len(key) != localKeySize {
+		return nil, fmt.Errorf("key encryption key must be %d bytes, got %d", localKeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Key ID reveals nothing about key, but lets a snapshot wrapped with a different key be told apart
+	digest := sha256.Sum256(key)
+	return &Local{keyID: "local:" + hex.EncodeToString(digest[:8]), aead: aead}, nil
+}
+
+// KeyID identifies the key encryption key
+func (l *Local) KeyID() string {
+	return l.keyID
+}
+
+// Wrap encrypts dataKey with the key encryption key. Nonce is prepended to the result.
+func (l *Local) Wrap(_ context.Context, dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, l.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return l.aead.Seal(nonce, nonce, dataKey, []byte(l.keyID)), nil
+}
+
+// Unwrap decrypts a data key wrapped by Wrap
+func (l *Local) Unwrap(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != l.keyID {
+		return nil, fmt.Errorf("data key was wrapped with key %s, current key is %s", keyID, l.keyID)
+	}
+	if len(wrapped) < l.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped data key")
+	}
+	nonceSize := l.aead.NonceSize()
+	return l.aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], []byte(keyID))
+}
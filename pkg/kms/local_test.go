@@ -0,0 +1,71 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kms_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/kms"
+)
+
+var _ = Describe("Local", func() {
+	writeKey := func(size int) string {
+		key := make([]byte, size)
+		_, err := rand.Read(key)
+		Expect(err).To(BeNil())
+		path := filepath.Join(GinkgoT().TempDir(), "kek")
+		Expect(os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)).To(Succeed())
+		return path
+	}
+
+	It("NewLocal rejects invalid keys", func() {
+		_, err := kms.NewLocal(writeKey(16))
+		Expect(err).ToNot(BeNil())
+
+		path := filepath.Join(GinkgoT().TempDir(), "kek")
+		Expect(os.WriteFile(path, []byte("not base64!"), 0600)).To(Succeed())
+		_, err = kms.NewLocal(path)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("Unwrap returns the data key Wrap was called with", func() {
+		local, err := kms.NewLocal(writeKey(32))
+		Expect(err).To(BeNil())
+
+		dataKey := []byte("0123456789abcdef0123456789abcdef")
+		wrapped, err := local.Wrap(context.TODO(), dataKey)
+		Expect(err).To(BeNil())
+		Expect(wrapped).ToNot(ContainSubstring(string(dataKey)))
+
+		unwrapped, err := local.Unwrap(context.TODO(), local.KeyID(), wrapped)
+		Expect(err).To(BeNil())
+		Expect(unwrapped).To(Equal(dataKey))
+
+		// Data key wrapped with another key encryption key cannot be unwrapped
+		other, err := kms.NewLocal(writeKey(32))
+		Expect(err).To(BeNil())
+		_, err = other.Unwrap(context.TODO(), local.KeyID(), wrapped)
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,78 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubeconfig
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+// DetectClusterType returns the type of the managed cluster namespace/name, found by looking for
+// a SveltosCluster and a ClusterAPI Cluster with that name in the management cluster c points to.
+// Types whose CRD is not installed are skipped. configured (possibly empty) is the type passed by
+// the user. It is only needed when both cluster objects exist, or when none does yet.
+// An error is returned if configured contradicts the only cluster object found, as the managed
+// cluster kubeconfig would then be searched in the wrong Secret.
+func DetectClusterType(ctx context.Context, c client.Reader, namespace, name string,
+	configured libsveltosv1alpha1.ClusterType) (libsveltosv1alpha1.ClusterType, error) {
+
+	found := make([]libsveltosv1alpha1.ClusterType, 0)
+
+	candidates := map[libsveltosv1alpha1.ClusterType]client.Object{
+		libsveltosv1alpha1.ClusterTypeSveltos: &libsveltosv1alpha1.SveltosCluster{},
+		libsveltosv1alpha1.ClusterTypeCapi:    &clusterv1.Cluster{},
+	}
+	for _, clusterType := range []libsveltosv1alpha1.ClusterType{libsveltosv1alpha1.ClusterTypeSveltos,
+		libsveltosv1alpha1.ClusterTypeCapi} {
+
+		err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, candidates[clusterType])
+		switch {
+		case err == nil:
+			found = append(found, clusterType)
+		case apierrors.IsNotFound(err) || meta.IsNoMatchError(err):
+		default:
+			return "", errors.Wrapf(err, "failed to get %s cluster %s/%s", clusterType, namespace, name)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		if configured == "" {
+			return "", fmt.Errorf("neither SveltosCluster nor Cluster %s/%s exists: cluster type cannot be detected",
+				namespace, name)
+		}
+		return configured, nil
+	case 1:
+		if configured != "" && configured != found[0] {
+			return "", fmt.Errorf("cluster type is %s, but %s/%s is a %s cluster", configured, namespace, name, found[0])
+		}
+		return found[0], nil
+	default:
+		if configured == "" {
+			return "", fmt.Errorf("both SveltosCluster and Cluster %s/%s exist: cluster type must be set", namespace, name)
+		}
+		return configured, nil
+	}
+}
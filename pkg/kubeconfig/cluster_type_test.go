@@ -0,0 +1,102 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubeconfig_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/kubeconfig"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+var _ = Describe("DetectClusterType", func() {
+	It("detects cluster type from existing cluster objects", func() {
+		s := runtime.NewScheme()
+		Expect(libsveltosv1alpha1.AddToScheme(s)).To(Succeed())
+		Expect(clusterv1.AddToScheme(s)).To(Succeed())
+
+		objects := []runtime.Object{
+			&libsveltosv1alpha1.SveltosCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "sveltos"}},
+			&clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "capi"}},
+			&libsveltosv1alpha1.SveltosCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "both"}},
+			&clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "both"}},
+		}
+		c := fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(objects...).Build()
+
+		clusterType, err := kubeconfig.DetectClusterType(context.TODO(), c, "a", "sveltos", "")
+		Expect(err).To(BeNil())
+		Expect(clusterType).To(Equal(libsveltosv1alpha1.ClusterTypeSveltos))
+
+		clusterType, err = kubeconfig.DetectClusterType(context.TODO(), c, "a", "capi", "")
+		Expect(err).To(BeNil())
+		Expect(clusterType).To(Equal(libsveltosv1alpha1.ClusterTypeCapi))
+
+		// Configured type contradicting the existing cluster object
+		_, err = kubeconfig.DetectClusterType(context.TODO(), c, "a", "capi", libsveltosv1alpha1.ClusterTypeSveltos)
+		Expect(err).ToNot(BeNil())
+
+		// Ambiguous: configured type is needed
+		_, err = kubeconfig.DetectClusterType(context.TODO(), c, "a", "both", "")
+		Expect(err).ToNot(BeNil())
+		clusterType, err = kubeconfig.DetectClusterType(context.TODO(), c, "a", "both", libsveltosv1alpha1.ClusterTypeCapi)
+		Expect(err).To(BeNil())
+		Expect(clusterType).To(Equal(libsveltosv1alpha1.ClusterTypeCapi))
+
+		// No cluster object yet: configured type is used
+		_, err = kubeconfig.DetectClusterType(context.TODO(), c, "a", "missing", "")
+		Expect(err).ToNot(BeNil())
+		clusterType, err = kubeconfig.DetectClusterType(context.TODO(), c, "a", "missing", libsveltosv1alpha1.ClusterTypeSveltos)
+		Expect(err).To(BeNil())
+		Expect(clusterType).To(Equal(libsveltosv1alpha1.ClusterTypeSveltos))
+	})
+
+	It("skips cluster types whose CRD is not installed", func() {
+		s := runtime.NewScheme()
+		Expect(libsveltosv1alpha1.AddToScheme(s)).To(Succeed())
+		Expect(clusterv1.AddToScheme(s)).To(Succeed())
+
+		objects := []runtime.Object{
+			&libsveltosv1alpha1.SveltosCluster{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "sveltos"}},
+		}
+		c := fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(objects...).
+			WithInterceptorFuncs(interceptor.Funcs{
+				Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object,
+					opts ...client.GetOption) error {
+
+					if _, ok := obj.(*clusterv1.Cluster); ok {
+						return &meta.NoKindMatchError{GroupKind: clusterv1.GroupVersion.WithKind("Cluster").GroupKind()}
+					}
+					return c.Get(ctx, key, obj, opts...)
+				},
+			}).Build()
+
+		clusterType, err := kubeconfig.DetectClusterType(context.TODO(), c, "a", "sveltos", "")
+		Expect(err).To(BeNil())
+		Expect(clusterType).To(Equal(libsveltosv1alpha1.ClusterTypeSveltos))
+	})
+})
@@ -0,0 +1,61 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubeconfig
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ContextConfigs returns the rest configs of all contexts of kubeconfig data, current context
+// first and the others sorted by name. Meant for kubeconfigs whose contexts are different API
+// server endpoints (e.g. control plane nodes or load balancers) of the same cluster, to be used
+// for failover (see Rotator).
+func ContextConfigs(data []byte) ([]*rest.Config, error) {
+	kubeconfig, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid kubeconfig")
+	}
+
+	names := make([]string, 0, len(kubeconfig.Contexts))
+	for name := range kubeconfig.Contexts {
+		if name != kubeconfig.CurrentContext {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := kubeconfig.Contexts[kubeconfig.CurrentContext]; ok {
+		names = append([]string{kubeconfig.CurrentContext}, names...)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("kubeconfig has no context")
+	}
+
+	configs := make([]*rest.Config, len(names))
+	for i := range names {
+		configs[i], err = clientcmd.NewNonInteractiveClientConfig(*kubeconfig, names[i],
+			&clientcmd.ConfigOverrides{}, nil).ClientConfig()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid kubeconfig context %s", names[i])
+		}
+	}
+	return configs, nil
+}
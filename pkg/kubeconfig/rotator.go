@@ -0,0 +1,396 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kubeconfig lets drift-detection-manager, when running in the management cluster,
+// follow rotation of the managed cluster kubeconfig, and fail over between API server endpoints
+// of the managed cluster, without restarting (which would drop all tracking state).
+package kubeconfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// refreshInterval is how often kubeconfig is fetched again to detect rotation
+	refreshInterval = 30 * time.Second
+
+	// credentialGenerationEnv is set, on exec credential plugins, to the number of times
+	// credentials were proactively refreshed. client-go keeps one authenticator (and its cached
+	// credentials) per plugin configuration: changing it forces the plugin to run again.
+	credentialGenerationEnv = "DRIFT_DETECTION_CREDENTIAL_GENERATION"
+
+	// defaultFailoverAfter is how long requests to an API server endpoint must keep failing
+	// with connection errors before next endpoint is used
+	defaultFailoverAfter = 15 * time.Second
+)
+
+// FetchFunc returns the current rest configs of the managed cluster: one per API server
+// endpoint, the preferred one first
+type FetchFunc func(ctx context.Context) ([]*rest.Config, error)
+
+// endpoint is an API server endpoint of the managed cluster
+type endpoint struct {
+	transport http.RoundTripper
+	host      *url.URL
+}
+
+// Rotator is an http.RoundTripper sending requests to the managed cluster with the credentials
+// of the most recent kubeconfig. When kubeconfig changes, a new transport is built and used for
+// all new requests. Established watches keep using old credentials till they are closed: once
+// old credentials are revoked, watches fail and are re-established with new ones.
+// Kubeconfigs using exec credential plugins (EKS/GKE/AKS style) or the OIDC auth provider are
+// supported. client-go only runs exec plugins again once credentials are expired (or rejected),
+// so requests sent meanwhile fail. See SetCredentialRefresh to refresh them ahead of expiry.
+// When managed cluster has more than one API server endpoint, and requests keep failing with
+// connection errors, next endpoint is used. Watches broken by the failure are re-established
+// against the new endpoint.
+type Rotator struct {
+	fetch  FetchFunc
+	logger logr.Logger
+
+	// credentialRefresh, when set, is how often exec plugin credentials are refreshed
+	credentialRefresh time.Duration
+
+	// failoverAfter is how long requests must keep failing before next endpoint is used
+	failoverAfter time.Duration
+
+	mu        sync.RWMutex
+	endpoints []endpoint
+	// active is the index, in endpoints, of the endpoint requests are sent to
+	active int
+	// failingSince is when requests to active endpoint started failing with connection
+	// errors. Zero if last request reached API server.
+	failingSince time.Time
+	fingerprint  string
+	// bases are the API server URLs handed out by Config. Requests are built by prefixing
+	// their path with one of them.
+	bases []*url.URL
+	// generation is the number of times exec plugin credentials were proactively refreshed
+	generation int
+	// credentialsIssued is when current transport was built
+	credentialsIssued time.Time
+}
+
+// NewRotator fetches kubeconfig and returns a Rotator using it
+func NewRotator(ctx context.Context, fetch FetchFunc, logger logr.Logger) (*Rotator, error) {
+	r := &Rotator{fetch: fetch, logger: logger, failoverAfter: defaultFailoverAfter}
+	if _, err := r.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetCredentialRefresh sets how often, when kubeconfig uses an exec credential plugin, the plugin
+// is run again to get new credentials. It must be shorter than credentials lifetime (e.g. 15
+// minutes on EKS) so that credentials never expire while in use. Zero disables it.
+// Must be called before Start.
+func (r *Rotator) SetCredentialRefresh(interval time.Duration) {
+	r.credentialRefresh = interval
+}
+
+// Config returns a rest config whose requests go through r. Clients built from it follow
+// kubeconfig rotation.
+func (r *Rotator) Config() *rest.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	host := r.endpoints[r.active].host
+	known := false
+	for i := range r.bases {
+		known = known || *r.bases[i] == *host
+	}
+	if !known {
+		r.bases = append(r.bases, host)
+	}
+
+	return &rest.Config{
+		Host:      host.String(),
+		Transport: r,
+	}
+}
+
+// RoundTrip sends req to the active endpoint of the managed cluster, with the credentials of
+// most recent kubeconfig
+func (r *Rotator) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.RLock()
+	active := r.active
+	endpoint := r.endpoints[active]
+	base := findBase(req.URL, r.bases)
+	r.mu.RUnlock()
+
+	// API server address can change with kubeconfig or on failover
+	if u := rebase(req.URL, base, endpoint.host); u != req.URL {
+		req = req.Clone(req.Context())
+		req.URL = u
+		req.Host = ""
+	}
+
+	resp, err := endpoint.transport.RoundTrip(req)
+	if req.Context().Err() == nil {
+		r.observe(active, err)
+	}
+	return resp, err
+}
+
+// findBase returns the base URL, among bases, u was built from. Nil if none.
+func findBase(u *url.URL, bases []*url.URL) *url.URL {
+	var found *url.URL
+	for _, base := range bases {
+		if base.Scheme != u.Scheme || base.Host != u.Host {
+			continue
+		}
+		prefix := strings.TrimSuffix(base.Path, "/")
+		if u.Path != prefix && !strings.HasPrefix(u.Path, prefix+"/") {
+			continue
+		}
+		// The most specific base wins
+		if found == nil || len(prefix) > len(strings.TrimSuffix(found.Path, "/")) {
+			found = base
+		}
+	}
+	return found
+}
+
+// rebase returns u, built from base, sent to target instead: scheme and host are the ones of
+// target and base path prefix is replaced with the one of target. u is returned unchanged if
+// it already points to target. When base is unknown only scheme and host are changed.
+func rebase(u, base, target *url.URL) *url.URL {
+	basePath, targetPath := "", ""
+	baseRawPath, targetRawPath := "", ""
+	if base != nil {
+		basePath = strings.TrimSuffix(base.Path, "/")
+		targetPath = strings.TrimSuffix(target.Path, "/")
+		baseRawPath = strings.TrimSuffix(base.EscapedPath(), "/")
+		targetRawPath = strings.TrimSuffix(target.EscapedPath(), "/")
+	}
+	if u.Scheme == target.Scheme && u.Host == target.Host && basePath == targetPath {
+		return u
+	}
+
+	rebased := *u
+	rebased.Scheme = target.Scheme
+	rebased.Host = target.Host
+	rebased.Path = targetPath + strings.TrimPrefix(u.Path, basePath)
+	if u.RawPath != "" {
+		rebased.RawPath = targetRawPath + strings.TrimPrefix(u.RawPath, baseRawPath)
+	}
+	return &rebased
+}
+
+// observe tracks whether endpoint at index is reachable and, if requests to it keep failing
+// with connection errors for failoverAfter, fails over to next endpoint
+func (r *Rotator) observe(index int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if index != r.active {
+		// Failed over (or kubeconfig rotated) meanwhile
+		return
+	}
+	if err == nil || !isConnectionError(err) {
+		r.failingSince = time.Time{}
+		return
+	}
+	if r.failingSince.IsZero() {
+		r.failingSince = time.Now()
+		return
+	}
+	if len(r.endpoints) < 2 || time.Since(r.failingSince) < r.failoverAfter {
+		return
+	}
+
+	previous := r.endpoints[r.active]
+	r.active = (r.active + 1) % len(r.endpoints)
+	r.failingSince = time.Time{}
+	r.logger.V(logs.LogInfo).Info(fmt.Sprintf("managed cluster API server %s is unreachable: %v. Failing over to %s",
+		previous.host.Host, err, r.endpoints[r.active].host.Host))
+
+	closeIdleConnections(previous.transport)
+}
+
+// isConnectionError returns true if err means API server could not be reached
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || utilnet.IsConnectionRefused(err) || utilnet.IsConnectionReset(err) ||
+		utilnet.IsProbableEOF(err)
+}
+
+// Start fetches kubeconfig every refreshInterval, till ctx is canceled, switching to new
+// credentials whenever kubeconfig changes
+func (r *Rotator) Start(ctx context.Context) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rotated, err := r.refresh(ctx)
+			if err != nil {
+				r.logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to refresh managed cluster kubeconfig. "+
+					"Keep using current one: %v", err))
+			} else if rotated {
+				r.logger.V(logs.LogInfo).Info("managed cluster kubeconfig rotated. Using new credentials")
+			}
+		}
+	}
+}
+
+// refresh fetches kubeconfig and, if changed, switches to it. Returns true if kubeconfig changed.
+// When kubeconfig is unchanged but exec plugin credentials are due for refresh (see
+// SetCredentialRefresh), new transports are built as well, so that plugin runs again.
+func (r *Rotator) refresh(ctx context.Context) (bool, error) {
+	configs, err := r.fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+	if len(configs) == 0 {
+		return false, errors.New("no managed cluster API server endpoint")
+	}
+
+	current := fingerprint(configs...)
+	usesExecProvider := false
+	for i := range configs {
+		usesExecProvider = usesExecProvider || configs[i].ExecProvider != nil
+	}
+	r.mu.RLock()
+	unchanged := current == r.fingerprint
+	generation := r.generation
+	credentialsExpiring := r.credentialRefresh > 0 && usesExecProvider &&
+		time.Since(r.credentialsIssued) >= r.credentialRefresh
+	r.mu.RUnlock()
+	if unchanged && !credentialsExpiring {
+		return false, nil
+	}
+
+	if unchanged {
+		generation++
+	}
+	endpoints := make([]endpoint, len(configs))
+	for i := range configs {
+		if endpoints[i], err = newEndpoint(configs[i], generation); err != nil {
+			return false, err
+		}
+	}
+
+	r.mu.Lock()
+	previous := r.endpoints
+	r.endpoints = endpoints
+	if !unchanged || r.active >= len(endpoints) {
+		// Endpoints may have changed: start again from the preferred one
+		r.active = 0
+		r.failingSince = time.Time{}
+	}
+	r.fingerprint = current
+	r.generation = generation
+	r.credentialsIssued = time.Now()
+	r.mu.Unlock()
+
+	if unchanged {
+		r.logger.V(logs.LogDebug).Info("refreshed managed cluster exec plugin credentials")
+	}
+
+	// Connections not in use are not reused with old credentials
+	for i := range previous {
+		closeIdleConnections(previous[i].transport)
+	}
+
+	return previous != nil && !unchanged, nil
+}
+
+// newEndpoint returns the endpoint config points to. generation, when not zero, is passed to
+// exec credential plugin so that it runs again (see credentialGenerationEnv).
+func newEndpoint(config *rest.Config, generation int) (endpoint, error) {
+	transportConfig := config
+	if config.ExecProvider != nil && generation != 0 {
+		// CopyConfig does not copy ExecProvider, which must be left untouched
+		transportConfig = rest.CopyConfig(config)
+		execProvider := *config.ExecProvider
+		execProvider.Env = append(append([]clientcmdapi.ExecEnvVar{}, config.ExecProvider.Env...),
+			clientcmdapi.ExecEnvVar{Name: credentialGenerationEnv, Value: strconv.Itoa(generation)})
+		transportConfig.ExecProvider = &execProvider
+	}
+
+	host, _, err := rest.DefaultServerUrlFor(config)
+	if err != nil {
+		return endpoint{}, errors.Wrap(err, "invalid managed cluster address")
+	}
+	transport, err := rest.TransportFor(transportConfig)
+	if err != nil {
+		return endpoint{}, errors.Wrap(err, "failed to create transport for managed cluster")
+	}
+	return endpoint{transport: transport, host: host}, nil
+}
+
+func closeIdleConnections(transport http.RoundTripper) {
+	if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// fingerprint returns a digest of the fields of configs identifying the API servers and credentials
+func fingerprint(configs ...*rest.Config) string {
+	h := sha256.New()
+	write := func(values ...string) {
+		for _, v := range values {
+			// length prefix avoids ambiguities between consecutive values
+			fmt.Fprintf(h, "%d:%s", len(v), v)
+		}
+	}
+
+	for _, config := range configs {
+		writeConfig(write, config)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func writeConfig(write func(values ...string), config *rest.Config) {
+	write(config.Host, config.APIPath, config.BearerToken, config.BearerTokenFile,
+		config.Username, config.Password, config.TLSClientConfig.ServerName,
+		config.TLSClientConfig.CAFile, config.TLSClientConfig.CertFile, config.TLSClientConfig.KeyFile,
+		string(config.TLSClientConfig.CAData), string(config.TLSClientConfig.CertData),
+		string(config.TLSClientConfig.KeyData), fmt.Sprint(config.TLSClientConfig.Insecure))
+	if config.ExecProvider != nil {
+		write(config.ExecProvider.APIVersion, config.ExecProvider.Command)
+		write(config.ExecProvider.Args...)
+		for _, env := range config.ExecProvider.Env {
+			write(env.Name, env.Value)
+		}
+	}
+	if config.AuthProvider != nil {
+		// maps are printed sorted by key
+		write(config.AuthProvider.Name, fmt.Sprint(config.AuthProvider.Config))
+	}
+}
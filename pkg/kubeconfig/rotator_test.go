@@ -0,0 +1,251 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubeconfig_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-logr/logr"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/kubeconfig"
+)
+
+var _ = Describe("Rotator", func() {
+	It("sends requests with the most recent kubeconfig", func() {
+		tokens := make(chan string, 2)
+		newServer := func() *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tokens <- r.Header.Get("Authorization")
+				w.WriteHeader(http.StatusOK)
+			}))
+		}
+		first := newServer()
+		defer first.Close()
+		second := newServer()
+		defer second.Close()
+
+		current := &rest.Config{Host: first.URL, BearerToken: "first"}
+		fetch := func(context.Context) ([]*rest.Config, error) {
+			return []*rest.Config{current}, nil
+		}
+
+		rotator, err := kubeconfig.NewRotator(context.TODO(), fetch, logr.Discard())
+		Expect(err).To(BeNil())
+
+		c, err := rest.HTTPClientFor(rotator.Config())
+		Expect(err).To(BeNil())
+
+		url := rotator.Config().Host + "/version"
+		resp, err := c.Get(url)
+		Expect(err).To(BeNil())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(<-tokens).To(Equal("Bearer first"))
+
+		rotated, err := kubeconfig.Refresh(rotator, context.TODO())
+		Expect(err).To(BeNil())
+		Expect(rotated).To(BeFalse())
+
+		current = &rest.Config{Host: second.URL, BearerToken: "second"}
+		rotated, err = kubeconfig.Refresh(rotator, context.TODO())
+		Expect(err).To(BeNil())
+		Expect(rotated).To(BeTrue())
+
+		// Same URL: request is redirected to the new API server
+		resp, err = c.Get(url)
+		Expect(err).To(BeNil())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(<-tokens).To(Equal("Bearer second"))
+	})
+
+	It("proactively refreshes exec plugin credentials", func() {
+		tokens := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokens <- r.Header.Get("Authorization")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		// Plugin returns a token containing the generation of credentials
+		plugin := filepath.Join(GinkgoT().TempDir(), "plugin.sh")
+		Expect(os.WriteFile(plugin, []byte(`#!/bin/sh
+echo '{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential",'\
+'"status":{"token":"generation-'"${DRIFT_DETECTION_CREDENTIAL_GENERATION:-0}"'"}}'
+`), 0700)).To(Succeed())
+
+		fetch := func(context.Context) ([]*rest.Config, error) {
+			return []*rest.Config{{
+				Host: server.URL,
+				ExecProvider: &clientcmdapi.ExecConfig{
+					APIVersion:      "client.authentication.k8s.io/v1",
+					Command:         plugin,
+					InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+				},
+			}}, nil
+		}
+
+		rotator, err := kubeconfig.NewRotator(context.TODO(), fetch, logr.Discard())
+		Expect(err).To(BeNil())
+
+		c, err := rest.HTTPClientFor(rotator.Config())
+		Expect(err).To(BeNil())
+
+		url := rotator.Config().Host + "/version"
+		resp, err := c.Get(url)
+		Expect(err).To(BeNil())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(<-tokens).To(Equal("Bearer generation-0"))
+
+		// Credentials are not refreshed unless configured
+		rotated, err := kubeconfig.Refresh(rotator, context.TODO())
+		Expect(err).To(BeNil())
+		Expect(rotated).To(BeFalse())
+		resp, err = c.Get(url)
+		Expect(err).To(BeNil())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(<-tokens).To(Equal("Bearer generation-0"))
+
+		rotator.SetCredentialRefresh(time.Nanosecond)
+		rotated, err = kubeconfig.Refresh(rotator, context.TODO())
+		Expect(err).To(BeNil())
+		// kubeconfig did not change
+		Expect(rotated).To(BeFalse())
+
+		resp, err = c.Get(url)
+		Expect(err).To(BeNil())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(<-tokens).To(Equal("Bearer generation-1"))
+	})
+
+	It("fails over to next endpoint on sustained connection errors", func() {
+		tokens := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokens <- r.Header.Get("Authorization")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+		// Nothing listens on this endpoint anymore
+		unreachable := httptest.NewServer(http.NotFoundHandler())
+		unreachable.Close()
+
+		fetch := func(context.Context) ([]*rest.Config, error) {
+			return []*rest.Config{
+				{Host: unreachable.URL, BearerToken: "unreachable"},
+				{Host: server.URL, BearerToken: "reachable"},
+			}, nil
+		}
+
+		rotator, err := kubeconfig.NewRotator(context.TODO(), fetch, logr.Discard())
+		Expect(err).To(BeNil())
+		rotator.SetFailoverAfter(0)
+
+		c, err := rest.HTTPClientFor(rotator.Config())
+		Expect(err).To(BeNil())
+		url := rotator.Config().Host + "/version"
+
+		// A single failure is not enough to fail over
+		_, err = c.Get(url)
+		Expect(err).ToNot(BeNil())
+		Expect(rotator.Config().Host).To(Equal(unreachable.URL))
+
+		_, err = c.Get(url)
+		Expect(err).ToNot(BeNil())
+		Expect(rotator.Config().Host).To(Equal(server.URL))
+
+		// Same URL: request is sent to the new endpoint
+		resp, err := c.Get(url)
+		Expect(err).To(BeNil())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(<-tokens).To(Equal("Bearer reachable"))
+	})
+
+	It("keeps path prefix of endpoints on failover", func() {
+		paths := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths <- r.URL.Path
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+		// Nothing listens on this endpoint anymore
+		unreachable := httptest.NewServer(http.NotFoundHandler())
+		unreachable.Close()
+
+		// API servers behind a proxy (e.g. Rancher) are reached with a path prefix
+		fetch := func(context.Context) ([]*rest.Config, error) {
+			return []*rest.Config{
+				{Host: unreachable.URL + "/k8s/clusters/a", BearerToken: "unreachable"},
+				{Host: server.URL + "/k8s/clusters/b/", BearerToken: "reachable"},
+			}, nil
+		}
+
+		rotator, err := kubeconfig.NewRotator(context.TODO(), fetch, logr.Discard())
+		Expect(err).To(BeNil())
+		rotator.SetFailoverAfter(0)
+
+		c, err := rest.HTTPClientFor(rotator.Config())
+		Expect(err).To(BeNil())
+		url := rotator.Config().Host + "/api/v1/namespaces"
+
+		_, err = c.Get(url)
+		Expect(err).ToNot(BeNil())
+		_, err = c.Get(url)
+		Expect(err).ToNot(BeNil())
+		Expect(rotator.Config().Host).To(Equal(server.URL + "/k8s/clusters/b/"))
+
+		// Path prefix of the failed endpoint is replaced with the one of the new endpoint
+		resp, err := c.Get(url)
+		Expect(err).To(BeNil())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(<-paths).To(Equal("/k8s/clusters/b/api/v1/namespaces"))
+
+		// Requests built from the new endpoint are sent unchanged
+		resp, err = c.Get(rotator.Config().Host + "api/v1/pods")
+		Expect(err).To(BeNil())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(<-paths).To(Equal("/k8s/clusters/b/api/v1/pods"))
+	})
+
+	It("ContextConfigs returns a config per context, current one first", func() {
+		config := clientcmdapi.NewConfig()
+		for _, name := range []string{"b", "a", "c"} {
+			config.Clusters[name] = &clientcmdapi.Cluster{Server: "https://" + name + ".example.com:6443"}
+			config.AuthInfos[name] = &clientcmdapi.AuthInfo{Token: name}
+			config.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: name}
+		}
+		config.CurrentContext = "c"
+		data, err := clientcmd.Write(*config)
+		Expect(err).To(BeNil())
+
+		configs, err := kubeconfig.ContextConfigs(data)
+		Expect(err).To(BeNil())
+		Expect(configs).To(HaveLen(3))
+		Expect(configs[0].Host).To(Equal("https://c.example.com:6443"))
+		Expect(configs[0].BearerToken).To(Equal("c"))
+		Expect(configs[1].Host).To(Equal("https://a.example.com:6443"))
+		Expect(configs[2].Host).To(Equal("https://b.example.com:6443"))
+	})
+})
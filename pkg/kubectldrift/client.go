@@ -0,0 +1,148 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubectldrift
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+)
+
+const (
+	requestTimeout = 30 * time.Second
+
+	// coreGroup identifies the core group in evaluate requests (see driftdetection.EvaluatePath)
+	coreGroup = "core"
+)
+
+// client talks to the API served on drift-detection-manager diagnostics endpoint
+type client struct {
+	address string
+	token   string
+	http    *http.Client
+}
+
+func newClient(address, token string, tlsConfig *tls.Config) *client {
+	return &client{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		http: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+}
+
+// listTracked returns all tracked resources, fetching them page by page
+func (c *client) listTracked(ctx context.Context) ([]driftdetection.TrackedResource, error) {
+	var result []driftdetection.TrackedResource
+	continueToken := ""
+	for {
+		query := url.Values{}
+		if continueToken != "" {
+			query.Set("continue", continueToken)
+		}
+
+		list := &driftdetection.TrackedResourceList{}
+		if err := c.do(ctx, http.MethodGet, driftdetection.TrackedPath, query, list); err != nil {
+			return nil, err
+		}
+		result = append(result, list.Items...)
+
+		if list.Continue == "" {
+			return result, nil
+		}
+		continueToken = list.Continue
+	}
+}
+
+// listDriftEvents returns the recent drift events with a sequence greater than after
+func (c *client) listDriftEvents(ctx context.Context, after uint64) ([]driftdetection.DriftEvent, error) {
+	query := url.Values{}
+	query.Set("after", strconv.FormatUint(after, 10))
+
+	list := &driftdetection.DriftEventList{}
+	if err := c.do(ctx, http.MethodGet, driftdetection.DriftEventsPath, query, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// evaluate asks drift-detection-manager to evaluate resourceRef right away
+func (c *client) evaluate(ctx context.Context, resourceRef *corev1.ObjectReference,
+) (*driftdetection.EvaluationResult, error) {
+
+	gvk := resourceRef.GroupVersionKind()
+	group := gvk.Group
+	if group == "" {
+		group = coreGroup
+	}
+
+	requestPath := path.Join(driftdetection.EvaluatePath, group, gvk.Version, gvk.Kind, resourceRef.Namespace,
+		resourceRef.Name)
+
+	result := &driftdetection.EvaluationResult{}
+	if err := c.do(ctx, http.MethodPost, requestPath, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// do sends a request and decodes the JSON response into v
+func (c *client) do(ctx context.Context, method, requestPath string, query url.Values, v interface{}) error {
+	u := c.address + requestPath
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, http.NoBody)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to contact drift-detection-manager")
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "failed to decode response")
+	}
+	return nil
+}
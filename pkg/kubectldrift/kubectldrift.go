@@ -0,0 +1,331 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kubectldrift implements the kubectl-drift plugin, which talks to the versioned API
+// served on drift-detection-manager diagnostics endpoint to:
+//   - show drift status per namespace and kind (status);
+//   - print, and optionally follow, drift events (events);
+//   - evaluate a resource right away (evaluate).
+//
+// Diagnostics endpoint is usually reached via port-forward:
+//
+//	kubectl -n projectsveltos port-forward deployment/drift-detection-manager 8443
+//	kubectl drift status
+package kubectldrift
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/mtls"
+)
+
+const (
+	statusCommand   = "status"
+	eventsCommand   = "events"
+	evaluateCommand = "evaluate"
+
+	usage = `Usage:
+  kubectl drift status [--namespace NAMESPACE] [--kind KIND]
+  kubectl drift events [--follow]
+  kubectl drift evaluate APIVERSION KIND NAME [--namespace NAMESPACE]
+
+Flags:
+`
+)
+
+type options struct {
+	address               string
+	token                 string
+	tokenFile             string
+	insecureSkipTLSVerify bool
+	tls                   mtls.ClientOptions
+	namespace             string
+	kind                  string
+	follow                bool
+	pollInterval          time.Duration
+}
+
+// Run parses args and runs the requested command, writing its output to out
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	fs := pflag.NewFlagSet("kubectl-drift", pflag.ContinueOnError)
+
+	o := &options{}
+	fs.StringVar(&o.address, "address", "https://localhost:8443",
+		"Address of drift-detection-manager diagnostics endpoint (e.g. port-forwarded).")
+	fs.StringVar(&o.token, "token", "",
+		"Bearer token used to authenticate. When empty, the token of current kubeconfig context is used, if any.")
+	fs.StringVar(&o.tokenFile, "token-file", "", "File containing the bearer token used to authenticate.")
+	fs.BoolVar(&o.insecureSkipTLSVerify, "insecure-skip-tls-verify", true,
+		"Skip verification of the diagnostics endpoint certificate, which is self-signed by default.")
+	o.tls.AddFlags(fs)
+	fs.StringVarP(&o.namespace, "namespace", "n", "",
+		"status: only show resources in this namespace. evaluate: namespace of the resource.")
+	fs.StringVar(&o.kind, "kind", "", "status: only show resources of this kind (e.g. Deployment or Deployment.apps).")
+	fs.BoolVarP(&o.follow, "follow", "f", false, "events: keep printing new drift events.")
+	fs.DurationVar(&o.pollInterval, "poll-interval", 5*time.Second, "events: how often new drift events are fetched.")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing command")
+	}
+
+	token, err := getToken(o)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := o.tls.TLSConfig(o.insecureSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	c := newClient(o.address, token, tlsConfig)
+
+	switch fs.Arg(0) {
+	case statusCommand:
+		return status(ctx, c, o, out)
+	case eventsCommand:
+		return events(ctx, c, o, out)
+	case evaluateCommand:
+		if fs.NArg() != 4 {
+			return fmt.Errorf("usage: kubectl drift evaluate APIVERSION KIND NAME [--namespace NAMESPACE]")
+		}
+		resourceRef := &corev1.ObjectReference{APIVersion: fs.Arg(1), Kind: fs.Arg(2), Name: fs.Arg(3),
+			Namespace: o.namespace}
+		return evaluate(ctx, c, resourceRef, out)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+}
+
+// getToken returns the bearer token from, in order, --token, --token-file or current kubeconfig context
+func getToken(o *options) (string, error) {
+	if o.token != "" {
+		return o.token, nil
+	}
+
+	tokenFile := o.tokenFile
+	if tokenFile == "" {
+		config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).ClientConfig()
+		if err != nil {
+			// No kubeconfig. Request might still be accepted (for instance with --insecure-diagnostics)
+			return "", nil //nolint: nilerr // kubeconfig is optional
+		}
+		if config.BearerToken != "" {
+			return config.BearerToken, nil
+		}
+		tokenFile = config.BearerTokenFile
+	}
+
+	if tokenFile == "" {
+		return "", nil
+	}
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read token file")
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+type statusKey struct {
+	namespace string
+	groupKind string
+}
+
+type statusEntry struct {
+	tracked   int
+	missing   int
+	drifts    int
+	lastDrift time.Time
+}
+
+// status prints, per namespace and kind, the number of tracked resources, how many of those
+// do not exist and how many recent drift events were reported
+func status(ctx context.Context, c *client, o *options, out io.Writer) error {
+	entries := make(map[statusKey]*statusEntry)
+	getEntry := func(ref *corev1.ObjectReference) *statusEntry {
+		key := statusKey{namespace: ref.Namespace, groupKind: ref.GroupVersionKind().GroupKind().String()}
+		if entries[key] == nil {
+			entries[key] = &statusEntry{}
+		}
+		return entries[key]
+	}
+
+	resources, err := c.listTracked(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range resources {
+		if !o.matches(&resources[i].Resource) {
+			continue
+		}
+		entry := getEntry(&resources[i].Resource)
+		entry.tracked++
+		if resources[i].Hash == "" {
+			entry.missing++
+		}
+	}
+
+	driftEvents, err := c.listDriftEvents(ctx, 0)
+	if err != nil {
+		return err
+	}
+	for i := range driftEvents {
+		if !o.matches(&driftEvents[i].Resource) {
+			continue
+		}
+		entry := getEntry(&driftEvents[i].Resource)
+		entry.drifts++
+		entry.lastDrift = driftEvents[i].Time
+	}
+
+	keys := make([]statusKey, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].groupKind < keys[j].groupKind
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tKIND\tTRACKED\tMISSING\tRECENT DRIFTS\tLAST DRIFT")
+	for i := range keys {
+		entry := entries[keys[i]]
+		namespace := keys[i].namespace
+		if namespace == "" {
+			namespace = "<cluster>"
+		}
+		lastDrift := "-"
+		if !entry.lastDrift.IsZero() {
+			lastDrift = time.Since(entry.lastDrift).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", namespace, keys[i].groupKind, entry.tracked,
+			entry.missing, entry.drifts, lastDrift)
+	}
+	return w.Flush()
+}
+
+// matches returns true if resource matches --namespace and --kind
+func (o *options) matches(ref *corev1.ObjectReference) bool {
+	if o.namespace != "" && ref.Namespace != o.namespace {
+		return false
+	}
+	if o.kind == "" {
+		return true
+	}
+	gk := ref.GroupVersionKind().GroupKind()
+	wanted := schema.ParseGroupKind(o.kind)
+	if wanted.Group == "" {
+		// only kind was specified
+		return strings.EqualFold(gk.Kind, wanted.Kind)
+	}
+	return strings.EqualFold(gk.Kind, wanted.Kind) && gk.Group == wanted.Group
+}
+
+// events prints recent drift events. With --follow, it keeps polling and printing new ones.
+func events(ctx context.Context, c *client, o *options, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tRESOURCE\tCHANGE\tCONSUMERS")
+
+	var last uint64
+	for {
+		driftEvents, err := c.listDriftEvents(ctx, last)
+		if err != nil {
+			return err
+		}
+		for i := range driftEvents {
+			change := "modified"
+			if driftEvents[i].Deleted {
+				change = "deleted"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", driftEvents[i].Time.Format(time.RFC3339),
+				formatRef(&driftEvents[i].Resource), change, formatRefs(driftEvents[i].Consumers))
+			last = driftEvents[i].Sequence
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if !o.follow {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(o.pollInterval):
+		}
+	}
+}
+
+// evaluate asks drift-detection-manager to evaluate resource right away
+func evaluate(ctx context.Context, c *client, resourceRef *corev1.ObjectReference, out io.Writer) error {
+	result, err := c.evaluate(ctx, resourceRef)
+	if err != nil {
+		return err
+	}
+
+	if result.Drifted {
+		fmt.Fprintf(out, "%s: configuration drift detected and reported\n", formatRef(&result.Resource))
+		return nil
+	}
+	fmt.Fprintf(out, "%s: no configuration drift\n", formatRef(&result.Resource))
+	return nil
+}
+
+// formatRef returns Kind.group namespace/name (or Kind.group name for cluster wide resources)
+func formatRef(ref *corev1.ObjectReference) string {
+	gk := ref.GroupVersionKind().GroupKind().String()
+	if ref.Namespace == "" {
+		return fmt.Sprintf("%s %s", gk, ref.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", gk, ref.Namespace, ref.Name)
+}
+
+func formatRefs(refs []corev1.ObjectReference) string {
+	if len(refs) == 0 {
+		return "-"
+	}
+	result := make([]string, len(refs))
+	for i := range refs {
+		result[i] = refs[i].Namespace + "/" + refs[i].Name
+	}
+	return strings.Join(result, ",")
+}
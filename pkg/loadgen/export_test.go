@@ -0,0 +1,42 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package loadgen
+
+import (
+	"time"
+)
+
+var (
+	Setup   = setup
+	Churn   = churn
+	Cleanup = cleanup
+)
+
+// NewOptions returns loadgen options
+func NewOptions(namespace string, resourceSummaries, resources, resourcesPerSummary, valueSize int,
+	mutationsPerSecond float64, duration time.Duration) *options {
+
+	return &options{
+		namespace:           namespace,
+		resourceSummaries:   resourceSummaries,
+		resources:           resources,
+		resourcesPerSummary: resourcesPerSummary,
+		valueSize:           valueSize,
+		mutationsPerSecond:  mutationsPerSecond,
+		duration:            duration,
+	}
+}
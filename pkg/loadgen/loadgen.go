@@ -0,0 +1,255 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package loadgen implements the loadgen subcommand, which creates ResourceSummaries tracking
+// synthetic resources and drives mutation churn against them. It is meant to validate how many
+// tracked resources a given drift-detection-manager pod size can sustain.
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/projectsveltos/drift-detection-manager/controllers"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+// Name is the name of the subcommand
+const Name = "loadgen"
+
+const (
+	// loadgenLabel is set on all objects created by loadgen
+	loadgenLabel = "projectsveltos.io/drift-detection-loadgen"
+
+	dataKey = "value"
+)
+
+type options struct {
+	kubeconfig          string
+	namespace           string
+	resourceSummaries   int
+	resources           int
+	resourcesPerSummary int
+	valueSize           int
+	mutationsPerSecond  float64
+	duration            time.Duration
+	cleanup             bool
+}
+
+// Run parses args, creates the synthetic ResourceSummaries and resources and drives
+// mutation churn against them, writing progress to out
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	fs := pflag.NewFlagSet(Name, pflag.ContinueOnError)
+
+	o := &options{}
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "",
+		"Path to the kubeconfig of the cluster drift-detection-manager is watching. In-cluster config is used when empty.")
+	fs.StringVar(&o.namespace, "namespace", "drift-detection-loadgen",
+		"Namespace where synthetic ResourceSummaries and resources are created.")
+	fs.IntVar(&o.resourceSummaries, "resource-summaries", 100, "Number of ResourceSummaries to create.")
+	fs.IntVar(&o.resources, "resources", 1000, "Number of synthetic resources (ConfigMaps) to create.")
+	fs.IntVar(&o.resourcesPerSummary, "resources-per-summary", 10,
+		"Number of resources tracked by each ResourceSummary. Resources are spread across ResourceSummaries, "+
+			"so a resource can be tracked by more than one.")
+	fs.IntVar(&o.valueSize, "value-size", 1024, "Size, in bytes, of each synthetic resource data.")
+	fs.Float64Var(&o.mutationsPerSecond, "mutations-per-second", 10, "Number of resources modified per second.")
+	fs.DurationVar(&o.duration, "duration", 10*time.Minute, "How long to drive mutation churn for.")
+	fs.BoolVar(&o.cleanup, "cleanup", true, "Delete all created objects when done.")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if o.resourceSummaries <= 0 || o.resources <= 0 || o.resourcesPerSummary <= 0 || o.mutationsPerSecond <= 0 {
+		return fmt.Errorf("resource-summaries, resources, resources-per-summary and mutations-per-second must be positive")
+	}
+
+	c, err := getClient(o.kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	if o.cleanup {
+		defer func() {
+			// Use a new context: ctx might be canceled already
+			if err := cleanup(context.Background(), c, o, out); err != nil {
+				fmt.Fprintf(out, "cleanup failed: %v\n", err)
+			}
+		}()
+	}
+
+	if err := setup(ctx, c, o, out); err != nil {
+		return err
+	}
+
+	return churn(ctx, c, o, out)
+}
+
+func getClient(kubeconfig string) (client.Client, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get rest config")
+	}
+
+	scheme, err := controllers.InitScheme()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.New(config, client.Options{Scheme: scheme})
+}
+
+// setup creates namespace, synthetic resources and ResourceSummaries tracking those
+func setup(ctx context.Context, c client.Client, o *options, out io.Writer) error {
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: o.namespace, Labels: map[string]string{loadgenLabel: "true"}},
+	}
+	if err := create(ctx, c, ns); err != nil {
+		return err
+	}
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano())) //nolint: gosec // no need for a secure generator
+	for i := 0; i < o.resources; i++ {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: o.namespace,
+				Name:      resourceName(i),
+				Labels:    map[string]string{loadgenLabel: "true"},
+			},
+			Data: map[string]string{dataKey: randomValue(o.valueSize, random)},
+		}
+		if err := create(ctx, c, configMap); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "created %d resources\n", o.resources)
+
+	for i := 0; i < o.resourceSummaries; i++ {
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: o.namespace,
+				Name:      fmt.Sprintf("loadgen-%d", i),
+				Labels:    map[string]string{loadgenLabel: "true"},
+			},
+		}
+		for j := 0; j < o.resourcesPerSummary; j++ {
+			resourceSummary.Spec.Resources = append(resourceSummary.Spec.Resources,
+				libsveltosv1alpha1.Resource{
+					Name:      resourceName((i*o.resourcesPerSummary + j) % o.resources),
+					Namespace: o.namespace,
+					Kind:      "ConfigMap",
+					Version:   "v1",
+				})
+		}
+		if err := create(ctx, c, resourceSummary); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "created %d ResourceSummaries\n", o.resourceSummaries)
+
+	return nil
+}
+
+// churn modifies random resources at the configured rate till duration expires or ctx is canceled
+func churn(ctx context.Context, c client.Client, o *options, out io.Writer) error {
+	random := rand.New(rand.NewSource(time.Now().UnixNano())) //nolint: gosec // no need for a secure generator
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / o.mutationsPerSecond))
+	defer ticker.Stop()
+
+	const reportInterval = 30 * time.Second
+	report := time.NewTicker(reportInterval)
+	defer report.Stop()
+
+	ctx, cancel := context.WithTimeout(ctx, o.duration)
+	defer cancel()
+
+	mutations, failures := 0, 0
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Fprintf(out, "done: %d mutations, %d failures\n", mutations, failures)
+			return nil
+		case <-report.C:
+			fmt.Fprintf(out, "%d mutations, %d failures\n", mutations, failures)
+		case <-ticker.C:
+			configMap := &corev1.ConfigMap{}
+			key := client.ObjectKey{Namespace: o.namespace, Name: resourceName(random.Intn(o.resources))}
+			if err := c.Get(ctx, key, configMap); err != nil {
+				failures++
+				continue
+			}
+			configMap.Data = map[string]string{dataKey: randomValue(o.valueSize, random)}
+			if err := c.Update(ctx, configMap); err != nil {
+				failures++
+				continue
+			}
+			mutations++
+		}
+	}
+}
+
+// cleanup deletes all objects created by setup. ResourceSummaries are deleted first,
+// so drift-detection-manager stops tracking resources before those are deleted.
+func cleanup(ctx context.Context, c client.Client, o *options, out io.Writer) error {
+	selector := client.MatchingLabels{loadgenLabel: "true"}
+
+	if err := c.DeleteAllOf(ctx, &libsveltosv1alpha1.ResourceSummary{},
+		client.InNamespace(o.namespace), selector); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: o.namespace}}
+	if err := c.Delete(ctx, ns); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	fmt.Fprintf(out, "deleted namespace %s\n", o.namespace)
+	return nil
+}
+
+func create(ctx context.Context, c client.Client, obj client.Object) error {
+	if err := c.Create(ctx, obj); err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create %s %s",
+			obj.GetObjectKind().GroupVersionKind().Kind, obj.GetName())
+	}
+	return nil
+}
+
+func resourceName(index int) string {
+	return "loadgen-" + strconv.Itoa(index)
+}
+
+func randomValue(size int, random *rand.Rand) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = letters[random.Intn(len(letters))]
+	}
+	return string(b)
+}
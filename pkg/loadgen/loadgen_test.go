@@ -0,0 +1,113 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package loadgen_test
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/drift-detection-manager/controllers"
+	"github.com/projectsveltos/drift-detection-manager/pkg/loadgen"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+const (
+	namespace = "loadgen"
+)
+
+var _ = Describe("Loadgen", func() {
+	var c client.Client
+
+	BeforeEach(func() {
+		s, err := controllers.InitScheme()
+		Expect(err).To(BeNil())
+		c = fake.NewClientBuilder().WithScheme(s).Build()
+	})
+
+	It("setup creates ResourceSummaries tracking synthetic resources, cleanup deletes them", func() {
+		o := loadgen.NewOptions(namespace, 4, 6, 3, 16, 1, time.Second)
+		out := &bytes.Buffer{}
+		Expect(loadgen.Setup(context.TODO(), c, o, out)).To(Succeed())
+
+		configMaps := &corev1.ConfigMapList{}
+		Expect(c.List(context.TODO(), configMaps, client.InNamespace(namespace))).To(Succeed())
+		Expect(configMaps.Items).To(HaveLen(6))
+		for i := range configMaps.Items {
+			Expect(configMaps.Items[i].Data["value"]).To(HaveLen(16))
+		}
+
+		resourceSummaries := &libsveltosv1alpha1.ResourceSummaryList{}
+		Expect(c.List(context.TODO(), resourceSummaries, client.InNamespace(namespace))).To(Succeed())
+		Expect(resourceSummaries.Items).To(HaveLen(4))
+		tracked := map[string]int{}
+		for i := range resourceSummaries.Items {
+			Expect(resourceSummaries.Items[i].Spec.Resources).To(HaveLen(3))
+			for _, resource := range resourceSummaries.Items[i].Spec.Resources {
+				Expect(resource.Namespace).To(Equal(namespace))
+				Expect(resource.Kind).To(Equal("ConfigMap"))
+				tracked[resource.Name]++
+			}
+		}
+		// 12 tracked resources are spread across 6 resources
+		Expect(tracked).To(HaveLen(6))
+		for name := range tracked {
+			Expect(tracked[name]).To(Equal(2))
+		}
+
+		// setup can be re-run against existing objects
+		Expect(loadgen.Setup(context.TODO(), c, o, out)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("created 6 resources"))
+		Expect(out.String()).To(ContainSubstring("created 4 ResourceSummaries"))
+
+		Expect(loadgen.Cleanup(context.TODO(), c, o, out)).To(Succeed())
+		Expect(c.List(context.TODO(), resourceSummaries, client.InNamespace(namespace))).To(Succeed())
+		Expect(resourceSummaries.Items).To(BeEmpty())
+		err := c.Get(context.TODO(), client.ObjectKey{Name: namespace}, &corev1.Namespace{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("churn modifies resources till duration expires", func() {
+		o := loadgen.NewOptions(namespace, 1, 2, 1, 16, 100, 500*time.Millisecond)
+		out := &bytes.Buffer{}
+		Expect(loadgen.Setup(context.TODO(), c, o, out)).To(Succeed())
+
+		before := &corev1.ConfigMapList{}
+		Expect(c.List(context.TODO(), before, client.InNamespace(namespace))).To(Succeed())
+
+		Expect(loadgen.Churn(context.TODO(), c, o, out)).To(Succeed())
+		Expect(out.String()).To(MatchRegexp(`done: [1-9]\d* mutations, 0 failures`))
+
+		after := &corev1.ConfigMapList{}
+		Expect(c.List(context.TODO(), after, client.InNamespace(namespace))).To(Succeed())
+		Expect(after.Items).To(HaveLen(2))
+		Expect(after.Items).ToNot(Equal(before.Items))
+	})
+
+	It("Run rejects non positive sizes", func() {
+		Expect(loadgen.Run(context.TODO(), []string{"--resources=0"}, &bytes.Buffer{})).ToNot(Succeed())
+		Expect(loadgen.Run(context.TODO(), []string{"--mutations-per-second=0"}, &bytes.Buffer{})).ToNot(Succeed())
+	})
+})
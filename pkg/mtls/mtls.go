@@ -0,0 +1,176 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mtls implements mutual TLS for the diagnostics endpoint: client certificates are
+// verified against a CA bundle which is reloaded on rotation (for instance when the Secret
+// it is mounted from changes), and clients (inspect, kubectl-drift) can present certificates.
+package mtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// reloadInterval is how often CA bundle is checked for changes. Files mounted from Secrets
+	// are replaced via symlink swaps, which polling handles reliably.
+	reloadInterval = 10 * time.Second
+)
+
+// ClientCAWatcher keeps the pool of CAs client certificates are verified against, reloading it
+// whenever CA bundle changes
+type ClientCAWatcher struct {
+	path string
+
+	mu   sync.RWMutex
+	pool *x509.CertPool
+	// content is the CA bundle pool was built from
+	content []byte
+}
+
+// NewClientCAWatcher returns a ClientCAWatcher for the PEM encoded CA bundle at path
+func NewClientCAWatcher(path string) (*ClientCAWatcher, error) {
+	w := &ClientCAWatcher{path: path}
+	if _, err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// reload reads CA bundle again. Returns true if it changed. On error, previous pool is kept.
+func (w *ClientCAWatcher) reload() (bool, error) {
+	content, err := os.ReadFile(w.path)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read client CA bundle")
+	}
+
+	w.mu.RLock()
+	unchanged := bytes.Equal(content, w.content)
+	w.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return false, fmt.Errorf("no valid certificate found in client CA bundle %s", w.path)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pool = pool
+	w.content = content
+	return true, nil
+}
+
+func (w *ClientCAWatcher) getPool() *x509.CertPool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.pool
+}
+
+// Start reloads CA bundle, when it changes, till ctx is canceled
+func (w *ClientCAWatcher) Start(ctx context.Context, logger logr.Logger) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := w.reload()
+			if err != nil {
+				logger.Error(err, "failed to reload client CA bundle. Keep using previous one")
+			} else if changed {
+				logger.Info("client CA bundle reloaded")
+			}
+		}
+	}
+}
+
+// TLSOpt returns an option requiring clients to present a certificate signed by one of the
+// CAs in the bundle. Bundle is looked up on each handshake, so rotation applies to new connections.
+func (w *ClientCAWatcher) TLSOpt() func(*tls.Config) {
+	return func(cfg *tls.Config) {
+		cfg.MinVersion = tls.VersionTLS12
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			// cfg is completed (server certificate) after options are applied, so it is
+			// only cloned on handshake
+			c := cfg.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = w.getPool()
+			return c, nil
+		}
+	}
+}
+
+// ClientOptions configures TLS of clients of the diagnostics endpoint
+type ClientOptions struct {
+	// CertificateAuthority, when set, is the CA bundle endpoint certificate is verified against
+	CertificateAuthority string
+
+	// ClientCertificate and ClientKey, when set, are the certificate presented to the endpoint
+	ClientCertificate string
+	ClientKey         string
+}
+
+// AddFlags adds the flags setting o to fs
+func (o *ClientOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.CertificateAuthority, "certificate-authority", "",
+		"CA bundle the diagnostics endpoint certificate is verified against (see also --insecure-skip-tls-verify).")
+	fs.StringVar(&o.ClientCertificate, "client-certificate", "",
+		"Client certificate presented to the diagnostics endpoint (see --diagnostics-client-ca-file).")
+	fs.StringVar(&o.ClientKey, "client-key", "", "Key of the client certificate.")
+}
+
+// TLSConfig returns the TLS configuration used to talk to the diagnostics endpoint
+func (o *ClientOptions) TLSConfig(insecureSkipTLSVerify bool) (*tls.Config, error) {
+	//nolint: gosec // diagnostics endpoint certificate is self-signed unless configured otherwise
+	cfg := &tls.Config{InsecureSkipVerify: insecureSkipTLSVerify}
+
+	if o.CertificateAuthority != "" {
+		content, err := os.ReadFile(o.CertificateAuthority)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read certificate authority")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no valid certificate found in %s", o.CertificateAuthority)
+		}
+	}
+
+	if o.ClientCertificate != "" || o.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCertificate, o.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
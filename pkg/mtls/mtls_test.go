@@ -0,0 +1,196 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mtls_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/mtls"
+)
+
+// certificate is a certificate with its key, PEM encoded
+type certificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newCertificate returns a certificate signed by parent. A nil parent means a self-signed CA.
+func newCertificate(commonName string, parent *certificate) *certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	Expect(err).To(BeNil())
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+
+	return &certificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+var _ = Describe("mTLS", func() {
+	var dir string
+	var serverCA *certificate
+	var server *httptest.Server
+
+	writeFile := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		Expect(os.WriteFile(path, content, 0600)).To(Succeed())
+		return path
+	}
+
+	// get sends a request to server presenting, if not nil, client certificate
+	get := func(client *certificate) error {
+		options := &mtls.ClientOptions{CertificateAuthority: filepath.Join(dir, "server-ca.crt")}
+		if client != nil {
+			options.ClientCertificate = writeFile("client.crt", client.certPEM)
+			options.ClientKey = writeFile("client.key", client.keyPEM)
+		}
+		tlsConfig, err := options.TLSConfig(false)
+		Expect(err).To(BeNil())
+
+		// New connection for each request, so that CA bundle in use is the current one
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}}
+		resp, err := httpClient.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		return nil
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+
+		serverCA = newCertificate("server-ca", nil)
+		writeFile("server-ca.crt", serverCA.certPEM)
+		serverCert := newCertificate("server", serverCA)
+		serverKeyPair, err := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+		Expect(err).To(BeNil())
+
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{serverKeyPair}, MinVersion: tls.VersionTLS12}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("only clients presenting a certificate signed by a CA in the bundle are accepted, bundle is reloaded", func() {
+		clientCA := newCertificate("client-ca", nil)
+		otherClientCA := newCertificate("other-client-ca", nil)
+		bundle := writeFile("client-ca.crt", clientCA.certPEM)
+
+		watcher, err := mtls.NewClientCAWatcher(bundle)
+		Expect(err).To(BeNil())
+		watcher.TLSOpt()(server.TLS)
+		server.StartTLS()
+
+		client := newCertificate("client", clientCA)
+		otherClient := newCertificate("other-client", otherClientCA)
+
+		Expect(get(client)).To(Succeed())
+		Expect(get(otherClient)).ToNot(Succeed())
+		Expect(get(nil)).ToNot(Succeed())
+
+		// CA bundle is rotated
+		writeFile("client-ca.crt", otherClientCA.certPEM)
+		changed, err := mtls.Reload(watcher)
+		Expect(err).To(BeNil())
+		Expect(changed).To(BeTrue())
+		Expect(get(otherClient)).To(Succeed())
+		Expect(get(client)).ToNot(Succeed())
+
+		changed, err = mtls.Reload(watcher)
+		Expect(err).To(BeNil())
+		Expect(changed).To(BeFalse())
+
+		// Invalid bundle: previous one is kept
+		writeFile("client-ca.crt", []byte("not a certificate"))
+		_, err = mtls.Reload(watcher)
+		Expect(err).ToNot(BeNil())
+		Expect(get(otherClient)).To(Succeed())
+	})
+
+	It("NewClientCAWatcher fails when CA bundle is missing or invalid", func() {
+		_, err := mtls.NewClientCAWatcher(filepath.Join(dir, "missing.crt"))
+		Expect(err).ToNot(BeNil())
+
+		_, err = mtls.NewClientCAWatcher(writeFile("invalid.crt", []byte("not a certificate")))
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("ClientOptions.TLSConfig fails when certificate authority or client certificate cannot be loaded", func() {
+		_, err := (&mtls.ClientOptions{CertificateAuthority: filepath.Join(dir, "missing.crt")}).TLSConfig(false)
+		Expect(err).ToNot(BeNil())
+
+		_, err = (&mtls.ClientOptions{ClientCertificate: filepath.Join(dir, "missing.crt")}).TLSConfig(false)
+		Expect(err).ToNot(BeNil())
+
+		tlsConfig, err := (&mtls.ClientOptions{}).TLSConfig(true)
+		Expect(err).To(BeNil())
+		Expect(tlsConfig.InsecureSkipVerify).To(BeTrue())
+	})
+})
@@ -0,0 +1,273 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package preflight verifies drift-detection-manager can run: API server is reachable,
+// required CRDs are installed and RBAC grants the needed permissions. When running in the
+// management cluster, it also verifies the managed cluster is reachable.
+// It is meant for init containers and install verification (see --preflight).
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	driftdetectionv1alpha1 "github.com/projectsveltos/drift-detection-manager/api/v1alpha1"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+const (
+	// requestTimeout bounds each request sent by a check
+	requestTimeout = 10 * time.Second
+)
+
+// Status is the outcome of a Check
+type Status string
+
+const (
+	// Passed means check succeeded
+	Passed = Status("passed")
+
+	// Failed means drift-detection-manager cannot run (or cannot detect drifts)
+	Failed = Status("failed")
+
+	// Warning means drift-detection-manager can run, with an optional feature unavailable
+	Warning = Status("warning")
+
+	// Skipped means check was not run because a previous one failed
+	Skipped = Status("skipped")
+)
+
+// Check is the outcome of a single verification
+type Check struct {
+	Name string `json:"name"`
+
+	Status Status `json:"status"`
+
+	Message string `json:"message,omitempty"`
+}
+
+// Report contains the outcome of all checks, in the order they were run
+type Report struct {
+	Checks []Check `json:"checks"`
+}
+
+// Failed returns true if any check failed
+func (r *Report) Failed() bool {
+	for i := range r.Checks {
+		if r.Checks[i].Status == Failed {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Report) add(name string, status Status, message string) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: status, Message: message})
+}
+
+// Options configures the checks
+type Options struct {
+	// ManagedClusterConfig, when set, returns the rest config of the managed cluster. Set it when
+	// drift-detection-manager runs in the management cluster. Config passed to Run is then the
+	// management cluster one.
+	ManagedClusterConfig func(ctx context.Context) (*rest.Config, error)
+
+	// Namespaces, if set, are the only namespaces drift-detection-manager processes. Namespaced
+	// permissions are then verified in each of them only.
+	Namespaces []string
+}
+
+// permission is a permission drift-detection-manager needs
+type permission struct {
+	group       string
+	resource    string
+	subresource string
+	verbs       []string
+}
+
+// requiredPermissions are the permissions drift-detection-manager needs in each processed namespace.
+// Must be kept in sync with RBAC markers.
+var requiredPermissions = []permission{
+	{group: libsveltosv1alpha1.GroupVersion.Group, resource: "resourcesummaries",
+		verbs: []string{"get", "list", "watch", "update", "patch"}},
+	{group: libsveltosv1alpha1.GroupVersion.Group, resource: "resourcesummaries", subresource: "status",
+		verbs: []string{"update", "patch"}},
+	{group: "", resource: "events", verbs: []string{"create", "patch"}},
+	// Tracked resources can be of any kind
+	{group: "*", resource: "*", verbs: []string{"get", "list", "watch"}},
+}
+
+// Run runs all checks against the cluster config points to and returns a report
+func Run(ctx context.Context, config *rest.Config, options *Options) *Report {
+	report := &Report{}
+
+	config = rest.CopyConfig(config)
+	config.Timeout = requestTimeout
+
+	if options.ManagedClusterConfig != nil {
+		if !checkConnectivity(report, "management-cluster-connectivity", config) {
+			report.add("managed-cluster-connectivity", Skipped, "")
+			return report
+		}
+
+		managedConfig, err := options.ManagedClusterConfig(ctx)
+		if err != nil {
+			report.add("managed-cluster-kubeconfig", Failed, err.Error())
+			report.add("managed-cluster-connectivity", Skipped, "")
+			return report
+		}
+		report.add("managed-cluster-kubeconfig", Passed, "")
+
+		config = rest.CopyConfig(managedConfig)
+		config.Timeout = requestTimeout
+		if !checkConnectivity(report, "managed-cluster-connectivity", config) {
+			return report
+		}
+	} else if !checkConnectivity(report, "api-server-connectivity", config) {
+		return report
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		report.add("crds", Failed, err.Error())
+		return report
+	}
+	checkCRD(report, discoveryClient, libsveltosv1alpha1.GroupVersion.WithKind(libsveltosv1alpha1.ResourceSummaryKind),
+		"resourcesummaries", true)
+	checkCRD(report, discoveryClient, driftdetectionv1alpha1.GroupVersion.WithKind(driftdetectionv1alpha1.DriftDetectionConfigKind),
+		"driftdetectionconfigs", false)
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		report.add("rbac", Failed, err.Error())
+		return report
+	}
+	checkPermissions(ctx, report, clientset, options.Namespaces)
+
+	return report
+}
+
+// checkConnectivity verifies API server config points to is reachable. Returns false otherwise.
+func checkConnectivity(report *Report, name string, config *rest.Config) bool {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		report.add(name, Failed, err.Error())
+		return false
+	}
+
+	version, err := discoveryClient.ServerVersion()
+	if err != nil {
+		report.add(name, Failed, fmt.Sprintf("%s: %v", config.Host, err))
+		return false
+	}
+
+	report.add(name, Passed, fmt.Sprintf("%s (Kubernetes %s)", config.Host, version.GitVersion))
+	return true
+}
+
+// checkCRD verifies resource of gvk is served. A missing optional CRD is only a warning.
+func checkCRD(report *Report, discoveryClient discovery.DiscoveryInterface, gvk schema.GroupVersionKind,
+	resource string, required bool) {
+
+	name := fmt.Sprintf("crd-%s", resource)
+
+	resources, err := discoveryClient.ServerResourcesForGroupVersion(gvk.GroupVersion().String())
+	if err == nil {
+		for i := range resources.APIResources {
+			if resources.APIResources[i].Name == resource {
+				report.add(name, Passed, gvk.String())
+				return
+			}
+		}
+	} else if !apierrors.IsNotFound(err) {
+		report.add(name, Failed, err.Error())
+		return
+	}
+
+	if required {
+		report.add(name, Failed, fmt.Sprintf("%s is not installed", gvk.GroupKind()))
+		return
+	}
+	report.add(name, Warning, fmt.Sprintf("%s is not installed: settings cannot be changed at runtime", gvk.GroupKind()))
+}
+
+// checkPermissions verifies, via SelfSubjectAccessReviews, drift-detection-manager has all
+// requiredPermissions, in each of namespaces if set (in all namespaces otherwise).
+func checkPermissions(ctx context.Context, report *Report, clientset kubernetes.Interface, namespaces []string) {
+	if len(namespaces) == 0 {
+		namespaces = []string{corev1.NamespaceAll}
+	}
+
+	missing := make([]string, 0)
+	for i := range requiredPermissions {
+		p := &requiredPermissions[i]
+		for _, namespace := range namespaces {
+			for _, verb := range p.verbs {
+				review := &authorizationv1.SelfSubjectAccessReview{
+					Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+						ResourceAttributes: &authorizationv1.ResourceAttributes{
+							Namespace:   namespace,
+							Verb:        verb,
+							Group:       p.group,
+							Resource:    p.resource,
+							Subresource: p.subresource,
+						},
+					},
+				}
+				result, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review,
+					metav1.CreateOptions{})
+				if err != nil {
+					report.add("rbac", Failed, err.Error())
+					return
+				}
+				if !result.Status.Allowed {
+					missing = append(missing, describePermission(p, verb, namespace))
+				}
+			}
+		}
+	}
+
+	if len(missing) != 0 {
+		report.add("rbac", Failed, "missing permissions: "+strings.Join(missing, ", "))
+		return
+	}
+	report.add("rbac", Passed, "")
+}
+
+func describePermission(p *permission, verb, namespace string) string {
+	resource := p.resource
+	if p.subresource != "" {
+		resource += "/" + p.subresource
+	}
+	if p.group != "" {
+		resource += "." + p.group
+	}
+	if namespace != corev1.NamespaceAll {
+		return fmt.Sprintf("%s %s in namespace %s", verb, resource, namespace)
+	}
+	return fmt.Sprintf("%s %s", verb, resource)
+}
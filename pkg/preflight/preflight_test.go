@@ -0,0 +1,209 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package preflight_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/preflight"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+// denyVerbs returns an authorizer allowing all verbs but denied ones
+func denyVerbs(denied ...string) func(attributes *authorizationv1.ResourceAttributes) bool {
+	return func(attributes *authorizationv1.ResourceAttributes) bool {
+		for i := range denied {
+			if attributes.Verb == denied[i] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// newAPIServer returns a fake API server serving ResourceSummaries only. SelfSubjectAccessReviews
+// are answered by allowed.
+func newAPIServer(allowed func(attributes *authorizationv1.ResourceAttributes) bool) *httptest.Server {
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, obj interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		Expect(json.NewEncoder(w).Encode(obj)).To(Succeed())
+	}
+	mux.HandleFunc("/version", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, &version.Info{GitVersion: "v1.30.0"})
+	})
+	mux.HandleFunc("/apis/"+libsveltosv1alpha1.GroupVersion.String(), func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: libsveltosv1alpha1.GroupVersion.String(),
+			APIResources: []metav1.APIResource{{Name: "resourcesummaries", Namespaced: true,
+				Kind: libsveltosv1alpha1.ResourceSummaryKind}},
+		})
+	})
+	mux.HandleFunc("/apis/authorization.k8s.io/v1/selfsubjectaccessreviews", func(w http.ResponseWriter, r *http.Request) {
+		defer GinkgoRecover()
+		review := &authorizationv1.SelfSubjectAccessReview{}
+		Expect(json.NewDecoder(r.Body).Decode(review)).To(Succeed())
+		review.Status.Allowed = allowed(review.Spec.ResourceAttributes)
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, review)
+	})
+	// Any other group version is not served
+	mux.HandleFunc("/", http.NotFound)
+
+	return httptest.NewServer(mux)
+}
+
+func getCheck(report *preflight.Report, name string) *preflight.Check {
+	for i := range report.Checks {
+		if report.Checks[i].Name == name {
+			return &report.Checks[i]
+		}
+	}
+	return nil
+}
+
+// allowsResource returns true if rule grants the access described by attributes, as RBAC does
+func allowsResource(rule *rbacv1.PolicyRule, attributes *authorizationv1.ResourceAttributes) bool {
+	resource := attributes.Resource
+	if attributes.Subresource != "" {
+		resource += "/" + attributes.Subresource
+	}
+	return matches(rule.APIGroups, attributes.Group) && matches(rule.Resources, resource) &&
+		matches(rule.Verbs, attributes.Verb)
+}
+
+func matches(values []string, value string) bool {
+	for i := range values {
+		if values[i] == rbacv1.ResourceAll || values[i] == value {
+			return true
+		}
+	}
+	return false
+}
+
+var _ = Describe("Preflight", func() {
+	It("Run passes when API server is reachable, ResourceSummary CRD installed and RBAC granted", func() {
+		server := newAPIServer(denyVerbs())
+		defer server.Close()
+
+		report := preflight.Run(context.TODO(), &rest.Config{Host: server.URL}, &preflight.Options{})
+		Expect(report.Failed()).To(BeFalse())
+		Expect(getCheck(report, "api-server-connectivity").Status).To(Equal(preflight.Passed))
+		Expect(getCheck(report, "api-server-connectivity").Message).To(ContainSubstring("v1.30.0"))
+		Expect(getCheck(report, "crd-resourcesummaries").Status).To(Equal(preflight.Passed))
+		// DriftDetectionConfig is optional
+		Expect(getCheck(report, "crd-driftdetectionconfigs").Status).To(Equal(preflight.Warning))
+		Expect(getCheck(report, "rbac").Status).To(Equal(preflight.Passed))
+	})
+
+	It("Run reports missing permissions in each processed namespace", func() {
+		server := newAPIServer(denyVerbs("watch"))
+		defer server.Close()
+
+		report := preflight.Run(context.TODO(), &rest.Config{Host: server.URL},
+			&preflight.Options{Namespaces: []string{"foo"}})
+		Expect(report.Failed()).To(BeTrue())
+		rbac := getCheck(report, "rbac")
+		Expect(rbac.Status).To(Equal(preflight.Failed))
+		Expect(rbac.Message).To(ContainSubstring("watch resourcesummaries.lib.projectsveltos.io in namespace foo"))
+		Expect(rbac.Message).To(ContainSubstring("watch *.* in namespace foo"))
+		Expect(rbac.Message).ToNot(ContainSubstring("get "))
+	})
+
+	It("namespaced Role grants all permissions needed with --namespace-scoped", func() {
+		const tenantNamespace = "tenant"
+		data, err := os.ReadFile(filepath.Join("..", "..", "config", "namespaced", "role.yaml"))
+		Expect(err).To(BeNil())
+		role := &rbacv1.Role{}
+		Expect(yaml.Unmarshal(data, role)).To(Succeed())
+
+		// Only the Role, bound in tenant namespace, grants permissions
+		server := newAPIServer(func(attributes *authorizationv1.ResourceAttributes) bool {
+			if attributes.Namespace != tenantNamespace {
+				return false
+			}
+			for i := range role.Rules {
+				if allowsResource(&role.Rules[i], attributes) {
+					return true
+				}
+			}
+			return false
+		})
+		defer server.Close()
+
+		report := preflight.Run(context.TODO(), &rest.Config{Host: server.URL},
+			&preflight.Options{Namespaces: []string{tenantNamespace}})
+		Expect(getCheck(report, "rbac").Status).To(Equal(preflight.Passed), getCheck(report, "rbac").Message)
+
+		// Role is not enough without --namespace-scoped
+		report = preflight.Run(context.TODO(), &rest.Config{Host: server.URL}, &preflight.Options{})
+		Expect(getCheck(report, "rbac").Status).To(Equal(preflight.Failed))
+	})
+
+	It("Run stops at first connectivity failure", func() {
+		server := newAPIServer(denyVerbs())
+		server.Close()
+
+		report := preflight.Run(context.TODO(), &rest.Config{Host: server.URL}, &preflight.Options{})
+		Expect(report.Failed()).To(BeTrue())
+		Expect(report.Checks).To(HaveLen(1))
+		Expect(report.Checks[0].Name).To(Equal("api-server-connectivity"))
+		Expect(report.Checks[0].Status).To(Equal(preflight.Failed))
+	})
+
+	It("Run verifies the managed cluster when running in the management cluster", func() {
+		management := newAPIServer(denyVerbs())
+		defer management.Close()
+
+		report := preflight.Run(context.TODO(), &rest.Config{Host: management.URL}, &preflight.Options{
+			ManagedClusterConfig: func(_ context.Context) (*rest.Config, error) {
+				return nil, errors.New("kubeconfig not found")
+			},
+		})
+		Expect(report.Failed()).To(BeTrue())
+		Expect(getCheck(report, "management-cluster-connectivity").Status).To(Equal(preflight.Passed))
+		Expect(getCheck(report, "managed-cluster-kubeconfig").Message).To(Equal("kubeconfig not found"))
+		Expect(getCheck(report, "managed-cluster-connectivity").Status).To(Equal(preflight.Skipped))
+
+		managed := newAPIServer(denyVerbs())
+		defer managed.Close()
+		report = preflight.Run(context.TODO(), &rest.Config{Host: management.URL}, &preflight.Options{
+			ManagedClusterConfig: func(_ context.Context) (*rest.Config, error) {
+				return &rest.Config{Host: managed.URL}, nil
+			},
+		})
+		Expect(report.Failed()).To(BeFalse())
+		Expect(getCheck(report, "managed-cluster-connectivity").Message).To(ContainSubstring(managed.URL))
+	})
+})
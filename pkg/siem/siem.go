@@ -0,0 +1,374 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package siem sends drifts, and their remediation by Sveltos, to a syslog server (RFC 5424 over
+// TCP or TLS, with octet counting framing as per RFC 6587), so that drift records land in the SIEM
+// security teams use. Message is either RFC 5424 structured data or a CEF or LEEF record, the
+// formats most SIEMs (ArcSight, QRadar, Splunk, Sentinel...) parse with no custom configuration.
+package siem
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/egress"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// Format is the format of syslog messages
+type Format string
+
+const (
+	// RFC5424Format sends drift details as RFC 5424 structured data
+	RFC5424Format = Format("rfc5424")
+
+	// CEFFormat sends drift details as an ArcSight Common Event Format record
+	CEFFormat = Format("cef")
+
+	// LEEFFormat sends drift details as an IBM QRadar Log Event Extended Format 2.0 record
+	LEEFFormat = Format("leef")
+)
+
+const (
+	vendor  = "projectsveltos"
+	product = "drift-detection-manager"
+	version = "1"
+
+	// sdID is the ID of the structured data element drift details are in. 32473 is the
+	// enterprise number reserved for documentation (RFC 5612).
+	sdID = "drift@32473"
+
+	// facility is local0
+	facility = 16
+
+	severityWarning = 4
+	severityNotice  = 5
+
+	// queueSize is the number of messages waiting to be sent. Messages are dropped when queue is full.
+	queueSize = 1000
+
+	// dialTimeout bounds each connection attempt to the syslog server
+	dialTimeout = 10 * time.Second
+
+	// retryInterval is how long to wait before connecting again after a failure
+	retryInterval = 5 * time.Second
+)
+
+// Options configures a Sink
+type Options struct {
+	// Endpoint is the syslog server, as tcp://host:port or tls://host:port
+	Endpoint string
+
+	// Format is the format of messages
+	Format Format
+
+	// CAFile, used with tls endpoints, is the PEM file with the CA verifying the syslog
+	// server. System roots if not set.
+	CAFile string
+
+	// Cluster identifies the managed cluster, as type:namespace/name
+	Cluster string
+}
+
+// message is a syslog message, before formatting
+type message struct {
+	timestamp time.Time
+	severity  int
+	// msgID is drift or remediation
+	msgID   string
+	name    string
+	text    string
+	details [][2]string
+}
+
+// Sink sends drift events to a syslog server (see driftdetection.AddDriftEventSink)
+type Sink struct {
+	address   string
+	tlsConfig *tls.Config
+	format    Format
+	cluster   string
+	hostname  string
+
+	queue chan *message
+	conn  net.Conn
+	log   logr.Logger
+}
+
+// New returns a Sink sending drift events as described by options. Fails if options are invalid
+// or endpoint is not allowed (see egress.SetAllowlist). Messages are only sent once Run is called.
+func New(options *Options, logger logr.Logger) (*Sink, error) {
+	switch options.Format {
+	case RFC5424Format, CEFFormat, LEEFFormat:
+	default:
+		return nil, fmt.Errorf("unsupported format %q", options.Format)
+	}
+
+	u, err := url.Parse(options.Endpoint)
+	if err != nil || u.Port() == "" {
+		return nil, fmt.Errorf("invalid endpoint %q: must be tcp://host:port or tls://host:port", options.Endpoint)
+	}
+
+	s := &Sink{
+		address: u.Host,
+		format:  options.Format,
+		cluster: options.Cluster,
+		queue:   make(chan *message, queueSize),
+		log:     logger,
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		if options.CAFile != "" {
+			return nil, fmt.Errorf("CA file requires a tls endpoint")
+		}
+	case "tls":
+		s.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: u.Hostname()}
+		if options.CAFile != "" {
+			data, err := os.ReadFile(options.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			s.tlsConfig.RootCAs = x509.NewCertPool()
+			if !s.tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate found in %s", options.CAFile)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid endpoint %q: must be tcp://host:port or tls://host:port", options.Endpoint)
+	}
+
+	if err := egress.Register("siem", options.Endpoint); err != nil {
+		return nil, err
+	}
+
+	s.hostname, err = os.Hostname()
+	if err != nil || s.hostname == "" {
+		s.hostname = "-"
+	}
+
+	return s, nil
+}
+
+// Run sends queued messages till ctx is canceled. Connection is established on first message
+// and established again, after retryInterval, whenever it fails.
+func (s *Sink) Run(ctx context.Context) {
+	defer s.disconnect()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-s.queue:
+			if err := s.send(ctx, s.frame(msg)); err != nil {
+				s.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to send %s message to %s: %v",
+					msg.msgID, s.address, err))
+				s.disconnect()
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retryInterval):
+				}
+			}
+		}
+	}
+}
+
+// DriftDetected queues a drift message
+func (s *Sink) DriftDetected(event *driftdetection.DriftEvent) {
+	name := "Configuration drift"
+	switch {
+	case event.ValuesDrift:
+		name = "Helm release values drift"
+	case event.Deleted:
+		name = "Configuration drift: resource deleted"
+	}
+
+	s.enqueue(&message{
+		timestamp: event.Time,
+		severity:  severityWarning,
+		msgID:     "drift",
+		name:      name,
+		text:      fmt.Sprintf("%s %s drifted", event.Resource.Kind, getResourceName(&event.Resource)),
+		details:   s.getDetails(event, nil),
+	})
+}
+
+// DriftRemediated queues a remediation message
+func (s *Sink) DriftRemediated(event *driftdetection.DriftEvent, resourceSummary *corev1.ObjectReference) {
+	s.enqueue(&message{
+		timestamp: time.Now(),
+		severity:  severityNotice,
+		msgID:     "remediation",
+		name:      "Configuration drift remediated",
+		text:      fmt.Sprintf("%s %s drift was remediated by Sveltos", event.Resource.Kind, getResourceName(&event.Resource)),
+		details:   s.getDetails(event, resourceSummary),
+	})
+}
+
+// getDetails returns the details of event, as key value pairs. resourceSummary, when set, is
+// the ResourceSummary whose reconciliation remediated the drift.
+func (s *Sink) getDetails(event *driftdetection.DriftEvent, resourceSummary *corev1.ObjectReference) [][2]string {
+	details := [][2]string{
+		{"cluster", s.cluster},
+		{"sequence", fmt.Sprintf("%d", event.Sequence)},
+		{"apiVersion", event.Resource.APIVersion},
+		{"kind", event.Resource.Kind},
+		{"namespace", event.Resource.Namespace},
+		{"name", event.Resource.Name},
+		{"deleted", fmt.Sprintf("%t", event.Deleted)},
+		{"reportOnly", fmt.Sprintf("%t", event.ReportOnly)},
+	}
+	if resourceSummary != nil {
+		details = append(details, [2]string{"resourceSummary", getResourceName(resourceSummary)})
+	}
+	return details
+}
+
+// enqueue queues msg. Drift detection must never be blocked by the syslog server: msg is dropped
+// if queue is full.
+func (s *Sink) enqueue(msg *message) {
+	select {
+	case s.queue <- msg:
+	default:
+		s.log.V(logs.LogInfo).Info(fmt.Sprintf("syslog queue is full. Dropping %s message", msg.msgID))
+	}
+}
+
+// frame returns msg as a RFC 5424 syslog message, framed with octet counting (RFC 6587)
+func (s *Sink) frame(msg *message) []byte {
+	structuredData := "-"
+	var text string
+	switch s.format {
+	case CEFFormat:
+		text = s.formatCEF(msg)
+	case LEEFFormat:
+		text = s.formatLEEF(msg)
+	default:
+		structuredData = formatStructuredData(msg.details)
+		text = msg.text
+	}
+
+	syslogMsg := fmt.Sprintf("<%d>1 %s %s %s - %s %s %s",
+		facility*8+msg.severity, msg.timestamp.UTC().Format(time.RFC3339Nano), s.hostname, product,
+		msg.msgID, structuredData, text)
+	return []byte(fmt.Sprintf("%d %s", len(syslogMsg), syslogMsg))
+}
+
+// formatStructuredData returns details as a RFC 5424 structured data element
+func formatStructuredData(details [][2]string) string {
+	var b strings.Builder
+	b.WriteString("[" + sdID)
+	for i := range details {
+		if details[i][1] == "" {
+			continue
+		}
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(details[i][1])
+		fmt.Fprintf(&b, ` %s="%s"`, details[i][0], value)
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// formatCEF returns msg as a CEF record
+func (s *Sink) formatCEF(msg *message) string {
+	header := strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	extension := strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`)
+
+	// CEF severity ranges from 0 to 10
+	severity := 6
+	if msg.severity == severityNotice {
+		severity = 3
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|", vendor, product, version, msg.msgID, header.Replace(msg.name), severity)
+	fmt.Fprintf(&b, "rt=%d msg=%s", msg.timestamp.UnixMilli(), extension.Replace(msg.text))
+	for i := range msg.details {
+		if msg.details[i][1] == "" {
+			continue
+		}
+		// Details are written as custom extension keys, which most CEF parsers accept:
+		// cs<N>/cs<N>Label pairs would limit them to six
+		fmt.Fprintf(&b, " %s=%s", msg.details[i][0], extension.Replace(msg.details[i][1]))
+	}
+	return b.String()
+}
+
+// formatLEEF returns msg as a LEEF 2.0 record. Attributes are tab separated.
+func (s *Sink) formatLEEF(msg *message) string {
+	value := strings.NewReplacer("\t", " ", "\n", " ")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:2.0|%s|%s|%s|%s|", vendor, product, version, msg.msgID)
+	fmt.Fprintf(&b, "devTime=%s\tdevTimeFormat=yyyy-MM-dd'T'HH:mm:ss.SSSX\tmsg=%s",
+		msg.timestamp.UTC().Format("2006-01-02T15:04:05.000Z"), value.Replace(msg.text))
+	for i := range msg.details {
+		if msg.details[i][1] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\t%s=%s", msg.details[i][0], value.Replace(msg.details[i][1]))
+	}
+	return b.String()
+}
+
+// send writes data to the syslog server, connecting first if needed
+func (s *Sink) send(ctx context.Context, data []byte) error {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: dialTimeout}
+		var err error
+		if s.tlsConfig != nil {
+			s.conn, err = (&tls.Dialer{NetDialer: dialer, Config: s.tlsConfig}).DialContext(ctx, "tcp", s.address)
+		} else {
+			s.conn, err = dialer.DialContext(ctx, "tcp", s.address)
+		}
+		if err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(dialTimeout)); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *Sink) disconnect() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// getResourceName returns namespace/name of resource, or name for cluster wide resources
+func getResourceName(resource *corev1.ObjectReference) string {
+	if resource.Namespace == "" {
+		return resource.Name
+	}
+	return fmt.Sprintf("%s/%s", resource.Namespace, resource.Name)
+}
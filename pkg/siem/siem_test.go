@@ -0,0 +1,144 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package siem_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/siem"
+)
+
+// receive starts a syslog server and returns its endpoint along with the channel messages,
+// without octet counting framing, are sent to
+func receive() (endpoint string, messages chan string, listener net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	messages = make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(length))
+			if err != nil {
+				return
+			}
+			data := make([]byte, n)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			messages <- string(data)
+		}
+	}()
+
+	return fmt.Sprintf("tcp://%s", listener.Addr().String()), messages, listener
+}
+
+var _ = Describe("SIEM", func() {
+	var drift *driftdetection.DriftEvent
+
+	BeforeEach(func() {
+		drift = &driftdetection.DriftEvent{
+			Sequence: 3,
+			Resource: corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "nginx"},
+		}
+	})
+
+	It("New rejects invalid options", func() {
+		_, err := siem.New(&siem.Options{Endpoint: "udp://127.0.0.1:514", Format: siem.RFC5424Format}, logr.Discard())
+		Expect(err).ToNot(BeNil())
+		_, err = siem.New(&siem.Options{Endpoint: "tcp://127.0.0.1", Format: siem.RFC5424Format}, logr.Discard())
+		Expect(err).ToNot(BeNil())
+		_, err = siem.New(&siem.Options{Endpoint: "tcp://127.0.0.1:514", Format: "json"}, logr.Discard())
+		Expect(err).ToNot(BeNil())
+		_, err = siem.New(&siem.Options{Endpoint: "tcp://127.0.0.1:514", Format: siem.CEFFormat,
+			CAFile: "ca.crt"}, logr.Discard())
+		Expect(err).ToNot(BeNil())
+	})
+
+	DescribeTable("sends drifts to the syslog server",
+		func(format siem.Format, expected []string) {
+			endpoint, messages, listener := receive()
+			defer listener.Close()
+
+			sink, err := siem.New(&siem.Options{Endpoint: endpoint, Format: format, Cluster: "sveltos:default/cluster"},
+				logr.Discard())
+			Expect(err).To(BeNil())
+
+			ctx, cancel := context.WithCancel(context.TODO())
+			defer cancel()
+			go sink.Run(ctx)
+
+			sink.DriftDetected(drift)
+
+			var msg string
+			Eventually(messages).Should(Receive(&msg))
+			// PRI is local0.warning
+			Expect(msg).To(HavePrefix("<132>1 "))
+			for i := range expected {
+				Expect(msg).To(ContainSubstring(expected[i]))
+			}
+		},
+		Entry("rfc5424", siem.RFC5424Format, []string{` drift [drift@32473 cluster="sveltos:default/cluster" `,
+			`kind="Deployment"`, `name="nginx"`}),
+		Entry("cef", siem.CEFFormat, []string{"CEF:0|projectsveltos|drift-detection-manager|1|drift|Configuration drift|6|",
+			"namespace=default", "cluster=sveltos:default/cluster"}),
+		Entry("leef", siem.LEEFFormat, []string{"LEEF:2.0|projectsveltos|drift-detection-manager|1|drift|",
+			"\tkind=Deployment", "\tname=nginx"}),
+	)
+
+	It("sends remediations to the syslog server", func() {
+		endpoint, messages, listener := receive()
+		defer listener.Close()
+
+		sink, err := siem.New(&siem.Options{Endpoint: endpoint, Format: siem.RFC5424Format}, logr.Discard())
+		Expect(err).To(BeNil())
+
+		ctx, cancel := context.WithCancel(context.TODO())
+		defer cancel()
+		go sink.Run(ctx)
+
+		sink.DriftRemediated(drift, &corev1.ObjectReference{Namespace: "projectsveltos", Name: "summary"})
+
+		var msg string
+		Eventually(messages).Should(Receive(&msg))
+		// PRI is local0.notice
+		Expect(msg).To(HavePrefix("<133>1 "))
+		Expect(msg).To(ContainSubstring(`resourceSummary="projectsveltos/summary"`))
+	})
+})
@@ -0,0 +1,270 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package statsd periodically sends the metrics drift-detection-manager exposes to Prometheus,
+// to a StatsD or DogStatsD agent over UDP, for environments where workload clusters are not
+// scraped by Prometheus. Counters are sent as the increase since previous flush, gauges as
+// their value, and histograms and summaries as the increase of their count and sum. StatsD has
+// no labels: with plain StatsD label values are appended to the metric name, with DogStatsD
+// labels are sent as tags.
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/egress"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// Flavor is the protocol metrics are sent with
+type Flavor string
+
+const (
+	// StatsDFlavor sends metrics with plain StatsD protocol
+	StatsDFlavor = Flavor("statsd")
+
+	// DogStatsDFlavor sends metrics with DogStatsD protocol (StatsD with tags)
+	DogStatsDFlavor = Flavor("dogstatsd")
+)
+
+const (
+	// maxPacketSize keeps packets within the Ethernet MTU, so they are never fragmented
+	maxPacketSize = 1432
+
+	defaultInterval = 10 * time.Second
+)
+
+var (
+	invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+	invalidTagChars  = regexp.MustCompile(`[|,#\s]`)
+)
+
+// Options configures an Emitter
+type Options struct {
+	// Address is the StatsD agent, as host:port
+	Address string
+
+	// Flavor is the protocol metrics are sent with
+	Flavor Flavor
+
+	// Prefix, when set, prefixes all metric names (separated by a dot)
+	Prefix string
+
+	// Interval is how often metrics are sent
+	Interval time.Duration
+
+	// Tags, as key:value, are added to all metrics. DogStatsD only.
+	Tags []string
+}
+
+// Emitter sends metrics to a StatsD agent
+type Emitter struct {
+	address  string
+	flavor   Flavor
+	prefix   string
+	interval time.Duration
+	tags     []string
+	gatherer prometheus.Gatherer
+
+	// sent contains, per metric line key, the cumulative value sent last, so that only the
+	// increase of counters is sent
+	sent map[string]float64
+	log  logr.Logger
+}
+
+// New returns an Emitter sending metrics gathered from gatherer as described by options. Fails if
+// options are invalid or address is not allowed (see egress.SetAllowlist). Metrics are only sent
+// once Run is called.
+func New(options *Options, gatherer prometheus.Gatherer, logger logr.Logger) (*Emitter, error) {
+	switch options.Flavor {
+	case StatsDFlavor:
+		if len(options.Tags) != 0 {
+			return nil, fmt.Errorf("tags require %s flavor", DogStatsDFlavor)
+		}
+	case DogStatsDFlavor:
+	default:
+		return nil, fmt.Errorf("unsupported flavor %q", options.Flavor)
+	}
+
+	if _, port, err := net.SplitHostPort(options.Address); err != nil || port == "" {
+		return nil, fmt.Errorf("invalid address %q: must be host:port", options.Address)
+	}
+
+	if err := egress.Register("statsd", options.Address); err != nil {
+		return nil, err
+	}
+
+	e := &Emitter{
+		address:  options.Address,
+		flavor:   options.Flavor,
+		prefix:   options.Prefix,
+		interval: options.Interval,
+		tags:     options.Tags,
+		gatherer: gatherer,
+		sent:     make(map[string]float64),
+		log:      logger,
+	}
+	if e.interval <= 0 {
+		e.interval = defaultInterval
+	}
+	return e, nil
+}
+
+// Run sends metrics every interval till ctx is canceled
+func (e *Emitter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.flush(); err != nil {
+				e.log.V(logs.LogInfo).Info(fmt.Sprintf("failed to send metrics to %s: %v", e.address, err))
+			}
+		}
+	}
+}
+
+// flush gathers metrics and sends them
+func (e *Emitter) flush() error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	lines := make([]string, 0)
+	for _, family := range families {
+		lines = append(lines, e.getLines(family)...)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("udp", e.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, packet := range pack(lines) {
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getLines returns the StatsD lines for family
+func (e *Emitter) getLines(family *dto.MetricFamily) []string {
+	lines := make([]string, 0, len(family.GetMetric()))
+	for _, metric := range family.GetMetric() {
+		name, tags := e.getNameAndTags(family.GetName(), metric.GetLabel())
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			lines = e.appendIncrease(lines, name, tags, metric.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			lines = append(lines, e.format(name, metric.GetGauge().GetValue(), "g", tags))
+		case dto.MetricType_UNTYPED:
+			lines = append(lines, e.format(name, metric.GetUntyped().GetValue(), "g", tags))
+		case dto.MetricType_HISTOGRAM:
+			lines = e.appendIncrease(lines, name+".count", tags, float64(metric.GetHistogram().GetSampleCount()))
+			lines = e.appendIncrease(lines, name+".sum", tags, metric.GetHistogram().GetSampleSum())
+		case dto.MetricType_SUMMARY:
+			lines = e.appendIncrease(lines, name+".count", tags, float64(metric.GetSummary().GetSampleCount()))
+			lines = e.appendIncrease(lines, name+".sum", tags, metric.GetSummary().GetSampleSum())
+		}
+	}
+	return lines
+}
+
+// appendIncrease appends a counter line with the increase of value since previous flush, if any.
+// A value lower than the one sent last means the counter was reset: value is then sent as is.
+func (e *Emitter) appendIncrease(lines []string, name string, tags []string, value float64) []string {
+	key := name + "|" + strings.Join(tags, ",")
+	increase := value
+	if previous, ok := e.sent[key]; ok && previous <= value {
+		increase = value - previous
+	}
+	e.sent[key] = value
+	if increase == 0 {
+		return lines
+	}
+	return append(lines, e.format(name, increase, "c", tags))
+}
+
+// getNameAndTags returns the StatsD name and, with DogStatsD, tags of a metric
+func (e *Emitter) getNameAndTags(familyName string, labels []*dto.LabelPair) (name string, tags []string) {
+	name = familyName
+	if e.prefix != "" {
+		name = e.prefix + "." + name
+	}
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	if e.flavor == StatsDFlavor {
+		for _, label := range labels {
+			name += "." + label.GetValue()
+		}
+		return invalidNameChars.ReplaceAllString(name, "_"), nil
+	}
+
+	tags = append(tags, e.tags...)
+	for _, label := range labels {
+		tags = append(tags, label.GetName()+":"+invalidTagChars.ReplaceAllString(label.GetValue(), "_"))
+	}
+	return invalidNameChars.ReplaceAllString(name, "_"), tags
+}
+
+func (e *Emitter) format(name string, value float64, metricType string, tags []string) string {
+	line := fmt.Sprintf("%s:%s|%s", name, strconv.FormatFloat(value, 'f', -1, 64), metricType)
+	if len(tags) != 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// pack groups lines, newline separated, in packets of at most maxPacketSize bytes. A line longer
+// than maxPacketSize is sent in a packet of its own.
+func pack(lines []string) [][]byte {
+	packets := make([][]byte, 0)
+	var current []byte
+	for _, line := range lines {
+		if len(current) != 0 && len(current)+1+len(line) > maxPacketSize {
+			packets = append(packets, current)
+			current = nil
+		}
+		if len(current) != 0 {
+			current = append(current, '\n')
+		}
+		current = append(current, line...)
+	}
+	if len(current) != 0 {
+		packets = append(packets, current)
+	}
+	return packets
+}
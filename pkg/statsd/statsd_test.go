@@ -0,0 +1,116 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statsd_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/statsd"
+)
+
+var _ = Describe("StatsD emitter", func() {
+	var registry *prometheus.Registry
+	var counter *prometheus.CounterVec
+	var gauge prometheus.Gauge
+	var conn net.PacketConn
+
+	BeforeEach(func() {
+		registry = prometheus.NewRegistry()
+		counter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "drifts_total"}, []string{"gvk"})
+		gauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_length"})
+		registry.MustRegister(counter, gauge)
+
+		var err error
+		conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+	})
+
+	// receive returns the lines of the next packet containing a line for name
+	receive := func(name string) []string {
+		buffer := make([]byte, 65536)
+		for {
+			Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			n, _, err := conn.ReadFrom(buffer)
+			Expect(err).To(BeNil())
+			lines := strings.Split(string(buffer[:n]), "\n")
+			for i := range lines {
+				if strings.HasPrefix(lines[i], name+":") {
+					return lines
+				}
+			}
+		}
+	}
+
+	run := func(options *statsd.Options) context.CancelFunc {
+		emitter, err := statsd.New(options, registry, logr.Discard())
+		Expect(err).To(BeNil())
+		ctx, cancel := context.WithCancel(context.TODO())
+		go emitter.Run(ctx)
+		return cancel
+	}
+
+	It("sends counter increases and gauges with DogStatsD tags", func() {
+		counter.WithLabelValues("apps/v1, Kind=Deployment").Add(3)
+		gauge.Set(7)
+
+		cancel := run(&statsd.Options{Address: conn.LocalAddr().String(), Flavor: statsd.DogStatsDFlavor,
+			Prefix: "sveltos", Interval: 50 * time.Millisecond, Tags: []string{"cluster:production"}})
+		defer cancel()
+
+		lines := receive("sveltos.drifts_total")
+		Expect(lines).To(ContainElement("sveltos.drifts_total:3|c|#cluster:production,gvk:apps/v1__Kind=Deployment"))
+		Expect(lines).To(ContainElement("sveltos.queue_length:7|g|#cluster:production"))
+
+		// Only the increase since previous flush is sent
+		counter.WithLabelValues("apps/v1, Kind=Deployment").Add(2)
+		Expect(receive("sveltos.drifts_total")).To(ContainElement(
+			"sveltos.drifts_total:2|c|#cluster:production,gvk:apps/v1__Kind=Deployment"))
+	})
+
+	It("appends label values to metric name with plain StatsD", func() {
+		counter.WithLabelValues("v1, Kind=ConfigMap").Inc()
+
+		cancel := run(&statsd.Options{Address: conn.LocalAddr().String(), Flavor: statsd.StatsDFlavor,
+			Interval: 50 * time.Millisecond})
+		defer cancel()
+
+		Expect(receive("drifts_total.v1__Kind_ConfigMap")).To(ContainElement("drifts_total.v1__Kind_ConfigMap:1|c"))
+	})
+
+	It("rejects invalid options", func() {
+		_, err := statsd.New(&statsd.Options{Address: "localhost:8125", Flavor: "graphite"}, registry, logr.Discard())
+		Expect(err).ToNot(BeNil())
+		_, err = statsd.New(&statsd.Options{Address: "localhost", Flavor: statsd.StatsDFlavor}, registry, logr.Discard())
+		Expect(err).ToNot(BeNil())
+		_, err = statsd.New(&statsd.Options{Address: "localhost:8125", Flavor: statsd.StatsDFlavor,
+			Tags: []string{"cluster:production"}}, registry, logr.Discard())
+		Expect(err).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,83 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/egress"
+)
+
+const (
+	serviceName = "drift-detection-manager"
+)
+
+// Setup configures the global OpenTelemetry tracer provider to export spans, via OTLP gRPC,
+// to endpoint. If endpoint is empty, tracing is left disabled (global no-op provider).
+// Fails if endpoint is not allowed (see egress.SetAllowlist).
+// Returned function must be called on shutdown to flush pending spans.
+func Setup(ctx context.Context, endpoint string, insecure bool) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	if err := egress.Register("tracing", endpoint); err != nil {
+		return nil, err
+	}
+
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, options...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create OTLP trace exporter")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer used by drift-detection-manager. When tracing is
+// not enabled, a no-op tracer is returned.
+func Tracer() trace.Tracer {
+	return otel.Tracer(serviceName)
+}
+
+// TraceID returns the trace ID of the span stored in ctx, if any.
+// Returns an empty string if ctx does not carry a sampled span.
+func TraceID(ctx context.Context) string {
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if !spanCtx.HasTraceID() || !spanCtx.IsSampled() {
+		return ""
+	}
+	return spanCtx.TraceID().String()
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// proxyDialTimeout bounds dialing the proxy and establishing the tunnel
+const proxyDialTimeout = 30 * time.Second
+
+// ProxyTLS is how drift-detection-manager authenticates to an https proxy and verifies it,
+// independently from the managed cluster API server. For instance konnectivity server requires
+// client certificates issued by its own CA. Files are PEM encoded.
+type ProxyTLS struct {
+	// CAFile verifies the proxy certificate. System roots are used if empty.
+	CAFile string
+
+	// CertFile and KeyFile are the client certificate presented to the proxy, if any. They are
+	// read on every connection, so that rotated certificates are picked up.
+	CertFile string
+	KeyFile  string
+}
+
+// isSet returns true if any TLS setting was provided
+func (p *ProxyTLS) isSet() bool {
+	return p != nil && (p.CAFile != "" || p.CertFile != "" || p.KeyFile != "")
+}
+
+func (p *ProxyTLS) tlsConfig(serverName string) (*tls.Config, error) {
+	if (p.CertFile == "") != (p.KeyFile == "") {
+		return nil, fmt.Errorf("proxy client certificate and key must be set together")
+	}
+
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if p.CAFile != "" {
+		data, err := os.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read proxy CA")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in proxy CA %s", p.CAFile)
+		}
+	}
+	if p.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile); err != nil {
+			return nil, errors.Wrap(err, "invalid proxy client certificate")
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to load proxy client certificate")
+			}
+			return &cert, nil
+		}
+	}
+	return config, nil
+}
+
+// connectDialer opens tunnels to the managed cluster API server through an HTTP CONNECT proxy
+// it dials itself. Unlike http.Transport proxy support, the TLS connection to the proxy does not
+// reuse the TLS settings of the managed cluster.
+type connectDialer struct {
+	proxyURL  *url.URL
+	tlsConfig *tls.Config
+}
+
+// DialContext returns a connection tunneled to address
+func (d *connectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, proxyDialTimeout)
+	defer cancel()
+
+	proxyAddress := d.proxyURL.Host
+	if d.proxyURL.Port() == "" {
+		proxyAddress = net.JoinHostPort(d.proxyURL.Hostname(), defaultPort(d.proxyURL.Scheme))
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, proxyAddress)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial proxy")
+	}
+	if d.tlsConfig != nil {
+		tlsConn := tls.Client(conn, d.tlsConfig.Clone())
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "TLS handshake with proxy failed")
+		}
+		conn = tlsConn
+	}
+
+	tunneled, err := d.connect(ctx, conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunneled, nil
+}
+
+// connect asks proxy, conn is connected to, to tunnel conn to address
+func (d *connectDialer) connect(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if user := d.proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, errors.Wrap(err, "failed to send CONNECT request to proxy")
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read CONNECT response from proxy")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused to tunnel to %s: %s", address, resp.Status)
+	}
+
+	// Proxy might have sent bytes of the tunneled stream along with its response
+	if reader.Buffered() != 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read in reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
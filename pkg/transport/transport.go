@@ -0,0 +1,153 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package transport configures how drift-detection-manager, when running in the management
+// cluster, reaches the API server of the managed cluster. By default the address in the managed
+// cluster kubeconfig is dialed directly. Air-gapped managed clusters, whose API server is not
+// reachable from the management cluster, can instead be reached through a reverse tunnel: an
+// agent in the managed cluster keeps an outbound connection to a tunnel server in the management
+// cluster (for instance konnectivity server in http-connect mode), and drift-detection-manager
+// tunnels its connections through that server via HTTP CONNECT. The same mode fits fleets whose
+// workload clusters are only exposed through an HTTP(S) proxy. When the proxy requires its own TLS
+// settings (see ProxyTLS), like konnectivity server with client certificates, the tunnel is
+// established by drift-detection-manager itself rather than by the managed cluster transport.
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
+)
+
+// Mode is how the managed cluster API server is reached
+type Mode string
+
+const (
+	// Direct dials the managed cluster API server address found in its kubeconfig
+	Direct = Mode("direct")
+
+	// HTTPConnect tunnels connections to the managed cluster API server through an HTTP CONNECT
+	// proxy, like a reverse tunnel server managed cluster agents are connected to
+	HTTPConnect = Mode("http-connect")
+)
+
+// Cluster is the managed cluster. Its fields can be used in the proxy URL template.
+type Cluster struct {
+	Namespace string
+	Name      string
+	Type      string
+}
+
+// Transport configures how managed cluster is reached
+type Transport interface {
+	// Configure sets up cfg, the rest config of the managed cluster, so that connections go
+	// through this transport
+	Configure(cfg *rest.Config)
+
+	// Endpoint returns the address, other than managed cluster API server, connections go to.
+	// Empty if none.
+	Endpoint() string
+}
+
+// New returns the Transport for mode. With HTTPConnect, proxyURL is the URL of the proxy. It is
+// a template whose fields are those of Cluster (e.g. http://tunnel-{{.Name}}.{{.Namespace}}:8090),
+// so that clusters can be served by different tunnel servers. proxyTLS, if set, requires an
+// https proxy.
+func New(mode Mode, proxyURL string, proxyTLS *ProxyTLS, cluster *Cluster) (Transport, error) {
+	switch mode {
+	case Direct, "":
+		if proxyURL != "" || proxyTLS.isSet() {
+			return nil, fmt.Errorf("proxy settings require %s mode", HTTPConnect)
+		}
+		return direct{}, nil
+	case HTTPConnect:
+		u, err := renderProxyURL(proxyURL, cluster)
+		if err != nil {
+			return nil, err
+		}
+		if !proxyTLS.isSet() {
+			return &httpConnect{proxyURL: u}, nil
+		}
+		if u.Scheme != "https" {
+			return nil, fmt.Errorf("proxy TLS settings require an https proxy URL")
+		}
+		tlsConfig, err := proxyTLS.tlsConfig(u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		return &httpConnect{proxyURL: u, dialer: &connectDialer{proxyURL: u, tlsConfig: tlsConfig}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transport mode %q", mode)
+	}
+}
+
+func renderProxyURL(proxyURL string, cluster *Cluster) (*url.URL, error) {
+	if proxyURL == "" {
+		return nil, fmt.Errorf("%s mode requires a proxy URL", HTTPConnect)
+	}
+
+	tmpl, err := template.New("proxy").Option("missingkey=error").Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy URL template")
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, cluster); err != nil {
+		return nil, errors.Wrap(err, "invalid proxy URL template")
+	}
+
+	u, err := url.Parse(buf.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy URL")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: must be http(s)://host[:port]", u.Redacted())
+	}
+	return u, nil
+}
+
+type direct struct{}
+
+func (direct) Configure(_ *rest.Config) {}
+
+func (direct) Endpoint() string { return "" }
+
+type httpConnect struct {
+	proxyURL *url.URL
+
+	// dialer, if set, establishes tunnels in place of the managed cluster transport
+	dialer *connectDialer
+}
+
+// Configure overrides any proxy set in managed cluster kubeconfig
+func (t *httpConnect) Configure(cfg *rest.Config) {
+	if t.dialer == nil {
+		cfg.Proxy = http.ProxyURL(t.proxyURL)
+		return
+	}
+
+	cfg.Dial = t.dialer.DialContext
+	// Connections are already tunneled. Proxy from environment must not be used on top.
+	cfg.Proxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+}
+
+func (t *httpConnect) Endpoint() string {
+	return t.proxyURL.Redacted()
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/client-go/rest"
+
+	"github.com/projectsveltos/drift-detection-manager/pkg/transport"
+)
+
+var _ = Describe("Transport", func() {
+	cluster := &transport.Cluster{Namespace: "tenant", Name: "edge-1", Type: "Sveltos"}
+
+	It("direct leaves rest config untouched", func() {
+		t, err := transport.New(transport.Direct, "", nil, cluster)
+		Expect(err).To(BeNil())
+		Expect(t.Endpoint()).To(BeEmpty())
+
+		cfg := &rest.Config{Host: "https://10.0.0.1:6443"}
+		t.Configure(cfg)
+		Expect(cfg.Proxy).To(BeNil())
+
+		_, err = transport.New(transport.Direct, "http://tunnel:8090", nil, cluster)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("http-connect tunnels connections through the proxy rendered for cluster", func() {
+		t, err := transport.New(transport.HTTPConnect, "http://tunnel-{{.Name}}.{{.Namespace}}.svc:8090", nil, cluster)
+		Expect(err).To(BeNil())
+		Expect(t.Endpoint()).To(Equal("http://tunnel-edge-1.tenant.svc:8090"))
+
+		cfg := &rest.Config{Host: "https://10.0.0.1:6443"}
+		t.Configure(cfg)
+		Expect(cfg.Proxy).ToNot(BeNil())
+
+		req, err := http.NewRequest(http.MethodGet, "https://10.0.0.1:6443/api", http.NoBody)
+		Expect(err).To(BeNil())
+		proxy, err := cfg.Proxy(req)
+		Expect(err).To(BeNil())
+		Expect(proxy.String()).To(Equal("http://tunnel-edge-1.tenant.svc:8090"))
+	})
+
+	It("http-connect rejects invalid proxy URLs", func() {
+		for _, proxyURL := range []string{"", "tunnel:8090", "http://{{.Unknown}}", "socks5://tunnel:1080"} {
+			_, err := transport.New(transport.HTTPConnect, proxyURL, nil, cluster)
+			Expect(err).ToNot(BeNil(), proxyURL)
+		}
+	})
+
+	It("http-connect with proxy TLS settings tunnels connections through an https proxy", func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("tunneled"))
+		}))
+		defer backend.Close()
+
+		proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			upstream, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				upstream.Close()
+				return
+			}
+			_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			go func() { _, _ = io.Copy(upstream, conn) }()
+			go func() { _, _ = io.Copy(conn, upstream) }()
+		}))
+		defer proxy.Close()
+
+		caFile := filepath.Join(GinkgoT().TempDir(), "ca.crt")
+		Expect(os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+			Bytes: proxy.Certificate().Raw}), 0600)).To(Succeed())
+
+		t, err := transport.New(transport.HTTPConnect, proxy.URL, &transport.ProxyTLS{CAFile: caFile}, cluster)
+		Expect(err).To(BeNil())
+
+		cfg := &rest.Config{Host: backend.URL}
+		t.Configure(cfg)
+		Expect(cfg.Dial).ToNot(BeNil())
+		req, err := http.NewRequest(http.MethodGet, backend.URL, http.NoBody)
+		Expect(err).To(BeNil())
+		proxyURL, err := cfg.Proxy(req)
+		Expect(err).To(BeNil())
+		Expect(proxyURL).To(BeNil())
+
+		conn, err := cfg.Dial(context.TODO(), "tcp", backend.Listener.Addr().String())
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		Expect(req.Write(conn)).To(Succeed())
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(string(body)).To(ContainSubstring("tunneled"))
+	})
+
+	It("proxy TLS settings are validated", func() {
+		caFile := filepath.Join(GinkgoT().TempDir(), "ca.crt")
+		Expect(os.WriteFile(caFile, []byte("not a certificate"), 0600)).To(Succeed())
+
+		for _, proxyTLS := range []*transport.ProxyTLS{{CAFile: caFile}, {CertFile: "tls.crt"},
+			{CAFile: filepath.Join(GinkgoT().TempDir(), "missing.crt")}} {
+
+			_, err := transport.New(transport.HTTPConnect, "https://konnectivity:8131", proxyTLS, cluster)
+			Expect(err).ToNot(BeNil())
+		}
+
+		_, err := transport.New(transport.HTTPConnect, "http://konnectivity:8131", &transport.ProxyTLS{KeyFile: "tls.key"}, cluster)
+		Expect(err).ToNot(BeNil())
+
+		_, err = transport.New(transport.Direct, "", &transport.ProxyTLS{CAFile: caFile}, cluster)
+		Expect(err).ToNot(BeNil())
+	})
+})
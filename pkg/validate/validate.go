@@ -0,0 +1,342 @@
+/*
+Copyright 2024. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package validate implements the validate subcommand, which checks ResourceSummary manifests
+// without a cluster, the way drift-detection-manager would process them. It is meant to run in
+// CI of GitOps repositories:
+//
+//	drift-detection-manager validate --excluded-namespaces=kube-system ./clusters
+//
+// Files (or directories, walked recursively for .yaml, .yml and .json files) are read from
+// arguments, or from stdin when argument is "-". Documents which are not ResourceSummaries are
+// ignored. Command fails if any error is found. Warnings (for instance resources which would
+// not be tracked) are only reported.
+package validate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/api/validation/path"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+// Name is the name of the subcommand
+const Name = "validate"
+
+const stdin = "-"
+
+// Severity is the severity of an Issue
+type Severity string
+
+const (
+	// Error means ResourceSummary would be rejected or its resources could not be tracked
+	Error = Severity("error")
+
+	// Warning means ResourceSummary is valid but drift-detection-manager would ignore part of it
+	Warning = Severity("warning")
+)
+
+// Issue is a problem found in a ResourceSummary
+type Issue struct {
+	Severity Severity
+
+	// Field is the path of the offending field (e.g. spec.resources[0].version)
+	Field string
+
+	Message string
+}
+
+type options struct {
+	excludedNamespaces []string
+	includedNamespaces []string
+	deniedKinds        []string
+}
+
+// Run parses args, validates the ResourceSummaries found in the listed files and writes
+// the issues found to out
+func Run(_ context.Context, args []string, out io.Writer) error {
+	flags := pflag.NewFlagSet(Name, pflag.ContinueOnError)
+
+	o := &options{}
+	flags.StringSliceVar(&o.excludedNamespaces, "excluded-namespaces", []string{},
+		"Same as drift-detection-manager --excluded-namespaces. Resources in those namespaces are reported as not tracked.")
+	flags.StringSliceVar(&o.includedNamespaces, "included-namespaces", []string{},
+		"Same as drift-detection-manager --included-namespaces. Resources outside those namespaces are reported as not tracked.")
+	flags.StringSliceVar(&o.deniedKinds, "denied-kinds", []string{},
+		"Same as drift-detection-manager --denied-kinds. Resources of those kinds are reported as not tracked.")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: %s [--excluded-namespaces NAMESPACES] [--included-namespaces NAMESPACES] FILE|DIR|- ...",
+			Name)
+	}
+
+	driftdetection.SetExcludedNamespaces(o.excludedNamespaces)
+	driftdetection.SetIncludedNamespaces(o.includedNamespaces)
+	deniedKinds := make([]schema.GroupKind, len(o.deniedKinds))
+	for i := range o.deniedKinds {
+		deniedKinds[i] = schema.ParseGroupKind(o.deniedKinds[i])
+	}
+	driftdetection.SetDeniedKinds(deniedKinds)
+
+	errorCount, warningCount := 0, 0
+	for _, arg := range flags.Args() {
+		err := forEachFile(arg, func(source string, r io.Reader) error {
+			return validateStream(source, r, func(resourceSummary string, issue *Issue) {
+				if issue.Severity == Error {
+					errorCount++
+				} else {
+					warningCount++
+				}
+				fmt.Fprintf(out, "%s: %s: ResourceSummary %s: %s: %s\n", source, issue.Severity,
+					resourceSummary, issue.Field, issue.Message)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(out, "%d error(s), %d warning(s)\n", errorCount, warningCount)
+	if errorCount != 0 {
+		return fmt.Errorf("found %d error(s)", errorCount)
+	}
+	return nil
+}
+
+// forEachFile invokes process for stdin (arg is "-"), the file arg or, if arg is a directory,
+// each manifest file in it
+func forEachFile(arg string, process func(source string, r io.Reader) error) error {
+	if arg == stdin {
+		return process("<stdin>", os.Stdin)
+	}
+
+	return filepath.WalkDir(arg, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// Explicitly listed files are always read. In directories only manifests are.
+		if filePath != arg {
+			switch strings.ToLower(filepath.Ext(filePath)) {
+			case ".yaml", ".yml", ".json":
+			default:
+				return nil
+			}
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return errors.Wrap(err, "failed to open file")
+		}
+		defer f.Close()
+		return process(filePath, f)
+	})
+}
+
+// validateStream validates each ResourceSummary in the (possibly multi-document) YAML or JSON
+// stream r, invoking report for each issue found
+func validateStream(source string, r io.Reader, report func(resourceSummary string, issue *Issue)) error {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", source)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		typeMeta := &metav1.TypeMeta{}
+		if err := yaml.Unmarshal(doc, typeMeta); err != nil {
+			report("<unknown>", &Issue{Severity: Error, Field: "<document>", Message: err.Error()})
+			continue
+		}
+		if typeMeta.Kind != libsveltosv1alpha1.ResourceSummaryKind {
+			continue
+		}
+
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{}
+		// Strict, so misspelled fields (silently dropped by the API server) are reported
+		if err := yaml.UnmarshalStrict(doc, resourceSummary); err != nil {
+			report("<unknown>", &Issue{Severity: Error, Field: "<document>", Message: err.Error()})
+			continue
+		}
+
+		name := resourceSummary.Name
+		if resourceSummary.Namespace != "" {
+			name = resourceSummary.Namespace + "/" + name
+		}
+		issues := ValidateResourceSummary(resourceSummary)
+		for i := range issues {
+			report(name, &issues[i])
+		}
+	}
+}
+
+// ValidateResourceSummary returns the issues found in resourceSummary. Excluded and included
+// namespaces (see driftdetection.SetExcludedNamespaces) and denied kinds are honored.
+func ValidateResourceSummary(resourceSummary *libsveltosv1alpha1.ResourceSummary) []Issue {
+	issues := make([]Issue, 0)
+
+	if resourceSummary.Name == "" {
+		issues = append(issues, Issue{Severity: Error, Field: "metadata.name", Message: "name is required"})
+	}
+
+	if resourceSummary.Namespace != "" && driftdetection.IsNamespaceExcluded(resourceSummary.Namespace) {
+		issues = append(issues, Issue{Severity: Warning, Field: "metadata.namespace",
+			Message: "namespace is excluded: ResourceSummary is not processed"})
+	}
+
+	issues = append(issues, validateResources("spec.resources", resourceSummary.Spec.Resources)...)
+
+	for i := range resourceSummary.Spec.ChartResources {
+		issues = append(issues, validateHelmResources(fmt.Sprintf("spec.chartResources[%d]", i),
+			&resourceSummary.Spec.ChartResources[i])...)
+	}
+
+	if len(resourceSummary.Spec.KustomizeResources) != 0 {
+		issues = append(issues, Issue{Severity: Warning, Field: "spec.kustomizeResources",
+			Message: "resources deployed via Kustomize are not tracked for configuration drift"})
+	}
+
+	return issues
+}
+
+func validateHelmResources(field string, helmResources *libsveltosv1alpha1.HelmResources) []Issue {
+	issues := make([]Issue, 0)
+
+	if helmResources.ChartName == "" {
+		issues = append(issues, Issue{Severity: Error, Field: field + ".chartName", Message: "chartName is required"})
+	}
+
+	if helmResources.ReleaseName == "" {
+		issues = append(issues, Issue{Severity: Error, Field: field + ".releaseName", Message: "releaseName is required"})
+	}
+
+	// Namespaced resources with no namespace are tracked in release namespace
+	if helmResources.ReleaseNamespace == "" {
+		issues = append(issues, Issue{Severity: Error, Field: field + ".releaseNamespace",
+			Message: "releaseNamespace is required"})
+	} else {
+		issues = append(issues, validateDNSLabel(field+".releaseNamespace", helmResources.ReleaseNamespace)...)
+	}
+
+	return append(issues, validateResources(field+".group", helmResources.Resources)...)
+}
+
+func validateResources(field string, resources []libsveltosv1alpha1.Resource) []Issue {
+	issues := make([]Issue, 0)
+
+	seen := make(map[libsveltosv1alpha1.Resource]int, len(resources))
+	for i := range resources {
+		resourceField := fmt.Sprintf("%s[%d]", field, i)
+		issues = append(issues, validateResource(resourceField, &resources[i])...)
+
+		if first, ok := seen[resources[i]]; ok {
+			issues = append(issues, Issue{Severity: Warning, Field: resourceField,
+				Message: fmt.Sprintf("duplicate of %s[%d]", field, first)})
+			continue
+		}
+		seen[resources[i]] = i
+	}
+
+	return issues
+}
+
+// validateResource verifies resource identifies a single object: drift-detection-manager
+// watches its GroupVersionKind and fetches it by namespace and name
+func validateResource(field string, resource *libsveltosv1alpha1.Resource) []Issue {
+	issues := make([]Issue, 0)
+
+	if resource.Group != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(resource.Group) {
+			issues = append(issues, Issue{Severity: Error, Field: field + ".group", Message: msg})
+		}
+	}
+
+	if resource.Version == "" {
+		issues = append(issues, Issue{Severity: Error, Field: field + ".version", Message: "version is required"})
+	} else {
+		for _, msg := range validation.IsDNS1035Label(resource.Version) {
+			issues = append(issues, Issue{Severity: Error, Field: field + ".version", Message: msg})
+		}
+	}
+
+	if resource.Kind == "" {
+		issues = append(issues, Issue{Severity: Error, Field: field + ".kind", Message: "kind is required"})
+	} else if strings.ContainsAny(resource.Kind, "./ ") {
+		issues = append(issues, Issue{Severity: Error, Field: field + ".kind",
+			Message: "kind must not contain group or version (set group and version fields instead)"})
+	}
+
+	if resource.Name == "" {
+		issues = append(issues, Issue{Severity: Error, Field: field + ".name", Message: "name is required"})
+	} else {
+		for _, msg := range path.IsValidPathSegmentName(resource.Name) {
+			issues = append(issues, Issue{Severity: Error, Field: field + ".name", Message: msg})
+		}
+	}
+
+	if resource.Namespace != "" {
+		issues = append(issues, validateDNSLabel(field+".namespace", resource.Namespace)...)
+	}
+	if driftdetection.IsNamespaceExcluded(resource.Namespace) {
+		msg := "namespace is excluded: resource is not tracked"
+		if resource.Namespace == "" {
+			msg = "no namespace: if cluster wide, resource is not tracked when included namespaces are set"
+		}
+		issues = append(issues, Issue{Severity: Warning, Field: field + ".namespace", Message: msg})
+	}
+	if driftdetection.IsKindDenied(schema.GroupKind{Group: resource.Group, Kind: resource.Kind}) {
+		issues = append(issues, Issue{Severity: Warning, Field: field + ".kind",
+			Message: "kind is denied: resource is not tracked"})
+	}
+
+	return issues
+}
+
+func validateDNSLabel(field, value string) []Issue {
+	issues := make([]Issue, 0)
+	for _, msg := range validation.IsDNS1123Label(value) {
+		issues = append(issues, Issue{Severity: Error, Field: field, Message: msg})
+	}
+	return issues
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validate_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	driftdetection "github.com/projectsveltos/drift-detection-manager/pkg/drift-detection"
+	"github.com/projectsveltos/drift-detection-manager/pkg/validate"
+	libsveltosv1alpha1 "github.com/projectsveltos/libsveltos/api/v1alpha1"
+)
+
+const manifests = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+---
+apiVersion: lib.projectsveltos.io/v1alpha1
+kind: ResourceSummary
+metadata:
+  name: valid
+  namespace: default
+spec:
+  resources:
+  - group: apps
+    version: v1
+    kind: Deployment
+    name: nginx
+    namespace: default
+---
+apiVersion: lib.projectsveltos.io/v1alpha1
+kind: ResourceSummary
+metadata:
+  name: invalid
+  namespace: default
+spec:
+  resources:
+  - version: v1
+    kind: apps/Deployment
+    name: nginx
+`
+
+var _ = Describe("Validate", func() {
+	It("ValidateResourceSummary reports invalid GroupVersionKinds", func() {
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{
+			ObjectMeta: metav1.ObjectMeta{Name: "rs", Namespace: "default"},
+			Spec: libsveltosv1alpha1.ResourceSummarySpec{
+				Resources: []libsveltosv1alpha1.Resource{
+					{Group: "apps", Version: "v1", Kind: "Deployment", Name: "nginx", Namespace: "default"},
+					{Group: "apps/v1", Version: "", Kind: "Deployment", Name: "nginx", Namespace: "default"},
+				},
+			},
+		}
+
+		issues := validate.ValidateResourceSummary(resourceSummary)
+		fields := make([]string, len(issues))
+		for i := range issues {
+			Expect(issues[i].Severity).To(Equal(validate.Error))
+			fields[i] = issues[i].Field
+		}
+		Expect(fields).To(ConsistOf("spec.resources[1].group", "spec.resources[1].version"))
+	})
+
+	It("ValidateResourceSummary warns about resources in excluded namespaces", func() {
+		driftdetection.SetExcludedNamespaces([]string{"kube-system"})
+		defer driftdetection.SetExcludedNamespaces(nil)
+
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{
+			ObjectMeta: metav1.ObjectMeta{Name: "rs", Namespace: "default"},
+			Spec: libsveltosv1alpha1.ResourceSummarySpec{
+				ChartResources: []libsveltosv1alpha1.HelmResources{
+					{
+						ChartName: "coredns", ReleaseName: "coredns", ReleaseNamespace: "kube-system",
+						Resources: []libsveltosv1alpha1.Resource{
+							{Version: "v1", Kind: "ConfigMap", Name: "coredns", Namespace: "kube-system"},
+						},
+					},
+				},
+			},
+		}
+
+		issues := validate.ValidateResourceSummary(resourceSummary)
+		Expect(issues).To(HaveLen(1))
+		Expect(issues[0].Severity).To(Equal(validate.Warning))
+		Expect(issues[0].Field).To(Equal("spec.chartResources[0].group[0].namespace"))
+	})
+
+	It("ValidateResourceSummary warns about resources of denied kinds", func() {
+		driftdetection.SetDeniedKinds([]schema.GroupKind{{Group: "coordination.k8s.io", Kind: "Lease"}})
+		defer driftdetection.SetDeniedKinds(nil)
+
+		resourceSummary := &libsveltosv1alpha1.ResourceSummary{
+			ObjectMeta: metav1.ObjectMeta{Name: "rs", Namespace: "default"},
+			Spec: libsveltosv1alpha1.ResourceSummarySpec{
+				Resources: []libsveltosv1alpha1.Resource{
+					{Version: "v1", Kind: "ConfigMap", Name: "cm", Namespace: "default"},
+					{Group: "coordination.k8s.io", Version: "v1", Kind: "Lease", Name: "lease", Namespace: "default"},
+				},
+			},
+		}
+
+		issues := validate.ValidateResourceSummary(resourceSummary)
+		Expect(issues).To(HaveLen(1))
+		Expect(issues[0].Severity).To(Equal(validate.Warning))
+		Expect(issues[0].Field).To(Equal("spec.resources[1].kind"))
+	})
+
+	It("Run validates ResourceSummaries in manifest files", func() {
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "manifests.yaml"), []byte(manifests), 0600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "README.md"), []byte("kind: ResourceSummary"), 0600)).To(Succeed())
+
+		var out bytes.Buffer
+		err := validate.Run(context.TODO(), []string{dir}, &out)
+		Expect(err).ToNot(BeNil())
+		Expect(out.String()).To(ContainSubstring("ResourceSummary default/invalid: spec.resources[0].kind"))
+		Expect(out.String()).ToNot(ContainSubstring("default/valid:"))
+		Expect(out.String()).To(ContainSubstring("1 error(s), 0 warning(s)"))
+	})
+})